@@ -0,0 +1,413 @@
+// Package acme obtains a keyserver's TLS certificate from an ACME CA, such as
+// Let's Encrypt, and renews it before it expires, answering HTTP-01 or DNS-01
+// challenges.
+package acme
+
+import (
+	"context"
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/cloudflare/cfssl/helpers"
+	"github.com/cloudflare/cfssl/log"
+	"golang.org/x/crypto/acme"
+)
+
+const (
+	// ChallengeHTTP01 proves control of the domains by serving a token from
+	// the Manager's HTTPHandler on port 80.
+	ChallengeHTTP01 = "http-01"
+	// ChallengeDNS01 proves control of the domains by publishing TXT records
+	// with a DNSProvider.
+	ChallengeDNS01 = "dns-01"
+
+	// DefaultRenewBefore is how long before the certificate expires it is
+	// renewed if Config.RenewBefore is not set.
+	DefaultRenewBefore = 30 * 24 * time.Hour
+
+	// checkInterval is how often the Manager checks whether the certificate
+	// is due for renewal, and retries failed renewals.
+	checkInterval = time.Hour
+)
+
+// A DNSProvider publishes the TXT records of DNS-01 challenges.
+type DNSProvider interface {
+	// Present creates a TXT record with value at name, such as
+	// _acme-challenge.example.com, and returns once it is visible to the CA.
+	Present(ctx context.Context, name, value string) error
+	// CleanUp removes the record created by Present.
+	CleanUp(ctx context.Context, name, value string) error
+}
+
+// Config configures a Manager.
+type Config struct {
+	// DirectoryURL is the ACME directory of the CA. It defaults to Let's
+	// Encrypt.
+	DirectoryURL string
+	// Email is the contact address of the ACME account, if any.
+	Email string
+	// Domains are the names the certificate is issued for. The first one is
+	// its common name.
+	Domains []string
+	// CertFile and KeyFile are where the certificate chain and its key are
+	// stored, so that they are reused after a restart until they are due for
+	// renewal.
+	CertFile, KeyFile string
+	// AccountKeyFile holds the key of the ACME account. It is created if it
+	// doesn't exist.
+	AccountKeyFile string
+	// Challenge is ChallengeHTTP01 or ChallengeDNS01.
+	Challenge string
+	// DNS publishes the records of DNS-01 challenges.
+	DNS DNSProvider
+	// RenewBefore is how long before it expires the certificate is renewed.
+	RenewBefore time.Duration
+}
+
+// A Manager holds the current certificate and renews it in the background.
+type Manager struct {
+	cfg    Config
+	client *acme.Client
+
+	mtx  sync.RWMutex
+	cert *tls.Certificate
+
+	// tokens maps the paths of pending HTTP-01 challenges to their responses.
+	tokensMtx sync.Mutex
+	tokens    map[string]string
+
+	cancel context.CancelFunc
+	done   chan struct{}
+}
+
+// NewManager creates a Manager with cfg, loading the certificate and the
+// account key from their files if they exist. It does not contact the CA: if
+// NeedsRenewal reports true, the caller must call Renew before the
+// certificate is used.
+func NewManager(cfg Config) (*Manager, error) {
+	if len(cfg.Domains) == 0 {
+		return nil, errors.New("acme: no domains")
+	}
+	if cfg.CertFile == "" || cfg.KeyFile == "" || cfg.AccountKeyFile == "" {
+		return nil, errors.New("acme: certificate, key and account key files must be set")
+	}
+	switch cfg.Challenge {
+	case ChallengeHTTP01:
+	case ChallengeDNS01:
+		if cfg.DNS == nil {
+			return nil, errors.New("acme: dns-01 challenges require a DNS provider")
+		}
+	default:
+		return nil, fmt.Errorf("acme: unsupported challenge %q", cfg.Challenge)
+	}
+	if cfg.DirectoryURL == "" {
+		cfg.DirectoryURL = acme.LetsEncryptURL
+	}
+	if cfg.RenewBefore <= 0 {
+		cfg.RenewBefore = DefaultRenewBefore
+	}
+
+	key, err := loadAccountKey(cfg.AccountKeyFile)
+	if err != nil {
+		return nil, err
+	}
+	m := &Manager{
+		cfg:    cfg,
+		client: &acme.Client{Key: key, DirectoryURL: cfg.DirectoryURL},
+		tokens: make(map[string]string),
+		cancel: func() {},
+	}
+	if cert, err := tls.LoadX509KeyPair(cfg.CertFile, cfg.KeyFile); err == nil {
+		if cert.Leaf, err = x509.ParseCertificate(cert.Certificate[0]); err == nil {
+			m.cert = &cert
+		}
+	} else if !os.IsNotExist(err) {
+		log.Warningf("acme: ignoring existing certificate: %v", err)
+	}
+	return m, nil
+}
+
+// loadAccountKey reads the account key from file, or generates and saves one
+// if it doesn't exist.
+func loadAccountKey(file string) (crypto.Signer, error) {
+	in, err := ioutil.ReadFile(file)
+	if err == nil {
+		return helpers.ParsePrivateKeyPEM(in)
+	}
+	if !os.IsNotExist(err) {
+		return nil, err
+	}
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		return nil, err
+	}
+	der, err := x509.MarshalECPrivateKey(key)
+	if err != nil {
+		return nil, err
+	}
+	if err := writeFile(file, pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: der}), 0600); err != nil {
+		return nil, err
+	}
+	log.Infof("acme: created account key %s", file)
+	return key, nil
+}
+
+// Certificate returns the current certificate, or nil if there is none.
+func (m *Manager) Certificate() *tls.Certificate {
+	m.mtx.RLock()
+	defer m.mtx.RUnlock()
+	return m.cert
+}
+
+// NeedsRenewal reports whether there is no certificate, or whether it is for
+// other domains or expires within RenewBefore.
+func (m *Manager) NeedsRenewal() bool {
+	cert := m.Certificate()
+	if cert == nil || time.Until(cert.Leaf.NotAfter) < m.cfg.RenewBefore {
+		return true
+	}
+	for _, domain := range m.cfg.Domains {
+		if cert.Leaf.VerifyHostname(domain) != nil {
+			return true
+		}
+	}
+	return false
+}
+
+// ConfigureServer sets up config, a keyless server TLS configuration, to
+// present the current certificate.
+func (m *Manager) ConfigureServer(config *tls.Config) {
+	config.Certificates = nil
+	config.GetCertificate = func(*tls.ClientHelloInfo) (*tls.Certificate, error) {
+		if cert := m.Certificate(); cert != nil {
+			return cert, nil
+		}
+		return nil, errors.New("acme: no certificate yet")
+	}
+}
+
+// HTTPHandler answers HTTP-01 challenges, and passes other requests to
+// fallback, or answers them with 404 if fallback is nil. It must be served on
+// port 80 of the domains.
+func (m *Manager) HTTPHandler(fallback http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if strings.HasPrefix(r.URL.Path, "/.well-known/acme-challenge/") {
+			m.tokensMtx.Lock()
+			resp, ok := m.tokens[r.URL.Path]
+			m.tokensMtx.Unlock()
+			if ok {
+				w.Header().Set("Content-Type", "text/plain")
+				w.Write([]byte(resp))
+				return
+			}
+		}
+		if fallback == nil {
+			http.NotFound(w, r)
+			return
+		}
+		fallback.ServeHTTP(w, r)
+	})
+}
+
+// Renew obtains a new certificate for the domains, saves it, and makes it the
+// current certificate.
+func (m *Manager) Renew(ctx context.Context) error {
+	if _, err := m.client.Register(ctx, m.account(), acme.AcceptTOS); err != nil && err != acme.ErrAccountAlreadyExists {
+		return fmt.Errorf("acme: registering account: %v", err)
+	}
+
+	order, err := m.client.AuthorizeOrder(ctx, acme.DomainIDs(m.cfg.Domains...))
+	if err != nil {
+		return fmt.Errorf("acme: creating order: %v", err)
+	}
+	for _, url := range order.AuthzURLs {
+		if err := m.authorize(ctx, url); err != nil {
+			return err
+		}
+	}
+	if order, err = m.client.WaitOrder(ctx, order.URI); err != nil {
+		return fmt.Errorf("acme: waiting for order: %v", err)
+	}
+
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		return err
+	}
+	csr, err := x509.CreateCertificateRequest(rand.Reader, &x509.CertificateRequest{
+		Subject:  pkix.Name{CommonName: m.cfg.Domains[0]},
+		DNSNames: m.cfg.Domains,
+	}, key)
+	if err != nil {
+		return err
+	}
+	chain, _, err := m.client.CreateOrderCert(ctx, order.FinalizeURL, csr, true)
+	if err != nil {
+		return fmt.Errorf("acme: finalizing order: %v", err)
+	}
+	leaf, err := x509.ParseCertificate(chain[0])
+	if err != nil {
+		return fmt.Errorf("acme: invalid certificate: %v", err)
+	}
+
+	var certPEM []byte
+	for _, der := range chain {
+		certPEM = append(certPEM, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der})...)
+	}
+	keyDER, err := x509.MarshalECPrivateKey(key)
+	if err != nil {
+		return err
+	}
+	// Write the key first, so that a crash leaves at worst a new key with the
+	// old certificate, which LoadX509KeyPair rejects, rather than a new
+	// certificate nobody has the key of.
+	if err := writeFile(m.cfg.KeyFile, pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: keyDER}), 0600); err != nil {
+		return err
+	}
+	if err := writeFile(m.cfg.CertFile, certPEM, 0644); err != nil {
+		return err
+	}
+
+	m.mtx.Lock()
+	m.cert = &tls.Certificate{Certificate: chain, PrivateKey: key, Leaf: leaf}
+	m.mtx.Unlock()
+	log.Infof("acme: obtained certificate for %s expiring %s", strings.Join(m.cfg.Domains, ", "), leaf.NotAfter.Format(time.RFC3339))
+	return nil
+}
+
+func (m *Manager) account() *acme.Account {
+	acct := &acme.Account{}
+	if m.cfg.Email != "" {
+		acct.Contact = []string{"mailto:" + m.cfg.Email}
+	}
+	return acct
+}
+
+// authorize completes the authorization at url, if it is pending, with the
+// configured challenge.
+func (m *Manager) authorize(ctx context.Context, url string) error {
+	authz, err := m.client.GetAuthorization(ctx, url)
+	if err != nil {
+		return fmt.Errorf("acme: fetching authorization: %v", err)
+	}
+	if authz.Status != acme.StatusPending {
+		return nil
+	}
+	var chal *acme.Challenge
+	for _, c := range authz.Challenges {
+		if c.Type == m.cfg.Challenge {
+			chal = c
+			break
+		}
+	}
+	if chal == nil {
+		return fmt.Errorf("acme: no %s challenge offered for %s", m.cfg.Challenge, authz.Identifier.Value)
+	}
+
+	switch m.cfg.Challenge {
+	case ChallengeHTTP01:
+		resp, err := m.client.HTTP01ChallengeResponse(chal.Token)
+		if err != nil {
+			return err
+		}
+		path := m.client.HTTP01ChallengePath(chal.Token)
+		m.tokensMtx.Lock()
+		m.tokens[path] = resp
+		m.tokensMtx.Unlock()
+		defer func() {
+			m.tokensMtx.Lock()
+			delete(m.tokens, path)
+			m.tokensMtx.Unlock()
+		}()
+	case ChallengeDNS01:
+		value, err := m.client.DNS01ChallengeRecord(chal.Token)
+		if err != nil {
+			return err
+		}
+		name := "_acme-challenge." + strings.TrimPrefix(authz.Identifier.Value, "*.")
+		if err := m.cfg.DNS.Present(ctx, name, value); err != nil {
+			return fmt.Errorf("acme: publishing %s: %v", name, err)
+		}
+		defer func() {
+			if err := m.cfg.DNS.CleanUp(ctx, name, value); err != nil {
+				log.Warningf("acme: removing %s: %v", name, err)
+			}
+		}()
+	}
+
+	if _, err := m.client.Accept(ctx, chal); err != nil {
+		return fmt.Errorf("acme: accepting challenge for %s: %v", authz.Identifier.Value, err)
+	}
+	if _, err := m.client.WaitAuthorization(ctx, authz.URI); err != nil {
+		return fmt.Errorf("acme: authorizing %s: %v", authz.Identifier.Value, err)
+	}
+	return nil
+}
+
+// Start renews the certificate in the background whenever it is due, until
+// Close is called. Failed renewals are logged and retried.
+func (m *Manager) Start() {
+	ctx, cancel := context.WithCancel(context.Background())
+	m.cancel = cancel
+	m.done = make(chan struct{})
+	go func() {
+		defer close(m.done)
+		ticker := time.NewTicker(checkInterval)
+		defer ticker.Stop()
+		for {
+			if m.NeedsRenewal() {
+				if err := m.Renew(ctx); err != nil && ctx.Err() == nil {
+					log.Errorf("acme: renewing certificate: %v", err)
+				}
+			}
+			select {
+			case <-ticker.C:
+			case <-ctx.Done():
+				return
+			}
+		}
+	}()
+}
+
+// Close stops renewing the certificate.
+func (m *Manager) Close() {
+	m.cancel()
+	if m.done != nil {
+		<-m.done
+	}
+}
+
+// writeFile atomically replaces file with data.
+func writeFile(file string, data []byte, perm os.FileMode) error {
+	tmp, err := ioutil.TempFile(filepath.Dir(file), filepath.Base(file)+".tmp")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name())
+	if _, err := tmp.Write(data); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := tmp.Chmod(perm); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := tmp.Close(); err != nil {
+		return err
+	}
+	return os.Rename(tmp.Name(), file)
+}
@@ -0,0 +1,195 @@
+package acme
+
+import (
+	"context"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"io/ioutil"
+	"math/big"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+	"time"
+)
+
+// writeCert writes a self-signed certificate for domain, valid for lifetime,
+// and its key to dir, and returns a Config using them.
+func writeCert(t *testing.T, dir, domain string, lifetime time.Duration) Config {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	tmpl := &x509.Certificate{
+		SerialNumber: big.NewInt(1),
+		Subject:      pkix.Name{CommonName: domain},
+		DNSNames:     []string{domain},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(lifetime),
+	}
+	der, err := x509.CreateCertificate(rand.Reader, tmpl, tmpl, &key.PublicKey, key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	keyDER, err := x509.MarshalECPrivateKey(key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	cfg := Config{
+		Domains:        []string{domain},
+		CertFile:       filepath.Join(dir, "cert.pem"),
+		KeyFile:        filepath.Join(dir, "key.pem"),
+		AccountKeyFile: filepath.Join(dir, "account.pem"),
+		Challenge:      ChallengeHTTP01,
+	}
+	if err := ioutil.WriteFile(cfg.CertFile, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der}), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if err := ioutil.WriteFile(cfg.KeyFile, pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: keyDER}), 0600); err != nil {
+		t.Fatal(err)
+	}
+	return cfg
+}
+
+func tempDir(t *testing.T) string {
+	dir, err := ioutil.TempDir("", "acme")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { os.RemoveAll(dir) })
+	return dir
+}
+
+func TestNewManager(t *testing.T) {
+	dir := tempDir(t)
+	cfg := Config{
+		Domains:        []string{"keyless.example.com"},
+		CertFile:       filepath.Join(dir, "cert.pem"),
+		KeyFile:        filepath.Join(dir, "key.pem"),
+		AccountKeyFile: filepath.Join(dir, "account.pem"),
+		Challenge:      ChallengeDNS01,
+	}
+	if _, err := NewManager(cfg); err == nil {
+		t.Fatal("dns-01 challenges without a provider should be rejected")
+	}
+	cfg.Challenge = "tls-alpn-01"
+	if _, err := NewManager(cfg); err == nil {
+		t.Fatal("unsupported challenges should be rejected")
+	}
+
+	// The account key is created once and then reused.
+	cfg.Challenge = ChallengeHTTP01
+	m, err := NewManager(cfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !m.NeedsRenewal() || m.Certificate() != nil {
+		t.Fatal("a manager without a certificate should need renewal")
+	}
+	m2, err := NewManager(cfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(m.client.Key.Public(), m2.client.Key.Public()) {
+		t.Fatal("account key was not reused")
+	}
+}
+
+func TestNeedsRenewal(t *testing.T) {
+	dir := tempDir(t)
+	cfg := writeCert(t, dir, "keyless.example.com", 90*24*time.Hour)
+	m, err := NewManager(cfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if m.NeedsRenewal() {
+		t.Fatal("a fresh certificate should not need renewal")
+	}
+
+	cfg.RenewBefore = 100 * 24 * time.Hour
+	if m, err = NewManager(cfg); err != nil {
+		t.Fatal(err)
+	}
+	if !m.NeedsRenewal() {
+		t.Fatal("a certificate expiring within RenewBefore should need renewal")
+	}
+
+	cfg.RenewBefore = 0
+	cfg.Domains = append(cfg.Domains, "other.example.com")
+	if m, err = NewManager(cfg); err != nil {
+		t.Fatal(err)
+	}
+	if !m.NeedsRenewal() {
+		t.Fatal("a certificate missing a domain should need renewal")
+	}
+}
+
+func TestHTTPHandler(t *testing.T) {
+	dir := tempDir(t)
+	m, err := NewManager(writeCert(t, dir, "keyless.example.com", time.Hour))
+	if err != nil {
+		t.Fatal(err)
+	}
+	m.tokens["/.well-known/acme-challenge/token"] = "token.thumbprint"
+	fallback := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusTeapot)
+	})
+	srv := httptest.NewServer(m.HTTPHandler(fallback))
+	defer srv.Close()
+
+	resp, err := http.Get(srv.URL + "/.well-known/acme-challenge/token")
+	if err != nil {
+		t.Fatal(err)
+	}
+	body, _ := ioutil.ReadAll(resp.Body)
+	resp.Body.Close()
+	if string(body) != "token.thumbprint" {
+		t.Fatalf("got %q for a pending challenge", body)
+	}
+
+	for _, path := range []string{"/.well-known/acme-challenge/other", "/"} {
+		resp, err := http.Get(srv.URL + path)
+		if err != nil {
+			t.Fatal(err)
+		}
+		resp.Body.Close()
+		if resp.StatusCode != http.StatusTeapot {
+			t.Fatalf("%s was not passed to the fallback handler", path)
+		}
+	}
+}
+
+func TestCommandDNSProvider(t *testing.T) {
+	dir := tempDir(t)
+	script := filepath.Join(dir, "dns.sh")
+	log := filepath.Join(dir, "log")
+	if err := ioutil.WriteFile(script, []byte("#!/bin/sh\necho \"$@\" >> "+log+"\n"), 0755); err != nil {
+		t.Fatal(err)
+	}
+	p := CommandDNSProvider{Command: script}
+	ctx := context.Background()
+	if err := p.Present(ctx, "_acme-challenge.example.com", "value"); err != nil {
+		t.Fatal(err)
+	}
+	if err := p.CleanUp(ctx, "_acme-challenge.example.com", "value"); err != nil {
+		t.Fatal(err)
+	}
+	out, err := ioutil.ReadFile(log)
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := "present _acme-challenge.example.com value\ncleanup _acme-challenge.example.com value\n"
+	if string(out) != want {
+		t.Fatalf("got %q", out)
+	}
+
+	if err := (CommandDNSProvider{Command: filepath.Join(dir, "missing")}).Present(ctx, "name", "value"); err == nil {
+		t.Fatal("a failing command should return an error")
+	}
+}
@@ -0,0 +1,37 @@
+package acme
+
+import (
+	"context"
+	"fmt"
+	"os/exec"
+	"strings"
+)
+
+// A CommandDNSProvider publishes DNS-01 records by running a command, such as
+// a script calling the API of the DNS host, as
+//
+//	command present|cleanup <name> <value>
+//
+// Present returns once the command exits successfully, so the command must
+// wait until the record is visible to the CA.
+type CommandDNSProvider struct {
+	Command string
+}
+
+// Present runs the command with "present".
+func (p CommandDNSProvider) Present(ctx context.Context, name, value string) error {
+	return p.run(ctx, "present", name, value)
+}
+
+// CleanUp runs the command with "cleanup".
+func (p CommandDNSProvider) CleanUp(ctx context.Context, name, value string) error {
+	return p.run(ctx, "cleanup", name, value)
+}
+
+func (p CommandDNSProvider) run(ctx context.Context, action, name, value string) error {
+	out, err := exec.CommandContext(ctx, p.Command, action, name, value).CombinedOutput()
+	if err != nil {
+		return fmt.Errorf("%s %s: %v: %s", p.Command, action, err, strings.TrimSpace(string(out)))
+	}
+	return nil
+}
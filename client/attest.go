@@ -0,0 +1,73 @@
+package client
+
+import (
+	"bytes"
+	"context"
+	"crypto"
+	"crypto/rand"
+	"crypto/sha256"
+	"errors"
+	"fmt"
+
+	"github.com/cloudflare/gokeyless/conn"
+	"github.com/cloudflare/gokeyless/protocol"
+)
+
+// An AttestationPolicy describes the attestation a keyserver must provide, in
+// addition to its TLS certificate, before a Client sends it any requests. See
+// protocol.Attestation.
+type AttestationPolicy struct {
+	// Key is the public key which must have signed the attestation.
+	Key crypto.PublicKey
+	// SKIs, if set, lists the keys the server must attest to holding.
+	SKIs []protocol.SKI
+	// BuildHashes, if set, lists the server builds which are accepted.
+	BuildHashes [][]byte
+}
+
+// ErrNotAttested is wrapped by the errors returned when dialing a keyserver
+// which fails the Client's AttestationPolicy.
+var ErrNotAttested = errors.New("keyserver attestation failed")
+
+// verify requests an attestation over cn, whose server authenticated with the
+// DER-encoded certificate cert, and checks it against p.
+func (p *AttestationPolicy) verify(ctx context.Context, cn *conn.Conn, cert []byte) error {
+	nonce := make([]byte, 32)
+	if _, err := rand.Read(nonce); err != nil {
+		return err
+	}
+	a, err := cn.Attest(ctx, nonce)
+	if err != nil {
+		return fmt.Errorf("%w: %v", ErrNotAttested, err)
+	}
+	if err := a.Verify(p.Key); err != nil {
+		return fmt.Errorf("%w: %v", ErrNotAttested, err)
+	}
+	if !bytes.Equal(a.Nonce, nonce) {
+		return fmt.Errorf("%w: nonce mismatch", ErrNotAttested)
+	}
+	if a.CertHash != sha256.Sum256(cert) {
+		return fmt.Errorf("%w: attested certificate differs from the TLS certificate", ErrNotAttested)
+	}
+
+	if len(p.BuildHashes) > 0 {
+		ok := false
+		for _, h := range p.BuildHashes {
+			ok = ok || bytes.Equal(h, a.BuildHash)
+		}
+		if !ok {
+			return fmt.Errorf("%w: unexpected build %x", ErrNotAttested, a.BuildHash)
+		}
+	}
+
+	held := make(map[protocol.SKI]bool, len(a.SKIs))
+	for _, ski := range a.SKIs {
+		held[ski] = true
+	}
+	for _, ski := range p.SKIs {
+		if !held[ski] {
+			return fmt.Errorf("%w: key %v not attested", ErrNotAttested, ski)
+		}
+	}
+	return nil
+}
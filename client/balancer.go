@@ -0,0 +1,332 @@
+package client
+
+import (
+	"context"
+	"hash/fnv"
+	"math/rand"
+	"net"
+	"sort"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// A Balancer decides the order in which the members of a Group are dialed.
+// Group.Dial tries each returned Remote in turn until one succeeds.
+type Balancer interface {
+	// Order returns the remotes in the order they should be tried. It must not
+	// modify remotes, and may return fewer remotes than it was given.
+	Order(c *Client, remotes []Remote) []Remote
+}
+
+// A ContextBalancer is a Balancer which can order remotes for the operation
+// dialing them, e.g. by the affinity key of its context. Groups and tiers call
+// OrderContext instead of Order.
+type ContextBalancer interface {
+	Balancer
+	OrderContext(ctx context.Context, c *Client, remotes []Remote) []Remote
+}
+
+// order returns remotes in the order chosen by c.Balancer, which must be set,
+// for the operation of ctx.
+func (c *Client) order(ctx context.Context, remotes []Remote) []Remote {
+	if b, ok := c.Balancer.(ContextBalancer); ok {
+		return b.OrderContext(ctx, c, remotes)
+	}
+	return c.Balancer.Order(c, remotes)
+}
+
+// ServerStats is a snapshot of the statistics a Client has collected about a
+// single keyserver.
+type ServerStats struct {
+	// Outstanding is the number of requests currently in flight.
+	Outstanding int64
+	// Requests is the total number of completed requests.
+	Requests uint64
+	// Failures is the total number of failed requests and dials.
+	Failures uint64
+	// Latency is an exponentially weighted moving average of request latency.
+	// It is zero if no request has completed successfully.
+	Latency time.Duration
+	// ConsecutiveFailures is the number of failures since the last success.
+	ConsecutiveFailures int
+	// CircuitOpen is set while the Client's CircuitBreaker keeps requests
+	// from being sent to the server.
+	CircuitOpen bool
+}
+
+// serverStats collects statistics for one keyserver address.
+type serverStats struct {
+	mtx     sync.Mutex
+	stats   ServerStats
+	circuit circuit
+	// dialFailure is when the server last failed to dial, or zero if it was
+	// dialed successfully since.
+	dialFailure time.Time
+}
+
+// ewmaWeight is the weight given to each new latency sample.
+const ewmaWeight = 0.3
+
+func (s *serverStats) begin() {
+	s.mtx.Lock()
+	s.stats.Outstanding++
+	s.mtx.Unlock()
+}
+
+func (s *serverStats) end(latency time.Duration, err error) {
+	s.mtx.Lock()
+	defer s.mtx.Unlock()
+	s.stats.Outstanding--
+	s.stats.Requests++
+	probe := !s.circuit.probeAt.IsZero()
+	s.circuit.record(err != nil)
+	if err != nil {
+		s.stats.Failures++
+		return
+	}
+	if s.stats.Latency == 0 || probe {
+		// A successful probe starts a fresh average, so that the slow period
+		// which opened the circuit doesn't open it again.
+		s.stats.Latency = latency
+		return
+	}
+	s.stats.Latency = time.Duration(ewmaWeight*float64(latency) + (1-ewmaWeight)*float64(s.stats.Latency))
+}
+
+// fail records a failed dial.
+func (s *serverStats) fail() {
+	s.mtx.Lock()
+	s.stats.Failures++
+	s.circuit.record(true)
+	s.dialFailure = time.Now()
+	s.mtx.Unlock()
+}
+
+// dialed records a successful dial.
+func (s *serverStats) dialed() {
+	s.mtx.Lock()
+	s.dialFailure = time.Time{}
+	s.mtx.Unlock()
+}
+
+// unreachable reports whether the server failed to dial within unreachableFor
+// of now, and hasn't been dialed successfully since.
+func (s *serverStats) unreachable(now time.Time) bool {
+	s.mtx.Lock()
+	defer s.mtx.Unlock()
+	return !s.dialFailure.IsZero() && now.Sub(s.dialFailure) < unreachableFor
+}
+
+func (s *serverStats) snapshot() ServerStats {
+	s.mtx.Lock()
+	defer s.mtx.Unlock()
+	stats := s.stats
+	stats.ConsecutiveFailures = s.circuit.consecutiveFailures
+	stats.CircuitOpen = s.circuit.open
+	return stats
+}
+
+// serverStatsFor returns the statistics collector for addr, creating it if
+// necessary.
+func (c *Client) serverStatsFor(addr string) *serverStats {
+	v, _ := c.stats.LoadOrStore(addr, &serverStats{})
+	return v.(*serverStats)
+}
+
+// ServerStats returns the statistics collected for the keyserver at addr.
+func (c *Client) ServerStats(addr string) ServerStats {
+	v, ok := c.stats.Load(addr)
+	if !ok {
+		return ServerStats{}
+	}
+	return v.(*serverStats).snapshot()
+}
+
+// remoteAddr returns the address of r, or "" if r is not an individual server.
+func remoteAddr(r Remote) string {
+	if a, ok := r.(net.Addr); ok {
+		return a.String()
+	}
+	return ""
+}
+
+// RandomBalancer tries remotes in a uniformly random order.
+type RandomBalancer struct{}
+
+// Order implements Balancer.
+func (RandomBalancer) Order(c *Client, remotes []Remote) []Remote {
+	out := make([]Remote, len(remotes))
+	for i, j := range rand.Perm(len(remotes)) {
+		out[i] = remotes[j]
+	}
+	return out
+}
+
+// RoundRobinBalancer rotates the starting remote on every call.
+type RoundRobinBalancer struct {
+	next uint32
+}
+
+// Order implements Balancer.
+func (b *RoundRobinBalancer) Order(c *Client, remotes []Remote) []Remote {
+	if len(remotes) == 0 {
+		return nil
+	}
+	start := int((atomic.AddUint32(&b.next, 1) - 1) % uint32(len(remotes)))
+	out := make([]Remote, 0, len(remotes))
+	out = append(out, remotes[start:]...)
+	return append(out, remotes[:start]...)
+}
+
+// LeastOutstandingBalancer prefers the remotes with the fewest requests in
+// flight. Ties are broken randomly.
+type LeastOutstandingBalancer struct{}
+
+// Order implements Balancer.
+func (LeastOutstandingBalancer) Order(c *Client, remotes []Remote) []Remote {
+	out := RandomBalancer{}.Order(c, remotes)
+	sort.SliceStable(out, func(i, j int) bool {
+		return c.ServerStats(remoteAddr(out[i])).Outstanding < c.ServerStats(remoteAddr(out[j])).Outstanding
+	})
+	return out
+}
+
+// LatencyBalancer prefers the remotes with the lowest EWMA request latency.
+// Remotes which have not been measured yet are tried first so that every
+// server is eventually sampled.
+type LatencyBalancer struct{}
+
+// Order implements Balancer.
+func (LatencyBalancer) Order(c *Client, remotes []Remote) []Remote {
+	out := RandomBalancer{}.Order(c, remotes)
+	sort.SliceStable(out, func(i, j int) bool {
+		return c.ServerStats(remoteAddr(out[i])).Latency < c.ServerStats(remoteAddr(out[j])).Latency
+	})
+	return out
+}
+
+// LocalityBalancer prefers remotes whose IP falls within one of the Local
+// networks. Unix socket remotes are always considered local. Within each tier,
+// remotes are ordered by Fallback (RandomBalancer if nil).
+type LocalityBalancer struct {
+	Local    []*net.IPNet
+	Fallback Balancer
+}
+
+// Order implements Balancer.
+func (b *LocalityBalancer) Order(c *Client, remotes []Remote) []Remote {
+	var local, remote []Remote
+	for _, r := range remotes {
+		if b.isLocal(r) {
+			local = append(local, r)
+		} else {
+			remote = append(remote, r)
+		}
+	}
+
+	fallback := b.Fallback
+	if fallback == nil {
+		fallback = RandomBalancer{}
+	}
+	return append(fallback.Order(c, local), fallback.Order(c, remote)...)
+}
+
+func (b *LocalityBalancer) isLocal(r Remote) bool {
+	var ip net.IP
+	switch a := r.(type) {
+	case *singleRemote:
+		switch addr := a.Addr.(type) {
+		case *net.UnixAddr:
+			return true
+		case *net.TCPAddr:
+			ip = addr.IP
+		}
+	}
+	if ip == nil {
+		return false
+	}
+	for _, n := range b.Local {
+		if n.Contains(ip) {
+			return true
+		}
+	}
+	return false
+}
+
+type affinityKey struct{}
+
+// WithAffinity returns a copy of ctx carrying key, such as the ID of a TLS
+// session or connection, so that an AffinityBalancer sends the operations
+// executed with it to the same keyserver while that server is healthy.
+func WithAffinity(ctx context.Context, key string) context.Context {
+	return context.WithValue(ctx, affinityKey{}, key)
+}
+
+// AffinityFromContext returns the affinity key set on ctx with WithAffinity,
+// if any.
+func AffinityFromContext(ctx context.Context) (string, bool) {
+	key, ok := ctx.Value(affinityKey{}).(string)
+	return key, ok
+}
+
+// AffinityBalancer orders the remotes of operations with an affinity key, set
+// with WithAffinity, by rendezvous hashing of the key with their addresses, so
+// that operations with the same key are sent to the same keyserver, improving
+// its cache hit rates, e.g. of per-key HSM sessions. Adding or removing a
+// server only moves the keys it gains or loses. Servers which recently failed
+// to dial, or whose circuit is open, are tried last as with other balancers,
+// so keys move to the next server in their order while theirs is unhealthy.
+// Remotes without an address, such as nested groups, come last. Other
+// operations are ordered by Fallback (RandomBalancer if nil).
+type AffinityBalancer struct {
+	Fallback Balancer
+}
+
+// Order implements Balancer, for operations without an affinity key.
+func (b *AffinityBalancer) Order(c *Client, remotes []Remote) []Remote {
+	fallback := b.Fallback
+	if fallback == nil {
+		fallback = RandomBalancer{}
+	}
+	return fallback.Order(c, remotes)
+}
+
+// OrderContext implements ContextBalancer.
+func (b *AffinityBalancer) OrderContext(ctx context.Context, c *Client, remotes []Remote) []Remote {
+	key, ok := AffinityFromContext(ctx)
+	if !ok {
+		return b.Order(c, remotes)
+	}
+	out := make([]Remote, len(remotes))
+	copy(out, remotes)
+	weights := make(map[Remote]uint64, len(out))
+	for _, r := range out {
+		if addr := remoteAddr(r); addr != "" {
+			weights[r] = affinityWeight(key, addr)
+		}
+	}
+	sort.SliceStable(out, func(i, j int) bool {
+		wi, oki := weights[out[i]]
+		wj, okj := weights[out[j]]
+		if oki != okj {
+			return oki
+		}
+		return wi > wj
+	})
+	return out
+}
+
+// affinityWeight returns the rendezvous hashing weight of the server at addr
+// for key.
+func affinityWeight(key, addr string) uint64 {
+	h := fnv.New64a()
+	h.Write([]byte(key))
+	h.Write([]byte{0})
+	h.Write([]byte(addr))
+	// FNV-1a spreads similar inputs poorly, so finalize it as SplitMix64 does.
+	x := h.Sum64()
+	x = (x ^ (x >> 30)) * 0xbf58476d1ce4e5b9
+	x = (x ^ (x >> 27)) * 0x94d049bb133111eb
+	return x ^ (x >> 31)
+}
@@ -0,0 +1,128 @@
+package client
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net"
+	"testing"
+	"time"
+)
+
+func testRemotes(ips ...string) []Remote {
+	var remotes []Remote
+	for _, ip := range ips {
+		remotes = append(remotes, NewServer(&net.TCPAddr{IP: net.ParseIP(ip), Port: 2407}, "keyserver"))
+	}
+	return remotes
+}
+
+func TestRoundRobinBalancer(t *testing.T) {
+	c := &Client{}
+	remotes := testRemotes("10.0.0.1", "10.0.0.2", "10.0.0.3")
+	b := &RoundRobinBalancer{}
+
+	for i := 0; i < 6; i++ {
+		order := b.Order(c, remotes)
+		if len(order) != len(remotes) {
+			t.Fatalf("got %d remotes; want %d", len(order), len(remotes))
+		}
+		if order[0] != remotes[i%len(remotes)] {
+			t.Fatalf("call %d: got first remote %v; want %v", i, order[0], remotes[i%len(remotes)])
+		}
+	}
+}
+
+func TestLeastOutstandingBalancer(t *testing.T) {
+	c := &Client{}
+	remotes := testRemotes("10.0.0.1", "10.0.0.2", "10.0.0.3")
+	c.serverStatsFor(remoteAddr(remotes[0])).begin()
+	c.serverStatsFor(remoteAddr(remotes[0])).begin()
+	c.serverStatsFor(remoteAddr(remotes[2])).begin()
+
+	order := LeastOutstandingBalancer{}.Order(c, remotes)
+	if order[0] != remotes[1] || order[1] != remotes[2] || order[2] != remotes[0] {
+		t.Fatalf("unexpected order: %v", order)
+	}
+}
+
+func TestLatencyBalancer(t *testing.T) {
+	c := &Client{}
+	remotes := testRemotes("10.0.0.1", "10.0.0.2", "10.0.0.3")
+	for i, d := range []time.Duration{30 * time.Millisecond, 10 * time.Millisecond, 20 * time.Millisecond} {
+		s := c.serverStatsFor(remoteAddr(remotes[i]))
+		s.begin()
+		s.end(d, nil)
+	}
+	// Failures don't update the latency average.
+	s := c.serverStatsFor(remoteAddr(remotes[1]))
+	s.begin()
+	s.end(time.Second, errors.New("failed"))
+
+	order := LatencyBalancer{}.Order(c, remotes)
+	if order[0] != remotes[1] || order[1] != remotes[2] || order[2] != remotes[0] {
+		t.Fatalf("unexpected order: %v", order)
+	}
+	if stats := c.ServerStats(remoteAddr(remotes[1])); stats.Requests != 2 || stats.Failures != 1 || stats.Outstanding != 0 {
+		t.Fatalf("unexpected stats: %+v", stats)
+	}
+}
+
+func TestLocalityBalancer(t *testing.T) {
+	c := &Client{}
+	remotes := testRemotes("10.0.0.1", "192.168.0.1", "10.0.0.2", "192.168.0.2")
+	_, local, _ := net.ParseCIDR("192.168.0.0/16")
+	b := &LocalityBalancer{Local: []*net.IPNet{local}, Fallback: LatencyBalancer{}}
+
+	for i := 0; i < 10; i++ {
+		order := b.Order(c, remotes)
+		if len(order) != len(remotes) {
+			t.Fatalf("got %d remotes; want %d", len(order), len(remotes))
+		}
+		for _, r := range order[:2] {
+			if !local.Contains(r.(*singleRemote).Addr.(*net.TCPAddr).IP) {
+				t.Fatalf("non-local remote %v ordered before local remotes", r)
+			}
+		}
+	}
+}
+
+func TestAffinityBalancer(t *testing.T) {
+	c := &Client{}
+	remotes := testRemotes("10.0.0.1", "10.0.0.2", "10.0.0.3", "10.0.0.4")
+	b := &AffinityBalancer{Fallback: &RoundRobinBalancer{}}
+
+	first := make(map[string]Remote)
+	used := make(map[Remote]bool)
+	for i := 0; i < 100; i++ {
+		key := fmt.Sprintf("session-%d", i)
+		ctx := WithAffinity(context.Background(), key)
+		order := b.OrderContext(ctx, c, remotes)
+		if len(order) != len(remotes) {
+			t.Fatalf("got %d remotes; want %d", len(order), len(remotes))
+		}
+		if again := b.OrderContext(ctx, c, remotes); again[0] != order[0] {
+			t.Fatalf("%s: got %v, then %v", key, order[0], again[0])
+		}
+		first[key] = order[0]
+		used[order[0]] = true
+	}
+	if len(used) != len(remotes) {
+		t.Fatalf("keys only went to %d of %d remotes", len(used), len(remotes))
+	}
+
+	// Removing a server only moves its keys.
+	for key, r := range first {
+		order := b.OrderContext(WithAffinity(context.Background(), key), c, remotes[1:])
+		if r != remotes[0] && order[0] != r {
+			t.Fatalf("%s: moved from %v to %v", key, r, order[0])
+		}
+	}
+
+	// Operations without a key are ordered by the fallback.
+	for i := 0; i < 4; i++ {
+		if order := b.OrderContext(context.Background(), c, remotes); order[0] != remotes[i] {
+			t.Fatalf("call %d: got first remote %v; want %v", i, order[0], remotes[i])
+		}
+	}
+}
@@ -0,0 +1,100 @@
+package client
+
+import (
+	"context"
+	"crypto"
+	"crypto/rand"
+	"errors"
+	"fmt"
+
+	"github.com/cloudflare/gokeyless/protocol"
+)
+
+// DoBatch performs ops on server in a single round trip with protocol.OpBatch.
+// The results, in the same order as ops, each have opcode OpResponse or
+// OpError. The encoded ops must fit in a single packet. Servers which predate
+// batching respond with protocol.ErrBadOpcode.
+func (c *Client) DoBatch(ctx context.Context, server string, ops []protocol.Operation) ([]protocol.Operation, error) {
+	payload, err := protocol.MarshalBatch(ops)
+	if err != nil {
+		return nil, err
+	}
+	payload, err = c.do(ctx, server, protocol.Operation{Opcode: protocol.OpBatch, Payload: payload})
+	if err != nil {
+		return nil, err
+	}
+	results, err := protocol.UnmarshalBatch(payload)
+	if err != nil {
+		return nil, err
+	}
+	if len(results) != len(ops) {
+		return nil, fmt.Errorf("got %d batch results for %d operations", len(results), len(ops))
+	}
+	return results, nil
+}
+
+// SignBatch signs each of digests with the key in a single round trip, as if
+// by calling Sign with opts for each. It fails if any of the signatures fails.
+// If no keyserver can be reached, the digests are signed with the Client's
+// fallback key, if there is one.
+func (key *PrivateKey) SignBatch(digests [][]byte, opts crypto.SignerOpts) ([][]byte, error) {
+	return key.SignBatchContext(context.Background(), digests, opts)
+}
+
+// SignBatchContext is like SignBatch, but gives up when ctx is done.
+func (key *PrivateKey) SignBatchContext(ctx context.Context, digests [][]byte, opts crypto.SignerOpts) ([][]byte, error) {
+	op := signOpFromSignerOpts(key, opts)
+	if op == protocol.OpError {
+		return nil, errors.New("invalid key type, hash or options")
+	}
+	ops := make([]protocol.Operation, len(digests))
+	for i, digest := range digests {
+		if opts.HashFunc() != 0 && len(digest) != opts.HashFunc().Size() {
+			return nil, errors.New("input must be hashed message")
+		}
+		ops[i] = protocol.Operation{
+			Opcode:   op,
+			Payload:  digest,
+			SKI:      key.ski,
+			ClientIP: key.clientIP,
+			ServerIP: key.serverIP,
+			SNI:      key.sni,
+			CertID:   key.certID,
+		}
+	}
+
+	results, err := key.client.DoBatch(ctx, key.keyserver, ops)
+	if err != nil {
+		var operr *OperationError
+		if errors.As(err, &operr) {
+			// The keyserver was reached, but refused the batch.
+			return nil, err
+		}
+		if ctx.Err() != nil {
+			return nil, err
+		}
+		var sigs [][]byte
+		_, err = key.fallback(op, err, func(priv crypto.Signer) ([]byte, error) {
+			for _, digest := range digests {
+				sig, err := priv.Sign(rand.Reader, digest, opts)
+				if err != nil {
+					return nil, err
+				}
+				sigs = append(sigs, sig)
+			}
+			return nil, nil
+		})
+		if err != nil {
+			return nil, err
+		}
+		return sigs, nil
+	}
+	sigs := make([][]byte, len(results))
+	for i, result := range results {
+		if err := responseError(key.keyserver, op, &result); err != nil {
+			return nil, fmt.Errorf("signature %d: %w", i, err)
+		}
+		sigs[i] = result.Payload
+	}
+	return sigs, nil
+}
@@ -0,0 +1,122 @@
+package client
+
+import (
+	"errors"
+	"time"
+
+	"github.com/cloudflare/cfssl/log"
+)
+
+// A CircuitBreaker stops a Client from sending requests to a keyserver which
+// keeps failing or has become too slow. Once a server's circuit opens, dials
+// to it fail immediately, so that a Group routes requests to the other
+// servers instead. After OpenTimeout a single request is let through to probe
+// the server: if it succeeds the circuit closes, otherwise it stays open for
+// another OpenTimeout.
+type CircuitBreaker struct {
+	// Failures is the number of consecutive failed dials or requests which
+	// opens the circuit. Zero disables this check.
+	Failures int
+	// Latency, if positive, opens the circuit when the moving average of a
+	// server's request latency exceeds it.
+	Latency time.Duration
+	// OpenTimeout is how long the circuit stays open before a probe.
+	OpenTimeout time.Duration
+}
+
+// ErrCircuitOpen is returned when dialing a keyserver whose circuit is open.
+var ErrCircuitOpen = errors.New("keyserver circuit breaker is open")
+
+// circuit is the circuit breaker state of one keyserver. It is guarded by the
+// mutex of the server's serverStats.
+type circuit struct {
+	// consecutiveFailures counts the failures since the last success.
+	consecutiveFailures int
+	open                bool
+	// openedAt is when the circuit opened, or when the last probe failed.
+	openedAt time.Time
+	// probeAt is when the current probe was let through, if any.
+	probeAt time.Time
+}
+
+// allow reports whether a request may be sent to the server with stats
+// according to cb, which may be nil.
+func (cb *CircuitBreaker) allow(addr string, s *serverStats) bool {
+	if cb == nil {
+		return true
+	}
+	s.mtx.Lock()
+	defer s.mtx.Unlock()
+
+	now := time.Now()
+	if !s.circuit.open {
+		if !cb.unhealthy(s) {
+			return true
+		}
+		log.Warningf("opening circuit to %s: %d consecutive failures, %v latency",
+			addr, s.circuit.consecutiveFailures, s.stats.Latency)
+		s.circuit.open = true
+		s.circuit.openedAt = now
+		return false
+	}
+	if now.Sub(s.circuit.openedAt) < cb.OpenTimeout {
+		return false
+	}
+	// Only one probe at a time, unless the last one never reported back.
+	if !s.circuit.probeAt.IsZero() && now.Sub(s.circuit.probeAt) < cb.OpenTimeout {
+		return false
+	}
+	log.Infof("probing %s with open circuit", addr)
+	s.circuit.probeAt = now
+	return true
+}
+
+// available reports whether the circuit of the server with stats is closed or
+// ready for a probe.
+func (cb *CircuitBreaker) available(s *serverStats) bool {
+	s.mtx.Lock()
+	defer s.mtx.Unlock()
+	return !s.circuit.open || time.Since(s.circuit.openedAt) >= cb.OpenTimeout
+}
+
+// preferAvailable returns remotes with the servers whose circuit is open, and
+// not yet ready for a probe, moved to the end.
+func (c *Client) preferAvailable(remotes []Remote) []Remote {
+	out := make([]Remote, 0, len(remotes))
+	var open []Remote
+	for _, r := range remotes {
+		if addr := remoteAddr(r); addr != "" && !c.CircuitBreaker.available(c.serverStatsFor(addr)) {
+			open = append(open, r)
+			continue
+		}
+		out = append(out, r)
+	}
+	return append(out, open...)
+}
+
+func (cb *CircuitBreaker) unhealthy(s *serverStats) bool {
+	if cb.Failures > 0 && s.circuit.consecutiveFailures >= cb.Failures {
+		return true
+	}
+	return cb.Latency > 0 && s.stats.Latency > cb.Latency
+}
+
+// record updates the circuit with the outcome of a dial or request. It must
+// be called with the serverStats mutex held.
+func (c *circuit) record(failed bool) {
+	if failed {
+		c.consecutiveFailures++
+	} else {
+		c.consecutiveFailures = 0
+	}
+	if c.probeAt.IsZero() {
+		return
+	}
+	// This was the probe.
+	c.probeAt = time.Time{}
+	if failed {
+		c.openedAt = time.Now()
+		return
+	}
+	c.open = false
+}
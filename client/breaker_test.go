@@ -0,0 +1,78 @@
+package client
+
+import (
+	"errors"
+	"testing"
+	"time"
+)
+
+func TestCircuitBreaker(t *testing.T) {
+	const timeout = 50 * time.Millisecond
+	c := &Client{CircuitBreaker: &CircuitBreaker{Failures: 2, Latency: 10 * time.Millisecond, OpenTimeout: timeout}}
+	s := c.serverStatsFor("keyserver")
+	allow := func() bool { return c.CircuitBreaker.allow("keyserver", s) }
+
+	s.fail()
+	if !allow() {
+		t.Fatal("circuit opened after one failure")
+	}
+	s.begin()
+	s.end(time.Millisecond, errors.New("failed"))
+	if allow() {
+		t.Fatal("circuit still closed after two consecutive failures")
+	}
+	if stats := c.ServerStats("keyserver"); !stats.CircuitOpen || stats.ConsecutiveFailures != 2 {
+		t.Fatalf("unexpected stats: %+v", stats)
+	}
+
+	// A failed probe keeps the circuit open for another timeout.
+	time.Sleep(timeout)
+	if !allow() {
+		t.Fatal("no probe after the open timeout")
+	}
+	if allow() {
+		t.Fatal("second probe while the first is outstanding")
+	}
+	s.fail()
+	if allow() {
+		t.Fatal("circuit closed after a failed probe")
+	}
+
+	// A successful probe closes it.
+	time.Sleep(timeout)
+	if !allow() {
+		t.Fatal("no probe after the open timeout")
+	}
+	s.begin()
+	s.end(time.Millisecond, nil)
+	if !allow() || c.ServerStats("keyserver").CircuitOpen {
+		t.Fatal("circuit still open after a successful probe")
+	}
+
+	// Slow responses open it too.
+	for i := 0; i < 10; i++ {
+		s.begin()
+		s.end(50*time.Millisecond, nil)
+	}
+	if allow() {
+		t.Fatal("circuit still closed for a slow server")
+	}
+}
+
+func TestCircuitBreakerPreferAvailable(t *testing.T) {
+	c := &Client{Blacklist: &AddrSet{}, CircuitBreaker: &CircuitBreaker{Failures: 1, OpenTimeout: time.Hour}}
+	remotes := testRemotes("10.0.0.1", "10.0.0.2", "10.0.0.3")
+	s := c.serverStatsFor(remoteAddr(remotes[0]))
+	s.fail()
+	if c.CircuitBreaker.allow(remoteAddr(remotes[0]), s) {
+		t.Fatal("circuit did not open")
+	}
+
+	order := c.preferAvailable(remotes)
+	if order[0] != remotes[1] || order[1] != remotes[2] || order[2] != remotes[0] {
+		t.Fatalf("unexpected order: %v", order)
+	}
+	if _, err := remotes[0].Dial(c); !errors.Is(err, ErrCircuitOpen) {
+		t.Fatalf("got error %v; want %v", err, ErrCircuitOpen)
+	}
+}
@@ -0,0 +1,30 @@
+package client
+
+import (
+	"context"
+
+	"github.com/cloudflare/gokeyless/protocol"
+)
+
+// Capabilities is the set of opcodes supported by a keyserver.
+type Capabilities map[protocol.Op]bool
+
+// Supports reports whether op is supported.
+func (caps Capabilities) Supports(op protocol.Op) bool {
+	return caps[op]
+}
+
+// GetCapabilities asks server which opcodes it supports. Servers which predate
+// capability negotiation respond with protocol.ErrBadOpcode.
+func (c *Client) GetCapabilities(ctx context.Context, server string) (Capabilities, error) {
+	payload, err := c.do(ctx, server, protocol.Operation{Opcode: protocol.OpGetCapabilities})
+	if err != nil {
+		return nil, err
+	}
+
+	caps := make(Capabilities, len(payload))
+	for _, op := range payload {
+		caps[protocol.Op(op)] = true
+	}
+	return caps, nil
+}
@@ -0,0 +1,29 @@
+package client
+
+import (
+	"context"
+	"fmt"
+
+	"github.com/cloudflare/gokeyless/protocol"
+)
+
+// GetCertificates lists the certificates server has indexed which match q,
+// soonest to expire first, so that terminators can discover which names it
+// can serve keys for. The list is truncated if the matching certificates
+// don't fit in one response; a narrower query returns the rest.
+func (c *Client) GetCertificates(ctx context.Context, server string, q protocol.CertificateQuery) (*protocol.CertificateList, error) {
+	payload, err := q.MarshalBinary()
+	if err != nil {
+		return nil, err
+	}
+	res, err := c.do(ctx, server, protocol.Operation{Opcode: protocol.OpGetCertificates, Payload: payload})
+	if err != nil {
+		return nil, err
+	}
+
+	l := new(protocol.CertificateList)
+	if err := l.UnmarshalBinary(res); err != nil {
+		return nil, fmt.Errorf("invalid certificate list: %v", err)
+	}
+	return l, nil
+}
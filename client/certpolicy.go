@@ -0,0 +1,191 @@
+package client
+
+import (
+	"crypto/sha256"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"strings"
+	"sync"
+
+	"github.com/cloudflare/cfssl/log"
+)
+
+// ErrCertificateBlocked is returned when a keyserver presents a certificate
+// blocked by the Client's CertPolicy.
+var ErrCertificateBlocked = errors.New("keyserver certificate is blocked")
+
+// ErrCertificateNotPinned is returned when a keyserver presents a leaf
+// certificate which isn't pinned by the Client's CertPolicy, while it pins
+// some.
+var ErrCertificateNotPinned = errors.New("keyserver certificate is not pinned")
+
+// A Fingerprint is the SHA-256 hash of the DER encoding of a certificate.
+type Fingerprint [sha256.Size]byte
+
+// CertificateFingerprint returns the fingerprint of cert.
+func CertificateFingerprint(cert *x509.Certificate) Fingerprint {
+	return sha256.Sum256(cert.Raw)
+}
+
+// ParseFingerprint parses a hex-encoded SHA-256 fingerprint, optionally
+// prefixed with "sha256:" and with its bytes separated by colons, as printed
+// by "openssl x509 -fingerprint -sha256".
+func ParseFingerprint(s string) (Fingerprint, error) {
+	var fp Fingerprint
+	s = strings.TrimPrefix(strings.ToLower(strings.TrimSpace(s)), "sha256:")
+	b, err := hex.DecodeString(strings.Replace(s, ":", "", -1))
+	if err != nil || len(b) != len(fp) {
+		return fp, fmt.Errorf("invalid SHA-256 fingerprint %q", s)
+	}
+	copy(fp[:], b)
+	return fp, nil
+}
+
+func (fp Fingerprint) String() string {
+	return hex.EncodeToString(fp[:])
+}
+
+// A CertPolicy blocks or pins keyserver certificates by fingerprint, so that
+// a leaked keyserver certificate can be distrusted at once, without rotating
+// the CA which issued it. The certificates are checked after the usual
+// verification, in VerifyPeerCertificate. Changes to the policy also close
+// the pooled connections to the keyservers whose certificates it now
+// rejects. A CertPolicy can be changed while Clients use it.
+type CertPolicy struct {
+	mtx     sync.RWMutex
+	blocked map[Fingerprint]bool
+	pinned  map[Fingerprint]bool
+}
+
+// NewCertPolicy returns a CertPolicy which neither blocks nor pins any
+// certificate.
+func NewCertPolicy() *CertPolicy {
+	return &CertPolicy{
+		blocked: make(map[Fingerprint]bool),
+		pinned:  make(map[Fingerprint]bool),
+	}
+}
+
+// Block distrusts the certificates with the given fingerprints, whether they
+// are presented as a keyserver's leaf certificate or as an intermediate.
+func (p *CertPolicy) Block(fps ...Fingerprint) {
+	p.mtx.Lock()
+	for _, fp := range fps {
+		p.blocked[fp] = true
+		log.Infof("blocked keyserver certificate %s", fp)
+	}
+	p.mtx.Unlock()
+	p.closeRejected()
+}
+
+// Unblock trusts the certificates with the given fingerprints again.
+func (p *CertPolicy) Unblock(fps ...Fingerprint) {
+	p.mtx.Lock()
+	defer p.mtx.Unlock()
+	for _, fp := range fps {
+		delete(p.blocked, fp)
+	}
+}
+
+// Pin restricts the keyservers to the leaf certificates with the given
+// fingerprints, and those pinned earlier. Until a certificate is pinned, any
+// certificate which isn't blocked is accepted.
+func (p *CertPolicy) Pin(fps ...Fingerprint) {
+	p.mtx.Lock()
+	for _, fp := range fps {
+		p.pinned[fp] = true
+	}
+	p.mtx.Unlock()
+	p.closeRejected()
+}
+
+// Unpin removes the pins of the certificates with the given fingerprints.
+func (p *CertPolicy) Unpin(fps ...Fingerprint) {
+	p.mtx.Lock()
+	for _, fp := range fps {
+		delete(p.pinned, fp)
+	}
+	p.mtx.Unlock()
+	p.closeRejected()
+}
+
+// Blocked returns the fingerprints of the blocked certificates.
+func (p *CertPolicy) Blocked() []Fingerprint {
+	p.mtx.RLock()
+	defer p.mtx.RUnlock()
+	fps := make([]Fingerprint, 0, len(p.blocked))
+	for fp := range p.blocked {
+		fps = append(fps, fp)
+	}
+	return fps
+}
+
+// VerifyPeerCertificate rejects the keyserver certificates blocked or not
+// pinned by p. It has the signature of tls.Config.VerifyPeerCertificate.
+func (p *CertPolicy) VerifyPeerCertificate(rawCerts [][]byte, _ [][]*x509.Certificate) error {
+	fps := make([]Fingerprint, len(rawCerts))
+	for i, raw := range rawCerts {
+		fps[i] = sha256.Sum256(raw)
+	}
+	return p.check(fps)
+}
+
+// check checks the fingerprints of the certificates presented by a
+// keyserver, leaf first.
+func (p *CertPolicy) check(fps []Fingerprint) error {
+	if len(fps) == 0 {
+		return nil
+	}
+	p.mtx.RLock()
+	defer p.mtx.RUnlock()
+	for _, fp := range fps {
+		if p.blocked[fp] {
+			return fmt.Errorf("%w: %s", ErrCertificateBlocked, fp)
+		}
+	}
+	if len(p.pinned) > 0 && !p.pinned[fps[0]] {
+		return fmt.Errorf("%w: %s", ErrCertificateNotPinned, fps[0])
+	}
+	return nil
+}
+
+// closeRejected closes the pooled connections, dialed by clients with
+// policy p, to keyservers whose certificates p now rejects.
+func (p *CertPolicy) closeRejected() {
+	n := connPool.closeWhere(func(cn *Conn) bool {
+		return cn.client != nil && cn.client.CertPolicy == p && p.check(cn.peerCerts) != nil
+	})
+	if n > 0 {
+		log.Infof("closed %d connections to keyservers with distrusted certificates", n)
+	}
+}
+
+// tlsConfig returns a copy of c.Config for dialing the keyserver named
+// serverName, which also checks its certificates with c.CertPolicy.
+func (c *Client) tlsConfig(serverName string) *tls.Config {
+	config := c.Config.Clone()
+	config.ServerName = serverName
+	if policy, verify := c.CertPolicy, config.VerifyPeerCertificate; policy != nil {
+		config.VerifyPeerCertificate = func(rawCerts [][]byte, verifiedChains [][]*x509.Certificate) error {
+			if verify != nil {
+				if err := verify(rawCerts, verifiedChains); err != nil {
+					return err
+				}
+			}
+			return policy.VerifyPeerCertificate(rawCerts, verifiedChains)
+		}
+	}
+	return config
+}
+
+// peerFingerprints returns the fingerprints of certs.
+func peerFingerprints(certs []*x509.Certificate) []Fingerprint {
+	fps := make([]Fingerprint, len(certs))
+	for i, cert := range certs {
+		fps[i] = CertificateFingerprint(cert)
+	}
+	return fps
+}
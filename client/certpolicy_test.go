@@ -0,0 +1,69 @@
+package client
+
+import (
+	"crypto/sha256"
+	"errors"
+	"testing"
+)
+
+func TestParseFingerprint(t *testing.T) {
+	want := Fingerprint(sha256.Sum256([]byte("cert")))
+	for _, s := range []string{
+		want.String(),
+		"sha256:" + want.String(),
+		"SHA256:" + colonHex(want),
+	} {
+		fp, err := ParseFingerprint(s)
+		if err != nil {
+			t.Fatalf("%s: %v", s, err)
+		}
+		if fp != want {
+			t.Fatalf("%s: got %s", s, fp)
+		}
+	}
+	if _, err := ParseFingerprint("abcd"); err == nil {
+		t.Fatal("short fingerprint accepted")
+	}
+}
+
+func colonHex(fp Fingerprint) string {
+	s := fp.String()
+	var out []byte
+	for i := 0; i < len(s); i += 2 {
+		if i > 0 {
+			out = append(out, ':')
+		}
+		out = append(out, s[i:i+2]...)
+	}
+	return string(out)
+}
+
+func TestCertPolicy(t *testing.T) {
+	leaf := [][]byte{[]byte("leaf"), []byte("intermediate")}
+	other := [][]byte{[]byte("other")}
+	p := NewCertPolicy()
+	if err := p.VerifyPeerCertificate(leaf, nil); err != nil {
+		t.Fatal(err)
+	}
+
+	p.Block(sha256.Sum256([]byte("intermediate")))
+	if err := p.VerifyPeerCertificate(leaf, nil); !errors.Is(err, ErrCertificateBlocked) {
+		t.Fatalf("got %v, want ErrCertificateBlocked", err)
+	}
+	p.Unblock(sha256.Sum256([]byte("intermediate")))
+	if err := p.VerifyPeerCertificate(leaf, nil); err != nil {
+		t.Fatal(err)
+	}
+
+	p.Pin(sha256.Sum256([]byte("leaf")))
+	if err := p.VerifyPeerCertificate(leaf, nil); err != nil {
+		t.Fatal(err)
+	}
+	if err := p.VerifyPeerCertificate(other, nil); !errors.Is(err, ErrCertificateNotPinned) {
+		t.Fatalf("got %v, want ErrCertificateNotPinned", err)
+	}
+	p.Unpin(sha256.Sum256([]byte("leaf")))
+	if err := p.VerifyPeerCertificate(other, nil); err != nil {
+		t.Fatal(err)
+	}
+}
@@ -12,13 +12,17 @@ import (
 	"fmt"
 	"io/ioutil"
 	"net"
+	"net/url"
 	"os"
 	"path/filepath"
 	"regexp"
+	"sync"
 	"time"
 
 	"github.com/cloudflare/cfssl/log"
+	"github.com/cloudflare/gokeyless/noise"
 	"github.com/cloudflare/gokeyless/protocol"
+	"github.com/cloudflare/gokeyless/sm2"
 	"github.com/cloudflare/gokeyless/tracing"
 	"github.com/lziest/ttlcache"
 	"github.com/opentracing/opentracing-go"
@@ -43,25 +47,168 @@ type Client struct {
 	DefaultRemote Remote
 	// Blacklist is a list of addresses that this client won't dial.
 	Blacklist *AddrSet
+	// Balancer decides the order in which the members of a Group are dialed.
+	// If nil, a random choice among the lowest-latency servers is made. An
+	// AffinityBalancer sends the operations with the same affinity key, set
+	// with WithAffinity, to the same server.
+	Balancer Balancer
+	// CircuitBreaker, if set, stops requests from being sent to keyservers
+	// which keep failing or are too slow.
+	CircuitBreaker *CircuitBreaker
+	// Proxy, if set, returns the proxy through which to dial the keyserver at
+	// addr (host:port), or nil to dial it directly. socks5://, http:// and
+	// https:// proxy URLs are supported, with optional user:password
+	// credentials. See ProxyURL and ProxyMap.
+	Proxy func(addr string) (*url.URL, error)
+	// ProxyTLSConfig is used to connect to https:// proxies.
+	ProxyTLSConfig *tls.Config
+	// Features, if set, are offered to each keyserver with protocol.OpHello
+	// when a connection is established. The negotiated features are available
+	// from the connection's Features method. Connections on which a server
+	// which negotiated Reconnect asks the client to reconnect are retired from
+	// the pool, so that new operations are sent on a new connection.
+	Features *protocol.Features
+	// OnKeyRemoved, if set, is called with the address of a keyserver and
+	// the SKI of a key it no longer serves, when servers which negotiated
+	// KeyRemoved in Features remove a key, so that maps of which servers hold
+	// a key can be pruned before a request fails. It must not block.
+	OnKeyRemoved func(addr string, ski protocol.SKI)
+	// Revalidate, if set, makes the client check, whenever it connects to a
+	// keyserver it was connected to before, as it does once the keyserver
+	// restarts, that the server still holds the keys used on it, with
+	// protocol.OpProbeKey. Keys it no longer holds are passed to OnKeyRemoved,
+	// and KeyAvailable reports them until an operation with them succeeds on
+	// the server again.
+	Revalidate bool
+	// StrictPadding makes connections to keyservers reject responses with
+	// invalid padding, as conn.Conn.StrictPadding does. Responses are padded
+	// with zero bytes to at least 1024 bytes unless protocol.PaddingOptional
+	// was negotiated with Features.
+	StrictPadding bool
+	// CertPolicy, if set, blocks or pins keyserver certificates by
+	// fingerprint, in addition to their verification against Config.
+	CertPolicy *CertPolicy
+	// Attestation, if set, is required of each keyserver when a connection is
+	// established, and connections to servers which fail it are refused.
+	Attestation *AttestationPolicy
+	// Token, if set, returns the bearer token the client authenticates with,
+	// for keyservers which accept tokens in place of client certificates. It
+	// is called for each new connection, after attestation if any, and for
+	// each request to HTTP remotes, so it should cache the token.
+	Token func(ctx context.Context) (string, error)
+	// NoiseKey is the static key the client authenticates with to the
+	// keyservers of NewNoiseServer, in place of its TLS certificate.
+	NoiseKey *noise.KeyPair
+	// Metrics, if set, records the outcome of each request and dial, e.g.
+	// for export with a PrometheusMetrics.
+	Metrics Metrics
+	// DialRaceDelay, if positive, makes Groups dial their servers in the
+	// style of Happy Eyeballs (RFC 8305): alternating between IPv6 and IPv4
+	// addresses, the next server is dialed once the previous one has failed
+	// or has not connected within DialRaceDelay, and the first connection
+	// established is used. RFC 8305 recommends 250ms. Otherwise, as by
+	// default, each server is dialed in turn until one connects. Either way,
+	// servers which recently failed to dial are tried last.
+	DialRaceDelay time.Duration
+	// Queue, if set, bounds the requests in flight to each keyserver, and
+	// queues the rest. It must not be changed once the Client is in use.
+	Queue *QueueConfig
+	// Hedging, if set, makes requests to a Group which are slower than usual
+	// be duplicated to a second server of the Group, using whichever response
+	// arrives first.
+	Hedging *HedgingPolicy
+	// WarmUp, if set, makes the client connect to keyservers as soon as
+	// signers are created for their keys, and keep the connections warm.
+	WarmUp *WarmUpPolicy
+	// warm maps the keyservers and *TieredRemotes whose connections are kept
+	// warm to the channel stopping it.
+	warm sync.Map
 	// remoteCache maps all known server names to corresponding remote.
 	remoteCache *ttlcache.LRU
+	// stats maps server addresses to their *serverStats.
+	stats sync.Map
+	// fallbacks maps SKIs to the local keys registered with AddFallbackKey.
+	fallbacks sync.Map
+	// tiers maps SKIs to the *TieredRemote registered with RegisterTiers.
+	tiers sync.Map
+	// served maps server addresses to the *servedKeys used on them, with
+	// Revalidate.
+	served sync.Map
+	// queues maps server addresses to their *requestQueue.
+	queues sync.Map
+	// latencies holds recent request latencies, from which the delay before
+	// hedging a request is derived.
+	latencies latencyWindow
+}
+
+// TLSOptions customize the TLS configuration of a Client created with
+// NewClientWithTLSOptions. Zero values keep the defaults of NewClient.
+type TLSOptions struct {
+	// MinVersion is the lowest TLS version negotiated with keyservers, which
+	// may not be below TLS 1.2. It defaults to TLS 1.2.
+	MinVersion uint16
+	// MaxVersion is the highest TLS version negotiated with keyservers. It
+	// defaults to the highest version supported, TLS 1.3.
+	MaxVersion uint16
+	// CipherSuites are the TLS 1.2 cipher suites offered to keyservers, which
+	// may not include the suites of tls.InsecureCipherSuites. They default to
+	// ECDHE with AES-256-GCM. TLS 1.3 cipher suites are not configurable.
+	CipherSuites []uint16
+	// VerifyPeerCertificate, if set, is called with the keyserver's
+	// certificates after they have been verified as usual, so that it can
+	// reject them, e.g. by pinning keys.
+	VerifyPeerCertificate func(rawCerts [][]byte, verifiedChains [][]*x509.Certificate) error
+}
+
+// defaultCipherSuites are the TLS 1.2 cipher suites offered by default.
+var defaultCipherSuites = []uint16{
+	tls.TLS_ECDHE_ECDSA_WITH_AES_256_GCM_SHA384,
+	tls.TLS_ECDHE_RSA_WITH_AES_256_GCM_SHA384,
 }
 
 // NewClient prepares a TLS client capable of connecting to keyservers.
 func NewClient(cert tls.Certificate, keyserverCA *x509.CertPool) *Client {
+	c, _ := NewClientWithTLSOptions(cert, keyserverCA, TLSOptions{})
+	return c
+}
+
+// NewClientWithTLSOptions is like NewClient, but customizes the TLS
+// configuration of the client with opts.
+func NewClientWithTLSOptions(cert tls.Certificate, keyserverCA *x509.CertPool, opts TLSOptions) (*Client, error) {
+	config := &tls.Config{
+		RootCAs:               keyserverCA,
+		Certificates:          []tls.Certificate{cert},
+		MinVersion:            tls.VersionTLS12,
+		MaxVersion:            opts.MaxVersion,
+		CipherSuites:          append([]uint16(nil), defaultCipherSuites...),
+		VerifyPeerCertificate: opts.VerifyPeerCertificate,
+	}
+	if opts.MinVersion != 0 {
+		if opts.MinVersion < tls.VersionTLS12 {
+			return nil, fmt.Errorf("minimum TLS version %#04x is below TLS 1.2", opts.MinVersion)
+		}
+		config.MinVersion = opts.MinVersion
+	}
+	if config.MaxVersion != 0 && config.MaxVersion < config.MinVersion {
+		return nil, fmt.Errorf("maximum TLS version %#04x is below the minimum, %#04x", config.MaxVersion, config.MinVersion)
+	}
+	if opts.CipherSuites != nil {
+		for _, id := range opts.CipherSuites {
+			for _, suite := range tls.InsecureCipherSuites() {
+				if id == suite.ID {
+					return nil, fmt.Errorf("cipher suite %s is insecure", suite.Name)
+				}
+			}
+		}
+		config.CipherSuites = opts.CipherSuites
+	}
+
 	return &Client{
-		Config: &tls.Config{
-			RootCAs:      keyserverCA,
-			Certificates: []tls.Certificate{cert},
-			CipherSuites: []uint16{
-				tls.TLS_ECDHE_ECDSA_WITH_AES_256_GCM_SHA384,
-				tls.TLS_ECDHE_RSA_WITH_AES_256_GCM_SHA384,
-			},
-		},
+		Config:      config,
 		Dialer:      &net.Dialer{},
 		Blacklist:   &AddrSet{},
 		remoteCache: ttlcache.NewLRU(remoteCacheSize, remoteCacheTTL, nil),
-	}
+	}, nil
 }
 
 // NewClientFromFile reads certificate, key, and CA files in order to create a Server.
@@ -190,6 +337,48 @@ func (c *Client) getRemote(server string) (Remote, error) {
 	return r, nil
 }
 
+// do performs a keyless operation which is not tied to a particular key on
+// server, returning the response payload.
+func (c *Client) do(ctx context.Context, server string, op protocol.Operation) ([]byte, error) {
+	r, err := c.getRemote(server)
+	if err != nil {
+		return nil, err
+	}
+
+	conn, err := c.DialContext(ctx, r)
+	if err != nil {
+		return nil, err
+	}
+
+	start := time.Now()
+	release, err := c.acquire(ctx, conn.addr)
+	if err != nil {
+		c.observeRequest(conn.addr, op.Opcode, time.Since(start), err)
+		conn.KeepAlive()
+		return nil, err
+	}
+	start = time.Now()
+	result, err := conn.doOperation(ctx, op)
+	release()
+	c.observeRequest(conn.addr, op.Opcode, time.Since(start), operationError(result, err))
+	c.observeTiming(conn.addr, op.Opcode, result)
+	if err != nil {
+		if err == ctx.Err() {
+			// The operation was abandoned, but the connection is still usable.
+			conn.KeepAlive()
+		} else {
+			conn.Close()
+		}
+		return nil, err
+	}
+	conn.KeepAlive()
+
+	if err := responseError(conn.addr, op.Opcode, result); err != nil {
+		return nil, err
+	}
+	return result.Payload, nil
+}
+
 // NewRemoteSignerWithCertID returns a remote keyserver based crypto.Signer
 // ski, sni, serverIP, and certID are used to identify the key by the remote
 // keyserver.
@@ -197,15 +386,8 @@ func NewRemoteSignerWithCertID(ctx context.Context, c *Client, keyserver string,
 	pub crypto.PublicKey, sni string, certID string, serverIP net.IP) (crypto.Signer, error) {
 	span, _ := opentracing.StartSpanFromContext(ctx, "client.NewRemoteSignerWithCertID")
 	defer span.Finish()
-	priv := PrivateKey{
-		public:    pub,
-		client:    c,
-		ski:       ski,
-		sni:       sni,
-		serverIP:  serverIP,
-		keyserver: keyserver,
-		certID:    certID,
-	}
+	priv := newPrivateKey(c, keyserver, ski, pub, sni, certID, serverIP)
+	c.warmUpKeyserver(keyserver)
 	var err error
 	priv.JaegerSpan, err = tracing.SpanContextToBinary(span.Context())
 	if err != nil {
@@ -228,14 +410,8 @@ func NewRemoteSigner(ctx context.Context, c *Client, keyserver string, ski proto
 
 	span, _ := opentracing.StartSpanFromContext(ctx, "client.NewRemoteSignerWithCertID")
 	defer span.Finish()
-	priv := PrivateKey{
-		public:    pub,
-		client:    c,
-		ski:       ski,
-		sni:       sni,
-		serverIP:  serverIP,
-		keyserver: keyserver,
-	}
+	priv := newPrivateKey(c, keyserver, ski, pub, sni, "", serverIP)
+	c.warmUpKeyserver(keyserver)
 	var err error
 	priv.JaegerSpan, err = tracing.SpanContextToBinary(span.Context())
 	if err != nil {
@@ -298,6 +474,10 @@ func (c *Client) NewRemoteSignerByCertPEM(ctx context.Context, server string, ce
 
 	cert, err := x509.ParseCertificate(block.Bytes)
 	if err != nil {
+		// crypto/x509 doesn't know the SM2 curve.
+		if pub, sm2Err := sm2.ParseCertificatePublicKey(block.Bytes); sm2Err == nil {
+			return c.NewRemoteSignerTemplate(ctx, server, pub, "", nil)
+		}
 		return nil, err
 	}
 
@@ -395,13 +575,13 @@ func DefaultLoadPubKey(in []byte) (crypto.PublicKey, error) {
 		return nil, errors.New("failed to parse PEM block containing the public key")
 	}
 
-	pub, err := x509.ParsePKIXPublicKey(block.Bytes)
+	pub, err := protocol.ParsePublicKey(block.Bytes)
 	if err != nil {
 		return nil, errors.New("failed to parse DER encoded public key: " + err.Error())
 	}
 
 	switch pub := pub.(type) {
-	case *rsa.PublicKey, *ecdsa.PublicKey:
+	case *rsa.PublicKey, *ecdsa.PublicKey, *sm2.PublicKey:
 		return pub, nil
 	default:
 		return nil, errors.New("unknown/unsupported type of public key")
@@ -1,6 +1,7 @@
 package client
 
 import (
+	"crypto/tls"
 	"net"
 	"testing"
 )
@@ -32,3 +33,28 @@ func TestAddrSet(t *testing.T) {
 		t.Fatal("doesn't contain address in subnet")
 	}
 }
+
+func TestTLSOptions(t *testing.T) {
+	c := NewClient(tls.Certificate{}, nil)
+	if c.Config.MinVersion != tls.VersionTLS12 || c.Config.MaxVersion != 0 || len(c.Config.CipherSuites) != 2 {
+		t.Fatalf("unexpected defaults: versions %#04x-%#04x, suites %v", c.Config.MinVersion, c.Config.MaxVersion, c.Config.CipherSuites)
+	}
+
+	for _, opts := range []TLSOptions{
+		{MinVersion: tls.VersionTLS11},
+		{MinVersion: tls.VersionTLS13, MaxVersion: tls.VersionTLS12},
+		{CipherSuites: []uint16{tls.TLS_ECDHE_RSA_WITH_AES_128_GCM_SHA256, tls.TLS_RSA_WITH_RC4_128_SHA}},
+	} {
+		if _, err := NewClientWithTLSOptions(tls.Certificate{}, nil, opts); err == nil {
+			t.Fatalf("options %+v were accepted", opts)
+		}
+	}
+
+	c, err := NewClientWithTLSOptions(tls.Certificate{}, nil, TLSOptions{MinVersion: tls.VersionTLS13})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if c.Config.MinVersion != tls.VersionTLS13 {
+		t.Fatalf("got minimum version %#04x", c.Config.MinVersion)
+	}
+}
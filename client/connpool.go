@@ -0,0 +1,283 @@
+package client
+
+import (
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/cloudflare/cfssl/log"
+)
+
+const (
+	defaultTTL = 1 * time.Hour
+	// retireGrace is how long a connection which exceeded its max lifetime is
+	// kept open after leaving the pool, so in-flight operations can complete.
+	retireGrace = 30 * time.Second
+)
+
+// TestDisableConnectionPool allows the connection pooling to be disabled during
+// tests which require concurrency.
+var TestDisableConnectionPool uint32
+
+// ConnPoolConfig controls how connections to keyservers are pooled.
+type ConnPoolConfig struct {
+	// MaxConnsPerServer is the number of connections kept open to each
+	// keyserver. Operations are spread across them round-robin. Values less
+	// than 1 are treated as 1.
+	MaxConnsPerServer int
+	// IdleTimeout closes connections which haven't been used for this long.
+	// Zero disables idle reaping.
+	IdleTimeout time.Duration
+	// MaxLifetime retires connections this long after they were established,
+	// so that they are re-dialed. Zero means connections live forever.
+	MaxLifetime time.Duration
+}
+
+// DefaultConnPoolConfig returns the default pool configuration: a single
+// connection per keyserver, closed after an hour of inactivity.
+func DefaultConnPoolConfig() ConnPoolConfig {
+	return ConnPoolConfig{
+		MaxConnsPerServer: 1,
+		IdleTimeout:       defaultTTL,
+	}
+}
+
+// SetConnPoolConfig changes the configuration of the connection pool shared by
+// all clients. Existing connections beyond the new limits are dropped from the
+// pool as they are reaped or retired.
+func SetConnPoolConfig(config ConnPoolConfig) {
+	connPool.setConfig(config)
+}
+
+type pooledConn struct {
+	conn     *Conn
+	created  time.Time
+	lastUsed time.Time
+}
+
+// connKey identifies interchangeable pooled connections: those to the same
+// address, dialed by the same Client. A Client's TLS configuration, CertPolicy,
+// AttestationPolicy and Token are only checked when a connection is dialed, so
+// one Client's connections must never be handed out to another.
+type connKey struct {
+	addr   string
+	client *Client
+}
+
+// connPoolType is a async safe pool of established gokeyless Conn
+// so we don't need to do TLS handshake unnecessarily.
+type connPoolType struct {
+	mtx    sync.Mutex
+	config ConnPoolConfig
+	conns  map[connKey][]*pooledConn
+	next   map[connKey]int
+	reaper *time.Ticker
+}
+
+// connPool keeps all active Conn
+var connPool *connPoolType
+
+func init() {
+	connPool = newConnPool(DefaultConnPoolConfig())
+}
+
+func newConnPool(config ConnPoolConfig) *connPoolType {
+	p := &connPoolType{
+		conns: make(map[connKey][]*pooledConn),
+		next:  make(map[connKey]int),
+	}
+	p.setConfig(config)
+	return p
+}
+
+func (p *connPoolType) setConfig(config ConnPoolConfig) {
+	if config.MaxConnsPerServer < 1 {
+		config.MaxConnsPerServer = 1
+	}
+
+	p.mtx.Lock()
+	defer p.mtx.Unlock()
+	p.config = config
+	if p.reaper != nil {
+		p.reaper.Stop()
+		p.reaper = nil
+	}
+	if interval := reapInterval(config); interval > 0 {
+		p.reaper = time.NewTicker(interval)
+		go p.reap(p.reaper)
+	}
+}
+
+// reapInterval returns how often the pool should look for idle or expired
+// connections, or zero if it never needs to.
+func reapInterval(config ConnPoolConfig) time.Duration {
+	var interval time.Duration
+	for _, d := range []time.Duration{config.IdleTimeout, config.MaxLifetime} {
+		if d > 0 && (interval == 0 || d < interval) {
+			interval = d
+		}
+	}
+	if interval == 0 {
+		return 0
+	}
+	interval /= 2
+	if interval > time.Minute {
+		interval = time.Minute
+	}
+	return interval
+}
+
+func (p *connPoolType) reap(ticker *time.Ticker) {
+	for now := range ticker.C {
+		p.mtx.Lock()
+		if p.reaper != ticker {
+			p.mtx.Unlock()
+			return
+		}
+		var idle, expired []*Conn
+		for key, conns := range p.conns {
+			kept := conns[:0]
+			for _, pc := range conns {
+				switch {
+				case p.config.IdleTimeout > 0 && now.Sub(pc.lastUsed) > p.config.IdleTimeout:
+					idle = append(idle, pc.conn)
+				case p.config.MaxLifetime > 0 && now.Sub(pc.created) > p.config.MaxLifetime:
+					expired = append(expired, pc.conn)
+				default:
+					kept = append(kept, pc)
+				}
+			}
+			p.setLocked(key, kept)
+		}
+		p.mtx.Unlock()
+
+		for _, cn := range idle {
+			log.Debug("closing idle conn with key:", cn.addr)
+			cn.Close()
+		}
+		for _, cn := range expired {
+			retire(cn)
+		}
+	}
+}
+
+// retire closes a connection which has been removed from the pool once any
+// in-flight operations have had a chance to finish.
+func retire(cn *Conn) {
+	atomic.StoreUint32(&cn.retired, 1)
+	log.Debug("retiring conn with key:", cn.addr)
+	time.AfterFunc(retireGrace, func() { cn.Close() })
+}
+
+func (p *connPoolType) setLocked(key connKey, conns []*pooledConn) {
+	if len(conns) == 0 {
+		delete(p.conns, key)
+		delete(p.next, key)
+		return
+	}
+	p.conns[key] = conns
+}
+
+// Get returns a Conn from the pool if there is any. It returns nil while the
+// pool holds fewer than MaxConnsPerServer connections for key, so that the
+// caller dials another one.
+func (p *connPoolType) Get(key connKey) *Conn {
+	if atomic.LoadUint32(&TestDisableConnectionPool) == 1 {
+		return nil
+	}
+
+	p.mtx.Lock()
+	defer p.mtx.Unlock()
+	conns := p.conns[key]
+	if len(conns) < p.config.MaxConnsPerServer {
+		return nil
+	}
+	i := p.next[key] % len(conns)
+	p.next[key] = i + 1
+	pc := conns[i]
+	pc.lastUsed = time.Now()
+	return pc.conn
+}
+
+// Add adds a Conn to the pool. Adding a Conn which is already pooled marks it
+// as recently used. If the pool is full for the Conn's key, the Conn is left
+// out and false is returned.
+func (p *connPoolType) Add(conn *Conn) bool {
+	if atomic.LoadUint32(&TestDisableConnectionPool) == 1 {
+		return false
+	}
+
+	if atomic.LoadUint32(&conn.retired) == 1 {
+		return false
+	}
+
+	p.mtx.Lock()
+	defer p.mtx.Unlock()
+	now := time.Now()
+	key := conn.key()
+	conns := p.conns[key]
+	for _, pc := range conns {
+		if pc.conn == conn {
+			pc.lastUsed = now
+			return true
+		}
+	}
+	if len(conns) >= p.config.MaxConnsPerServer {
+		return false
+	}
+	p.conns[key] = append(conns, &pooledConn{conn: conn, created: now, lastUsed: now})
+	log.Debug("add conn with key:", conn.addr)
+	return true
+}
+
+// Remove removes a Conn from the pool.
+func (p *connPoolType) Remove(conn *Conn) {
+	if atomic.LoadUint32(&TestDisableConnectionPool) == 1 {
+		return
+	}
+
+	p.mtx.Lock()
+	defer p.mtx.Unlock()
+	key := conn.key()
+	conns := p.conns[key]
+	for i, pc := range conns {
+		if pc.conn == conn {
+			kept := append(conns[:i:i], conns[i+1:]...)
+			p.setLocked(key, kept)
+			log.Debug("remove conn with key:", conn.addr)
+			return
+		}
+	}
+}
+
+// closeWhere closes the pooled connections for which match returns true, and
+// returns their number.
+func (p *connPoolType) closeWhere(match func(*Conn) bool) int {
+	p.mtx.Lock()
+	var closed []*Conn
+	for key, conns := range p.conns {
+		kept := conns[:0]
+		for _, pc := range conns {
+			if match(pc.conn) {
+				closed = append(closed, pc.conn)
+			} else {
+				kept = append(kept, pc)
+			}
+		}
+		p.setLocked(key, kept)
+	}
+	p.mtx.Unlock()
+
+	for _, cn := range closed {
+		log.Debug("closing distrusted conn with key:", cn.addr)
+		cn.Close()
+	}
+	return len(closed)
+}
+
+// Len returns the number of pooled connections for key.
+func (p *connPoolType) Len(key connKey) int {
+	p.mtx.Lock()
+	defer p.mtx.Unlock()
+	return len(p.conns[key])
+}
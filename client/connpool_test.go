@@ -0,0 +1,115 @@
+package client
+
+import (
+	"net"
+	"testing"
+	"time"
+
+	"github.com/cloudflare/gokeyless/conn"
+)
+
+func testPoolConn(addr string) *Conn {
+	inner, _ := net.Pipe()
+	return NewStandaloneConn(addr, conn.NewConn(inner))
+}
+
+func TestConnPoolMaxConns(t *testing.T) {
+	p := newConnPool(ConnPoolConfig{MaxConnsPerServer: 2})
+	const addr = "10.0.0.1:2407"
+
+	if cn := p.Get(connKey{addr: addr}); cn != nil {
+		t.Fatal("got conn from empty pool")
+	}
+	a, b, extra := testPoolConn(addr), testPoolConn(addr), testPoolConn(addr)
+	if !p.Add(a) {
+		t.Fatal("failed to add first conn")
+	}
+	if cn := p.Get(connKey{addr: addr}); cn != nil {
+		t.Fatal("got conn from pool below MaxConnsPerServer")
+	}
+	if !p.Add(b) {
+		t.Fatal("failed to add second conn")
+	}
+	if p.Add(extra) {
+		t.Fatal("added conn beyond MaxConnsPerServer")
+	}
+	if !p.Add(a) {
+		t.Fatal("re-adding pooled conn should succeed")
+	}
+
+	// Conns are handed out round-robin.
+	seen := make(map[*Conn]int)
+	for i := 0; i < 4; i++ {
+		seen[p.Get(connKey{addr: addr})]++
+	}
+	if seen[a] != 2 || seen[b] != 2 {
+		t.Fatalf("unbalanced conns: %d, %d", seen[a], seen[b])
+	}
+
+	p.Remove(a)
+	if n := p.Len(connKey{addr: addr}); n != 1 {
+		t.Fatalf("got %d pooled conns; want 1", n)
+	}
+
+	a.Close()
+	if p.Add(a) {
+		t.Fatal("added closed conn")
+	}
+}
+
+func TestConnPoolPerClient(t *testing.T) {
+	p := newConnPool(DefaultConnPoolConfig())
+	const addr = "10.0.0.1:2407"
+
+	a, b := &Client{}, &Client{}
+	cn := testPoolConn(addr)
+	cn.client = a
+	if !p.Add(cn) {
+		t.Fatal("failed to add conn")
+	}
+	if got := p.Get(connKey{addr, a}); got != cn {
+		t.Fatal("didn't get conn dialed by the same client")
+	}
+	if got := p.Get(connKey{addr, b}); got != nil {
+		t.Fatal("got conn dialed by another client")
+	}
+	p.Remove(cn)
+	if n := p.Len(connKey{addr, a}); n != 0 {
+		t.Fatalf("got %d pooled conns; want 0", n)
+	}
+}
+
+func TestConnPoolReapIdle(t *testing.T) {
+	p := newConnPool(ConnPoolConfig{MaxConnsPerServer: 1, IdleTimeout: 20 * time.Millisecond})
+	const addr = "10.0.0.1:2407"
+
+	cn := testPoolConn(addr)
+	p.Add(cn)
+	deadline := time.Now().Add(time.Second)
+	for p.Len(connKey{addr: addr}) != 0 {
+		if time.Now().After(deadline) {
+			t.Fatal("idle conn was not reaped")
+		}
+		time.Sleep(5 * time.Millisecond)
+	}
+}
+
+func TestConnPoolMaxLifetime(t *testing.T) {
+	p := newConnPool(ConnPoolConfig{MaxConnsPerServer: 1, MaxLifetime: 20 * time.Millisecond})
+	const addr = "10.0.0.1:2407"
+
+	cn := testPoolConn(addr)
+	p.Add(cn)
+	deadline := time.Now().Add(time.Second)
+	for p.Len(connKey{addr: addr}) != 0 {
+		if time.Now().After(deadline) {
+			t.Fatal("expired conn was not retired")
+		}
+		// Keep the conn busy so that only its lifetime can expire it.
+		p.Get(connKey{addr: addr})
+		time.Sleep(5 * time.Millisecond)
+	}
+	if p.Add(cn) {
+		t.Fatal("re-added retired conn")
+	}
+}
@@ -0,0 +1,143 @@
+package client
+
+import (
+	"context"
+	"net"
+	"time"
+
+	"github.com/cloudflare/cfssl/log"
+)
+
+// unreachableFor is how long an address which failed to dial is tried after
+// the others.
+const unreachableFor = time.Minute
+
+// preferReachable returns remotes with the servers which recently failed to
+// dial moved to the end, so that e.g. a broken IPv6 path isn't tried first
+// again and again.
+func (c *Client) preferReachable(remotes []Remote) []Remote {
+	now := time.Now()
+	out := make([]Remote, 0, len(remotes))
+	var unreachable []Remote
+	for _, r := range remotes {
+		if addr := remoteAddr(r); addr != "" && c.serverStatsFor(addr).unreachable(now) {
+			unreachable = append(unreachable, r)
+			continue
+		}
+		out = append(out, r)
+	}
+	return append(out, unreachable...)
+}
+
+// interleaveFamilies reorders remotes so that IPv6 and IPv4 addresses
+// alternate, starting with the family of the first, as recommended by
+// RFC 8305. Remotes of either family otherwise keep their order, and those
+// which aren't IP addresses follow.
+func interleaveFamilies(remotes []Remote) []Remote {
+	var v6, v4, other []Remote
+	for _, r := range remotes {
+		switch ip := remoteIP(r); {
+		case ip == nil:
+			other = append(other, r)
+		case ip.To4() == nil:
+			v6 = append(v6, r)
+		default:
+			v4 = append(v4, r)
+		}
+	}
+	first, second := v6, v4
+	if len(remotes) > 0 && remoteIP(remotes[0]).To4() != nil {
+		first, second = v4, v6
+	}
+
+	out := make([]Remote, 0, len(remotes))
+	for i := 0; i < len(first) || i < len(second); i++ {
+		if i < len(first) {
+			out = append(out, first[i])
+		}
+		if i < len(second) {
+			out = append(out, second[i])
+		}
+	}
+	return append(out, other...)
+}
+
+// remoteIP returns the IP address of r, or nil if it has none.
+func remoteIP(r Remote) net.IP {
+	if s, ok := r.(*singleRemote); ok {
+		if tcp, ok := s.Addr.(*net.TCPAddr); ok {
+			return tcp.IP
+		}
+	}
+	return nil
+}
+
+type dialResult struct {
+	conn *Conn
+	err  error
+}
+
+// raceDial dials remotes in the style of Happy Eyeballs (RFC 8305): it starts
+// dialing the next remote once the previous attempt has failed or has not
+// connected within c.DialRaceDelay, and returns the first connection
+// established. The other attempts are abandoned.
+func (c *Client) raceDial(ctx context.Context, remotes []Remote) (*Conn, error) {
+	raceCtx, cancel := context.WithCancel(ctx)
+	defer cancel()
+	results := make(chan dialResult, len(remotes))
+	next, pending := 0, 0
+	start := func() {
+		r := remotes[next]
+		next++
+		pending++
+		go func() {
+			conn, err := c.DialContext(raceCtx, r)
+			results <- dialResult{conn, err}
+		}()
+	}
+
+	var err error
+	start()
+	for pending > 0 {
+		var timer *time.Timer
+		var delay <-chan time.Time
+		if next < len(remotes) {
+			timer = time.NewTimer(c.DialRaceDelay)
+			delay = timer.C
+		}
+		select {
+		case res := <-results:
+			pending--
+			if res.err == nil {
+				go keepLosers(results, pending)
+				return res.conn, nil
+			}
+			err = res.err
+			if ctx.Err() != nil {
+				return nil, err
+			}
+			log.Debugf("retry due to dial failure: %v", err)
+			if next < len(remotes) {
+				start()
+			}
+		case <-delay:
+			log.Debugf("dialing %v while waiting for another attempt", remotes[next])
+			start()
+		}
+		if timer != nil {
+			timer.Stop()
+		}
+	}
+	return nil, err
+}
+
+// keepLosers hands the connections established by the n attempts of a race
+// which were still pending once it was won to the pool, which closes those it
+// has no room for.
+func keepLosers(results <-chan dialResult, n int) {
+	for i := 0; i < n; i++ {
+		if res := <-results; res.err == nil {
+			res.conn.KeepAlive()
+		}
+	}
+}
@@ -0,0 +1,121 @@
+package client
+
+import (
+	"context"
+	"errors"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/cloudflare/gokeyless/conn"
+)
+
+// raceRemote is a Remote whose dials take delay, then fail with err if it is
+// set. A negative delay never completes.
+type raceRemote struct {
+	name     string
+	delay    time.Duration
+	err      error
+	canceled chan struct{}
+}
+
+func (r *raceRemote) Dial(c *Client) (*Conn, error) {
+	return r.DialContext(context.Background(), c)
+}
+
+func (r *raceRemote) DialContext(ctx context.Context, c *Client) (*Conn, error) {
+	var done <-chan time.Time
+	if r.delay >= 0 {
+		done = time.After(r.delay)
+	}
+	select {
+	case <-done:
+	case <-ctx.Done():
+		close(r.canceled)
+		return nil, ctx.Err()
+	}
+	if r.err != nil {
+		return nil, r.err
+	}
+	inner, _ := net.Pipe()
+	return NewStandaloneConn(r.name, conn.NewConn(inner)), nil
+}
+
+func (r *raceRemote) PingAll(*Client, int) {}
+
+func newRaceRemote(name string, delay time.Duration, err error) *raceRemote {
+	return &raceRemote{name: name, delay: delay, err: err, canceled: make(chan struct{})}
+}
+
+func TestRaceDial(t *testing.T) {
+	c := &Client{DialRaceDelay: 10 * time.Millisecond}
+	ctx := context.Background()
+
+	// A server which doesn't answer only delays the next one, and its dial is
+	// abandoned once another connects.
+	blackhole := newRaceRemote("blackhole", -1, nil)
+	cn, err := c.raceDial(ctx, []Remote{blackhole, newRaceRemote("b", 0, nil)})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if cn.addr != "b" {
+		t.Fatalf("got a connection to %s", cn.addr)
+	}
+	cn.Close()
+	<-blackhole.canceled
+
+	// Failures start the next dial right away.
+	c.DialRaceDelay = time.Hour
+	start := time.Now()
+	cn, err = c.raceDial(ctx, []Remote{newRaceRemote("a", 0, errors.New("refused")), newRaceRemote("b", 0, nil)})
+	if err != nil {
+		t.Fatal(err)
+	}
+	cn.Close()
+	if time.Since(start) > time.Second {
+		t.Fatalf("dialing took %v", time.Since(start))
+	}
+
+	// The last error is returned if no dial succeeds.
+	failed := errors.New("unreachable")
+	_, err = c.raceDial(ctx, []Remote{newRaceRemote("a", 0, errors.New("refused")), newRaceRemote("b", 0, failed)})
+	if err != failed {
+		t.Fatalf("got %v", err)
+	}
+}
+
+func TestInterleaveFamilies(t *testing.T) {
+	remotes := testRemotes("10.0.0.1", "10.0.0.2", "10.0.0.3", "2001:db8::1", "2001:db8::2")
+	want := []int{0, 3, 1, 4, 2}
+	for i, r := range interleaveFamilies(remotes) {
+		if r != remotes[want[i]] {
+			t.Fatalf("got %v at %d; want %v", r, i, remotes[want[i]])
+		}
+	}
+
+	remotes = testRemotes("2001:db8::1", "10.0.0.1", "10.0.0.2")
+	want = []int{0, 1, 2}
+	for i, r := range interleaveFamilies(remotes) {
+		if r != remotes[want[i]] {
+			t.Fatalf("got %v at %d; want %v", r, i, remotes[want[i]])
+		}
+	}
+}
+
+func TestPreferReachable(t *testing.T) {
+	c := &Client{}
+	remotes := testRemotes("2001:db8::1", "10.0.0.1")
+	stats := c.serverStatsFor(remoteAddr(remotes[0]))
+
+	stats.fail()
+	if order := c.preferReachable(remotes); order[0] != remotes[1] || order[1] != remotes[0] {
+		t.Fatalf("unexpected order after a failed dial: %v", order)
+	}
+	if !stats.unreachable(time.Now()) || stats.unreachable(time.Now().Add(unreachableFor)) {
+		t.Fatal("failed dials should only be remembered for a while")
+	}
+	stats.dialed()
+	if order := c.preferReachable(remotes); order[0] != remotes[0] {
+		t.Fatalf("unexpected order after a successful dial: %v", order)
+	}
+}
@@ -0,0 +1,195 @@
+package client
+
+import (
+	"errors"
+	"fmt"
+	"net"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/cloudflare/cfssl/log"
+	"github.com/miekg/dns"
+)
+
+// LookupSRV resolves the SRV records for name (e.g.
+// "_keyless._tcp.example.com") with the resolvers list sequentially until one
+// resolver can answer the request. It falls back to the system resolver if none
+// of the resolvers can answer. Records are returned sorted by priority.
+func LookupSRV(resolvers []string, name string) ([]*net.SRV, error) {
+	var srvs []*net.SRV
+
+	m := new(dns.Msg)
+	dnsClient := new(dns.Client)
+	dnsClient.Net = "tcp"
+	for _, resolver := range resolvers {
+		m.SetQuestion(dns.Fqdn(name), dns.TypeSRV)
+		in, _, err := dnsClient.Exchange(m, resolver)
+		if err != nil {
+			log.Warningf("fail to get SRV records for %s with %s: %v", name, resolver, err)
+			continue
+		}
+		for _, rr := range in.Answer {
+			if srv, ok := rr.(*dns.SRV); ok {
+				log.Debugf("resolve %s to %s", name, srv)
+				srvs = append(srvs, &net.SRV{
+					Target:   srv.Target,
+					Port:     srv.Port,
+					Priority: srv.Priority,
+					Weight:   srv.Weight,
+				})
+			}
+		}
+		if len(srvs) != 0 {
+			break
+		}
+	}
+
+	if len(srvs) == 0 {
+		_, addrs, err := net.LookupSRV("", "", name)
+		if err != nil {
+			return nil, err
+		}
+		srvs = addrs
+	}
+
+	sort.SliceStable(srvs, func(i, j int) bool { return srvs[i].Priority < srvs[j].Priority })
+	return srvs, nil
+}
+
+// lookupServersSRV resolves the SRV records for name and the addresses of each
+// target, and returns a Remote for each usable address.
+func (c *Client) lookupServersSRV(serverName, name string) ([]Remote, error) {
+	srvs, err := LookupSRV(c.Resolvers, name)
+	if err != nil {
+		return nil, err
+	}
+
+	var servers []Remote
+	for _, srv := range srvs {
+		host := strings.TrimSuffix(srv.Target, ".")
+		sn := serverName
+		if sn == "" {
+			sn = host
+		}
+		rs, err := c.lookupServers(sn, host, strconv.Itoa(int(srv.Port)))
+		if err != nil {
+			log.Warningf("fail to resolve SRV target %s of %s: %v", host, name, err)
+			continue
+		}
+		servers = append(servers, rs...)
+	}
+	if len(servers) == 0 {
+		return nil, fmt.Errorf("no usable SRV targets for %s", name)
+	}
+	return servers, nil
+}
+
+// LookupServerSRV uses DNS SRV records to look up a group of Remote servers.
+// If serverName is empty, each target's hostname is used for TLS verification.
+func (c *Client) LookupServerSRV(serverName, name string) (Remote, error) {
+	servers, err := c.lookupServersSRV(serverName, name)
+	if err != nil {
+		return nil, err
+	}
+	return NewGroup(servers)
+}
+
+// Update replaces the members of the group with remotes. Latency measurements
+// are kept for members which are still present. An empty list is rejected so
+// that a transient resolution failure cannot empty the group.
+func (g *Group) Update(remotes []Remote) error {
+	if len(remotes) == 0 {
+		return errors.New("attempted to update remote group with no remotes")
+	}
+
+	g.Lock()
+	defer g.Unlock()
+
+	old := make(map[string]mRemote, len(g.remotes))
+	for _, r := range g.remotes {
+		if addr := remoteAddr(r.Remote); addr != "" {
+			old[addr] = r
+		}
+	}
+
+	updated := make([]mRemote, 0, len(remotes))
+	for _, r := range remotes {
+		if m, ok := old[remoteAddr(r)]; ok {
+			updated = append(updated, m)
+			continue
+		}
+		updated = append(updated, mRemote{Remote: r})
+	}
+	g.remotes = updated
+	return nil
+}
+
+// A Watcher periodically re-resolves a DNS name and updates the members of a
+// Group to match.
+type Watcher struct {
+	group  *Group
+	lookup func() ([]Remote, error)
+	done   chan struct{}
+}
+
+// Group returns the group maintained by the watcher.
+func (w *Watcher) Group() *Group { return w.group }
+
+// Stop stops re-resolving. The group keeps its current members.
+func (w *Watcher) Stop() { close(w.done) }
+
+func (w *Watcher) run(interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ticker.C:
+		case <-w.done:
+			return
+		}
+
+		remotes, err := w.lookup()
+		if err != nil {
+			log.Warningf("failed to re-resolve keyservers: %v", err)
+			continue
+		}
+		if err := w.group.Update(remotes); err != nil {
+			log.Warningf("failed to update keyservers: %v", err)
+		}
+	}
+}
+
+func newWatcher(lookup func() ([]Remote, error), interval time.Duration) (*Watcher, error) {
+	if interval <= 0 {
+		return nil, errors.New("re-resolution interval must be positive")
+	}
+	remotes, err := lookup()
+	if err != nil {
+		return nil, err
+	}
+	g, err := NewGroup(remotes)
+	if err != nil {
+		return nil, err
+	}
+	w := &Watcher{group: g, lookup: lookup, done: make(chan struct{})}
+	go w.run(interval)
+	return w, nil
+}
+
+// WatchServer resolves hostport every interval, adding and removing members of
+// the watcher's group as DNS records change.
+func (c *Client) WatchServer(serverName, hostport string, interval time.Duration) (*Watcher, error) {
+	host, port, err := net.SplitHostPort(hostport)
+	if err != nil {
+		return nil, err
+	}
+	return newWatcher(func() ([]Remote, error) { return c.lookupServers(serverName, host, port) }, interval)
+}
+
+// WatchServerSRV resolves the SRV records for name every interval, adding and
+// removing members of the watcher's group as DNS records change.
+func (c *Client) WatchServerSRV(serverName, name string, interval time.Duration) (*Watcher, error) {
+	return newWatcher(func() ([]Remote, error) { return c.lookupServersSRV(serverName, name) }, interval)
+}
@@ -0,0 +1,78 @@
+package client
+
+import (
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestGroupUpdate(t *testing.T) {
+	remotes := testRemotes("10.0.0.1", "10.0.0.2")
+	g, err := NewGroup(remotes)
+	if err != nil {
+		t.Fatal(err)
+	}
+	g.remotes[0].latency.val = time.Millisecond
+
+	if err := g.Update(nil); err == nil {
+		t.Fatal("expected error updating group with no remotes")
+	}
+
+	if err := g.Update(testRemotes("10.0.0.1", "10.0.0.3")); err != nil {
+		t.Fatal(err)
+	}
+	if len(g.remotes) != 2 {
+		t.Fatalf("got %d remotes; want 2", len(g.remotes))
+	}
+	if g.remotes[0].Remote != remotes[0] || g.remotes[0].latency.val != time.Millisecond {
+		t.Fatal("existing remote was not preserved")
+	}
+	if remoteAddr(g.remotes[1].Remote) != "10.0.0.3:2407" {
+		t.Fatalf("unexpected new remote %v", g.remotes[1].Remote)
+	}
+}
+
+func TestWatcher(t *testing.T) {
+	var mtx sync.Mutex
+	ips := []string{"10.0.0.1"}
+	lookup := func() ([]Remote, error) {
+		mtx.Lock()
+		defer mtx.Unlock()
+		return testRemotes(ips...), nil
+	}
+
+	w, err := newWatcher(lookup, 10*time.Millisecond)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer w.Stop()
+
+	mtx.Lock()
+	ips = []string{"10.0.0.2", "10.0.0.3"}
+	mtx.Unlock()
+
+	deadline := time.Now().Add(5 * time.Second)
+	for {
+		w.Group().RLock()
+		n := len(w.Group().remotes)
+		w.Group().RUnlock()
+		if n == 2 {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatal("watcher did not pick up new records")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+func TestWatchServer(t *testing.T) {
+	w, err := c.WatchServer("localhost", "127.0.0.1:2407", time.Hour)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer w.Stop()
+	if len(w.Group().remotes) != 1 {
+		t.Fatalf("got %d remotes; want 1", len(w.Group().remotes))
+	}
+}
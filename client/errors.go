@@ -0,0 +1,63 @@
+package client
+
+import (
+	"errors"
+	"fmt"
+
+	"github.com/cloudflare/gokeyless/protocol"
+)
+
+// ErrUnexpectedResponse is returned when a keyserver answers an operation
+// with something other than a response or an error.
+var ErrUnexpectedResponse = errors.New("keyserver sent an unexpected response")
+
+// ErrEmptyResponse is returned when a keyserver answers an operation which
+// must return data with an empty payload.
+var ErrEmptyResponse = errors.New("keyserver sent an empty response")
+
+// An OperationError is returned when a keyserver answers an operation with an
+// error. It wraps the protocol.Error sent by the server, so callers can test
+// for a particular failure with errors.Is:
+//
+//	if errors.Is(err, protocol.ErrKeyNotFound) { ... }
+//
+// or get at the operation and server with errors.As.
+type OperationError struct {
+	// Op is the opcode of the failed operation.
+	Op protocol.Op
+	// Server is the address of the keyserver which failed the operation.
+	Server string
+	// Code is the error sent by the keyserver.
+	Code protocol.Error
+}
+
+func (e *OperationError) Error() string {
+	return fmt.Sprintf("%v on %s: %v", e.Op, e.Server, e.Code)
+}
+
+// Unwrap returns e.Code.
+func (e *OperationError) Unwrap() error {
+	return e.Code
+}
+
+// Temporary reports whether the operation may succeed if retried later.
+func (e *OperationError) Temporary() bool {
+	return e.Code.Temporary()
+}
+
+// responseError returns the error with which server answered op with result,
+// or nil if it sent a response.
+func responseError(server string, op protocol.Op, result *protocol.Operation) error {
+	switch result.Opcode {
+	case protocol.OpResponse:
+		return nil
+	case protocol.OpError:
+		code := protocol.ErrInternal
+		if len(result.Payload) == 1 {
+			code = protocol.Error(result.Payload[0])
+		}
+		return &OperationError{Op: op, Server: server, Code: code}
+	default:
+		return fmt.Errorf("%w: %v", ErrUnexpectedResponse, result.Opcode)
+	}
+}
@@ -0,0 +1,33 @@
+package client
+
+import (
+	"errors"
+	"testing"
+
+	"github.com/cloudflare/gokeyless/protocol"
+)
+
+func TestResponseError(t *testing.T) {
+	op := protocol.OpECDSASignSHA256
+	if err := responseError("keyserver", op, &protocol.Operation{Opcode: protocol.OpResponse}); err != nil {
+		t.Fatal(err)
+	}
+
+	result := protocol.MakeErrorOp(protocol.ErrThrottled)
+	err := responseError("keyserver", op, &result)
+	if !errors.Is(err, protocol.ErrThrottled) || errors.Is(err, protocol.ErrInternal) {
+		t.Fatalf("%v does not wrap the server's error", err)
+	}
+	var operr *OperationError
+	if !errors.As(err, &operr) {
+		t.Fatalf("got %T", err)
+	}
+	if operr.Op != op || operr.Server != "keyserver" || !operr.Temporary() {
+		t.Fatalf("got %+v", operr)
+	}
+
+	err = responseError("keyserver", op, &protocol.Operation{Opcode: protocol.OpPong})
+	if !errors.Is(err, ErrUnexpectedResponse) {
+		t.Fatalf("got %v for an unexpected opcode", err)
+	}
+}
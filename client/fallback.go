@@ -0,0 +1,73 @@
+package client
+
+import (
+	"bytes"
+	"crypto"
+	"fmt"
+
+	"github.com/cloudflare/cfssl/log"
+	"github.com/cloudflare/gokeyless/protocol"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+)
+
+var localFallbacks = promauto.NewCounterVec(prometheus.CounterOpts{
+	Name: "keyless_client_local_fallbacks",
+	Help: "Number of operations performed with a local fallback key because no keyserver could be reached.",
+}, []string{"op"})
+
+// AddFallbackKey registers priv as a local copy of a keyserver-backed key.
+// Operations on remote keys with the same public key are performed with priv
+// when no keyserver can be reached, e.g. because of a network outage. They
+// still fail as usual when a keyserver responds with an error.
+func (c *Client) AddFallbackKey(priv crypto.Signer) error {
+	ski, err := protocol.GetSKI(priv.Public())
+	if err != nil {
+		return err
+	}
+	c.fallbacks.Store(ski, priv)
+	return nil
+}
+
+// RemoveFallbackKey removes the fallback key registered for the public key
+// pub, if any.
+func (c *Client) RemoveFallbackKey(pub crypto.PublicKey) error {
+	ski, err := protocol.GetSKI(pub)
+	if err != nil {
+		return err
+	}
+	c.fallbacks.Delete(ski)
+	return nil
+}
+
+// fallbackKey returns the fallback key registered for key, or nil.
+func (c *Client) fallbackKey(key *PrivateKey) crypto.Signer {
+	v, ok := c.fallbacks.Load(key.ski)
+	if !ok {
+		return nil
+	}
+	priv := v.(crypto.Signer)
+	// Guard against SKI collisions by comparing the full public keys.
+	got, err := protocol.MarshalPublicKey(priv.Public())
+	if key.der == nil || err != nil || !bytes.Equal(key.der, got) {
+		return nil
+	}
+	return priv
+}
+
+// fallback performs op locally with the fallback key registered for key,
+// after err prevented it from reaching any keyserver. If there is no fallback
+// key, err is returned.
+func (key *PrivateKey) fallback(op protocol.Op, err error, local func(crypto.Signer) ([]byte, error)) ([]byte, error) {
+	priv := key.client.fallbackKey(key)
+	if priv == nil {
+		return nil, err
+	}
+	log.Warningf("no keyserver reachable for %v on key %v, using local key: %v", op, key.ski, err)
+	localFallbacks.WithLabelValues(op.String()).Inc()
+	result, localErr := local(priv)
+	if localErr != nil {
+		return nil, fmt.Errorf("local fallback failed: %v (keyserver error: %v)", localErr, err)
+	}
+	return result, nil
+}
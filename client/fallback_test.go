@@ -0,0 +1,75 @@
+package client
+
+import (
+	"context"
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/tls"
+	"net"
+	"testing"
+)
+
+func TestFallbackKey(t *testing.T) {
+	// Reserve a port with nothing listening on it.
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	addr := l.Addr()
+	l.Close()
+
+	c := NewClient(tls.Certificate{}, nil)
+	c.DefaultRemote = NewServer(addr, "localhost")
+	priv, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	key, err := c.NewRemoteSignerByPublicKey(context.Background(), "", priv.Public())
+	if err != nil {
+		t.Fatal(err)
+	}
+	digest := sha256.Sum256([]byte("message"))
+
+	if _, err := key.Sign(rand.Reader, digest[:], crypto.SHA256); err == nil {
+		t.Fatal("signed without a keyserver or fallback key")
+	}
+
+	other, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := c.AddFallbackKey(other); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := key.Sign(rand.Reader, digest[:], crypto.SHA256); err == nil {
+		t.Fatal("signed with the fallback key of another public key")
+	}
+
+	if err := c.AddFallbackKey(priv); err != nil {
+		t.Fatal(err)
+	}
+	sig, err := key.Sign(rand.Reader, digest[:], crypto.SHA256)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !ecdsa.VerifyASN1(&priv.PublicKey, digest[:], sig) {
+		t.Fatal("fallback signature does not verify")
+	}
+	sigs, err := key.(*PrivateKey).SignBatch([][]byte{digest[:], digest[:]}, crypto.SHA256)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(sigs) != 2 || !ecdsa.VerifyASN1(&priv.PublicKey, digest[:], sigs[1]) {
+		t.Fatal("fallback batch signatures do not verify")
+	}
+
+	if err := c.RemoveFallbackKey(priv.Public()); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := key.Sign(rand.Reader, digest[:], crypto.SHA256); err == nil {
+		t.Fatal("signed with a removed fallback key")
+	}
+}
@@ -0,0 +1,207 @@
+package client
+
+import (
+	"context"
+	"errors"
+	"math"
+	"math/rand"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/cloudflare/cfssl/log"
+	"github.com/cloudflare/gokeyless/protocol"
+)
+
+const (
+	// defaultHedgePercentile is the latency percentile after which requests
+	// are hedged unless set otherwise.
+	defaultHedgePercentile = 0.95
+	// hedgeWindow is the number of recent latencies the hedging delay is
+	// derived from.
+	hedgeWindow = 256
+	// hedgeMinSamples is the number of latencies needed before the hedging
+	// delay is derived from them.
+	hedgeMinSamples = 20
+)
+
+// A HedgingPolicy makes a Client send a duplicate of a request to a second
+// keyserver of a Group when the first hasn't answered within a delay derived
+// from recent request latencies. The first response is used and the other
+// request is cancelled, which cuts tail latency while a keyserver is
+// transiently slow, at the cost of some extra load.
+type HedgingPolicy struct {
+	// Percentile of the latencies of recent successful requests, across all
+	// keyservers, after which a request is hedged, e.g. 0.95. It defaults to
+	// 0.95.
+	Percentile float64
+	// MinDelay is the least time a request waits before being hedged, so
+	// that requests aren't duplicated while every keyserver is fast.
+	MinDelay time.Duration
+	// MaxDelay, if positive, is the most time a request waits before being
+	// hedged. It is also the delay used until enough latencies have been
+	// recorded; if it is zero, requests aren't hedged until then.
+	MaxDelay time.Duration
+}
+
+// HedgeMetrics is implemented by Metrics which also record the requests a
+// Client hedges when its Hedging is set.
+type HedgeMetrics interface {
+	// ObserveHedge records that a request was duplicated to the keyserver at
+	// addr, and whether that keyserver answered first.
+	ObserveHedge(addr string, won bool)
+}
+
+func (c *Client) observeHedge(addr string, won bool) {
+	if m, ok := c.Metrics.(HedgeMetrics); ok {
+		m.ObserveHedge(addr, won)
+	}
+}
+
+// latencyWindow holds the latencies of recent successful requests.
+type latencyWindow struct {
+	mtx     sync.Mutex
+	samples [hedgeWindow]time.Duration
+	// n is the number of samples recorded, which wrap around the window.
+	n int
+}
+
+func (w *latencyWindow) record(latency time.Duration) {
+	w.mtx.Lock()
+	w.samples[w.n%hedgeWindow] = latency
+	w.n++
+	w.mtx.Unlock()
+}
+
+// percentile returns the p-th percentile of the recorded latencies, and false
+// if there are too few of them.
+func (w *latencyWindow) percentile(p float64) (time.Duration, bool) {
+	w.mtx.Lock()
+	n := w.n
+	if n > hedgeWindow {
+		n = hedgeWindow
+	}
+	samples := make([]time.Duration, n)
+	copy(samples, w.samples[:n])
+	w.mtx.Unlock()
+
+	if n < hedgeMinSamples {
+		return 0, false
+	}
+	sort.Slice(samples, func(i, j int) bool { return samples[i] < samples[j] })
+	i := int(math.Ceil(p*float64(n))) - 1
+	if i < 0 {
+		i = 0
+	} else if i >= n {
+		i = n - 1
+	}
+	return samples[i], true
+}
+
+// hedgeDelay returns how long a request waits before being hedged, and false
+// if it shouldn't be hedged.
+func (c *Client) hedgeDelay() (time.Duration, bool) {
+	p := c.Hedging.Percentile
+	if p <= 0 || p > 1 {
+		p = defaultHedgePercentile
+	}
+	delay, ok := c.latencies.percentile(p)
+	if !ok {
+		return c.Hedging.MaxDelay, c.Hedging.MaxDelay > 0
+	}
+	if delay < c.Hedging.MinDelay {
+		delay = c.Hedging.MinDelay
+	}
+	if c.Hedging.MaxDelay > 0 && delay > c.Hedging.MaxDelay {
+		delay = c.Hedging.MaxDelay
+	}
+	return delay, true
+}
+
+// dialOther dials a member of g other than the server at addr, to hedge a
+// request sent to it. Only one server is tried, so that the hedged request
+// isn't delayed further.
+func (g *Group) dialOther(ctx context.Context, c *Client, addr string) (*Conn, error) {
+	g.RLock()
+	var remotes []Remote
+	for _, r := range g.remotes {
+		if remoteAddr(r.Remote) != addr {
+			remotes = append(remotes, r.Remote)
+		}
+	}
+	g.RUnlock()
+
+	if c.Balancer != nil {
+		remotes = c.order(ctx, remotes)
+	} else {
+		rand.Shuffle(len(remotes), func(i, j int) { remotes[i], remotes[j] = remotes[j], remotes[i] })
+	}
+	remotes = c.preferReachable(remotes)
+	if c.CircuitBreaker != nil {
+		remotes = c.preferAvailable(remotes)
+	}
+	if len(remotes) == 0 {
+		return nil, errors.New("no other keyserver in group")
+	}
+	return c.DialContext(ctx, remotes[0])
+}
+
+// hedgeOutcome is the outcome of one of the requests of a hedged operation.
+type hedgeOutcome struct {
+	result *protocol.Operation
+	addr   string
+	retry  bool
+	err    error
+}
+
+// hedge performs op on conn as attempt does and, if no response has arrived
+// within the Client's hedging delay, also on another server of g. The first
+// successful response is returned and the other request is cancelled. If both
+// fail, the error of the last one is returned.
+func (key *PrivateKey) hedge(ctx context.Context, g *Group, conn *Conn, op protocol.Op, msg []byte) (*protocol.Operation, string, bool, error) {
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+	// The channel is buffered so that the request which loses never blocks.
+	outcomes := make(chan hedgeOutcome, 2)
+	run := func(conn *Conn) {
+		result, retry, err := key.attempt(ctx, conn, op, msg)
+		outcomes <- hedgeOutcome{result, conn.addr, retry, err}
+	}
+	go run(conn)
+
+	var timeout <-chan time.Time
+	if delay, ok := key.client.hedgeDelay(); ok {
+		timer := time.NewTimer(delay)
+		defer timer.Stop()
+		timeout = timer.C
+	}
+	var hedgeAddr string
+	var last hedgeOutcome
+	for pending := 1; pending > 0; {
+		select {
+		case o := <-outcomes:
+			pending--
+			if o.err == nil {
+				if hedgeAddr != "" {
+					key.client.observeHedge(hedgeAddr, o.addr == hedgeAddr)
+				}
+				return o.result, o.addr, false, nil
+			}
+			last = o
+		case <-timeout:
+			timeout = nil
+			hedged, err := g.dialOther(ctx, key.client, conn.addr)
+			if err != nil {
+				log.Debugf("failed to hedge %v request to %s: %v", op, conn.addr, err)
+				continue
+			}
+			hedgeAddr = hedged.addr
+			pending++
+			go run(hedged)
+		}
+	}
+	if hedgeAddr != "" {
+		key.client.observeHedge(hedgeAddr, false)
+	}
+	return last.result, last.addr, last.retry, last.err
+}
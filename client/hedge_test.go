@@ -0,0 +1,145 @@
+package client
+
+import (
+	"context"
+	"crypto"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/tls"
+	"net"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/cloudflare/gokeyless/protocol"
+	"github.com/cloudflare/gokeyless/server"
+)
+
+func TestHedgeDelay(t *testing.T) {
+	c := NewClient(tls.Certificate{}, nil)
+	c.Hedging = &HedgingPolicy{}
+	if _, ok := c.hedgeDelay(); ok {
+		t.Fatal("hedged without latencies or MaxDelay")
+	}
+	c.Hedging.MaxDelay = time.Second
+	if delay, ok := c.hedgeDelay(); !ok || delay != time.Second {
+		t.Fatalf("got %v, %v without latencies", delay, ok)
+	}
+
+	for i := 1; i <= 100; i++ {
+		c.latencies.record(time.Duration(i) * time.Millisecond)
+	}
+	if delay, _ := c.hedgeDelay(); delay != 95*time.Millisecond {
+		t.Fatalf("got %v for the default percentile", delay)
+	}
+	c.Hedging.Percentile = 0.5
+	if delay, _ := c.hedgeDelay(); delay != 50*time.Millisecond {
+		t.Fatalf("got %v for the median", delay)
+	}
+	c.Hedging.MinDelay = 60 * time.Millisecond
+	if delay, _ := c.hedgeDelay(); delay != 60*time.Millisecond {
+		t.Fatalf("got %v below MinDelay", delay)
+	}
+	c.Hedging.MaxDelay = 10 * time.Millisecond
+	if delay, _ := c.hedgeDelay(); delay != 10*time.Millisecond {
+		t.Fatalf("got %v above MaxDelay", delay)
+	}
+
+	// Only the most recent latencies count.
+	for i := 0; i < hedgeWindow; i++ {
+		c.latencies.record(time.Second)
+	}
+	c.Hedging = &HedgingPolicy{}
+	if delay, _ := c.hedgeDelay(); delay != time.Second {
+		t.Fatalf("got %v after the window wrapped", delay)
+	}
+}
+
+// orderedBalancer dials remotes in the order they were given.
+type orderedBalancer struct{}
+
+func (orderedBalancer) Order(c *Client, remotes []Remote) []Remote { return remotes }
+
+type hedgeMetrics struct {
+	mtx    sync.Mutex
+	hedges map[string]bool
+}
+
+func (m *hedgeMetrics) ObserveRequest(string, protocol.Op, time.Duration, error) {}
+func (m *hedgeMetrics) ObserveDial(string, time.Duration, error)                 {}
+func (m *hedgeMetrics) ObserveHedge(addr string, won bool) {
+	m.mtx.Lock()
+	defer m.mtx.Unlock()
+	m.hedges[addr] = won
+}
+
+func TestHedge(t *testing.T) {
+	// The slow server holds requests until the test ends or they are
+	// cancelled.
+	release := make(chan struct{})
+	slowConfig := server.DefaultServeConfig().WithMiddleware(func(next server.Handler) server.Handler {
+		return server.HandlerFunc(func(ctx context.Context, op *protocol.Operation) protocol.Operation {
+			select {
+			case <-release:
+			case <-ctx.Done():
+			}
+			return next.Handle(ctx, op)
+		})
+	})
+	slow, err := server.NewServerFromFile(slowConfig, serverCert, serverKey, keylessCA)
+	if err != nil {
+		t.Fatal(err)
+	}
+	slow.TLSConfig().Time = fixedCurrentTime
+	keys, err := server.NewKeystoreFromDir("testdata", LoadKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	slow.SetKeystore(keys)
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	go slow.Serve(l)
+	defer slow.Close()
+	defer close(release)
+
+	fastAddr, err := net.ResolveTCPAddr("tcp", sAddr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	group, err := NewGroup([]Remote{NewServer(l.Addr(), "localhost"), NewServer(fastAddr, "localhost")})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	metrics := &hedgeMetrics{hedges: make(map[string]bool)}
+	c2, err := NewClientFromFile(clientCert, clientKey, keyserverCA)
+	if err != nil {
+		t.Fatal(err)
+	}
+	c2.Config.Time = fixedCurrentTime
+	c2.Dialer.Timeout = 3 * time.Second
+	c2.DefaultRemote = group
+	c2.Balancer = orderedBalancer{}
+	c2.Metrics = metrics
+	c2.Hedging = &HedgingPolicy{MaxDelay: 20 * time.Millisecond}
+
+	key, err := c2.NewRemoteSignerByPublicKey(context.Background(), "", ecdsaSigner.Public())
+	if err != nil {
+		t.Fatal(err)
+	}
+	digest := sha256.Sum256([]byte("message"))
+	start := time.Now()
+	if _, err := key.Sign(rand.Reader, digest[:], crypto.SHA256); err != nil {
+		t.Fatal(err)
+	}
+	if elapsed := time.Since(start); elapsed > 2*time.Second {
+		t.Fatalf("hedged request took %v", elapsed)
+	}
+	metrics.mtx.Lock()
+	defer metrics.mtx.Unlock()
+	if won, ok := metrics.hedges[fastAddr.String()]; !ok || !won {
+		t.Fatalf("observed hedges %v", metrics.hedges)
+	}
+}
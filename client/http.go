@@ -0,0 +1,162 @@
+package client
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"crypto/tls"
+	"fmt"
+	"net"
+	"net/http"
+	"net/url"
+	"sync"
+
+	"github.com/cloudflare/cfssl/log"
+	"github.com/cloudflare/gokeyless/conn"
+	"golang.org/x/net/http2"
+)
+
+// An httpRemote is a keyserver reached over HTTP/2, with each operation sent
+// as a POST request. See server.Server.HTTPHandler.
+type httpRemote struct {
+	url *url.URL
+}
+
+// NewHTTPRemote returns a Remote which sends operations over HTTP/2 to the
+// keyless HTTP handler at rawurl, e.g. https://keyserver.example.com/keyless.
+// This allows L7 load balancers and middleware to sit between the client and
+// the keyservers.
+func NewHTTPRemote(rawurl string) (Remote, error) {
+	u, err := url.Parse(rawurl)
+	if err != nil {
+		return nil, err
+	}
+	if u.Scheme != "https" {
+		return nil, fmt.Errorf("unsupported keyserver URL scheme %q", u.Scheme)
+	}
+	return &httpRemote{url: u}, nil
+}
+
+func (r *httpRemote) String() string {
+	return r.url.String()
+}
+
+// Dial returns a connection to the keyserver, reusing an existing one if
+// possible. Operations on the connection are multiplexed over HTTP/2.
+func (r *httpRemote) Dial(c *Client) (*Conn, error) {
+	return r.DialContext(context.Background(), c)
+}
+
+// DialContext is like Dial, but gives up when ctx is done.
+func (r *httpRemote) DialContext(ctx context.Context, c *Client) (*Conn, error) {
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+	addr := r.url.Host
+	if r.url.Port() == "" {
+		addr = net.JoinHostPort(r.url.Hostname(), "443")
+	}
+
+	cn := connPool.Get(connKey{r.String(), c})
+	if cn != nil {
+		return cn, nil
+	}
+
+	config := c.tlsConfig(r.url.Hostname())
+	// cert is the certificate of the first connection, which is attested.
+	// Later connections must present the same one.
+	var (
+		cert    []byte
+		certMtx sync.Mutex
+	)
+	transport := &http2.Transport{
+		TLSClientConfig: config,
+		DialTLS: func(network, _ string, config *tls.Config) (net.Conn, error) {
+			log.Debugf("Dialing %s at %s\n", config.ServerName, addr)
+			// The transport dials lazily, for any request, so the dial
+			// isn't bound to the context of the one which triggered it.
+			inner, err := c.dialTLS(context.Background(), network, addr, config)
+			if err != nil {
+				return nil, err
+			}
+			if p := inner.ConnectionState().NegotiatedProtocol; p != http2.NextProtoTLS {
+				inner.Close()
+				return nil, fmt.Errorf("server %s does not support HTTP/2 (negotiated %q)", addr, p)
+			}
+			peer := inner.ConnectionState().PeerCertificates[0].Raw
+			certMtx.Lock()
+			defer certMtx.Unlock()
+			if cert == nil {
+				cert = peer
+			} else if c.Attestation != nil && !bytes.Equal(cert, peer) {
+				inner.Close()
+				return nil, fmt.Errorf("server %s: %w: certificate changed", addr, ErrNotAttested)
+			}
+			return inner, nil
+		},
+	}
+	var rt http.RoundTripper = transport
+	if c.Token != nil {
+		rt = &tokenTransport{transport, c.Token}
+	}
+	cn = NewConn(r.String(), conn.NewHTTPConn(&http.Client{Transport: rt}, r.String()))
+	cn.client = c
+
+	// Make sure the keyserver is reachable before handing out the connection.
+	if err := cn.Conn.Ping(ctx, nil); err != nil {
+		cn.Close()
+		return nil, err
+	}
+	if c.Features != nil {
+		features, err := cn.Conn.Hello(ctx, *c.Features)
+		if err != nil {
+			cn.Close()
+			return nil, fmt.Errorf("hello to %s failed: %w", r.String(), err)
+		}
+		log.Debugf("negotiated protocol version %d with %s", features.Version, r.String())
+	}
+	certMtx.Lock()
+	attested := cert
+	certMtx.Unlock()
+	if attested != nil {
+		cn.peerCerts = []Fingerprint{sha256.Sum256(attested)}
+	}
+	if c.Attestation != nil {
+		if err := c.Attestation.verify(ctx, cn.Conn, attested); err != nil {
+			cn.Close()
+			return nil, fmt.Errorf("server %s: %w", r.String(), err)
+		}
+	}
+	connPool.Add(cn)
+
+	return cn, nil
+}
+
+// PingAll simply attempts to ping the keyserver.
+func (r *httpRemote) PingAll(c *Client, concurrency int) {
+	cn, err := r.Dial(c)
+	if err != nil {
+		return
+	}
+
+	err = cn.Conn.Ping(context.Background(), nil)
+	if err != nil {
+		cn.Close()
+	}
+}
+
+// tokenTransport adds the client's bearer token to each request.
+type tokenTransport struct {
+	http.RoundTripper
+	token func(ctx context.Context) (string, error)
+}
+
+func (t *tokenTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	token, err := t.token(req.Context())
+	if err != nil {
+		return nil, err
+	}
+	req = req.Clone(req.Context())
+	req.Header.Set("Authorization", "Bearer "+token)
+	return t.RoundTripper.RoundTrip(req)
+}
@@ -1,18 +1,23 @@
 package client
 
 import (
+	"bytes"
 	"context"
 	"crypto"
 	"crypto/ecdsa"
 	"crypto/rsa"
 	"crypto/subtle"
+	"crypto/x509"
 	"errors"
 	"fmt"
 	"io"
 	"net"
+	"time"
 
 	"github.com/cloudflare/cfssl/log"
 	"github.com/cloudflare/gokeyless/protocol"
+	"github.com/cloudflare/gokeyless/sm2"
+	"github.com/cloudflare/gokeyless/sm3"
 	"github.com/cloudflare/gokeyless/tracing"
 	"github.com/opentracing/opentracing-go"
 	"github.com/opentracing/opentracing-go/ext"
@@ -40,7 +45,7 @@ var (
 
 func signOpFromSignerOpts(key *PrivateKey, opts crypto.SignerOpts) protocol.Op {
 	if opts, ok := opts.(*rsa.PSSOptions); ok {
-		if _, ok := key.Public().(*rsa.PublicKey); !ok {
+		if key.alg != x509.RSA {
 			return protocol.OpError
 		}
 		// Keyless only implements RSA-PSS with salt length == hash length,
@@ -61,27 +66,36 @@ func signOpFromSignerOpts(key *PrivateKey, opts crypto.SignerOpts) protocol.Op {
 			return protocol.OpError
 		}
 	}
-	switch key.Public().(type) {
-	case *rsa.PublicKey:
+	if _, ok := key.public.(*sm2.PublicKey); ok {
+		// SM2 signs an SM3 digest of the signer's identity and the message.
+		if opts.HashFunc() != 0 {
+			return protocol.OpError
+		}
+		return protocol.OpSM2SignSM3
+	}
+	switch key.alg {
+	case x509.RSA:
 		if value, ok := rsaCrypto[opts.HashFunc()]; ok {
 			return value
 		} else {
 			return protocol.OpError
 		}
-	case *ecdsa.PublicKey:
+	case x509.ECDSA:
 		if value, ok := ecdsaCrypto[opts.HashFunc()]; ok {
 			return value
 		} else {
 			return protocol.OpError
 		}
-	case ed25519.PublicKey:
+	case x509.Ed25519:
 		return protocol.OpEd25519Sign
 	default:
 		return protocol.OpError
 	}
 }
 
-// PrivateKey represents a keyless-backed RSA/ECDSA private key.
+// PrivateKey represents a keyless-backed RSA/ECDSA private key. Everything
+// derived from its public key is computed once by newPrivateKey, and never
+// changes afterwards.
 type PrivateKey struct {
 	public    crypto.PublicKey
 	client    *Client
@@ -91,83 +105,232 @@ type PrivateKey struct {
 	keyserver string
 	sni       string
 	certID    string
+	// ski256 is the SHA-256 SKI of the key, sent instead of ski to servers
+	// which negotiated protocol.SKISchemeSHA256, or zero if unknown.
+	ski256 protocol.SKI
+	// alg is the algorithm of public.
+	alg x509.PublicKeyAlgorithm
+	// der is the DER encoding of public, or nil if it can't be encoded.
+	der []byte
+	// digest is the digest of public if it is an RSA key, or zero.
+	digest protocol.Digest
 
 	// We have shove the span context inside PrivateKey because
 	// it's used by calling functions on the `crypto.Signer` interface, which don't take ctx as a parameter.
 	JaegerSpan []byte
 }
 
+// newPrivateKey returns the key identified by ski on keyserver, with the
+// metadata derived from pub.
+func newPrivateKey(c *Client, keyserver string, ski protocol.SKI, pub crypto.PublicKey, sni, certID string, serverIP net.IP) PrivateKey {
+	key := PrivateKey{
+		public:    pub,
+		client:    c,
+		ski:       ski,
+		sni:       sni,
+		serverIP:  serverIP,
+		keyserver: keyserver,
+		certID:    certID,
+		ski256:    sha256SKI(ski, pub),
+	}
+	switch pub.(type) {
+	case *rsa.PublicKey:
+		key.alg = x509.RSA
+		key.digest, _ = protocol.GetDigest(pub)
+	case *ecdsa.PublicKey:
+		key.alg = x509.ECDSA
+	case ed25519.PublicKey:
+		key.alg = x509.Ed25519
+	}
+	if der, err := protocol.MarshalPublicKey(pub); err == nil {
+		key.der = der
+	}
+	return key
+}
+
 // Public returns the public key corresponding to the opaque private key.
 func (key *PrivateKey) Public() crypto.PublicKey {
 	return key.public
 }
 
+// SKI returns the SKI identifying the key on keyservers.
+func (key *PrivateKey) SKI() protocol.SKI {
+	return key.ski
+}
+
+// Digest returns the digest of the key's modulus if it is an RSA key, or
+// else the zero Digest.
+func (key *PrivateKey) Digest() protocol.Digest {
+	return key.digest
+}
+
+// Equal reports whether x is a keyless-backed key with the same public key,
+// so that keys work with x509.CreateCertificate and other helpers which
+// compare private keys.
+func (key *PrivateKey) Equal(x crypto.PrivateKey) bool {
+	var other *PrivateKey
+	switch x := x.(type) {
+	case *PrivateKey:
+		other = x
+	case *Decrypter:
+		other = &x.PrivateKey
+	default:
+		return false
+	}
+	if key.der == nil || other.der == nil {
+		return key.der == nil && other.der == nil && key.ski == other.ski
+	}
+	return bytes.Equal(key.der, other.der)
+}
+
 // execute performs an opaque cryptographic operation on a server associated
-// with the key.
-func (key *PrivateKey) execute(ctx context.Context, op protocol.Op, msg []byte) ([]byte, error) {
+// with the key. If no server can be reached, the operation is performed by
+// local with the Client's fallback key, if there is one. Once ctx is done, the
+// operation is neither retried nor performed locally.
+func (key *PrivateKey) execute(ctx context.Context, op protocol.Op, msg []byte, local func(crypto.Signer) ([]byte, error)) ([]byte, error) {
 	span, ctx := opentracing.StartSpanFromContext(ctx, "PrivateKey.execute")
 	defer span.Finish()
 	var result *protocol.Operation
+	var addr string
 	// retry once if connection returned by remote Dial is problematic.
 	for attempts := 2; attempts > 0; attempts-- {
-		r, err := key.client.getRemote(key.keyserver)
+		r, err := key.client.remoteFor(key)
 		if err != nil {
-			return nil, err
+			return key.fallback(op, err, local)
 		}
 
-		conn, err := r.Dial(key.client)
+		conn, err := key.client.DialContext(ctx, r)
 		if err != nil {
-			return nil, err
+			if ctx.Err() != nil {
+				return nil, err
+			}
+			return key.fallback(op, err, local)
 		}
 
-		// We explicitly do NOT want to fill in JaegerSpan here, since the remote keyless server
-		// will error if it does know how to handle that Tag
-		// https://github.com/cloudflare/gokeyless/pull/276 makes it safe to fill it in,
-		// but there's no way to know the version of the remote keyserver
-		result, err = conn.Conn.DoOperation(ctx, protocol.Operation{
-			Opcode:   op,
-			Payload:  msg,
-			SKI:      key.ski,
-			ClientIP: key.clientIP,
-			ServerIP: key.serverIP,
-			SNI:      key.sni,
-			CertID:   key.certID,
-		})
+		var retry bool
+		if g, ok := r.(*Group); ok && key.client.Hedging != nil {
+			result, addr, retry, err = key.hedge(ctx, g, conn, op, msg)
+		} else {
+			addr = conn.addr
+			result, retry, err = key.attempt(ctx, conn, op, msg)
+		}
 		if err != nil {
-			conn.Close()
+			if ctx.Err() != nil {
+				return nil, err
+			}
 			// not the last attempt, log error and retry
-			if attempts > 1 {
+			if retry && attempts > 1 {
 				log.Info("failed remote operation:", err)
 				log.Infof("retry new connection")
 				continue
 			}
-			return nil, err
+			return key.fallback(op, err, local)
 		}
-		conn.KeepAlive()
 		break
 	}
 
-	if result.Opcode != protocol.OpResponse {
-		if result.Opcode == protocol.OpError {
-			return nil, result.GetError()
-		}
-		return nil, fmt.Errorf("wrong response opcode: %v", result.Opcode)
+	if err := responseError(addr, op, result); err != nil {
+		return nil, err
 	}
-
 	if len(result.Payload) == 0 {
-		return nil, errors.New("empty payload")
+		return nil, ErrEmptyResponse
 	}
 
 	return result.Payload, nil
 }
 
+// skiFor returns the SKI of key in the scheme negotiated on conn.
+func (key *PrivateKey) skiFor(conn *Conn) protocol.SKI {
+	if !key.ski256.Valid() {
+		return key.ski
+	}
+	if features := conn.Conn.Features(); features.SKIScheme() == protocol.SKISchemeSHA256 {
+		return key.ski256
+	}
+	return key.ski
+}
+
+// sha256SKI returns the SHA-256 SKI of pub if ski is its SHA-1 SKI, or zero if
+// the key can't be identified by it.
+func sha256SKI(ski protocol.SKI, pub crypto.PublicKey) protocol.SKI {
+	if pub == nil {
+		return protocol.SKI{}
+	}
+	if sha1SKI, err := protocol.GetSKI(pub); err != nil || sha1SKI != ski {
+		return protocol.SKI{}
+	}
+	ski256, _ := protocol.GetSKIScheme(pub, protocol.SKISchemeSHA256)
+	return ski256
+}
+
+// attempt performs op on conn, which it returns to the connection pool or
+// closes once the response has arrived. retry reports whether the operation
+// failed because of the connection, so that it may be retried on a new one.
+func (key *PrivateKey) attempt(ctx context.Context, conn *Conn, op protocol.Op, msg []byte) (result *protocol.Operation, retry bool, err error) {
+	start := time.Now()
+	release, err := key.client.acquire(ctx, conn.addr)
+	if err != nil {
+		key.client.observeRequest(conn.addr, op, time.Since(start), err)
+		conn.KeepAlive()
+		return nil, false, err
+	}
+	stats := key.client.serverStatsFor(conn.addr)
+	stats.begin()
+	start = time.Now()
+	// We explicitly do NOT want to fill in JaegerSpan here, since the remote keyless server
+	// will error if it does know how to handle that Tag
+	// https://github.com/cloudflare/gokeyless/pull/276 makes it safe to fill it in,
+	// but there's no way to know the version of the remote keyserver
+	result, err = conn.Conn.DoOperation(ctx, protocol.Operation{
+		Opcode:   op,
+		Payload:  msg,
+		SKI:      key.skiFor(conn),
+		ClientIP: key.clientIP,
+		ServerIP: key.serverIP,
+		SNI:      key.sni,
+		CertID:   key.certID,
+	})
+	release()
+	latency := time.Since(start)
+	key.client.observeRequest(conn.addr, op, latency, operationError(result, err))
+	key.client.observeTiming(conn.addr, op, result)
+	key.client.recordServed(conn.addr, key, result)
+	if err != nil && ctx.Err() != nil {
+		if err == ctx.Err() {
+			// The operation was abandoned, but the connection is still
+			// usable.
+			conn.KeepAlive()
+		} else {
+			conn.Close()
+		}
+		stats.end(latency, nil)
+		return nil, false, err
+	}
+	stats.end(latency, err)
+	if err != nil {
+		conn.Close()
+		return nil, true, err
+	}
+	conn.KeepAlive()
+	if key.client.Hedging != nil && result.Opcode != protocol.OpError {
+		key.client.latencies.record(latency)
+	}
+	return result, false, nil
+}
+
 // Sign implements the crypto.Signer operation for the given key.
 func (key *PrivateKey) Sign(r io.Reader, msg []byte, opts crypto.SignerOpts) ([]byte, error) {
+	return key.SignContext(context.Background(), r, msg, opts)
+}
+
+// SignContext is like Sign, but gives up when ctx is done, e.g. when the
+// handshake which needs the signature is abandoned.
+func (key *PrivateKey) SignContext(ctx context.Context, r io.Reader, msg []byte, opts crypto.SignerOpts) ([]byte, error) {
 	spanCtx, err := tracing.SpanContextFromBinary(key.JaegerSpan)
 	if err != nil {
 		log.Errorf("failed to extract span: %v", err)
 	}
-	span, ctx := opentracing.StartSpanFromContext(context.Background(), "client: PrivateKey.Sign", ext.RPCServerOption(spanCtx))
+	span, ctx := opentracing.StartSpanFromContext(ctx, "client: PrivateKey.Sign", ext.RPCServerOption(spanCtx))
 	defer span.Finish()
 
 	// If opts specifies a hash function, then the message is expected to be the
@@ -180,30 +343,60 @@ func (key *PrivateKey) Sign(r io.Reader, msg []byte, opts crypto.SignerOpts) ([]
 	if op == protocol.OpError {
 		return nil, errors.New("invalid key type, hash or options")
 	}
-	return key.execute(ctx, op, msg)
+	if op == protocol.OpSM2SignSM3 && len(msg) != sm3.Size {
+		return nil, errors.New("input must be an SM3 digest, as computed by sm2.Digest")
+	}
+	sig, err := key.execute(ctx, op, msg, func(priv crypto.Signer) ([]byte, error) {
+		return priv.Sign(r, msg, opts)
+	})
+	if errors.Is(err, protocol.ErrBadOpcode) {
+		// Older keyservers don't implement every signing opcode (e.g. RSA-PSS).
+		return nil, fmt.Errorf("keyserver does not support %v: %w", op, err)
+	}
+	return sig, err
 }
 
-// Decrypter implements the Decrypt method on a PrivateKey.
+// Decrypter is an RSA PrivateKey, which also implements crypto.Decrypter.
+// PrivateKey itself must not, since crypto/tls refuses ECDSA keys which do.
 type Decrypter struct {
 	PrivateKey
 }
 
 // Decrypt implements the crypto.Decrypter operation for the given key.
 func (key *Decrypter) Decrypt(rand io.Reader, msg []byte, opts crypto.DecrypterOpts) ([]byte, error) {
+	return key.DecryptContext(context.Background(), rand, msg, opts)
+}
+
+// DecryptContext is like Decrypter.Decrypt, but gives up when ctx is done.
+// Only RSA keys support decryption.
+func (key *PrivateKey) DecryptContext(ctx context.Context, rand io.Reader, msg []byte, opts crypto.DecrypterOpts) ([]byte, error) {
+	if key.alg != x509.RSA {
+		return nil, errors.New("decryption is only supported for RSA keys")
+	}
+
 	spanCtx, err := tracing.SpanContextFromBinary(key.JaegerSpan)
 	if err != nil {
 		log.Errorf("failed to extract span: %v", err)
 	}
-	span, ctx := opentracing.StartSpanFromContext(context.Background(), "client: Decrypter.Decrypt", ext.RPCServerOption(spanCtx))
+	span, ctx := opentracing.StartSpanFromContext(ctx, "client: PrivateKey.Decrypt", ext.RPCServerOption(spanCtx))
 	defer span.Finish()
 	opts1v15, ok := opts.(*rsa.PKCS1v15DecryptOptions)
 	if opts != nil && !ok {
 		return nil, errors.New("invalid options for Decrypt")
 	}
 
-	ptxt, err := key.execute(ctx, protocol.OpRSADecrypt, msg)
-	if err != nil {
-		return nil, err
+	var local bool
+	ptxt, err := key.execute(ctx, protocol.OpRSADecrypt, msg, func(priv crypto.Signer) ([]byte, error) {
+		local = true
+		dec, ok := priv.(crypto.Decrypter)
+		if !ok || opts == nil {
+			// crypto.Decrypter has no raw RSA decryption.
+			return nil, errors.New("fallback key cannot perform this decryption")
+		}
+		return dec.Decrypt(rand, msg, opts)
+	})
+	if err != nil || local {
+		return ptxt, err
 	}
 
 	if ok {
@@ -0,0 +1,58 @@
+package client
+
+import (
+	"context"
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/tls"
+	"testing"
+
+	"github.com/cloudflare/gokeyless/protocol"
+)
+
+func TestPrivateKeyEqual(t *testing.T) {
+	c := NewClient(tls.Certificate{}, nil)
+	rsaPriv, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ecPriv, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	signer := func(pub crypto.PublicKey) crypto.Signer {
+		key, err := c.NewRemoteSignerByPublicKey(context.Background(), "", pub)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return key
+	}
+	type equaler interface {
+		Equal(crypto.PrivateKey) bool
+	}
+	rsaKey, rsaKey2, ecKey := signer(rsaPriv.Public()), signer(rsaPriv.Public()), signer(ecPriv.Public())
+
+	if !rsaKey.(equaler).Equal(rsaKey2) {
+		t.Fatal("keys with the same public key are not equal")
+	}
+	if rsaKey.(equaler).Equal(ecKey) || ecKey.(equaler).Equal(rsaKey) {
+		t.Fatal("keys with different public keys are equal")
+	}
+	if rsaKey.(equaler).Equal(rsaPriv) {
+		t.Fatal("keyless key is equal to a local key")
+	}
+
+	digest, err := protocol.GetDigest(rsaPriv.Public())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got := rsaKey.(*Decrypter).Digest(); got != digest {
+		t.Fatalf("got digest %x, want %x", got, digest)
+	}
+	if ecKey.(*PrivateKey).Digest().Valid() {
+		t.Fatal("ECDSA key has a digest")
+	}
+}
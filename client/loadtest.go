@@ -0,0 +1,217 @@
+package client
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"math"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/cloudflare/gokeyless/protocol"
+)
+
+// A LoadTester drives operations against a keyserver from a number of
+// concurrent workers and measures their latency, to help size a server's
+// worker pools before production.
+type LoadTester struct {
+	// Client is used to dial the keyserver.
+	Client *Client
+	// Server is the keyserver to load; if empty, Client.DefaultRemote is used.
+	Server string
+	// Concurrency is the number of workers, each of which waits for a
+	// response before sending its next request. It defaults to 1.
+	Concurrency int
+	// Duration is how long to run for. If zero, the test runs until Requests
+	// have been sent or the context is done.
+	Duration time.Duration
+	// Requests, if positive, limits the total number of requests sent.
+	Requests int
+	// Ops are the operations to send. Each worker cycles through them in
+	// order, so their mix determines the mix of key types and opcodes.
+	Ops []protocol.Operation
+}
+
+// LatencyStats summarises the requests of a load test.
+type LatencyStats struct {
+	Requests int
+	// Errors counts requests which failed or got an error response. They are
+	// not included in the latency percentiles.
+	Errors        int
+	P50, P95, P99 time.Duration
+	Max           time.Duration
+}
+
+// A LoadTestResult is the outcome of a load test.
+type LoadTestResult struct {
+	// Duration is the time from the first request to the last response.
+	Duration time.Duration
+	Total    LatencyStats
+	ByOpcode map[protocol.Op]LatencyStats
+}
+
+// Throughput returns the number of successful requests per second.
+func (r *LoadTestResult) Throughput() float64 {
+	if r.Duration <= 0 {
+		return 0
+	}
+	return float64(r.Total.Requests-r.Total.Errors) / r.Duration.Seconds()
+}
+
+func (r *LoadTestResult) String() string {
+	var b strings.Builder
+	fmt.Fprintf(&b, "%d requests (%d errors) in %v, %.1f requests/s\n",
+		r.Total.Requests, r.Total.Errors, r.Duration.Round(time.Millisecond), r.Throughput())
+	fmt.Fprintf(&b, "%-20s %8s %8s %10s %10s %10s %10s\n", "opcode", "requests", "errors", "p50", "p95", "p99", "max")
+	row := func(name string, s LatencyStats) {
+		fmt.Fprintf(&b, "%-20s %8d %8d %10v %10v %10v %10v\n", name, s.Requests, s.Errors,
+			s.P50.Round(time.Microsecond), s.P95.Round(time.Microsecond),
+			s.P99.Round(time.Microsecond), s.Max.Round(time.Microsecond))
+	}
+	ops := make([]protocol.Op, 0, len(r.ByOpcode))
+	for op := range r.ByOpcode {
+		ops = append(ops, op)
+	}
+	sort.Slice(ops, func(i, j int) bool { return ops[i] < ops[j] })
+	for _, op := range ops {
+		row(op.String(), r.ByOpcode[op])
+	}
+	row("total", r.Total)
+	return b.String()
+}
+
+// latencies collects the samples for one opcode.
+type latencies struct {
+	samples []time.Duration
+	errors  int
+}
+
+func (l *latencies) stats() LatencyStats {
+	s := LatencyStats{Requests: len(l.samples) + l.errors, Errors: l.errors}
+	if len(l.samples) == 0 {
+		return s
+	}
+	sort.Slice(l.samples, func(i, j int) bool { return l.samples[i] < l.samples[j] })
+	percentile := func(p float64) time.Duration {
+		return l.samples[int(math.Ceil(p*float64(len(l.samples))))-1]
+	}
+	s.P50, s.P95, s.P99 = percentile(0.50), percentile(0.95), percentile(0.99)
+	s.Max = l.samples[len(l.samples)-1]
+	return s
+}
+
+// Run runs the load test until Duration has elapsed, Requests have been sent
+// or ctx is done, whichever comes first.
+func (lt *LoadTester) Run(ctx context.Context) (*LoadTestResult, error) {
+	if len(lt.Ops) == 0 {
+		return nil, errors.New("load test has no operations")
+	}
+	if lt.Duration <= 0 && lt.Requests <= 0 {
+		if _, ok := ctx.Deadline(); !ok {
+			return nil, errors.New("load test needs a duration, a number of requests or a deadline")
+		}
+	}
+	r, err := lt.Client.getRemote(lt.Server)
+	if err != nil {
+		return nil, err
+	}
+	if lt.Duration > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, lt.Duration)
+		defer cancel()
+	}
+	concurrency := lt.Concurrency
+	if concurrency <= 0 {
+		concurrency = 1
+	}
+
+	// remaining is the number of requests left to send, if limited.
+	var mtx sync.Mutex
+	remaining := lt.Requests
+	next := func() bool {
+		if lt.Requests <= 0 {
+			return ctx.Err() == nil
+		}
+		mtx.Lock()
+		defer mtx.Unlock()
+		if remaining == 0 || ctx.Err() != nil {
+			return false
+		}
+		remaining--
+		return true
+	}
+
+	results := make([]map[protocol.Op]*latencies, concurrency)
+	var wg sync.WaitGroup
+	start := time.Now()
+	for i := 0; i < concurrency; i++ {
+		byOp := make(map[protocol.Op]*latencies)
+		results[i] = byOp
+		wg.Add(1)
+		go func(worker int) {
+			defer wg.Done()
+			for n := worker; next(); n++ {
+				op := lt.Ops[n%len(lt.Ops)]
+				l := byOp[op.Opcode]
+				if l == nil {
+					l = new(latencies)
+					byOp[op.Opcode] = l
+				}
+				d, err := lt.do(ctx, r, op)
+				if err != nil {
+					l.errors++
+					continue
+				}
+				l.samples = append(l.samples, d)
+			}
+		}(i)
+	}
+	wg.Wait()
+
+	result := &LoadTestResult{
+		Duration: time.Since(start),
+		ByOpcode: make(map[protocol.Op]LatencyStats),
+	}
+	total := new(latencies)
+	merged := make(map[protocol.Op]*latencies)
+	for _, byOp := range results {
+		for op, l := range byOp {
+			m := merged[op]
+			if m == nil {
+				m = new(latencies)
+				merged[op] = m
+			}
+			m.samples = append(m.samples, l.samples...)
+			m.errors += l.errors
+			total.samples = append(total.samples, l.samples...)
+			total.errors += l.errors
+		}
+	}
+	for op, l := range merged {
+		result.ByOpcode[op] = l.stats()
+	}
+	result.Total = total.stats()
+	return result, nil
+}
+
+// do sends op and returns its latency, or an error if it failed.
+func (lt *LoadTester) do(ctx context.Context, r Remote, op protocol.Operation) (time.Duration, error) {
+	conn, err := lt.Client.DialContext(ctx, r)
+	if err != nil {
+		return 0, err
+	}
+	start := time.Now()
+	result, err := conn.Conn.DoOperation(ctx, op)
+	d := time.Since(start)
+	if err != nil {
+		conn.Close()
+		return 0, err
+	}
+	conn.KeepAlive()
+	if result.Opcode == protocol.OpError {
+		return 0, responseError(conn.addr, op.Opcode, result)
+	}
+	return d, nil
+}
@@ -0,0 +1,152 @@
+package client
+
+import (
+	"bytes"
+	"context"
+	"crypto"
+	"errors"
+	"fmt"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/cloudflare/cfssl/log"
+	"github.com/cloudflare/gokeyless/protocol"
+)
+
+// GetManifest fetches the key manifest of server and checks that it was signed
+// by the private key of pub, which is normally the public key of the server's
+// Attester.
+func (c *Client) GetManifest(ctx context.Context, server string, pub crypto.PublicKey) (*protocol.Manifest, error) {
+	payload, err := c.do(ctx, server, protocol.Operation{Opcode: protocol.OpGetManifest})
+	if err != nil {
+		return nil, err
+	}
+
+	m := new(protocol.Manifest)
+	if err := m.UnmarshalBinary(payload); err != nil {
+		return nil, fmt.Errorf("invalid manifest: %v", err)
+	}
+	if err := m.Verify(pub); err != nil {
+		return nil, err
+	}
+	return m, nil
+}
+
+// A KeyManifest holds a remote signer for each key listed in the manifest of a
+// keyserver, as returned by LoadManifest.
+type KeyManifest struct {
+	client *Client
+	server string
+	pub    crypto.PublicKey
+
+	mtx     sync.RWMutex
+	issued  time.Time
+	signers map[protocol.SKI]crypto.Signer
+
+	done chan struct{}
+}
+
+// LoadManifest fetches the key manifest of server, verified with pub, and
+// creates a remote signer for each key it lists, so that keys don't have to
+// be registered one by one. If refresh is positive, the manifest is refetched
+// every refresh until Close is called, adding signers for new keys and
+// dropping those for removed ones. Refresh failures are logged and the
+// previous keys are kept, and manifests issued before the current one are
+// rejected.
+func (c *Client) LoadManifest(ctx context.Context, server string, pub crypto.PublicKey, refresh time.Duration) (*KeyManifest, error) {
+	km := &KeyManifest{
+		client: c,
+		server: server,
+		pub:    pub,
+		done:   make(chan struct{}),
+	}
+	if err := km.update(ctx); err != nil {
+		return nil, err
+	}
+	if refresh <= 0 {
+		return km, nil
+	}
+
+	go func() {
+		ticker := time.NewTicker(refresh)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-ticker.C:
+			case <-km.done:
+				return
+			case <-ctx.Done():
+				return
+			}
+
+			if err := km.update(ctx); err != nil {
+				log.Warningf("failed to refresh key manifest from %s: %v", server, err)
+			}
+		}
+	}()
+	return km, nil
+}
+
+// update fetches the manifest and replaces the signers of km with those of the
+// keys it lists.
+func (km *KeyManifest) update(ctx context.Context) error {
+	m, err := km.client.GetManifest(ctx, km.server, km.pub)
+	if err != nil {
+		return err
+	}
+
+	km.mtx.Lock()
+	defer km.mtx.Unlock()
+	if m.Issued.Before(km.issued) {
+		return errors.New("manifest is older than the current one")
+	}
+	signers := make(map[protocol.SKI]crypto.Signer, len(m.Keys))
+	for _, key := range m.Keys {
+		if s, ok := km.signers[key.SKI]; ok {
+			signers[key.SKI] = s
+			continue
+		}
+		s, err := NewRemoteSigner(ctx, km.client, km.server, key.SKI, key.Public, "", nil)
+		if err != nil {
+			return err
+		}
+		signers[key.SKI] = s
+	}
+	km.issued = m.Issued
+	km.signers = signers
+	return nil
+}
+
+// Signer returns the remote signer for the key with the given SKI, or nil if
+// the manifest does not list it.
+func (km *KeyManifest) Signer(ski protocol.SKI) crypto.Signer {
+	km.mtx.RLock()
+	defer km.mtx.RUnlock()
+	return km.signers[ski]
+}
+
+// SKIs returns the SKIs of the keys listed in the manifest, in ascending order.
+func (km *KeyManifest) SKIs() []protocol.SKI {
+	km.mtx.RLock()
+	skis := make([]protocol.SKI, 0, len(km.signers))
+	for ski := range km.signers {
+		skis = append(skis, ski)
+	}
+	km.mtx.RUnlock()
+
+	sort.Slice(skis, func(i, j int) bool { return bytes.Compare(skis[i][:], skis[j][:]) < 0 })
+	return skis
+}
+
+// Issued returns when the current manifest was signed.
+func (km *KeyManifest) Issued() time.Time {
+	km.mtx.RLock()
+	defer km.mtx.RUnlock()
+	return km.issued
+}
+
+// Close stops refreshing the manifest. The signers remain usable.
+func (km *KeyManifest) Close() {
+	close(km.done)
+}
@@ -0,0 +1,212 @@
+package client
+
+import (
+	"context"
+	"errors"
+	"strconv"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+
+	"github.com/cloudflare/gokeyless/protocol"
+)
+
+// Metrics records the outcome of the requests and dials a Client makes, so
+// that degraded keyservers can be noticed from the client side. Unlike
+// ServerStats, which only steer the Client's Balancer, metrics are meant to be
+// exported. Implementations must be safe for concurrent use.
+type Metrics interface {
+	// ObserveRequest records a request with opcode op to the keyserver at
+	// addr, which took latency and failed with err, if it isn't nil. Errors
+	// returned by the keyserver are protocol.Errors.
+	ObserveRequest(addr string, op protocol.Op, latency time.Duration, err error)
+	// ObserveDial records a connection to the keyserver at addr, including
+	// the handshake, attestation and authentication, which took latency and
+	// failed with err, if it isn't nil.
+	ObserveDial(addr string, latency time.Duration, err error)
+}
+
+// QueueMetrics is implemented by Metrics which also record the depth of the
+// request queues a Client keeps when its Queue is set.
+type QueueMetrics interface {
+	// ObserveQueueDepth records that depth requests are waiting to be sent
+	// to the keyserver at addr.
+	ObserveQueueDepth(addr string, depth int)
+}
+
+// TimingMetrics is implemented by Metrics which also record the timing hints
+// keyservers attach to their responses once protocol.FeatureTiming is
+// negotiated, to tell network latency from server-side queueing.
+type TimingMetrics interface {
+	// ObserveServerTiming records that the keyserver at addr spent timing on
+	// a request with opcode op.
+	ObserveServerTiming(addr string, op protocol.Op, timing protocol.Timing)
+}
+
+func (c *Client) observeRequest(addr string, op protocol.Op, latency time.Duration, err error) {
+	if c.Metrics != nil {
+		c.Metrics.ObserveRequest(addr, op, latency, err)
+	}
+}
+
+// observeTiming records the timing hint of result, if it carries one.
+func (c *Client) observeTiming(addr string, op protocol.Op, result *protocol.Operation) {
+	if m, ok := c.Metrics.(TimingMetrics); ok && result != nil && !result.Timing.IsZero() {
+		m.ObserveServerTiming(addr, op, result.Timing)
+	}
+}
+
+func (c *Client) observeDial(addr string, latency time.Duration, err error) {
+	if c.Metrics != nil {
+		c.Metrics.ObserveDial(addr, latency, err)
+	}
+}
+
+func (c *Client) observeQueueDepth(addr string, depth int) {
+	if m, ok := c.Metrics.(QueueMetrics); ok {
+		m.ObserveQueueDepth(addr, depth)
+	}
+}
+
+// operationError returns the error with which an operation that returned
+// result and err failed, or nil if it succeeded.
+func operationError(result *protocol.Operation, err error) error {
+	if err == nil && result.Opcode == protocol.OpError {
+		return result.GetError()
+	}
+	return err
+}
+
+// errorLabel classifies err into one of a small set of label values.
+func errorLabel(err error) string {
+	var perr protocol.Error
+	switch {
+	case err == nil:
+		return ""
+	case errors.Is(err, ErrQueueFull):
+		return "queue full"
+	case errors.Is(err, ErrQueueTimeout):
+		return "queue timeout"
+	case errors.As(err, &perr):
+		return perr.String()
+	case errors.Is(err, context.Canceled):
+		return "canceled"
+	case errors.Is(err, context.DeadlineExceeded):
+		return "deadline exceeded"
+	default:
+		return "transport"
+	}
+}
+
+// PrometheusMetrics is a Metrics which is also a prometheus.Collector. It
+// exports request and dial counts, broken down by keyserver, opcode and error,
+// latency histograms, the depth of the request queues, hedged requests and the
+// keyservers' timing hints. It must be registered to be exported.
+type PrometheusMetrics struct {
+	requests        *prometheus.CounterVec
+	requestDuration *prometheus.HistogramVec
+	dials           *prometheus.CounterVec
+	dialDuration    *prometheus.HistogramVec
+	queueDepth      *prometheus.GaugeVec
+	hedges          *prometheus.CounterVec
+	serverQueue     *prometheus.HistogramVec
+	serverProcess   *prometheus.HistogramVec
+}
+
+// NewPrometheusMetrics returns a PrometheusMetrics whose metrics are named
+// with prefix, e.g. "keyless_client".
+func NewPrometheusMetrics(prefix string) *PrometheusMetrics {
+	// buckets starting at 100 microseconds and doubling until reaching a
+	// maximum of ~3.3 seconds
+	buckets := prometheus.ExponentialBuckets(1e-4, 2.0, 15)
+	return &PrometheusMetrics{
+		requests: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Name: prefix + "_requests",
+			Help: "Number of requests sent to each keyserver, by opcode and error.",
+		}, []string{"server", "opcode", "error"}),
+		requestDuration: prometheus.NewHistogramVec(prometheus.HistogramOpts{
+			Name:    prefix + "_request_duration",
+			Help:    "Time for each keyserver to answer a request, by opcode.",
+			Buckets: buckets,
+		}, []string{"server", "opcode"}),
+		dials: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Name: prefix + "_dials",
+			Help: "Number of connections made to each keyserver, by error.",
+		}, []string{"server", "error"}),
+		dialDuration: prometheus.NewHistogramVec(prometheus.HistogramOpts{
+			Name:    prefix + "_dial_duration",
+			Help:    "Time to connect to each keyserver.",
+			Buckets: buckets,
+		}, []string{"server"}),
+		queueDepth: prometheus.NewGaugeVec(prometheus.GaugeOpts{
+			Name: prefix + "_queue_depth",
+			Help: "Number of requests waiting to be sent to each keyserver.",
+		}, []string{"server"}),
+		hedges: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Name: prefix + "_hedged_requests",
+			Help: "Number of requests duplicated to each keyserver because another was slow, by whether it answered first.",
+		}, []string{"server", "won"}),
+		serverQueue: prometheus.NewHistogramVec(prometheus.HistogramOpts{
+			Name:    prefix + "_server_queue_duration",
+			Help:    "Time requests queued on each keyserver before being processed, as it reported, by opcode.",
+			Buckets: buckets,
+		}, []string{"server", "opcode"}),
+		serverProcess: prometheus.NewHistogramVec(prometheus.HistogramOpts{
+			Name:    prefix + "_server_processing_duration",
+			Help:    "Time each keyserver took to process requests once dequeued, as it reported, by opcode.",
+			Buckets: buckets,
+		}, []string{"server", "opcode"}),
+	}
+}
+
+// ObserveRequest implements Metrics.
+func (m *PrometheusMetrics) ObserveRequest(addr string, op protocol.Op, latency time.Duration, err error) {
+	m.requests.WithLabelValues(addr, op.String(), errorLabel(err)).Inc()
+	m.requestDuration.WithLabelValues(addr, op.String()).Observe(latency.Seconds())
+}
+
+// ObserveDial implements Metrics.
+func (m *PrometheusMetrics) ObserveDial(addr string, latency time.Duration, err error) {
+	m.dials.WithLabelValues(addr, errorLabel(err)).Inc()
+	m.dialDuration.WithLabelValues(addr).Observe(latency.Seconds())
+}
+
+// ObserveQueueDepth implements QueueMetrics.
+func (m *PrometheusMetrics) ObserveQueueDepth(addr string, depth int) {
+	m.queueDepth.WithLabelValues(addr).Set(float64(depth))
+}
+
+// ObserveHedge implements HedgeMetrics.
+func (m *PrometheusMetrics) ObserveHedge(addr string, won bool) {
+	m.hedges.WithLabelValues(addr, strconv.FormatBool(won)).Inc()
+}
+
+// ObserveServerTiming implements TimingMetrics.
+func (m *PrometheusMetrics) ObserveServerTiming(addr string, op protocol.Op, timing protocol.Timing) {
+	m.serverQueue.WithLabelValues(addr, op.String()).Observe(timing.Queue.Seconds())
+	m.serverProcess.WithLabelValues(addr, op.String()).Observe(timing.Processing.Seconds())
+}
+
+// Describe implements prometheus.Collector.
+func (m *PrometheusMetrics) Describe(ch chan<- *prometheus.Desc) {
+	m.requests.Describe(ch)
+	m.requestDuration.Describe(ch)
+	m.dials.Describe(ch)
+	m.dialDuration.Describe(ch)
+	m.queueDepth.Describe(ch)
+	m.hedges.Describe(ch)
+	m.serverQueue.Describe(ch)
+	m.serverProcess.Describe(ch)
+}
+
+// Collect implements prometheus.Collector.
+func (m *PrometheusMetrics) Collect(ch chan<- prometheus.Metric) {
+	m.requests.Collect(ch)
+	m.requestDuration.Collect(ch)
+	m.dials.Collect(ch)
+	m.dialDuration.Collect(ch)
+	m.queueDepth.Collect(ch)
+	m.hedges.Collect(ch)
+	m.serverQueue.Collect(ch)
+	m.serverProcess.Collect(ch)
+}
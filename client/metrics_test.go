@@ -0,0 +1,95 @@
+package client
+
+import (
+	"context"
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/sha256"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/cloudflare/gokeyless/protocol"
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+func TestMetrics(t *testing.T) {
+	metrics := NewPrometheusMetrics("test_client")
+	registry := prometheus.NewRegistry()
+	if err := registry.Register(metrics); err != nil {
+		t.Fatal(err)
+	}
+
+	c2, err := NewClientFromFile(clientCert, clientKey, keyserverCA)
+	if err != nil {
+		t.Fatal(err)
+	}
+	c2.Config.Time = fixedCurrentTime
+	c2.Dialer.Timeout = 3 * time.Second
+	c2.DefaultRemote = remote
+	c2.Metrics = metrics
+
+	digest := sha256.Sum256([]byte("message"))
+	key, err := c2.NewRemoteSignerByPublicKey(context.Background(), "", ecdsaSigner.Public())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := key.Sign(rand.Reader, digest[:], crypto.SHA256); err != nil {
+		t.Fatal(err)
+	}
+	unknown, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	key, err = c2.NewRemoteSignerByPublicKey(context.Background(), "", unknown.Public())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := key.Sign(rand.Reader, digest[:], crypto.SHA256); err == nil {
+		t.Fatal("signed with an unknown key")
+	}
+
+	// Reserve a port with nothing listening on it.
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	dead := l.Addr()
+	l.Close()
+	if _, err := NewServer(dead, "localhost").Dial(c2); err == nil {
+		t.Fatal("dialed a closed port")
+	}
+
+	families, err := registry.Gather()
+	if err != nil {
+		t.Fatal(err)
+	}
+	counts := make(map[string]float64)
+	for _, family := range families {
+		for _, m := range family.GetMetric() {
+			labels := family.GetName()
+			for _, label := range m.GetLabel() {
+				labels += " " + label.GetName() + "=" + label.GetValue()
+			}
+			switch {
+			case m.GetCounter() != nil:
+				counts[labels] = m.GetCounter().GetValue()
+			case m.GetHistogram() != nil:
+				counts[labels] = float64(m.GetHistogram().GetSampleCount())
+			}
+		}
+	}
+	for labels, want := range map[string]float64{
+		"test_client_requests error= opcode=OpECDSASignSHA256 server=" + sAddr:                                         1,
+		"test_client_requests error=" + protocol.ErrKeyNotFound.String() + " opcode=OpECDSASignSHA256 server=" + sAddr: 1,
+		"test_client_request_duration opcode=OpECDSASignSHA256 server=" + sAddr:                                        2,
+		"test_client_dials error=transport server=" + dead.String():                                                    1,
+		"test_client_dial_duration server=" + dead.String():                                                            1,
+	} {
+		if counts[labels] != want {
+			t.Errorf("%s: got %v, want %v", labels, counts[labels], want)
+		}
+	}
+}
@@ -0,0 +1,69 @@
+package client
+
+import (
+	"context"
+	"errors"
+	"net"
+	"time"
+
+	"github.com/cloudflare/gokeyless/noise"
+)
+
+var errNoiseAttestation = errors.New("attestations require TLS, not Noise")
+
+// NewNoiseServer returns a Remote for the keyserver at addr which secures its
+// connections with the Noise protocol instead of TLS, and authenticates with
+// serverKey. The client authenticates with its NoiseKey, which must be set.
+// Noise keyservers can't be required to attest, and proxies aren't used to
+// dial them.
+func NewNoiseServer(addr net.Addr, serverKey noise.PublicKey) Remote {
+	return &singleRemote{
+		Addr:       addr,
+		ServerName: addr.String(),
+		noiseKey:   &serverKey,
+	}
+}
+
+// dialNoise dials the keyserver at addr and performs the Noise handshake with
+// it, giving up when ctx is done.
+func (c *Client) dialNoise(ctx context.Context, network, addr string, serverKey noise.PublicKey) (net.Conn, error) {
+	if c.NoiseKey == nil {
+		return nil, errors.New("dialing a Noise keyserver requires a NoiseKey")
+	}
+	dialer := c.Dialer
+	if dialer == nil {
+		dialer = new(net.Dialer)
+	}
+	if dialer.Timeout > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, dialer.Timeout)
+		defer cancel()
+	}
+	inner, err := dialer.DialContext(ctx, network, addr)
+	if err != nil {
+		return nil, err
+	}
+	if deadline, ok := ctx.Deadline(); ok {
+		inner.SetDeadline(deadline)
+	}
+	// Interrupt the handshake if ctx is done before it completes.
+	done := make(chan struct{})
+	defer close(done)
+	go func() {
+		select {
+		case <-ctx.Done():
+			inner.SetDeadline(time.Unix(1, 0))
+		case <-done:
+		}
+	}()
+	conn := noise.Client(inner, &noise.Config{StaticKey: *c.NoiseKey, ServerKey: serverKey})
+	if err := conn.Handshake(); err != nil {
+		conn.Close()
+		if ctx.Err() != nil {
+			return nil, ctx.Err()
+		}
+		return nil, err
+	}
+	inner.SetDeadline(time.Time{})
+	return conn, nil
+}
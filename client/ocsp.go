@@ -0,0 +1,50 @@
+package client
+
+import (
+	"context"
+	"crypto"
+	"crypto/x509"
+	"io"
+
+	"github.com/cloudflare/gokeyless/conn"
+	"github.com/cloudflare/gokeyless/protocol"
+	"golang.org/x/crypto/ocsp"
+)
+
+// CreateOCSPResponse is like ocsp.CreateResponse, but the response is signed
+// on the keyserver with protocol.OpOCSPSign, so the key can be a delegated OCSP
+// responder key which the keyserver uses for nothing else. The result can be
+// parsed with ocsp.ParseResponse. Only RSA and ECDSA keys are supported.
+func (key *PrivateKey) CreateOCSPResponse(issuer, responderCert *x509.Certificate, template ocsp.Response) ([]byte, error) {
+	return key.CreateOCSPResponseContext(context.Background(), issuer, responderCert, template)
+}
+
+// CreateOCSPResponseContext is like CreateOCSPResponse, but gives up when ctx
+// is done. Since OCSP responses are signed ahead of time, the request is sent
+// with protocol.PriorityLow unless ctx carries another priority.
+func (key *PrivateKey) CreateOCSPResponseContext(ctx context.Context, issuer, responderCert *x509.Certificate, template ocsp.Response) ([]byte, error) {
+	if _, ok := conn.PriorityFromContext(ctx); !ok {
+		ctx = conn.WithPriority(ctx, protocol.PriorityLow)
+	}
+	unsigned, err := ocsp.CreateResponse(issuer, responderCert, template, unsignedSigner{key.Public()})
+	if err != nil {
+		return nil, err
+	}
+	return key.execute(ctx, protocol.OpOCSPSign, unsigned, func(priv crypto.Signer) ([]byte, error) {
+		return ocsp.CreateResponse(issuer, responderCert, template, priv)
+	})
+}
+
+// unsignedSigner produces empty signatures for pub, for structures which are
+// signed separately.
+type unsignedSigner struct {
+	pub crypto.PublicKey
+}
+
+func (s unsignedSigner) Public() crypto.PublicKey {
+	return s.pub
+}
+
+func (s unsignedSigner) Sign(io.Reader, []byte, crypto.SignerOpts) ([]byte, error) {
+	return []byte{}, nil
+}
@@ -0,0 +1,292 @@
+package client
+
+import (
+	"bufio"
+	"context"
+	"crypto/tls"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/url"
+	"strconv"
+	"time"
+)
+
+// ProxyURL returns a Client.Proxy function which dials every keyserver through
+// the proxy at u.
+func ProxyURL(u *url.URL) func(addr string) (*url.URL, error) {
+	return func(string) (*url.URL, error) { return u, nil }
+}
+
+// ProxyMap returns a Client.Proxy function which dials the keyservers at the
+// addresses in proxies through the corresponding proxy, and all others
+// through def, which may be nil to dial them directly.
+func ProxyMap(proxies map[string]*url.URL, def *url.URL) func(addr string) (*url.URL, error) {
+	return func(addr string) (*url.URL, error) {
+		if u, ok := proxies[addr]; ok {
+			return u, nil
+		}
+		return def, nil
+	}
+}
+
+// dialTLS dials addr and performs the TLS handshake, connecting through the
+// proxy chosen by c.Proxy, if any. It gives up when ctx is done.
+func (c *Client) dialTLS(ctx context.Context, network, addr string, config *tls.Config) (*tls.Conn, error) {
+	var proxy *url.URL
+	if c.Proxy != nil && network == "tcp" {
+		var err error
+		if proxy, err = c.Proxy(addr); err != nil {
+			return nil, err
+		}
+	}
+	if proxy == nil {
+		dialer := &tls.Dialer{NetDialer: c.Dialer, Config: config}
+		conn, err := dialer.DialContext(ctx, network, addr)
+		if err != nil {
+			return nil, err
+		}
+		return conn.(*tls.Conn), nil
+	}
+
+	if c.Dialer.Timeout > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, c.Dialer.Timeout)
+		defer cancel()
+	}
+	inner, err := dialProxy(ctx, c.Dialer, proxy, c.ProxyTLSConfig, addr)
+	if err != nil {
+		return nil, err
+	}
+	if deadline, ok := ctx.Deadline(); ok {
+		inner.SetDeadline(deadline)
+	}
+	// Interrupt the handshake if ctx is done before it completes.
+	done := make(chan struct{})
+	defer close(done)
+	go func() {
+		select {
+		case <-ctx.Done():
+			inner.SetDeadline(time.Unix(1, 0))
+		case <-done:
+		}
+	}()
+	conn := tls.Client(inner, config)
+	if err := conn.Handshake(); err != nil {
+		conn.Close()
+		if ctx.Err() != nil {
+			return nil, ctx.Err()
+		}
+		return nil, err
+	}
+	inner.SetDeadline(time.Time{})
+	return conn, nil
+}
+
+// dialProxy connects to addr through the SOCKS5 (socks5://) or HTTP CONNECT
+// (http:// or https://) proxy at proxy. Credentials in the URL's user info
+// are used to authenticate to the proxy. For https:// proxies the connection
+// to the proxy uses TLS with tlsConfig, which may be nil.
+func dialProxy(ctx context.Context, dialer *net.Dialer, proxy *url.URL, tlsConfig *tls.Config, addr string) (net.Conn, error) {
+	proxyAddr := proxy.Host
+	if proxy.Port() == "" {
+		switch proxy.Scheme {
+		case "socks5":
+			proxyAddr = net.JoinHostPort(proxy.Hostname(), "1080")
+		case "http":
+			proxyAddr = net.JoinHostPort(proxy.Hostname(), "80")
+		case "https":
+			proxyAddr = net.JoinHostPort(proxy.Hostname(), "443")
+		}
+	}
+
+	conn, err := dialer.DialContext(ctx, "tcp", proxyAddr)
+	if err != nil {
+		return nil, fmt.Errorf("dial proxy %s: %v", proxyAddr, err)
+	}
+	if deadline, ok := ctx.Deadline(); ok {
+		conn.SetDeadline(deadline)
+	}
+
+	switch proxy.Scheme {
+	case "socks5":
+		err = socks5Connect(conn, proxy.User, addr)
+	case "https":
+		if tlsConfig == nil {
+			tlsConfig = &tls.Config{}
+		} else {
+			tlsConfig = tlsConfig.Clone()
+		}
+		if tlsConfig.ServerName == "" {
+			tlsConfig.ServerName = proxy.Hostname()
+		}
+		conn = tls.Client(conn, tlsConfig)
+		fallthrough
+	case "http":
+		conn, err = httpConnect(conn, proxy.User, addr)
+	default:
+		err = fmt.Errorf("unsupported proxy scheme %q", proxy.Scheme)
+	}
+	if err != nil {
+		conn.Close()
+		return nil, fmt.Errorf("proxy %s: %v", proxyAddr, err)
+	}
+	conn.SetDeadline(time.Time{})
+	return conn, nil
+}
+
+// httpConnect asks an HTTP proxy to open a tunnel to addr.
+func httpConnect(conn net.Conn, user *url.Userinfo, addr string) (net.Conn, error) {
+	req := &http.Request{
+		Method: http.MethodConnect,
+		URL:    &url.URL{Opaque: addr},
+		Host:   addr,
+		Header: make(http.Header),
+	}
+	if user != nil {
+		pass, _ := user.Password()
+		creds := base64.StdEncoding.EncodeToString([]byte(user.Username() + ":" + pass))
+		req.Header.Set("Proxy-Authorization", "Basic "+creds)
+	}
+	if err := req.Write(conn); err != nil {
+		return conn, err
+	}
+
+	br := bufio.NewReader(conn)
+	resp, err := http.ReadResponse(br, req)
+	if err != nil {
+		return conn, err
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return conn, fmt.Errorf("CONNECT %s: %s", addr, resp.Status)
+	}
+	if br.Buffered() > 0 {
+		// The keyserver never speaks first, but don't lose data if it did.
+		return &bufferedConn{Conn: conn, r: br}, nil
+	}
+	return conn, nil
+}
+
+type bufferedConn struct {
+	net.Conn
+	r *bufio.Reader
+}
+
+func (c *bufferedConn) Read(b []byte) (int, error) { return c.r.Read(b) }
+
+// SOCKS5 constants from RFC 1928 and RFC 1929.
+const (
+	socks5Version        = 0x05
+	socks5AuthNone       = 0x00
+	socks5AuthPassword   = 0x02
+	socks5AuthNoAccept   = 0xFF
+	socks5CmdConnect     = 0x01
+	socks5AddrIPv4       = 0x01
+	socks5AddrDomain     = 0x03
+	socks5AddrIPv6       = 0x04
+	socks5PasswordVers   = 0x01
+	socks5ReplySucceeded = 0x00
+)
+
+// socks5Connect asks a SOCKS5 proxy to connect to addr.
+func socks5Connect(conn net.Conn, user *url.Userinfo, addr string) error {
+	host, portStr, err := net.SplitHostPort(addr)
+	if err != nil {
+		return err
+	}
+	port, err := strconv.ParseUint(portStr, 10, 16)
+	if err != nil {
+		return fmt.Errorf("invalid port %q", portStr)
+	}
+
+	methods := []byte{socks5AuthNone}
+	if user != nil {
+		methods = []byte{socks5AuthPassword}
+	}
+	if _, err := conn.Write(append([]byte{socks5Version, byte(len(methods))}, methods...)); err != nil {
+		return err
+	}
+	var buf [4]byte
+	if _, err := io.ReadFull(conn, buf[:2]); err != nil {
+		return err
+	}
+	if buf[0] != socks5Version {
+		return fmt.Errorf("unexpected SOCKS version %d", buf[0])
+	}
+	switch buf[1] {
+	case socks5AuthNone:
+	case socks5AuthPassword:
+		if user == nil {
+			return errors.New("SOCKS5 proxy requires authentication")
+		}
+		pass, _ := user.Password()
+		if len(user.Username()) > 255 || len(pass) > 255 {
+			return errors.New("SOCKS5 credentials too long")
+		}
+		req := []byte{socks5PasswordVers, byte(len(user.Username()))}
+		req = append(req, user.Username()...)
+		req = append(req, byte(len(pass)))
+		req = append(req, pass...)
+		if _, err := conn.Write(req); err != nil {
+			return err
+		}
+		if _, err := io.ReadFull(conn, buf[:2]); err != nil {
+			return err
+		}
+		if buf[1] != 0 {
+			return errors.New("SOCKS5 authentication failed")
+		}
+	case socks5AuthNoAccept:
+		return errors.New("SOCKS5 proxy accepted none of the authentication methods")
+	default:
+		return fmt.Errorf("unexpected SOCKS5 authentication method %d", buf[1])
+	}
+
+	req := []byte{socks5Version, socks5CmdConnect, 0}
+	if ip := net.ParseIP(host); ip == nil {
+		if len(host) > 255 {
+			return fmt.Errorf("host name %q too long", host)
+		}
+		req = append(req, socks5AddrDomain, byte(len(host)))
+		req = append(req, host...)
+	} else if ip4 := ip.To4(); ip4 != nil {
+		req = append(req, socks5AddrIPv4)
+		req = append(req, ip4...)
+	} else {
+		req = append(req, socks5AddrIPv6)
+		req = append(req, ip...)
+	}
+	req = append(req, byte(port>>8), byte(port))
+	if _, err := conn.Write(req); err != nil {
+		return err
+	}
+
+	if _, err := io.ReadFull(conn, buf[:4]); err != nil {
+		return err
+	}
+	if buf[1] != socks5ReplySucceeded {
+		return fmt.Errorf("SOCKS5 connect to %s failed with code %d", addr, buf[1])
+	}
+	// Skip the bound address and port.
+	var skip int
+	switch buf[3] {
+	case socks5AddrIPv4:
+		skip = net.IPv4len
+	case socks5AddrIPv6:
+		skip = net.IPv6len
+	case socks5AddrDomain:
+		if _, err := io.ReadFull(conn, buf[:1]); err != nil {
+			return err
+		}
+		skip = int(buf[0])
+	default:
+		return fmt.Errorf("unexpected SOCKS5 address type %d", buf[3])
+	}
+	_, err = io.CopyN(ioutil.Discard, conn, int64(skip)+2)
+	return err
+}
@@ -0,0 +1,227 @@
+package client
+
+import (
+	"bufio"
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/binary"
+	"io"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/url"
+	"strconv"
+	"sync/atomic"
+	"testing"
+
+	"github.com/cloudflare/gokeyless/conn"
+)
+
+// tunnel copies data between a and b until either is closed.
+func tunnel(a, b net.Conn) {
+	go func() {
+		io.Copy(a, b)
+		a.Close()
+	}()
+	io.Copy(b, a)
+	b.Close()
+}
+
+// serveProxy accepts connections on l and hands each to handle.
+func serveProxy(t *testing.T, l net.Listener, handle func(net.Conn)) {
+	t.Cleanup(func() { l.Close() })
+	go func() {
+		for {
+			c, err := l.Accept()
+			if err != nil {
+				return
+			}
+			go handle(c)
+		}
+	}()
+}
+
+// startSOCKS5Proxy runs a SOCKS5 proxy requiring user:pass, counting connects.
+func startSOCKS5Proxy(t *testing.T, connects *int32) string {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	serveProxy(t, l, func(c net.Conn) {
+		defer c.Close()
+		var buf [256]byte
+		// greeting
+		if _, err := io.ReadFull(c, buf[:2]); err != nil {
+			return
+		}
+		if _, err := io.ReadFull(c, buf[:buf[1]]); err != nil {
+			return
+		}
+		c.Write([]byte{socks5Version, socks5AuthPassword})
+		// username/password
+		if _, err := io.ReadFull(c, buf[:2]); err != nil {
+			return
+		}
+		user := make([]byte, buf[1])
+		io.ReadFull(c, user)
+		io.ReadFull(c, buf[:1])
+		pass := make([]byte, buf[0])
+		io.ReadFull(c, pass)
+		if string(user) != "user" || string(pass) != "pass" {
+			c.Write([]byte{socks5PasswordVers, 1})
+			return
+		}
+		c.Write([]byte{socks5PasswordVers, 0})
+		// connect request
+		if _, err := io.ReadFull(c, buf[:4]); err != nil {
+			return
+		}
+		var host string
+		switch buf[3] {
+		case socks5AddrIPv4:
+			io.ReadFull(c, buf[:4])
+			host = net.IP(buf[:4]).String()
+		case socks5AddrDomain:
+			io.ReadFull(c, buf[:1])
+			name := make([]byte, buf[0])
+			io.ReadFull(c, name)
+			host = string(name)
+		default:
+			return
+		}
+		io.ReadFull(c, buf[:2])
+		port := binary.BigEndian.Uint16(buf[:2])
+		target, err := net.Dial("tcp", net.JoinHostPort(host, strconv.Itoa(int(port))))
+		if err != nil {
+			c.Write([]byte{socks5Version, 5, 0, socks5AddrIPv4, 0, 0, 0, 0, 0, 0})
+			return
+		}
+		atomic.AddInt32(connects, 1)
+		c.Write([]byte{socks5Version, socks5ReplySucceeded, 0, socks5AddrIPv4, 127, 0, 0, 1, 0, 0})
+		tunnel(c, target)
+	})
+	return l.Addr().String()
+}
+
+// startHTTPProxy runs an HTTP CONNECT proxy requiring user:pass, counting
+// connects. If config is set, the proxy is served over TLS.
+func startHTTPProxy(t *testing.T, config *tls.Config, connects *int32) string {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if config != nil {
+		l = tls.NewListener(l, config)
+	}
+	serveProxy(t, l, func(c net.Conn) {
+		defer c.Close()
+		br := bufio.NewReader(c)
+		req, err := http.ReadRequest(br)
+		if err != nil {
+			return
+		}
+		if req.Method != http.MethodConnect {
+			io.WriteString(c, "HTTP/1.1 405 Method Not Allowed\r\n\r\n")
+			return
+		}
+		if user, pass, ok := (&http.Request{Header: http.Header{
+			"Authorization": req.Header["Proxy-Authorization"],
+		}}).BasicAuth(); !ok || user != "user" || pass != "pass" {
+			io.WriteString(c, "HTTP/1.1 407 Proxy Authentication Required\r\n\r\n")
+			return
+		}
+		target, err := net.Dial("tcp", req.Host)
+		if err != nil {
+			io.WriteString(c, "HTTP/1.1 502 Bad Gateway\r\n\r\n")
+			return
+		}
+		atomic.AddInt32(connects, 1)
+		io.WriteString(c, "HTTP/1.1 200 Connection Established\r\n\r\n")
+		tunnel(c, target)
+	})
+	return l.Addr().String()
+}
+
+func TestProxy(t *testing.T) {
+	cert, err := tls.LoadX509KeyPair(serverCert, serverKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	caPEM, err := ioutil.ReadFile(keyserverCA)
+	if err != nil {
+		t.Fatal(err)
+	}
+	roots := x509.NewCertPool()
+	roots.AppendCertsFromPEM(caPEM)
+
+	var connects int32
+	socksAddr := startSOCKS5Proxy(t, &connects)
+	httpAddr := startHTTPProxy(t, nil, &connects)
+	httpsAddr := startHTTPProxy(t, &tls.Config{Certificates: []tls.Certificate{cert}}, &connects)
+
+	pc, err := NewClientFromFile(clientCert, clientKey, keyserverCA)
+	if err != nil {
+		t.Fatal(err)
+	}
+	pc.Config.Time = fixedCurrentTime
+	pc.ProxyTLSConfig = &tls.Config{RootCAs: roots, ServerName: "localhost", Time: fixedCurrentTime}
+
+	_, port, _ := net.SplitHostPort(sAddr)
+	for _, test := range []struct {
+		proxy string
+		ok    bool
+	}{
+		{"socks5://user:pass@" + socksAddr, true},
+		{"http://user:pass@" + httpAddr, true},
+		{"https://user:pass@" + httpsAddr, true},
+		{"socks5://user:wrong@" + socksAddr, false},
+		{"http://" + httpAddr, false},
+		{"ftp://" + httpAddr, false},
+	} {
+		t.Run(test.proxy, func(t *testing.T) {
+			u, err := url.Parse(test.proxy)
+			if err != nil {
+				t.Fatal(err)
+			}
+			pc.Proxy = ProxyMap(map[string]*url.URL{"localhost:" + port: u}, nil)
+			before := atomic.LoadInt32(&connects)
+
+			config := pc.Config.Clone()
+			config.ServerName = "localhost"
+			inner, err := pc.dialTLS(context.Background(), "tcp", "localhost:"+port, config)
+			if !test.ok {
+				if err == nil {
+					inner.Close()
+					t.Fatal("dial succeeded")
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			cn := conn.NewConn(inner)
+			defer cn.Close()
+			go func() {
+				for cn.DoRead() == nil {
+				}
+			}()
+			if err := cn.Ping(context.Background(), []byte("proxied")); err != nil {
+				t.Fatal(err)
+			}
+			if atomic.LoadInt32(&connects) != before+1 {
+				t.Fatal("connection did not go through the proxy")
+			}
+		})
+	}
+
+	// Addresses without a proxy are dialed directly.
+	pc.Proxy = ProxyMap(nil, nil)
+	config := pc.Config.Clone()
+	config.ServerName = "localhost"
+	inner, err := pc.dialTLS(context.Background(), "tcp", sAddr, config)
+	if err != nil {
+		t.Fatal(err)
+	}
+	inner.Close()
+}
@@ -0,0 +1,150 @@
+// Package proxytest runs in-process TLS terminators whose private keys are held
+// by a keyserver, as nginx or HAProxy do with keyless, so that users can write
+// integration tests against their keyserver deployments without setting up a
+// real proxy.
+package proxytest
+
+import (
+	"bytes"
+	"crypto/tls"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"time"
+)
+
+// A Proxy is a TLS listener on a loopback address, whose handshakes are signed
+// with the private keys of its certificates.
+type Proxy struct {
+	// Addr is the host:port the proxy listens on.
+	Addr string
+	// Config is the TLS configuration of the proxy.
+	Config *tls.Config
+
+	l       net.Listener
+	handler func(*tls.Conn)
+	wg      sync.WaitGroup
+
+	mtx  sync.Mutex
+	errs []error
+}
+
+// NewProxy starts a Proxy presenting certs, whose private keys are normally
+// *client.PrivateKeys, as returned by client.LoadTLSCertificate. Once their
+// handshake completes, connections are passed to handler, which is Echo if
+// nil, and closed when it returns.
+func NewProxy(handler func(*tls.Conn), certs ...tls.Certificate) (*Proxy, error) {
+	if len(certs) == 0 {
+		return nil, errors.New("proxytest: no certificates")
+	}
+	if handler == nil {
+		handler = Echo
+	}
+	config := &tls.Config{Certificates: certs}
+	l, err := tls.Listen("tcp", "127.0.0.1:0", config)
+	if err != nil {
+		return nil, err
+	}
+	p := &Proxy{
+		Addr:    l.Addr().String(),
+		Config:  config,
+		l:       l,
+		handler: handler,
+	}
+	p.wg.Add(1)
+	go p.serve()
+	return p, nil
+}
+
+func (p *Proxy) serve() {
+	defer p.wg.Done()
+	for {
+		c, err := p.l.Accept()
+		if err != nil {
+			return
+		}
+		p.wg.Add(1)
+		go func(conn *tls.Conn) {
+			defer p.wg.Done()
+			defer conn.Close()
+			if err := conn.Handshake(); err != nil {
+				p.mtx.Lock()
+				p.errs = append(p.errs, err)
+				p.mtx.Unlock()
+				return
+			}
+			p.handler(conn)
+		}(c.(*tls.Conn))
+	}
+}
+
+// Echo writes back what it reads from conn until the client closes its side
+// or stops writing for a second.
+func Echo(conn *tls.Conn) {
+	conn.SetReadDeadline(time.Now().Add(time.Second))
+	io.Copy(conn, conn)
+}
+
+// Dial connects to p with config, which must trust p's certificates, and
+// completes the handshake.
+func (p *Proxy) Dial(config *tls.Config) (*tls.Conn, error) {
+	return tls.Dial("tcp", p.Addr, config)
+}
+
+// Check connects to p, which must use Echo, with config and checks that a
+// message is echoed back, which requires a working keyserver.
+func (p *Proxy) Check(config *tls.Config) error {
+	conn, err := p.Dial(config)
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+
+	msg := []byte("Hello World!")
+	if _, err := conn.Write(msg); err != nil {
+		return err
+	}
+	if err := conn.CloseWrite(); err != nil {
+		return err
+	}
+	out, err := ioutil.ReadAll(conn)
+	if err != nil {
+		return err
+	}
+	if !bytes.Equal(msg, out) {
+		return fmt.Errorf("proxytest: got %q back", out)
+	}
+	return nil
+}
+
+// Errors returns the handshake errors seen by p, such as failures to reach the
+// keyserver, which clients only see as handshake alerts.
+func (p *Proxy) Errors() []error {
+	p.mtx.Lock()
+	defer p.mtx.Unlock()
+	return append([]error(nil), p.errs...)
+}
+
+// Close stops p and waits for its connections to be handled.
+func (p *Proxy) Close() error {
+	err := p.l.Close()
+	p.wg.Wait()
+	return err
+}
+
+// NewHTTPSServer starts an HTTPS server presenting certs, whose private keys
+// are normally *client.PrivateKeys. The server's Client trusts the first
+// certificate's leaf, so it works as is if the leaf is valid for 127.0.0.1,
+// and otherwise needs a ServerName the leaf is valid for. The caller must Close
+// the server.
+func NewHTTPSServer(handler http.Handler, certs ...tls.Certificate) *httptest.Server {
+	s := httptest.NewUnstartedServer(handler)
+	s.TLS = &tls.Config{Certificates: certs}
+	s.StartTLS()
+	return s
+}
@@ -0,0 +1,90 @@
+package proxytest
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"io/ioutil"
+	"math/big"
+	"net"
+	"net/http"
+	"testing"
+	"time"
+)
+
+// testCertificate returns a certificate for 127.0.0.1 with a local key,
+// standing in for one backed by a keyserver, and a pool trusting it.
+func testCertificate(t *testing.T) (tls.Certificate, *x509.CertPool) {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	tmpl := &x509.Certificate{
+		SerialNumber: big.NewInt(1),
+		Subject:      pkix.Name{CommonName: "proxytest"},
+		IPAddresses:  []net.IP{net.IPv4(127, 0, 0, 1)},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+	}
+	der, err := x509.CreateCertificate(rand.Reader, tmpl, tmpl, &key.PublicKey, key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	leaf, err := x509.ParseCertificate(der)
+	if err != nil {
+		t.Fatal(err)
+	}
+	pool := x509.NewCertPool()
+	pool.AddCert(leaf)
+	return tls.Certificate{Certificate: [][]byte{der}, PrivateKey: key, Leaf: leaf}, pool
+}
+
+func TestProxy(t *testing.T) {
+	cert, roots := testCertificate(t)
+	p, err := NewProxy(nil, cert)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer p.Close()
+
+	if err := p.Check(&tls.Config{RootCAs: roots}); err != nil {
+		t.Fatal(err)
+	}
+	if errs := p.Errors(); len(errs) != 0 {
+		t.Fatalf("unexpected handshake errors: %v", errs)
+	}
+
+	// Clients which don't trust the proxy fail, and so does the proxy's side of
+	// the handshake.
+	if err := p.Check(&tls.Config{RootCAs: x509.NewCertPool()}); err == nil {
+		t.Fatal("an untrusted proxy was accepted")
+	}
+	p.Close()
+	if errs := p.Errors(); len(errs) != 1 {
+		t.Fatalf("got handshake errors %v", errs)
+	}
+}
+
+func TestHTTPSServer(t *testing.T) {
+	cert, _ := testCertificate(t)
+	s := NewHTTPSServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte("ok"))
+	}), cert)
+	defer s.Close()
+
+	resp, err := s.Client().Get(s.URL)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+	body, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(body) != "ok" {
+		t.Fatalf("got %q", body)
+	}
+}
@@ -0,0 +1,127 @@
+package client
+
+import (
+	"context"
+	"errors"
+	"sync"
+	"time"
+)
+
+var (
+	// ErrQueueFull is returned for requests to a keyserver whose request
+	// queue is already QueueConfig.MaxDepth deep.
+	ErrQueueFull = errors.New("keyserver request queue is full")
+	// ErrQueueTimeout is returned for requests which waited in a keyserver's
+	// request queue for QueueConfig.Timeout.
+	ErrQueueTimeout = errors.New("timed out in keyserver request queue")
+)
+
+// QueueConfig bounds the requests a Client has in flight to each keyserver.
+// Requests beyond the bound wait in a queue for one of the in-flight requests
+// to complete, rather than piling onto connections which are already busy.
+type QueueConfig struct {
+	// MaxInFlight is the number of requests sent to each keyserver at once,
+	// across all connections to it. Values less than 1 are treated as 1.
+	MaxInFlight int
+	// MaxDepth is the number of requests which may wait for each keyserver.
+	// Requests arriving at a full queue fail with ErrQueueFull.
+	MaxDepth int
+	// Timeout is how long a request waits in the queue before failing with
+	// ErrQueueTimeout. Zero means requests wait until their context is done.
+	Timeout time.Duration
+}
+
+// requestQueue limits the requests in flight to a keyserver.
+type requestQueue struct {
+	// slots holds a value for each request in flight.
+	slots chan struct{}
+	// mtx protects waiting, and serializes the reports of its changes to
+	// Metrics so that the last one reported is current.
+	mtx     sync.Mutex
+	waiting int
+}
+
+func (q *requestQueue) release() {
+	<-q.slots
+}
+
+// queueFor returns the request queue of the keyserver at addr, creating it if
+// necessary.
+func (c *Client) queueFor(addr string) *requestQueue {
+	if v, ok := c.queues.Load(addr); ok {
+		return v.(*requestQueue)
+	}
+	n := c.Queue.MaxInFlight
+	if n < 1 {
+		n = 1
+	}
+	v, _ := c.queues.LoadOrStore(addr, &requestQueue{slots: make(chan struct{}, n)})
+	return v.(*requestQueue)
+}
+
+// QueueDepth returns the number of requests waiting to be sent to the
+// keyserver at addr.
+func (c *Client) QueueDepth(addr string) int {
+	v, ok := c.queues.Load(addr)
+	if !ok {
+		return 0
+	}
+	q := v.(*requestQueue)
+	q.mtx.Lock()
+	defer q.mtx.Unlock()
+	return q.waiting
+}
+
+// acquire waits until a request may be sent to the keyserver at addr, and
+// returns a function which must be called once the request completes. It
+// fails if the keyserver's queue is full, the request times out in the queue
+// or ctx is done.
+func (c *Client) acquire(ctx context.Context, addr string) (func(), error) {
+	if c.Queue == nil {
+		return func() {}, nil
+	}
+	q := c.queueFor(addr)
+	select {
+	case q.slots <- struct{}{}:
+		return q.release, nil
+	default:
+	}
+
+	if !c.enqueue(q, addr) {
+		return nil, ErrQueueFull
+	}
+	defer c.dequeue(q, addr)
+	var timeout <-chan time.Time
+	if c.Queue.Timeout > 0 {
+		timer := time.NewTimer(c.Queue.Timeout)
+		defer timer.Stop()
+		timeout = timer.C
+	}
+	select {
+	case q.slots <- struct{}{}:
+		return q.release, nil
+	case <-timeout:
+		return nil, ErrQueueTimeout
+	case <-ctx.Done():
+		return nil, ctx.Err()
+	}
+}
+
+// enqueue adds a request to q, unless it is full.
+func (c *Client) enqueue(q *requestQueue, addr string) bool {
+	q.mtx.Lock()
+	defer q.mtx.Unlock()
+	if q.waiting >= c.Queue.MaxDepth {
+		return false
+	}
+	q.waiting++
+	c.observeQueueDepth(addr, q.waiting)
+	return true
+}
+
+func (c *Client) dequeue(q *requestQueue, addr string) {
+	q.mtx.Lock()
+	defer q.mtx.Unlock()
+	q.waiting--
+	c.observeQueueDepth(addr, q.waiting)
+}
@@ -0,0 +1,89 @@
+package client
+
+import (
+	"context"
+	"crypto/tls"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/cloudflare/gokeyless/protocol"
+)
+
+type depthMetrics struct {
+	mtx    sync.Mutex
+	depths []int
+}
+
+func (m *depthMetrics) ObserveRequest(string, protocol.Op, time.Duration, error) {}
+func (m *depthMetrics) ObserveDial(string, time.Duration, error)                {}
+func (m *depthMetrics) ObserveQueueDepth(addr string, depth int) {
+	m.mtx.Lock()
+	defer m.mtx.Unlock()
+	m.depths = append(m.depths, depth)
+}
+
+func TestQueue(t *testing.T) {
+	metrics := &depthMetrics{}
+	c := NewClient(tls.Certificate{}, nil)
+	c.Metrics = metrics
+	c.Queue = &QueueConfig{MaxInFlight: 1, MaxDepth: 1, Timeout: 50 * time.Millisecond}
+	ctx := context.Background()
+
+	release, err := c.acquire(ctx, "a")
+	if err != nil {
+		t.Fatal(err)
+	}
+	// Queues are kept per keyserver.
+	if _, err := c.acquire(ctx, "b"); err != nil {
+		t.Fatal(err)
+	}
+
+	queued := make(chan error)
+	go func() {
+		release, err := c.acquire(ctx, "a")
+		if err == nil {
+			release()
+		}
+		queued <- err
+	}()
+	for c.QueueDepth("a") != 1 {
+		time.Sleep(time.Millisecond)
+	}
+	if _, err := c.acquire(ctx, "a"); err != ErrQueueFull {
+		t.Fatalf("got %v from a full queue", err)
+	}
+	release()
+	if err := <-queued; err != nil {
+		t.Fatal(err)
+	}
+
+	release, err = c.acquire(ctx, "a")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer release()
+	if _, err := c.acquire(ctx, "a"); err != ErrQueueTimeout {
+		t.Fatalf("got %v after the queue timeout", err)
+	}
+	cctx, cancel := context.WithCancel(ctx)
+	cancel()
+	if _, err := c.acquire(cctx, "a"); err != context.Canceled {
+		t.Fatalf("got %v with a canceled context", err)
+	}
+
+	metrics.mtx.Lock()
+	defer metrics.mtx.Unlock()
+	if len(metrics.depths) != 6 || metrics.depths[len(metrics.depths)-1] != 0 {
+		t.Fatalf("observed queue depths %v", metrics.depths)
+	}
+}
+
+func TestQueueDisabled(t *testing.T) {
+	c := NewClient(tls.Certificate{}, nil)
+	for i := 0; i < 10; i++ {
+		if _, err := c.acquire(context.Background(), "a"); err != nil {
+			t.Fatal(err)
+		}
+	}
+}
@@ -0,0 +1,159 @@
+package client
+
+import (
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/pem"
+	"errors"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"regexp"
+	"strings"
+
+	"github.com/cloudflare/cfssl/log"
+)
+
+var pemExt = regexp.MustCompile(`.+\.pem`)
+
+// CertificateMap maps hostnames to certificates whose PrivateKey is a remote
+// signer backed by a keyserver, as returned by RegisterPEMBundle and
+// RegisterDir.
+type CertificateMap map[string]*tls.Certificate
+
+// GetCertificate returns the certificate for the SNI of hello, or for the
+// wildcard matching it. It can be used as tls.Config.GetCertificate, which
+// falls back to tls.Config.Certificates if no certificate is found.
+func (m CertificateMap) GetCertificate(hello *tls.ClientHelloInfo) (*tls.Certificate, error) {
+	name := strings.ToLower(strings.TrimSuffix(hello.ServerName, "."))
+	if cert, ok := m[name]; ok {
+		return cert, nil
+	}
+	if i := strings.IndexByte(name, '.'); i > 0 {
+		if cert, ok := m["*"+name[i:]]; ok {
+			return cert, nil
+		}
+	}
+	return nil, nil
+}
+
+// add maps the names of cert to it, unless they are already mapped to a
+// certificate which expires later.
+func (m CertificateMap) add(cert *tls.Certificate) {
+	for _, name := range certNames(cert.Leaf) {
+		if old, ok := m[name]; ok && old.Leaf.NotAfter.After(cert.Leaf.NotAfter) {
+			continue
+		}
+		m[name] = cert
+	}
+}
+
+// certNames returns the DNS and IP SANs of cert, or its common name if it has
+// none.
+func certNames(cert *x509.Certificate) []string {
+	var names []string
+	for _, name := range cert.DNSNames {
+		names = append(names, strings.ToLower(name))
+	}
+	for _, ip := range cert.IPAddresses {
+		names = append(names, ip.String())
+	}
+	if len(names) == 0 && cert.Subject.CommonName != "" {
+		names = append(names, strings.ToLower(cert.Subject.CommonName))
+	}
+	return names
+}
+
+// RegisterPEMBundle registers the keys of the leaf certificates in a PEM
+// bundle with the given keyserver. The bundle may hold several certificate
+// chains, each a leaf certificate followed by its intermediates. Non-certificate
+// PEM blocks are ignored.
+func (c *Client) RegisterPEMBundle(server string, bundle []byte) (CertificateMap, error) {
+	certs := make(CertificateMap)
+	n, err := c.registerPEMBundle(server, bundle, certs)
+	if err != nil {
+		return nil, err
+	}
+	if n == 0 {
+		return nil, errors.New("no leaf certificates found in PEM bundle")
+	}
+	return certs, nil
+}
+
+// RegisterDir registers the keys of the leaf certificates in all .crt and .pem
+// files under dir with the given keyserver, as RegisterPEMBundle does. Files
+// without certificates, such as public or private keys, are skipped. If
+// several certificates are valid for a hostname, the one which expires last is
+// used.
+func (c *Client) RegisterDir(server, dir string) (CertificateMap, error) {
+	certs := make(CertificateMap)
+	err := filepath.Walk(dir, func(path string, info os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+		if info.IsDir() || !(crtExt.MatchString(info.Name()) || pemExt.MatchString(info.Name())) {
+			return nil
+		}
+
+		in, err := ioutil.ReadFile(path)
+		if err != nil {
+			return err
+		}
+		n, err := c.registerPEMBundle(server, in, certs)
+		if err != nil {
+			return err
+		}
+		if n > 0 {
+			log.Infof("Registered %d certificates from %s\n", n, path)
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	return certs, nil
+}
+
+// registerPEMBundle adds the chains of bundle to certs and returns how many
+// leaf certificates it holds. CA certificates which precede any leaf are
+// ignored.
+func (c *Client) registerPEMBundle(server string, bundle []byte, certs CertificateMap) (int, error) {
+	var chains []*tls.Certificate
+	for {
+		var block *pem.Block
+		block, bundle = pem.Decode(bundle)
+		if block == nil {
+			break
+		}
+		if block.Type != "CERTIFICATE" {
+			continue
+		}
+
+		x509Cert, err := x509.ParseCertificate(block.Bytes)
+		if err != nil {
+			return 0, err
+		}
+		if x509Cert.IsCA {
+			if len(chains) > 0 {
+				chain := chains[len(chains)-1]
+				chain.Certificate = append(chain.Certificate, block.Bytes)
+			}
+			continue
+		}
+		chains = append(chains, &tls.Certificate{
+			Certificate: [][]byte{block.Bytes},
+			Leaf:        x509Cert,
+		})
+	}
+
+	for _, chain := range chains {
+		priv, err := c.NewRemoteSignerByCert(context.Background(), server, chain.Leaf)
+		if err != nil {
+			return 0, err
+		}
+		chain.PrivateKey = priv
+		certs.add(chain)
+	}
+	return len(chains), nil
+}
@@ -0,0 +1,127 @@
+package client
+
+import (
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"io/ioutil"
+	"math/big"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func newTestCert(t *testing.T, parent *x509.Certificate, parentKey crypto.Signer, ca bool, notAfter time.Time, names ...string) (*x509.Certificate, crypto.Signer, []byte) {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	tmpl := &x509.Certificate{
+		SerialNumber:          big.NewInt(time.Now().UnixNano()),
+		Subject:               pkix.Name{CommonName: "test"},
+		NotBefore:             time.Now().Add(-time.Hour),
+		NotAfter:              notAfter,
+		DNSNames:              names,
+		IsCA:                  ca,
+		BasicConstraintsValid: true,
+	}
+	if parent == nil {
+		parent, parentKey = tmpl, key
+	}
+	der, err := x509.CreateCertificate(rand.Reader, tmpl, parent, key.Public(), parentKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	cert, err := x509.ParseCertificate(der)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return cert, key, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der})
+}
+
+func TestRegisterPEMBundle(t *testing.T) {
+	c := NewClient(tls.Certificate{}, nil)
+	expiry := time.Now().Add(24 * time.Hour)
+	ca, caKey, caPEM := newTestCert(t, nil, nil, true, expiry)
+	_, _, aPEM := newTestCert(t, ca, caKey, false, expiry, "a.example.com", "*.a.example.com")
+	_, _, bPEM := newTestCert(t, ca, caKey, false, expiry, "b.example.com")
+
+	var bundle []byte
+	for _, b := range [][]byte{caPEM, aPEM, caPEM, bPEM, caPEM} {
+		bundle = append(bundle, b...)
+	}
+	certs, err := c.RegisterPEMBundle("localhost:2407", bundle)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(certs) != 3 {
+		t.Fatalf("got %d hostnames, want 3", len(certs))
+	}
+	for name, chainLen := range map[string]int{"a.example.com": 2, "b.example.com": 2} {
+		cert, err := certs.GetCertificate(&tls.ClientHelloInfo{ServerName: name})
+		if err != nil || cert == nil {
+			t.Fatalf("no certificate for %s", name)
+		}
+		if len(cert.Certificate) != chainLen {
+			t.Fatalf("%s has a chain of %d certificates, want %d", name, len(cert.Certificate), chainLen)
+		}
+		key, ok := cert.PrivateKey.(*PrivateKey)
+		if !ok {
+			t.Fatalf("%s has a %T key", name, cert.PrivateKey)
+		}
+		if key.keyserver != "localhost:2407" {
+			t.Fatalf("%s is registered with %q", name, key.keyserver)
+		}
+	}
+	if cert, _ := certs.GetCertificate(&tls.ClientHelloInfo{ServerName: "www.a.example.com"}); cert != certs["a.example.com"] {
+		t.Fatal("wildcard not matched")
+	}
+	if cert, _ := certs.GetCertificate(&tls.ClientHelloInfo{ServerName: "c.example.com"}); cert != nil {
+		t.Fatal("unexpected certificate for c.example.com")
+	}
+
+	if _, err := c.RegisterPEMBundle("localhost:2407", caPEM); err == nil {
+		t.Fatal("registered a bundle without leaf certificates")
+	}
+}
+
+func TestRegisterDir(t *testing.T) {
+	c := NewClient(tls.Certificate{}, nil)
+	dir := t.TempDir()
+	ca, caKey, caPEM := newTestCert(t, nil, nil, true, time.Now().Add(48*time.Hour))
+	_, _, oldPEM := newTestCert(t, ca, caKey, false, time.Now().Add(time.Hour), "example.com")
+	newCert, key, newPEM := newTestCert(t, ca, caKey, false, time.Now().Add(24*time.Hour), "example.com")
+	keyDER, err := x509.MarshalPKCS8PrivateKey(key)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	files := map[string][]byte{
+		"ca.pem":  caPEM,
+		"new.crt": append(newPEM, caPEM...),
+		"old.pem": oldPEM,
+		"new.key": pem.EncodeToMemory(&pem.Block{Type: "PRIVATE KEY", Bytes: keyDER}),
+		"key.pem": pem.EncodeToMemory(&pem.Block{Type: "PRIVATE KEY", Bytes: keyDER}),
+	}
+	for name, data := range files {
+		if err := ioutil.WriteFile(filepath.Join(dir, name), data, 0600); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	certs, err := c.RegisterDir("localhost:2407", dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(certs) != 1 {
+		t.Fatalf("got %d hostnames, want 1", len(certs))
+	}
+	if cert := certs["example.com"]; cert == nil || !cert.Leaf.Equal(newCert) {
+		t.Fatal("certificate expiring last not chosen")
+	}
+}
@@ -17,51 +17,58 @@ import (
 	"github.com/cloudflare/backoff"
 	"github.com/cloudflare/cfssl/log"
 	"github.com/cloudflare/gokeyless/conn"
-	"github.com/lziest/ttlcache"
+	"github.com/cloudflare/gokeyless/noise"
+	"github.com/cloudflare/gokeyless/protocol"
 	"github.com/miekg/dns"
 )
 
-const (
-	connPoolSize = 512
-	defaultTTL   = 1 * time.Hour
-)
-
-// TestDisableConnectionPool allows the connection pooling to be disabled during
-// tests which require concurrency.
-var TestDisableConnectionPool uint32
-
-// connPoolType is a async safe pool of established gokeyless Conn
-// so we don't need to do TLS handshake unnecessarily.
-type connPoolType struct {
-	pool *ttlcache.LRU
-}
-
-// connPool keeps all active Conn
-var connPool *connPoolType
-
 // A Remote represents some number of remote keyless server(s)
 type Remote interface {
 	Dial(*Client) (*Conn, error)
 	PingAll(*Client, int)
 }
 
+// A ContextRemote is a Remote which can be dialed with a context, which bounds
+// the dial including the TLS handshake. The Remotes created by this package
+// implement it.
+type ContextRemote interface {
+	Remote
+	DialContext(context.Context, *Client) (*Conn, error)
+}
+
+// DialContext dials r, giving up when ctx is done. Remotes which don't
+// implement ContextRemote are dialed with Dial unless ctx is already done.
+func (c *Client) DialContext(ctx context.Context, r Remote) (*Conn, error) {
+	if r, ok := r.(ContextRemote); ok {
+		return r.DialContext(ctx, c)
+	}
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+	return r.Dial(c)
+}
+
 // A Conn represents a long-lived client connection to a keyserver.
 type Conn struct {
 	*conn.Conn
 	addr string
-	done chan struct{}
+	// client is the Client which dialed the Conn, if any; only it is handed
+	// the Conn from the pool.
+	client *Client
+	done   chan struct{}
+	// retired is set once the Conn must no longer be added to the pool.
+	retired uint32
+	// peerCerts are the fingerprints of the certificates the keyserver
+	// presented, leaf first, set before the Conn is pooled.
+	peerCerts []Fingerprint
 }
 
 // A singleRemote is an individual remote server
 type singleRemote struct {
 	net.Addr          // actual address
 	ServerName string // hostname for TLS verification
-}
-
-func init() {
-	connPool = &connPoolType{
-		pool: ttlcache.NewLRU(connPoolSize, defaultTTL, nil),
-	}
+	// noiseKey, if set, is the static key of a server dialed with Noise.
+	noiseKey *noise.PublicKey
 }
 
 // NewConn creates a new Conn based on a conn.Conn and spawns a goroutine to
@@ -86,11 +93,17 @@ func NewStandaloneConn(addr string, conn *conn.Conn) *Conn {
 	}
 }
 
+// key returns the key under which conn is pooled.
+func (conn *Conn) key() connKey {
+	return connKey{conn.addr, conn.client}
+}
+
 // Close closes a Conn and remove it from the conn pool
 func (conn *Conn) Close() error {
 	// TODO(joshlf): This function seems fishy because it's meant to interact with
 	// the pool, and thus could close a connection out from somebody else's feet.
-	connPool.Remove(conn.addr)
+	atomic.StoreUint32(&conn.retired, 1)
+	connPool.Remove(conn)
 	// Try sending on the buffered channel, but only if it immediately succeeds.
 	// We need to do this rather than closing the channel since Close may be
 	// called multiple times.
@@ -102,9 +115,15 @@ func (conn *Conn) Close() error {
 	return conn.Conn.Close()
 }
 
-// KeepAlive keeps Conn reusable in the conn pool
+// KeepAlive keeps Conn reusable in the conn pool. If the pool already holds
+// enough connections to the server, the Conn is closed instead.
 func (conn *Conn) KeepAlive() {
-	connPool.Add(conn.addr, conn)
+	if atomic.LoadUint32(&TestDisableConnectionPool) == 1 || atomic.LoadUint32(&conn.retired) == 1 {
+		return
+	}
+	if !connPool.Add(conn) {
+		retire(conn)
+	}
 }
 
 // healthchecker is a recurrent timer function that tests the connections
@@ -137,38 +156,6 @@ func healthchecker(c *Conn) {
 	}
 }
 
-// Get returns a Conn from the pool if there is any.
-func (p *connPoolType) Get(key string) *Conn {
-	if atomic.LoadUint32(&TestDisableConnectionPool) == 1 {
-		return nil
-	}
-	// ignore stale indicator
-	value, _ := p.pool.Get(key)
-	conn, ok := value.(*Conn)
-	if ok {
-		return conn
-	}
-	return nil
-}
-
-// Add adds a Conn to the pool.
-func (p *connPoolType) Add(key string, conn *Conn) {
-	if atomic.LoadUint32(&TestDisableConnectionPool) == 1 {
-		return
-	}
-	p.pool.Set(key, conn, defaultTTL)
-	log.Debug("add conn with key:", key)
-}
-
-// Remove removes a Conn keyed by key.
-func (p *connPoolType) Remove(key string) {
-	if atomic.LoadUint32(&TestDisableConnectionPool) == 1 {
-		return
-	}
-	p.pool.Remove(key)
-	log.Debug("remove conn with key:", key)
-}
-
 // NewServer creates a new remote based a given addr and server name.
 func NewServer(addr net.Addr, serverName string) Remote {
 	return &singleRemote{
@@ -229,6 +216,15 @@ func LookupIPs(resolvers []string, host string) (ips []net.IP, err error) {
 // LookupServerWithName uses DNS to look up an a group of Remote servers with
 // optional TLS server name.
 func (c *Client) LookupServerWithName(serverName, host, port string) (Remote, error) {
+	servers, err := c.lookupServers(serverName, host, port)
+	if err != nil {
+		return nil, err
+	}
+	return NewGroup(servers)
+}
+
+// lookupServers resolves host and returns a Remote for each usable address.
+func (c *Client) lookupServers(serverName, host, port string) ([]Remote, error) {
 	if serverName == "" {
 		serverName = host
 	}
@@ -255,7 +251,7 @@ func (c *Client) LookupServerWithName(serverName, host, port string) (Remote, er
 		}
 	}
 	log.Debugf("server lookup: %s has %d usable upstream", host, len(servers))
-	return NewGroup(servers)
+	return servers, nil
 }
 
 // LookupServer with default ServerName.
@@ -270,25 +266,53 @@ func (c *Client) LookupServer(hostport string) (Remote, error) {
 
 // Dial dials a remote server, returning an existing connection if possible.
 func (s *singleRemote) Dial(c *Client) (*Conn, error) {
+	return s.DialContext(context.Background(), c)
+}
+
+// DialContext is like Dial, but gives up when ctx is done.
+func (s *singleRemote) DialContext(ctx context.Context, c *Client) (*Conn, error) {
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
 	if c.Blacklist.Contains(s.Addr) {
 		return nil, fmt.Errorf("server %s on client blacklist", s.String())
 	}
+	stats := c.serverStatsFor(s.String())
+	if !c.CircuitBreaker.allow(s.String(), stats) {
+		return nil, fmt.Errorf("server %s: %w", s.String(), ErrCircuitOpen)
+	}
 
-	cn := connPool.Get(s.String())
+	cn := connPool.Get(connKey{s.String(), c})
 	if cn != nil {
 		return cn, nil
 	}
 
-	config := c.Config.Clone()
-	config.ServerName = s.ServerName
 	log.Debugf("Dialing %s at %s\n", s.ServerName, s.String())
-	inner, err := tls.DialWithDialer(c.Dialer, s.Network(), s.String(), config)
+	start := time.Now()
+	var inner net.Conn
+	var peerCerts []Fingerprint
+	var err error
+	if s.noiseKey != nil {
+		inner, err = c.dialNoise(ctx, s.Network(), s.String(), *s.noiseKey)
+	} else {
+		var tconn *tls.Conn
+		if tconn, err = c.dialTLS(ctx, s.Network(), s.String(), c.tlsConfig(s.ServerName)); err == nil {
+			inner = tconn
+			peerCerts = peerFingerprints(tconn.ConnectionState().PeerCertificates)
+		}
+	}
 	if err != nil {
+		if ctx.Err() == nil {
+			stats.fail()
+		}
+		c.observeDial(s.String(), time.Since(start), err)
 		return nil, err
 	}
 
 	cn = NewConn(s.String(), conn.NewConn(inner))
-	connPool.Add(s.String(), cn)
+	cn.client = c
+	cn.peerCerts = peerCerts
+	cn.Conn.StrictPadding(c.StrictPadding)
 	go func() {
 		for {
 			err := cn.Conn.DoRead()
@@ -305,6 +329,55 @@ func (s *singleRemote) Dial(c *Client) (*Conn, error) {
 		cn.Close()
 	}()
 
+	if c.Features != nil {
+		if c.OnKeyRemoved != nil {
+			addr := s.String()
+			cn.Conn.OnKeyRemoved(func(ski protocol.SKI) { c.OnKeyRemoved(addr, ski) })
+		}
+		cn.Conn.OnReconnect(func() {
+			log.Debugf("connection %v: server asked to reconnect", inner.RemoteAddr())
+			connPool.Remove(cn)
+			retire(cn)
+		})
+		features, err := cn.Conn.Hello(ctx, *c.Features)
+		if err != nil {
+			cn.Close()
+			stats.fail()
+			c.observeDial(s.String(), time.Since(start), err)
+			return nil, fmt.Errorf("hello to %s failed: %w", s.String(), err)
+		}
+		log.Debugf("negotiated protocol version %d with %s", features.Version, s.String())
+	}
+	if c.Attestation != nil {
+		err := errNoiseAttestation
+		if tlsConn, ok := inner.(*tls.Conn); ok {
+			err = c.Attestation.verify(ctx, cn.Conn, tlsConn.ConnectionState().PeerCertificates[0].Raw)
+		}
+		if err != nil {
+			cn.Close()
+			stats.fail()
+			c.observeDial(s.String(), time.Since(start), err)
+			return nil, fmt.Errorf("server %s: %w", s.String(), err)
+		}
+	}
+	if c.Token != nil {
+		token, err := c.Token(ctx)
+		if err == nil {
+			err = cn.Conn.Authenticate(ctx, token)
+		}
+		if err != nil {
+			cn.Close()
+			c.observeDial(s.String(), time.Since(start), err)
+			return nil, fmt.Errorf("authenticating to %s failed: %w", s.String(), err)
+		}
+	}
+	c.observeDial(s.String(), time.Since(start), nil)
+	stats.dialed()
+	connPool.Add(cn)
+	if c.Revalidate {
+		c.revalidate(cn)
+	}
+
 	return cn, nil
 }
 
@@ -315,7 +388,11 @@ func (s *singleRemote) PingAll(c *Client, concurrency int) {
 		return
 	}
 
+	stats := c.serverStatsFor(s.String())
+	stats.begin()
+	start := time.Now()
 	err = cn.Conn.Ping(context.Background(), nil)
+	stats.end(time.Since(start), err)
 	if err != nil {
 		cn.Close()
 	}
@@ -383,10 +460,18 @@ func NewGroup(remotes []Remote) (*Group, error) {
 	return g, nil
 }
 
-// Dial returns a connection with best latency measurement.
+// Dial returns a connection with best latency measurement, or if c.Balancer is
+// set, the first connection which succeeds in the order chosen by the balancer.
 func (g *Group) Dial(c *Client) (conn *Conn, err error) {
+	return g.DialContext(context.Background(), c)
+}
+
+// DialContext is like Dial, but gives up when ctx is done instead of trying
+// the next remote.
+func (g *Group) DialContext(ctx context.Context, c *Client) (conn *Conn, err error) {
 	g.RLock()
 	if len(g.remotes) == 0 {
+		g.RUnlock()
 		err = errors.New("remote group empty")
 		return nil, err
 	}
@@ -399,15 +484,39 @@ func (g *Group) Dial(c *Client) (conn *Conn, err error) {
 	if len(g.remotes) < n {
 		n = len(g.remotes)
 	}
+	all := make([]Remote, len(g.remotes))
+	for i, r := range g.remotes {
+		all[i] = r.Remote
+	}
 
-	remotes := make([]mRemote, n)
-	// copy and shuffle first n remotes for load balancing
-	for i := 0; i < n; i++ {
-		j := rand.Intn(i + 1)
-		if i != j {
-			remotes[i] = remotes[j]
+	var remotes []Remote
+	// affine is set if the order follows the operation's affinity key.
+	affine := false
+	if c.Balancer != nil {
+		if _, ok := c.Balancer.(ContextBalancer); ok {
+			_, affine = AffinityFromContext(ctx)
+		}
+		remotes = c.preferReachable(c.order(ctx, all))
+		if c.CircuitBreaker != nil {
+			remotes = c.preferAvailable(remotes)
+		}
+		if len(remotes) > n {
+			remotes = remotes[:n]
+		}
+	} else {
+		all = c.preferReachable(all)
+		if c.CircuitBreaker != nil {
+			all = c.preferAvailable(all)
+		}
+		remotes = make([]Remote, n)
+		// copy and shuffle first n remotes for load balancing
+		for i := 0; i < n; i++ {
+			j := rand.Intn(i + 1)
+			if i != j {
+				remotes[i] = remotes[j]
+			}
+			remotes[j] = all[i]
 		}
-		remotes[j] = g.remotes[i]
 	}
 	g.RUnlock()
 
@@ -421,13 +530,16 @@ func (g *Group) Dial(c *Client) (conn *Conn, err error) {
 
 	}()
 
+	// Racing would reorder the servers of an affinity key.
+	if c.DialRaceDelay > 0 && len(remotes) > 1 && !affine {
+		return c.raceDial(ctx, interleaveFamilies(remotes))
+	}
 	for _, r := range remotes {
-		conn, err = r.Dial(c)
-		if err != nil {
-			log.Debugf("retry due to dial failure: %v", err)
-		} else {
+		conn, err = c.DialContext(ctx, r)
+		if err == nil || ctx.Err() != nil {
 			break
 		}
+		log.Debugf("retry due to dial failure: %v", err)
 	}
 
 	return conn, err
@@ -3,8 +3,12 @@ package client
 import (
 	"context"
 	"crypto"
+	"crypto/rand"
+	"crypto/sha256"
 	"crypto/x509"
 	"encoding/pem"
+	"errors"
+	"io"
 	"io/ioutil"
 	"log"
 	"net"
@@ -14,6 +18,7 @@ import (
 
 	"github.com/cloudflare/cfssl/helpers"
 	"github.com/cloudflare/cfssl/helpers/derhelpers"
+	"github.com/cloudflare/gokeyless/conn"
 	"github.com/cloudflare/gokeyless/server"
 )
 
@@ -234,6 +239,62 @@ func TestSlowServer(t *testing.T) {
 	}
 }
 
+func TestContext(t *testing.T) {
+	// A server which accepts connections, but never completes a handshake.
+	l, err := net.Listen("tcp", "localhost:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer l.Close()
+	go func() {
+		var conns []net.Conn
+		for {
+			cn, err := l.Accept()
+			if err != nil {
+				break
+			}
+			conns = append(conns, cn)
+		}
+		for _, cn := range conns {
+			cn.Close()
+		}
+	}()
+	host, port, _ := net.SplitHostPort(l.Addr().String())
+	stuck, err := c.LookupServerWithName("localhost", host, port)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 100*time.Millisecond)
+	defer cancel()
+	start := time.Now()
+	if _, err := c.DialContext(ctx, stuck); !errors.Is(err, context.DeadlineExceeded) {
+		t.Fatalf("dialing a stuck server: got %v, want %v", err, context.DeadlineExceeded)
+	}
+	if d := time.Since(start); d >= c.Dialer.Timeout {
+		t.Fatalf("dialing a stuck server took %v", d)
+	}
+
+	// A cancelled operation is neither sent nor retried.
+	ctx, cancel = context.WithCancel(context.Background())
+	cancel()
+	digest := sha256.Sum256([]byte("hello"))
+	if _, err := ecdsaSigner.(*PrivateKey).SignContext(ctx, rand.Reader, digest[:], crypto.SHA256); !errors.Is(err, context.Canceled) {
+		t.Fatalf("signing with a cancelled context: got %v, want %v", err, context.Canceled)
+	}
+
+	// An operation the server never answers gives up at the deadline.
+	client, server := net.Pipe()
+	defer client.Close()
+	defer server.Close()
+	go io.Copy(ioutil.Discard, server)
+	ctx, cancel = context.WithTimeout(context.Background(), 100*time.Millisecond)
+	defer cancel()
+	if err := conn.NewConn(client).Ping(ctx, nil); !errors.Is(err, context.DeadlineExceeded) {
+		t.Fatalf("unanswered ping: got %v, want %v", err, context.DeadlineExceeded)
+	}
+}
+
 // helper function reads a cert from a file and convert it to a signer
 func NewRemoteSignerByCertFile(filepath string) (crypto.Signer, error) {
 	pemBytes, err := ioutil.ReadFile(filepath)
@@ -0,0 +1,135 @@
+package client
+
+import (
+	"context"
+	"sync"
+	"time"
+
+	"github.com/cloudflare/cfssl/log"
+	"github.com/cloudflare/gokeyless/protocol"
+)
+
+// revalidateTimeout bounds each probe sent when revalidating keys.
+const revalidateTimeout = 5 * time.Second
+
+// servedKeys are the keys used on a keyserver, by the address of the server.
+type servedKeys struct {
+	mtx  sync.Mutex
+	keys map[protocol.SKI]*PrivateKey
+	// unavailable holds the SKIs of the keys the server was found not to
+	// hold.
+	unavailable map[protocol.SKI]bool
+	// revalidating is set while the keys are being probed.
+	revalidating bool
+}
+
+// servedKeysFor returns the keys used on the keyserver at addr, and whether
+// any connection was established to it before.
+func (c *Client) servedKeysFor(addr string) (*servedKeys, bool) {
+	v, loaded := c.served.LoadOrStore(addr, &servedKeys{
+		keys:        make(map[protocol.SKI]*PrivateKey),
+		unavailable: make(map[protocol.SKI]bool),
+	})
+	return v.(*servedKeys), loaded
+}
+
+// recordServed records the result of an operation with key on the keyserver
+// at addr: the key is unavailable there if it wasn't found, and otherwise
+// available.
+func (c *Client) recordServed(addr string, key *PrivateKey, result *protocol.Operation) {
+	if !c.Revalidate || result == nil {
+		return
+	}
+	sk, _ := c.servedKeysFor(addr)
+	sk.mtx.Lock()
+	defer sk.mtx.Unlock()
+	sk.keys[key.ski] = key
+	if result.Opcode == protocol.OpError && result.GetError() == protocol.ErrKeyNotFound {
+		sk.unavailable[key.ski] = true
+	} else {
+		delete(sk.unavailable, key.ski)
+	}
+}
+
+// KeyAvailable reports whether the keyserver at addr (host:port) may hold the
+// key with the given SKI. With Revalidate, it is false once an operation or a
+// probe found that the server doesn't hold the key, until an operation with
+// it succeeds there again; otherwise it is always true.
+func (c *Client) KeyAvailable(addr string, ski protocol.SKI) bool {
+	v, ok := c.served.Load(addr)
+	if !ok {
+		return true
+	}
+	sk := v.(*servedKeys)
+	sk.mtx.Lock()
+	defer sk.mtx.Unlock()
+	return !sk.unavailable[ski]
+}
+
+// revalidate probes, in the background, each key used on the keyserver of
+// cn, if a connection was established to the server before, as happens when
+// it restarts. Keys the server no longer holds are marked unavailable and
+// passed to OnKeyRemoved.
+func (c *Client) revalidate(cn *Conn) {
+	sk, loaded := c.servedKeysFor(cn.addr)
+	if !loaded {
+		return
+	}
+	sk.mtx.Lock()
+	if sk.revalidating || len(sk.keys) == 0 {
+		sk.mtx.Unlock()
+		return
+	}
+	sk.revalidating = true
+	keys := make([]*PrivateKey, 0, len(sk.keys))
+	for _, key := range sk.keys {
+		keys = append(keys, key)
+	}
+	sk.mtx.Unlock()
+
+	go func() {
+		defer func() {
+			sk.mtx.Lock()
+			sk.revalidating = false
+			sk.mtx.Unlock()
+		}()
+		for _, key := range keys {
+			ctx, cancel := context.WithTimeout(context.Background(), revalidateTimeout)
+			result, err := cn.Conn.DoOperation(ctx, protocol.Operation{
+				Opcode:   protocol.OpProbeKey,
+				SKI:      key.skiFor(cn),
+				ClientIP: key.clientIP,
+				ServerIP: key.serverIP,
+				SNI:      key.sni,
+				CertID:   key.certID,
+			})
+			cancel()
+			if err != nil {
+				log.Debugf("revalidation of keys on %s: %v", cn.addr, err)
+				return
+			}
+			if result.Opcode != protocol.OpError {
+				sk.mtx.Lock()
+				delete(sk.unavailable, key.ski)
+				sk.mtx.Unlock()
+				continue
+			}
+			switch result.GetError() {
+			case protocol.ErrKeyNotFound:
+				sk.mtx.Lock()
+				removed := !sk.unavailable[key.ski]
+				sk.unavailable[key.ski] = true
+				sk.mtx.Unlock()
+				log.Warningf("keyserver %s no longer holds key %v", cn.addr, key.ski)
+				if removed && c.OnKeyRemoved != nil {
+					c.OnKeyRemoved(cn.addr, key.ski)
+				}
+			case protocol.ErrBadOpcode, protocol.ErrUnexpectedOpcode:
+				log.Debugf("keyserver %s can't probe keys; skipping revalidation", cn.addr)
+				return
+			default:
+				log.Debugf("revalidation of key %v on %s: %v", key.ski, cn.addr, result.GetError())
+			}
+		}
+	}()
+}
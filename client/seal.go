@@ -0,0 +1,38 @@
+package client
+
+import (
+	"context"
+
+	"github.com/cloudflare/gokeyless/protocol"
+)
+
+// streamMargin leaves room in a packet for results larger than the payload,
+// such as sealed blobs, so that they needn't be streamed back.
+const streamMargin = 1024
+
+// Seal asks server to encrypt blob with protocol.OpSeal, under a key which
+// never leaves the server. The result can only be decrypted with Unseal.
+// Blobs too large for a packet are streamed with protocol.OpStream.
+func (c *Client) Seal(ctx context.Context, server string, blob []byte) ([]byte, error) {
+	return c.do(ctx, server, protocol.Operation{Opcode: protocol.OpSeal, Payload: blob})
+}
+
+// Unseal asks server to decrypt and authenticate a blob returned by Seal with
+// protocol.OpUnseal. Servers using server.AEADSealer respond with
+// protocol.ErrExpired once the key the blob was sealed with is retired.
+// Blobs too large for a packet are streamed with protocol.OpStream.
+func (c *Client) Unseal(ctx context.Context, server string, sealed []byte) ([]byte, error) {
+	return c.do(ctx, server, protocol.Operation{Opcode: protocol.OpUnseal, Payload: sealed})
+}
+
+// doOperation performs op on conn, streaming OpSeal and OpUnseal operations
+// whose blob doesn't fit in a packet.
+func (conn *Conn) doOperation(ctx context.Context, op protocol.Operation) (*protocol.Operation, error) {
+	switch op.Opcode {
+	case protocol.OpSeal, protocol.OpUnseal:
+		if len(op.Payload)+streamMargin > int(conn.Conn.Features().MaxPayload) {
+			return conn.Conn.DoStream(ctx, op)
+		}
+	}
+	return conn.Conn.DoOperation(ctx, op)
+}
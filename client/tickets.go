@@ -0,0 +1,70 @@
+package client
+
+import (
+	"context"
+	"crypto/tls"
+	"errors"
+	"fmt"
+	"time"
+
+	"github.com/cloudflare/cfssl/log"
+	"github.com/cloudflare/gokeyless/protocol"
+)
+
+// GetTicketKeys fetches the current TLS session ticket keys from server. The
+// first key is the one new tickets should be encrypted with.
+func (c *Client) GetTicketKeys(ctx context.Context, server string) ([][32]byte, error) {
+	payload, err := c.do(ctx, server, protocol.Operation{Opcode: protocol.OpGetTicketKeys})
+	if err != nil {
+		return nil, err
+	}
+
+	if len(payload) == 0 || len(payload)%32 != 0 {
+		return nil, fmt.Errorf("invalid ticket key payload length: %d", len(payload))
+	}
+
+	keys := make([][32]byte, len(payload)/32)
+	for i := range keys {
+		copy(keys[i][:], payload[i*32:])
+	}
+	return keys, nil
+}
+
+// SyncSessionTicketKeys fetches the session ticket keys from server and installs
+// them in config, then keeps them up to date by refetching every interval.
+// Refresh failures are logged and the previous keys are kept. The returned
+// function stops the refresh.
+func (c *Client) SyncSessionTicketKeys(ctx context.Context, server string, config *tls.Config, interval time.Duration) (stop func(), err error) {
+	if interval <= 0 {
+		return nil, errors.New("ticket key refresh interval must be positive")
+	}
+
+	keys, err := c.GetTicketKeys(ctx, server)
+	if err != nil {
+		return nil, err
+	}
+	config.SetSessionTicketKeys(keys)
+
+	done := make(chan struct{})
+	go func() {
+		ticker := time.NewTicker(interval)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-ticker.C:
+			case <-done:
+				return
+			case <-ctx.Done():
+				return
+			}
+
+			keys, err := c.GetTicketKeys(ctx, server)
+			if err != nil {
+				log.Warningf("failed to refresh session ticket keys from %s: %v", server, err)
+				continue
+			}
+			config.SetSessionTicketKeys(keys)
+		}
+	}()
+	return func() { close(done) }, nil
+}
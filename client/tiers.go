@@ -0,0 +1,108 @@
+package client
+
+import (
+	"context"
+	"errors"
+
+	"github.com/cloudflare/cfssl/log"
+	"github.com/cloudflare/gokeyless/protocol"
+)
+
+// A TieredRemote is a Remote made of ordered tiers of servers, e.g. the
+// keyservers local to the edge, then regional ones, then the origin. Dial
+// tries every server of a tier before moving on to the next, so that failover
+// is deterministic and requests stay as local as possible. Within a tier,
+// servers are dialed in the order chosen by the Client's Balancer, or in a
+// random order, with those which recently failed last.
+type TieredRemote struct {
+	tiers [][]Remote
+}
+
+// NewTieredRemote returns a TieredRemote with the given tiers, from the most
+// preferred to the least. Empty tiers are skipped.
+func NewTieredRemote(tiers ...[]Remote) (*TieredRemote, error) {
+	t := new(TieredRemote)
+	for _, tier := range tiers {
+		if len(tier) > 0 {
+			t.tiers = append(t.tiers, append([]Remote(nil), tier...))
+		}
+	}
+	if len(t.tiers) == 0 {
+		return nil, errors.New("attempted to create tiered remote without servers")
+	}
+	return t, nil
+}
+
+// Dial returns a connection to the first server which can be dialed, in the
+// tier order.
+func (t *TieredRemote) Dial(c *Client) (*Conn, error) {
+	return t.DialContext(context.Background(), c)
+}
+
+// DialContext is like Dial, but gives up when ctx is done instead of trying
+// the next server.
+func (t *TieredRemote) DialContext(ctx context.Context, c *Client) (conn *Conn, err error) {
+	for i, tier := range t.tiers {
+		var remotes []Remote
+		if c.Balancer != nil {
+			remotes = c.order(ctx, tier)
+		} else {
+			remotes = RandomBalancer{}.Order(c, tier)
+		}
+		remotes = c.preferReachable(remotes)
+		if c.CircuitBreaker != nil {
+			remotes = c.preferAvailable(remotes)
+		}
+		for _, r := range remotes {
+			conn, err = c.DialContext(ctx, r)
+			if err == nil || ctx.Err() != nil {
+				return conn, err
+			}
+			log.Debugf("tier %d: retry due to dial failure: %v", i, err)
+		}
+	}
+	return nil, err
+}
+
+// PingAll pings the servers of every tier.
+func (t *TieredRemote) PingAll(c *Client, concurrency int) {
+	for _, tier := range t.tiers {
+		for _, r := range tier {
+			r.PingAll(c, concurrency)
+		}
+	}
+}
+
+// RegisterTiers makes the operations of the key with ski go to tiers of
+// servers, as with a TieredRemote, instead of the keyserver its signer was
+// created with. With a WarmUp policy, connections to the tiers are kept warm
+// until they are unregistered.
+func (c *Client) RegisterTiers(ski protocol.SKI, tiers ...[]Remote) error {
+	t, err := NewTieredRemote(tiers...)
+	if err != nil {
+		return err
+	}
+	if old, ok := c.tiers.Load(ski); ok {
+		c.stopWarmUp(old)
+	}
+	c.tiers.Store(ski, t)
+	c.warmUp(t, func() (Remote, error) { return t, nil })
+	return nil
+}
+
+// UnregisterTiers removes the tiers registered for the key with ski, if any.
+func (c *Client) UnregisterTiers(ski protocol.SKI) {
+	if t, ok := c.tiers.Load(ski); ok {
+		c.stopWarmUp(t)
+	}
+	c.tiers.Delete(ski)
+}
+
+// remoteFor returns the Remote which serves key: its registered tiers, if
+// any, or its keyserver.
+func (c *Client) remoteFor(key *PrivateKey) (Remote, error) {
+	if t, ok := c.tiers.Load(key.ski); ok {
+		return t.(*TieredRemote), nil
+	}
+	return c.getRemote(key.keyserver)
+}
@@ -0,0 +1,98 @@
+package client
+
+import (
+	"context"
+	"crypto/tls"
+	"errors"
+	"sort"
+	"testing"
+
+	"github.com/cloudflare/gokeyless/protocol"
+)
+
+// dialLog is a Remote which records its dials in a shared log before dialing
+// a raceRemote.
+type dialLog struct {
+	*raceRemote
+	dials *[]string
+}
+
+func (r dialLog) Dial(c *Client) (*Conn, error) {
+	return r.DialContext(context.Background(), c)
+}
+
+func (r dialLog) DialContext(ctx context.Context, c *Client) (*Conn, error) {
+	*r.dials = append(*r.dials, r.name)
+	return r.raceRemote.DialContext(ctx, c)
+}
+
+func TestTieredRemote(t *testing.T) {
+	c := &Client{}
+	var dials []string
+	refused := errors.New("refused")
+	remote := func(name string, err error) Remote {
+		return dialLog{newRaceRemote(name, 0, err), &dials}
+	}
+
+	if _, err := NewTieredRemote(nil, []Remote{}); err == nil {
+		t.Fatal("created a tiered remote without servers")
+	}
+
+	// Every server of a tier is tried before the next tier.
+	tiers, err := NewTieredRemote(
+		[]Remote{remote("edge1", refused), remote("edge2", refused)},
+		nil,
+		[]Remote{remote("regional1", refused), remote("regional2", nil)},
+		[]Remote{remote("origin", nil)},
+	)
+	if err != nil {
+		t.Fatal(err)
+	}
+	cn, err := tiers.Dial(c)
+	if err != nil {
+		t.Fatal(err)
+	}
+	cn.Close()
+	if cn.addr != "regional2" {
+		t.Fatalf("got a connection to %s", cn.addr)
+	}
+	// Servers of a tier are dialed in a random order, so regional1 may not
+	// have been dialed.
+	if len(dials) < 3 {
+		t.Fatalf("unexpected dials: %v", dials)
+	}
+	edge := append([]string(nil), dials[:2]...)
+	sort.Strings(edge)
+	if edge[0] != "edge1" || edge[1] != "edge2" || dials[len(dials)-1] != "regional2" {
+		t.Fatalf("unexpected dials: %v", dials)
+	}
+
+	// The last error is returned if no server can be dialed.
+	dials = nil
+	tiers, _ = NewTieredRemote([]Remote{remote("edge", refused)}, []Remote{remote("origin", refused)})
+	if _, err := tiers.Dial(c); err != refused {
+		t.Fatalf("got %v", err)
+	}
+	if len(dials) != 2 || dials[0] != "edge" || dials[1] != "origin" {
+		t.Fatalf("unexpected dials: %v", dials)
+	}
+
+	// Keys with registered tiers use them instead of their keyserver.
+	c = NewClient(tls.Certificate{}, nil)
+	ski := protocol.SKI{1}
+	if err := c.RegisterTiers(ski, []Remote{remote("edge", nil)}); err != nil {
+		t.Fatal(err)
+	}
+	key := &PrivateKey{client: c, ski: ski, keyserver: "unused.example:2407"}
+	r, err := c.remoteFor(key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, ok := r.(*TieredRemote); !ok {
+		t.Fatalf("got remote %T", r)
+	}
+	c.UnregisterTiers(ski)
+	if r, _ := c.remoteFor(&PrivateKey{client: c, ski: ski}); r != nil {
+		t.Fatalf("got remote %T without a keyserver", r)
+	}
+}
@@ -0,0 +1,103 @@
+package client
+
+import (
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"net"
+)
+
+// A CertificateSource looks up the certificate chain to serve in a TLS
+// handshake, such as a CertificateMap. The PrivateKey of the certificates it
+// returns is ignored.
+type CertificateSource interface {
+	// GetCertificate returns the certificate for hello, or nil if there is
+	// none.
+	GetCertificate(hello *tls.ClientHelloInfo) (*tls.Certificate, error)
+}
+
+// NewGetCertificate returns a function to be used as tls.Config.GetCertificate
+// by TLS terminators. It looks up the certificate for each handshake in certs
+// and pairs it with a remote signer for the certificate's key on server, or
+// on c.DefaultRemote if server is empty. The SNI and local address of the
+// handshake are sent to the keyserver to help it identify the key.
+func NewGetCertificate(c *Client, server string, certs CertificateSource) func(*tls.ClientHelloInfo) (*tls.Certificate, error) {
+	return func(hello *tls.ClientHelloInfo) (*tls.Certificate, error) {
+		cert, err := certs.GetCertificate(hello)
+		if err != nil || cert == nil {
+			return nil, err
+		}
+		if len(cert.Certificate) == 0 {
+			return nil, errors.New("certificate chain is empty")
+		}
+
+		leaf := cert.Leaf
+		if leaf == nil {
+			if leaf, err = x509.ParseCertificate(cert.Certificate[0]); err != nil {
+				return nil, err
+			}
+		}
+		var serverIP net.IP
+		if hello.Conn != nil {
+			if addr, ok := hello.Conn.LocalAddr().(*net.TCPAddr); ok {
+				serverIP = addr.IP
+			}
+		}
+		priv, err := c.NewRemoteSignerTemplate(context.Background(), server, leaf.PublicKey, hello.ServerName, serverIP)
+		if err != nil {
+			return nil, err
+		}
+
+		return &tls.Certificate{
+			Certificate:                 cert.Certificate,
+			PrivateKey:                  priv,
+			OCSPStaple:                  cert.OCSPStaple,
+			SignedCertificateTimestamps: cert.SignedCertificateTimestamps,
+			Leaf:                        leaf,
+		}, nil
+	}
+}
+
+// NewGetClientCertificate returns a function to be used as
+// tls.Config.GetClientCertificate by clients which authenticate to TLS
+// servers with certificates whose private keys are kept on a keyserver. It
+// pairs each of chains with a remote signer for its leaf's key on server, or
+// on c.DefaultRemote if server is empty, and answers certificate requests
+// with the first chain the server accepts, or with no certificate if it
+// accepts none, as crypto/tls does with tls.Config.Certificates. The
+// PrivateKey of the chains is ignored.
+func NewGetClientCertificate(c *Client, server string, chains ...tls.Certificate) (func(*tls.CertificateRequestInfo) (*tls.Certificate, error), error) {
+	certs := make([]*tls.Certificate, len(chains))
+	for i, chain := range chains {
+		if len(chain.Certificate) == 0 {
+			return nil, errors.New("certificate chain is empty")
+		}
+		leaf := chain.Leaf
+		if leaf == nil {
+			var err error
+			if leaf, err = x509.ParseCertificate(chain.Certificate[0]); err != nil {
+				return nil, err
+			}
+		}
+		priv, err := c.NewRemoteSignerByCert(context.Background(), server, leaf)
+		if err != nil {
+			return nil, err
+		}
+		certs[i] = &tls.Certificate{
+			Certificate:                 chain.Certificate,
+			PrivateKey:                  priv,
+			OCSPStaple:                  chain.OCSPStaple,
+			SignedCertificateTimestamps: chain.SignedCertificateTimestamps,
+			Leaf:                        leaf,
+		}
+	}
+	return func(cri *tls.CertificateRequestInfo) (*tls.Certificate, error) {
+		for _, cert := range certs {
+			if err := cri.SupportsCertificate(cert); err == nil {
+				return cert, nil
+			}
+		}
+		return new(tls.Certificate), nil
+	}, nil
+}
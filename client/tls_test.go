@@ -0,0 +1,116 @@
+package client
+
+import (
+	"crypto/ed25519"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"math/big"
+	"net"
+	"testing"
+	"time"
+)
+
+func TestNewGetCertificate(t *testing.T) {
+	c := NewClient(tls.Certificate{}, nil)
+	expiry := time.Now().Add(24 * time.Hour)
+	ca, caKey, caPEM := newTestCert(t, nil, nil, true, expiry)
+	_, _, leafPEM := newTestCert(t, ca, caKey, false, expiry, "example.com")
+	certs, err := c.RegisterPEMBundle("", append(leafPEM, caPEM...))
+	if err != nil {
+		t.Fatal(err)
+	}
+	// The source's chain must be served even if it has no parsed leaf.
+	certs["example.com"].Leaf = nil
+
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer l.Close()
+	conn, err := net.Dial("tcp", l.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+
+	getCertificate := NewGetCertificate(c, "localhost:2407", certs)
+	cert, err := getCertificate(&tls.ClientHelloInfo{ServerName: "example.com", Conn: conn})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(cert.Certificate) != 2 || cert.Leaf == nil {
+		t.Fatal("certificate chain not served")
+	}
+	key, ok := cert.PrivateKey.(*PrivateKey)
+	if !ok {
+		t.Fatalf("got a %T key", cert.PrivateKey)
+	}
+	if key.keyserver != "localhost:2407" || key.sni != "example.com" || !key.serverIP.Equal(net.IPv4(127, 0, 0, 1)) {
+		t.Fatalf("key has keyserver %q, SNI %q and server IP %v", key.keyserver, key.sni, key.serverIP)
+	}
+
+	if cert, err := getCertificate(&tls.ClientHelloInfo{ServerName: "other.com"}); cert != nil || err != nil {
+		t.Fatalf("got %v, %v for an unknown name", cert, err)
+	}
+}
+
+func TestNewGetClientCertificate(t *testing.T) {
+	c := NewClient(tls.Certificate{}, nil)
+	expiry := time.Now().Add(24 * time.Hour)
+	ca, caKey, _ := newTestCert(t, nil, nil, true, expiry)
+	leaf, _, _ := newTestCert(t, ca, caKey, false, expiry)
+	// other is self-signed with an Ed25519 key.
+	_, otherKey, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	tmpl := &x509.Certificate{
+		SerialNumber: big.NewInt(1),
+		Subject:      pkix.Name{CommonName: "other"},
+		NotAfter:     expiry,
+	}
+	otherDER, err := x509.CreateCertificate(rand.Reader, tmpl, tmpl, otherKey.Public(), otherKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if _, err := NewGetClientCertificate(c, "", tls.Certificate{}); err == nil {
+		t.Fatal("accepted an empty chain")
+	}
+	getClientCertificate, err := NewGetClientCertificate(c, "localhost:2407",
+		tls.Certificate{Certificate: [][]byte{otherDER}},
+		tls.Certificate{Certificate: [][]byte{leaf.Raw, ca.Raw}},
+	)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// The server only accepts ECDSA certificates issued by ca.
+	cri := &tls.CertificateRequestInfo{
+		AcceptableCAs:    [][]byte{ca.RawSubject},
+		SignatureSchemes: []tls.SignatureScheme{tls.ECDSAWithP256AndSHA256, tls.Ed25519},
+		Version:          tls.VersionTLS12,
+	}
+	cert, err := getClientCertificate(cri)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(cert.Certificate) != 2 || !cert.Leaf.Equal(leaf) {
+		t.Fatal("the accepted chain was not sent")
+	}
+	key, ok := cert.PrivateKey.(*PrivateKey)
+	if !ok {
+		t.Fatalf("got a %T key", cert.PrivateKey)
+	}
+	if key.keyserver != "localhost:2407" {
+		t.Fatalf("key has keyserver %q", key.keyserver)
+	}
+
+	// Servers which accept no chain get no certificate.
+	cri.SignatureSchemes = []tls.SignatureScheme{tls.PSSWithSHA256}
+	if cert, err := getClientCertificate(cri); err != nil || len(cert.Certificate) != 0 {
+		t.Fatalf("got %v, %v for a server accepting no chain", cert, err)
+	}
+}
@@ -0,0 +1,114 @@
+package client
+
+import (
+	"context"
+	"sync/atomic"
+	"time"
+
+	"github.com/cloudflare/cfssl/log"
+)
+
+// defaultWarmUpInterval is how often warm connections are pinged by default.
+const defaultWarmUpInterval = 30 * time.Second
+
+// A WarmUpPolicy makes a Client connect to keyservers as soon as keys are
+// registered with them, and keep those connections open with periodic pings,
+// so that the first operations of a freshly started process don't pay for the
+// keyserver's TLS handshake. Warm connections are those of the connection
+// pool, which keeps up to ConnPoolConfig.MaxConnsPerServer of them per server.
+type WarmUpPolicy struct {
+	// Conns is the number of connections dialed, or pinged once dialed, each
+	// interval. It defaults to 1, and should match MaxConnsPerServer.
+	Conns int
+	// PingInterval is how often warm connections are pinged, and those which
+	// failed re-dialed. It defaults to 30 seconds, and must be below the
+	// pool's IdleTimeout for connections to stay warm.
+	PingInterval time.Duration
+}
+
+// warmUp starts keeping the connections of the Remote returned by remote warm,
+// under key, unless they already are or c has no WarmUp policy.
+func (c *Client) warmUp(key interface{}, remote func() (Remote, error)) {
+	if c.WarmUp == nil {
+		return
+	}
+	stop := make(chan struct{})
+	if _, loaded := c.warm.LoadOrStore(key, stop); loaded {
+		return
+	}
+	go c.keepWarm(key, remote, *c.WarmUp, stop)
+}
+
+// StopWarmUp stops keeping connections warm. Connections already established
+// stay in the pool until they are idle. Keys registered afterwards are warmed
+// up again.
+func (c *Client) StopWarmUp() {
+	c.warm.Range(func(key, _ interface{}) bool {
+		c.stopWarmUp(key)
+		return true
+	})
+}
+
+// stopWarmUp stops keeping the connections warmed up under key warm.
+func (c *Client) stopWarmUp(key interface{}) {
+	if stop, ok := c.warm.Load(key); ok {
+		c.warm.Delete(key)
+		close(stop.(chan struct{}))
+	}
+}
+
+func (c *Client) keepWarm(key interface{}, remote func() (Remote, error), policy WarmUpPolicy, stop chan struct{}) {
+	n := policy.Conns
+	if n < 1 {
+		n = 1
+	}
+	interval := policy.PingInterval
+	if interval <= 0 {
+		interval = defaultWarmUpInterval
+	}
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		if r, err := remote(); err != nil {
+			log.Debugf("warm-up of %v: %v", key, err)
+		} else {
+			c.warmConns(r, n, interval)
+		}
+		select {
+		case <-ticker.C:
+		case <-stop:
+			return
+		}
+	}
+}
+
+// warmConns dials r n times, pinging the connections, which are pooled ones
+// once the pool is full.
+func (c *Client) warmConns(r Remote, n int, timeout time.Duration) {
+	for i := 0; i < n; i++ {
+		ctx, cancel := context.WithTimeout(context.Background(), timeout)
+		conn, err := c.DialContext(ctx, r)
+		if err != nil {
+			cancel()
+			log.Debugf("warm-up dial failed: %v", err)
+			return
+		}
+		err = conn.Ping(ctx, nil)
+		cancel()
+		switch {
+		case err != nil:
+			log.Debugf("warm-up ping to %s failed: %v", conn.addr, err)
+			conn.Close()
+		case atomic.LoadUint32(&TestDisableConnectionPool) == 1:
+			conn.Close()
+		default:
+			conn.KeepAlive()
+		}
+	}
+}
+
+// warmUpKeyserver warms up the connections to keyserver, the address keys are
+// registered with.
+func (c *Client) warmUpKeyserver(keyserver string) {
+	c.warmUp(keyserver, func() (Remote, error) { return c.getRemote(keyserver) })
+}
@@ -0,0 +1,89 @@
+package client
+
+import (
+	"context"
+	"crypto"
+	"crypto/rand"
+	"crypto/sha256"
+	"net"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/cloudflare/gokeyless/protocol"
+	"github.com/cloudflare/gokeyless/server"
+)
+
+// dialMetrics counts successful dials.
+type dialMetrics struct {
+	mtx   sync.Mutex
+	dials int
+}
+
+func (m *dialMetrics) ObserveRequest(string, protocol.Op, time.Duration, error) {}
+func (m *dialMetrics) ObserveDial(addr string, latency time.Duration, err error) {
+	if err == nil {
+		m.mtx.Lock()
+		m.dials++
+		m.mtx.Unlock()
+	}
+}
+
+func (m *dialMetrics) count() int {
+	m.mtx.Lock()
+	defer m.mtx.Unlock()
+	return m.dials
+}
+
+func TestWarmUp(t *testing.T) {
+	// A server of its own, so that no connection to it is pooled yet.
+	s, err := server.NewServerFromFile(nil, serverCert, serverKey, keylessCA)
+	if err != nil {
+		t.Fatal(err)
+	}
+	s.TLSConfig().Time = fixedCurrentTime
+	keys, err := server.NewKeystoreFromDir("testdata", LoadKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	s.SetKeystore(keys)
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	go s.Serve(l)
+	defer s.Close()
+
+	c, err := NewClientFromFile(clientCert, clientKey, keyserverCA)
+	if err != nil {
+		t.Fatal(err)
+	}
+	c.Config.Time = fixedCurrentTime
+	c.DefaultRemote = NewServer(l.Addr(), "localhost")
+	metrics := &dialMetrics{}
+	c.Metrics = metrics
+	c.WarmUp = &WarmUpPolicy{PingInterval: 200 * time.Millisecond}
+	defer c.StopWarmUp()
+
+	key, err := c.NewRemoteSignerByPublicKey(context.Background(), "", ecdsaSigner.Public())
+	if err != nil {
+		t.Fatal(err)
+	}
+	deadline := time.Now().Add(5 * time.Second)
+	for metrics.count() == 0 {
+		if time.Now().After(deadline) {
+			t.Fatal("no connection was warmed up")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+
+	// Signing uses the warm connection, which pings keep alive.
+	time.Sleep(500 * time.Millisecond)
+	digest := sha256.Sum256([]byte("message"))
+	if _, err := key.Sign(rand.Reader, digest[:], crypto.SHA256); err != nil {
+		t.Fatal(err)
+	}
+	if n := metrics.count(); n != 1 {
+		t.Fatalf("dialed %d connections instead of 1", n)
+	}
+}
@@ -3,6 +3,7 @@
 package main
 
 import (
+	"context"
 	"crypto/rand"
 	"crypto/tls"
 	"encoding/hex"
@@ -34,6 +35,8 @@ var (
 	portFlag     uint64
 
 	bwFlag                     bool
+	loadFlag                   bool
+	requestsFlag               int
 	gmpFlag                    int
 	workersFlag                int
 	durFlag                    time.Duration
@@ -69,11 +72,13 @@ func init() {
 	flag.StringVar(&sniFlag, "sni", "localhost", "SNI of the certificate to request a signature for")
 	flag.StringVar(&serverIPFlag, "server-ip", "127.0.0.1", "IP address of the certificate to request a signature for")
 	flag.StringVar(&skiFlag, "ski", "D9C69B8E23ABBA7C26FD5D0E282F3DD679741036", "SKI of the key to request a signature from")
-	flag.StringVar(&opFlag, "op", "ECDSA-SHA512", "the operation to request from the server")
+	flag.StringVar(&opFlag, "op", "ECDSA-SHA512", "the operation to request from the server (a comma-separated list for load tests)")
 	flag.StringVar(&serverFlag, "server", "localhost", "keyless server to connect to")
 	flag.Uint64Var(&portFlag, "port", 2407, "port to connect to the keyless server on")
 
 	flag.BoolVar(&bwFlag, "bandwidth", false, "perform a bandwidth test rather than a latency test")
+	flag.BoolVar(&loadFlag, "load", false, "perform a load test reporting latency percentiles and throughput")
+	flag.IntVar(&requestsFlag, "requests", 0, "for load tests, stop after this many requests (default unlimited)")
 	flag.IntVar(&gmpFlag, "gmp", runtime.GOMAXPROCS(0), "override the default GOMAXPROCS")
 	flag.IntVar(&workersFlag, "workers", runtime.NumCPU(), "the number of worker goroutines to use")
 	flag.DurationVar(&durFlag, "duration", 10*time.Second, "the duration to run the test for")
@@ -119,13 +124,20 @@ func main() {
 		op.SNI = sniFlag
 	}
 
-	opFn, ok := ops[opFlag]
-	if !ok {
-		fmt.Fprintf(os.Stderr, "unrecognized signing operation: %v", opFlag)
+	var loadOps []protocol.Operation
+	for _, name := range strings.Split(opFlag, ",") {
+		opFn, ok := ops[name]
+		if !ok {
+			fmt.Fprintf(os.Stderr, "unrecognized signing operation: %v", name)
+			os.Exit(2) // same code flag package uses for usage errors
+		}
+		loadOps = append(loadOps, opFn(op))
+	}
+	if len(loadOps) > 1 && !loadFlag {
+		fmt.Fprintln(os.Stderr, "multiple operations are only supported for load tests")
 		os.Exit(2) // same code flag package uses for usage errors
 	}
-
-	op = opFn(op)
+	op = loadOps[0]
 
 	runtime.GOMAXPROCS(gmpFlag)
 
@@ -134,7 +146,23 @@ func main() {
 		panic(err)
 	}
 
-	if bwFlag {
+	if loadFlag {
+		// Run a load test
+		client.SetConnPoolConfig(client.ConnPoolConfig{MaxConnsPerServer: workersFlag, IdleTimeout: time.Hour})
+		lt := &client.LoadTester{
+			Client:      cli,
+			Server:      net.JoinHostPort(serverFlag, fmt.Sprint(portFlag)),
+			Concurrency: workersFlag,
+			Duration:    durFlag,
+			Requests:    requestsFlag,
+			Ops:         loadOps,
+		}
+		res, err := lt.Run(context.Background())
+		if err != nil {
+			panic(err)
+		}
+		fmt.Print(res)
+	} else if bwFlag {
 		// Run a bandwidth test
 		var clients []bclient.BandwidthClient
 		for i := 0; i < workersFlag; i++ {
@@ -187,13 +215,13 @@ func readPacket(conn *tls.Conn) {
 		panic(err)
 	}
 
-	var pkt protocol.Packet
-	err = pkt.UnmarshalBinary(buf[:])
+	var hdr protocol.Header
+	err = hdr.UnmarshalBinary(buf[:])
 	if err != nil {
 		panic(err)
 	}
 
-	body := make([]byte, pkt.Length)
+	body := make([]byte, hdr.Length)
 	_, err = io.ReadFull(conn, body)
 	if err != nil {
 		panic(err)
@@ -0,0 +1,1235 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"os"
+	"os/signal"
+	"strconv"
+	"strings"
+	"sync"
+	"syscall"
+	"time"
+
+	"github.com/cloudflare/cfssl/log"
+	"github.com/cloudflare/gokeyless/acme"
+	"github.com/cloudflare/gokeyless/noise"
+	"github.com/cloudflare/gokeyless/protocol"
+	"github.com/cloudflare/gokeyless/server"
+	"github.com/spf13/viper"
+)
+
+// loadConfig reads the configuration file, applies flag overrides, and
+// validates the result.
+func loadConfig() (Config, error) {
+	var cfg Config
+	if err := viper.ReadInConfig(); err != nil {
+		// File not found is non-fatal, unless it was explicitly provided.
+		if _, ok := err.(viper.ConfigFileNotFoundError); !ok || configFile != "" {
+			return cfg, err
+		}
+	}
+
+	if err := viper.Unmarshal(&cfg); err != nil {
+		return cfg, err
+	}
+
+	// Special handling for private key override flags since the config file
+	// uses a slice of structs.
+	if privateKeyDirs != "" || privateKeyFiles != "" {
+		var dirs, files []string
+		if privateKeyDirs != "" {
+			dirs = strings.Split(strings.TrimSpace(privateKeyDirs), ",")
+		}
+		if privateKeyFiles != "" {
+			files = strings.Split(strings.TrimSpace(privateKeyFiles), ",")
+		}
+		cfg.PrivateKeyStores = make([]PrivateKeyStoreConfig, 0, len(dirs)+len(files))
+		for _, dir := range dirs {
+			cfg.PrivateKeyStores = append(cfg.PrivateKeyStores, PrivateKeyStoreConfig{Dir: dir})
+		}
+		for _, file := range files {
+			cfg.PrivateKeyStores = append(cfg.PrivateKeyStores, PrivateKeyStoreConfig{File: file})
+		}
+	}
+
+	return cfg, cfg.Validate()
+}
+
+// Validate checks the configuration for errors which don't require touching
+// any files or keys.
+func (c *Config) Validate() error {
+	if c.LogLevel < log.LevelDebug || c.LogLevel > log.LevelFatal {
+		return fmt.Errorf("loglevel must be between %d and %d", log.LevelDebug, log.LevelFatal)
+	}
+
+	if c.CurrentTime != "" {
+		if _, err := time.Parse(time.RFC3339, c.CurrentTime); err != nil {
+			return fmt.Errorf("invalid time format for --current-time")
+		}
+	}
+
+	for _, store := range c.PrivateKeyStores {
+		if store.Watch && store.Dir == "" {
+			return fmt.Errorf("only 'dir' private key stores can be watched")
+		}
+		set := 0
+		for _, s := range []string{store.Dir, store.File, store.URI, store.Metadata} {
+			if s != "" {
+				set++
+			}
+		}
+		if set != 1 {
+			return fmt.Errorf("private key stores must define exactly one of the 'dir', 'file', 'uri' or 'metadata' keys")
+		}
+		if store.Metadata != "" && (len(store.Operations) > 0 || len(store.Hashes) > 0 || store.Shard != "" || store.Tenant != "") {
+			return errors.New("metadata private key stores can't restrict key usage or set 'shard' or 'tenant'")
+		}
+	}
+	sharded, tenanted := 0, 0
+	for _, store := range c.PrivateKeyStores {
+		if store.Shard != "" {
+			sharded++
+		}
+		if store.Tenant != "" {
+			tenanted++
+		}
+	}
+	if sharded > 0 && sharded < len(c.PrivateKeyStores) {
+		return errors.New("either all private key stores or none must set 'shard'")
+	}
+	if tenanted > 0 && tenanted < len(c.PrivateKeyStores) {
+		return errors.New("either all private key stores or none must set 'tenant'")
+	}
+	if _, err := c.tenantFunc(); err != nil {
+		return err
+	}
+	if tenanted > 0 && c.TenantFrom == "" {
+		return errors.New("private key stores with a 'tenant' require 'tenant_from'")
+	}
+	for _, store := range c.PrivateKeyStores {
+		if _, err := store.usage(); err != nil {
+			return err
+		}
+		if store.Shard != "" && (store.Watch || len(store.SKIPrefixes) > 0) {
+			return errors.New("sharded private key stores can't be watched or set 'ski_prefixes'")
+		}
+		if store.Tenant != "" && (store.Shard != "" || len(store.SKIPrefixes) > 0) {
+			return errors.New("private key stores with a 'tenant' can't set 'shard' or 'ski_prefixes'")
+		}
+		// Adding a store to a throwaway chain checks its SKI prefixes.
+		if err := server.NewKeystoreChain().Add(nil, store.SKIPrefixes...); err != nil {
+			return err
+		}
+	}
+
+	for name, port := range map[string]int{"port": c.Port, "http_port": c.HTTPPort, "metrics_port": c.MetricsPort, "debug_port": c.DebugPort, "admin_port": c.AdminPort} {
+		if port < 0 || port > 65535 {
+			return fmt.Errorf("%s must be between 0 and 65535", name)
+		}
+	}
+	if (c.AdminPort != 0) != (c.AdminTokensFile != "") {
+		return errors.New("admin_port and admin_tokens_file must be set together")
+	}
+	if c.Port == 0 && c.UnixSocket == "" && len(c.Listeners) == 0 {
+		return errors.New("at least one of port, unix_socket and listeners must be set")
+	}
+	for _, l := range c.Listeners {
+		if err := l.validate(); err != nil {
+			return fmt.Errorf("listener %s: %v", l.Address, err)
+		}
+		if l.TokenAuth && !c.TokenAuth.enabled() {
+			return fmt.Errorf("listener %s: token_auth needs token_auth to be configured", l.Address)
+		}
+		if c.SPIFFESocket != "" && l.AuthCert != "" && l.ClientCACert == "" {
+			// The SPIFFE trust bundle is only used with the SPIFFE certificate.
+			return fmt.Errorf("listener %s: client_ca_cert must be set with auth_cert when using SPIFFE", l.Address)
+		}
+	}
+
+	if err := validateClientCAs(c.ClientCAs); err != nil {
+		return fmt.Errorf("client_cas: %v", err)
+	}
+	if err := c.TokenAuth.validate(); err != nil {
+		return fmt.Errorf("token_auth: %v", err)
+	}
+	if err := c.ACME.validate(); err != nil {
+		return fmt.Errorf("acme: %v", err)
+	}
+	if c.ACME.enabled() && c.SPIFFESocket != "" {
+		return errors.New("acme and spiffe_socket can't both be set")
+	}
+	if err := c.KeyEncryption.validate(); err != nil {
+		return fmt.Errorf("key_encryption: %v", err)
+	}
+	if err := c.Shadow.validate(); err != nil {
+		return fmt.Errorf("shadow: %v", err)
+	}
+	for _, backend := range c.VerifySignaturesSkip {
+		switch backend {
+		case server.BackendSoftware, server.BackendPKCS11, server.BackendAzure,
+			server.BackendGoogle, server.BackendTPM, server.BackendOther:
+		default:
+			return fmt.Errorf("unknown verify_signatures_skip backend %q (must be software, pkcs11, azure, google, tpm or other)", backend)
+		}
+	}
+	if c.KeyExpiry.Window < 0 || c.KeyExpiry.Interval < 0 {
+		return errors.New("key_expiry window and interval must not be negative")
+	}
+	for name, value := range c.secretRefs() {
+		if _, _, err := parseSecretRef(value); err != nil {
+			return fmt.Errorf("%s: %v", name, err)
+		}
+	}
+
+	for name, n := range map[string]int{
+		"rsa_workers":              c.RSAWorkers,
+		"ecdsa_workers":            c.ECDSAWorkers,
+		"other_workers":            c.OtherWorkers,
+		"background_workers":       c.BackgroundWorkers,
+		"rsa_procs":                c.RSAProcs,
+		"key_concurrency":          c.KeyConcurrency,
+		"key_queue":                c.KeyQueue,
+		"max_connections":          c.MaxConnections,
+		"max_connections_per_ip":   c.MaxConnectionsPerIP,
+		"max_outstanding_requests": c.MaxOutstandingRequests,
+		"max_payload":              c.MaxPayload,
+	} {
+		if n < 0 {
+			return fmt.Errorf("%s must not be negative", name)
+		}
+	}
+	if _, _, err := c.ipLists(); err != nil {
+		return err
+	}
+	for _, pool := range c.WorkerPools {
+		if pool.Name == "" {
+			return errors.New("worker pools must have a name")
+		}
+		if pool.Workers <= 0 || pool.Queue < 0 {
+			return fmt.Errorf("worker pool %s needs a positive number of workers and a non-negative queue", pool.Name)
+		}
+		if _, _, err := pool.routes(); err != nil {
+			return fmt.Errorf("worker pool %s: %v", pool.Name, err)
+		}
+	}
+	if c.MaxStreamLength < 0 {
+		return errors.New("max_stream_length must not be negative")
+	}
+	for _, limit := range c.PayloadLimits {
+		if limit.MaxPayload < 0 {
+			return errors.New("payload limits must not be negative")
+		}
+		for _, name := range limit.Opcodes {
+			if _, err := parseOp(name); err != nil {
+				return fmt.Errorf("payload limits: %v", err)
+			}
+		}
+	}
+	for _, slo := range c.LatencySLOs {
+		if slo.Percentile <= 0 || slo.Percentile > 1 || slo.Threshold <= 0 {
+			return errors.New("latency SLOs need a percentile between 0 and 1 and a positive threshold")
+		}
+		for _, name := range slo.Opcodes {
+			if _, err := parseOp(name); err != nil {
+				return fmt.Errorf("latency SLOs: %v", err)
+			}
+		}
+	}
+	for _, policy := range c.LoadShedding {
+		if policy.QueueDelay <= 0 || policy.Sustain < 0 {
+			return errors.New("load shedding needs a positive queue_delay and a non-negative sustain")
+		}
+		for _, name := range policy.Opcodes {
+			if _, err := parseOp(name); err != nil {
+				return fmt.Errorf("load shedding: %v", err)
+			}
+		}
+	}
+	for _, f := range c.Faults {
+		for _, rate := range []float64{f.LatencyRate, f.ErrorRate, f.TruncateRate, f.ResetRate} {
+			if rate < 0 || rate > 1 {
+				return errors.New("fault rates must be between 0 and 1")
+			}
+		}
+		if f.ErrorRate+f.TruncateRate+f.ResetRate > 1 {
+			return errors.New("fault error_rate, truncate_rate and reset_rate must not add up to more than 1")
+		}
+		if f.Latency < 0 {
+			return errors.New("fault latency must not be negative")
+		}
+		for _, code := range f.Errors {
+			if code <= int(protocol.ErrNone) || code > 0xff {
+				return fmt.Errorf("fault error code %#x is out of range", code)
+			}
+		}
+		for _, name := range f.Opcodes {
+			if _, err := parseOp(name); err != nil {
+				return fmt.Errorf("faults: %v", err)
+			}
+		}
+	}
+	if c.TCPTimeout < 0 || c.UnixTimeout < 0 || c.KeyQueueTimeout < 0 || c.KeepaliveInterval < 0 || c.KeepaliveTimeout < 0 || c.ConnMaxAge < 0 || c.ConnRetireGrace < 0 || c.ReplayWindow < 0 || c.ClientCRLRefresh < 0 {
+		return errors.New("timeouts must not be negative")
+	}
+	if c.ConnMaxBytes < 0 {
+		return errors.New("conn_max_bytes must not be negative")
+	}
+
+	if c.MinResponseLength < 0 || c.MinResponseLength > protocol.MaxPacketLength {
+		return fmt.Errorf("min_response_length must be between 0 and %d", protocol.MaxPacketLength)
+	}
+
+	if c.AuditLogMaxSize < 0 {
+		return errors.New("audit_log_max_size must not be negative")
+	}
+	if c.AuditHMACKey != "" && c.AuditLog == "" {
+		return errors.New("audit_hmac_key requires audit_log")
+	}
+
+	if c.OTLPInterval < 0 {
+		return errors.New("otlp_interval must not be negative")
+	}
+
+	if c.TracingSampleRate < 0 || c.TracingSampleRate > 1 {
+		return errors.New("tracing_sample_rate must be between 0 and 1")
+	}
+	return nil
+}
+
+// serveConfig returns the server configuration for the worker and timeout
+// settings, leaving unset values at their defaults.
+func (c *Config) serveConfig() *server.ServeConfig {
+	cfg := server.DefaultServeConfig()
+	if c.RSAWorkers > 0 {
+		cfg.WithRSAWorkers(c.RSAWorkers)
+	}
+	if c.ECDSAWorkers > 0 {
+		cfg.WithECDSAWorkers(c.ECDSAWorkers)
+	}
+	if c.OtherWorkers > 0 {
+		cfg.WithOtherWorkers(c.OtherWorkers)
+	}
+	if c.BackgroundWorkers > 0 {
+		cfg.WithBackgroundWorkers(c.BackgroundWorkers)
+	}
+	cfg.WithRSAProcs(c.RSAProcs)
+	for _, pool := range c.WorkerPools {
+		name := server.WorkerPoolType(pool.Name)
+		cfg.WithWorkerPool(server.WorkerPoolConfig{Name: name, Workers: pool.Workers, Queue: pool.Queue})
+		// The routes were checked by Validate.
+		ops, skis, _ := pool.routes()
+		for _, op := range ops {
+			cfg.WithOpcodePool(op, name)
+		}
+		for _, ski := range skis {
+			cfg.WithKeyPool(ski, name)
+		}
+	}
+	if c.TCPTimeout > 0 {
+		cfg.WithTCPTimeout(c.TCPTimeout)
+	}
+	if c.UnixTimeout > 0 {
+		cfg.WithUnixTimeout(c.UnixTimeout)
+	}
+	cfg.WithKeepalive(c.KeepaliveInterval, c.KeepaliveTimeout)
+	cfg.WithConnLifetime(c.ConnMaxAge, c.ConnMaxBytes, c.ConnRetireGrace)
+	cfg.WithKeyRemovedNotices(c.KeyRemovedNotices)
+	cfg.WithTimingHints(c.TimingHints)
+	if c.KeyConcurrency > 0 {
+		cfg.WithKeyLimits(server.PerSKIKeyLimit(c.KeyConcurrency, c.KeyQueue, c.KeyQueueTimeout))
+	}
+	cfg.WithConnectionLimits(c.MaxConnections, c.MaxConnectionsPerIP)
+	cfg.WithMaxOutstandingRequests(c.MaxOutstandingRequests)
+	cfg.WithReplayDetection(c.ReplayWindow)
+	// tenant_from was checked by Validate.
+	if tenants, _ := c.tenantFunc(); tenants != nil {
+		cfg.WithTenants(tenants)
+	}
+	cfg.WithMinResponseLength(c.MinResponseLength)
+	cfg.WithStrictPadding(c.StrictPadding)
+	// The filter is set even without lists, so that a reload can add them.
+	// The lists were checked by Validate.
+	allow, deny, _ := c.ipLists()
+	cfg.WithIPFilter(server.NewIPFilter(allow, deny))
+	if len(c.LatencySLOs) > 0 {
+		var slos []server.LatencySLO
+		for _, slo := range c.LatencySLOs {
+			for _, name := range slo.Opcodes {
+				// The opcodes were checked by Validate.
+				op, _ := parseOp(name)
+				slos = append(slos, server.LatencySLO{Op: op, Percentile: slo.Percentile, Threshold: slo.Threshold})
+			}
+		}
+		cfg.WithLatencySLOs(logSLOStatus, slos...)
+	}
+	var policies []server.LoadShedPolicy
+	for _, policy := range c.LoadShedding {
+		for _, name := range policy.Opcodes {
+			// The opcodes were checked by Validate.
+			op, _ := parseOp(name)
+			policies = append(policies, server.LoadShedPolicy{Op: op, QueueDelay: policy.QueueDelay, Sustain: policy.Sustain})
+		}
+	}
+	cfg.WithLoadShedding(policies...)
+	var faults []server.Fault
+	for _, f := range c.Faults {
+		var codes []protocol.Error
+		for _, code := range f.Errors {
+			codes = append(codes, protocol.Error(code))
+		}
+		for _, name := range f.Opcodes {
+			// The opcodes were checked by Validate.
+			op, _ := parseOp(name)
+			faults = append(faults, server.Fault{
+				Op:           op,
+				Latency:      f.Latency,
+				LatencyRate:  f.LatencyRate,
+				ErrorRate:    f.ErrorRate,
+				Errors:       codes,
+				TruncateRate: f.TruncateRate,
+				ResetRate:    f.ResetRate,
+			})
+		}
+	}
+	if len(faults) > 0 {
+		log.Warningf("injecting faults into the responses to %d opcodes: this server is for testing clients only", len(faults))
+	}
+	cfg.WithFaultInjection(faults...)
+	cfg.WithDefaultPayloadLimit(c.MaxPayload)
+	for _, limit := range c.PayloadLimits {
+		for _, name := range limit.Opcodes {
+			// The opcodes were checked by Validate.
+			op, _ := parseOp(name)
+			cfg.WithPayloadLimit(op, limit.MaxPayload)
+		}
+	}
+	cfg.WithMaxStreamLength(c.MaxStreamLength)
+	cfg.WithRejectUntilReady(c.RejectUntilReady)
+	cfg.WithHardenedSigning(c.Hardened, c.AllowRSADecrypt)
+	cfg.WithSignatureVerification(c.VerifySignatures, c.VerifySignaturesSkip...)
+	cfg.WithKeyExpiry(c.KeyExpiry.Window, c.KeyExpiry.Evict)
+	cfg.WithDeterministicECDSA(c.ECDSADeterministic)
+	cfg.WithLowSECDSA(c.ECDSALowS)
+	for _, store := range c.PrivateKeyStores {
+		// Metadata stores are keyed by SHA-1 SKIs only.
+		if store.Metadata != "" {
+			cfg.WithSKISchemes(protocol.SKISchemeSHA1)
+		}
+	}
+	return cfg
+}
+
+// ipLists returns the networks of the IP allow and deny lists.
+func (c *Config) ipLists() (allow, deny []*net.IPNet, err error) {
+	if allow, err = server.ParseCIDRs(c.IPAllowlist); err != nil {
+		return nil, nil, fmt.Errorf("ip_allowlist: %v", err)
+	}
+	if deny, err = server.ParseCIDRs(c.IPDenylist); err != nil {
+		return nil, nil, fmt.Errorf("ip_denylist: %v", err)
+	}
+	return allow, deny, nil
+}
+
+// network returns the network the listener listens on.
+func (l *ListenerConfig) network() string {
+	if l.Network == "" {
+		return "tcp"
+	}
+	return l.Network
+}
+
+func (l *ListenerConfig) validate() error {
+	switch {
+	case l.Address == "":
+		return errors.New("listeners need an address")
+	case l.network() != "tcp" && l.network() != "unix":
+		return fmt.Errorf("unknown network %q (must be tcp or unix)", l.Network)
+	case l.Plaintext && (l.network() != "unix" || l.HTTP):
+		return errors.New("only unix listeners of the keyless protocol can be plaintext")
+	case l.Plaintext && (l.AuthCert != "" || l.ClientCACert != "" || l.TokenAuth):
+		return errors.New("plaintext listeners have no certificates or tokens")
+	case (l.AuthCert == "") != (l.AuthKey == ""):
+		return errors.New("auth_cert and auth_key must be set together")
+	case l.NoiseKey == "" && len(l.NoiseClientKeys) > 0:
+		return errors.New("noise_client_keys needs noise_key")
+	case l.NoiseKey != "" && (l.HTTP || l.Plaintext):
+		return errors.New("only listeners of the keyless protocol can use noise")
+	case l.NoiseKey != "" && (l.AuthCert != "" || l.ClientCACert != "" || l.TokenAuth):
+		return errors.New("noise listeners have no certificates or tokens")
+	case l.NoiseKey != "" && len(l.NoiseClientKeys) == 0:
+		return errors.New("noise listeners need noise_client_keys")
+	case (l.Plaintext || l.NoiseKey != "") && len(l.ClientCAs) > 0:
+		return errors.New("only TLS listeners can set client_cas")
+	}
+	if err := validateClientCAs(l.ClientCAs); err != nil {
+		return fmt.Errorf("client_cas: %v", err)
+	}
+	for _, key := range l.NoiseClientKeys {
+		if _, err := noise.ParsePublicKey(key); err != nil {
+			return fmt.Errorf("noise_client_keys: %v", err)
+		}
+	}
+	return nil
+}
+
+// noiseConfig returns the Noise configuration of the listener, or nil if it
+// uses TLS.
+func (l *ListenerConfig) noiseConfig() (*noise.Config, error) {
+	if l.NoiseKey == "" {
+		return nil, nil
+	}
+	b, err := ioutil.ReadFile(l.NoiseKey)
+	if err != nil {
+		return nil, err
+	}
+	kp, err := noise.ParseKeyPair(strings.TrimSpace(string(b)))
+	if err != nil {
+		return nil, err
+	}
+	config := &noise.Config{StaticKey: kp}
+	for _, key := range l.NoiseClientKeys {
+		// The keys were checked by Validate.
+		pub, _ := noise.ParsePublicKey(key)
+		config.ClientKeys = append(config.ClientKeys, pub)
+	}
+	log.Infof("listener %s: Noise public key %s", l.Address, kp.Public)
+	return config, nil
+}
+
+// tlsConfig returns the TLS configuration of the listener: the server's, with
+// the listener's certificate and client CAs, or nil if it is plaintext.
+// clientCAs are the server's client CAs by server name, which the listener's
+// replace.
+func (l *ListenerConfig) tlsConfig(s *server.Server, clientCAs []ClientCAConfig) (*tls.Config, error) {
+	if l.Plaintext {
+		return nil, nil
+	}
+	config := s.TLSConfig()
+	if l.AuthCert == "" && l.ClientCACert == "" && !l.TokenAuth && len(l.ClientCAs) == 0 {
+		return config, nil
+	}
+	config = config.Clone()
+	if l.TokenAuth {
+		// Clients without a certificate authenticate with a token instead.
+		config.ClientAuth = tls.VerifyClientCertIfGiven
+	}
+	if l.AuthCert != "" {
+		cert, err := tls.LoadX509KeyPair(l.AuthCert, l.AuthKey)
+		if err != nil {
+			return nil, err
+		}
+		config.Certificates = []tls.Certificate{cert}
+		config.GetCertificate = nil
+	}
+	if l.ClientCACert != "" {
+		pemCerts, err := ioutil.ReadFile(l.ClientCACert)
+		if err != nil {
+			return nil, err
+		}
+		config.ClientCAs = x509.NewCertPool()
+		if !config.ClientCAs.AppendCertsFromPEM(pemCerts) {
+			return nil, errors.New("failed to read client CA from PEM")
+		}
+	}
+	// The server's GetConfigForClient, if any, would undo the overrides.
+	config.GetConfigForClient = nil
+	if len(l.ClientCAs) > 0 {
+		clientCAs = l.ClientCAs
+	}
+	if len(clientCAs) > 0 {
+		cas, err := loadClientCAs(clientCAs)
+		if err != nil {
+			return nil, err
+		}
+		cas.ConfigureServer(config)
+	}
+	return config, nil
+}
+
+// validateClientCAs checks that each of cas has server names and a CA bundle,
+// and that no server name is listed twice.
+func validateClientCAs(cas []ClientCAConfig) error {
+	seen := make(map[string]bool)
+	for _, ca := range cas {
+		if len(ca.ServerNames) == 0 || ca.CACert == "" {
+			return errors.New("each entry needs server_names and a ca_cert")
+		}
+		for _, name := range ca.ServerNames {
+			name = strings.ToLower(name)
+			if seen[name] {
+				return fmt.Errorf("server name %s is listed twice", name)
+			}
+			seen[name] = true
+		}
+	}
+	return nil
+}
+
+// loadClientCAs reads the CA bundles of cas.
+func loadClientCAs(cas []ClientCAConfig) (server.ClientCAMap, error) {
+	m := make(server.ClientCAMap)
+	for _, ca := range cas {
+		pemCerts, err := ioutil.ReadFile(ca.CACert)
+		if err != nil {
+			return nil, err
+		}
+		pool := x509.NewCertPool()
+		if !pool.AppendCertsFromPEM(pemCerts) {
+			return nil, fmt.Errorf("failed to read client CAs from %s", ca.CACert)
+		}
+		for _, name := range ca.ServerNames {
+			m[strings.ToLower(name)] = pool
+		}
+	}
+	return m, nil
+}
+
+// enabled reports whether the certificate is obtained with ACME.
+func (a *ACMEConfig) enabled() bool {
+	return len(a.Domains) > 0
+}
+
+func (a *ACMEConfig) challenge() string {
+	if a.Challenge == "" {
+		return acme.ChallengeHTTP01
+	}
+	return a.Challenge
+}
+
+func (a *ACMEConfig) httpAddress() string {
+	if a.HTTPAddress == "" {
+		return ":80"
+	}
+	return a.HTTPAddress
+}
+
+func (a *ACMEConfig) validate() error {
+	if !a.enabled() {
+		return nil
+	}
+	switch {
+	case a.AccountKey == "":
+		return errors.New("account_key must be set")
+	case a.challenge() != acme.ChallengeHTTP01 && a.challenge() != acme.ChallengeDNS01:
+		return fmt.Errorf("unknown challenge %q (must be http-01 or dns-01)", a.Challenge)
+	case a.challenge() == acme.ChallengeDNS01 && a.DNSHook == "":
+		return errors.New("dns-01 challenges need dns_hook to be set")
+	}
+	return nil
+}
+
+// enabled reports whether key files are encrypted.
+func (k *KeyEncryptionConfig) enabled() bool {
+	return k.File != "" || k.KMS != "" || k.PassphraseFile != "" || k.Passphrase != ""
+}
+
+func (k *KeyEncryptionConfig) validate() error {
+	n := 0
+	for _, v := range []string{k.File, k.KMS, k.PassphraseFile, k.Passphrase} {
+		if v != "" {
+			n++
+		}
+	}
+	if n > 1 {
+		return errors.New("only one of file, kms, passphrase_file and passphrase can be set")
+	}
+	return nil
+}
+
+// kek returns the KEK of the configuration.
+func (k *KeyEncryptionConfig) kek() (server.KEK, error) {
+	switch {
+	case k.File != "":
+		return server.LoadKEKFile(k.File)
+	case k.KMS != "":
+		return server.NewKMSKEK(k.KMS)
+	case k.Passphrase != "":
+		passphrase, err := resolveSecret(k.Passphrase)
+		if err != nil {
+			return nil, err
+		}
+		return server.NewPassphraseKEK([]byte(passphrase))
+	default:
+		passphrase, err := ioutil.ReadFile(k.PassphraseFile)
+		if err != nil {
+			return nil, err
+		}
+		return server.NewPassphraseKEK(bytes.TrimRight(passphrase, "\r\n"))
+	}
+}
+
+// enabled reports whether requests are mirrored to a shadow keystore.
+func (k *KeyExpiryConfig) enabled() bool {
+	return k.Window > 0 || k.Evict
+}
+
+func (k *KeyExpiryConfig) interval() time.Duration {
+	if k.Interval > 0 {
+		return k.Interval
+	}
+	return defaultKeyExpiryInterval
+}
+
+func (sh *ShadowConfig) enabled() bool {
+	return len(sh.PrivateKeyStores) > 0
+}
+
+func (sh *ShadowConfig) validate() error {
+	if sh.Workers < 0 {
+		return errors.New("workers can't be negative")
+	}
+	for _, store := range sh.PrivateKeyStores {
+		set := 0
+		for _, s := range []string{store.Dir, store.File, store.URI} {
+			if s != "" {
+				set++
+			}
+		}
+		if set != 1 {
+			return errors.New("private key stores must define exactly one of the 'dir', 'file' or 'uri' keys")
+		}
+		if store.Watch || store.Metadata != "" || len(store.SKIPrefixes) > 0 || store.Shard != "" || store.Tenant != "" {
+			return errors.New("private key stores can't be watched or set 'metadata', 'ski_prefixes', 'shard' or 'tenant'")
+		}
+		if _, err := store.usage(); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// managerConfig returns the configuration of the ACME manager, storing the
+// certificate in auth_cert and auth_key.
+func (a *ACMEConfig) managerConfig() acme.Config {
+	cfg := acme.Config{
+		DirectoryURL:   a.Directory,
+		Email:          a.Email,
+		Domains:        a.Domains,
+		CertFile:       config.CertFile,
+		KeyFile:        config.KeyFile,
+		AccountKeyFile: a.AccountKey,
+		Challenge:      a.challenge(),
+		RenewBefore:    a.RenewBefore,
+	}
+	if a.DNSHook != "" {
+		cfg.DNS = acme.CommandDNSProvider{Command: a.DNSHook}
+	}
+	return cfg
+}
+
+// enabled reports whether token authentication is configured.
+func (t *TokenAuthConfig) enabled() bool {
+	return t.TokensFile != "" || t.JWKSURL != "" || t.OIDCIssuer != ""
+}
+
+func (t *TokenAuthConfig) validate() error {
+	n := 0
+	for _, s := range []string{t.TokensFile, t.JWKSURL, t.OIDCIssuer} {
+		if s != "" {
+			n++
+		}
+	}
+	switch {
+	case n > 1:
+		return errors.New("at most one of tokens_file, jwks_url and oidc_issuer may be set")
+	case (t.JWKSURL != "" || t.OIDCIssuer != "") && t.Audience == "":
+		return errors.New("audience must be set to verify JWTs")
+	}
+	return nil
+}
+
+// keyHashes are the hashes which keys can be restricted to, by name.
+var keyHashes = map[string]crypto.Hash{
+	"md5sha1": crypto.MD5SHA1,
+	"sha1":    crypto.SHA1,
+	"sha224":  crypto.SHA224,
+	"sha256":  crypto.SHA256,
+	"sha384":  crypto.SHA384,
+	"sha512":  crypto.SHA512,
+}
+
+// usage returns the usage the store's keys are restricted to, or nil if they
+// are not restricted.
+func (s *PrivateKeyStoreConfig) usage() (*server.KeyUsage, error) {
+	if len(s.Operations) == 0 && len(s.Hashes) == 0 {
+		return nil, nil
+	}
+	usage := &server.KeyUsage{}
+	if len(s.Operations) == 0 {
+		usage.Sign, usage.Decrypt, usage.OCSP = true, true, true
+	}
+	for _, op := range s.Operations {
+		switch op {
+		case "sign":
+			usage.Sign = true
+		case "decrypt":
+			usage.Decrypt = true
+		case "ocsp":
+			usage.OCSP = true
+		default:
+			return nil, fmt.Errorf("unknown private key store operation %q (must be sign, decrypt or ocsp)", op)
+		}
+	}
+	for _, name := range s.Hashes {
+		hash, ok := keyHashes[strings.ToLower(name)]
+		if !ok {
+			return nil, fmt.Errorf("unknown private key store hash %q", name)
+		}
+		usage.Hashes = append(usage.Hashes, hash)
+	}
+	return usage, nil
+}
+
+// routes parses the opcodes and keys routed to the pool.
+func (p *WorkerPoolConfig) routes() ([]protocol.Op, []protocol.SKI, error) {
+	var ops []protocol.Op
+	for _, name := range p.Opcodes {
+		op, err := parseOp(name)
+		if err != nil {
+			return nil, nil, err
+		}
+		ops = append(ops, op)
+	}
+	var skis []protocol.SKI
+	for _, key := range p.Keys {
+		b, err := hex.DecodeString(key)
+		if err != nil || len(b) != len(protocol.SKI{}) {
+			return nil, nil, fmt.Errorf("invalid SKI %q", key)
+		}
+		var ski protocol.SKI
+		copy(ski[:], b)
+		skis = append(skis, ski)
+	}
+	return ops, skis, nil
+}
+
+// logSLOStatus logs the latency SLOs which start or stop being breached.
+func logSLOStatus(status server.SLOStatus) {
+	slo := status.SLO
+	if status.Breached {
+		log.Warningf("latency SLO of %s breached: p%g is %v, over %v", slo.Op, slo.Percentile*100, status.Latency, slo.Threshold)
+	} else {
+		log.Infof("latency SLO of %s met again: p%g is %v", slo.Op, slo.Percentile*100, status.Latency)
+	}
+}
+
+// parseOp parses an opcode given by name, such as OpRSASignSHA256, or number.
+func parseOp(s string) (protocol.Op, error) {
+	if n, err := strconv.ParseUint(s, 0, 8); err == nil {
+		return protocol.Op(n), nil
+	}
+	for i := 0; i <= 0xff; i++ {
+		if op := protocol.Op(i); op.String() == s {
+			return op, nil
+		}
+	}
+	return 0, fmt.Errorf("unknown opcode %q", s)
+}
+
+// validate performs a dry run of starting the server: the configuration is
+// checked and the authentication certificate and private keys are loaded, but
+// nothing is listened on.
+func validate() error {
+	if config.SPIFFESocket == "" && !config.ACME.enabled() {
+		if _, err := server.NewServerFromFile(nil, config.CertFile, config.KeyFile, config.CACertFile); err != nil {
+			return fmt.Errorf("cannot load server certificate: %v", err)
+		}
+	}
+	_, watchers, err := initKeyStore()
+	if err != nil {
+		return fmt.Errorf("cannot load private keys: %v", err)
+	}
+	closeWatchers(watchers)
+	if _, err := loadClientCAs(config.ClientCAs); err != nil {
+		return fmt.Errorf("cannot load client CAs: %v", err)
+	}
+	if config.AuditHMACKey != "" {
+		if _, err := os.Stat(config.AuditHMACKey); err != nil {
+			return fmt.Errorf("cannot read audit HMAC key: %v", err)
+		}
+	}
+	if config.AttestationKey != "" {
+		if _, err := initAttester(); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// tenantFunc returns the function deriving the tenants of clients named by
+// tenant_from, if any.
+func (c *Config) tenantFunc() (server.TenantFunc, error) {
+	switch c.TenantFrom {
+	case "":
+		return nil, nil
+	case "common_name":
+		return server.TenantByCommonName, nil
+	case "spiffe_trust_domain":
+		return server.TenantBySPIFFETrustDomain, nil
+	default:
+		return nil, fmt.Errorf("unknown tenant_from %q, expected common_name or spiffe_trust_domain", c.TenantFrom)
+	}
+}
+
+// reloadableKeystore is a Keystore whose underlying Keystore can be replaced
+// while the server is running.
+type reloadableKeystore struct {
+	mtx  sync.RWMutex
+	keys server.Keystore
+	// onRemove is set by OnRemove.
+	onRemove func(ski protocol.SKI)
+}
+
+func (r *reloadableKeystore) Get(ctx context.Context, op *protocol.Operation) (crypto.Signer, error) {
+	r.mtx.RLock()
+	keys := r.keys
+	r.mtx.RUnlock()
+	return keys.Get(ctx, op)
+}
+
+// KeyUsage returns the usage the underlying Keystore restricts the key to, if
+// it restricts key usage.
+func (r *reloadableKeystore) KeyUsage(op *protocol.Operation, key crypto.Signer) *server.KeyUsage {
+	r.mtx.RLock()
+	keys := r.keys
+	r.mtx.RUnlock()
+	if keys, ok := keys.(interface {
+		KeyUsage(*protocol.Operation, crypto.Signer) *server.KeyUsage
+	}); ok {
+		return keys.KeyUsage(op, key)
+	}
+	return nil
+}
+
+// SKIs lists the keys of the underlying Keystore for attestations, if it can.
+func (r *reloadableKeystore) SKIs() []protocol.SKI {
+	r.mtx.RLock()
+	keys := r.keys
+	r.mtx.RUnlock()
+	if keys, ok := keys.(interface{ SKIs() []protocol.SKI }); ok {
+		return keys.SKIs()
+	}
+	return nil
+}
+
+// PublicKeys lists the public keys of the underlying Keystore for manifests,
+// if it can.
+func (r *reloadableKeystore) PublicKeys() []protocol.PublicKey {
+	r.mtx.RLock()
+	keys := r.keys
+	r.mtx.RUnlock()
+	if keys, ok := keys.(interface{ PublicKeys() []protocol.PublicKey }); ok {
+		return keys.PublicKeys()
+	}
+	return nil
+}
+
+// backends returns the underlying Keystore, or its backends if it is a
+// server.KeystoreChain.
+func (r *reloadableKeystore) backends() []server.Keystore {
+	r.mtx.RLock()
+	keys := r.keys
+	r.mtx.RUnlock()
+	if chain, ok := keys.(*server.KeystoreChain); ok {
+		return chain.Backends()
+	}
+	return []server.Keystore{keys}
+}
+
+// admin returns the underlying Keystore, or the first backend of a chain, if
+// its keys can be managed through the admin API.
+func (r *reloadableKeystore) admin() (adminKeystore, error) {
+	for _, keys := range r.backends() {
+		if keys, ok := keys.(adminKeystore); ok {
+			return keys, nil
+		}
+	}
+	return nil, errors.New("keystore does not support adding and removing keys")
+}
+
+// Keys lists the keys of the underlying Keystore.
+func (r *reloadableKeystore) Keys() []server.KeyInfo {
+	keys, err := r.admin()
+	if err != nil {
+		return nil
+	}
+	return keys.Keys()
+}
+
+// Add adds a key to the underlying Keystore. Like rotations, added keys are
+// lost when the key stores are reloaded.
+func (r *reloadableKeystore) Add(op *protocol.Operation, priv crypto.Signer) error {
+	keys, err := r.admin()
+	if err != nil {
+		return err
+	}
+	return keys.Add(op, priv)
+}
+
+// Remove evicts a key from the underlying Keystore until it is reloaded.
+func (r *reloadableKeystore) Remove(ski protocol.SKI) {
+	if keys, err := r.admin(); err == nil {
+		keys.Remove(ski)
+	}
+}
+
+// sharded returns the underlying Keystore if it is sharded.
+func (r *reloadableKeystore) sharded() (*server.ShardedKeystore, error) {
+	r.mtx.RLock()
+	keys := r.keys
+	r.mtx.RUnlock()
+	if keys, ok := keys.(*server.ShardedKeystore); ok {
+		return keys, nil
+	}
+	return nil, errors.New("keystore is not sharded")
+}
+
+// ShardStats describes the shards of the underlying Keystore, if it is
+// sharded.
+func (r *reloadableKeystore) ShardStats() []server.ShardStats {
+	keys, err := r.sharded()
+	if err != nil {
+		return nil
+	}
+	return keys.ShardStats()
+}
+
+// Rebalance moves the keys of the underlying Keystore to their shards.
+func (r *reloadableKeystore) Rebalance(ctx context.Context) (int, error) {
+	keys, err := r.sharded()
+	if err != nil {
+		return 0, err
+	}
+	return keys.Rebalance(ctx)
+}
+
+// Probe checks the backends of the underlying Keystore.
+func (r *reloadableKeystore) Probe(ctx context.Context) error {
+	r.mtx.RLock()
+	keys := r.keys
+	r.mtx.RUnlock()
+	return server.ProbeKeystore(ctx, keys)
+}
+
+// CanonicalSKI resolves the SHA-256 SKIs of the keys of the underlying
+// Keystore, if it can.
+func (r *reloadableKeystore) CanonicalSKI(ski protocol.SKI) (protocol.SKI, bool) {
+	r.mtx.RLock()
+	keys := r.keys
+	r.mtx.RUnlock()
+	if keys, ok := keys.(interface {
+		CanonicalSKI(protocol.SKI) (protocol.SKI, bool)
+	}); ok {
+		return keys.CanonicalSKI(ski)
+	}
+	return ski, false
+}
+
+// rotating returns the underlying Keystore, or the first backend of a chain,
+// if it supports key rotation.
+func (r *reloadableKeystore) rotating() (rotatingKeystore, error) {
+	for _, keys := range r.backends() {
+		if keys, ok := keys.(rotatingKeystore); ok {
+			return keys, nil
+		}
+	}
+	return nil, errors.New("keystore does not support rotation")
+}
+
+// StageKey stages a key rotation in the underlying Keystore. Rotations are
+// lost when the key stores are reloaded, so the new key should be added to
+// the configured key stores before reloading.
+func (r *reloadableKeystore) StageKey(old protocol.SKI, priv crypto.Signer) (protocol.SKI, error) {
+	keys, err := r.rotating()
+	if err != nil {
+		return protocol.SKI{}, err
+	}
+	return keys.StageKey(old, priv)
+}
+
+// SwitchKey switches a key rotation in the underlying Keystore.
+func (r *reloadableKeystore) SwitchKey(old protocol.SKI, grace time.Duration) error {
+	keys, err := r.rotating()
+	if err != nil {
+		return err
+	}
+	return keys.SwitchKey(old, grace)
+}
+
+// AbortRotation aborts a key rotation in the underlying Keystore.
+func (r *reloadableKeystore) AbortRotation(old protocol.SKI) error {
+	keys, err := r.rotating()
+	if err != nil {
+		return err
+	}
+	return keys.AbortRotation(old)
+}
+
+// Rotations lists the key rotations of the underlying Keystore.
+func (r *reloadableKeystore) Rotations() []server.KeyRotation {
+	keys, err := r.rotating()
+	if err != nil {
+		return nil
+	}
+	return keys.Rotations()
+}
+
+// rotatingKeystore is implemented by Keystores which support key rotation,
+// such as server.DefaultKeystore.
+// removalKeystore is implemented by the Keystores which report the keys
+// removed from them.
+type removalKeystore interface {
+	OnRemove(f func(ski protocol.SKI))
+}
+
+type rotatingKeystore interface {
+	StageKey(old protocol.SKI, priv crypto.Signer) (protocol.SKI, error)
+	SwitchKey(old protocol.SKI, grace time.Duration) error
+	AbortRotation(old protocol.SKI) error
+	Rotations() []server.KeyRotation
+}
+
+// adminKeystore is implemented by Keystores whose keys can be listed, added
+// and removed through the admin API, such as server.DefaultKeystore.
+type adminKeystore interface {
+	Keys() []server.KeyInfo
+	Add(op *protocol.Operation, priv crypto.Signer) error
+	Remove(ski protocol.SKI)
+}
+
+func (r *reloadableKeystore) set(keys server.Keystore) {
+	r.mtx.Lock()
+	old, onRemove := r.keys, r.onRemove
+	if onRemove != nil {
+		// The replaced keystore's watchers may still remove keys which the
+		// new one serves.
+		if old, ok := old.(removalKeystore); ok {
+			old.OnRemove(nil)
+		}
+		if keys, ok := keys.(removalKeystore); ok {
+			keys.OnRemove(onRemove)
+		}
+	}
+	r.keys = keys
+	r.mtx.Unlock()
+
+	// Tell clients about the keys which weren't reloaded.
+	if onRemove == nil {
+		return
+	}
+	type enumerable interface{ SKIs() []protocol.SKI }
+	oldKeys, ok1 := old.(enumerable)
+	newKeys, ok2 := keys.(enumerable)
+	if !ok1 || !ok2 {
+		return
+	}
+	kept := make(map[protocol.SKI]bool)
+	for _, ski := range newKeys.SKIs() {
+		kept[ski] = true
+	}
+	for _, ski := range oldKeys.SKIs() {
+		if !kept[ski] {
+			onRemove(ski)
+		}
+	}
+}
+
+// OnRemove sets the function called with the SKI of each key removed from the
+// underlying Keystore, or dropped from it by a reload.
+func (r *reloadableKeystore) OnRemove(f func(ski protocol.SKI)) {
+	r.mtx.Lock()
+	defer r.mtx.Unlock()
+	r.onRemove = f
+	if keys, ok := r.keys.(removalKeystore); ok {
+		keys.OnRemove(f)
+	}
+}
+
+// reloadOnSIGHUP re-reads the configuration whenever SIGHUP is received and
+// applies the sections which can be changed while running: the log level, the
+// private key stores and the contents of the sealing keys file. Other changes
+// are ignored with a warning until the server is restarted.
+func reloadOnSIGHUP(keys *reloadableKeystore) {
+	sig := make(chan os.Signal, 1)
+	signal.Notify(sig, syscall.SIGHUP)
+	for range sig {
+		log.Info("received SIGHUP, reloading configuration")
+		if err := reload(keys); err != nil {
+			log.Errorf("failed to reload configuration: %v", err)
+		}
+	}
+}
+
+func reload(keys *reloadableKeystore) error {
+	cfg, err := loadConfig()
+	if err != nil {
+		return err
+	}
+
+	old := config
+	config.LogLevel = cfg.LogLevel
+	config.PrivateKeyStores = cfg.PrivateKeyStores
+	var sealingKeys map[uint32][]byte
+	if sealer != nil {
+		if sealingKeys, err = loadSealingKeys(); err != nil {
+			config = old
+			return err
+		}
+	}
+	newKeys, watchers, err := initKeyStore()
+	if err != nil {
+		config = old
+		return err
+	}
+	if sealer != nil {
+		if err := sealer.SetKeys(sealingKeys); err != nil {
+			closeWatchers(watchers)
+			config = old
+			return err
+		}
+	}
+	replaced := keys.backends()
+	keys.set(newKeys)
+	if config.Hardened {
+		keyServer.WarnWeakKeys()
+	}
+	closeWatchers(keyWatchers)
+	for _, old := range replaced {
+		if old, ok := old.(*server.DefaultKeystore); ok {
+			old.DestroyKeys()
+		}
+	}
+	keyWatchers = watchers
+	indexCertificates()
+	if config.KeyExpiry.enabled() {
+		keyServer.CheckKeyExpiry()
+	}
+	log.Level = config.LogLevel
+	config.IPAllowlist, config.IPDenylist = cfg.IPAllowlist, cfg.IPDenylist
+	if filter := keyServer.Config().IPFilter(); filter != nil {
+		// The lists were checked by loadConfig.
+		allow, deny, _ := config.ipLists()
+		filter.Set(allow, deny)
+	}
+
+	// Compare what's left to warn about changes which weren't applied.
+	cfg.LogLevel, cfg.PrivateKeyStores = config.LogLevel, config.PrivateKeyStores
+	if !configEqual(cfg, config) {
+		log.Warning("configuration changes other than loglevel, private_key_stores, ip_allowlist and ip_denylist require a restart")
+	}
+	log.Info("configuration reloaded")
+	return nil
+}
+
+func configEqual(a, b Config) bool {
+	return fmt.Sprintf("%+v", a) == fmt.Sprintf("%+v", b)
+}
@@ -0,0 +1,182 @@
+package main
+
+import (
+	"crypto/tls"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"os/signal"
+	"path/filepath"
+	"runtime"
+	"strings"
+	"syscall"
+	"testing"
+	"time"
+
+	"github.com/cloudflare/cfssl/log"
+	"github.com/cloudflare/gokeyless/server"
+	"github.com/spf13/viper"
+)
+
+func TestConfigValidate(t *testing.T) {
+	for _, test := range []struct {
+		name string
+		// change modifies a valid configuration; err is a substring of the error
+		// Validate returns afterwards, or empty if it must succeed.
+		change func(c *Config)
+		err    string
+	}{
+		{name: "valid", change: func(c *Config) {}},
+		{name: "loglevel", change: func(c *Config) { c.LogLevel = log.LevelFatal + 1 }, err: "loglevel must be between"},
+		{name: "current_time", change: func(c *Config) { c.CurrentTime = "yesterday" }, err: "invalid time format"},
+		{name: "port", change: func(c *Config) { c.Port = 65536 }, err: "port must be between 0 and 65535"},
+		{name: "metrics_port", change: func(c *Config) { c.MetricsPort = -1 }, err: "metrics_port must be between 0 and 65535"},
+		{name: "no listener", change: func(c *Config) { c.Port = 0 }, err: "at least one of port, unix_socket and listeners"},
+		{name: "unix_socket", change: func(c *Config) { c.Port, c.UnixSocket = 0, "/run/gokeyless.sock" }},
+		{name: "admin_port alone", change: func(c *Config) { c.AdminPort = 2408 }, err: "admin_port and admin_tokens_file"},
+		{name: "admin_tokens_file alone", change: func(c *Config) { c.AdminTokensFile = "/etc/keyless/admin-tokens" }, err: "admin_port and admin_tokens_file"},
+		{name: "admin", change: func(c *Config) { c.AdminPort, c.AdminTokensFile = 2408, "/etc/keyless/admin-tokens" }},
+		{name: "no key store", change: func(c *Config) {
+			c.PrivateKeyStores = []PrivateKeyStoreConfig{{}}
+		}, err: "exactly one of"},
+		{name: "two key stores", change: func(c *Config) {
+			c.PrivateKeyStores = []PrivateKeyStoreConfig{{Dir: "/etc/keyless/keys", File: "/etc/keyless/key.pem"}}
+		}, err: "exactly one of"},
+		{name: "watched file", change: func(c *Config) {
+			c.PrivateKeyStores = []PrivateKeyStoreConfig{{File: "/etc/keyless/key.pem", Watch: true}}
+		}, err: "only 'dir' private key stores can be watched"},
+		{name: "partly sharded", change: func(c *Config) {
+			c.PrivateKeyStores = []PrivateKeyStoreConfig{{Dir: "/etc/keyless/a", Shard: "a"}, {Dir: "/etc/keyless/b"}}
+		}, err: "either all private key stores or none must set 'shard'"},
+		{name: "secret", change: func(c *Config) { c.OriginCAKey = "env://GOKEYLESS_ORIGIN_CA_KEY" }},
+		{name: "relative secret", change: func(c *Config) { c.OriginCAKey = "file://origin-ca-key" }, err: "origin_ca_api_key"},
+		{name: "negative workers", change: func(c *Config) { c.RSAWorkers = -1 }, err: "rsa_workers must not be negative"},
+		{name: "negative timeout", change: func(c *Config) { c.TCPTimeout = -time.Second }, err: "timeouts must not be negative"},
+		{name: "audit_hmac_key", change: func(c *Config) { c.AuditHMACKey = "env://GOKEYLESS_AUDIT_KEY" }, err: "audit_hmac_key requires audit_log"},
+		{name: "tracing_sample_rate", change: func(c *Config) { c.TracingSampleRate = 1.5 }, err: "tracing_sample_rate"},
+	} {
+		c := Config{
+			LogLevel:         log.LevelInfo,
+			Port:             2407,
+			PrivateKeyStores: []PrivateKeyStoreConfig{{Dir: "/etc/keyless/keys"}},
+		}
+		test.change(&c)
+		err := c.Validate()
+		switch {
+		case test.err == "" && err != nil:
+			t.Errorf("%s: %v", test.name, err)
+		case test.err != "" && err == nil:
+			t.Errorf("%s: no error, want %q", test.name, test.err)
+		case test.err != "" && !strings.Contains(err.Error(), test.err):
+			t.Errorf("%s: got %q, want %q", test.name, err, test.err)
+		}
+	}
+}
+
+func TestReloadOnSIGHUP(t *testing.T) {
+	if runtime.GOOS == "windows" {
+		t.Skip("SIGHUP can't be sent on Windows")
+	}
+
+	oldConfig, oldServer, oldWatchers, oldLevel := config, keyServer, keyWatchers, log.Level
+	defer func() {
+		config, keyServer, keyWatchers, log.Level = oldConfig, oldServer, oldWatchers, oldLevel
+		viper.Reset()
+	}()
+
+	dir, err := ioutil.TempDir("", "gokeyless")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	testdata, err := filepath.Abs(filepath.Join("..", "..", "tests", "testdata"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	path := filepath.Join(dir, "gokeyless.yaml")
+	writeConfig := func(level int, keys ...string) {
+		yaml := fmt.Sprintf("port: 2407\nloglevel: %d\nprivate_key_stores:\n", level)
+		for _, key := range keys {
+			yaml += fmt.Sprintf("  - file: %s\n", filepath.Join(testdata, key))
+		}
+		if err := ioutil.WriteFile(path, []byte(yaml), 0600); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	writeConfig(log.LevelInfo, "rsa.key")
+	viper.SetConfigType("yaml")
+	viper.SetConfigFile(path)
+	if config, err = loadConfig(); err != nil {
+		t.Fatal(err)
+	}
+	if keyServer, err = server.NewServer(nil, tls.Certificate{}, nil); err != nil {
+		t.Fatal(err)
+	}
+	var initial server.Keystore
+	if initial, keyWatchers, err = initKeyStore(); err != nil {
+		t.Fatal(err)
+	}
+	keys := &reloadableKeystore{keys: initial}
+	skis := keys.SKIs()
+	if len(skis) != 1 {
+		t.Fatalf("serving %d keys, want 1", len(skis))
+	}
+	rsaSKI := skis[0]
+
+	// A configuration which doesn't validate leaves the running one alone.
+	writeConfig(log.LevelFatal+1, "rsa.key", "ecdsa.key")
+	if err := reload(keys); err == nil {
+		t.Fatal("reloaded an invalid configuration")
+	}
+	if config.LogLevel != log.LevelInfo || len(config.PrivateKeyStores) != 1 {
+		t.Errorf("failed reload changed the configuration to loglevel %d with %d private key stores", config.LogLevel, len(config.PrivateKeyStores))
+	}
+	if n := len(keys.SKIs()); n != 1 {
+		t.Errorf("serving %d keys after a failed reload, want 1", n)
+	}
+
+	// Neither does one whose keys can't be loaded.
+	writeConfig(log.LevelDebug, "ecdsa.key", "missing.key")
+	if err := reload(keys); err == nil {
+		t.Fatal("reloaded a configuration with a missing key")
+	}
+	if config.LogLevel != log.LevelInfo || len(config.PrivateKeyStores) != 1 {
+		t.Errorf("failed reload changed the configuration to loglevel %d with %d private key stores", config.LogLevel, len(config.PrivateKeyStores))
+	}
+	if n := len(keys.SKIs()); n != 1 {
+		t.Errorf("serving %d keys after a failed reload, want 1", n)
+	}
+
+	// Keys which were dropped from the configuration are no longer served.
+	writeConfig(log.LevelInfo, "ecdsa.key")
+	if err := reload(keys); err != nil {
+		t.Fatal(err)
+	}
+	if skis := keys.SKIs(); len(skis) != 1 || skis[0] == rsaSKI {
+		t.Errorf("serving %v after replacing the RSA key", skis)
+	}
+
+	// SIGHUP terminates the process unless it is being notified of it, which
+	// reloadOnSIGHUP may not be yet when the first signal is sent.
+	ignored := make(chan os.Signal, 1)
+	signal.Notify(ignored, syscall.SIGHUP)
+	defer signal.Stop(ignored)
+	go reloadOnSIGHUP(keys)
+	self, err := os.FindProcess(os.Getpid())
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	writeConfig(log.LevelWarning, "rsa.key", "ecdsa.key")
+	deadline := time.Now().Add(5 * time.Second)
+	for len(keys.SKIs()) != 2 || log.Level != log.LevelWarning {
+		if time.Now().After(deadline) {
+			t.Fatalf("not reloaded after SIGHUP: serving %d keys at loglevel %d", len(keys.SKIs()), log.Level)
+		}
+		if err := self.Signal(syscall.SIGHUP); err != nil {
+			t.Fatal(err)
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
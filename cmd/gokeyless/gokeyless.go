@@ -1,13 +1,23 @@
 package main
 
 import (
+	"bufio"
 	"bytes"
+	"context"
+	"crypto"
+	"crypto/sha256"
 	"crypto/tls"
 	"crypto/x509"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
 	"fmt"
+	"io"
 	"io/ioutil"
 	"net"
+	"net/http"
 	"os"
+	"runtime"
 	"strconv"
 	"strings"
 	"time"
@@ -21,8 +31,12 @@ import (
 
 	"github.com/cloudflare/cfssl/helpers"
 	"github.com/cloudflare/cfssl/log"
+	"github.com/cloudflare/gokeyless/acme"
 	"github.com/cloudflare/gokeyless/certmetrics"
+	"github.com/cloudflare/gokeyless/noise"
+	"github.com/cloudflare/gokeyless/protocol"
 	"github.com/cloudflare/gokeyless/server"
+	"github.com/cloudflare/gokeyless/spiffe"
 )
 
 const (
@@ -42,19 +56,130 @@ type Config struct {
 	KeyFile    string `yaml:"auth_key" mapstructure:"auth_key"`
 	CSRFile    string `yaml:"auth_csr" mapstructure:"auth_csr"`
 	CACertFile string `yaml:"cloudflare_ca_cert" mapstructure:"cloudflare_ca_cert"`
+	// ClientCAs verify the certificates of clients which ask for some server
+	// names against other CAs than cloudflare_ca_cert.
+	ClientCAs []ClientCAConfig `yaml:"client_cas,omitempty" mapstructure:"client_cas"`
+
+	SPIFFESocket string `yaml:"spiffe_socket,omitempty" mapstructure:"spiffe_socket"`
+	// ACME, if it lists domains, obtains the authentication certificate from
+	// an ACME CA and renews it, storing it in auth_cert and auth_key.
+	ACME ACMEConfig `yaml:"acme,omitempty" mapstructure:"acme"`
 
 	PrivateKeyStores []PrivateKeyStoreConfig `yaml:"private_key_stores" mapstructure:"private_key_stores"`
+	// KeyEncryption, if set, is the KEK the key files of dir and file stores
+	// are encrypted under with --encrypt-key.
+	KeyEncryption KeyEncryptionConfig `yaml:"key_encryption,omitempty" mapstructure:"key_encryption"`
+	// Shadow, if it lists private key stores, mirrors signing and decryption
+	// requests to their keys and compares the results with those of the
+	// private_key_stores, to validate a new backend under production traffic.
+	Shadow ShadowConfig `yaml:"shadow,omitempty" mapstructure:"shadow"`
+	// TenantFrom derives the tenant of clients from their identity:
+	// common_name or spiffe_trust_domain.
+	TenantFrom string `yaml:"tenant_from,omitempty" mapstructure:"tenant_from"`
+
+	Port        int    `yaml:"port" mapstructure:"port"`
+	UnixSocket  string `yaml:"unix_socket,omitempty" mapstructure:"unix_socket"`
+	HTTPPort    int    `yaml:"http_port,omitempty" mapstructure:"http_port"`
+	MetricsPort int    `yaml:"metrics_port" mapstructure:"metrics_port"`
+	DebugPort   int    `yaml:"debug_port,omitempty" mapstructure:"debug_port"`
+	AdminPort   int    `yaml:"admin_port,omitempty" mapstructure:"admin_port"`
+	// AdminTokensFile lists the tokens admin requests must carry, one
+	// "name token" pair per line.
+	AdminTokensFile string `yaml:"admin_tokens_file,omitempty" mapstructure:"admin_tokens_file"`
+
+	Listeners []ListenerConfig `yaml:"listeners,omitempty" mapstructure:"listeners"`
+	TokenAuth TokenAuthConfig  `yaml:"token_auth,omitempty" mapstructure:"token_auth"`
+
+	RSAWorkers        int           `yaml:"rsa_workers,omitempty" mapstructure:"rsa_workers"`
+	ECDSAWorkers      int           `yaml:"ecdsa_workers,omitempty" mapstructure:"ecdsa_workers"`
+	OtherWorkers      int           `yaml:"other_workers,omitempty" mapstructure:"other_workers"`
+	BackgroundWorkers int           `yaml:"background_workers,omitempty" mapstructure:"background_workers"`
+	RSAProcs          int           `yaml:"rsa_procs,omitempty" mapstructure:"rsa_procs"`
+	TCPTimeout        time.Duration `yaml:"tcp_timeout,omitempty" mapstructure:"tcp_timeout"`
+	UnixTimeout       time.Duration `yaml:"unix_timeout,omitempty" mapstructure:"unix_timeout"`
+
+	KeepaliveInterval time.Duration `yaml:"keepalive_interval,omitempty" mapstructure:"keepalive_interval"`
+	KeepaliveTimeout  time.Duration `yaml:"keepalive_timeout,omitempty" mapstructure:"keepalive_timeout"`
+
+	ConnMaxAge      time.Duration `yaml:"conn_max_age,omitempty" mapstructure:"conn_max_age"`
+	ConnMaxBytes    int64         `yaml:"conn_max_bytes,omitempty" mapstructure:"conn_max_bytes"`
+	ConnRetireGrace time.Duration `yaml:"conn_retire_grace,omitempty" mapstructure:"conn_retire_grace"`
+
+	KeyRemovedNotices bool `yaml:"key_removed_notices,omitempty" mapstructure:"key_removed_notices"`
+	TimingHints       bool `yaml:"timing_hints,omitempty" mapstructure:"timing_hints"`
+
+	WorkerPools []WorkerPoolConfig `yaml:"worker_pools,omitempty" mapstructure:"worker_pools"`
+
+	KeyConcurrency  int           `yaml:"key_concurrency,omitempty" mapstructure:"key_concurrency"`
+	KeyQueue        int           `yaml:"key_queue,omitempty" mapstructure:"key_queue"`
+	KeyQueueTimeout time.Duration `yaml:"key_queue_timeout,omitempty" mapstructure:"key_queue_timeout"`
+
+	MaxConnections         int `yaml:"max_connections,omitempty" mapstructure:"max_connections"`
+	MaxConnectionsPerIP    int `yaml:"max_connections_per_ip,omitempty" mapstructure:"max_connections_per_ip"`
+	MaxOutstandingRequests int `yaml:"max_outstanding_requests,omitempty" mapstructure:"max_outstanding_requests"`
+
+	ReplayWindow time.Duration `yaml:"replay_window,omitempty" mapstructure:"replay_window"`
+
+	MinResponseLength int  `yaml:"min_response_length,omitempty" mapstructure:"min_response_length"`
+	StrictPadding     bool `yaml:"strict_padding,omitempty" mapstructure:"strict_padding"`
 
-	Port        int `yaml:"port" mapstructure:"port"`
-	MetricsPort int `yaml:"metrics_port" mapstructure:"metrics_port"`
+	IPAllowlist []string `yaml:"ip_allowlist,omitempty" mapstructure:"ip_allowlist"`
+	IPDenylist  []string `yaml:"ip_denylist,omitempty" mapstructure:"ip_denylist"`
+
+	ClientCRLs         []string      `yaml:"client_crls,omitempty" mapstructure:"client_crls"`
+	ClientCRLRefresh   time.Duration `yaml:"client_crl_refresh,omitempty" mapstructure:"client_crl_refresh"`
+	ClientOCSP         bool          `yaml:"client_ocsp,omitempty" mapstructure:"client_ocsp"`
+	RevocationSoftFail bool          `yaml:"revocation_soft_fail,omitempty" mapstructure:"revocation_soft_fail"`
+
+	MaxPayload      int                  `yaml:"max_payload,omitempty" mapstructure:"max_payload"`
+	PayloadLimits   []PayloadLimitConfig `yaml:"payload_limits,omitempty" mapstructure:"payload_limits"`
+	MaxStreamLength int                  `yaml:"max_stream_length,omitempty" mapstructure:"max_stream_length"`
+
+	LatencySLOs []LatencySLOConfig `yaml:"latency_slos,omitempty" mapstructure:"latency_slos"`
+
+	LoadShedding []LoadSheddingConfig `yaml:"load_shedding,omitempty" mapstructure:"load_shedding"`
+
+	Faults []FaultConfig `yaml:"faults,omitempty" mapstructure:"faults"`
+
+	RejectUntilReady bool `yaml:"reject_until_ready,omitempty" mapstructure:"reject_until_ready"`
+
+	Hardened        bool `yaml:"hardened,omitempty" mapstructure:"hardened"`
+	AllowRSADecrypt bool `yaml:"allow_rsa_decrypt,omitempty" mapstructure:"allow_rsa_decrypt"`
+
+	VerifySignatures     bool     `yaml:"verify_signatures,omitempty" mapstructure:"verify_signatures"`
+	VerifySignaturesSkip []string `yaml:"verify_signatures_skip,omitempty" mapstructure:"verify_signatures_skip"`
+
+	KeyExpiry KeyExpiryConfig `yaml:"key_expiry,omitempty" mapstructure:"key_expiry"`
+
+	ECDSADeterministic bool `yaml:"ecdsa_deterministic,omitempty" mapstructure:"ecdsa_deterministic"`
+	ECDSALowS          bool `yaml:"ecdsa_low_s,omitempty" mapstructure:"ecdsa_low_s"`
 
 	PidFile string `yaml:"pid_file" mapstructure:"pid_file"`
 
+	AuditLog        string `yaml:"audit_log,omitempty" mapstructure:"audit_log"`
+	AuditHMACKey    string `yaml:"audit_hmac_key,omitempty" mapstructure:"audit_hmac_key"`
+	AuditLogMaxSize int64  `yaml:"audit_log_max_size,omitempty" mapstructure:"audit_log_max_size"`
+
+	AttestationKey string `yaml:"attestation_key,omitempty" mapstructure:"attestation_key"`
+
+	SealingKeys string `yaml:"sealing_keys,omitempty" mapstructure:"sealing_keys"`
+
+	// LockMemory keeps the process's memory, and so its keys, out of swap.
+	LockMemory bool `yaml:"lock_memory,omitempty" mapstructure:"lock_memory"`
+	// ZeroizeKeys overwrites the private material of software keys once they
+	// are no longer served, and keeps it from being printed or marshaled.
+	ZeroizeKeys bool `yaml:"zeroize_keys,omitempty" mapstructure:"zeroize_keys"`
+
 	CurrentTime string `yaml:"current_time" mapstructure:"current_time"`
 
 	TracingEnabled    bool    `yaml:"tracing_enabled" mapstructure:"tracing_enabled"`
 	TracingAddress    string  `yaml:"tracing_address" mapstructure:"tracing_address"`
 	TracingSampleRate float64 `yaml:"tracing_sample_rate" mapstructure:"tracing_sample_rate"` // between 0 and 1
+
+	StatsdAddress string        `yaml:"statsd_address,omitempty" mapstructure:"statsd_address"`
+	StatsdPrefix  string        `yaml:"statsd_prefix,omitempty" mapstructure:"statsd_prefix"`
+	OTLPEndpoint  string        `yaml:"otlp_endpoint,omitempty" mapstructure:"otlp_endpoint"`
+	OTLPInterval  time.Duration `yaml:"otlp_interval,omitempty" mapstructure:"otlp_interval"`
 }
 
 // PrivateKeyStoreConfig defines a key store.
@@ -62,6 +187,201 @@ type PrivateKeyStoreConfig struct {
 	Dir  string `yaml:"dir,omitempty" mapstructure:"dir"`
 	File string `yaml:"file,omitempty" mapstructure:"file"`
 	URI  string `yaml:"uri,omitempty" mapstructure:"uri"`
+	// Watch keeps a dir store in sync with the key files added to or removed
+	// from it while the server is running.
+	Watch bool `yaml:"watch,omitempty" mapstructure:"watch"`
+	// Operations, if set, restricts the keys to the listed operations: sign,
+	// decrypt and ocsp.
+	Operations []string `yaml:"operations,omitempty" mapstructure:"operations"`
+	// Hashes, if set, restricts the keys to signing with the listed hashes,
+	// e.g. sha256.
+	Hashes []string `yaml:"hashes,omitempty" mapstructure:"hashes"`
+	// SKIPrefixes, if set, only looks up the keys whose hex SKI starts with
+	// one of the prefixes in this store. If any store sets it, each store
+	// becomes a separate backend, asked in order until one has the key.
+	SKIPrefixes []string `yaml:"ski_prefixes,omitempty" mapstructure:"ski_prefixes"`
+	// Metadata is the URL of a Redis or etcd metadata store holding the
+	// locations of keys shared by a fleet of keyservers, such as
+	// redis://host:6379/0?prefix=keyless/. Such a store is a separate backend,
+	// asked in order like stores with SKI prefixes.
+	Metadata string `yaml:"metadata,omitempty" mapstructure:"metadata"`
+	// Shard, if set, names the shard the keys of this store are loaded
+	// into. If any store sets it, all must, and keys are partitioned across
+	// the shards by consistent hashing of their SKIs.
+	Shard string `yaml:"shard,omitempty" mapstructure:"shard"`
+	// Tenant, if set, registers the keys of this store under the tenant ID.
+	// If any store sets it, all must, and clients only find the keys of
+	// their tenant, as derived by tenant_from.
+	Tenant string `yaml:"tenant,omitempty" mapstructure:"tenant"`
+}
+
+// ACMEConfig defines how the authentication certificate is obtained from an
+// ACME CA.
+type ACMEConfig struct {
+	// Directory is the ACME directory URL of the CA, Let's Encrypt by
+	// default.
+	Directory string   `yaml:"directory,omitempty" mapstructure:"directory"`
+	Email     string   `yaml:"email,omitempty" mapstructure:"email"`
+	Domains   []string `yaml:"domains,omitempty" mapstructure:"domains"`
+	// AccountKey is the file holding the ACME account key, created if it
+	// doesn't exist.
+	AccountKey string `yaml:"account_key,omitempty" mapstructure:"account_key"`
+	// Challenge is http-01 (the default) or dns-01.
+	Challenge string `yaml:"challenge,omitempty" mapstructure:"challenge"`
+	// HTTPAddress is where http-01 challenges are answered, :80 by default.
+	HTTPAddress string `yaml:"http_address,omitempty" mapstructure:"http_address"`
+	// DNSHook is the command publishing dns-01 records, run as
+	// "hook present|cleanup <name> <value>".
+	DNSHook     string        `yaml:"dns_hook,omitempty" mapstructure:"dns_hook"`
+	RenewBefore time.Duration `yaml:"renew_before,omitempty" mapstructure:"renew_before"`
+}
+
+// KeyEncryptionConfig defines the KEK under which key files are encrypted at
+// rest. Exactly one of its fields may be set.
+type KeyEncryptionConfig struct {
+	// File holds a base64-encoded 32-byte AES key.
+	File string `yaml:"file,omitempty" mapstructure:"file"`
+	// KMS is the resource name of a symmetric Google Cloud KMS crypto key,
+	// such as projects/p/locations/l/keyRings/r/cryptoKeys/k.
+	KMS string `yaml:"kms,omitempty" mapstructure:"kms"`
+	// PassphraseFile holds a passphrase the KEK is derived from.
+	PassphraseFile string `yaml:"passphrase_file,omitempty" mapstructure:"passphrase_file"`
+	// Passphrase is a passphrase the KEK is derived from, which should be a
+	// reference to a secret such as env://KEYLESS_KEK_PASSPHRASE.
+	Passphrase string `yaml:"passphrase,omitempty" mapstructure:"passphrase"`
+}
+
+// ShadowConfig defines the shadow keystore requests are mirrored to.
+type ShadowConfig struct {
+	// PrivateKeyStores are dir, file or uri stores, as in private_key_stores.
+	PrivateKeyStores []PrivateKeyStoreConfig `yaml:"private_key_stores,omitempty" mapstructure:"private_key_stores"`
+	// Workers is the number of goroutines executing mirrored requests, 1 by
+	// default.
+	Workers int `yaml:"workers,omitempty" mapstructure:"workers"`
+}
+
+// KeyExpiryConfig flags, and optionally evicts, the keys whose certificates in
+// the directories of dir stores have expired or are about to.
+type KeyExpiryConfig struct {
+	// Window flags the keys whose certificates all expire within it.
+	Window time.Duration `yaml:"window,omitempty" mapstructure:"window"`
+	// Evict evicts the keys whose certificates have all expired until the
+	// key stores are reloaded.
+	Evict bool `yaml:"evict,omitempty" mapstructure:"evict"`
+	// Interval is how often keys are checked, an hour by default.
+	Interval time.Duration `yaml:"interval,omitempty" mapstructure:"interval"`
+}
+
+// ListenerConfig defines an additional listener, with its own TLS settings.
+type ListenerConfig struct {
+	// Network is tcp (the default) or unix.
+	Network string `yaml:"network,omitempty" mapstructure:"network"`
+	// Address is the host:port or socket path to listen on.
+	Address string `yaml:"address" mapstructure:"address"`
+	// HTTP serves keyless requests over HTTP/2 instead of the keyless
+	// protocol.
+	HTTP bool `yaml:"http,omitempty" mapstructure:"http"`
+	// Plaintext disables TLS on a unix listener, whose clients are trusted
+	// like those with a valid certificate.
+	Plaintext bool `yaml:"plaintext,omitempty" mapstructure:"plaintext"`
+	// AuthCert and AuthKey, if set, replace the server's certificate.
+	AuthCert string `yaml:"auth_cert,omitempty" mapstructure:"auth_cert"`
+	AuthKey  string `yaml:"auth_key,omitempty" mapstructure:"auth_key"`
+	// ClientCACert, if set, replaces the CA client certificates are verified
+	// with.
+	ClientCACert string `yaml:"client_ca_cert,omitempty" mapstructure:"client_ca_cert"`
+	// ClientCAs, if set, replace the server's client_cas on the listener.
+	ClientCAs []ClientCAConfig `yaml:"client_cas,omitempty" mapstructure:"client_cas"`
+	// TokenAuth lets clients without a certificate authenticate with a bearer
+	// token, as configured by token_auth.
+	TokenAuth bool `yaml:"token_auth,omitempty" mapstructure:"token_auth"`
+	// NoiseKey, if set, secures the listener with the Noise protocol instead
+	// of TLS. It is the path of the server's base64-encoded static private
+	// key, and NoiseClientKeys are the base64-encoded static public keys of
+	// the clients which may connect.
+	NoiseKey        string   `yaml:"noise_key,omitempty" mapstructure:"noise_key"`
+	NoiseClientKeys []string `yaml:"noise_client_keys,omitempty" mapstructure:"noise_client_keys"`
+}
+
+// ClientCAConfig verifies the certificates of the clients which ask for some
+// server names with SNI against a bundle of CAs.
+type ClientCAConfig struct {
+	// ServerNames may be wildcards such as *.partners.example.com.
+	ServerNames []string `yaml:"server_names" mapstructure:"server_names"`
+	// CACert is the path of the PEM bundle of the CAs.
+	CACert string `yaml:"ca_cert" mapstructure:"ca_cert"`
+}
+
+// TokenAuthConfig defines how the bearer tokens of clients without a
+// certificate are verified. Exactly one of TokensFile, JWKSURL and OIDCIssuer
+// may be set.
+type TokenAuthConfig struct {
+	// TokensFile lists static tokens, one "name token" pair per line.
+	TokensFile string `yaml:"tokens_file,omitempty" mapstructure:"tokens_file"`
+	// JWKSURL accepts JWTs signed with the keys of the JSON Web Key Set
+	// published at the URL.
+	JWKSURL string `yaml:"jwks_url,omitempty" mapstructure:"jwks_url"`
+	// OIDCIssuer accepts the ID tokens of an OpenID Connect provider.
+	OIDCIssuer string `yaml:"oidc_issuer,omitempty" mapstructure:"oidc_issuer"`
+	// Issuer and Audience are required of JWTs. Audience must be set.
+	Issuer   string `yaml:"issuer,omitempty" mapstructure:"issuer"`
+	Audience string `yaml:"audience,omitempty" mapstructure:"audience"`
+}
+
+// WorkerPoolConfig defines an additional worker pool and the requests routed
+// to it.
+type WorkerPoolConfig struct {
+	Name    string `yaml:"name" mapstructure:"name"`
+	Workers int    `yaml:"workers" mapstructure:"workers"`
+	Queue   int    `yaml:"queue,omitempty" mapstructure:"queue"`
+	// Opcodes are the operations routed to the pool, by name (e.g.
+	// OpRSASignSHA256) or number (e.g. 0x05).
+	Opcodes []string `yaml:"opcodes,omitempty" mapstructure:"opcodes"`
+	// Keys are the hex-encoded SKIs of the keys routed to the pool.
+	Keys []string `yaml:"keys,omitempty" mapstructure:"keys"`
+}
+
+// PayloadLimitConfig limits the payload of requests with some opcodes.
+type PayloadLimitConfig struct {
+	// Opcodes are the operations limited, by name (e.g. OpRSASignSHA256) or
+	// number (e.g. 0x05).
+	Opcodes    []string `yaml:"opcodes" mapstructure:"opcodes"`
+	MaxPayload int      `yaml:"max_payload" mapstructure:"max_payload"`
+}
+
+// LatencySLOConfig sets a latency objective for the requests with some
+// opcodes.
+type LatencySLOConfig struct {
+	// Opcodes are the operations the objective applies to, each on its own,
+	// by name (e.g. OpRSASignSHA256) or number (e.g. 0x05).
+	Opcodes    []string      `yaml:"opcodes" mapstructure:"opcodes"`
+	Percentile float64       `yaml:"percentile" mapstructure:"percentile"`
+	Threshold  time.Duration `yaml:"threshold" mapstructure:"threshold"`
+}
+
+// LoadSheddingConfig sheds the requests with some opcodes under sustained
+// queue pressure.
+type LoadSheddingConfig struct {
+	// Opcodes are the operations shed, each on its own, by name (e.g.
+	// OpRSADecrypt) or number (e.g. 0x08).
+	Opcodes    []string      `yaml:"opcodes" mapstructure:"opcodes"`
+	QueueDelay time.Duration `yaml:"queue_delay" mapstructure:"queue_delay"`
+	Sustain    time.Duration `yaml:"sustain" mapstructure:"sustain"`
+}
+
+// FaultConfig injects faults into the responses to requests with some
+// opcodes, for testing clients.
+type FaultConfig struct {
+	// Opcodes are the operations whose responses are tampered with, each on
+	// its own, by name (e.g. OpECDSASignSHA256) or number (e.g. 0x15).
+	Opcodes     []string      `yaml:"opcodes" mapstructure:"opcodes"`
+	Latency     time.Duration `yaml:"latency,omitempty" mapstructure:"latency"`
+	LatencyRate float64       `yaml:"latency_rate,omitempty" mapstructure:"latency_rate"`
+	ErrorRate   float64       `yaml:"error_rate,omitempty" mapstructure:"error_rate"`
+	// Errors are the error codes responses are replaced with, e.g. 0x0E.
+	Errors       []int   `yaml:"errors,omitempty" mapstructure:"errors"`
+	TruncateRate float64 `yaml:"truncate_rate,omitempty" mapstructure:"truncate_rate"`
+	ResetRate    float64 `yaml:"reset_rate,omitempty" mapstructure:"reset_rate"`
 }
 
 var (
@@ -77,6 +397,10 @@ var (
 	versionMode      bool
 	helpMode         bool
 	outputConfigMode bool
+	validateMode     bool
+	wrapKeyFile      string
+	encryptKeyFile   string
+	noiseKeygenFile  string
 
 	version = "dev"
 )
@@ -107,11 +431,19 @@ func init() {
 	viper.SetDefault("auth_csr", "server.csr")
 	flagset.String("cloudflare-ca-cert", "", "Key client certificate authority (key clients run on Cloudflare's edge servers)")
 	viper.SetDefault("cloudflare_ca_cert", "keyless_cacert.pem")
+	flagset.String("spiffe-socket", "", "SPIFFE Workload API address (e.g. unix:///run/spire/agent.sock) to obtain the authentication certificate and client CA from, instead of the auth-cert, auth-key and cloudflare-ca-cert files")
 	flagset.Int("port", 0, "Port for key server to listen on (must match configuration in Cloudflare dashboard)")
 	viper.SetDefault("port", 2407)
+	flagset.String("unix-socket", "", "Unix socket for key server to listen on, in addition to the TCP port")
+	flagset.Int("http-port", 0, "Port for key server to serve keyless requests over HTTP/2 on, in addition to the keyless protocol")
 	flagset.Int("metrics-port", 0, "Port for key server to serve /metrics")
 	viper.SetDefault("metrics_port", 2406)
+	flagset.Int("debug-port", 0, "Port for key server to serve pprof, expvar and connection details on, on localhost only")
 	flagset.String("pid-file", "", "File to store PID of running server")
+	flagset.String("audit-log", "", "File to append a record of every signing and decryption operation to")
+	flagset.String("audit-hmac-key", "", "File containing a key used to HMAC-chain audit records for tamper evidence")
+	flagset.Int64("audit-log-max-size", 0, "Size in bytes after which the audit log is rotated (0 disables rotation)")
+	flagset.String("attestation-key", "", "Private key used to sign attestations of this key server for clients which require them")
 	flagset.String("current-time", "", "Current time used for certificate validation (for testing only)")
 	flagset.Bool("tracing-enabled", false, "")
 	flagset.String("tracing-address", "", "")
@@ -129,6 +461,10 @@ func init() {
 	flagset.BoolVar(&configMode, "config-only", false, "Perform interactive configuration, but do not run server")
 	flagset.BoolVarP(&versionMode, "version", "v", false, "Print version and exit")
 	flagset.BoolVarP(&helpMode, "help", "h", false, "Print usage exit")
+	flagset.BoolVar(&validateMode, "validate", false, "Validate the configuration, including loading certificates and keys, and exit")
+	flagset.StringVar(&wrapKeyFile, "wrap-key", "", "Print a request for the admin API loading the given private key, wrapped for the public key of the authentication certificate, and exit")
+	flagset.StringVar(&encryptKeyFile, "encrypt-key", "", "Print the given private key file encrypted under the KEK of key_encryption, and exit")
+	flagset.StringVar(&noiseKeygenFile, "noise-keygen", "", "Generate a Noise static key, write its private key to the given file, print its public key, and exit")
 	// Temporary option to demo config overrides.
 	flagset.BoolVarP(&outputConfigMode, "output-config", "o", false, "Print usage exit")
 	flagset.MarkHidden("output_config")
@@ -151,54 +487,15 @@ func initConfig() error {
 		viper.AddConfigPath("/etc/keyless")
 	}
 
-	if err := viper.ReadInConfig(); err != nil {
-		// File not found is non-fatal, unless it was explicitly provided.
-		if _, ok := err.(viper.ConfigFileNotFoundError); !ok || configFile != "" {
-			return err
-		}
-	}
-
-	if err := viper.Unmarshal(&config); err != nil {
+	cfg, err := loadConfig()
+	if err != nil {
 		return err
 	}
-
-	// Validate the config.
+	config = cfg
 	if config.CurrentTime != "" {
-		var err error
-		currentTime, err = time.Parse(time.RFC3339, config.CurrentTime)
-		if err != nil {
-			return fmt.Errorf("invalid time format for --current-time")
-		}
+		// Already validated by loadConfig.
+		currentTime, _ = time.Parse(time.RFC3339, config.CurrentTime)
 	}
-
-	for _, store := range config.PrivateKeyStores {
-		if (store.Dir != "" && store.File == "" && store.URI == "") ||
-			(store.Dir == "" && store.File != "" && store.URI == "") ||
-			(store.Dir == "" && store.File == "" && store.URI != "") {
-			continue
-		}
-		return fmt.Errorf("private key stores must define exactly one of the 'dir', 'file', or 'uri' keys")
-	}
-
-	// Special handling for private key override flags since the config file
-	// uses a slice of structs.
-	if privateKeyDirs != "" || privateKeyFiles != "" {
-		var dirs, files []string
-		if privateKeyDirs != "" {
-			dirs = strings.Split(strings.TrimSpace(privateKeyDirs), ",")
-		}
-		if privateKeyFiles != "" {
-			files = strings.Split(strings.TrimSpace(privateKeyFiles), ",")
-		}
-		config.PrivateKeyStores = make([]PrivateKeyStoreConfig, 0, len(dirs)+len(files))
-		for _, dir := range dirs {
-			config.PrivateKeyStores = append(config.PrivateKeyStores, PrivateKeyStoreConfig{Dir: dir})
-		}
-		for _, file := range files {
-			config.PrivateKeyStores = append(config.PrivateKeyStores, PrivateKeyStoreConfig{File: file})
-		}
-	}
-
 	return nil
 }
 
@@ -239,6 +536,27 @@ func main() {
 			log.Info("already configured; exiting")
 		}
 		os.Exit(0)
+	case validateMode:
+		if err := validate(); err != nil {
+			log.Fatal(err)
+		}
+		fmt.Println("configuration OK")
+		os.Exit(0)
+	case wrapKeyFile != "":
+		if err := wrapKey(wrapKeyFile); err != nil {
+			log.Fatal(err)
+		}
+		os.Exit(0)
+	case encryptKeyFile != "":
+		if err := encryptKey(encryptKeyFile); err != nil {
+			log.Fatal(err)
+		}
+		os.Exit(0)
+	case noiseKeygenFile != "":
+		if err := noiseKeygen(noiseKeygenFile); err != nil {
+			log.Fatal(err)
+		}
+		os.Exit(0)
 	case outputConfigMode:
 		b, err := yaml.Marshal(config)
 		if err != nil {
@@ -263,12 +581,35 @@ func main() {
 		opentracing.SetGlobalTracer(tracer)
 		log.Infof("tracing enabled: %s", sampler.String())
 	}
+	sinks, sinkErr := initMetricsSinks()
+	if sinkErr != nil {
+		log.Fatalf("cannot set up metrics: %v", sinkErr)
+	}
+	for _, sink := range sinks {
+		defer sink.Close()
+	}
+
+	if config.LockMemory {
+		if err := server.LockMemory(); err != nil {
+			log.Fatalf("cannot lock memory: %v", err)
+		}
+	}
+
+	// Go runs as many goroutines at once as the machine has CPUs, however
+	// few the cgroup quota allows, which gets the process throttled. Unless
+	// told otherwise, run as many as the quota allows.
+	if os.Getenv("GOMAXPROCS") == "" {
+		if n := server.AvailableCPUs(); n < runtime.GOMAXPROCS(0) {
+			log.Infof("setting GOMAXPROCS to %d to match the CPU quota", n)
+			runtime.GOMAXPROCS(n)
+		}
+	}
 
 	// If we make it here we need to ask for user input, so we need to give up
 	// and log an error instead (in case the server is running as a daemon).
 	// Failing hard with an error message makes the problem obvious, whereas a
 	// daemon blocked waiting on input can be hard to debug.
-	if needNewCertAndKey() {
+	if config.SPIFFESocket == "" && !config.ACME.enabled() && needNewCertAndKey() {
 		if needInteractivePrompt() {
 			log.Error("the server cert/key need to be generated; set the hostname, zone_id, and origin_ca_api_key values in your config file, or run the server with either the --config-only or --manual-activation flag to generate the pair interactively")
 			os.Exit(1)
@@ -276,8 +617,30 @@ func main() {
 		initializeServerCertAndKey()
 	}
 
-	cfg := server.DefaultServeConfig()
-	s, err := server.NewServerFromFile(cfg, config.CertFile, config.KeyFile, config.CACertFile)
+	cfg := config.serveConfig()
+	if len(config.ClientCRLs) > 0 || config.ClientOCSP {
+		rc, err := server.NewRevocationChecker(server.RevocationConfig{
+			CRLs:            config.ClientCRLs,
+			RefreshInterval: config.ClientCRLRefresh,
+			OCSP:            config.ClientOCSP,
+			SoftFail:        config.RevocationSoftFail,
+		})
+		if err != nil {
+			log.Fatalf("cannot set up revocation checks: %v", err)
+		}
+		defer rc.Close()
+		cfg.WithRevocationChecker(rc)
+	}
+	var s *server.Server
+	var err error
+	switch {
+	case config.SPIFFESocket != "":
+		s, err = newSPIFFEServer(cfg)
+	case config.ACME.enabled():
+		s, err = newACMEServer(cfg)
+	default:
+		s, err = server.NewServerFromFile(cfg, config.CertFile, config.KeyFile, config.CACertFile)
+	}
 	if err != nil {
 		log.Fatal("cannot start server:", err)
 	}
@@ -285,12 +648,75 @@ func main() {
 	if !currentTime.IsZero() {
 		s.TLSConfig().Time = func() time.Time { return currentTime }
 	}
+	if len(config.ClientCAs) > 0 {
+		cas, err := loadClientCAs(config.ClientCAs)
+		if err != nil {
+			log.Fatal("cannot load client CAs:", err)
+		}
+		cas.ConfigureServer(s.TLSConfig())
+	}
 
-	keys, err := initKeyStore()
+	keyServer = s
+	keys, watchers, err := initKeyStore()
 	if err != nil {
 		log.Fatal(err)
 	}
-	s.SetKeystore(keys)
+	keyWatchers = watchers
+	indexCertificates()
+	reloadable := &reloadableKeystore{keys: keys}
+	s.SetKeystore(reloadable)
+	go reloadOnSIGHUP(reloadable)
+	s.AddReadinessCheck("keys", func(ctx context.Context) error {
+		return server.ProbeKeystore(ctx, reloadable)
+	})
+	go s.WaitReady(context.Background(), readinessInterval)
+	if config.KeyExpiry.enabled() {
+		go s.WatchKeyExpiry(context.Background(), config.KeyExpiry.interval())
+	}
+
+	if config.Shadow.enabled() {
+		keys, err := initShadowKeyStore()
+		if err != nil {
+			log.Fatal(err)
+		}
+		s.SetShadowKeystore(keys, config.Shadow.Workers)
+	}
+
+	if config.AuditLog != "" {
+		audit, err := initAuditLogger()
+		if err != nil {
+			log.Fatal(err)
+		}
+		defer audit.Close()
+		s.SetAuditLogger(audit)
+	}
+
+	if config.AttestationKey != "" {
+		attester, err := initAttester()
+		if err != nil {
+			log.Fatal(err)
+		}
+		s.SetAttester(attester)
+	}
+
+	if config.SealingKeys != "" {
+		keys, err := loadSealingKeys()
+		if err != nil {
+			log.Fatal(err)
+		}
+		if sealer, err = server.NewAEADSealer(keys); err != nil {
+			log.Fatal(err)
+		}
+		s.SetSealer(sealer)
+	}
+
+	if config.TokenAuth.enabled() {
+		verifier, err := initTokenVerifier()
+		if err != nil {
+			log.Fatal(err)
+		}
+		s.Config().WithTokenVerifier(verifier)
+	}
 
 	if config.PidFile != "" {
 		if f, err := os.Create(config.PidFile); err != nil {
@@ -300,35 +726,618 @@ func main() {
 			f.Close()
 		}
 	}
-	certs := gatherCerts()
-	certmetrics.Observe(certs...)
+	if config.SPIFFESocket == "" {
+		certs := gatherCerts()
+		certmetrics.Observe(certs...)
+	}
 	go func() {
 		log.Critical(s.MetricsListenAndServe(net.JoinHostPort("", strconv.Itoa(config.MetricsPort))))
 	}()
-	log.Fatal(s.ListenAndServe(net.JoinHostPort("", strconv.Itoa(config.Port))))
+	if config.DebugPort != 0 {
+		go func() {
+			log.Critical(s.DebugListenAndServe(net.JoinHostPort("localhost", strconv.Itoa(config.DebugPort))))
+		}()
+	}
+	if config.AdminTokensFile != "" {
+		tokens, err := loadStaticTokens(config.AdminTokensFile)
+		if err != nil {
+			log.Fatal(err)
+		}
+		s.Config().WithAdminTokenVerifier(server.NewStaticTokenVerifier(tokens))
+	}
+	if config.AdminPort != 0 {
+		go func() {
+			log.Critical(s.AdminListenAndServe(net.JoinHostPort("localhost", strconv.Itoa(config.AdminPort))))
+		}()
+	}
+	if ok, err := runService(s); ok {
+		if err != nil {
+			log.Fatal(err)
+		}
+		return
+	}
+	log.Fatal(serve(s, notifyReady))
 }
 
-func initKeyStore() (server.Keystore, error) {
-	keys := server.NewDefaultKeystore()
-	for _, store := range config.PrivateKeyStores {
+// serve serves s on the listeners passed by systemd socket activation or, if
+// there are none, on the configured port, Unix socket and HTTP port. Activated
+// sockets named "http" serve keyless requests over HTTP/2, and the others the
+// keyless protocol. ready is called once all listeners are open. serve returns
+// when any of them fails.
+func serve(s *server.Server, ready func()) error {
+	// listener is a listener and the TLS configuration its connections are
+	// authenticated with.
+	type listener struct {
+		net.Listener
+		config *tls.Config
+		// noise, if set, secures the listener instead of config.
+		noise *noise.Config
+	}
+	activated, err := activatedListeners()
+	if err != nil {
+		return err
+	}
+	var keyless, http2 []listener
+	if len(activated) > 0 {
+		for name, ls := range activated {
+			for _, l := range ls {
+				if name == "http" {
+					http2 = append(http2, listener{Listener: l, config: s.TLSConfig()})
+				} else {
+					keyless = append(keyless, listener{Listener: l, config: s.TLSConfig()})
+				}
+			}
+		}
+	} else {
+		if config.Port != 0 {
+			l, err := net.Listen("tcp", net.JoinHostPort("", strconv.Itoa(config.Port)))
+			if err != nil {
+				return err
+			}
+			keyless = append(keyless, listener{Listener: l, config: s.TLSConfig()})
+		}
+		if config.UnixSocket != "" {
+			l, err := net.Listen("unix", config.UnixSocket)
+			if err != nil {
+				return err
+			}
+			keyless = append(keyless, listener{Listener: l, config: s.TLSConfig()})
+		}
+		if config.HTTPPort != 0 {
+			l, err := net.Listen("tcp", net.JoinHostPort("", strconv.Itoa(config.HTTPPort)))
+			if err != nil {
+				return err
+			}
+			http2 = append(http2, listener{Listener: l, config: s.TLSConfig()})
+		}
+		for _, lc := range config.Listeners {
+			tlsConfig, err := lc.tlsConfig(s, config.ClientCAs)
+			if err != nil {
+				return fmt.Errorf("listener %s: %v", lc.Address, err)
+			}
+			noiseConfig, err := lc.noiseConfig()
+			if err != nil {
+				return fmt.Errorf("listener %s: %v", lc.Address, err)
+			}
+			l, err := net.Listen(lc.network(), lc.Address)
+			if err != nil {
+				return err
+			}
+			if lc.HTTP {
+				http2 = append(http2, listener{Listener: l, config: tlsConfig})
+			} else {
+				keyless = append(keyless, listener{Listener: l, config: tlsConfig, noise: noiseConfig})
+			}
+		}
+	}
+
+	errs := make(chan error, len(keyless)+len(http2))
+	for _, l := range keyless {
+		scheme := l.Addr().Network()
 		switch {
-		case store.Dir != "":
-			if err := keys.AddFromDir(store.Dir, server.DefaultLoadKey); err != nil {
+		case l.noise != nil:
+			scheme += "+noise"
+			log.Infof("Listening at %s://%s\n", scheme, l.Addr())
+			go func(l listener) { errs <- s.ServeWithNoise(l.Listener, l.noise) }(l)
+			continue
+		case l.config == nil:
+			scheme += "+plaintext"
+		}
+		log.Infof("Listening at %s://%s\n", scheme, l.Addr())
+		go func(l listener) { errs <- s.ServeWithTLS(l.Listener, l.config) }(l)
+	}
+	for _, l := range http2 {
+		log.Infof("Listening at https://%s\n", l.Addr())
+		go func(l listener) { errs <- s.ServeHTTP2WithTLS(l.Listener, l.config) }(l)
+	}
+	ready()
+	return <-errs
+}
+
+// newSPIFFEServer creates a server whose authentication certificate and client
+// CA are obtained, and kept up to date, from the SPIFFE Workload API.
+func newSPIFFEServer(cfg *server.ServeConfig) (*server.Server, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), time.Minute)
+	defer cancel()
+	src, err := spiffe.NewSource(ctx, config.SPIFFESocket)
+	if err != nil {
+		return nil, err
+	}
+	log.Infof("using SPIFFE identity %s", src.ID())
+
+	s, err := server.NewServer(cfg, tls.Certificate{}, nil)
+	if err != nil {
+		src.Close()
+		return nil, err
+	}
+	src.ConfigureServer(s.TLSConfig())
+	return s, nil
+}
+
+// newACMEServer creates a server whose authentication certificate is obtained,
+// and renewed, from the ACME CA configured by acme.
+func newACMEServer(cfg *server.ServeConfig) (*server.Server, error) {
+	m, err := acme.NewManager(config.ACME.managerConfig())
+	if err != nil {
+		return nil, err
+	}
+	if config.ACME.challenge() == acme.ChallengeHTTP01 {
+		go func() {
+			log.Critical(http.ListenAndServe(config.ACME.httpAddress(), m.HTTPHandler(nil)))
+		}()
+	}
+	if m.NeedsRenewal() {
+		ctx, cancel := context.WithTimeout(context.Background(), 5*time.Minute)
+		err := m.Renew(ctx)
+		cancel()
+		if err != nil {
+			if m.Certificate() == nil {
 				return nil, err
 			}
-		case store.File != "":
-			if err := keys.AddFromFile(store.File, server.DefaultLoadKey); err != nil {
-				return nil, err
+			// The current certificate is still valid for a while, so keep
+			// using it and retry in the background.
+			log.Errorf("acme: renewing certificate: %v", err)
+		}
+	}
+	m.Start()
+
+	pemCerts, err := ioutil.ReadFile(config.CACertFile)
+	if err != nil {
+		m.Close()
+		return nil, err
+	}
+	keylessCA := x509.NewCertPool()
+	if !keylessCA.AppendCertsFromPEM(pemCerts) {
+		m.Close()
+		return nil, errors.New("failed to read keyless CA from PEM")
+	}
+	s, err := server.NewServer(cfg, tls.Certificate{}, keylessCA)
+	if err != nil {
+		m.Close()
+		return nil, err
+	}
+	m.ConfigureServer(s.TLSConfig())
+	return s, nil
+}
+
+// initTokenVerifier creates the verifier of client tokens configured by
+// token_auth.
+func initTokenVerifier() (server.TokenVerifier, error) {
+	auth := config.TokenAuth
+	switch {
+	case auth.TokensFile != "":
+		tokens, err := loadStaticTokens(auth.TokensFile)
+		if err != nil {
+			return nil, err
+		}
+		return server.NewStaticTokenVerifier(tokens), nil
+	case auth.JWKSURL != "":
+		return server.NewJWTTokenVerifier(auth.JWKSURL, auth.Issuer, auth.Audience), nil
+	default:
+		ctx, cancel := context.WithTimeout(context.Background(), time.Minute)
+		defer cancel()
+		return server.NewOIDCTokenVerifier(ctx, auth.OIDCIssuer, auth.Audience)
+	}
+}
+
+// loadStaticTokens reads a file with a client name and a token on each line,
+// and returns the tokens mapped to the names.
+func loadStaticTokens(path string) (map[string]string, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, fmt.Errorf("cannot read tokens: %v", err)
+	}
+	defer f.Close()
+	tokens := make(map[string]string)
+	scanner := bufio.NewScanner(f)
+	for line := 1; scanner.Scan(); line++ {
+		fields := strings.Fields(scanner.Text())
+		if len(fields) == 0 || strings.HasPrefix(fields[0], "#") {
+			continue
+		}
+		if len(fields) != 2 {
+			return nil, fmt.Errorf("%s:%d: expected a name and a token", path, line)
+		}
+		tokens[fields[1]] = fields[0]
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, fmt.Errorf("cannot read tokens: %v", err)
+	}
+	return tokens, nil
+}
+
+// sealer seals blobs with the keys in the sealing_keys file, if it is set.
+var sealer *server.AEADSealer
+
+// loadSealingKeys reads the sealing_keys file, which holds a key version and a
+// hex encoded 32-byte key on each line.
+func loadSealingKeys() (map[uint32][]byte, error) {
+	f, err := os.Open(config.SealingKeys)
+	if err != nil {
+		return nil, fmt.Errorf("cannot read sealing keys: %v", err)
+	}
+	defer f.Close()
+	keys := make(map[uint32][]byte)
+	scanner := bufio.NewScanner(f)
+	for line := 1; scanner.Scan(); line++ {
+		fields := strings.Fields(scanner.Text())
+		if len(fields) == 0 || strings.HasPrefix(fields[0], "#") {
+			continue
+		}
+		if len(fields) != 2 {
+			return nil, fmt.Errorf("%s:%d: expected a version and a key", config.SealingKeys, line)
+		}
+		version, err := strconv.ParseUint(fields[0], 10, 32)
+		if err != nil {
+			return nil, fmt.Errorf("%s:%d: invalid version: %v", config.SealingKeys, line, err)
+		}
+		if _, ok := keys[uint32(version)]; ok {
+			return nil, fmt.Errorf("%s:%d: duplicate version %d", config.SealingKeys, line, version)
+		}
+		key, err := hex.DecodeString(fields[1])
+		if err != nil {
+			return nil, fmt.Errorf("%s:%d: invalid key: %v", config.SealingKeys, line, err)
+		}
+		keys[uint32(version)] = key
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, fmt.Errorf("cannot read sealing keys: %v", err)
+	}
+	return keys, nil
+}
+
+func initAuditLogger() (*server.FileAuditLogger, error) {
+	var key []byte
+	if config.AuditHMACKey != "" {
+		var err error
+		key, err = ioutil.ReadFile(config.AuditHMACKey)
+		if err != nil {
+			return nil, fmt.Errorf("cannot read audit HMAC key: %v", err)
+		}
+		key = bytes.TrimSpace(key)
+	}
+	return server.NewFileAuditLogger(config.AuditLog, key, config.AuditLogMaxSize)
+}
+
+// initAttester loads the attestation key. The build is identified by the
+// SHA-256 hash of the running binary.
+// defaultOTLPInterval is how often metrics are exported to an OTLP collector
+// by default.
+const defaultOTLPInterval = 10 * time.Second
+
+// initMetricsSinks sends metrics to statsd and an OTLP collector, if
+// configured, besides Prometheus.
+func initMetricsSinks() ([]io.Closer, error) {
+	sinks := []server.MetricsSink{server.PrometheusSink}
+	var closers []io.Closer
+	if config.StatsdAddress != "" {
+		statsd, err := server.NewStatsdSink(config.StatsdAddress, config.StatsdPrefix)
+		if err != nil {
+			return nil, err
+		}
+		sinks = append(sinks, statsd)
+		closers = append(closers, statsd)
+		log.Infof("sending metrics to statsd at %s", config.StatsdAddress)
+	}
+	if config.OTLPEndpoint != "" {
+		interval := config.OTLPInterval
+		if interval == 0 {
+			interval = defaultOTLPInterval
+		}
+		otlp := server.NewOTLPSink(config.OTLPEndpoint, interval)
+		sinks = append(sinks, otlp)
+		closers = append(closers, otlp)
+		log.Infof("exporting metrics to %s every %v", config.OTLPEndpoint, interval)
+	}
+	server.SetMetricsSinks(sinks...)
+	return closers, nil
+}
+
+func initAttester() (*server.Attester, error) {
+	in, err := ioutil.ReadFile(config.AttestationKey)
+	if err != nil {
+		return nil, fmt.Errorf("cannot read attestation key: %v", err)
+	}
+	key, err := server.DefaultLoadKey(in)
+	if err != nil {
+		return nil, fmt.Errorf("cannot load attestation key: %v", err)
+	}
+
+	path, err := os.Executable()
+	if err != nil {
+		return nil, err
+	}
+	binary, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("cannot hash binary: %v", err)
+	}
+	buildHash := sha256.Sum256(binary)
+	log.Infof("attesting build %x", buildHash)
+	return &server.Attester{Key: key, BuildHash: buildHash[:]}, nil
+}
+
+// keyWatchers watch the directories of the current keystore's watched stores.
+var keyWatchers []*server.KeyDirWatcher
+
+// readinessInterval is how often failed readiness checks are retried.
+const readinessInterval = 5 * time.Second
+
+// defaultKeyExpiryInterval is how often the expiry of keys' certificates is
+// checked by default.
+const defaultKeyExpiryInterval = time.Hour
+
+// kek decrypts the key files of dir and file stores, once initKeyStore built
+// it from key_encryption.
+var kek server.KEK
+
+// keyServer is the running server, which unwraps the keys of metadata stores.
+// It is nil when validating the configuration.
+var keyServer *server.Server
+
+func initKeyStore() (server.Keystore, []*server.KeyDirWatcher, error) {
+	if kek == nil && config.KeyEncryption.enabled() {
+		var err error
+		if kek, err = config.KeyEncryption.kek(); err != nil {
+			return nil, nil, fmt.Errorf("key_encryption: %v", err)
+		}
+	}
+	chained, sharded, tenanted := false, false, false
+	for _, store := range config.PrivateKeyStores {
+		chained = chained || len(store.SKIPrefixes) > 0 || store.Metadata != ""
+		sharded = sharded || store.Shard != ""
+		tenanted = tenanted || store.Tenant != ""
+	}
+	if sharded {
+		keys, err := initShardedKeyStore()
+		return keys, nil, err
+	}
+	if tenanted {
+		return initTenantKeyStore()
+	}
+	if !chained {
+		// All the stores share a single keystore, which supports the admin API
+		// and key rotation.
+		keys := server.NewDefaultKeystore()
+		keys.SetZeroize(config.ZeroizeKeys)
+		var watchers []*server.KeyDirWatcher
+		for _, store := range config.PrivateKeyStores {
+			w, err := addKeyStore(keys, store)
+			if w != nil {
+				watchers = append(watchers, w)
 			}
-		case store.URI != "":
-			if err := keys.AddFromURI(store.URI); err != nil {
-				return nil, err
+			if err != nil {
+				closeWatchers(watchers)
+				return nil, nil, err
+			}
+		}
+		return keys, watchers, nil
+	}
+
+	chain := server.NewKeystoreChain()
+	var watchers []*server.KeyDirWatcher
+	for _, store := range config.PrivateKeyStores {
+		if store.Metadata != "" {
+			keys, err := newMetadataKeystore(store.Metadata)
+			if err == nil {
+				err = chain.Add(keys, store.SKIPrefixes...)
+			}
+			if err != nil {
+				closeWatchers(watchers)
+				return nil, nil, err
 			}
+			continue
+		}
+		keys := server.NewDefaultKeystore()
+		keys.SetZeroize(config.ZeroizeKeys)
+		w, err := addKeyStore(keys, store)
+		if w != nil {
+			watchers = append(watchers, w)
+		}
+		if err == nil {
+			err = chain.Add(keys, store.SKIPrefixes...)
+		}
+		if err != nil {
+			closeWatchers(watchers)
+			return nil, nil, err
+		}
+	}
+	return chain, watchers, nil
+}
+
+// initShadowKeyStore returns the keystore of the shadow private key stores.
+func initShadowKeyStore() (server.Keystore, error) {
+	keys := server.NewDefaultKeystore()
+	keys.SetZeroize(config.ZeroizeKeys)
+	for _, store := range config.Shadow.PrivateKeyStores {
+		// Validate made sure shadow stores aren't watched.
+		if _, err := addKeyStore(keys, store); err != nil {
+			return nil, fmt.Errorf("shadow: %v", err)
 		}
 	}
 	return keys, nil
 }
 
+// newMetadataKeystore returns a keystore looking keys up in the metadata store
+// at rawurl.
+func newMetadataKeystore(rawurl string) (*server.MetadataKeystore, error) {
+	rawurl, err := resolveSecret(rawurl)
+	if err != nil {
+		return nil, err
+	}
+	store, err := server.NewMetadataStore(rawurl)
+	if err != nil {
+		return nil, err
+	}
+	var load func(*server.KeyRecord) (crypto.Signer, error)
+	if keyServer != nil {
+		load = keyServer.LoadKeyRecord
+	}
+	return server.NewMetadataKeystore(store, load), nil
+}
+
+// initShardedKeyStore loads the keys of the stores into their shards, and
+// moves them to the shards they hash to.
+func initShardedKeyStore() (*server.ShardedKeystore, error) {
+	sharded := server.NewShardedKeystore(0)
+	shards := make(map[string]*server.DefaultKeystore)
+	for _, store := range config.PrivateKeyStores {
+		keys, ok := shards[store.Shard]
+		if !ok {
+			keys = server.NewDefaultKeystore()
+			keys.SetZeroize(config.ZeroizeKeys)
+			if err := sharded.AddShard(store.Shard, keys); err != nil {
+				return nil, err
+			}
+			shards[store.Shard] = keys
+		}
+		// Sharded stores can't be watched, which Validate checks.
+		if _, err := addKeyStore(keys, store); err != nil {
+			return nil, err
+		}
+	}
+	moved, err := sharded.Rebalance(context.Background())
+	if err != nil {
+		return nil, err
+	}
+	if moved > 0 {
+		log.Infof("moved %d keys to their shards", moved)
+	}
+	return sharded, nil
+}
+
+// initTenantKeyStore loads the keys of the stores of each tenant into a
+// keystore of its own.
+func initTenantKeyStore() (*server.TenantKeystore, []*server.KeyDirWatcher, error) {
+	tenants := server.NewTenantKeystore()
+	stores := make(map[string]*server.DefaultKeystore)
+	var watchers []*server.KeyDirWatcher
+	for _, store := range config.PrivateKeyStores {
+		keys, ok := stores[store.Tenant]
+		if !ok {
+			keys = server.NewDefaultKeystore()
+			keys.SetZeroize(config.ZeroizeKeys)
+			if err := tenants.SetTenant(store.Tenant, keys); err != nil {
+				closeWatchers(watchers)
+				return nil, nil, err
+			}
+			stores[store.Tenant] = keys
+		}
+		w, err := addKeyStore(keys, store)
+		if w != nil {
+			watchers = append(watchers, w)
+		}
+		if err != nil {
+			closeWatchers(watchers)
+			return nil, nil, err
+		}
+	}
+	return tenants, watchers, nil
+}
+
+// addKeyStore loads the keys of store into keys, returning the watcher of a
+// watched store.
+func addKeyStore(keys *server.DefaultKeystore, store PrivateKeyStoreConfig) (*server.KeyDirWatcher, error) {
+	// The usage was checked by Validate.
+	usage, _ := store.usage()
+	load := loadKeyWithUsage(keys, usage)
+	switch {
+	case store.Dir != "" && store.Watch:
+		w, err := keys.WatchDir(store.Dir, load)
+		if w != nil && keyServer != nil {
+			w.IndexCertificates(keyServer.CertIndex())
+		}
+		return w, err
+	case store.Dir != "":
+		return nil, keys.AddFromDir(store.Dir, load)
+	case store.File != "":
+		return nil, keys.AddFromFile(store.File, load)
+	case store.URI != "":
+		before := make(map[protocol.SKI]bool)
+		for _, ski := range keys.SKIs() {
+			before[ski] = true
+		}
+		uri, err := resolveSecret(store.URI)
+		if err != nil {
+			return nil, err
+		}
+		if err := keys.AddFromURI(uri); err != nil {
+			return nil, err
+		}
+		for _, ski := range keys.SKIs() {
+			if !before[ski] {
+				keys.SetKeyUsage(ski, usage)
+			}
+		}
+	}
+	return nil, nil
+}
+
+// loadKeyWithUsage returns a function which loads keys like
+// server.DefaultLoadKey, after decrypting them with the KEK if key_encryption
+// is set, and restricts them to usage in keys.
+func loadKeyWithUsage(keys *server.DefaultKeystore, usage *server.KeyUsage) func([]byte) (crypto.Signer, error) {
+	load := server.DefaultLoadKey
+	if kek != nil {
+		load = server.EncryptedLoadKey(kek, load)
+	}
+	return func(in []byte) (crypto.Signer, error) {
+		priv, err := load(in)
+		if err != nil {
+			return nil, err
+		}
+		ski, err := protocol.GetSKI(priv.Public())
+		if err != nil {
+			return nil, err
+		}
+		keys.SetKeyUsage(ski, usage)
+		return priv, nil
+	}
+}
+
+// indexCertificates replaces the server's certificate index with the
+// certificates in the directories of dir stores, which are listed for
+// OpGetCertificates and the admin API. Certificates added to watched stores
+// are only indexed on reload.
+func indexCertificates() {
+	certs := server.NewCertIndex()
+	for _, store := range config.PrivateKeyStores {
+		if store.Dir == "" {
+			continue
+		}
+		if err := certs.AddFromDir(store.Dir); err != nil {
+			log.Warningf("cannot index certificates in %s: %v", store.Dir, err)
+		}
+	}
+	keyServer.CertIndex().Replace(certs)
+	log.Infof("indexed %d certificates", certs.Len())
+}
+
+func closeWatchers(watchers []*server.KeyDirWatcher) {
+	for _, w := range watchers {
+		w.Close()
+	}
+}
+
 // validCertExpiry checks if certificate is currently valid.
 func validCertExpiry(cert *x509.Certificate) bool {
 	now := currentTime
@@ -423,6 +1432,67 @@ func verifyCSRAndKey() bool {
 	return true
 }
 
+// wrapKey prints a LoadKeyRequest for the admin API with the private key in
+// file wrapped for the server's certificate, so that the key can be pushed to
+// a running server which never writes it to disk.
+func wrapKey(file string) error {
+	in, err := ioutil.ReadFile(file)
+	if err != nil {
+		return err
+	}
+	if _, err := server.DefaultLoadKey(in); err != nil {
+		return fmt.Errorf("%s: %v", file, err)
+	}
+	certs := pemCertsFromFile(config.CertFile)
+	if len(certs) == 0 {
+		return fmt.Errorf("no certificate in %s", config.CertFile)
+	}
+	wrapped, err := protocol.WrapKey(certs[0].PublicKey, in)
+	if err != nil {
+		return err
+	}
+	return json.NewEncoder(os.Stdout).Encode(server.LoadKeyRequest{Wrapped: wrapped})
+}
+
+// encryptKey prints the private key in file encrypted under the KEK of
+// key_encryption.
+func encryptKey(file string) error {
+	if !config.KeyEncryption.enabled() {
+		return errors.New("key_encryption must be set to encrypt keys")
+	}
+	in, err := ioutil.ReadFile(file)
+	if err != nil {
+		return err
+	}
+	if _, err := server.DefaultLoadKey(in); err != nil {
+		return fmt.Errorf("%s: %v", file, err)
+	}
+	k, err := config.KeyEncryption.kek()
+	if err != nil {
+		return fmt.Errorf("key_encryption: %v", err)
+	}
+	encrypted, err := server.EncryptKey(k, in)
+	if err != nil {
+		return err
+	}
+	_, err = os.Stdout.Write(encrypted)
+	return err
+}
+
+// noiseKeygen generates a Noise static key, writes its private key to file and
+// prints its public key.
+func noiseKeygen(file string) error {
+	kp, err := noise.GenerateKeyPair(nil)
+	if err != nil {
+		return err
+	}
+	if err := ioutil.WriteFile(file, []byte(kp.String()+"\n"), 0600); err != nil {
+		return err
+	}
+	fmt.Println(kp.Public)
+	return nil
+}
+
 // pemCertsFromFile reads PEM format certificates from a file.
 func pemCertsFromFile(path string) []*x509.Certificate {
 	file, err := os.Open(path)
@@ -132,7 +132,11 @@ func initializeServerCertAndKey() {
 
 	log.Info("contacting Cloudflare API for CSR signing")
 
-	cert, err := initAPICall(config.OriginCAKey, config.Hostname, config.ZoneID, string(csr))
+	token, err := resolveSecret(config.OriginCAKey)
+	if err != nil {
+		log.Fatal("cannot resolve origin_ca_api_key: ", err)
+	}
+	cert, err := initAPICall(token, config.Hostname, config.ZoneID, string(csr))
 	if err != nil {
 		log.Fatal("initialization failed due to API error:", err)
 	}
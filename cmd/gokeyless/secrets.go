@@ -0,0 +1,117 @@
+package main
+
+import (
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"strings"
+
+	"github.com/cloudflare/gokeyless/server"
+)
+
+// Secret fields of the configuration, such as origin_ca_api_key and the URIs
+// of private key stores, which may carry PINs and passwords, are either given
+// literally or refer to where the secret is kept, so that it doesn't have to
+// live in the configuration file:
+//
+//	env://NAME holds the value of the environment variable NAME.
+//	file:///path holds the contents of the file, without trailing newlines.
+//	kms://projects/p/locations/l/keyRings/r/cryptoKeys/k:CIPHERTEXT holds
+//	the base64-encoded ciphertext, decrypted with the Google Cloud KMS crypto
+//	key, as encrypted by "gcloud kms encrypt".
+//
+// References are resolved when the secret is used, at startup and on reload,
+// so that the configuration printed by --output-config doesn't reveal them.
+const (
+	secretEnv  = "env://"
+	secretFile = "file://"
+	secretKMS  = "kms://"
+)
+
+// parseSecretRef splits a reference to a secret into its scheme and the rest
+// of it, or returns an empty scheme if value is a literal secret.
+func parseSecretRef(value string) (scheme, ref string, err error) {
+	for _, scheme := range []string{secretEnv, secretFile, secretKMS} {
+		if !strings.HasPrefix(value, scheme) {
+			continue
+		}
+		ref = strings.TrimPrefix(value, scheme)
+		switch scheme {
+		case secretEnv:
+			if ref == "" {
+				return "", "", errors.New("env:// secret must name a variable")
+			}
+		case secretFile:
+			if !strings.HasPrefix(ref, "/") {
+				return "", "", fmt.Errorf("file:// secret must be an absolute path: %s", value)
+			}
+		case secretKMS:
+			i := strings.LastIndex(ref, ":")
+			if i < 0 {
+				return "", "", errors.New("kms:// secret must be a crypto key and a ciphertext separated by a colon")
+			}
+			if _, err := base64.StdEncoding.DecodeString(ref[i+1:]); err != nil {
+				return "", "", fmt.Errorf("kms:// secret ciphertext is not base64: %v", err)
+			}
+		}
+		return scheme, ref, nil
+	}
+	return "", value, nil
+}
+
+// resolveSecret returns the secret value refers to, or value itself if it is
+// a literal secret.
+func resolveSecret(value string) (string, error) {
+	scheme, ref, err := parseSecretRef(value)
+	if err != nil {
+		return "", err
+	}
+	switch scheme {
+	case secretEnv:
+		secret, ok := os.LookupEnv(ref)
+		if !ok {
+			return "", fmt.Errorf("environment variable %s is not set", ref)
+		}
+		return secret, nil
+	case secretFile:
+		secret, err := ioutil.ReadFile(ref)
+		if err != nil {
+			return "", fmt.Errorf("cannot read secret: %v", err)
+		}
+		return strings.TrimRight(string(secret), "\r\n"), nil
+	case secretKMS:
+		i := strings.LastIndex(ref, ":")
+		// The ciphertext was checked by parseSecretRef.
+		ciphertext, _ := base64.StdEncoding.DecodeString(ref[i+1:])
+		kek, err := server.NewKMSKEK(ref[:i])
+		if err != nil {
+			return "", err
+		}
+		secret, err := kek.Unwrap(ciphertext)
+		if err != nil {
+			return "", fmt.Errorf("cannot decrypt secret: %v", err)
+		}
+		return string(secret), nil
+	default:
+		return value, nil
+	}
+}
+
+// secretRefs returns the secret fields of the configuration by name, for
+// Validate to check their references.
+func (c *Config) secretRefs() map[string]string {
+	refs := map[string]string{
+		"origin_ca_api_key":         c.OriginCAKey,
+		"key_encryption.passphrase": c.KeyEncryption.Passphrase,
+	}
+	for i, store := range c.PrivateKeyStores {
+		refs[fmt.Sprintf("private_key_stores[%d].uri", i)] = store.URI
+		refs[fmt.Sprintf("private_key_stores[%d].metadata", i)] = store.Metadata
+	}
+	for i, store := range c.Shadow.PrivateKeyStores {
+		refs[fmt.Sprintf("shadow.private_key_stores[%d].uri", i)] = store.URI
+	}
+	return refs
+}
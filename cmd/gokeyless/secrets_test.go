@@ -0,0 +1,73 @@
+package main
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestResolveSecret(t *testing.T) {
+	const env = "GOKEYLESS_TEST_SECRET"
+	os.Setenv(env, "from env")
+	defer os.Unsetenv(env)
+	os.Unsetenv(env + "_UNSET")
+
+	dir, err := ioutil.TempDir("", "gokeyless")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	file := filepath.Join(dir, "secret")
+	if err := ioutil.WriteFile(file, []byte("from file\r\n\n"), 0600); err != nil {
+		t.Fatal(err)
+	}
+
+	for _, test := range []struct {
+		value string
+		// scheme and ref are what parseSecretRef returns, and secret what
+		// resolveSecret does. Both fail if bad is set, and resolveSecret alone
+		// if unresolved is.
+		scheme, ref, secret string
+		bad, unresolved     bool
+	}{
+		{value: "literal", ref: "literal", secret: "literal"},
+		{value: "", secret: ""},
+		{value: "env://" + env, scheme: secretEnv, ref: env, secret: "from env"},
+		{value: "env://" + env + "_UNSET", scheme: secretEnv, ref: env + "_UNSET", unresolved: true},
+		{value: "env://", bad: true},
+		{value: "file://" + file, scheme: secretFile, ref: file, secret: "from file"},
+		{value: "file://" + filepath.Join(dir, "missing"), scheme: secretFile, ref: filepath.Join(dir, "missing"), unresolved: true},
+		{value: "file://secret", bad: true},
+		{value: "file://./secret", bad: true},
+		{value: "kms://projects/p/locations/l/keyRings/r/cryptoKeys/k", bad: true},
+		{value: "kms://projects/p/locations/l/keyRings/r/cryptoKeys/k:not base64!", bad: true},
+	} {
+		scheme, ref, err := parseSecretRef(test.value)
+		if test.bad {
+			if err == nil {
+				t.Errorf("%q: parsed as %q %q", test.value, scheme, ref)
+			}
+			if secret, err := resolveSecret(test.value); err == nil {
+				t.Errorf("%q: resolved to %q", test.value, secret)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("%q: %v", test.value, err)
+			continue
+		}
+		if scheme != test.scheme || ref != test.ref {
+			t.Errorf("%q: parsed as %q %q, want %q %q", test.value, scheme, ref, test.scheme, test.ref)
+		}
+		secret, err := resolveSecret(test.value)
+		switch {
+		case test.unresolved && err == nil:
+			t.Errorf("%q: resolved to %q", test.value, secret)
+		case !test.unresolved && err != nil:
+			t.Errorf("%q: %v", test.value, err)
+		case !test.unresolved && secret != test.secret:
+			t.Errorf("%q: resolved to %q, want %q", test.value, secret, test.secret)
+		}
+	}
+}
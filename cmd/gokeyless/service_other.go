@@ -0,0 +1,10 @@
+// +build !windows
+
+package main
+
+import "github.com/cloudflare/gokeyless/server"
+
+// runService runs s as a Windows service, which is only possible on Windows.
+func runService(s *server.Server) (bool, error) {
+	return false, nil
+}
@@ -0,0 +1,53 @@
+// +build windows
+
+package main
+
+import (
+	"github.com/cloudflare/cfssl/log"
+	"github.com/cloudflare/gokeyless/server"
+	"golang.org/x/sys/windows/svc"
+)
+
+// runService runs s as a Windows service if the process was started by the
+// service control manager, reporting whether it was.
+func runService(s *server.Server) (bool, error) {
+	isService, err := svc.IsWindowsService()
+	if err != nil || !isService {
+		return false, err
+	}
+	return true, svc.Run("gokeyless", &service{s: s})
+}
+
+// service implements svc.Handler for the server.
+type service struct {
+	s *server.Server
+}
+
+func (h *service) Execute(args []string, requests <-chan svc.ChangeRequest, status chan<- svc.Status) (bool, uint32) {
+	const accepts = svc.AcceptStop | svc.AcceptShutdown
+	status <- svc.Status{State: svc.StartPending}
+
+	errs := make(chan error, 1)
+	go func() {
+		errs <- serve(h.s, func() {
+			status <- svc.Status{State: svc.Running, Accepts: accepts}
+		})
+	}()
+
+	for {
+		select {
+		case err := <-errs:
+			log.Errorf("server failed: %v", err)
+			return false, 1
+		case req := <-requests:
+			switch req.Cmd {
+			case svc.Interrogate:
+				status <- req.CurrentStatus
+			case svc.Stop, svc.Shutdown:
+				status <- svc.Status{State: svc.StopPending}
+				h.s.Close()
+				return false, 0
+			}
+		}
+	}
+}
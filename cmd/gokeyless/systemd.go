@@ -0,0 +1,104 @@
+package main
+
+import (
+	"fmt"
+	"net"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/cloudflare/cfssl/log"
+)
+
+// listenFDsStart is the first file descriptor passed by systemd socket
+// activation.
+const listenFDsStart = 3
+
+// activatedListeners returns the listeners passed by systemd socket activation
+// (see sd_listen_fds(3)), keyed by their FileDescriptorName. Sockets without
+// a name are keyed "unknown", as systemd does. The environment variables are
+// unset so that child processes don't inherit them.
+func activatedListeners() (map[string][]net.Listener, error) {
+	defer os.Unsetenv("LISTEN_PID")
+	defer os.Unsetenv("LISTEN_FDS")
+	defer os.Unsetenv("LISTEN_FDNAMES")
+
+	pid, err := strconv.Atoi(os.Getenv("LISTEN_PID"))
+	if err != nil || pid != os.Getpid() {
+		return nil, nil
+	}
+	n, err := strconv.Atoi(os.Getenv("LISTEN_FDS"))
+	if err != nil || n <= 0 {
+		return nil, fmt.Errorf("invalid LISTEN_FDS %q", os.Getenv("LISTEN_FDS"))
+	}
+	names := strings.Split(os.Getenv("LISTEN_FDNAMES"), ":")
+
+	listeners := make(map[string][]net.Listener)
+	for i := 0; i < n; i++ {
+		name := "unknown"
+		if i < len(names) && names[i] != "" {
+			name = names[i]
+		}
+		f := os.NewFile(uintptr(listenFDsStart+i), name)
+		l, err := net.FileListener(f)
+		f.Close()
+		if err != nil {
+			return nil, fmt.Errorf("socket %d (%s) from systemd: %v", i, name, err)
+		}
+		listeners[name] = append(listeners[name], l)
+	}
+	return listeners, nil
+}
+
+// sdNotify sends state to the service manager (see sd_notify(3)). It does
+// nothing if the server wasn't started by systemd with NotifyAccess.
+func sdNotify(state string) error {
+	addr := os.Getenv("NOTIFY_SOCKET")
+	if addr == "" {
+		return nil
+	}
+	if addr[0] == '@' {
+		// An abstract socket.
+		addr = "\x00" + addr[1:]
+	}
+	conn, err := net.DialUnix("unixgram", nil, &net.UnixAddr{Name: addr, Net: "unixgram"})
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+	_, err = conn.Write([]byte(state))
+	return err
+}
+
+// watchdogInterval returns the interval within which systemd expects watchdog
+// pings (see sd_watchdog_enabled(3)), or zero if the watchdog is disabled.
+func watchdogInterval() time.Duration {
+	usec, err := strconv.ParseInt(os.Getenv("WATCHDOG_USEC"), 10, 64)
+	if err != nil || usec <= 0 {
+		return 0
+	}
+	if pid := os.Getenv("WATCHDOG_PID"); pid != "" && pid != strconv.Itoa(os.Getpid()) {
+		return 0
+	}
+	return time.Duration(usec) * time.Microsecond
+}
+
+// notifyReady tells systemd that the server is serving, and starts sending
+// watchdog pings at half the watchdog interval if it is enabled.
+func notifyReady() {
+	if err := sdNotify("READY=1"); err != nil {
+		log.Errorf("systemd notification failed: %v", err)
+	}
+	interval := watchdogInterval()
+	if interval == 0 {
+		return
+	}
+	go func() {
+		for range time.Tick(interval / 2) {
+			if err := sdNotify("WATCHDOG=1"); err != nil {
+				log.Errorf("systemd watchdog notification failed: %v", err)
+			}
+		}
+	}()
+}
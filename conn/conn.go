@@ -72,6 +72,26 @@ import (
 // in a loop. It acquires the read mutex, reads a message off the connection,
 // and dispatches it to the appropriate listener.
 //
+// Answering Pings
+//
+// Servers which negotiated keepalive with Hello may ping an idle connection to
+// check that the client is still there. Servers never send OpPing as a
+// response, so DoRead answers any OpPing it reads with an OpPong, whatever its
+// ID, instead of dispatching it.
+//
+// Key Removal Notices
+//
+// Servers which negotiated FeatureKeyRemoved with Hello send OpKeyRemoved when
+// they stop serving a key. DoRead passes its SKI to the function set with
+// OnKeyRemoved, if any, instead of dispatching it.
+//
+// Reconnect Requests
+//
+// Servers which negotiated FeatureReconnect with Hello send OpReconnect before
+// closing a connection which reached its maximum age or size. DoRead calls the
+// function set with OnReconnect, if any, instead of dispatching it, so that
+// new operations are sent on another connection.
+//
 // Closing the Connection
 //
 // Ideally, a client would only close the connection after all of its other
@@ -111,13 +131,30 @@ var ErrNotFound = fmt.Errorf("connection removed")
 type Conn struct {
 	// In order to read, acquire readMtx; in order to write, acquire writeMtx
 	conn net.Conn
+	// http, if set, is used to send operations instead of conn.
+	http *httpTransport
 	// In order to read, acquire mapMtx.RLock(); in order to write, acquire
 	// mapMtx.Lock().
 	listeners map[uint32]chan *result
 	// In order to modify, acquire mapMtx.Lock().
 	nextID uint32
+	// nextStream is the ID of the next stream of DoStream. In order to read or
+	// write, acquire mapMtx.
+	nextStream uint32
 
 	opTimeout time.Duration
+	// features negotiated with the server. In order to read or write, acquire
+	// mapMtx.
+	features protocol.Features
+	// onKeyRemoved is set by OnKeyRemoved. In order to read or write, acquire
+	// mapMtx.
+	onKeyRemoved func(protocol.SKI)
+	// onReconnect is set by OnReconnect. In order to read or write, acquire
+	// mapMtx.
+	onReconnect func()
+	// strictPadding is set by StrictPadding. In order to read or write,
+	// acquire mapMtx.
+	strictPadding bool
 
 	// To lock up the connection, always acquire in the following order to avoid
 	// deadlock: writeMtx, mapMtx (don't acquire readMtx).
@@ -140,6 +177,7 @@ func NewConnTimeout(inner net.Conn, opTimeout time.Duration) *Conn {
 		conn:      inner,
 		listeners: make(map[uint32]chan *result),
 		opTimeout: opTimeout,
+		features:  protocol.V1Features,
 	}
 }
 
@@ -159,7 +197,12 @@ func (c *Conn) Close() error {
 	}
 
 	c.closed = true
-	err := c.conn.Close()
+	var err error
+	if c.http != nil {
+		c.http.client.CloseIdleConnections()
+	} else {
+		err = c.conn.Close()
+	}
 	for _, l := range c.listeners {
 		// signal to all of the blocking calls to DoOperation that they should
 		// return
@@ -184,6 +227,34 @@ func (c *Conn) DoRead() error {
 	if err != nil {
 		return err
 	}
+	c.mapMtx.Lock()
+	strict, required := c.strictPadding, c.features.Padding != protocol.PaddingOptional
+	c.mapMtx.Unlock()
+	var paddingErr error
+	if strict {
+		paddingErr = pkt.CheckPadding(required)
+	}
+	if pkt.Opcode == protocol.OpPing {
+		return c.pong(pkt)
+	}
+	if pkt.Opcode == protocol.OpKeyRemoved {
+		c.mapMtx.Lock()
+		f := c.onKeyRemoved
+		c.mapMtx.Unlock()
+		if f != nil {
+			f(pkt.SKI)
+		}
+		return nil
+	}
+	if pkt.Opcode == protocol.OpReconnect {
+		c.mapMtx.Lock()
+		f := c.onReconnect
+		c.mapMtx.Unlock()
+		if f != nil {
+			f()
+		}
+		return nil
+	}
 	l, err := c.extractChannel(pkt.ID)
 	if err != nil {
 		// The timeout fired, our connection was removed.
@@ -195,10 +266,66 @@ func (c *Conn) DoRead() error {
 		return err
 	}
 
+	if paddingErr != nil {
+		l <- &result{err: fmt.Errorf("invalid padding in response: %w", paddingErr)}
+		return nil
+	}
 	l <- &result{op: &pkt.Operation}
 	return nil
 }
 
+// OnKeyRemoved sets the function called by DoRead with the SKI of each key the
+// server says it no longer serves. It is only called if FeatureKeyRemoved was
+// negotiated with Hello, and must not block.
+func (c *Conn) OnKeyRemoved(f func(ski protocol.SKI)) {
+	c.mapMtx.Lock()
+	defer c.mapMtx.Unlock()
+	c.onKeyRemoved = f
+}
+
+// OnReconnect sets the function called by DoRead when the server asks the
+// client to move to a new connection. It is only called if FeatureReconnect
+// was negotiated with Hello, and must not block.
+func (c *Conn) OnReconnect(f func()) {
+	c.mapMtx.Lock()
+	defer c.mapMtx.Unlock()
+	c.onReconnect = f
+}
+
+// StrictPadding makes DoRead reject responses whose padding items aren't all
+// zero bytes, or which aren't padded to 1024 bytes although
+// protocol.PaddingOptional wasn't negotiated. Operations whose responses are
+// rejected fail with an error wrapping a *protocol.ParseError; the connection
+// stays usable.
+func (c *Conn) StrictPadding(strict bool) {
+	c.mapMtx.Lock()
+	defer c.mapMtx.Unlock()
+	c.strictPadding = strict
+}
+
+// pong answers a ping from the server.
+func (c *Conn) pong(ping *protocol.Packet) error {
+	c.writeMtx.Lock()
+	defer c.writeMtx.Unlock()
+	c.mapMtx.Lock()
+	closed, features := c.closed, c.features
+	c.mapMtx.Unlock()
+	if closed {
+		return ErrClosed
+	}
+
+	op := protocol.MakePongOp(ping.Payload)
+	op.NoPadding = features.Padding == protocol.PaddingOptional
+	if err := c.conn.SetWriteDeadline(time.Now().Add(c.opTimeout)); err != nil {
+		return fmt.Errorf("could not set write deadline: %v", err)
+	}
+	pkt := protocol.NewPacket(ping.ID, op)
+	if _, err := pkt.WriteTo(c.conn); err != nil {
+		return fmt.Errorf("could not write to connection: %v", err)
+	}
+	return nil
+}
+
 func (c *Conn) extractChannel(id uint32) (chan *result, error) {
 	c.mapMtx.Lock()
 	defer c.mapMtx.Unlock()
@@ -222,12 +349,32 @@ func (c *Conn) timeoutRequest(id uint32, timeout time.Duration) {
 	place <- &result{err: fmt.Errorf("operation timed out")}
 }
 
-// DoOperation executes an entire keyless operation, returning its result.
+type priorityKey struct{}
+
+// WithPriority returns a copy of ctx carrying p, which is sent as the Priority
+// of the operations executed with it that don't set their own.
+func WithPriority(ctx context.Context, p protocol.Priority) context.Context {
+	return context.WithValue(ctx, priorityKey{}, p)
+}
+
+// PriorityFromContext returns the priority set on ctx with WithPriority, if
+// any.
+func PriorityFromContext(ctx context.Context) (protocol.Priority, bool) {
+	p, ok := ctx.Value(priorityKey{}).(protocol.Priority)
+	return p, ok
+}
+
+// DoOperation executes an entire keyless operation, returning its result. It
+// gives up when ctx is done, or after the connection's operation timeout.
 func (c *Conn) DoOperation(ctx context.Context, op protocol.Operation) (*protocol.Operation, error) {
 	span, ctx := opentracing.StartSpanFromContext(ctx, "Conn.DoOperation")
 	defer span.Finish()
 	tracing.SetOperationSpanTags(span, &op)
 
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+
 	// NOTE: It's very important that this channel be buffered so that if we
 	// time out, but a reader finds this channel before we have a chance to delete
 	// it from the map, the reader doesn't block forever sending us a value that
@@ -240,8 +387,36 @@ func (c *Conn) DoOperation(ctx context.Context, op protocol.Operation) (*protoco
 		c.mapMtx.Unlock()
 		return nil, ErrClosed
 	}
+	if len(op.Payload) > int(c.features.MaxPayload) {
+		c.mapMtx.Unlock()
+		return nil, fmt.Errorf("payload of %d bytes exceeds the server's maximum of %d", len(op.Payload), c.features.MaxPayload)
+	}
+	op.NoPadding = c.features.Padding == protocol.PaddingOptional
+	if len(c.features.Compression) > 0 {
+		if err := op.Compress(c.features.Compression[0]); err != nil {
+			c.mapMtx.Unlock()
+			return nil, err
+		}
+	}
+	if op.Budget == 0 {
+		// Tell the server how long we will wait, so that it doesn't execute
+		// the request once we have given up on it.
+		op.Budget = c.opTimeout
+		if deadline, ok := ctx.Deadline(); ok && time.Until(deadline) < op.Budget {
+			op.Budget = time.Until(deadline)
+		}
+	}
+	if op.Priority == protocol.PriorityNormal {
+		op.Priority, _ = PriorityFromContext(ctx)
+	}
 	id := c.nextID
 	c.nextID++
+	if c.http != nil {
+		// Each HTTP request carries its own response, so there is nothing to
+		// register with DoRead.
+		c.mapMtx.Unlock()
+		return c.http.roundTrip(ctx, protocol.NewPacket(id, op), c.opTimeout)
+	}
 	if _, ok := c.listeners[id]; ok {
 		c.mapMtx.Unlock()
 		c.Close()
@@ -263,7 +438,11 @@ func (c *Conn) DoOperation(ctx context.Context, op protocol.Operation) (*protoco
 		return nil, ErrClosed
 	}
 	end := time.Now().Add(c.opTimeout)
-	err := c.conn.SetWriteDeadline(end)
+	writeEnd := end
+	if deadline, ok := ctx.Deadline(); ok && deadline.Before(end) {
+		writeEnd = deadline
+	}
+	err := c.conn.SetWriteDeadline(writeEnd)
 	if err != nil {
 		c.writeMtx.Unlock()
 		return nil, fmt.Errorf("could not set write deadline: %v", err)
@@ -271,6 +450,11 @@ func (c *Conn) DoOperation(ctx context.Context, op protocol.Operation) (*protoco
 	_, err = pkt.WriteTo(c.conn)
 	c.writeMtx.Unlock()
 	if err != nil {
+		// A partially written packet leaves the connection unusable.
+		c.Close()
+		if ctx.Err() != nil {
+			return nil, fmt.Errorf("could not write to connection: %w", ctx.Err())
+		}
 		return nil, fmt.Errorf("could not write to connection: %v", err)
 	}
 	waitingSpan, ctx := opentracing.StartSpanFromContext(ctx, "Conn.DoOperation.Waiting")
@@ -280,7 +464,18 @@ func (c *Conn) DoOperation(ctx context.Context, op protocol.Operation) (*protoco
 	// connection was backed up).
 	left := end.Sub(time.Now())
 	go c.timeoutRequest(id, left)
-	res := <-response
+	var res *result
+	select {
+	case res = <-response:
+	case <-ctx.Done():
+		if _, err := c.extractChannel(id); err != nil {
+			// The response or timeout arrived first.
+			res = <-response
+			break
+		}
+		waitingSpan.Finish()
+		return nil, ctx.Err()
+	}
 	waitingSpan.Finish()
 	if res == nil {
 		return nil, ErrClosed
@@ -318,6 +513,111 @@ func (c *Conn) Ping(ctx context.Context, data []byte) error {
 	}
 }
 
+// Features returns the protocol features negotiated with the server, or
+// protocol.V1Features if Hello has not been called.
+func (c *Conn) Features() protocol.Features {
+	c.mapMtx.Lock()
+	defer c.mapMtx.Unlock()
+	return c.features
+}
+
+// Hello negotiates protocol features with the server, offering local. The
+// negotiated features are returned and apply to all subsequent operations on
+// the connection. Servers which don't support OpHello are assumed to have
+// protocol.V1Features.
+//
+// Hello should be called before any other operation is started.
+func (c *Conn) Hello(ctx context.Context, local protocol.Features) (protocol.Features, error) {
+	span, ctx := opentracing.StartSpanFromContext(ctx, "Conn.Hello")
+	defer span.Finish()
+
+	payload, err := local.MarshalBinary()
+	if err != nil {
+		return protocol.Features{}, err
+	}
+	result, err := c.DoOperation(ctx, protocol.Operation{
+		Opcode:  protocol.OpHello,
+		Payload: payload,
+	})
+	if err != nil {
+		return protocol.Features{}, err
+	}
+
+	var features protocol.Features
+	switch result.Opcode {
+	case protocol.OpResponse:
+		var remote protocol.Features
+		if err := remote.UnmarshalBinary(result.Payload); err != nil {
+			return protocol.Features{}, fmt.Errorf("hello: %v", err)
+		}
+		features = protocol.Negotiate(local, remote)
+	case protocol.OpError:
+		if err := result.GetError(); err != protocol.ErrBadOpcode {
+			return protocol.Features{}, err
+		}
+		features = protocol.Negotiate(local, protocol.V1Features)
+	default:
+		return protocol.Features{}, fmt.Errorf("hello: got unexpected response opcode: %v", result.Opcode)
+	}
+
+	c.mapMtx.Lock()
+	c.features = features
+	c.mapMtx.Unlock()
+	return features, nil
+}
+
+// Attest asks the server for an attestation including nonce. The attestation's
+// signature is not verified.
+func (c *Conn) Attest(ctx context.Context, nonce []byte) (*protocol.Attestation, error) {
+	span, ctx := opentracing.StartSpanFromContext(ctx, "Conn.Attest")
+	defer span.Finish()
+
+	result, err := c.DoOperation(ctx, protocol.Operation{
+		Opcode:  protocol.OpAttest,
+		Payload: nonce,
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	switch result.Opcode {
+	case protocol.OpResponse:
+		var a protocol.Attestation
+		if err := a.UnmarshalBinary(result.Payload); err != nil {
+			return nil, fmt.Errorf("attest: %v", err)
+		}
+		return &a, nil
+	case protocol.OpError:
+		return nil, result.GetError()
+	default:
+		return nil, fmt.Errorf("attest: got unexpected response opcode: %v", result.Opcode)
+	}
+}
+
+// Authenticate authenticates the connection with the bearer token token, for
+// clients which have no certificate.
+func (c *Conn) Authenticate(ctx context.Context, token string) error {
+	span, ctx := opentracing.StartSpanFromContext(ctx, "Conn.Authenticate")
+	defer span.Finish()
+
+	result, err := c.DoOperation(ctx, protocol.Operation{
+		Opcode:  protocol.OpAuthenticate,
+		Payload: []byte(token),
+	})
+	if err != nil {
+		return err
+	}
+
+	switch result.Opcode {
+	case protocol.OpResponse:
+		return nil
+	case protocol.OpError:
+		return result.GetError()
+	default:
+		return fmt.Errorf("authenticate: got unexpected response opcode: %v", result.Opcode)
+	}
+}
+
 // RPC returns an RPC client which uses the connection. Closing the returned
 // *rpc.Client will cleanup any spawned goroutines, but will not close the
 // underlying connection.
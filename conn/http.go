@@ -0,0 +1,69 @@
+package conn
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"time"
+
+	"github.com/cloudflare/gokeyless/protocol"
+)
+
+// httpTransport sends each operation as the body of an HTTP POST request.
+type httpTransport struct {
+	client *http.Client
+	url    string
+}
+
+// NewHTTPConn constructs a new Conn which sends each operation to the keyless
+// HTTP handler at url using client, with the default operation timeout of 10s.
+// Such a Conn needs no calls to DoRead.
+func NewHTTPConn(client *http.Client, url string) *Conn {
+	return &Conn{
+		http:      &httpTransport{client: client, url: url},
+		listeners: make(map[uint32]chan *result),
+		opTimeout: defaultOpTimeout,
+		features:  protocol.V1Features,
+	}
+}
+
+// roundTrip sends pkt and returns the operation of the response packet.
+func (t *httpTransport) roundTrip(ctx context.Context, pkt protocol.Packet, timeout time.Duration) (*protocol.Operation, error) {
+	ctx, cancel := context.WithTimeout(ctx, timeout)
+	defer cancel()
+
+	body, err := pkt.MarshalBinary()
+	if err != nil {
+		return nil, err
+	}
+	req, err := http.NewRequest(http.MethodPost, t.url, bytes.NewReader(body))
+	if err != nil {
+		return nil, err
+	}
+	req = req.WithContext(ctx)
+	req.Header.Set("Content-Type", protocol.HTTPContentType)
+
+	resp, err := t.client.Do(req)
+	if err != nil {
+		return nil, fmt.Errorf("could not send request: %w", err)
+	}
+	defer func() {
+		io.Copy(ioutil.Discard, resp.Body)
+		resp.Body.Close()
+	}()
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("keyserver responded with %s", resp.Status)
+	}
+
+	var out protocol.Packet
+	if _, err := out.ReadFrom(resp.Body); err != nil {
+		return nil, fmt.Errorf("could not read response: %v", err)
+	}
+	if out.ID != pkt.ID {
+		return nil, fmt.Errorf("got response for packet %d, expected %d", out.ID, pkt.ID)
+	}
+	return &out.Operation, nil
+}
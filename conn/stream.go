@@ -0,0 +1,100 @@
+package conn
+
+import (
+	"context"
+	"fmt"
+
+	"github.com/cloudflare/gokeyless/protocol"
+)
+
+// DoStream performs op like DoOperation, but sends its payload and receives
+// its result in chunks with protocol.OpStream, so that either can be larger
+// than a packet, e.g. to seal a multi-megabyte blob. The chunks are as large
+// as the server's MaxPayload allows, one request at a time. The returned
+// operation is the OpError of whichever request failed, or an OpResponse
+// carrying the whole result.
+func (c *Conn) DoStream(ctx context.Context, op protocol.Operation) (*protocol.Operation, error) {
+	c.mapMtx.Lock()
+	id := c.nextStream
+	c.nextStream++
+	chunkSize := int(c.features.MaxPayload) - protocol.StreamOverhead
+	c.mapMtx.Unlock()
+	if chunkSize <= 0 {
+		return nil, fmt.Errorf("stream: the server's maximum payload of %dB is too small", chunkSize+protocol.StreamOverhead)
+	}
+
+	// StreamBegin carries the other items of op, such as its SKI.
+	target, payload := op.Opcode, op.Payload
+	op.Opcode, op.Payload = protocol.OpStream, nil
+	resp, err := c.doStreamChunk(ctx, op, protocol.StreamChunk{
+		Phase:  protocol.StreamBegin,
+		ID:     id,
+		Opcode: target,
+		Length: len(payload),
+	})
+	if err != nil || resp.Opcode == protocol.OpError {
+		return resp, err
+	}
+	for offset := 0; ; offset += chunkSize {
+		end, phase := offset+chunkSize, protocol.StreamContinue
+		if end >= len(payload) {
+			end, phase = len(payload), protocol.StreamEnd
+		}
+		resp, err = c.doStreamChunk(ctx, protocol.Operation{Opcode: protocol.OpStream}, protocol.StreamChunk{
+			Phase:  phase,
+			ID:     id,
+			Offset: offset,
+			Data:   payload[offset:end],
+		})
+		if err != nil || resp.Opcode == protocol.OpError || phase == protocol.StreamEnd {
+			break
+		}
+	}
+	if err != nil || resp.Opcode == protocol.OpError {
+		return resp, err
+	}
+
+	var result []byte
+	for {
+		var chunk protocol.StreamChunk
+		if err := chunk.UnmarshalBinary(resp.Payload); err != nil {
+			return nil, fmt.Errorf("stream: %v", err)
+		}
+		if chunk.Offset != len(result) {
+			return nil, fmt.Errorf("stream: got a chunk at %d instead of %d", chunk.Offset, len(result))
+		}
+		if result == nil {
+			result = make([]byte, 0, chunk.Length)
+		}
+		result = append(result, chunk.Data...)
+		if len(result) >= chunk.Length || len(chunk.Data) == 0 {
+			break
+		}
+		resp, err = c.doStreamChunk(ctx, protocol.Operation{Opcode: protocol.OpStream}, protocol.StreamChunk{
+			Phase:  protocol.StreamRead,
+			ID:     id,
+			Offset: len(result),
+		})
+		if err != nil || resp.Opcode == protocol.OpError {
+			return resp, err
+		}
+	}
+	resp.Payload = result
+	return resp, nil
+}
+
+// doStreamChunk sends chunk as the payload of op, an OpStream request.
+func (c *Conn) doStreamChunk(ctx context.Context, op protocol.Operation, chunk protocol.StreamChunk) (*protocol.Operation, error) {
+	var err error
+	if op.Payload, err = chunk.MarshalBinary(); err != nil {
+		return nil, err
+	}
+	resp, err := c.DoOperation(ctx, op)
+	if err != nil {
+		return nil, err
+	}
+	if resp.Opcode != protocol.OpResponse && resp.Opcode != protocol.OpError {
+		return nil, fmt.Errorf("stream: got unexpected response opcode: %v", resp.Opcode)
+	}
+	return resp, nil
+}
@@ -0,0 +1,91 @@
+package etcd
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"sort"
+	"strings"
+	"testing"
+)
+
+func TestClient(t *testing.T) {
+	data := map[string]string{"keyless/a": "1", "keyless/b": "2", "other": "3"}
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch r.URL.Path {
+		case "/v3/auth/authenticate":
+			json.NewEncoder(w).Encode(map[string]string{"token": "token"})
+			return
+		case "/v3/kv/range":
+		default:
+			http.NotFound(w, r)
+			return
+		}
+		if r.Header.Get("Authorization") != "token" {
+			http.Error(w, "unauthenticated", http.StatusUnauthorized)
+			return
+		}
+		var req rangeRequest
+		if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		var resp rangeResponse
+		var keys []string
+		for k := range data {
+			if k == string(req.Key) || (req.RangeEnd != nil && k >= string(req.Key) && k < string(req.RangeEnd)) {
+				keys = append(keys, k)
+			}
+		}
+		sort.Strings(keys)
+		for _, k := range keys {
+			kv := struct {
+				Key   []byte `json:"key"`
+				Value []byte `json:"value"`
+			}{Key: []byte(k)}
+			if !req.KeysOnly {
+				kv.Value = []byte(data[k])
+			}
+			resp.KVs = append(resp.KVs, kv)
+		}
+		json.NewEncoder(w).Encode(resp)
+	}))
+	defer srv.Close()
+	ctx := context.Background()
+
+	c, err := New("etcd://user:password@" + strings.TrimPrefix(srv.URL, "http://"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	v, err := c.Get(ctx, "keyless/a")
+	if err != nil || string(v) != "1" {
+		t.Fatalf("got %q, %v", v, err)
+	}
+	if v, err := c.Get(ctx, "missing"); err != nil || v != nil {
+		t.Fatalf("got %q, %v for a missing key", v, err)
+	}
+	keys, err := c.Keys(ctx, "keyless/")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if strings.Join(keys, ",") != "keyless/a,keyless/b" {
+		t.Fatalf("got %v", keys)
+	}
+
+	c, err = New("etcd://" + strings.TrimPrefix(srv.URL, "http://"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := c.Get(ctx, "keyless/a"); err == nil {
+		t.Fatal("unauthenticated request succeeded")
+	}
+}
+
+func TestPrefixEnd(t *testing.T) {
+	for prefix, want := range map[string]string{"a/": "a0", "a\xff": "b", "\xff": "\x00"} {
+		if got := string(prefixEnd(prefix)); got != want {
+			t.Errorf("prefixEnd(%q) = %q, want %q", prefix, got, want)
+		}
+	}
+}
@@ -45,3 +45,44 @@ func TestSmoke(t *testing.T) {
 	require.Equal(sig, []byte("digest"))
 
 }
+
+// mockKEK "encrypts" by reversing the plaintext.
+type mockKEK struct{}
+
+func reversed(b []byte) []byte {
+	r := make([]byte, len(b))
+	for i := range b {
+		r[len(b)-1-i] = b[i]
+	}
+	return r
+}
+
+func (k mockKEK) Encrypt(ctx context.Context, req *kmspb.EncryptRequest, opts ...gax.CallOption) (*kmspb.EncryptResponse, error) {
+	ciphertext := reversed(req.Plaintext)
+	return &kmspb.EncryptResponse{
+		Ciphertext:              ciphertext,
+		CiphertextCrc32C:        wrapperspb.Int64(int64(crc32c(ciphertext))),
+		VerifiedPlaintextCrc32C: true,
+	}, nil
+}
+func (k mockKEK) Decrypt(ctx context.Context, req *kmspb.DecryptRequest, opts ...gax.CallOption) (*kmspb.DecryptResponse, error) {
+	plaintext := reversed(req.Ciphertext)
+	return &kmspb.DecryptResponse{
+		Plaintext:       plaintext,
+		PlaintextCrc32C: wrapperspb.Int64(int64(crc32c(plaintext))),
+	}, nil
+}
+
+func TestKEK(t *testing.T) {
+	require := require.New(t)
+	require.True(IsKMSCryptoKey("projects/abc/locations/us-west1/keyRings/xyz/cryptoKeys/kek"))
+	require.False(IsKMSCryptoKey("projects/abc/locations/us-west1/keyRings/xyz/cryptoKeys/kek/cryptoKeyVersions/3"))
+
+	k := KEK{client: mockKEK{}, name: "kek"}
+	wrapped, err := k.Wrap([]byte("data key"))
+	require.NoError(err)
+	require.Equal([]byte("yek atad"), wrapped)
+	dek, err := k.Unwrap(wrapped)
+	require.NoError(err)
+	require.Equal([]byte("data key"), dek)
+}
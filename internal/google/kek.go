@@ -0,0 +1,76 @@
+package google
+
+import (
+	"context"
+	"fmt"
+	"strings"
+
+	kms "cloud.google.com/go/kms/apiv1"
+	"github.com/googleapis/gax-go/v2"
+	kmspb "google.golang.org/genproto/googleapis/cloud/kms/v1"
+	"google.golang.org/protobuf/types/known/wrapperspb"
+)
+
+type kekClient interface {
+	Encrypt(ctx context.Context, req *kmspb.EncryptRequest, opts ...gax.CallOption) (*kmspb.EncryptResponse, error)
+	Decrypt(ctx context.Context, req *kmspb.DecryptRequest, opts ...gax.CallOption) (*kmspb.DecryptResponse, error)
+}
+
+// KEK is a key encryption key held in Google Cloud KMS: a symmetric crypto
+// key which encrypts the data keys of private keys at rest.
+type KEK struct {
+	client kekClient
+	name   string
+}
+
+// NewKEK returns a KEK using the KMS crypto key with the given resource name.
+func NewKEK(name string) (*KEK, error) {
+	client, err := kms.NewKeyManagementClient(context.Background())
+	if err != nil {
+		return nil, fmt.Errorf("google: failed to create kms client: %v", err)
+	}
+	return &KEK{client: client, name: name}, nil
+}
+
+// Wrap encrypts dek with the KMS key.
+func (k *KEK) Wrap(dek []byte) ([]byte, error) {
+	result, err := k.client.Encrypt(context.Background(), &kmspb.EncryptRequest{
+		Name:            k.name,
+		Plaintext:       dek,
+		PlaintextCrc32C: wrapperspb.Int64(int64(crc32c(dek))),
+	})
+	if err != nil {
+		return nil, fmt.Errorf("google: failed to encrypt data key: %v", err)
+	}
+	if !result.VerifiedPlaintextCrc32C {
+		return nil, fmt.Errorf("google: plaintext CRC32 not verified")
+	}
+	if result.CiphertextCrc32C == nil || int64(crc32c(result.Ciphertext)) != result.CiphertextCrc32C.Value {
+		return nil, fmt.Errorf("google: ciphertext crc32 incorrect")
+	}
+	return result.Ciphertext, nil
+}
+
+// Unwrap decrypts a data key encrypted by Wrap.
+func (k *KEK) Unwrap(wrapped []byte) ([]byte, error) {
+	result, err := k.client.Decrypt(context.Background(), &kmspb.DecryptRequest{
+		Name:             k.name,
+		Ciphertext:       wrapped,
+		CiphertextCrc32C: wrapperspb.Int64(int64(crc32c(wrapped))),
+	})
+	if err != nil {
+		return nil, fmt.Errorf("google: failed to decrypt data key: %v", err)
+	}
+	if result.PlaintextCrc32C == nil || int64(crc32c(result.Plaintext)) != result.PlaintextCrc32C.Value {
+		return nil, fmt.Errorf("google: plaintext crc32 incorrect")
+	}
+	return result.Plaintext, nil
+}
+
+// IsKMSCryptoKey attempts to identify if a name is a KMS `Key` resource
+// name, e.g. projects/p/locations/l/keyRings/r/cryptoKeys/k, which is how
+// KEKs are named.
+func IsKMSCryptoKey(name string) bool {
+	parts := strings.Split(name, "/")
+	return len(parts) == 8 && parts[0] == "projects" && parts[2] == "locations" && parts[4] == "keyRings" && parts[6] == "cryptoKeys"
+}
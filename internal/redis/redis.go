@@ -0,0 +1,277 @@
+// Package redis is a minimal Redis client, supporting the few commands needed
+// to read key metadata.
+package redis
+
+import (
+	"bufio"
+	"context"
+	"crypto/tls"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/url"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// dialTimeout bounds dialing the server when the context has no deadline.
+const dialTimeout = 5 * time.Second
+
+// IsURL reports whether rawurl is a redis:// or rediss:// URL.
+func IsURL(rawurl string) bool {
+	return strings.HasPrefix(rawurl, "redis://") || strings.HasPrefix(rawurl, "rediss://")
+}
+
+// A Client sends commands to a Redis server over a single connection, which
+// is redialed after errors.
+type Client struct {
+	addr     string
+	tls      *tls.Config
+	password string
+	db       int
+
+	mtx  sync.Mutex
+	conn net.Conn
+	r    *bufio.Reader
+}
+
+// New returns a Client for a URL such as redis://:password@host:6379/2, where
+// the path selects the database. rediss:// URLs connect with TLS. The server
+// is dialed on the first command.
+func New(rawurl string) (*Client, error) {
+	u, err := url.Parse(rawurl)
+	if err != nil {
+		return nil, err
+	}
+	c := &Client{addr: u.Host}
+	switch u.Scheme {
+	case "redis":
+	case "rediss":
+		c.tls = &tls.Config{ServerName: u.Hostname()}
+	default:
+		return nil, fmt.Errorf("unsupported scheme %q", u.Scheme)
+	}
+	if u.Port() == "" {
+		c.addr = net.JoinHostPort(u.Hostname(), "6379")
+	}
+	if u.User != nil {
+		c.password, _ = u.User.Password()
+	}
+	if db := strings.Trim(u.Path, "/"); db != "" {
+		if c.db, err = strconv.Atoi(db); err != nil {
+			return nil, fmt.Errorf("invalid database %q", db)
+		}
+	}
+	return c, nil
+}
+
+// An Error is an error reply from the server.
+type Error string
+
+func (e Error) Error() string {
+	return "redis: " + string(e)
+}
+
+// Get returns the value of key, or nil if it doesn't exist.
+func (c *Client) Get(ctx context.Context, key string) ([]byte, error) {
+	reply, err := c.do(ctx, "GET", key)
+	if err != nil {
+		return nil, err
+	}
+	switch reply := reply.(type) {
+	case nil:
+		return nil, nil
+	case []byte:
+		return reply, nil
+	default:
+		return nil, fmt.Errorf("redis: unexpected reply %T to GET", reply)
+	}
+}
+
+// Keys returns the keys starting with prefix, using SCAN so that the server
+// isn't blocked.
+func (c *Client) Keys(ctx context.Context, prefix string) ([]string, error) {
+	var keys []string
+	cursor := "0"
+	for {
+		reply, err := c.do(ctx, "SCAN", cursor, "MATCH", escapeGlob(prefix)+"*", "COUNT", "1000")
+		if err != nil {
+			return nil, err
+		}
+		page, ok := reply.([]interface{})
+		if !ok || len(page) != 2 {
+			return nil, errors.New("redis: unexpected reply to SCAN")
+		}
+		next, _ := page[0].([]byte)
+		batch, _ := page[1].([]interface{})
+		for _, key := range batch {
+			if key, ok := key.([]byte); ok {
+				keys = append(keys, string(key))
+			}
+		}
+		if cursor = string(next); cursor == "0" || cursor == "" {
+			return keys, nil
+		}
+	}
+}
+
+// Close closes the connection to the server.
+func (c *Client) Close() error {
+	c.mtx.Lock()
+	defer c.mtx.Unlock()
+	if c.conn == nil {
+		return nil
+	}
+	err := c.conn.Close()
+	c.conn = nil
+	return err
+}
+
+// escapeGlob escapes the characters of s which are special in SCAN patterns.
+func escapeGlob(s string) string {
+	var b strings.Builder
+	for _, r := range s {
+		if strings.ContainsRune(`*?[]^\`, r) {
+			b.WriteByte('\\')
+		}
+		b.WriteRune(r)
+	}
+	return b.String()
+}
+
+// do sends a command and reads its reply, which is nil, a []byte, an int64 or
+// an []interface{} of those.
+func (c *Client) do(ctx context.Context, args ...string) (interface{}, error) {
+	c.mtx.Lock()
+	defer c.mtx.Unlock()
+	if c.conn == nil {
+		if err := c.dial(ctx); err != nil {
+			return nil, err
+		}
+	}
+	reply, err := c.roundTrip(ctx, args)
+	if err != nil {
+		if _, ok := err.(Error); !ok {
+			// The connection is in an unknown state.
+			c.conn.Close()
+			c.conn = nil
+		}
+		return nil, err
+	}
+	return reply, nil
+}
+
+// dial connects to the server, authenticates and selects the database.
+// c.mtx must be held.
+func (c *Client) dial(ctx context.Context) error {
+	if _, ok := ctx.Deadline(); !ok {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, dialTimeout)
+		defer cancel()
+	}
+	var d net.Dialer
+	conn, err := d.DialContext(ctx, "tcp", c.addr)
+	if err != nil {
+		return err
+	}
+	if c.tls != nil {
+		tconn := tls.Client(conn, c.tls)
+		deadline, _ := ctx.Deadline()
+		tconn.SetDeadline(deadline)
+		if err := tconn.Handshake(); err != nil {
+			conn.Close()
+			return err
+		}
+		conn = tconn
+	}
+	c.conn, c.r = conn, bufio.NewReader(conn)
+	var setup [][]string
+	if c.password != "" {
+		setup = append(setup, []string{"AUTH", c.password})
+	}
+	if c.db != 0 {
+		setup = append(setup, []string{"SELECT", strconv.Itoa(c.db)})
+	}
+	for _, args := range setup {
+		if _, err := c.roundTrip(ctx, args); err != nil {
+			c.conn.Close()
+			c.conn = nil
+			return err
+		}
+	}
+	return nil
+}
+
+// roundTrip writes a command to c.conn and reads its reply. c.mtx must be
+// held.
+func (c *Client) roundTrip(ctx context.Context, args []string) (interface{}, error) {
+	deadline, _ := ctx.Deadline()
+	c.conn.SetDeadline(deadline)
+	var b strings.Builder
+	fmt.Fprintf(&b, "*%d\r\n", len(args))
+	for _, arg := range args {
+		fmt.Fprintf(&b, "$%d\r\n%s\r\n", len(arg), arg)
+	}
+	if _, err := io.WriteString(c.conn, b.String()); err != nil {
+		return nil, err
+	}
+	return readReply(c.r)
+}
+
+// readReply reads a RESP reply from r.
+func readReply(r *bufio.Reader) (interface{}, error) {
+	line, err := r.ReadString('\n')
+	if err != nil {
+		return nil, err
+	}
+	if len(line) < 3 || !strings.HasSuffix(line, "\r\n") {
+		return nil, errors.New("redis: malformed reply")
+	}
+	kind, line := line[0], line[1:len(line)-2]
+	switch kind {
+	case '+':
+		return []byte(line), nil
+	case '-':
+		return nil, Error(line)
+	case ':':
+		return strconv.ParseInt(line, 10, 64)
+	case '$':
+		n, err := strconv.Atoi(line)
+		if err != nil {
+			return nil, errors.New("redis: malformed bulk string length")
+		}
+		if n < 0 {
+			return nil, nil
+		}
+		buf := make([]byte, n+2)
+		if _, err := io.ReadFull(r, buf); err != nil {
+			return nil, err
+		}
+		return buf[:n], nil
+	case '*':
+		n, err := strconv.Atoi(line)
+		if err != nil {
+			return nil, errors.New("redis: malformed array length")
+		}
+		if n < 0 {
+			return nil, nil
+		}
+		array := make([]interface{}, n)
+		for i := range array {
+			if array[i], err = readReply(r); err != nil {
+				if e, ok := err.(Error); ok {
+					// Keep reading, so the connection stays usable.
+					array[i] = e
+					continue
+				}
+				return nil, err
+			}
+		}
+		return array, nil
+	default:
+		return nil, fmt.Errorf("redis: unknown reply type %q", kind)
+	}
+}
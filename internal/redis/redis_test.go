@@ -0,0 +1,125 @@
+package redis
+
+import (
+	"bufio"
+	"context"
+	"fmt"
+	"net"
+	"sort"
+	"strings"
+	"testing"
+)
+
+// fakeServer serves GET and SCAN from data, and requires AUTH with password.
+func fakeServer(t *testing.T, password string, data map[string]string) string {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { l.Close() })
+	go func() {
+		for {
+			conn, err := l.Accept()
+			if err != nil {
+				return
+			}
+			go serve(conn, password, data)
+		}
+	}()
+	return l.Addr().String()
+}
+
+func serve(conn net.Conn, password string, data map[string]string) {
+	defer conn.Close()
+	r := bufio.NewReader(conn)
+	authed := password == ""
+	for {
+		reply, err := readReply(r)
+		if err != nil {
+			return
+		}
+		var args []string
+		for _, arg := range reply.([]interface{}) {
+			args = append(args, string(arg.([]byte)))
+		}
+		switch {
+		case args[0] == "AUTH" && args[1] == password:
+			authed = true
+			fmt.Fprint(conn, "+OK\r\n")
+		case !authed:
+			fmt.Fprint(conn, "-NOAUTH Authentication required.\r\n")
+		case args[0] == "SELECT":
+			fmt.Fprint(conn, "+OK\r\n")
+		case args[0] == "GET":
+			if v, ok := data[args[1]]; ok {
+				fmt.Fprintf(conn, "$%d\r\n%s\r\n", len(v), v)
+			} else {
+				fmt.Fprint(conn, "$-1\r\n")
+			}
+		case args[0] == "SCAN":
+			// Return one key per page to exercise the cursor.
+			var keys []string
+			for k := range data {
+				if strings.HasPrefix(k, strings.TrimSuffix(args[3], "*")) {
+					keys = append(keys, k)
+				}
+			}
+			sort.Strings(keys)
+			var cursor int
+			fmt.Sscan(args[1], &cursor)
+			next := cursor + 1
+			if next >= len(keys) {
+				next = 0
+			}
+			if cursor >= len(keys) {
+				fmt.Fprintf(conn, "*2\r\n$1\r\n0\r\n*0\r\n")
+				continue
+			}
+			k := keys[cursor]
+			n := fmt.Sprint(next)
+			fmt.Fprintf(conn, "*2\r\n$%d\r\n%s\r\n*1\r\n$%d\r\n%s\r\n", len(n), n, len(k), k)
+		default:
+			fmt.Fprintf(conn, "-ERR unknown command '%s'\r\n", args[0])
+		}
+	}
+}
+
+func TestClient(t *testing.T) {
+	addr := fakeServer(t, "secret", map[string]string{"keyless/a": "1", "keyless/b": "2", "other": "3"})
+	c, err := New("redis://:secret@" + addr + "/2")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Close()
+	ctx := context.Background()
+
+	v, err := c.Get(ctx, "keyless/a")
+	if err != nil || string(v) != "1" {
+		t.Fatalf("got %q, %v", v, err)
+	}
+	if v, err := c.Get(ctx, "missing"); err != nil || v != nil {
+		t.Fatalf("got %q, %v for a missing key", v, err)
+	}
+	keys, err := c.Keys(ctx, "keyless/")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if strings.Join(keys, ",") != "keyless/a,keyless/b" {
+		t.Fatalf("got %v", keys)
+	}
+	// Error replies don't break the connection.
+	if _, err := c.do(ctx, "FLUSHALL"); err == nil {
+		t.Fatal("unknown command succeeded")
+	}
+	if v, err := c.Get(ctx, "keyless/b"); err != nil || string(v) != "2" {
+		t.Fatalf("got %q, %v", v, err)
+	}
+
+	c, err = New("redis://" + addr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := c.Get(ctx, "keyless/a"); err == nil {
+		t.Fatal("unauthenticated GET succeeded")
+	}
+}
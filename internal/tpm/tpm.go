@@ -0,0 +1,333 @@
+// Package tpm implements a crypto.Signer for keys held by a TPM 2.0, for
+// keyservers on machines which have no HSM.
+package tpm
+
+import (
+	"crypto"
+	"crypto/rand"
+	"crypto/rsa"
+	"encoding/asn1"
+	"encoding/pem"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"math/big"
+	"strconv"
+	"strings"
+	"sync"
+
+	"github.com/cloudflare/cfssl/log"
+	"github.com/google/go-tpm/tpm2"
+	"github.com/google/go-tpm/tpmutil"
+)
+
+// PEM block types of key blob files.
+const (
+	// PublicBlock holds the TPMT_PUBLIC area of the key.
+	PublicBlock = "TPM2 PUBLIC"
+	// PrivateBlock holds the TPM2B_PRIVATE area of a key created under the
+	// parent, or the duplicate of a key to import with the seed.
+	PrivateBlock = "TPM2 PRIVATE"
+	// SeedBlock, if present, holds the seed a duplicated key was encrypted
+	// with, itself encrypted to the parent, so that the key is imported
+	// with TPM2_Import before it is loaded.
+	SeedBlock = "TPM2 SEED"
+)
+
+// Session types, selected by the session attribute of a URI.
+const (
+	// SessionPassword authorizes the use of the key with its password in
+	// the clear.
+	SessionPassword = "password"
+	// SessionPolicy authorizes each use of the key with a policy session
+	// satisfying TPM2_PolicyPassword, for keys whose auth policy requires it.
+	SessionPolicy = "policy"
+)
+
+// srkTemplate is the template of the TCG's RSA 2048 storage root key, under
+// which key blobs are loaded unless a persistent parent is given.
+var srkTemplate = tpm2.Public{
+	Type:       tpm2.AlgRSA,
+	NameAlg:    tpm2.AlgSHA256,
+	Attributes: tpm2.FlagStorageDefault | tpm2.FlagNoDA,
+	RSAParameters: &tpm2.RSAParams{
+		Symmetric:  &tpm2.SymScheme{Alg: tpm2.AlgAES, KeyBits: 128, Mode: tpm2.AlgCFB},
+		KeyBits:    2048,
+		ModulusRaw: make([]byte, 256),
+	},
+}
+
+// hashAlgs maps the hashes which may be signed to their TPM algorithm IDs.
+var hashAlgs = map[crypto.Hash]tpm2.Algorithm{
+	crypto.SHA1:   tpm2.AlgSHA1,
+	crypto.SHA256: tpm2.AlgSHA256,
+	crypto.SHA384: tpm2.AlgSHA384,
+	crypto.SHA512: tpm2.AlgSHA512,
+}
+
+// config is a parsed TPM URI.
+type config struct {
+	// path is the TPM device, or "" for /dev/tpmrm0 or /dev/tpm0.
+	path string
+	// Exactly one of handle and blob is set.
+	handle tpmutil.Handle
+	blob   string
+	// parent is the persistent handle blob is loaded under, or 0 for the
+	// SRK.
+	parent   tpmutil.Handle
+	password string
+	session  string
+}
+
+// IsTPMURI reports whether uri names a TPM key.
+func IsTPMURI(uri string) bool {
+	return strings.HasPrefix(uri, "tpm:")
+}
+
+// parseURI parses a URI of the form
+//
+//	tpm:[path=/dev/tpmrm0;](handle=0x81000002|blob=/path/key.tpm[;parent=0x81000001])[;pin-value=secret|;pin-source=/path/pin][;session=policy]
+func parseURI(uri string) (*config, error) {
+	if !IsTPMURI(uri) {
+		return nil, fmt.Errorf("tpm: %s is not a TPM URI", uri)
+	}
+	cfg := &config{session: SessionPassword}
+	var pinSource string
+	for _, attr := range strings.Split(strings.TrimPrefix(uri, "tpm:"), ";") {
+		if attr == "" {
+			continue
+		}
+		i := strings.IndexByte(attr, '=')
+		if i < 0 {
+			return nil, fmt.Errorf("tpm: attribute %q has no value", attr)
+		}
+		name, value := attr[:i], attr[i+1:]
+		var err error
+		switch name {
+		case "path":
+			cfg.path = value
+		case "handle":
+			cfg.handle, err = parseHandle(value)
+		case "blob":
+			cfg.blob = value
+		case "parent":
+			cfg.parent, err = parseHandle(value)
+		case "pin-value":
+			cfg.password = value
+		case "pin-source":
+			pinSource = value
+		case "session":
+			if value != SessionPassword && value != SessionPolicy {
+				return nil, fmt.Errorf("tpm: unknown session type %q", value)
+			}
+			cfg.session = value
+		default:
+			return nil, fmt.Errorf("tpm: unknown attribute %q", name)
+		}
+		if err != nil {
+			return nil, fmt.Errorf("tpm: %s: %v", name, err)
+		}
+	}
+
+	switch {
+	case (cfg.handle == 0) == (cfg.blob == ""):
+		return nil, fmt.Errorf("tpm: exactly one of handle and blob must be set")
+	case cfg.parent != 0 && cfg.blob == "":
+		return nil, fmt.Errorf("tpm: parent is only used with blob")
+	case pinSource != "" && cfg.password != "":
+		return nil, fmt.Errorf("tpm: only one of pin-value and pin-source may be set")
+	case pinSource != "":
+		pin, err := ioutil.ReadFile(pinSource)
+		if err != nil {
+			return nil, fmt.Errorf("tpm: reading pin: %v", err)
+		}
+		cfg.password = strings.TrimRight(string(pin), "\r\n")
+	}
+	return cfg, nil
+}
+
+func parseHandle(s string) (tpmutil.Handle, error) {
+	h, err := strconv.ParseUint(s, 0, 32)
+	if err != nil {
+		return 0, err
+	}
+	return tpmutil.Handle(h), nil
+}
+
+// Signer is a crypto.Signer for a TPM 2.0 key, which is either persistent or
+// loaded from a key blob.
+type Signer struct {
+	// mtx serializes the commands sent to rw.
+	mtx    sync.Mutex
+	rw     io.ReadWriteCloser
+	handle tpmutil.Handle
+	// loaded is set if handle is a transient object loaded from a blob,
+	// which is flushed by Close.
+	loaded bool
+	pub    crypto.PublicKey
+	cfg    *config
+}
+
+// New opens the TPM and loads the key named by uri. See parseURI for the
+// format of uri.
+func New(uri string) (*Signer, error) {
+	cfg, err := parseURI(uri)
+	if err != nil {
+		return nil, err
+	}
+	rw, err := openTPM(cfg.path)
+	if err != nil {
+		return nil, fmt.Errorf("tpm: %v", err)
+	}
+	s, err := newSigner(rw, cfg)
+	if err != nil {
+		rw.Close()
+		return nil, err
+	}
+	return s, nil
+}
+
+// newSigner loads the key described by cfg from rw.
+func newSigner(rw io.ReadWriteCloser, cfg *config) (*Signer, error) {
+	s := &Signer{rw: rw, handle: cfg.handle, cfg: cfg}
+	if cfg.blob != "" {
+		if err := s.load(); err != nil {
+			return nil, err
+		}
+	}
+
+	pub, _, _, err := tpm2.ReadPublic(rw, s.handle)
+	if err != nil {
+		s.Close()
+		return nil, fmt.Errorf("tpm: reading public key: %v", err)
+	}
+	if pub.Attributes&tpm2.FlagSign == 0 || pub.Attributes&tpm2.FlagRestricted != 0 {
+		s.Close()
+		return nil, fmt.Errorf("tpm: key is not an unrestricted signing key")
+	}
+	if s.pub, err = pub.Key(); err != nil {
+		s.Close()
+		return nil, fmt.Errorf("tpm: %v", err)
+	}
+	return s, nil
+}
+
+// load loads the key in the blob file, importing it first if it is a
+// duplicate.
+func (s *Signer) load() error {
+	in, err := ioutil.ReadFile(s.cfg.blob)
+	if err != nil {
+		return fmt.Errorf("tpm: %v", err)
+	}
+	blocks := make(map[string][]byte)
+	for {
+		var block *pem.Block
+		if block, in = pem.Decode(in); block == nil {
+			break
+		}
+		blocks[block.Type] = block.Bytes
+	}
+	public, private := blocks[PublicBlock], blocks[PrivateBlock]
+	if public == nil || private == nil {
+		return fmt.Errorf("tpm: %s needs %s and %s blocks", s.cfg.blob, PublicBlock, PrivateBlock)
+	}
+
+	parent := s.cfg.parent
+	if parent == 0 {
+		srk, _, err := tpm2.CreatePrimary(s.rw, tpm2.HandleOwner, tpm2.PCRSelection{}, "", "", srkTemplate)
+		if err != nil {
+			return fmt.Errorf("tpm: creating SRK: %v", err)
+		}
+		defer tpm2.FlushContext(s.rw, srk)
+		parent = srk
+	}
+	if seed := blocks[SeedBlock]; seed != nil {
+		auth := tpm2.AuthCommand{Session: tpm2.HandlePasswordSession, Attributes: tpm2.AttrContinueSession}
+		if private, err = tpm2.Import(s.rw, parent, auth, public, private, seed, nil, nil); err != nil {
+			return fmt.Errorf("tpm: importing %s: %v", s.cfg.blob, err)
+		}
+	}
+	if s.handle, _, err = tpm2.Load(s.rw, parent, "", public, private); err != nil {
+		return fmt.Errorf("tpm: loading %s: %v", s.cfg.blob, err)
+	}
+	s.loaded = true
+	return nil
+}
+
+// Public returns the public key.
+func (s *Signer) Public() crypto.PublicKey {
+	return s.pub
+}
+
+// Sign signs digest with the key. RSA keys sign with PKCS #1 v1.5, or with
+// PSS if opts is *rsa.PSSOptions, using the salt length of the TPM, which is
+// the hash length on conforming TPMs. ECDSA signatures are ASN.1 encoded.
+func (s *Signer) Sign(_ io.Reader, digest []byte, opts crypto.SignerOpts) ([]byte, error) {
+	hash, ok := hashAlgs[opts.HashFunc()]
+	if !ok {
+		return nil, fmt.Errorf("tpm: unsupported hash %v", opts.HashFunc())
+	}
+	scheme := &tpm2.SigScheme{Hash: hash}
+	switch s.pub.(type) {
+	case *rsa.PublicKey:
+		scheme.Alg = tpm2.AlgRSASSA
+		if _, ok := opts.(*rsa.PSSOptions); ok {
+			scheme.Alg = tpm2.AlgRSAPSS
+		}
+	default:
+		scheme.Alg = tpm2.AlgECDSA
+	}
+
+	s.mtx.Lock()
+	defer s.mtx.Unlock()
+	session := tpm2.HandlePasswordSession
+	if s.cfg.session == SessionPolicy {
+		var err error
+		if session, err = s.policySession(); err != nil {
+			return nil, err
+		}
+		defer tpm2.FlushContext(s.rw, session)
+	}
+	sig, err := tpm2.SignWithSession(s.rw, session, s.handle, s.cfg.password, digest, nil, scheme)
+	if err != nil {
+		return nil, fmt.Errorf("tpm: signing: %v", err)
+	}
+	log.Debugf("tpm: signed %d bytes with %s", len(digest), opts.HashFunc())
+
+	if sig.RSA != nil {
+		return sig.RSA.Signature, nil
+	}
+	if sig.ECC != nil {
+		return asn1.Marshal(struct{ R, S *big.Int }{sig.ECC.R, sig.ECC.S})
+	}
+	return nil, fmt.Errorf("tpm: unexpected signature algorithm %v", sig.Alg)
+}
+
+// policySession starts a policy session satisfying TPM2_PolicyPassword, so
+// that the key's password authorizes the next command.
+func (s *Signer) policySession() (tpmutil.Handle, error) {
+	nonce := make([]byte, 16)
+	if _, err := rand.Read(nonce); err != nil {
+		return 0, err
+	}
+	session, _, err := tpm2.StartAuthSession(s.rw, tpm2.HandleNull, tpm2.HandleNull, nonce, nil, tpm2.SessionPolicy, tpm2.AlgNull, tpm2.AlgSHA256)
+	if err != nil {
+		return 0, fmt.Errorf("tpm: starting policy session: %v", err)
+	}
+	if err := tpm2.PolicyPassword(s.rw, session); err != nil {
+		tpm2.FlushContext(s.rw, session)
+		return 0, fmt.Errorf("tpm: satisfying policy: %v", err)
+	}
+	return session, nil
+}
+
+// Close flushes a key loaded from a blob and closes the TPM.
+func (s *Signer) Close() error {
+	s.mtx.Lock()
+	defer s.mtx.Unlock()
+	if s.loaded {
+		tpm2.FlushContext(s.rw, s.handle)
+		s.loaded = false
+	}
+	return s.rw.Close()
+}
@@ -0,0 +1,23 @@
+// +build !windows
+
+package tpm
+
+import (
+	"io"
+	"os"
+
+	"github.com/google/go-tpm/tpm2"
+)
+
+// openTPM opens the TPM device at path, or the default device if path is "".
+func openTPM(path string) (io.ReadWriteCloser, error) {
+	if path == "" {
+		// Prefer the kernel's resource manager, which lets the TPM be shared
+		// with other processes.
+		path = "/dev/tpmrm0"
+		if _, err := os.Stat(path); err != nil {
+			path = "/dev/tpm0"
+		}
+	}
+	return tpm2.OpenTPM(path)
+}
@@ -0,0 +1,62 @@
+package tpm
+
+import (
+	"crypto"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/google/go-tpm/tpmutil"
+	"github.com/stretchr/testify/require"
+)
+
+func TestIsTPMURI(t *testing.T) {
+	require.True(t, IsTPMURI("tpm:handle=0x81000002"))
+	require.False(t, IsTPMURI("pkcs11:token=a"))
+}
+
+func TestParseURI(t *testing.T) {
+	require := require.New(t)
+	dir, err := ioutil.TempDir("", "tpm")
+	require.NoError(err)
+	defer os.RemoveAll(dir)
+	pin := filepath.Join(dir, "pin")
+	require.NoError(ioutil.WriteFile(pin, []byte("secret\n"), 0600))
+
+	cfg, err := parseURI("tpm:handle=0x81000002")
+	require.NoError(err)
+	require.Equal(&config{handle: 0x81000002, session: SessionPassword}, cfg)
+
+	cfg, err = parseURI("tpm:path=/dev/tpm0;blob=/etc/key.tpm;parent=0x81000001;pin-source=" + pin + ";session=policy")
+	require.NoError(err)
+	require.Equal(&config{
+		path:     "/dev/tpm0",
+		blob:     "/etc/key.tpm",
+		parent:   tpmutil.Handle(0x81000001),
+		password: "secret",
+		session:  SessionPolicy,
+	}, cfg)
+
+	for _, uri := range []string{
+		"pkcs11:handle=0x81000002",
+		"tpm:",
+		"tpm:handle=0x81000002;blob=/etc/key.tpm",
+		"tpm:handle=0x81000002;parent=0x81000001",
+		"tpm:handle=foo",
+		"tpm:handle",
+		"tpm:handle=0x81000002;label=foo",
+		"tpm:handle=0x81000002;session=hmac",
+		"tpm:handle=0x81000002;pin-value=a;pin-source=" + pin,
+		"tpm:handle=0x81000002;pin-source=" + filepath.Join(dir, "missing"),
+	} {
+		_, err := parseURI(uri)
+		require.Error(err, uri)
+	}
+}
+
+func TestSignUnsupportedHash(t *testing.T) {
+	s := &Signer{cfg: &config{}}
+	_, err := s.Sign(nil, make([]byte, 36), crypto.MD5SHA1)
+	require.Error(t, err)
+}
@@ -0,0 +1,17 @@
+package tpm
+
+import (
+	"errors"
+	"io"
+
+	"github.com/google/go-tpm/tpm2"
+)
+
+// openTPM opens the TPM through the TPM Base Services, which share it between
+// processes. Windows has no TPM device path, so path must be "".
+func openTPM(path string) (io.ReadWriteCloser, error) {
+	if path != "" {
+		return nil, errors.New("the path attribute is not supported on Windows")
+	}
+	return tpm2.OpenTPM()
+}
@@ -0,0 +1,176 @@
+package noise
+
+import (
+	"encoding/binary"
+	"fmt"
+	"io"
+	"net"
+	"sync"
+)
+
+const (
+	// maxMessageSize is the maximum size of a Noise message.
+	maxMessageSize = 65535
+	// maxPlaintextSize is the maximum size of the plaintext of a message.
+	maxPlaintextSize = maxMessageSize - tagSize
+)
+
+// A Conn is a connection secured by the Noise protocol. Messages are
+// preceded by their 2-byte big-endian length on the underlying connection,
+// as are the handshake messages.
+type Conn struct {
+	net.Conn
+	config   *Config
+	isClient bool
+
+	handshakeMtx sync.Mutex
+	handshakeErr error
+	handshaked   bool
+	remoteKey    PublicKey
+
+	readMtx sync.Mutex
+	in      *cipherState
+	// pending is the plaintext of the last message not read yet.
+	pending []byte
+	rbuf    []byte
+
+	writeMtx sync.Mutex
+	out      *cipherState
+	wbuf     []byte
+}
+
+// Client returns a new Noise client side connection using c as the
+// underlying transport. config.StaticKey and config.ServerKey must be set.
+func Client(c net.Conn, config *Config) *Conn {
+	return &Conn{Conn: c, config: config, isClient: true}
+}
+
+// Server returns a new Noise server side connection using c as the
+// underlying transport. config.StaticKey and config.ClientKeys must be set.
+func Server(c net.Conn, config *Config) *Conn {
+	return &Conn{Conn: c, config: config}
+}
+
+// Handshake runs the handshake if it has not yet been run. Most uses of this
+// package need not call Handshake explicitly: the first Read or Write will
+// call it automatically.
+func (c *Conn) Handshake() error {
+	c.handshakeMtx.Lock()
+	defer c.handshakeMtx.Unlock()
+	if c.handshaked {
+		return c.handshakeErr
+	}
+	c.handshaked = true
+
+	e, err := GenerateKeyPair(nil)
+	if err != nil {
+		c.handshakeErr = err
+		return err
+	}
+	if c.isClient {
+		c.out, c.in, err = initiatorHandshake(c.config.StaticKey, c.config.ServerKey, e, c.writeMessage, c.readHandshakeMessage)
+		c.remoteKey = c.config.ServerKey
+	} else {
+		c.remoteKey, c.out, c.in, err = responderHandshake(c.config.StaticKey, e, c.config.allowed, c.writeMessage, c.readHandshakeMessage)
+	}
+	if err != nil {
+		c.handshakeErr = fmt.Errorf("noise: handshake failed: %w", err)
+	}
+	return c.handshakeErr
+}
+
+// RemoteKey returns the static key of the peer, once the handshake has
+// completed.
+func (c *Conn) RemoteKey() PublicKey {
+	c.handshakeMtx.Lock()
+	defer c.handshakeMtx.Unlock()
+	return c.remoteKey
+}
+
+// writeMessage writes a message, preceded by its length.
+func (c *Conn) writeMessage(msg []byte) error {
+	frame := make([]byte, 2, 2+len(msg))
+	binary.BigEndian.PutUint16(frame, uint16(len(msg)))
+	_, err := c.Conn.Write(append(frame, msg...))
+	return err
+}
+
+// readMessage reads a message into buf, which it grows as needed.
+func (c *Conn) readMessage(buf []byte) ([]byte, error) {
+	var hdr [2]byte
+	if _, err := io.ReadFull(c.Conn, hdr[:]); err != nil {
+		return nil, err
+	}
+	n := int(binary.BigEndian.Uint16(hdr[:]))
+	if cap(buf) < n {
+		buf = make([]byte, n)
+	}
+	buf = buf[:n]
+	if _, err := io.ReadFull(c.Conn, buf); err != nil {
+		if err == io.EOF {
+			err = io.ErrUnexpectedEOF
+		}
+		return nil, err
+	}
+	return buf, nil
+}
+
+// readHandshakeMessage reads a handshake message of size bytes.
+func (c *Conn) readHandshakeMessage(size int) ([]byte, error) {
+	msg, err := c.readMessage(nil)
+	if err != nil {
+		return nil, err
+	}
+	if len(msg) != size {
+		return nil, fmt.Errorf("handshake message has %d bytes instead of %d", len(msg), size)
+	}
+	return msg, nil
+}
+
+// Read reads data from the connection, after running the handshake if needed.
+func (c *Conn) Read(b []byte) (int, error) {
+	if err := c.Handshake(); err != nil {
+		return 0, err
+	}
+	c.readMtx.Lock()
+	defer c.readMtx.Unlock()
+	for len(c.pending) == 0 {
+		msg, err := c.readMessage(c.rbuf)
+		if err != nil {
+			return 0, err
+		}
+		c.rbuf = msg
+		if c.pending, err = c.in.decrypt(msg[:0], nil, msg); err != nil {
+			return 0, err
+		}
+	}
+	n := copy(b, c.pending)
+	c.pending = c.pending[n:]
+	return n, nil
+}
+
+// Write writes data to the connection, after running the handshake if
+// needed. Data larger than a Noise message is split across several.
+func (c *Conn) Write(b []byte) (int, error) {
+	if err := c.Handshake(); err != nil {
+		return 0, err
+	}
+	c.writeMtx.Lock()
+	defer c.writeMtx.Unlock()
+	var n int
+	for len(b) > 0 {
+		chunk := b
+		if len(chunk) > maxPlaintextSize {
+			chunk = chunk[:maxPlaintextSize]
+		}
+		c.wbuf = append(c.wbuf[:0], 0, 0)
+		c.wbuf = c.out.encrypt(c.wbuf, nil, chunk)
+		binary.BigEndian.PutUint16(c.wbuf, uint16(len(c.wbuf)-2))
+		if _, err := c.Conn.Write(c.wbuf); err != nil {
+			return n, err
+		}
+		n += len(chunk)
+		b = b[len(chunk):]
+	}
+	return n, nil
+}
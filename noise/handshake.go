@@ -0,0 +1,229 @@
+package noise
+
+import (
+	"crypto/cipher"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/binary"
+	"errors"
+
+	"golang.org/x/crypto/chacha20poly1305"
+	"golang.org/x/crypto/curve25519"
+)
+
+// protocolName is the full name of the Noise protocol, which is exactly
+// sha256.Size bytes long and is thus used as the initial hash as is.
+const protocolName = "Noise_IK_25519_ChaChaPoly_SHA256"
+
+// tagSize is the size of the authentication tags of ChaCha20-Poly1305.
+const tagSize = 16
+
+// prologue binds the handshake to the keyless protocol.
+var prologue = []byte("gokeyless")
+
+var errDecrypt = errors.New("noise: message authentication failed")
+
+// A cipherState encrypts the messages of one direction of a connection.
+type cipherState struct {
+	aead  cipher.AEAD
+	nonce uint64
+}
+
+func newCipherState(k []byte) *cipherState {
+	// The key is always chacha20poly1305.KeySize long.
+	aead, _ := chacha20poly1305.New(k)
+	return &cipherState{aead: aead}
+}
+
+func (cs *cipherState) nextNonce() []byte {
+	var n [chacha20poly1305.NonceSize]byte
+	binary.LittleEndian.PutUint64(n[4:], cs.nonce)
+	cs.nonce++
+	return n[:]
+}
+
+func (cs *cipherState) encrypt(out, ad, plaintext []byte) []byte {
+	return cs.aead.Seal(out, cs.nextNonce(), plaintext, ad)
+}
+
+func (cs *cipherState) decrypt(out, ad, ciphertext []byte) ([]byte, error) {
+	plaintext, err := cs.aead.Open(out, cs.nextNonce(), ciphertext, ad)
+	if err != nil {
+		return nil, errDecrypt
+	}
+	return plaintext, nil
+}
+
+// A symmetricState holds the chaining key and handshake hash of a handshake.
+type symmetricState struct {
+	ck, h [sha256.Size]byte
+	cs    *cipherState
+}
+
+func newSymmetricState() *symmetricState {
+	ss := new(symmetricState)
+	copy(ss.h[:], protocolName)
+	ss.ck = ss.h
+	ss.mixHash(prologue)
+	return ss
+}
+
+func (ss *symmetricState) mixHash(data []byte) {
+	h := sha256.New()
+	h.Write(ss.h[:])
+	h.Write(data)
+	h.Sum(ss.h[:0])
+}
+
+func (ss *symmetricState) mixKey(ikm []byte) {
+	var k []byte
+	ss.ck, k = hkdf(ss.ck[:], ikm)
+	ss.cs = newCipherState(k)
+}
+
+func (ss *symmetricState) encryptAndHash(out, plaintext []byte) []byte {
+	n := len(out)
+	out = ss.cs.encrypt(out, ss.h[:], plaintext)
+	ss.mixHash(out[n:])
+	return out
+}
+
+func (ss *symmetricState) decryptAndHash(ciphertext []byte) ([]byte, error) {
+	plaintext, err := ss.cs.decrypt(nil, ss.h[:], ciphertext)
+	if err != nil {
+		return nil, err
+	}
+	ss.mixHash(ciphertext)
+	return plaintext, nil
+}
+
+// split returns the cipher states of the messages sent by the initiator and
+// by the responder.
+func (ss *symmetricState) split() (initiator, responder *cipherState) {
+	k1, k2 := hkdf(ss.ck[:], nil)
+	return newCipherState(k1[:]), newCipherState(k2)
+}
+
+// hkdf derives two keys from ck and ikm, as defined by the Noise
+// specification.
+func hkdf(ck, ikm []byte) (k1 [sha256.Size]byte, k2 []byte) {
+	mac := hmac.New(sha256.New, ck)
+	mac.Write(ikm)
+	prk := mac.Sum(nil)
+
+	mac = hmac.New(sha256.New, prk)
+	mac.Write([]byte{1})
+	mac.Sum(k1[:0])
+
+	mac.Reset()
+	mac.Write(k1[:])
+	mac.Write([]byte{2})
+	return k1, mac.Sum(nil)[:chacha20poly1305.KeySize]
+}
+
+func dh(priv *[KeySize]byte, pub []byte) ([]byte, error) {
+	return curve25519.X25519(priv[:], pub)
+}
+
+// The handshake messages of Noise_IK with empty payloads:
+//
+//	-> e, es, s, ss
+//	<- e, ee, se
+const (
+	initiatorMessageSize = KeySize + KeySize + tagSize + tagSize
+	responderMessageSize = KeySize + tagSize
+)
+
+// initiatorHandshake performs the handshake of a client, which knows the
+// responder's static key rs. send and recv exchange handshake messages.
+func initiatorHandshake(s KeyPair, rs PublicKey, e KeyPair, send func([]byte) error, recv func(int) ([]byte, error)) (out, in *cipherState, err error) {
+	ss := newSymmetricState()
+	ss.mixHash(rs[:])
+
+	msg := append(make([]byte, 0, initiatorMessageSize), e.Public[:]...)
+	ss.mixHash(e.Public[:])
+	k, err := dh(&e.Private, rs[:])
+	if err != nil {
+		return nil, nil, err
+	}
+	ss.mixKey(k)
+	msg = ss.encryptAndHash(msg, s.Public[:])
+	if k, err = dh(&s.Private, rs[:]); err != nil {
+		return nil, nil, err
+	}
+	ss.mixKey(k)
+	msg = ss.encryptAndHash(msg, nil)
+	if err := send(msg); err != nil {
+		return nil, nil, err
+	}
+
+	if msg, err = recv(responderMessageSize); err != nil {
+		return nil, nil, err
+	}
+	re := msg[:KeySize]
+	ss.mixHash(re)
+	if k, err = dh(&e.Private, re); err != nil {
+		return nil, nil, err
+	}
+	ss.mixKey(k)
+	if k, err = dh(&s.Private, re); err != nil {
+		return nil, nil, err
+	}
+	ss.mixKey(k)
+	if _, err := ss.decryptAndHash(msg[KeySize:]); err != nil {
+		return nil, nil, err
+	}
+	out, in = ss.split()
+	return out, in, nil
+}
+
+// responderHandshake performs the handshake of a server, and returns the
+// initiator's static key, once allowed accepts it.
+func responderHandshake(s KeyPair, e KeyPair, allowed func(PublicKey) bool, send func([]byte) error, recv func(int) ([]byte, error)) (rs PublicKey, out, in *cipherState, err error) {
+	ss := newSymmetricState()
+	ss.mixHash(s.Public[:])
+
+	msg, err := recv(initiatorMessageSize)
+	if err != nil {
+		return rs, nil, nil, err
+	}
+	re := msg[:KeySize]
+	ss.mixHash(re)
+	k, err := dh(&s.Private, re)
+	if err != nil {
+		return rs, nil, nil, err
+	}
+	ss.mixKey(k)
+	static, err := ss.decryptAndHash(msg[KeySize : 2*KeySize+tagSize])
+	if err != nil {
+		return rs, nil, nil, err
+	}
+	copy(rs[:], static)
+	if k, err = dh(&s.Private, rs[:]); err != nil {
+		return rs, nil, nil, err
+	}
+	ss.mixKey(k)
+	if _, err := ss.decryptAndHash(msg[2*KeySize+tagSize:]); err != nil {
+		return rs, nil, nil, err
+	}
+	if !allowed(rs) {
+		return rs, nil, nil, ErrUnknownKey
+	}
+
+	msg = append(make([]byte, 0, responderMessageSize), e.Public[:]...)
+	ss.mixHash(e.Public[:])
+	if k, err = dh(&e.Private, re); err != nil {
+		return rs, nil, nil, err
+	}
+	ss.mixKey(k)
+	if k, err = dh(&e.Private, rs[:]); err != nil {
+		return rs, nil, nil, err
+	}
+	ss.mixKey(k)
+	msg = ss.encryptAndHash(msg, nil)
+	if err := send(msg); err != nil {
+		return rs, nil, nil, err
+	}
+	in, out = ss.split()
+	return rs, out, in, nil
+}
@@ -0,0 +1,122 @@
+// Package noise implements an authenticated and encrypted transport for the
+// keyless protocol, based on the Noise_IK_25519_ChaChaPoly_SHA256 handshake
+// of the Noise Protocol Framework (https://noiseprotocol.org/noise.html).
+//
+// Clients and servers are authenticated by static Curve25519 keys which are
+// distributed out of band, instead of by certificates issued by a CA: a client
+// must know the key of the server it dials, and a server only accepts the
+// clients whose keys it has been configured with. Its API follows that of
+// crypto/tls: Client and Server wrap a net.Conn, and the handshake happens on
+// the first read or write, or on an explicit call to Handshake.
+package noise
+
+import (
+	"crypto/rand"
+	"crypto/subtle"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"io"
+
+	"golang.org/x/crypto/curve25519"
+)
+
+// KeySize is the size of Curve25519 keys.
+const KeySize = 32
+
+// A PublicKey is a static Curve25519 public key.
+type PublicKey [KeySize]byte
+
+// String returns the base64 encoding of k, as parsed by ParsePublicKey.
+func (k PublicKey) String() string {
+	return base64.StdEncoding.EncodeToString(k[:])
+}
+
+// ParsePublicKey parses a base64-encoded public key.
+func ParsePublicKey(s string) (PublicKey, error) {
+	var k PublicKey
+	b, err := base64.StdEncoding.DecodeString(s)
+	if err != nil {
+		return k, fmt.Errorf("noise: invalid public key: %v", err)
+	}
+	if len(b) != KeySize {
+		return k, fmt.Errorf("noise: public key has %d bytes instead of %d", len(b), KeySize)
+	}
+	copy(k[:], b)
+	return k, nil
+}
+
+// A KeyPair is a static Curve25519 key pair.
+type KeyPair struct {
+	Private [KeySize]byte
+	Public  PublicKey
+}
+
+// GenerateKeyPair generates a key pair with randomness from rand, or from
+// crypto/rand if rand is nil.
+func GenerateKeyPair(r io.Reader) (KeyPair, error) {
+	if r == nil {
+		r = rand.Reader
+	}
+	var priv [KeySize]byte
+	if _, err := io.ReadFull(r, priv[:]); err != nil {
+		return KeyPair{}, err
+	}
+	return NewKeyPair(priv[:])
+}
+
+// NewKeyPair returns the key pair of the private key priv.
+func NewKeyPair(priv []byte) (KeyPair, error) {
+	var kp KeyPair
+	if len(priv) != KeySize {
+		return kp, fmt.Errorf("noise: private key has %d bytes instead of %d", len(priv), KeySize)
+	}
+	pub, err := curve25519.X25519(priv, curve25519.Basepoint)
+	if err != nil {
+		return kp, err
+	}
+	copy(kp.Private[:], priv)
+	copy(kp.Public[:], pub)
+	return kp, nil
+}
+
+// ParseKeyPair parses a base64-encoded private key, such as the contents of a
+// key file written by gokeyless, and returns its key pair.
+func ParseKeyPair(s string) (KeyPair, error) {
+	b, err := base64.StdEncoding.DecodeString(s)
+	if err != nil {
+		return KeyPair{}, fmt.Errorf("noise: invalid private key: %v", err)
+	}
+	return NewKeyPair(b)
+}
+
+// String returns the base64 encoding of the private key, as parsed by
+// ParseKeyPair.
+func (kp KeyPair) String() string {
+	return base64.StdEncoding.EncodeToString(kp.Private[:])
+}
+
+// A Config configures a Noise client or server.
+type Config struct {
+	// StaticKey is the key pair which authenticates the local peer.
+	StaticKey KeyPair
+	// ServerKey is the public key of the server, which clients must know in
+	// advance.
+	ServerKey PublicKey
+	// ClientKeys are the public keys of the clients a server accepts. The
+	// handshakes of other clients fail with ErrUnknownKey.
+	ClientKeys []PublicKey
+}
+
+// ErrUnknownKey is returned by the handshakes of servers with clients whose
+// key isn't one of Config.ClientKeys.
+var ErrUnknownKey = errors.New("noise: unknown client key")
+
+// allowed reports whether key is one of c.ClientKeys.
+func (c *Config) allowed(key PublicKey) bool {
+	ok := 0
+	for _, k := range c.ClientKeys {
+		ok |= subtle.ConstantTimeCompare(k[:], key[:])
+	}
+	return ok == 1
+}
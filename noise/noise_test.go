@@ -0,0 +1,103 @@
+package noise
+
+import (
+	"bytes"
+	"errors"
+	"io"
+	"net"
+	"testing"
+)
+
+func keyPair(t *testing.T) KeyPair {
+	kp, err := GenerateKeyPair(nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return kp
+}
+
+// pipe returns the ends of a connection between a client and a server with
+// config, and the server's handshake error.
+func pipe(client, server *Config) (*Conn, *Conn, <-chan error) {
+	c, s := net.Pipe()
+	cc, sc := Client(c, client), Server(s, server)
+	errs := make(chan error, 1)
+	go func() { errs <- sc.Handshake() }()
+	return cc, sc, errs
+}
+
+func TestHandshake(t *testing.T) {
+	ck, sk := keyPair(t), keyPair(t)
+	cc, sc, errs := pipe(&Config{StaticKey: ck, ServerKey: sk.Public}, &Config{StaticKey: sk, ClientKeys: []PublicKey{keyPair(t).Public, ck.Public}})
+	defer cc.Close()
+	defer sc.Close()
+	if err := cc.Handshake(); err != nil {
+		t.Fatal(err)
+	}
+	if err := <-errs; err != nil {
+		t.Fatal(err)
+	}
+	if sc.RemoteKey() != ck.Public || cc.RemoteKey() != sk.Public {
+		t.Fatal("wrong remote keys")
+	}
+
+	// Writes larger than a message are split.
+	msg := bytes.Repeat([]byte("keyless"), 20000)
+	go func() {
+		cc.Write(msg)
+		sc.Write([]byte("pong"))
+	}()
+	got := make([]byte, len(msg))
+	if _, err := io.ReadFull(sc, got); err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(got, msg) {
+		t.Fatal("message corrupted")
+	}
+	got = make([]byte, 4)
+	if _, err := io.ReadFull(cc, got); err != nil || string(got) != "pong" {
+		t.Fatalf("got %q, %v", got, err)
+	}
+}
+
+func TestHandshakeUnknownClient(t *testing.T) {
+	sk := keyPair(t)
+	cc, sc, errs := pipe(&Config{StaticKey: keyPair(t), ServerKey: sk.Public}, &Config{StaticKey: sk, ClientKeys: []PublicKey{keyPair(t).Public}})
+	defer cc.Close()
+	go func() {
+		cc.Handshake()
+	}()
+	if err := <-errs; !errors.Is(err, ErrUnknownKey) {
+		t.Fatalf("expected ErrUnknownKey, got %v", err)
+	}
+	sc.Close()
+}
+
+func TestHandshakeWrongServerKey(t *testing.T) {
+	ck := keyPair(t)
+	cc, sc, errs := pipe(&Config{StaticKey: ck, ServerKey: keyPair(t).Public}, &Config{StaticKey: keyPair(t), ClientKeys: []PublicKey{ck.Public}})
+	defer cc.Close()
+	go func() {
+		cc.Handshake()
+	}()
+	// The server can't decrypt the client's static key.
+	if err := <-errs; err == nil {
+		t.Fatal("handshake with the wrong server key succeeded")
+	}
+	sc.Close()
+}
+
+func TestParseKeys(t *testing.T) {
+	kp := keyPair(t)
+	parsed, err := ParseKeyPair(kp.String())
+	if err != nil || parsed != kp {
+		t.Fatalf("ParseKeyPair: %v", err)
+	}
+	pub, err := ParsePublicKey(kp.Public.String())
+	if err != nil || pub != kp.Public {
+		t.Fatalf("ParsePublicKey: %v", err)
+	}
+	if _, err := ParsePublicKey("c2hvcnQ="); err == nil {
+		t.Fatal("parsed a short public key")
+	}
+}
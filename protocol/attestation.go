@@ -0,0 +1,167 @@
+package protocol
+
+import (
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"errors"
+	"fmt"
+
+	"golang.org/x/crypto/ed25519"
+)
+
+// AttestationItem marks the type of an item in an OpAttest response.
+type AttestationItem byte
+
+const (
+	// AttestationNonce is the nonce sent by the client as the OpAttest payload,
+	// which makes each attestation fresh.
+	AttestationNonce AttestationItem = 0x01
+	// AttestationCertHash is the SHA-256 hash of the DER-encoded certificate
+	// the server authenticates its TLS connections with.
+	AttestationCertHash AttestationItem = 0x02
+	// AttestationSKIs lists the SKIs of the keys held by the server.
+	AttestationSKIs AttestationItem = 0x03
+	// AttestationBuildHash identifies the server build, e.g. as the hash of
+	// its binary. Its format is up to the operator.
+	AttestationBuildHash AttestationItem = 0x04
+	// AttestationSignature is the signature of the items preceding it. It must
+	// be the last item.
+	AttestationSignature AttestationItem = 0x05
+)
+
+// An Attestation is a statement about a keyserver, signed with an attestation
+// key that clients trust independently of the keyserver's TLS certificate.
+// Clients request one with OpAttest to check that a server is running an
+// expected build with the expected keys before sending it any requests.
+type Attestation struct {
+	Nonce     []byte
+	CertHash  [sha256.Size]byte
+	SKIs      []SKI
+	BuildHash []byte
+	Signature []byte
+
+	// signed is the encoding of the items covered by Signature, if a was
+	// unmarshaled.
+	signed []byte
+}
+
+// ErrAttestation is returned by Attestation.Verify if the signature is invalid.
+var ErrAttestation = errors.New("invalid attestation signature")
+
+// statement returns the encoding of the attested items, which is what is
+// signed.
+func (a *Attestation) statement() []byte {
+	if a.signed != nil {
+		return a.signed
+	}
+	item := func(b []byte, i AttestationItem, data []byte) []byte {
+		return append(b, tlvBytes(Tag(i), data)...)
+	}
+	skis := make([]byte, 0, len(a.SKIs)*len(SKI{}))
+	for _, ski := range a.SKIs {
+		skis = append(skis, ski[:]...)
+	}
+
+	var b []byte
+	b = item(b, AttestationNonce, a.Nonce)
+	b = item(b, AttestationCertHash, a.CertHash[:])
+	b = item(b, AttestationSKIs, skis)
+	b = item(b, AttestationBuildHash, a.BuildHash)
+	return b
+}
+
+// Sign sets a.Signature to the signature of a by signer, which must not have
+// been unmarshaled. RSA keys sign with PKCS #1 v1.5 and ECDSA keys with ASN.1
+// signatures, both over the SHA-256 hash of the statement; Ed25519 keys sign
+// the statement itself.
+func (a *Attestation) Sign(signer crypto.Signer) (err error) {
+	a.Signature, err = signStatement(signer, a.statement())
+	return err
+}
+
+// Verify checks that a was signed by the private key of pub.
+func (a *Attestation) Verify(pub crypto.PublicKey) error {
+	ok, err := verifyStatement(pub, a.statement(), a.Signature)
+	if err != nil {
+		return err
+	}
+	if !ok {
+		return ErrAttestation
+	}
+	return nil
+}
+
+// signStatement signs msg as described for Attestation.Sign.
+func signStatement(signer crypto.Signer, msg []byte) ([]byte, error) {
+	if _, ok := signer.Public().(ed25519.PublicKey); ok {
+		return signer.Sign(rand.Reader, msg, crypto.Hash(0))
+	}
+	digest := sha256.Sum256(msg)
+	return signer.Sign(rand.Reader, digest[:], crypto.SHA256)
+}
+
+// verifyStatement reports whether sig is a signature of msg by the private
+// key of pub, made by signStatement.
+func verifyStatement(pub crypto.PublicKey, msg, sig []byte) (bool, error) {
+	digest := sha256.Sum256(msg)
+	switch pub := pub.(type) {
+	case *rsa.PublicKey:
+		return rsa.VerifyPKCS1v15(pub, crypto.SHA256, digest[:], sig) == nil, nil
+	case *ecdsa.PublicKey:
+		return ecdsa.VerifyASN1(pub, digest[:], sig), nil
+	case ed25519.PublicKey:
+		return ed25519.Verify(pub, msg, sig), nil
+	default:
+		return false, fmt.Errorf("unsupported attestation key type %T", pub)
+	}
+}
+
+// MarshalBinary encodes a as the payload of an OpAttest response.
+func (a *Attestation) MarshalBinary() ([]byte, error) {
+	return append(a.statement(), tlvBytes(Tag(AttestationSignature), a.Signature)...), nil
+}
+
+// UnmarshalBinary parses an OpAttest response into a. Unknown items are
+// ignored so that new ones can be added without breaking older clients, but
+// they are still covered by the signature.
+func (a *Attestation) UnmarshalBinary(body []byte) error {
+	*a = Attestation{}
+	err := parseItems(body, func(b byte, offset int, data []byte) error {
+		switch AttestationItem(b) {
+		case AttestationNonce:
+			a.Nonce = data
+		case AttestationCertHash:
+			if len(data) != sha256.Size {
+				return parseErrorf(offset, "invalid certificate hash: %x", data)
+			}
+			copy(a.CertHash[:], data)
+		case AttestationSKIs:
+			if len(data)%len(SKI{}) != 0 {
+				return parseErrorf(offset, "invalid SKI list of %dB", len(data))
+			}
+			a.SKIs = make([]SKI, len(data)/len(SKI{}))
+			for j := range a.SKIs {
+				copy(a.SKIs[j][:], data[j*len(SKI{}):])
+			}
+		case AttestationBuildHash:
+			a.BuildHash = data
+		case AttestationSignature:
+			if offset+3+len(data) != len(body) {
+				return parseErrorf(offset, "attestation signature is not the last item")
+			}
+			a.Signature = data
+			a.signed = body[:offset]
+		}
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+	if a.Signature == nil {
+		return errors.New("attestation is not signed")
+	}
+	return nil
+}
@@ -0,0 +1,60 @@
+package protocol
+
+import (
+	"encoding/binary"
+	"fmt"
+	"math"
+)
+
+// MarshalBatch encodes ops as the payload of an OpBatch request or response:
+// each operation, serialised without padding, preceded by its length as a
+// big-endian uint16. The payload must still fit in a single packet.
+func MarshalBatch(ops []Operation) ([]byte, error) {
+	var b []byte
+	for i := range ops {
+		op := ops[i]
+		op.NoPadding = true
+		if op.Opcode == OpBatch {
+			return nil, fmt.Errorf("batch operation %d: batches cannot be nested", i)
+		}
+		body, err := op.MarshalBinary()
+		if err != nil {
+			return nil, err
+		}
+		if len(body) > math.MaxUint16 {
+			return nil, fmt.Errorf("batch operation %d is too long (%dB)", i, len(body))
+		}
+		var length [2]byte
+		binary.BigEndian.PutUint16(length[:], uint16(len(body)))
+		b = append(b, length[:]...)
+		b = append(b, body...)
+	}
+	return b, nil
+}
+
+// UnmarshalBatch parses the payload of an OpBatch request or response.
+// Malformed payloads are rejected with a *ParseError. The operations may not
+// be compressed, so that a small batch can't decompress to many large ones.
+func UnmarshalBatch(payload []byte) ([]Operation, error) {
+	var ops []Operation
+	for offset := 0; offset < len(payload); {
+		if len(payload)-offset < 2 {
+			return nil, parseErrorf(offset, "batch operation %d: truncated length", len(ops))
+		}
+		length := int(binary.BigEndian.Uint16(payload[offset:]))
+		offset += 2
+		if offset+length > len(payload) {
+			return nil, parseErrorf(offset, "batch operation %d: length is %dB beyond end of payload", len(ops), offset+length-len(payload))
+		}
+		var op Operation
+		if err := op.unmarshal(payload[offset:offset+length], false); err != nil {
+			if perr, ok := err.(*ParseError); ok {
+				return nil, parseErrorf(offset+perr.Offset, "batch operation %d: %s", len(ops), perr.Reason)
+			}
+			return nil, fmt.Errorf("batch operation %d: %v", len(ops), err)
+		}
+		ops = append(ops, op)
+		offset += length
+	}
+	return ops, nil
+}
@@ -0,0 +1,128 @@
+package protocol
+
+import (
+	"crypto/x509"
+	"encoding/binary"
+	"math/big"
+	"strings"
+	"time"
+)
+
+// CertificateItem marks the type of an item in an OpGetCertificates request
+// or response.
+type CertificateItem byte
+
+const (
+	// CertificateName matches the certificates valid for a server name, which
+	// may be covered by a wildcard name of the certificate.
+	CertificateName CertificateItem = 0x01
+	// CertificateSerial matches the certificates with a big-endian serial
+	// number.
+	CertificateSerial CertificateItem = 0x02
+	// CertificateSKI matches the certificates of the key with an SKI.
+	CertificateSKI CertificateItem = 0x03
+	// CertificateExpiresBefore matches the certificates which expire before a
+	// time, as a big-endian uint64 of seconds since the Unix epoch.
+	CertificateExpiresBefore CertificateItem = 0x04
+	// CertificateDER is a DER-encoded certificate. There is one item per
+	// certificate in a response.
+	CertificateDER CertificateItem = 0x05
+	// CertificateTruncated marks a response which lists only some of the
+	// matching certificates, because they didn't fit in one. It is empty.
+	CertificateTruncated CertificateItem = 0x06
+)
+
+// A CertificateQuery selects the certificates listed in response to
+// OpGetCertificates. Certificates must match all of the criteria which are
+// set; the empty query matches all of them.
+type CertificateQuery struct {
+	Name          string
+	Serial        *big.Int
+	SKI           SKI
+	ExpiresBefore time.Time
+}
+
+// MarshalBinary encodes q as the payload of an OpGetCertificates request.
+func (q *CertificateQuery) MarshalBinary() ([]byte, error) {
+	var b []byte
+	if q.Name != "" {
+		b = appendTLVString(b, Tag(CertificateName), q.Name)
+	}
+	if q.Serial != nil {
+		b = appendTLV(b, Tag(CertificateSerial), q.Serial.Bytes()...)
+	}
+	if q.SKI.Valid() {
+		b = appendTLV(b, Tag(CertificateSKI), q.SKI[:]...)
+	}
+	if !q.ExpiresBefore.IsZero() {
+		var expires [8]byte
+		binary.BigEndian.PutUint64(expires[:], uint64(q.ExpiresBefore.Unix()))
+		b = appendTLV(b, Tag(CertificateExpiresBefore), expires[:]...)
+	}
+	return b, nil
+}
+
+// UnmarshalBinary parses the payload of an OpGetCertificates request into q.
+// Unknown items are ignored.
+func (q *CertificateQuery) UnmarshalBinary(body []byte) error {
+	*q = CertificateQuery{}
+	return parseItems(body, func(b byte, offset int, data []byte) error {
+		switch CertificateItem(b) {
+		case CertificateName:
+			q.Name = strings.ToLower(string(data))
+		case CertificateSerial:
+			q.Serial = new(big.Int).SetBytes(data)
+		case CertificateSKI:
+			if len(data) != len(q.SKI) {
+				return parseErrorf(offset, "invalid SKI of %dB", len(data))
+			}
+			copy(q.SKI[:], data)
+		case CertificateExpiresBefore:
+			if len(data) != 8 {
+				return parseErrorf(offset, "invalid expiry time: %x", data)
+			}
+			q.ExpiresBefore = time.Unix(int64(binary.BigEndian.Uint64(data)), 0)
+		}
+		return nil
+	})
+}
+
+// A CertificateList is the response to OpGetCertificates: the certificates of
+// the keys held by the server which match the query.
+type CertificateList struct {
+	Certificates []*x509.Certificate
+	// Truncated is set if there were more matching certificates than fit in
+	// the response.
+	Truncated bool
+}
+
+// MarshalBinary encodes l as the payload of an OpGetCertificates response.
+func (l *CertificateList) MarshalBinary() ([]byte, error) {
+	var b []byte
+	for _, cert := range l.Certificates {
+		b = appendTLV(b, Tag(CertificateDER), cert.Raw...)
+	}
+	if l.Truncated {
+		b = appendTLV(b, Tag(CertificateTruncated))
+	}
+	return b, nil
+}
+
+// UnmarshalBinary parses an OpGetCertificates response into l. Unknown items
+// are ignored.
+func (l *CertificateList) UnmarshalBinary(body []byte) error {
+	*l = CertificateList{}
+	return parseItems(body, func(b byte, offset int, data []byte) error {
+		switch CertificateItem(b) {
+		case CertificateDER:
+			cert, err := x509.ParseCertificate(data)
+			if err != nil {
+				return parseErrorf(offset, "invalid certificate: %v", err)
+			}
+			l.Certificates = append(l.Certificates, cert)
+		case CertificateTruncated:
+			l.Truncated = true
+		}
+		return nil
+	})
+}
@@ -0,0 +1,67 @@
+package protocol
+
+import (
+	"bytes"
+	"compress/flate"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"math"
+)
+
+// minCompressLength is the shortest payload worth compressing.
+const minCompressLength = 512
+
+// Compress compresses o's payload with c, if it is long enough for that to
+// pay off and the result is smaller. c must have been agreed with the peer
+// with OpHello. Compress does nothing if c is CompressionNone or the payload
+// is already compressed.
+func (o *Operation) Compress(c Compression) error {
+	if c == CompressionNone || o.Compression != CompressionNone || len(o.Payload) < minCompressLength {
+		return nil
+	}
+
+	var buf bytes.Buffer
+	switch c {
+	case CompressionDeflate:
+		w, err := flate.NewWriter(&buf, flate.BestSpeed)
+		if err != nil {
+			return err
+		}
+		if _, err := w.Write(o.Payload); err != nil {
+			return err
+		}
+		if err := w.Close(); err != nil {
+			return err
+		}
+	default:
+		return fmt.Errorf("unknown compression algorithm %02x", byte(c))
+	}
+	if buf.Len() < len(o.Payload) {
+		o.Payload, o.Compression = buf.Bytes(), c
+	}
+	return nil
+}
+
+// decompress decompresses data compressed with c. Payloads can't decompress
+// to more than fits in a packet, so that a small packet can't make the
+// receiver allocate a large one.
+func decompress(c Compression, data []byte) ([]byte, error) {
+	var r io.Reader
+	switch c {
+	case CompressionDeflate:
+		fr := flate.NewReader(bytes.NewReader(data))
+		defer fr.Close()
+		r = fr
+	default:
+		return nil, fmt.Errorf("unknown compression algorithm %02x", byte(c))
+	}
+	out, err := ioutil.ReadAll(io.LimitReader(r, math.MaxUint16+1))
+	if err != nil {
+		return nil, fmt.Errorf("decompressing payload: %v", err)
+	}
+	if len(out) > math.MaxUint16 {
+		return nil, fmt.Errorf("decompressed payload exceeds %d bytes", math.MaxUint16)
+	}
+	return out, nil
+}
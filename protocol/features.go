@@ -0,0 +1,301 @@
+package protocol
+
+import (
+	"encoding/binary"
+	"math"
+)
+
+// Feature marks the type of an item in an OpHello payload.
+type Feature byte
+
+const (
+	// FeatureVersion is the single-byte protocol version of the sender.
+	FeatureVersion Feature = 0x01
+	// FeatureOps lists the opcodes supported by the sender, one byte each.
+	FeatureOps Feature = 0x02
+	// FeatureMaxPayload is the largest payload, as a big-endian uint16, the
+	// sender accepts in a request.
+	FeatureMaxPayload Feature = 0x03
+	// FeatureCompression lists the payload compression algorithms supported by
+	// the sender, one byte each, in order of preference.
+	FeatureCompression Feature = 0x04
+	// FeaturePadding is the single-byte PaddingPolicy of the sender.
+	FeaturePadding Feature = 0x05
+	// FeatureKeepalive is a single byte, 1 if the sender answers OpPing
+	// requests from its peer, so that it can be sent keepalive pings.
+	FeatureKeepalive Feature = 0x06
+	// FeatureSKISchemes lists the SKISchemes of the SKIs the sender accepts
+	// or sends, one byte each, in order of preference.
+	FeatureSKISchemes Feature = 0x07
+	// FeatureKeyRemoved is a single byte, 1 if the sender accepts OpKeyRemoved
+	// messages from its peer.
+	FeatureKeyRemoved Feature = 0x08
+	// FeatureTiming is a single byte, 1 if the sender attaches the Timing of
+	// requests to its responses or, for clients, accepts it.
+	FeatureTiming Feature = 0x09
+	// FeatureReconnect is a single byte, 1 if the sender accepts OpReconnect
+	// messages from its peer.
+	FeatureReconnect Feature = 0x0A
+)
+
+// Compression identifies a payload compression algorithm.
+type Compression byte
+
+const (
+	// CompressionNone means that the payload is not compressed.
+	CompressionNone Compression = 0x00
+	// CompressionDeflate is DEFLATE (RFC 1951).
+	CompressionDeflate Compression = 0x01
+)
+
+// PaddingPolicy describes whether messages must be padded to paddedLength.
+type PaddingPolicy byte
+
+const (
+	// PaddingRequired requires every message to be padded, as in version 1.
+	PaddingRequired PaddingPolicy = 0x00
+	// PaddingOptional allows messages to be sent without padding.
+	PaddingOptional PaddingPolicy = 0x01
+)
+
+// Version is the protocol version implemented by this package.
+const Version = 2
+
+// Features is the set of protocol features supported by one end of a
+// connection, or negotiated between both ends with OpHello.
+type Features struct {
+	Version uint8
+	// Ops lists the supported opcodes. A nil Ops means the supported opcodes
+	// are unknown, as with peers that predate OpHello.
+	Ops         []Op
+	MaxPayload  uint16
+	Compression []Compression
+	Padding     PaddingPolicy
+	// Keepalive is set if the peer answers pings. Once negotiated, servers
+	// may ping idle clients.
+	Keepalive bool
+	// SKISchemes lists the supported SKI schemes in order of preference. Nil
+	// means only SKISchemeSHA1, as with peers that predate it.
+	SKISchemes []SKIScheme
+	// KeyRemoved is set if the peer accepts OpKeyRemoved messages. Once
+	// negotiated, servers tell clients about the keys they stop serving.
+	KeyRemoved bool
+	// Timing is set if the peer sends or accepts the Timing of requests.
+	// Once negotiated, servers attach it to their responses.
+	Timing bool
+	// Reconnect is set if the peer accepts OpReconnect messages. Once
+	// negotiated, servers ask clients to move to a new connection before
+	// closing one which reached its maximum age or size.
+	Reconnect bool
+}
+
+// V1Features are the features of a peer which does not support OpHello.
+var V1Features = Features{
+	Version:    1,
+	MaxPayload: math.MaxUint16 - paddedLength,
+	Padding:    PaddingRequired,
+}
+
+// Supports reports whether op is supported. It returns true for any op if the
+// supported opcodes are unknown.
+func (f *Features) Supports(op Op) bool {
+	if f.Ops == nil {
+		return true
+	}
+	for _, o := range f.Ops {
+		if o == op {
+			return true
+		}
+	}
+	return false
+}
+
+// Negotiate returns the features supported by both local and remote: the lower
+// version and maximum payload, the common opcodes, compression algorithms and
+// SKI schemes (in local's order of preference), padding unless both allow
+// omitting it, and keepalive pings, key removal messages, request timings and
+// reconnect messages if both accept them.
+func Negotiate(local, remote Features) Features {
+	f := Features{
+		Version:    local.Version,
+		MaxPayload: local.MaxPayload,
+		Padding:    PaddingOptional,
+		Keepalive:  local.Keepalive && remote.Keepalive,
+		KeyRemoved: local.KeyRemoved && remote.KeyRemoved,
+		Timing:     local.Timing && remote.Timing,
+		Reconnect:  local.Reconnect && remote.Reconnect,
+	}
+	if remote.Version < f.Version {
+		f.Version = remote.Version
+	}
+	if remote.MaxPayload < f.MaxPayload {
+		f.MaxPayload = remote.MaxPayload
+	}
+	if local.Padding != PaddingOptional || remote.Padding != PaddingOptional {
+		f.Padding = PaddingRequired
+	}
+
+	switch {
+	case local.Ops == nil:
+		f.Ops = remote.Ops
+	case remote.Ops == nil:
+		f.Ops = local.Ops
+	default:
+		f.Ops = []Op{}
+		for _, op := range local.Ops {
+			if remote.Supports(op) {
+				f.Ops = append(f.Ops, op)
+			}
+		}
+	}
+
+	for _, c := range local.Compression {
+		for _, rc := range remote.Compression {
+			if c == rc {
+				f.Compression = append(f.Compression, c)
+				break
+			}
+		}
+	}
+	for _, scheme := range local.SKISchemes {
+		if remote.supportsSKIScheme(scheme) {
+			f.SKISchemes = append(f.SKISchemes, scheme)
+		}
+	}
+	return f
+}
+
+// supportsSKIScheme reports whether scheme is one of the SKI schemes of f.
+func (f *Features) supportsSKIScheme(scheme SKIScheme) bool {
+	if f.SKISchemes == nil {
+		return scheme == SKISchemeSHA1
+	}
+	for _, s := range f.SKISchemes {
+		if s == scheme {
+			return true
+		}
+	}
+	return false
+}
+
+// SKIScheme returns the preferred SKI scheme of f, which a client sends SKIs in
+// once the features have been negotiated. It is SKISchemeSHA1 unless another
+// scheme was negotiated.
+func (f *Features) SKIScheme() SKIScheme {
+	if len(f.SKISchemes) == 0 {
+		return SKISchemeSHA1
+	}
+	return f.SKISchemes[0]
+}
+
+// MarshalBinary serialises f as a list of Feature-Length-Value items, the
+// payload of OpHello.
+func (f *Features) MarshalBinary() ([]byte, error) {
+	item := func(b []byte, feature Feature, data []byte) []byte {
+		return append(b, tlvBytes(Tag(feature), data)...)
+	}
+
+	var maxPayload [2]byte
+	binary.BigEndian.PutUint16(maxPayload[:], f.MaxPayload)
+
+	var b []byte
+	b = item(b, FeatureVersion, []byte{f.Version})
+	if f.Ops != nil {
+		ops := make([]byte, len(f.Ops))
+		for i, op := range f.Ops {
+			ops[i] = byte(op)
+		}
+		b = item(b, FeatureOps, ops)
+	}
+	b = item(b, FeatureMaxPayload, maxPayload[:])
+	if len(f.Compression) > 0 {
+		comp := make([]byte, len(f.Compression))
+		for i, c := range f.Compression {
+			comp[i] = byte(c)
+		}
+		b = item(b, FeatureCompression, comp)
+	}
+	b = item(b, FeaturePadding, []byte{byte(f.Padding)})
+	if f.Keepalive {
+		b = item(b, FeatureKeepalive, []byte{1})
+	}
+	if len(f.SKISchemes) > 0 {
+		schemes := make([]byte, len(f.SKISchemes))
+		for i, scheme := range f.SKISchemes {
+			schemes[i] = byte(scheme)
+		}
+		b = item(b, FeatureSKISchemes, schemes)
+	}
+	if f.KeyRemoved {
+		b = item(b, FeatureKeyRemoved, []byte{1})
+	}
+	if f.Timing {
+		b = item(b, FeatureTiming, []byte{1})
+	}
+	if f.Reconnect {
+		b = item(b, FeatureReconnect, []byte{1})
+	}
+	return b, nil
+}
+
+// UnmarshalBinary parses an OpHello payload into f. Unknown features are
+// ignored so that new ones can be added without breaking older peers; missing
+// features take their version 1 values.
+func (f *Features) UnmarshalBinary(body []byte) error {
+	*f = V1Features
+	return parseItems(body, func(b byte, offset int, data []byte) error {
+		switch Feature(b) {
+		case FeatureVersion:
+			if len(data) != 1 {
+				return parseErrorf(offset, "invalid version: %x", data)
+			}
+			f.Version = data[0]
+		case FeatureOps:
+			f.Ops = make([]Op, len(data))
+			for j, op := range data {
+				f.Ops[j] = Op(op)
+			}
+		case FeatureMaxPayload:
+			if len(data) != 2 {
+				return parseErrorf(offset, "invalid max payload: %x", data)
+			}
+			f.MaxPayload = binary.BigEndian.Uint16(data)
+		case FeatureCompression:
+			f.Compression = make([]Compression, len(data))
+			for j, c := range data {
+				f.Compression[j] = Compression(c)
+			}
+		case FeaturePadding:
+			if len(data) != 1 {
+				return parseErrorf(offset, "invalid padding policy: %x", data)
+			}
+			f.Padding = PaddingPolicy(data[0])
+		case FeatureKeepalive:
+			if len(data) != 1 {
+				return parseErrorf(offset, "invalid keepalive: %x", data)
+			}
+			f.Keepalive = data[0] == 1
+		case FeatureSKISchemes:
+			f.SKISchemes = make([]SKIScheme, len(data))
+			for j, scheme := range data {
+				f.SKISchemes[j] = SKIScheme(scheme)
+			}
+		case FeatureKeyRemoved:
+			if len(data) != 1 {
+				return parseErrorf(offset, "invalid key removal: %x", data)
+			}
+			f.KeyRemoved = data[0] == 1
+		case FeatureTiming:
+			if len(data) != 1 {
+				return parseErrorf(offset, "invalid timing: %x", data)
+			}
+			f.Timing = data[0] == 1
+		case FeatureReconnect:
+			if len(data) != 1 {
+				return parseErrorf(offset, "invalid reconnect: %x", data)
+			}
+			f.Reconnect = data[0] == 1
+		}
+		return nil
+	})
+}
@@ -0,0 +1,110 @@
+//go:build go1.18
+// +build go1.18
+
+package protocol
+
+import (
+	"bytes"
+	"crypto/sha1"
+	"errors"
+	"io"
+	"net"
+	"testing"
+)
+
+// fuzzSeeds returns well-formed packets to start fuzzing from.
+func fuzzSeeds() [][]byte {
+	payload := bytes.Repeat([]byte("payload "), 100)
+	compressed := Operation{Opcode: OpSeal, Payload: payload, NoPadding: true}
+	compressed.Compress(CompressionDeflate)
+	batch, _ := MarshalBatch([]Operation{{Opcode: OpPing}, {Opcode: OpSeal, Payload: payload}})
+	ops := []Operation{
+		{Opcode: OpPing},
+		{Opcode: OpPing, NoPadding: true},
+		{
+			Opcode:   OpECDSASignSHA256,
+			Payload:  []byte("digest"),
+			SKI:      sha1.Sum([]byte("SKI")),
+			ClientIP: net.ParseIP("1.1.1.1").To4(),
+			ServerIP: net.ParseIP("::1"),
+			SNI:      "example.com",
+		},
+		compressed,
+		{Opcode: OpBatch, Payload: batch, NoPadding: true},
+	}
+	var seeds [][]byte
+	for i, op := range ops {
+		pkt := NewPacket(uint32(i), op)
+		b, _ := pkt.MarshalBinary()
+		seeds = append(seeds, b)
+	}
+	return seeds
+}
+
+func FuzzPacketReadFrom(f *testing.F) {
+	for _, seed := range fuzzSeeds() {
+		f.Add(seed)
+	}
+	f.Fuzz(func(t *testing.T, data []byte) {
+		var pkt Packet
+		n, err := pkt.ReadFrom(bytes.NewReader(data))
+		if err != nil {
+			var perr *ParseError
+			if !errors.As(err, &perr) && err != io.EOF && err != io.ErrUnexpectedEOF {
+				t.Fatalf("untyped error: %v", err)
+			}
+			return
+		}
+		if n != int64(headerSize)+int64(pkt.Length) {
+			t.Fatalf("read %d bytes of a %d byte packet", n, headerSize+int(pkt.Length))
+		}
+		if len(pkt.Payload) > int(pkt.Length) {
+			// A decompressed payload need not fit in a packet again.
+			return
+		}
+
+		// Whatever parses must survive a round trip.
+		again := NewPacket(pkt.ID, pkt.Operation)
+		b, err := again.MarshalBinary()
+		if err != nil {
+			t.Fatal(err)
+		}
+		var pkt2 Packet
+		if err := pkt2.UnmarshalBinary(b); err != nil {
+			t.Fatalf("reparsing: %v", err)
+		}
+		if pkt2.Opcode != pkt.Opcode || !bytes.Equal(pkt2.Payload, pkt.Payload) || pkt2.SKI != pkt.SKI {
+			t.Fatalf("round trip changed %v to %v", pkt.Operation, pkt2.Operation)
+		}
+	})
+}
+
+func FuzzOperationUnmarshalBinary(f *testing.F) {
+	for _, seed := range fuzzSeeds() {
+		f.Add(seed[headerSize:])
+	}
+	f.Fuzz(func(t *testing.T, body []byte) {
+		var op Operation
+		if err := op.UnmarshalBinary(body); err != nil {
+			return
+		}
+		if op.ClientIP != nil && len(op.ClientIP) != 4 && len(op.ClientIP) != 16 {
+			t.Fatalf("invalid client IP %v", op.ClientIP)
+		}
+		if op.Compression != CompressionNone {
+			t.Fatal("payload left compressed")
+		}
+		if op.Opcode == OpBatch {
+			UnmarshalBatch(op.Payload)
+		}
+	})
+}
+
+func FuzzFeaturesUnmarshalBinary(f *testing.F) {
+	b, _ := (&Features{Version: Version, Ops: []Op{OpPing}, MaxPayload: 1024, Compression: []Compression{CompressionDeflate}}).MarshalBinary()
+	f.Add(b)
+	f.Fuzz(func(t *testing.T, body []byte) {
+		var features Features
+		features.UnmarshalBinary(body)
+	})
+}
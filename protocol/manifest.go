@@ -0,0 +1,146 @@
+package protocol
+
+import (
+	"crypto"
+	"encoding/binary"
+	"errors"
+	"time"
+)
+
+// ManifestItem marks the type of an item in an OpGetManifest response.
+type ManifestItem byte
+
+const (
+	// ManifestIssued is when the manifest was signed, as a big-endian uint64
+	// of seconds since the Unix epoch.
+	ManifestIssued ManifestItem = 0x01
+	// ManifestKey is a key held by the server: its SKI followed by its
+	// DER-encoded PKIX public key. There is one item per key.
+	ManifestKey ManifestItem = 0x02
+	// ManifestSignature is the signature of the items preceding it. It must be
+	// the last item.
+	ManifestSignature ManifestItem = 0x03
+)
+
+// A PublicKey is a key listed in a Manifest.
+type PublicKey struct {
+	SKI    SKI
+	Public crypto.PublicKey
+}
+
+// A Manifest lists the keys a keyserver can serve, signed with its attestation
+// key, so that clients can set up remote signers for them without being given
+// each public key. Clients request one with OpGetManifest.
+type Manifest struct {
+	Issued    time.Time
+	Keys      []PublicKey
+	Signature []byte
+
+	// signed is the encoding of the items covered by Signature, if m was
+	// unmarshaled.
+	signed []byte
+}
+
+// ErrManifest is returned by Manifest.Verify if the signature is invalid.
+var ErrManifest = errors.New("invalid manifest signature")
+
+// statement returns the encoding of the listed items, which is what is signed.
+func (m *Manifest) statement() ([]byte, error) {
+	if m.signed != nil {
+		return m.signed, nil
+	}
+	var issued [8]byte
+	binary.BigEndian.PutUint64(issued[:], uint64(m.Issued.Unix()))
+	b := tlvBytes(Tag(ManifestIssued), issued[:])
+	for _, key := range m.Keys {
+		der, err := MarshalPublicKey(key.Public)
+		if err != nil {
+			return nil, err
+		}
+		item := append(append([]byte{}, key.SKI[:]...), der...)
+		b = append(b, tlvBytes(Tag(ManifestKey), item)...)
+	}
+	return b, nil
+}
+
+// Sign sets m.Signature to the signature of m by signer, which must not have
+// been unmarshaled, as Attestation.Sign does.
+func (m *Manifest) Sign(signer crypto.Signer) error {
+	msg, err := m.statement()
+	if err != nil {
+		return err
+	}
+	m.Signature, err = signStatement(signer, msg)
+	return err
+}
+
+// Verify checks that m was signed by the private key of pub.
+func (m *Manifest) Verify(pub crypto.PublicKey) error {
+	msg, err := m.statement()
+	if err != nil {
+		return err
+	}
+	ok, err := verifyStatement(pub, msg, m.Signature)
+	if err != nil {
+		return err
+	}
+	if !ok {
+		return ErrManifest
+	}
+	return nil
+}
+
+// MarshalBinary encodes m as the payload of an OpGetManifest response.
+func (m *Manifest) MarshalBinary() ([]byte, error) {
+	b, err := m.statement()
+	if err != nil {
+		return nil, err
+	}
+	return append(b, tlvBytes(Tag(ManifestSignature), m.Signature)...), nil
+}
+
+// UnmarshalBinary parses an OpGetManifest response into m. Each key's SKI must
+// match its public key. Unknown items are ignored, but are still covered by
+// the signature.
+func (m *Manifest) UnmarshalBinary(body []byte) error {
+	*m = Manifest{}
+	err := parseItems(body, func(b byte, offset int, data []byte) error {
+		switch ManifestItem(b) {
+		case ManifestIssued:
+			if len(data) != 8 {
+				return parseErrorf(offset, "invalid issue time: %x", data)
+			}
+			m.Issued = time.Unix(int64(binary.BigEndian.Uint64(data)), 0)
+		case ManifestKey:
+			var key PublicKey
+			if len(data) < len(key.SKI) {
+				return parseErrorf(offset, "invalid key of %dB", len(data))
+			}
+			copy(key.SKI[:], data)
+			pub, err := ParsePublicKey(data[len(key.SKI):])
+			if err != nil {
+				return parseErrorf(offset, "invalid public key: %v", err)
+			}
+			ski, err := GetSKI(pub)
+			if err != nil || ski != key.SKI {
+				return parseErrorf(offset, "SKI %v does not match its public key", key.SKI)
+			}
+			key.Public = pub
+			m.Keys = append(m.Keys, key)
+		case ManifestSignature:
+			if offset+3+len(data) != len(body) {
+				return parseErrorf(offset, "manifest signature is not the last item")
+			}
+			m.Signature = data
+			m.signed = body[:offset]
+		}
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+	if m.Signature == nil {
+		return errors.New("manifest is not signed")
+	}
+	return nil
+}
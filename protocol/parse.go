@@ -0,0 +1,43 @@
+package protocol
+
+import (
+	"encoding/binary"
+	"fmt"
+)
+
+// A ParseError reports a malformed message: a packet, or the payload of an
+// OpHello, OpBatch or OpAttest exchange.
+type ParseError struct {
+	// Offset is the offset of the malformed part in the bytes being parsed.
+	Offset int
+	// Reason describes what is malformed.
+	Reason string
+}
+
+func (e *ParseError) Error() string {
+	return fmt.Sprintf("keyless: malformed message at byte %d: %s", e.Offset, e.Reason)
+}
+
+func parseErrorf(offset int, format string, args ...interface{}) error {
+	return &ParseError{Offset: offset, Reason: fmt.Sprintf(format, args...)}
+}
+
+// parseItems calls f with the type, offset and data of each Tag-Length-Value
+// item in body, in order. Items which overrun body and trailing bytes too
+// short to be an item are rejected, so every byte of body belongs to an item.
+func parseItems(body []byte, f func(tag byte, offset int, data []byte) error) error {
+	for i := 0; i < len(body); {
+		if len(body)-i < 3 {
+			return parseErrorf(i, "truncated item header")
+		}
+		length := int(binary.BigEndian.Uint16(body[i+1 : i+3]))
+		if i+3+length > len(body) {
+			return parseErrorf(i, "item %02x length is %dB beyond end of body", body[i], i+3+length-len(body))
+		}
+		if err := f(body[i], i, body[i+3:i+3+length]); err != nil {
+			return err
+		}
+		i += 3 + length
+	}
+	return nil
+}
@@ -14,11 +14,15 @@ import (
 	"errors"
 	"fmt"
 	"io"
+	"io/ioutil"
 	"math"
 	"net"
+	"sync"
+	"time"
 
 	"github.com/cloudflare/cfssl/helpers"
 	"github.com/cloudflare/cfssl/helpers/derhelpers"
+	"github.com/cloudflare/gokeyless/sm2"
 )
 
 //go:generate stringer -type=Tag,Op -output=protocol_string.go
@@ -49,6 +53,18 @@ const (
 	TagExtra Tag = 0x14
 	// TagJaegerSpan contains a binary encoded jaeger span context. See https://www.jaegertracing.io/docs/1.19/client-libraries/#value
 	TagJaegerSpan Tag = 0x15
+	// TagCompression implies the Compression algorithm the payload is
+	// compressed with.
+	TagCompression Tag = 0x16
+	// TagBudget implies the time the client will wait for the response, as a
+	// 4-byte big-endian number of milliseconds.
+	TagBudget Tag = 0x17
+	// TagPriority implies the Priority of the request, as a single byte.
+	TagPriority Tag = 0x18
+	// TagTiming implies the Timing of a request, as two 4-byte big-endian
+	// numbers of microseconds: the time it queued, then the time it was
+	// processed.
+	TagTiming Tag = 0x19
 	// TagPadding implies an item with a meaningless payload added for padding.
 	TagPadding Tag = 0x20
 )
@@ -95,6 +111,11 @@ const (
 	// OpEd25519Sign requests an Ed25519 signature on an arbitrary-length payload.
 	OpEd25519Sign Op = 0x18
 
+	// OpSM2SignSM3 requests an SM2 signature on an SM3 hash payload, the
+	// digest of the signer's identity and the message, as computed by
+	// sm2.Digest.
+	OpSM2SignSM3 Op = 0x19
+
 	// OpSeal asks to encrypt a blob (like a Session Ticket)
 	OpSeal Op = 0x21
 	// OpUnseal asks to decrypt a blob encrypted by OpSeal
@@ -103,11 +124,60 @@ const (
 	OpRPC Op = 0x23
 	// OpCustom requests a custom operation that can be defined by a function set in the server configuration
 	OpCustom Op = 0x24
+	// OpGetTicketKeys requests the current set of TLS session ticket keys, newest first.
+	OpGetTicketKeys Op = 0x25
+	// OpGetCapabilities requests the list of opcodes supported by the server, one byte each.
+	OpGetCapabilities Op = 0x26
+	// OpHello negotiates protocol features for the connection. The payload is
+	// an encoded Features list, answered with the negotiated Features.
+	OpHello Op = 0x27
+	// OpAttest requests a signed Attestation of the server. The payload is a
+	// nonce to include in the attestation.
+	OpAttest Op = 0x28
+	// OpBatch performs several operations in one round trip. The payload is
+	// the list of operations encoded by MarshalBatch, answered with the list
+	// of their OpResponse or OpError results in the same order. Nested
+	// batches and operations of the connection, such as OpHello, are answered
+	// with ErrBadOpcode.
+	OpBatch Op = 0x29
+	// OpOCSPSign requests a signed OCSP response. The payload is a DER-encoded
+	// OCSPResponse whose signature is to be filled in by the key, answered
+	// with the signed OCSPResponse.
+	OpOCSPSign Op = 0x2A
+	// OpAuthenticate authenticates a connection whose client presented no
+	// certificate. The payload is a bearer token, answered with an empty
+	// OpResponse once the server has verified it.
+	OpAuthenticate Op = 0x2B
+	// OpGetManifest requests the signed Manifest of the keys held by the
+	// server. The payload is empty.
+	OpGetManifest Op = 0x2C
+	// OpProbeKey asks whether the server holds the key identified by the
+	// operation's SKI and other key items, e.g. after the server restarted.
+	// The payload is empty, and it is answered with an empty OpResponse if the
+	// server holds the key, or with ErrKeyNotFound.
+	OpProbeKey Op = 0x2D
+	// OpGetCertificates lists the certificates of the keys held by the server.
+	// The payload is a CertificateQuery selecting them, answered with a
+	// CertificateList.
+	OpGetCertificates Op = 0x2E
+	// OpStream carries a step of an operation whose payload or result don't
+	// fit in a packet, such as OpSeal of a large blob. The payload is a
+	// StreamChunk, whose phase tells how it is answered.
+	OpStream Op = 0x2F
 
 	// OpPing indicates a test message which will be echoed with opcode changed to OpPong.
 	OpPing Op = 0xF1
 	// OpPong indicates a response echoed from an OpPing test message.
 	OpPong Op = 0xF2
+	// OpKeyRemoved is sent by servers, never answered, to tell clients which
+	// negotiated FeatureKeyRemoved that the key with the SKI of the message is
+	// no longer served.
+	OpKeyRemoved Op = 0xF3
+	// OpReconnect is sent by servers, never answered, to ask clients which
+	// negotiated FeatureReconnect to send no more requests on the connection
+	// and open a new one, e.g. to renew its TLS keys. The server answers the
+	// requests already sent, and closes the connection after a grace period.
+	OpReconnect Op = 0xF4
 
 	// OpResponse is used to send a block of data back to the client.
 	OpResponse Op = 0xF0
@@ -126,10 +196,14 @@ func (op Op) Type() string {
 		return "custom"
 	case OpRPC:
 		return "rpc"
-	case OpSeal, OpUnseal, OpPing, OpPong, OpResponse, OpError:
+	case OpSeal, OpUnseal, OpGetTicketKeys, OpGetCapabilities, OpHello, OpAttest, OpBatch, OpAuthenticate, OpGetManifest, OpProbeKey, OpGetCertificates, OpStream, OpPing, OpPong, OpKeyRemoved, OpReconnect, OpResponse, OpError:
 		return "other"
 	case OpEd25519Sign:
 		return "ed25519"
+	case OpSM2SignSM3:
+		return "sm2"
+	case OpOCSPSign:
+		return "ocsp"
 	default:
 		return "unknown"
 	}
@@ -161,6 +235,24 @@ const (
 	ErrCertNotFound
 	// ErrExpired indicates that the sealed blob is no longer unsealable.
 	ErrExpired
+	// ErrKeyUsage indicates that the key may not be used for the operation.
+	ErrKeyUsage
+	// ErrUnauthorized indicates that the client has not authenticated, or
+	// that its token was rejected.
+	ErrUnauthorized
+	// ErrTimedOut indicates that the request waited in the server's queue
+	// for longer than its budget.
+	ErrTimedOut
+	// ErrThrottled indicates that the server is over one of its limits, such
+	// as the rate limit of the key or the number of outstanding requests.
+	ErrThrottled
+	// ErrNotReady indicates that the server hasn't finished loading its keys
+	// or checking its key backends yet.
+	ErrNotReady
+	// ErrReplayed indicates that the server has recently seen a request with
+	// the same client, packet ID and operation, as when a captured request is
+	// replayed.
+	ErrReplayed
 )
 
 func (e Error) Error() string {
@@ -191,16 +283,41 @@ func (e Error) String() string {
 		return "certificate not found"
 	case ErrExpired:
 		return "sealing key expired"
+	case ErrKeyUsage:
+		return "operation not allowed for key"
+	case ErrUnauthorized:
+		return "client not authenticated"
+	case ErrTimedOut:
+		return "timed out in queue"
+	case ErrThrottled:
+		return "request throttled"
+	case ErrNotReady:
+		return "server not ready"
+	case ErrReplayed:
+		return "request replayed"
 	default:
 		return "unknown error"
 	}
 }
 
+// Temporary reports whether a request which failed with e may succeed if
+// retried later, possibly on another server.
+func (e Error) Temporary() bool {
+	return e == ErrTimedOut || e == ErrThrottled || e == ErrNotReady
+}
+
 const (
 	paddedLength = 1024
 	headerSize   = 8
 )
 
+// HTTPContentType is the media type of a packet sent as the body of an HTTP
+// request or response.
+const HTTPContentType = "application/x-keyless"
+
+// MaxPacketLength is the length of the largest possible packet.
+const MaxPacketLength = headerSize + math.MaxUint16
+
 // SKI represents a subject key identifier used to index remote keys.
 type SKI [sha1.Size]byte
 
@@ -219,14 +336,44 @@ func (ski SKI) Valid() bool {
 	return ski != nilSKI
 }
 
-// GetSKI returns the SKI of a public key.
+// SKIScheme identifies how an SKI is derived from a public key. Every scheme
+// yields 20-byte SKIs, so that keys can be registered under the SKIs of
+// several schemes while clients migrate from one to another.
+type SKIScheme byte
+
+const (
+	// SKISchemeSHA1 is the SHA-1 hash of the subjectPublicKey, as in method 1
+	// of RFC 5280, section 4.2.1.2. It is the scheme of GetSKI.
+	SKISchemeSHA1 SKIScheme = 0x01
+	// SKISchemeSHA256 is the leftmost 160 bits of the SHA-256 hash of the
+	// subjectPublicKey, as in method 1 of RFC 7093.
+	SKISchemeSHA256 SKIScheme = 0x02
+)
+
+func (scheme SKIScheme) String() string {
+	switch scheme {
+	case SKISchemeSHA1:
+		return "sha1"
+	case SKISchemeSHA256:
+		return "sha256"
+	default:
+		return fmt.Sprintf("SKIScheme(%d)", byte(scheme))
+	}
+}
+
+// GetSKI returns the SKI of a public key, in SKISchemeSHA1.
 func GetSKI(pub crypto.PublicKey) (SKI, error) {
-	encodedPub, err := x509.MarshalPKIXPublicKey(pub)
+	return GetSKIScheme(pub, SKISchemeSHA1)
+}
+
+// GetSKIScheme returns the SKI of a public key in scheme.
+func GetSKIScheme(pub crypto.PublicKey, scheme SKIScheme) (SKI, error) {
+	if scheme != SKISchemeSHA1 && scheme != SKISchemeSHA256 {
+		return nilSKI, fmt.Errorf("unknown SKI scheme %v", scheme)
+	}
+	encodedPub, err := MarshalPublicKey(pub)
 	if err != nil {
-		encodedPub, err = derhelpers.MarshalEd25519PublicKey(pub)
-		if err != nil {
-			return nilSKI, err
-		}
+		return nilSKI, err
 	}
 
 	subPKI := new(struct {
@@ -238,9 +385,40 @@ func GetSKI(pub crypto.PublicKey) (SKI, error) {
 		return nilSKI, err
 	}
 
+	if scheme == SKISchemeSHA256 {
+		var ski SKI
+		sum := sha256.Sum256(subPKI.SubjectPublicKey.Bytes)
+		copy(ski[:], sum[:])
+		return ski, nil
+	}
 	return sha1.Sum(subPKI.SubjectPublicKey.Bytes), nil
 }
 
+// MarshalPublicKey returns the DER encoding of the PKIX public key pub,
+// including SM2 keys, which crypto/x509 doesn't support.
+func MarshalPublicKey(pub crypto.PublicKey) ([]byte, error) {
+	if pub, ok := pub.(*sm2.PublicKey); ok {
+		return sm2.MarshalPKIXPublicKey(pub)
+	}
+	der, err := x509.MarshalPKIXPublicKey(pub)
+	if err != nil {
+		return derhelpers.MarshalEd25519PublicKey(pub)
+	}
+	return der, nil
+}
+
+// ParsePublicKey parses a DER-encoded PKIX public key, including SM2 keys.
+func ParsePublicKey(der []byte) (crypto.PublicKey, error) {
+	pub, err := x509.ParsePKIXPublicKey(der)
+	if err != nil {
+		if pub, sm2Err := sm2.ParsePKIXPublicKey(der); sm2Err == nil {
+			return pub, nil
+		}
+		return nil, err
+	}
+	return pub, nil
+}
+
 // GetSKICert returns the SKI of a parsed X.509 Certificate.
 func GetSKICert(cert *x509.Certificate) (SKI, error) {
 	return GetSKI(cert.PublicKey)
@@ -283,18 +461,20 @@ type Header struct {
 
 // MarshalBinary marshals h into its wire format. It will never return an error.
 func (h *Header) MarshalBinary() ([]byte, error) {
-	data := make([]byte, 8)
-	data[0] = h.MajorVers
-	data[1] = h.MinorVers
-	binary.BigEndian.PutUint16(data[2:4], h.Length)
-	binary.BigEndian.PutUint32(data[4:8], h.ID)
-	return data, nil
+	return h.appendBinary(make([]byte, 0, headerSize)), nil
+}
+
+// appendBinary appends the wire format of h to b.
+func (h *Header) appendBinary(b []byte) []byte {
+	return append(b, h.MajorVers, h.MinorVers,
+		byte(h.Length>>8), byte(h.Length),
+		byte(h.ID>>24), byte(h.ID>>16), byte(h.ID>>8), byte(h.ID))
 }
 
 // UnmarshalBinary parses data as a header stored in its wire format.
 func (h *Header) UnmarshalBinary(data []byte) error {
-	if len(data) < 8 {
-		return fmt.Errorf("cannot unmarshal into header: got %v bytes; need 8", len(data))
+	if len(data) < headerSize {
+		return parseErrorf(len(data), "truncated header: got %v bytes; need %d", len(data), headerSize)
 	}
 	h.MajorVers = data[0]
 	h.MinorVers = data[1]
@@ -303,21 +483,39 @@ func (h *Header) UnmarshalBinary(data []byte) error {
 	return nil
 }
 
+// minBodyLength is the length of the shortest valid body, which holds just an
+// opcode item.
+const minBodyLength = 3 + 1
+
+// validate checks that h is the header of a version 1 packet with room for an
+// opcode.
+func (h *Header) validate() error {
+	if h.MajorVers != 0x01 {
+		return parseErrorf(0, "unsupported major version %d", h.MajorVers)
+	}
+	if h.Length < minBodyLength {
+		return parseErrorf(2, "body length %d is too short", h.Length)
+	}
+	return nil
+}
+
 // WriteTo serializes h in its wire format into w.
 func (h *Header) WriteTo(w io.Writer) (n int64, err error) {
-	var data [8]byte
-	data[0] = h.MajorVers
-	data[1] = h.MinorVers
-	binary.BigEndian.PutUint16(data[2:4], h.Length)
-	binary.BigEndian.PutUint32(data[4:8], h.ID)
-	nn, err := w.Write(data[:])
+	buf := getBuffer()
+	defer putBuffer(buf)
+	*buf = h.appendBinary(*buf)
+	nn, err := w.Write(*buf)
 	return int64(nn), err
 }
 
 // ReadFrom deserializes into h from its wire format read from r.
 func (h *Header) ReadFrom(r io.Reader) (n int64, err error) {
-	var hdr [8]byte
-	nn, err := io.ReadFull(r, hdr[:])
+	// A pooled buffer is used since an array on the stack would escape to
+	// the heap through r.
+	buf := getBuffer()
+	defer putBuffer(buf)
+	hdr := (*buf)[:headerSize]
+	nn, err := io.ReadFull(r, hdr)
 	if err != nil {
 		return int64(nn), err
 	}
@@ -325,7 +523,7 @@ func (h *Header) ReadFrom(r io.Reader) (n int64, err error) {
 	h.MinorVers = hdr[1]
 	h.Length = binary.BigEndian.Uint16(hdr[2:4])
 	h.ID = binary.BigEndian.Uint32(hdr[4:8])
-	return 8, nil
+	return headerSize, nil
 }
 
 // Packet represents the format for a Keyless protocol header and body.
@@ -350,15 +548,8 @@ func NewPacket(id uint32, op Operation) Packet {
 
 // MarshalBinary serializes p into its wire format.
 func (p *Packet) MarshalBinary() ([]byte, error) {
-	hdr, err := p.Header.MarshalBinary()
-	if err != nil {
-		panic(fmt.Sprintf("unexpected internal error: %v", err))
-	}
-	body, err := p.Operation.MarshalBinary()
-	if err != nil {
-		return nil, err
-	}
-	return append(hdr, body...), nil
+	b := make([]byte, 0, headerSize+int(p.Length))
+	return p.Operation.appendBinary(p.Header.appendBinary(b)), nil
 }
 
 // UnmarshalBinary deserializes into p from its wire format.
@@ -367,27 +558,77 @@ func (p *Packet) UnmarshalBinary(data []byte) error {
 	if err != nil {
 		return err
 	}
+	if err := p.Header.validate(); err != nil {
+		return err
+	}
 	// since h.Header.UnmarshalBinary succeeded, we know len(data) >= 8
-	return p.Operation.UnmarshalBinary(data[8:])
+	if body := data[headerSize:]; len(body) != int(p.Length) {
+		return parseErrorf(headerSize, "body is %dB, but the header says %dB", len(body), p.Length)
+	}
+	return p.Operation.UnmarshalBinary(data[headerSize:])
 }
 
-// WriteTo serializes p in its wire format into w.
+// WriteTo serializes p in its wire format into w, with a single call to
+// w.Write. The wire format is built in a pooled buffer, so that writing
+// packets doesn't allocate.
 func (p *Packet) WriteTo(w io.Writer) (n int64, err error) {
-	n, err = p.Header.WriteTo(w)
-	if err != nil {
-		return n, err
-	}
-	nn, err := p.Operation.WriteTo(w)
-	n += nn
-	return n, err
+	buf := getBuffer()
+	defer putBuffer(buf)
+	*buf = p.Operation.appendBinary(p.Header.appendBinary(*buf))
+	nn, err := w.Write(*buf)
+	return int64(nn), err
+}
+
+// bufferPool holds the buffers packets are serialized into by WriteTo. It
+// holds pointers to slices so that putting them back doesn't allocate.
+var bufferPool = sync.Pool{
+	New: func() interface{} {
+		b := make([]byte, 0, paddedLength)
+		return &b
+	},
 }
 
+func getBuffer() *[]byte {
+	return bufferPool.Get().(*[]byte)
+}
+
+// putBuffer returns buf to the pool. Every packet fits in MaxPacketLength, so
+// buffers don't grow any larger.
+func putBuffer(buf *[]byte) {
+	*buf = (*buf)[:0]
+	bufferPool.Put(buf)
+}
+
+// ErrPacketTooLarge is returned by ReadFromLimit for packets whose body is
+// longer than the limit. Only the header of the packet is set.
+var ErrPacketTooLarge = errors.New("keyless: packet too large")
+
 // ReadFrom deserializes into p from its wire format read from r.
 func (p *Packet) ReadFrom(r io.Reader) (n int64, err error) {
+	return p.ReadFromLimit(r, 0)
+}
+
+// ReadFromLimit is like ReadFrom, but discards the body of a packet longer
+// than limit bytes instead of buffering it, and returns ErrPacketTooLarge, so
+// that the next packet can still be read. Zero means no limit.
+func (p *Packet) ReadFromLimit(r io.Reader, limit int) (n int64, err error) {
 	n, err = p.Header.ReadFrom(r)
 	if err != nil {
 		return n, err
 	}
+	// Check the header before allocating the body, so that garbage isn't
+	// buffered.
+	if err := p.Header.validate(); err != nil {
+		return n, err
+	}
+	if limit > 0 && int(p.Length) > limit {
+		nn, err := io.CopyN(ioutil.Discard, r, int64(p.Length))
+		n += nn
+		if err != nil {
+			return n, err
+		}
+		return n, ErrPacketTooLarge
+	}
 	body := make([]byte, int(p.Length))
 	nn, err := io.ReadFull(r, body)
 	n += int64(nn)
@@ -397,6 +638,65 @@ func (p *Packet) ReadFrom(r io.Reader) (n int64, err error) {
 	return n, p.Operation.UnmarshalBinary(body)
 }
 
+// CheckPadding validates the padding of a packet decoded by UnmarshalBinary or
+// ReadFrom, which accept any padding: padding items must be all zero bytes
+// and, if required is set, the packet must be padded to at least 1024 bytes.
+// Invalid padding is reported with a *ParseError.
+func (p *Packet) CheckPadding(required bool) error {
+	if p.paddingErr != nil {
+		return p.paddingErr
+	}
+	if length := headerSize + int(p.Length); required && length < paddedLength {
+		return parseErrorf(headerSize, "packet is %dB, but must be padded to %dB", length, paddedLength)
+	}
+	return nil
+}
+
+// Priority is how urgently a client needs the response to a request.
+type Priority byte
+
+const (
+	// PriorityNormal is the priority of requests which don't set one.
+	PriorityNormal Priority = 0x00
+	// PriorityHigh is for requests something is waiting on, such as signatures
+	// for TLS handshakes.
+	PriorityHigh Priority = 0x01
+	// PriorityLow is for background work, such as signing OCSP responses.
+	PriorityLow Priority = 0x02
+)
+
+// Timing is the time a server spent on a request, which it may attach to the
+// response so that clients can tell network latency from server-side
+// queueing. Each is sent with microsecond precision, and at most
+// math.MaxUint32 microseconds.
+type Timing struct {
+	// Queue is the time from reading the request to a worker picking it up.
+	Queue time.Duration
+	// Processing is the time from then until the response was written.
+	Processing time.Duration
+}
+
+// IsZero reports whether t is unset.
+func (t Timing) IsZero() bool {
+	return t.Queue <= 0 && t.Processing <= 0
+}
+
+// timingBytes returns the wire format of t.
+func timingBytes(t Timing) (b [8]byte) {
+	micros := func(d time.Duration) uint32 {
+		switch {
+		case d <= 0:
+			return 0
+		case d/time.Microsecond > math.MaxUint32:
+			return math.MaxUint32
+		}
+		return uint32(d / time.Microsecond)
+	}
+	binary.BigEndian.PutUint32(b[:4], micros(t.Queue))
+	binary.BigEndian.PutUint32(b[4:], micros(t.Processing))
+	return b
+}
+
 // Operation defines a single (repeatable) keyless operation.
 type Operation struct {
 	Opcode         Op
@@ -410,6 +710,33 @@ type Operation struct {
 	CertID         string
 	CustomFuncName string
 	JaegerSpan     []byte
+	// NoPadding omits the padding item when serialising. It must only be set
+	// once the peer has agreed to PaddingOptional with OpHello.
+	NoPadding bool
+	// MinLength, if set, pads the packet to at least MinLength bytes, header
+	// included, even if NoPadding is set, so that the lengths of responses
+	// don't give away what they carry.
+	MinLength int
+	// Compression is the algorithm Payload is compressed with, as set by
+	// Compress. It is always CompressionNone after UnmarshalBinary, which
+	// decompresses the payload.
+	Compression Compression
+	// Budget, if positive, is how long the client will wait for the
+	// response. Servers shed requests which queued for longer with
+	// ErrTimedOut. It is sent with millisecond precision.
+	Budget time.Duration
+	// Priority is how urgently the client needs the response. Servers serve
+	// queued PriorityHigh requests first, and PriorityLow ones last. Unknown
+	// priorities are treated as PriorityNormal.
+	Priority Priority
+	// Timing, if set on a response, is the time the server spent on the
+	// request. Servers only send it to clients which negotiated
+	// FeatureTiming with OpHello.
+	Timing Timing
+
+	// paddingErr is set by UnmarshalBinary if a padding item isn't all zero
+	// bytes. See Packet.CheckPadding.
+	paddingErr error
 }
 
 func (o *Operation) String() string {
@@ -425,9 +752,18 @@ func (o *Operation) String() string {
 
 // tlvBytes returns the byte representation of a Tag-Length-Value item.
 func tlvBytes(tag Tag, data []byte) []byte {
-	b := make([]byte, 3)
-	b[0] = byte(tag)
-	binary.BigEndian.PutUint16(b[1:3], uint16(len(data)))
+	return appendTLV(make([]byte, 0, 3+len(data)), tag, data...)
+}
+
+// appendTLV appends the Tag-Length-Value item of tag and data to b.
+func appendTLV(b []byte, tag Tag, data ...byte) []byte {
+	b = append(b, byte(tag), byte(len(data)>>8), byte(len(data)))
+	return append(b, data...)
+}
+
+// appendTLVString is appendTLV for string data, which it doesn't copy first.
+func appendTLVString(b []byte, tag Tag, data string) []byte {
+	b = append(b, byte(tag), byte(len(data)>>8), byte(len(data)))
 	return append(b, data...)
 }
 
@@ -500,44 +836,73 @@ func (o *Operation) Bytes() uint16 {
 	if o.JaegerSpan != nil {
 		add(tlvLen(len(o.JaegerSpan)))
 	}
-	if int(length)+headerSize < paddedLength {
-		// TODO: Are we sure that's the right behavior?
-
-		// The +3 is to make room for the Tag and Length values in the TLV header.
-		left := paddedLength - (int(length) + headerSize + 3)
-		if left < 0 {
-			// It's possible that we were within 2 or 1 bytes of the padded length,
-			// in which case the 3 bytes of the TLV header take us past the end, so
-			// we calculate a negative length for the padding bytes. In that case,
-			// just use 0 padding bytes (and we'll go over the padding minimum by
-			// 1 or 2 bytes; oh well).
-			left = 0
-		}
-
+	if o.Compression != CompressionNone {
+		add(tlvLen(1))
+	}
+	if o.Budget > 0 {
+		add(tlvLen(4))
+	}
+	if o.Priority != PriorityNormal {
+		add(tlvLen(1))
+	}
+	if !o.Timing.IsZero() {
+		add(tlvLen(8))
+	}
+	if left := o.paddingLength(int(length)); left >= 0 {
 		add(tlvLen(left))
 	}
 	return length
 }
 
+// paddingLength returns the length of the data of the padding item o needs
+// after unpadded bytes of other items, or -1 if it needs none. Packets are
+// padded to 1024 bytes unless NoPadding is set, or to MinLength if longer.
+func (o *Operation) paddingLength(unpadded int) int {
+	target := o.MinLength
+	if !o.NoPadding && target < paddedLength {
+		target = paddedLength
+	}
+	if target > MaxPacketLength {
+		target = MaxPacketLength
+	}
+	// The +3 is to make room for the Tag and Length values in the TLV header.
+	if unpadded+headerSize >= target || unpadded+headerSize+3 > MaxPacketLength {
+		return -1
+	}
+	// It's possible that we were within 2 or 1 bytes of the target length, in
+	// which case the 3 bytes of the TLV header take us past it. In that case,
+	// just use 0 padding bytes (and we'll go over the target by 1 or 2 bytes).
+	left := target - (unpadded + headerSize + 3)
+	if left < 0 {
+		left = 0
+	}
+	return left
+}
+
 // MarshalBinary serialises o using a TLV encoding.
 func (o *Operation) MarshalBinary() ([]byte, error) {
-	var b []byte
+	return o.appendBinary(make([]byte, 0, paddedLength)), nil
+}
 
-	b = append(b, tlvBytes(TagOpcode, []byte{byte(o.Opcode)})...)
+// appendBinary appends the TLV encoding of o to b, without allocating if b has
+// enough capacity.
+func (o *Operation) appendBinary(b []byte) []byte {
+	start := len(b)
+	b = appendTLV(b, TagOpcode, byte(o.Opcode))
 
 	if len(o.Payload) > 0 {
-		b = append(b, tlvBytes(TagPayload, o.Payload)...)
+		b = appendTLV(b, TagPayload, o.Payload...)
 	}
 	if len(o.Extra) > 0 {
-		b = append(b, tlvBytes(TagExtra, o.Extra)...)
+		b = appendTLV(b, TagExtra, o.Extra...)
 	}
 
 	if o.SKI.Valid() {
-		b = append(b, tlvBytes(TagSubjectKeyIdentifier, o.SKI[:])...)
+		b = appendTLV(b, TagSubjectKeyIdentifier, o.SKI[:]...)
 	}
 
 	if o.Digest.Valid() {
-		b = append(b, tlvBytes(TagCertificateDigest, o.Digest[:])...)
+		b = appendTLV(b, TagCertificateDigest, o.Digest[:]...)
 	}
 
 	if o.ClientIP != nil {
@@ -545,7 +910,7 @@ func (o *Operation) MarshalBinary() ([]byte, error) {
 		if ip == nil {
 			ip = o.ClientIP
 		}
-		b = append(b, tlvBytes(TagClientIP, ip)...)
+		b = appendTLV(b, TagClientIP, ip...)
 	}
 
 	if o.ServerIP != nil {
@@ -553,77 +918,81 @@ func (o *Operation) MarshalBinary() ([]byte, error) {
 		if ip == nil {
 			ip = o.ServerIP
 		}
-		b = append(b, tlvBytes(TagServerIP, ip)...)
+		b = appendTLV(b, TagServerIP, ip...)
 	}
 
 	if o.SNI != "" {
-		b = append(b, tlvBytes(TagServerName, []byte(o.SNI))...)
+		b = appendTLVString(b, TagServerName, o.SNI)
 	}
 
 	if o.CertID != "" {
-		b = append(b, tlvBytes(TagCertID, []byte(o.CertID))...)
+		b = appendTLVString(b, TagCertID, o.CertID)
 	}
 
 	if o.CustomFuncName != "" {
-		b = append(b, tlvBytes(TagCustomFuncName, []byte(o.CustomFuncName))...)
+		b = appendTLVString(b, TagCustomFuncName, o.CustomFuncName)
 	}
 	if o.JaegerSpan != nil {
-		b = append(b, tlvBytes(TagJaegerSpan, o.JaegerSpan)...)
+		b = appendTLV(b, TagJaegerSpan, o.JaegerSpan...)
+	}
+	if o.Compression != CompressionNone {
+		b = appendTLV(b, TagCompression, byte(o.Compression))
+	}
+	if o.Budget > 0 {
+		budget := budgetBytes(o.Budget)
+		b = appendTLV(b, TagBudget, budget[:]...)
+	}
+	if o.Priority != PriorityNormal {
+		b = appendTLV(b, TagPriority, byte(o.Priority))
+	}
+	if !o.Timing.IsZero() {
+		timing := timingBytes(o.Timing)
+		b = appendTLV(b, TagTiming, timing[:]...)
 	}
 
-	if len(b)+headerSize < paddedLength {
-		// TODO: Are we sure that's the right behavior?
-
-		// The +3 is to make room for the Tag and Length values in the TLV header.
-		left := paddedLength - (len(b) + headerSize + 3)
-		if left < 0 {
-			// It's possible that we were within 2 or 1 bytes of the padded length,
-			// in which case the 3 bytes of the TLV header take us past the end, so
-			// we calculate a negative length for the padding bytes. In that case,
-			// just use 0 padding bytes (and we'll go over the padding minimum by
-			// 1 or 2 bytes; oh well).
-			left = 0
-		}
-
-		padding := make([]byte, left)
-		b = append(b, tlvBytes(TagPadding, padding)...)
+	if left := o.paddingLength(len(b) - start); left >= 0 {
+		b = append(b, byte(TagPadding), byte(left>>8), byte(left))
+		b = append(b, make([]byte, left)...)
 	}
-	return b, nil
+	return b
 }
 
 // UnmarshalBinary unmarshalls a binary-encoded TLV list of items into o.
-// It guarantees that ClientIP and ServerIP, if present, are each 4 or 16 bytes.
+// It guarantees that ClientIP and ServerIP, if present, are each 4 or 16 bytes,
+// and decompresses the payload if it is compressed. Malformed bodies are
+// rejected with a *ParseError. The byte slices of o, such as Payload, alias
+// body rather than copying it.
 func (o *Operation) UnmarshalBinary(body []byte) error {
+	return o.unmarshal(body, true)
+}
+
+// unmarshal is UnmarshalBinary, but rejects compressed payloads unless
+// compressed is set.
+func (o *Operation) unmarshal(body []byte, compressed bool) error {
 	// seen has enough entries to be indexed by any valid Tag value. If more tags
 	// are added later, change this code!
 	var seen [33]bool
-	var length int
+	var payloadOffset int
+	o.paddingErr = nil
 
-	validateIP := func(ip net.IP) (net.IP, error) {
+	validateIP := func(offset int, what string, ip net.IP) (net.IP, error) {
 		if len(ip) != 4 && len(ip) != 16 {
-			return nil, fmt.Errorf("invalid byte length for IP address: %v", len(ip))
+			return nil, parseErrorf(offset, "invalid byte length for %s IP address: %v", what, len(ip))
 		}
 		return ip, nil
 	}
 
-	for i := 0; i+2 < len(body); i += 3 + length {
-		tag := Tag(body[i])
-
-		length = int(binary.BigEndian.Uint16(body[i+1 : i+3]))
-		if i+3+length > len(body) {
-			return fmt.Errorf("%02x length is %dB beyond end of body", tag, i+3+length-len(body))
-		}
-
-		data := body[i+3 : i+3+length]
-
+	err := parseItems(body, func(b byte, offset int, data []byte) (err error) {
+		tag := Tag(b)
 		switch tag {
 		case TagOpcode:
 			if len(data) != 1 {
-				return fmt.Errorf("invalid opcode: %s", data)
+				return parseErrorf(offset, "invalid opcode: %x", data)
 			}
 			o.Opcode = Op(data[0])
 		case TagPayload:
 			o.Payload = data
+			payloadOffset = offset
 		case TagExtra:
 			o.Extra = data
 		case TagSubjectKeyIdentifier:
@@ -635,51 +1004,113 @@ func (o *Operation) UnmarshalBinary(body []byte) error {
 				copy(o.Digest[:], data)
 			}
 		case TagClientIP:
-			ip, err := validateIP(data)
-			if err != nil {
-				return fmt.Errorf("malformed client IP: %v", err)
+			if o.ClientIP, err = validateIP(offset, "client", data); err != nil {
+				return err
 			}
-			o.ClientIP = ip
 		case TagServerIP:
-			ip, err := validateIP(data)
-			if err != nil {
-				return fmt.Errorf("malformed server IP: %v", err)
+			if o.ServerIP, err = validateIP(offset, "server", data); err != nil {
+				return err
 			}
-			o.ServerIP = ip
 		case TagServerName:
 			o.SNI = string(data)
 		case TagCertID:
 			o.CertID = string(data)
 		case TagPadding:
-			// ignore padding
+			// Padding is only validated by CheckPadding, so that decoding
+			// accepts the packets of lax peers.
+			if o.paddingErr == nil && !allZero(data) {
+				o.paddingErr = parseErrorf(offset, "non-zero padding")
+			}
 		case TagCustomFuncName:
 			o.CustomFuncName = string(data)
 		case TagJaegerSpan:
 			o.JaegerSpan = data
+		case TagCompression:
+			if !compressed {
+				return parseErrorf(offset, "unexpected compressed payload")
+			}
+			if len(data) != 1 {
+				return parseErrorf(offset, "invalid compression: %x", data)
+			}
+			o.Compression = Compression(data[0])
+		case TagBudget:
+			if len(data) != 4 {
+				return parseErrorf(offset, "invalid budget: %x", data)
+			}
+			o.Budget = time.Duration(binary.BigEndian.Uint32(data)) * time.Millisecond
+		case TagPriority:
+			if len(data) != 1 {
+				return parseErrorf(offset, "invalid priority: %x", data)
+			}
+			o.Priority = Priority(data[0])
+		case TagTiming:
+			if len(data) != 8 {
+				return parseErrorf(offset, "invalid timing: %x", data)
+			}
+			o.Timing = Timing{
+				Queue:      time.Duration(binary.BigEndian.Uint32(data[:4])) * time.Microsecond,
+				Processing: time.Duration(binary.BigEndian.Uint32(data[4:])) * time.Microsecond,
+			}
 		default:
 			// Silently ignore any unknown tags (to allow for new tags to be gradually added to the protocol).
-			continue
+			return nil
 		}
 
 		// only use tag as an index in seen after we've validated that it's a tag
 		// that we recognize, and thus won't be out of bounds.
 		if seen[tag] {
-			return fmt.Errorf("tag %02x seen multiple times", tag)
+			return parseErrorf(offset, "tag %02x seen multiple times", byte(tag))
 		}
 		seen[tag] = true
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+	if !seen[TagOpcode] {
+		return parseErrorf(0, "missing opcode")
+	}
+	if o.Compression != CompressionNone {
+		payload, err := decompress(o.Compression, o.Payload)
+		if err != nil {
+			return parseErrorf(payloadOffset, "%v", err)
+		}
+		o.Payload, o.Compression = payload, CompressionNone
 	}
 	return nil
 }
 
+func allZero(b []byte) bool {
+	for _, c := range b {
+		if c != 0 {
+			return false
+		}
+	}
+	return true
+}
+
+// budgetBytes encodes budget as a number of milliseconds, rounded up so that
+// short budgets aren't sent as zero.
+func budgetBytes(budget time.Duration) [4]byte {
+	ms := budget / time.Millisecond
+	if budget%time.Millisecond != 0 {
+		ms++
+	}
+	if ms > math.MaxUint32 {
+		ms = math.MaxUint32
+	}
+	var b [4]byte
+	binary.BigEndian.PutUint32(b[:], uint32(ms))
+	return b
+}
+
 // WriteTo serializes o in its wire format into w.
 func (o *Operation) WriteTo(w io.Writer) (n int64, err error) {
-	buf, err := o.MarshalBinary()
-	if err != nil {
-		return 0, err
-	}
-	nn, err := w.Write(buf)
-	n = int64(nn)
-	return n, err
+	buf := getBuffer()
+	defer putBuffer(buf)
+	*buf = o.appendBinary(*buf)
+	nn, err := w.Write(*buf)
+	return int64(nn), err
 }
 
 // TODO(joshlf): Should GetError return nil if o.Opcode != OpError?
@@ -19,18 +19,22 @@ func _() {
 	_ = x[TagCustomFuncName-19]
 	_ = x[TagExtra-20]
 	_ = x[TagJaegerSpan-21]
+	_ = x[TagCompression-22]
+	_ = x[TagBudget-23]
+	_ = x[TagPriority-24]
+	_ = x[TagTiming-25]
 	_ = x[TagPadding-32]
 }
 
 const (
 	_Tag_name_0 = "TagCertificateDigestTagServerNameTagClientIPTagSubjectKeyIdentifierTagServerIPTagCertID"
-	_Tag_name_1 = "TagOpcodeTagPayloadTagCustomFuncNameTagExtraTagJaegerSpan"
+	_Tag_name_1 = "TagOpcodeTagPayloadTagCustomFuncNameTagExtraTagJaegerSpanTagCompressionTagBudgetTagPriorityTagTiming"
 	_Tag_name_2 = "TagPadding"
 )
 
 var (
 	_Tag_index_0 = [...]uint8{0, 20, 33, 44, 67, 78, 87}
-	_Tag_index_1 = [...]uint8{0, 9, 19, 36, 44, 57}
+	_Tag_index_1 = [...]uint8{0, 9, 19, 36, 44, 57, 71, 80, 91, 100}
 )
 
 func (i Tag) String() string {
@@ -38,7 +42,7 @@ func (i Tag) String() string {
 	case 1 <= i && i <= 6:
 		i -= 1
 		return _Tag_name_0[_Tag_index_0[i]:_Tag_index_0[i+1]]
-	case 17 <= i && i <= 21:
+	case 17 <= i && i <= 25:
 		i -= 17
 		return _Tag_name_1[_Tag_index_1[i]:_Tag_index_1[i+1]]
 	case i == 32:
@@ -68,31 +72,45 @@ func _() {
 	_ = x[OpECDSASignSHA384-22]
 	_ = x[OpECDSASignSHA512-23]
 	_ = x[OpEd25519Sign-24]
+	_ = x[OpSM2SignSM3-25]
 	_ = x[OpSeal-33]
 	_ = x[OpUnseal-34]
 	_ = x[OpRPC-35]
 	_ = x[OpCustom-36]
+	_ = x[OpGetTicketKeys-37]
+	_ = x[OpGetCapabilities-38]
+	_ = x[OpHello-39]
+	_ = x[OpAttest-40]
+	_ = x[OpBatch-41]
+	_ = x[OpOCSPSign-42]
+	_ = x[OpAuthenticate-43]
+	_ = x[OpGetManifest-44]
+	_ = x[OpProbeKey-45]
+	_ = x[OpGetCertificates-46]
+	_ = x[OpStream-47]
 	_ = x[OpPing-241]
 	_ = x[OpPong-242]
+	_ = x[OpKeyRemoved-243]
+	_ = x[OpReconnect-244]
 	_ = x[OpResponse-240]
 	_ = x[OpError-255]
 }
 
 const (
 	_Op_name_0 = "OpRSADecryptOpRSASignMD5SHA1OpRSASignSHA1OpRSASignSHA224OpRSASignSHA256OpRSASignSHA384OpRSASignSHA512"
-	_Op_name_1 = "OpECDSASignMD5SHA1OpECDSASignSHA1OpECDSASignSHA224OpECDSASignSHA256OpECDSASignSHA384OpECDSASignSHA512OpEd25519Sign"
-	_Op_name_2 = "OpSealOpUnsealOpRPCOpCustom"
+	_Op_name_1 = "OpECDSASignMD5SHA1OpECDSASignSHA1OpECDSASignSHA224OpECDSASignSHA256OpECDSASignSHA384OpECDSASignSHA512OpEd25519SignOpSM2SignSM3"
+	_Op_name_2 = "OpSealOpUnsealOpRPCOpCustomOpGetTicketKeysOpGetCapabilitiesOpHelloOpAttestOpBatchOpOCSPSignOpAuthenticateOpGetManifestOpProbeKeyOpGetCertificatesOpStream"
 	_Op_name_3 = "OpRSAPSSSignSHA256OpRSAPSSSignSHA384OpRSAPSSSignSHA512"
-	_Op_name_4 = "OpResponseOpPingOpPong"
+	_Op_name_4 = "OpResponseOpPingOpPongOpKeyRemovedOpReconnect"
 	_Op_name_5 = "OpError"
 )
 
 var (
 	_Op_index_0 = [...]uint8{0, 12, 28, 41, 56, 71, 86, 101}
-	_Op_index_1 = [...]uint8{0, 18, 33, 50, 67, 84, 101, 114}
-	_Op_index_2 = [...]uint8{0, 6, 14, 19, 27}
+	_Op_index_1 = [...]uint8{0, 18, 33, 50, 67, 84, 101, 114, 126}
+	_Op_index_2 = [...]uint8{0, 6, 14, 19, 27, 42, 59, 66, 74, 81, 91, 105, 118, 128, 145, 153}
 	_Op_index_3 = [...]uint8{0, 18, 36, 54}
-	_Op_index_4 = [...]uint8{0, 10, 16, 22}
+	_Op_index_4 = [...]uint8{0, 10, 16, 22, 34, 45}
 )
 
 func (i Op) String() string {
@@ -100,16 +118,16 @@ func (i Op) String() string {
 	case 1 <= i && i <= 7:
 		i -= 1
 		return _Op_name_0[_Op_index_0[i]:_Op_index_0[i+1]]
-	case 18 <= i && i <= 24:
+	case 18 <= i && i <= 25:
 		i -= 18
 		return _Op_name_1[_Op_index_1[i]:_Op_index_1[i+1]]
-	case 33 <= i && i <= 36:
+	case 33 <= i && i <= 47:
 		i -= 33
 		return _Op_name_2[_Op_index_2[i]:_Op_index_2[i+1]]
 	case 53 <= i && i <= 55:
 		i -= 53
 		return _Op_name_3[_Op_index_3[i]:_Op_index_3[i+1]]
-	case 240 <= i && i <= 242:
+	case 240 <= i && i <= 244:
 		i -= 240
 		return _Op_name_4[_Op_index_4[i]:_Op_index_4[i+1]]
 	case i == 255:
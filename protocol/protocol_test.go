@@ -2,11 +2,20 @@ package protocol
 
 import (
 	"bytes"
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/elliptic"
 	"crypto/rand"
+	"crypto/rsa"
 	"crypto/sha1"
 	"crypto/sha256"
+	"errors"
+	"io/ioutil"
+	"math"
 	"net"
+	"runtime"
 	"testing"
+	"time"
 
 	"github.com/stretchr/testify/require"
 )
@@ -43,3 +52,520 @@ func TestMarshalBinary(t *testing.T) {
 	require.Equal(pkt.ID, pkt2.ID)
 	require.Equal(op, pkt2.Operation)
 }
+
+// benchRequest returns a typical ECDSA signing request.
+func benchRequest() Packet {
+	digest := sha256.Sum256([]byte("message"))
+	return NewPacket(42, Operation{
+		Opcode:   OpECDSASignSHA256,
+		Payload:  digest[:],
+		SKI:      sha1.Sum([]byte("SKI")),
+		ServerIP: net.ParseIP("2.2.2.2").To4(),
+		SNI:      "example.com",
+	})
+}
+
+func TestWriteToAllocs(t *testing.T) {
+	require := require.New(t)
+
+	pkt := benchRequest()
+	var buf bytes.Buffer
+	_, err := pkt.WriteTo(&buf)
+	require.NoError(err)
+	b, err := pkt.MarshalBinary()
+	require.NoError(err)
+	require.Equal(b, buf.Bytes())
+	require.Equal(int(pkt.Length)+headerSize, len(b))
+
+	allocs := testing.AllocsPerRun(100, func() {
+		pkt.WriteTo(ioutil.Discard)
+	})
+	require.Zero(allocs)
+}
+
+func TestFeatures(t *testing.T) {
+	require := require.New(t)
+
+	f := Features{
+		Version:     Version,
+		Ops:         []Op{OpPing, OpEd25519Sign},
+		MaxPayload:  4096,
+		Compression: []Compression{1, 2},
+		Padding:     PaddingOptional,
+		Keepalive:   true,
+		SKISchemes:  []SKIScheme{SKISchemeSHA256, SKISchemeSHA1},
+		KeyRemoved:  true,
+		Timing:      true,
+	}
+	b, err := f.MarshalBinary()
+	require.NoError(err)
+
+	// Unknown features are ignored.
+	b = append(b, tlvBytes(Tag(0x7F), []byte("future"))...)
+	var f2 Features
+	require.NoError(f2.UnmarshalBinary(b))
+	require.Equal(f, f2)
+
+	// Missing features take their version 1 values.
+	require.NoError(f2.UnmarshalBinary(nil))
+	require.Equal(V1Features, f2)
+
+	n := Negotiate(f, Features{
+		Version:     3,
+		Ops:         []Op{OpEd25519Sign, OpSeal},
+		MaxPayload:  8192,
+		Compression: []Compression{2},
+		Padding:     PaddingOptional,
+		Keepalive:   true,
+		SKISchemes:  []SKIScheme{SKISchemeSHA1, SKISchemeSHA256},
+		Timing:      true,
+	})
+	require.Equal(Features{
+		Version:     Version,
+		Ops:         []Op{OpEd25519Sign},
+		MaxPayload:  4096,
+		Compression: []Compression{2},
+		Padding:     PaddingOptional,
+		Keepalive:   true,
+		SKISchemes:  []SKIScheme{SKISchemeSHA256, SKISchemeSHA1},
+		Timing:      true,
+	}, n)
+	require.Equal(SKISchemeSHA256, n.SKIScheme())
+
+	n = Negotiate(f, V1Features)
+	require.Equal(uint8(1), n.Version)
+	require.Equal(PaddingRequired, n.Padding)
+	require.Equal(f.Ops, n.Ops)
+	require.Empty(n.Compression)
+	require.False(n.Keepalive)
+	require.False(n.KeyRemoved)
+	require.False(n.Timing)
+	// Peers which predate SKI schemes only know SHA-1 SKIs.
+	require.Equal([]SKIScheme{SKISchemeSHA1}, n.SKISchemes)
+	require.Equal(SKISchemeSHA1, V1Features.SKIScheme())
+
+	op := Operation{Opcode: OpPing, NoPadding: true}
+	b, err = op.MarshalBinary()
+	require.NoError(err)
+	require.Equal(int(op.Bytes()), len(b))
+	require.Equal(tlvBytes(TagOpcode, []byte{byte(OpPing)}), b)
+}
+
+func TestAttestation(t *testing.T) {
+	require := require.New(t)
+
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	require.NoError(err)
+	a := Attestation{
+		Nonce:     []byte("nonce"),
+		CertHash:  sha256.Sum256([]byte("cert")),
+		SKIs:      []SKI{{1}, {2}},
+		BuildHash: []byte("build"),
+	}
+	require.NoError(a.Sign(key))
+	require.NoError(a.Verify(key.Public()))
+
+	b, err := a.MarshalBinary()
+	require.NoError(err)
+	var a2 Attestation
+	require.NoError(a2.UnmarshalBinary(b))
+	require.NoError(a2.Verify(key.Public()))
+	require.Equal(a.Nonce, a2.Nonce)
+	require.Equal(a.CertHash, a2.CertHash)
+	require.Equal(a.SKIs, a2.SKIs)
+	require.Equal(a.BuildHash, a2.BuildHash)
+
+	// Unknown items are ignored, but covered by the signature.
+	unknown := append(tlvBytes(Tag(0x7F), []byte("future")), b...)
+	require.NoError(a2.UnmarshalBinary(unknown))
+	require.Equal(ErrAttestation, a2.Verify(key.Public()))
+
+	other, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	require.NoError(err)
+	require.NoError(a2.UnmarshalBinary(b))
+	require.Equal(ErrAttestation, a2.Verify(other.Public()))
+
+	require.Error(a2.UnmarshalBinary(b[:len(b)-len(a.Signature)-3]))
+}
+
+func TestManifest(t *testing.T) {
+	require := require.New(t)
+
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	require.NoError(err)
+	listed, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	require.NoError(err)
+	ski, err := GetSKI(listed.Public())
+	require.NoError(err)
+	m := Manifest{
+		Issued: time.Unix(1600000000, 0),
+		Keys:   []PublicKey{{SKI: ski, Public: listed.Public()}},
+	}
+	require.NoError(m.Sign(key))
+
+	b, err := m.MarshalBinary()
+	require.NoError(err)
+	var m2 Manifest
+	require.NoError(m2.UnmarshalBinary(b))
+	require.NoError(m2.Verify(key.Public()))
+	require.True(m.Issued.Equal(m2.Issued))
+	require.Equal(m.Keys, m2.Keys)
+	require.Equal(ErrManifest, m2.Verify(listed.Public()))
+
+	// Unknown items are ignored, but covered by the signature.
+	unknown := append(tlvBytes(Tag(0x7F), []byte("future")), b...)
+	require.NoError(m2.UnmarshalBinary(unknown))
+	require.Equal(ErrManifest, m2.Verify(key.Public()))
+
+	require.Error(m2.UnmarshalBinary(b[:len(b)-len(m.Signature)-3]))
+
+	// Keys must match their SKI.
+	m.Keys[0].SKI = SKI{1}
+	require.NoError(m.Sign(key))
+	b, err = m.MarshalBinary()
+	require.NoError(err)
+	require.Error(m2.UnmarshalBinary(b))
+}
+
+func TestBatch(t *testing.T) {
+	require := require.New(t)
+
+	ops := []Operation{
+		{Opcode: OpPing, Payload: []byte("ping")},
+		{Opcode: OpECDSASignSHA256, Payload: make([]byte, 32), SKI: SKI{1}},
+	}
+	b, err := MarshalBatch(ops)
+	require.NoError(err)
+	got, err := UnmarshalBatch(b)
+	require.NoError(err)
+	require.Len(got, 2)
+	for i := range ops {
+		require.Equal(ops[i].Opcode, got[i].Opcode)
+		require.Equal(ops[i].Payload, got[i].Payload)
+		require.Equal(ops[i].SKI, got[i].SKI)
+	}
+
+	_, err = UnmarshalBatch(b[:len(b)-1])
+	require.Error(err)
+	_, err = MarshalBatch([]Operation{{Opcode: OpBatch}})
+	require.Error(err)
+}
+
+func TestCompression(t *testing.T) {
+	require := require.New(t)
+
+	payload := bytes.Repeat([]byte("certificate chain "), 100)
+	op := Operation{Opcode: OpSeal, Payload: payload, NoPadding: true}
+	require.NoError(op.Compress(CompressionDeflate))
+	require.Equal(CompressionDeflate, op.Compression)
+	require.True(len(op.Payload) < len(payload))
+
+	pkt := NewPacket(1, op)
+	b, err := pkt.MarshalBinary()
+	require.NoError(err)
+	require.Equal(int(pkt.Length)+8, len(b))
+	var pkt2 Packet
+	require.NoError(pkt2.UnmarshalBinary(b))
+	require.Equal(payload, pkt2.Payload)
+	require.Equal(CompressionNone, pkt2.Compression)
+
+	// Short and incompressible payloads are sent as they are.
+	short := Operation{Opcode: OpSeal, Payload: []byte("short")}
+	require.NoError(short.Compress(CompressionDeflate))
+	require.Equal(CompressionNone, short.Compression)
+	random := make([]byte, 1024)
+	_, err = rand.Read(random)
+	require.NoError(err)
+	incompressible := Operation{Opcode: OpSeal, Payload: random}
+	require.NoError(incompressible.Compress(CompressionDeflate))
+	require.Equal(random, incompressible.Payload)
+
+	// Payloads may not decompress beyond the maximum packet length.
+	bomb := Operation{Opcode: OpSeal, Payload: make([]byte, math.MaxUint16+1)}
+	require.NoError(bomb.Compress(CompressionDeflate))
+	b, err = bomb.MarshalBinary()
+	require.NoError(err)
+	require.Error(new(Operation).UnmarshalBinary(b))
+
+	unknown := Operation{Opcode: OpSeal, Payload: payload, Compression: 0x7F}
+	b, err = unknown.MarshalBinary()
+	require.NoError(err)
+	require.Error(new(Operation).UnmarshalBinary(b))
+}
+
+func TestParseErrors(t *testing.T) {
+	require := require.New(t)
+
+	pkt := NewPacket(1, Operation{Opcode: OpPing, Payload: []byte("ping")})
+	good, err := pkt.MarshalBinary()
+	require.NoError(err)
+
+	for name, b := range map[string][]byte{
+		"truncated header": good[:4],
+		"wrong version":    append([]byte{2}, good[1:]...),
+		"short body":       append(append([]byte(nil), good[:2]...), 0, 2, 0, 0, 0, 1, 0x11, 0),
+		"truncated body":   good[:len(good)-1],
+		"trailing bytes":   append(append([]byte(nil), good...), 0),
+	} {
+		var p Packet
+		var perr *ParseError
+		require.True(errors.As(p.UnmarshalBinary(b), &perr), name)
+	}
+
+	// Packets with a bad header are rejected before the body is read.
+	var p Packet
+	_, err = p.ReadFrom(bytes.NewReader(append([]byte{2}, good[1:8]...)))
+	var perr *ParseError
+	require.True(errors.As(err, &perr))
+
+	// The body of packets over the limit is skipped.
+	small := NewPacket(2, Operation{Opcode: OpPing, NoPadding: true})
+	b, err := small.MarshalBinary()
+	require.NoError(err)
+	r := bytes.NewReader(append(append([]byte(nil), good...), b...))
+	_, err = p.ReadFromLimit(r, int(small.Length))
+	require.Equal(ErrPacketTooLarge, err)
+	require.Equal(uint32(1), p.ID)
+	_, err = p.ReadFromLimit(r, int(small.Length))
+	require.NoError(err)
+	require.Equal(uint32(2), p.ID)
+
+	for name, body := range map[string][]byte{
+		"missing opcode":   tlvBytes(TagPayload, []byte("payload")),
+		"trailing bytes":   append(tlvBytes(TagOpcode, []byte{byte(OpPing)}), 0x12, 0),
+		"duplicate tag":    append(tlvBytes(TagOpcode, []byte{byte(OpPing)}), tlvBytes(TagOpcode, []byte{byte(OpPing)})...),
+		"invalid IP":       append(tlvBytes(TagOpcode, []byte{byte(OpPing)}), tlvBytes(TagClientIP, []byte{1, 2, 3})...),
+		"bad compression":  append(tlvBytes(TagOpcode, []byte{byte(OpPing)}), tlvBytes(TagCompression, []byte{byte(CompressionDeflate)})...),
+		"overrunning item": append(tlvBytes(TagOpcode, []byte{byte(OpPing)}), 0x12, 0, 9, 1),
+	} {
+		require.True(errors.As(new(Operation).UnmarshalBinary(body), &perr), name)
+	}
+
+	// Operations in a batch can't be compressed.
+	op := Operation{Opcode: OpSeal, Payload: bytes.Repeat([]byte("a"), 1024), NoPadding: true}
+	require.NoError(op.Compress(CompressionDeflate))
+	body, err := op.MarshalBinary()
+	require.NoError(err)
+	batch := append([]byte{byte(len(body) >> 8), byte(len(body))}, body...)
+	_, err = UnmarshalBatch(batch)
+	require.True(errors.As(err, &perr))
+}
+
+func TestBudget(t *testing.T) {
+	require := require.New(t)
+
+	for budget, sent := range map[time.Duration]time.Duration{
+		0:                       0,
+		-time.Second:            0,
+		time.Microsecond:        time.Millisecond,
+		1500 * time.Millisecond: 1500 * time.Millisecond,
+		math.MaxInt64:           math.MaxUint32 * time.Millisecond,
+	} {
+		op := Operation{Opcode: OpPing, Budget: budget}
+		b, err := op.MarshalBinary()
+		require.NoError(err)
+		require.Equal(int(op.Bytes()), len(b))
+		var op2 Operation
+		require.NoError(op2.UnmarshalBinary(b))
+		require.Equal(sent, op2.Budget, "budget %v", budget)
+	}
+
+	b := tlvBytes(TagOpcode, []byte{byte(OpPing)})
+	b = append(b, tlvBytes(TagBudget, []byte{1, 2})...)
+	var perr *ParseError
+	require.True(errors.As(new(Operation).UnmarshalBinary(b), &perr))
+}
+
+func TestPriority(t *testing.T) {
+	require := require.New(t)
+
+	for _, priority := range []Priority{PriorityNormal, PriorityHigh, PriorityLow, 0x7f} {
+		op := Operation{Opcode: OpPing, Priority: priority}
+		b, err := op.MarshalBinary()
+		require.NoError(err)
+		require.Equal(int(op.Bytes()), len(b))
+		var op2 Operation
+		require.NoError(op2.UnmarshalBinary(b))
+		require.Equal(priority, op2.Priority)
+	}
+
+	b := tlvBytes(TagOpcode, []byte{byte(OpPing)})
+	b = append(b, tlvBytes(TagPriority, []byte{1, 2})...)
+	var perr *ParseError
+	require.True(errors.As(new(Operation).UnmarshalBinary(b), &perr))
+}
+
+func TestPadding(t *testing.T) {
+	require := require.New(t)
+
+	for _, tc := range []struct {
+		op     Operation
+		length int
+	}{
+		{Operation{Opcode: OpPing}, paddedLength},
+		{Operation{Opcode: OpPing, NoPadding: true}, headerSize + 4},
+		{Operation{Opcode: OpPing, NoPadding: true, MinLength: 512}, 512},
+		{Operation{Opcode: OpPing, MinLength: 2048}, 2048},
+		{Operation{Opcode: OpPing, MinLength: 512}, paddedLength},
+		{Operation{Opcode: OpPing, MinLength: math.MaxInt32}, MaxPacketLength},
+	} {
+		pkt := NewPacket(1, tc.op)
+		b, err := pkt.MarshalBinary()
+		require.NoError(err)
+		require.Equal(tc.length, len(b), "%+v", tc.op)
+
+		var pkt2 Packet
+		require.NoError(pkt2.UnmarshalBinary(b))
+		require.NoError(pkt2.CheckPadding(false))
+		if tc.length >= paddedLength {
+			require.NoError(pkt2.CheckPadding(true))
+		} else {
+			require.Error(pkt2.CheckPadding(true))
+		}
+	}
+
+	// Non-zero padding is decoded, but rejected by CheckPadding.
+	b := tlvBytes(TagOpcode, []byte{byte(OpPing)})
+	b = append(b, tlvBytes(TagPadding, bytes.Repeat([]byte{1}, paddedLength))...)
+	pkt := NewPacket(1, Operation{})
+	pkt.Length = uint16(len(b))
+	hdr, err := pkt.Header.MarshalBinary()
+	require.NoError(err)
+	var pkt2 Packet
+	require.NoError(pkt2.UnmarshalBinary(append(hdr, b...)))
+	var perr *ParseError
+	require.True(errors.As(pkt2.CheckPadding(false), &perr))
+	require.Equal(4, perr.Offset)
+}
+
+func TestWrapKey(t *testing.T) {
+	require := require.New(t)
+
+	rsaKey, err := rsa.GenerateKey(rand.Reader, 2048)
+	require.NoError(err)
+	ecdsaKey, err := ecdsa.GenerateKey(elliptic.P384(), rand.Reader)
+	require.NoError(err)
+	other, err := ecdsa.GenerateKey(elliptic.P384(), rand.Reader)
+	require.NoError(err)
+
+	key := []byte("private key")
+	for _, priv := range []interface {
+		Public() crypto.PublicKey
+	}{rsaKey, ecdsaKey} {
+		wrapped, err := WrapKey(priv.Public(), key)
+		require.NoError(err)
+		require.False(bytes.Contains(wrapped, key))
+		unwrapped, err := UnwrapKey(priv, wrapped)
+		require.NoError(err)
+		require.Equal(key, unwrapped)
+
+		// Tampering is detected.
+		wrapped[len(wrapped)-1] ^= 1
+		_, err = UnwrapKey(priv, wrapped)
+		require.Equal(ErrWrappedKey, err)
+	}
+
+	wrapped, err := WrapKey(ecdsaKey.Public(), key)
+	require.NoError(err)
+	_, err = UnwrapKey(other, wrapped)
+	require.Equal(ErrWrappedKey, err)
+	_, err = UnwrapKey(ecdsaKey, wrapped[:10])
+	require.Equal(ErrWrappedKey, err)
+}
+
+func TestGetSKIScheme(t *testing.T) {
+	require := require.New(t)
+
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	require.NoError(err)
+	// The subjectPublicKey of an ECDSA key is its uncompressed point.
+	point := elliptic.Marshal(key.Curve, key.X, key.Y)
+
+	ski, err := GetSKIScheme(key.Public(), SKISchemeSHA1)
+	require.NoError(err)
+	require.Equal(SKI(sha1.Sum(point)), ski)
+	legacy, err := GetSKI(key.Public())
+	require.NoError(err)
+	require.Equal(ski, legacy)
+
+	ski, err = GetSKIScheme(key.Public(), SKISchemeSHA256)
+	require.NoError(err)
+	sum := sha256.Sum256(point)
+	require.Equal(sum[:len(ski)], ski[:])
+
+	_, err = GetSKIScheme(key.Public(), SKIScheme(0x7F))
+	require.Error(err)
+}
+
+// reportRate reports the allocations and allocated bytes per second the
+// benchmark's operation would cost at 50k requests per second, given the
+// memory statistics from before it ran.
+func reportRate(b *testing.B, before *runtime.MemStats) {
+	var after runtime.MemStats
+	runtime.ReadMemStats(&after)
+	const rate = 50000
+	n := float64(b.N)
+	b.ReportMetric(float64(after.Mallocs-before.Mallocs)/n*rate, "allocs/s@50k")
+	b.ReportMetric(float64(after.TotalAlloc-before.TotalAlloc)/n*rate, "B/s@50k")
+}
+
+func BenchmarkPacketWriteTo(b *testing.B) {
+	pkt := benchRequest()
+	b.ReportAllocs()
+	var before runtime.MemStats
+	runtime.ReadMemStats(&before)
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		pkt.WriteTo(ioutil.Discard)
+	}
+	reportRate(b, &before)
+}
+
+func BenchmarkPacketReadFrom(b *testing.B) {
+	req := benchRequest()
+	wire, err := req.MarshalBinary()
+	if err != nil {
+		b.Fatal(err)
+	}
+	r := bytes.NewReader(wire)
+	b.ReportAllocs()
+	var before runtime.MemStats
+	runtime.ReadMemStats(&before)
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		r.Reset(wire)
+		var pkt Packet
+		if _, err := pkt.ReadFrom(r); err != nil {
+			b.Fatal(err)
+		}
+	}
+	reportRate(b, &before)
+}
+
+// BenchmarkPacketRoundTrip reads a request and writes its response, as
+// servers do for each request, from parallel connections.
+func BenchmarkPacketRoundTrip(b *testing.B) {
+	req := benchRequest()
+	wire, err := req.MarshalBinary()
+	if err != nil {
+		b.Fatal(err)
+	}
+	signature := make([]byte, 72)
+	b.ReportAllocs()
+	var before runtime.MemStats
+	runtime.ReadMemStats(&before)
+	b.ResetTimer()
+	b.RunParallel(func(pb *testing.PB) {
+		r := bytes.NewReader(wire)
+		for pb.Next() {
+			r.Reset(wire)
+			var pkt Packet
+			if _, err := pkt.ReadFrom(r); err != nil {
+				b.Fatal(err)
+			}
+			resp := NewPacket(pkt.ID, MakeRespondOp(signature))
+			resp.WriteTo(ioutil.Discard)
+		}
+	})
+	reportRate(b, &before)
+}
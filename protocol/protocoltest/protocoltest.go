@@ -0,0 +1,167 @@
+// Package protocoltest provides a conformance suite for implementations of the
+// Keyless protocol's wire format. It consists of golden vectors of packets and
+// their encodings, covering each opcode and error code, the optional items and
+// the padding rules, and of malformed packets which must be rejected.
+//
+// Go implementations can run the suite with Run. Implementations in other
+// languages can run it against the vectors written by WriteJSON, which are
+// kept in testdata/vectors.json.
+package protocoltest
+
+import (
+	"bytes"
+	"encoding/hex"
+	"encoding/json"
+	"io"
+	"reflect"
+	"testing"
+	"time"
+
+	"github.com/cloudflare/gokeyless/protocol"
+)
+
+// A Codec is an implementation of the wire format under test.
+type Codec interface {
+	// Marshal encodes pkt, padding it unless pkt.NoPadding is set.
+	Marshal(pkt *protocol.Packet) ([]byte, error)
+	// Unmarshal decodes a packet, decompressing its payload if necessary.
+	Unmarshal(wire []byte) (*protocol.Packet, error)
+}
+
+// Run runs the conformance suite against c, as a subtest for each vector.
+func Run(t *testing.T, c Codec) {
+	for _, v := range Vectors() {
+		v := v
+		if !v.DecodeOnly {
+			t.Run("encode "+v.Name, func(t *testing.T) {
+				wire, err := c.Marshal(&v.Packet)
+				if err != nil {
+					t.Fatal(err)
+				}
+				if !bytes.Equal(wire, v.Wire) {
+					t.Fatalf("got\n%x\nwant\n%x", wire, v.Wire)
+				}
+			})
+		}
+		t.Run("decode "+v.Name, func(t *testing.T) {
+			pkt, err := c.Unmarshal(v.Wire)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if got, want := normalize(*pkt), normalize(v.Packet); !reflect.DeepEqual(got, want) {
+				t.Fatalf("got %+v, want %+v", got, want)
+			}
+		})
+	}
+	for _, m := range MalformedVectors() {
+		m := m
+		t.Run("reject "+m.Name, func(t *testing.T) {
+			if pkt, err := c.Unmarshal(m.Wire); err == nil {
+				t.Fatalf("decoded %+v", pkt)
+			}
+		})
+	}
+}
+
+// normalize clears the fields of pkt which decoding doesn't determine, and
+// replaces empty byte strings with nil.
+func normalize(pkt protocol.Packet) protocol.Packet {
+	op := &pkt.Operation
+	op.NoPadding = false
+	for _, b := range []*[]byte{&op.Payload, &op.Extra, &op.JaegerSpan} {
+		if len(*b) == 0 {
+			*b = nil
+		}
+	}
+	if len(op.ClientIP) == 0 {
+		op.ClientIP = nil
+	}
+	if len(op.ServerIP) == 0 {
+		op.ServerIP = nil
+	}
+	return pkt
+}
+
+type jsonVectors struct {
+	Vectors   []jsonVector    `json:"vectors"`
+	Malformed []jsonMalformed `json:"malformed"`
+}
+
+type jsonVector struct {
+	Name       string     `json:"name"`
+	Packet     jsonPacket `json:"packet"`
+	Wire       string     `json:"wire"`
+	DecodeOnly bool       `json:"decode_only,omitempty"`
+}
+
+// jsonPacket is a protocol.Packet with byte strings in hex.
+type jsonPacket struct {
+	ID             uint32 `json:"id"`
+	Length         uint16 `json:"length"`
+	Opcode         byte   `json:"opcode"`
+	Payload        string `json:"payload,omitempty"`
+	Extra          string `json:"extra,omitempty"`
+	SKI            string `json:"ski,omitempty"`
+	Digest         string `json:"digest,omitempty"`
+	ClientIP       string `json:"client_ip,omitempty"`
+	ServerIP       string `json:"server_ip,omitempty"`
+	SNI            string `json:"sni,omitempty"`
+	CertID         string `json:"cert_id,omitempty"`
+	CustomFuncName string `json:"custom_func_name,omitempty"`
+	JaegerSpan     string `json:"jaeger_span,omitempty"`
+	BudgetMillis   int64  `json:"budget_ms,omitempty"`
+	Priority       byte   `json:"priority,omitempty"`
+	NoPadding      bool   `json:"no_padding,omitempty"`
+}
+
+type jsonMalformed struct {
+	Name string `json:"name"`
+	Wire string `json:"wire"`
+}
+
+// WriteJSON writes the vectors to w as JSON, with byte strings, including IP
+// addresses, in hex.
+func WriteJSON(w io.Writer) error {
+	var out jsonVectors
+	for _, v := range Vectors() {
+		op := &v.Packet.Operation
+		pkt := jsonPacket{
+			ID:             v.Packet.ID,
+			Length:         v.Packet.Length,
+			Opcode:         byte(op.Opcode),
+			Payload:        hex.EncodeToString(op.Payload),
+			Extra:          hex.EncodeToString(op.Extra),
+			ClientIP:       hex.EncodeToString(op.ClientIP),
+			ServerIP:       hex.EncodeToString(op.ServerIP),
+			SNI:            op.SNI,
+			CertID:         op.CertID,
+			CustomFuncName: op.CustomFuncName,
+			JaegerSpan:     hex.EncodeToString(op.JaegerSpan),
+			BudgetMillis:   int64(op.Budget / time.Millisecond),
+			Priority:       byte(op.Priority),
+			NoPadding:      op.NoPadding,
+		}
+		if op.SKI.Valid() {
+			pkt.SKI = hex.EncodeToString(op.SKI[:])
+		}
+		if op.Digest.Valid() {
+			pkt.Digest = hex.EncodeToString(op.Digest[:])
+		}
+		out.Vectors = append(out.Vectors, jsonVector{
+			Name:       v.Name,
+			Packet:     pkt,
+			Wire:       hex.EncodeToString(v.Wire),
+			DecodeOnly: v.DecodeOnly,
+		})
+	}
+	for _, m := range MalformedVectors() {
+		out.Malformed = append(out.Malformed, jsonMalformed{Name: m.Name, Wire: hex.EncodeToString(m.Wire)})
+	}
+
+	b, err := json.MarshalIndent(out, "", "  ")
+	if err != nil {
+		return err
+	}
+	_, err = w.Write(append(b, '\n'))
+	return err
+}
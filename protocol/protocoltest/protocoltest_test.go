@@ -0,0 +1,89 @@
+package protocoltest
+
+import (
+	"bytes"
+	"errors"
+	"flag"
+	"io/ioutil"
+	"strings"
+	"testing"
+
+	"github.com/cloudflare/gokeyless/protocol"
+)
+
+var update = flag.Bool("update", false, "update testdata/vectors.json")
+
+// packetCodec is the protocol package's own implementation.
+type packetCodec struct{}
+
+func (packetCodec) Marshal(pkt *protocol.Packet) ([]byte, error) {
+	return pkt.MarshalBinary()
+}
+
+func (packetCodec) Unmarshal(wire []byte) (*protocol.Packet, error) {
+	pkt := new(protocol.Packet)
+	if err := pkt.UnmarshalBinary(wire); err != nil {
+		return nil, err
+	}
+	return pkt, nil
+}
+
+func TestProtocolPackage(t *testing.T) {
+	Run(t, packetCodec{})
+}
+
+func TestMalformedParseErrors(t *testing.T) {
+	for _, m := range MalformedVectors() {
+		var perr *protocol.ParseError
+		if _, err := (packetCodec{}).Unmarshal(m.Wire); !errors.As(err, &perr) {
+			t.Errorf("%s: got %v, want a *protocol.ParseError", m.Name, err)
+		}
+	}
+}
+
+func TestOpcodes(t *testing.T) {
+	known := make(map[protocol.Op]bool)
+	for _, op := range Opcodes {
+		if op.Value.String() != op.Name {
+			t.Errorf("%#02x is %v, not %s", byte(op.Value), op.Value, op.Name)
+		}
+		known[op.Value] = true
+	}
+	for i := 0; i < 256; i++ {
+		if op := protocol.Op(i); !strings.HasPrefix(op.String(), "Op(") && !known[op] {
+			t.Errorf("%v is missing from Opcodes", op)
+		}
+	}
+}
+
+func TestErrors(t *testing.T) {
+	known := make(map[protocol.Error]bool)
+	for _, e := range Errors {
+		known[e.Value] = true
+	}
+	unknown := protocol.Error(0xff).String()
+	for i := 0; i < 256; i++ {
+		if e := protocol.Error(i); e.String() != unknown && !known[e] {
+			t.Errorf("%#02x (%v) is missing from Errors", i, e)
+		}
+	}
+}
+
+func TestJSON(t *testing.T) {
+	var buf bytes.Buffer
+	if err := WriteJSON(&buf); err != nil {
+		t.Fatal(err)
+	}
+	if *update {
+		if err := ioutil.WriteFile("testdata/vectors.json", buf.Bytes(), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	want, err := ioutil.ReadFile("testdata/vectors.json")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(buf.Bytes(), want) {
+		t.Fatal("testdata/vectors.json is stale; regenerate it with go test -update")
+	}
+}
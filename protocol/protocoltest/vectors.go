@@ -0,0 +1,381 @@
+package protocoltest
+
+import (
+	"bytes"
+	"encoding/hex"
+	"fmt"
+	"net"
+	"strings"
+	"time"
+
+	"github.com/cloudflare/gokeyless/protocol"
+)
+
+// A Vector is a packet together with its wire format.
+type Vector struct {
+	// Name describes what the vector exercises.
+	Name string
+	// Packet is the decoded packet. Its NoPadding field tells encoders
+	// whether to pad the packet.
+	Packet protocol.Packet
+	// Wire is the encoding of Packet.
+	Wire []byte
+	// DecodeOnly is set for encodings which decoders must accept, but which
+	// encoders don't produce, e.g. because items are out of order.
+	DecodeOnly bool
+}
+
+// A Malformed is an encoding which decoders must reject.
+type Malformed struct {
+	// Name describes what is malformed.
+	Name string
+	// Wire is the malformed packet.
+	Wire []byte
+}
+
+// Opcodes lists the name and value of each opcode.
+var Opcodes = []struct {
+	Name  string
+	Value protocol.Op
+}{
+	{"OpRSADecrypt", 0x01},
+	{"OpRSASignMD5SHA1", 0x02},
+	{"OpRSASignSHA1", 0x03},
+	{"OpRSASignSHA224", 0x04},
+	{"OpRSASignSHA256", 0x05},
+	{"OpRSASignSHA384", 0x06},
+	{"OpRSASignSHA512", 0x07},
+	{"OpECDSASignMD5SHA1", 0x12},
+	{"OpECDSASignSHA1", 0x13},
+	{"OpECDSASignSHA224", 0x14},
+	{"OpECDSASignSHA256", 0x15},
+	{"OpECDSASignSHA384", 0x16},
+	{"OpECDSASignSHA512", 0x17},
+	{"OpEd25519Sign", 0x18},
+	{"OpSM2SignSM3", 0x19},
+	{"OpSeal", 0x21},
+	{"OpUnseal", 0x22},
+	{"OpRPC", 0x23},
+	{"OpCustom", 0x24},
+	{"OpGetTicketKeys", 0x25},
+	{"OpGetCapabilities", 0x26},
+	{"OpHello", 0x27},
+	{"OpAttest", 0x28},
+	{"OpBatch", 0x29},
+	{"OpOCSPSign", 0x2A},
+	{"OpAuthenticate", 0x2B},
+	{"OpGetManifest", 0x2C},
+	{"OpProbeKey", 0x2D},
+	{"OpGetCertificates", 0x2E},
+	{"OpStream", 0x2F},
+	{"OpRSAPSSSignSHA256", 0x35},
+	{"OpRSAPSSSignSHA384", 0x36},
+	{"OpRSAPSSSignSHA512", 0x37},
+	{"OpResponse", 0xF0},
+	{"OpPing", 0xF1},
+	{"OpPong", 0xF2},
+	{"OpKeyRemoved", 0xF3},
+	{"OpReconnect", 0xF4},
+	{"OpError", 0xFF},
+}
+
+// Errors lists the name and value of each error code.
+var Errors = []struct {
+	Name  string
+	Value protocol.Error
+}{
+	{"ErrNone", 0x00},
+	{"ErrCrypto", 0x01},
+	{"ErrKeyNotFound", 0x02},
+	{"ErrRead", 0x03},
+	{"ErrVersionMismatch", 0x04},
+	{"ErrBadOpcode", 0x05},
+	{"ErrUnexpectedOpcode", 0x06},
+	{"ErrFormat", 0x07},
+	{"ErrInternal", 0x08},
+	{"ErrCertNotFound", 0x09},
+	{"ErrExpired", 0x0A},
+	{"ErrKeyUsage", 0x0B},
+	{"ErrUnauthorized", 0x0C},
+	{"ErrTimedOut", 0x0D},
+	{"ErrThrottled", 0x0E},
+	{"ErrNotReady", 0x0F},
+	{"ErrReplayed", 0x10},
+}
+
+// unhex decodes the hex strings s, which may contain spaces for readability.
+func unhex(s ...string) []byte {
+	b, err := hex.DecodeString(strings.Replace(strings.Join(s, ""), " ", "", -1))
+	if err != nil {
+		panic(err)
+	}
+	return b
+}
+
+// repeat returns the hex encoding of n bytes of value b.
+func repeat(b byte, n int) string {
+	return hex.EncodeToString(bytes.Repeat([]byte{b}, n))
+}
+
+func packet(id uint32, length uint16, op protocol.Operation) protocol.Packet {
+	return protocol.Packet{
+		Header:    protocol.Header{MajorVers: 0x01, MinorVers: 0x00, Length: length, ID: id},
+		Operation: op,
+	}
+}
+
+var (
+	payload32 = unhex("000102030405060708090a0b0c0d0e0f101112131415161718191a1b1c1d1e1f")
+	ski       = unhex("a0a1a2a3a4a5a6a7a8a9aaabacadaeafb0b1b2b3")
+	digest    = unhex("c0c1c2c3c4c5c6c7c8c9cacbcccdcecfd0d1d2d3d4d5d6d7d8d9dadbdcdddedf")
+)
+
+// Vectors returns the vectors of well-formed packets. Unless NoPadding is set,
+// packets shorter than 1024 bytes are padded with a padding item (tag 0x20)
+// of zero bytes, which brings them to 1024 bytes, or 1025 or 1026 bytes if
+// they were within 3 bytes of it. Encoders write items in the order of these
+// vectors: opcode, payload, extra, SKI, digest, client IP, server IP, SNI,
+// cert ID, custom function name, Jaeger span, compression, budget and padding.
+func Vectors() []Vector {
+	var sk protocol.SKI
+	copy(sk[:], ski)
+	var dg protocol.Digest
+	copy(dg[:], digest)
+
+	vectors := []Vector{
+		{
+			Name:   "padded ping",
+			Packet: packet(1, 0x03f8, protocol.Operation{Opcode: protocol.OpPing}),
+			Wire: unhex("01 00 03f8 00000001",
+				"11 0001 f1",
+				"20 03f1", repeat(0, 1009)),
+		},
+		{
+			Name:   "unpadded ping",
+			Packet: packet(2, 0x0004, protocol.Operation{Opcode: protocol.OpPing, NoPadding: true}),
+			Wire: unhex("01 00 0004 00000002",
+				"11 0001 f1"),
+		},
+		{
+			Name: "ECDSA signature with key identifiers",
+			Packet: packet(3, 0x03f8, protocol.Operation{
+				Opcode:   protocol.OpECDSASignSHA256,
+				Payload:  payload32,
+				SKI:      sk,
+				ClientIP: net.IPv4(192, 0, 2, 1).To4(),
+				ServerIP: net.ParseIP("2001:db8::1"),
+				SNI:      "example.com",
+			}),
+			Wire: unhex("01 00 03f8 00000003",
+				"11 0001 15",
+				"12 0020", hex.EncodeToString(payload32),
+				"04 0014", hex.EncodeToString(ski),
+				"03 0004 c0000201",
+				"05 0010 20010db8000000000000000000000001",
+				"02 000b", hex.EncodeToString([]byte("example.com")),
+				"20 038f", repeat(0, 911)),
+		},
+		{
+			Name: "RSA decryption with digest, cert ID and extra",
+			Packet: packet(4, 0x004b, protocol.Operation{
+				Opcode:    protocol.OpRSADecrypt,
+				Payload:   payload32[:16],
+				Extra:     []byte("extra"),
+				Digest:    dg,
+				CertID:    "cert-1",
+				NoPadding: true,
+			}),
+			Wire: unhex("01 00 004b 00000004",
+				"11 0001 01",
+				"12 0010", hex.EncodeToString(payload32[:16]),
+				"14 0005", hex.EncodeToString([]byte("extra")),
+				"01 0020", hex.EncodeToString(digest),
+				"06 0006", hex.EncodeToString([]byte("cert-1"))),
+		},
+		{
+			Name: "custom operation with Jaeger span",
+			Packet: packet(5, 0x0017, protocol.Operation{
+				Opcode:         protocol.OpCustom,
+				Payload:        []byte("in"),
+				CustomFuncName: "echo",
+				JaegerSpan:     []byte{1, 2, 3, 4},
+				NoPadding:      true,
+			}),
+			Wire: unhex("01 00 0017 00000005",
+				"11 0001 24",
+				"12 0002", hex.EncodeToString([]byte("in")),
+				"13 0004", hex.EncodeToString([]byte("echo")),
+				"15 0004 01020304"),
+		},
+		{
+			Name: "budget of 250ms",
+			Packet: packet(6, 0x0012, protocol.Operation{
+				Opcode:    protocol.OpECDSASignSHA256,
+				Payload:   []byte("abcd"),
+				Budget:    250 * time.Millisecond,
+				NoPadding: true,
+			}),
+			Wire: unhex("01 00 0012 00000006",
+				"11 0001 15",
+				"12 0004 61626364",
+				"17 0004 000000fa"),
+		},
+		{
+			Name: "low priority",
+			Packet: packet(7, 0x000f, protocol.Operation{
+				Opcode:    protocol.OpRSASignSHA256,
+				Payload:   []byte("abcd"),
+				Priority:  protocol.PriorityLow,
+				NoPadding: true,
+			}),
+			Wire: unhex("01 00 000f 00000007",
+				"11 0001 05",
+				"12 0004 61626364",
+				"18 0001 02"),
+		},
+		{
+			Name: "padding to exactly 1024 bytes with an empty padding item",
+			Packet: packet(7, 0x03f8, protocol.Operation{
+				Opcode:  protocol.OpSeal,
+				Payload: unhex(repeat(0xab, 1006)),
+			}),
+			Wire: unhex("01 00 03f8 00000007",
+				"11 0001 21",
+				"12 03ee", repeat(0xab, 1006),
+				"20 0000"),
+		},
+		{
+			Name: "padding past 1024 bytes with an empty padding item",
+			Packet: packet(8, 0x03f9, protocol.Operation{
+				Opcode:  protocol.OpSeal,
+				Payload: unhex(repeat(0xab, 1007)),
+			}),
+			Wire: unhex("01 00 03f9 00000008",
+				"11 0001 21",
+				"12 03ef", repeat(0xab, 1007),
+				"20 0000"),
+		},
+		{
+			Name: "no padding for 1024 byte packets",
+			Packet: packet(9, 0x03f8, protocol.Operation{
+				Opcode:  protocol.OpSeal,
+				Payload: unhex(repeat(0xab, 1009)),
+			}),
+			Wire: unhex("01 00 03f8 00000009",
+				"11 0001 21",
+				"12 03f1", repeat(0xab, 1009)),
+		},
+		{
+			Name: "response",
+			Packet: packet(10, 0x0010, protocol.Operation{
+				Opcode:    protocol.OpResponse,
+				Payload:   []byte("signature"),
+				NoPadding: true,
+			}),
+			Wire: unhex("01 00 0010 0000000a",
+				"11 0001 f0",
+				"12 0009", hex.EncodeToString([]byte("signature"))),
+		},
+		{
+			Name: "response with timing",
+			Packet: packet(11, 0x001b, protocol.Operation{
+				Opcode:    protocol.OpResponse,
+				Payload:   []byte("signature"),
+				Timing:    protocol.Timing{Queue: 1500 * time.Microsecond, Processing: 250 * time.Microsecond},
+				NoPadding: true,
+			}),
+			Wire: unhex("01 00 001b 0000000b",
+				"11 0001 f0",
+				"12 0009", hex.EncodeToString([]byte("signature")),
+				"19 0008 000005dc 000000fa"),
+		},
+	}
+
+	for i, op := range Opcodes {
+		id := uint32(0x100 + i)
+		vectors = append(vectors, Vector{
+			Name:   "opcode " + op.Name,
+			Packet: packet(id, 0x0004, protocol.Operation{Opcode: op.Value, NoPadding: true}),
+			Wire:   unhex(fmt.Sprintf("01 00 0004 %08x 11 0001 %02x", id, byte(op.Value))),
+		})
+	}
+	for i, e := range Errors {
+		id := uint32(0x200 + i)
+		vectors = append(vectors, Vector{
+			Name: "error " + e.Name,
+			Packet: packet(id, 0x0008, protocol.Operation{
+				Opcode:    protocol.OpError,
+				Payload:   []byte{byte(e.Value)},
+				NoPadding: true,
+			}),
+			Wire: unhex(fmt.Sprintf("01 00 0008 %08x 11 0001 ff 12 0001 %02x", id, byte(e.Value))),
+		})
+	}
+
+	return append(vectors,
+		Vector{
+			Name: "items in any order",
+			Packet: packet(0x300, 0x0013, protocol.Operation{
+				Opcode:  protocol.OpECDSASignSHA256,
+				Payload: []byte("abcd"),
+				SNI:     "a.com",
+			}),
+			Wire: unhex("01 00 0013 00000300",
+				"02 0005", hex.EncodeToString([]byte("a.com")),
+				"12 0004 61626364",
+				"11 0001 15"),
+			DecodeOnly: true,
+		},
+		Vector{
+			Name:   "padding anywhere",
+			Packet: packet(0x301, 0x0009, protocol.Operation{Opcode: protocol.OpPing}),
+			Wire: unhex("01 00 0009 00000301",
+				"20 0002 0000",
+				"11 0001 f1"),
+			DecodeOnly: true,
+		},
+		Vector{
+			Name:   "unknown tags are ignored",
+			Packet: packet(0x302, 0x0009, protocol.Operation{Opcode: protocol.OpPing}),
+			Wire: unhex("01 00 0009 00000302",
+				"11 0001 f1",
+				"7f 0002 ffff"),
+			DecodeOnly: true,
+		},
+		Vector{
+			Name: "deflated payload",
+			Packet: packet(0x303, 0x0015, protocol.Operation{
+				Opcode:  protocol.OpSeal,
+				Payload: []byte("hello hello hello hello"),
+			}),
+			Wire: unhex("01 00 0015 00000303",
+				"11 0001 21",
+				"12 000a cb48cdc9c957c8402701",
+				"16 0001 01"),
+			DecodeOnly: true,
+		},
+	)
+}
+
+// MalformedVectors returns the vectors of malformed packets.
+func MalformedVectors() []Malformed {
+	return []Malformed{
+		{"truncated header", unhex("01 00 00")},
+		{"unsupported major version", unhex("02 00 0004 00000001 11 0001 f1")},
+		{"body too short for an opcode", unhex("01 00 0003 00000001 11 0000")},
+		{"body shorter than its length", unhex("01 00 0008 00000001 11 0001 f1")},
+		{"body longer than its length", unhex("01 00 0004 00000001 11 0001 f1 00")},
+		{"truncated item header", unhex("01 00 0006 00000001 11 0001 f1 12 00")},
+		{"item beyond the end of the body", unhex("01 00 0008 00000001 11 0001 f1 12 0002 00")},
+		{"missing opcode", unhex("01 00 0005 00000001 12 0002 abcd")},
+		{"opcode of two bytes", unhex("01 00 0005 00000001 11 0002 f1f1")},
+		{"repeated item", unhex("01 00 0008 00000001 11 0001 f1 11 0001 f1")},
+		{"client IP of five bytes", unhex("01 00 000c 00000001 11 0001 f1 03 0005 0102030405")},
+		{"server IP of three bytes", unhex("01 00 000a 00000001 11 0001 f1 05 0003 010203")},
+		{"budget of two bytes", unhex("01 00 0009 00000001 11 0001 f1 17 0002 0001")},
+		{"timing of four bytes", unhex("01 00 000b 00000001 11 0001 f0 19 0004 00000001")},
+		{"compression of two bytes", unhex("01 00 0009 00000001 11 0001 f1 16 0002 0101")},
+		{"unknown compression algorithm", unhex("01 00 000d 00000001 11 0001 21 12 0002 abcd 16 0001 7f")},
+		{"corrupt deflated payload", unhex("01 00 000d 00000001 11 0001 21 12 0002 ffff 16 0001 01")},
+	}
+}
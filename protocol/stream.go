@@ -0,0 +1,134 @@
+package protocol
+
+import (
+	"encoding/binary"
+	"fmt"
+)
+
+// StreamPhase is the sub-opcode of an OpStream request: the step of the
+// streamed operation it carries.
+type StreamPhase byte
+
+const (
+	// StreamBegin starts a stream: the operation streamed, and the length of
+	// its payload. The other items of the OpStream operation, such as its SKI,
+	// are those of the operation streamed. It is answered with an empty
+	// OpResponse.
+	StreamBegin StreamPhase = 0x01
+	// StreamContinue appends a chunk to the payload of the operation. It is
+	// answered with an empty OpResponse.
+	StreamContinue StreamPhase = 0x02
+	// StreamEnd appends the last chunk to the payload, and executes the
+	// operation. It is answered with the operation's OpError, or with an
+	// OpResponse whose payload is a StreamChunk: the length of the result,
+	// and its first chunk.
+	StreamEnd StreamPhase = 0x03
+	// StreamRead reads the chunk of the result at an offset, answered with an
+	// OpResponse whose payload is a StreamChunk. The stream ends once the last
+	// chunk has been read.
+	StreamRead StreamPhase = 0x04
+)
+
+// StreamItem marks the type of an item in an OpStream request or response.
+type StreamItem byte
+
+const (
+	// StreamItemPhase is the StreamPhase of a request, as one byte.
+	StreamItemPhase StreamItem = 0x01
+	// StreamItemID identifies the stream among those of the connection, as a
+	// big-endian uint32 chosen by the client.
+	StreamItemID StreamItem = 0x02
+	// StreamItemOpcode is the opcode of the operation streamed, as one byte.
+	StreamItemOpcode StreamItem = 0x03
+	// StreamItemOffset is the offset of the data in the payload or result, as
+	// a big-endian uint32.
+	StreamItemOffset StreamItem = 0x04
+	// StreamItemLength is the length of the whole payload in StreamBegin
+	// requests, and of the whole result in responses, as a big-endian uint32.
+	StreamItemLength StreamItem = 0x05
+	// StreamItemData is a chunk of the payload or result.
+	StreamItemData StreamItem = 0x06
+)
+
+// StreamOverhead is the number of bytes the items of a StreamChunk take up
+// besides its data, so that a chunk of MaxPayload-StreamOverhead bytes fits
+// in a packet.
+const StreamOverhead = 4 + 7 + 4 + 7 + 7 + 3
+
+// A StreamChunk is the payload of an OpStream request, or of the response to
+// a StreamEnd or StreamRead request. OpStream carries operations whose
+// payload or result don't fit in a packet, such as large blobs for OpSeal and
+// OpUnseal, in chunks of at most MaxPayload-StreamOverhead bytes.
+type StreamChunk struct {
+	Phase StreamPhase
+	ID    uint32
+	// Opcode is the operation streamed, in StreamBegin requests.
+	Opcode Op
+	// Offset is the offset of Data in the payload or result.
+	Offset int
+	// Length is the length of the payload in StreamBegin requests, and of the
+	// result in responses.
+	Length int
+	Data   []byte
+}
+
+// MarshalBinary encodes c as the payload of an OpStream request or response.
+func (c *StreamChunk) MarshalBinary() ([]byte, error) {
+	b := make([]byte, 0, StreamOverhead+len(c.Data))
+	if c.Phase != 0 {
+		b = appendTLV(b, Tag(StreamItemPhase), byte(c.Phase))
+	}
+	var id [4]byte
+	binary.BigEndian.PutUint32(id[:], c.ID)
+	b = appendTLV(b, Tag(StreamItemID), id[:]...)
+	if c.Opcode != 0 {
+		b = appendTLV(b, Tag(StreamItemOpcode), byte(c.Opcode))
+	}
+	for _, item := range []struct {
+		tag   StreamItem
+		value int
+	}{{StreamItemOffset, c.Offset}, {StreamItemLength, c.Length}} {
+		if item.value < 0 || uint64(item.value) > 0xFFFFFFFF {
+			return nil, fmt.Errorf("invalid stream offset or length %d", item.value)
+		}
+		var v [4]byte
+		binary.BigEndian.PutUint32(v[:], uint32(item.value))
+		b = appendTLV(b, Tag(item.tag), v[:]...)
+	}
+	return appendTLV(b, Tag(StreamItemData), c.Data...), nil
+}
+
+// UnmarshalBinary parses the payload of an OpStream request or response into
+// c. Unknown items are ignored.
+func (c *StreamChunk) UnmarshalBinary(body []byte) error {
+	*c = StreamChunk{}
+	return parseItems(body, func(b byte, offset int, data []byte) error {
+		switch StreamItem(b) {
+		case StreamItemPhase, StreamItemOpcode:
+			if len(data) != 1 {
+				return parseErrorf(offset, "invalid stream item of %dB", len(data))
+			}
+			if StreamItem(b) == StreamItemPhase {
+				c.Phase = StreamPhase(data[0])
+			} else {
+				c.Opcode = Op(data[0])
+			}
+		case StreamItemID, StreamItemOffset, StreamItemLength:
+			if len(data) != 4 {
+				return parseErrorf(offset, "invalid stream item of %dB", len(data))
+			}
+			v := binary.BigEndian.Uint32(data)
+			switch StreamItem(b) {
+			case StreamItemID:
+				c.ID = v
+			case StreamItemOffset:
+				c.Offset = int(v)
+			default:
+				c.Length = int(v)
+			}
+		case StreamItemData:
+			c.Data = data
+		}
+		return nil
+	})
+}
@@ -0,0 +1,146 @@
+package protocol
+
+import (
+	"crypto"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"encoding/binary"
+	"errors"
+	"fmt"
+)
+
+// wrapVersion is the first byte of keys wrapped by WrapKey.
+const wrapVersion = 0x01
+
+// wrapLabel binds the key encryption key to its use.
+var wrapLabel = []byte("gokeyless key import")
+
+// ErrWrappedKey is returned by UnwrapKey if the wrapped key is malformed, or
+// was not wrapped for the given private key.
+var ErrWrappedKey = errors.New("invalid wrapped key")
+
+// WrapKey encrypts key, normally a DER-encoded private key, to pub, the public
+// key of a keyserver's TLS certificate, so that it can be sent to the server's
+// admin API without being readable by anything in between. RSA keys wrap an
+// AES-256-GCM key with RSA-OAEP, and ECDSA keys derive one with ephemeral
+// ECDH. The result is:
+//
+//	0x01 | uint16 length | encapsulated key | 12-byte nonce | ciphertext
+func WrapKey(pub crypto.PublicKey, key []byte) ([]byte, error) {
+	var encapsulated, kek []byte
+	switch pub := pub.(type) {
+	case *rsa.PublicKey:
+		kek = make([]byte, 32)
+		if _, err := rand.Read(kek); err != nil {
+			return nil, err
+		}
+		var err error
+		if encapsulated, err = rsa.EncryptOAEP(sha256.New(), rand.Reader, pub, kek, wrapLabel); err != nil {
+			return nil, err
+		}
+	case *ecdsa.PublicKey:
+		eph, x, y, err := elliptic.GenerateKey(pub.Curve, rand.Reader)
+		if err != nil {
+			return nil, err
+		}
+		encapsulated = elliptic.Marshal(pub.Curve, x, y)
+		shared, _ := pub.Curve.ScalarMult(pub.X, pub.Y, eph)
+		kek = deriveWrappingKey(pub.Curve, shared.Bytes(), encapsulated)
+	default:
+		return nil, fmt.Errorf("unsupported wrapping key type %T", pub)
+	}
+	if len(encapsulated) > 0xffff {
+		return nil, errors.New("encapsulated key too long")
+	}
+
+	aead, err := newWrapAEAD(kek)
+	if err != nil {
+		return nil, err
+	}
+	b := make([]byte, 3, 3+len(encapsulated)+aead.NonceSize()+len(key)+aead.Overhead())
+	b[0] = wrapVersion
+	binary.BigEndian.PutUint16(b[1:], uint16(len(encapsulated)))
+	b = append(b, encapsulated...)
+	nonce := make([]byte, aead.NonceSize())
+	if _, err := rand.Read(nonce); err != nil {
+		return nil, err
+	}
+	b = append(b, nonce...)
+	// The header is authenticated so that the encapsulated key can't be
+	// swapped.
+	return aead.Seal(b, nonce, key, b[:3+len(encapsulated)]), nil
+}
+
+// UnwrapKey decrypts a key wrapped by WrapKey with priv, which must be an
+// *ecdsa.PrivateKey or a crypto.Decrypter with an RSA public key, such as an
+// *rsa.PrivateKey or an RSA key held in an HSM.
+func UnwrapKey(priv crypto.PrivateKey, wrapped []byte) ([]byte, error) {
+	if len(wrapped) < 3 || wrapped[0] != wrapVersion {
+		return nil, ErrWrappedKey
+	}
+	n := int(binary.BigEndian.Uint16(wrapped[1:]))
+	if len(wrapped) < 3+n {
+		return nil, ErrWrappedKey
+	}
+	header, encapsulated, rest := wrapped[:3+n], wrapped[3:3+n], wrapped[3+n:]
+
+	var kek []byte
+	switch priv := priv.(type) {
+	case *ecdsa.PrivateKey:
+		x, y := elliptic.Unmarshal(priv.Curve, encapsulated)
+		if x == nil {
+			return nil, ErrWrappedKey
+		}
+		shared, _ := priv.Curve.ScalarMult(x, y, priv.D.Bytes())
+		kek = deriveWrappingKey(priv.Curve, shared.Bytes(), encapsulated)
+	case crypto.Decrypter:
+		if _, ok := priv.Public().(*rsa.PublicKey); !ok {
+			return nil, fmt.Errorf("unsupported wrapping key type %T", priv.Public())
+		}
+		var err error
+		kek, err = priv.Decrypt(rand.Reader, encapsulated, &rsa.OAEPOptions{Hash: crypto.SHA256, Label: wrapLabel})
+		if err != nil || len(kek) != 32 {
+			return nil, ErrWrappedKey
+		}
+	default:
+		return nil, fmt.Errorf("unsupported wrapping key type %T", priv)
+	}
+
+	aead, err := newWrapAEAD(kek)
+	if err != nil {
+		return nil, err
+	}
+	if len(rest) < aead.NonceSize() {
+		return nil, ErrWrappedKey
+	}
+	key, err := aead.Open(nil, rest[:aead.NonceSize()], rest[aead.NonceSize():], header)
+	if err != nil {
+		return nil, ErrWrappedKey
+	}
+	return key, nil
+}
+
+// deriveWrappingKey hashes the ECDH shared secret, left-padded to the size of
+// the curve, with the ephemeral public key into an AES-256 key.
+func deriveWrappingKey(curve elliptic.Curve, shared, ephemeral []byte) []byte {
+	size := (curve.Params().BitSize + 7) / 8
+	h := sha256.New()
+	h.Write(wrapLabel)
+	h.Write(make([]byte, size-len(shared)))
+	h.Write(shared)
+	h.Write(ephemeral)
+	return h.Sum(nil)
+}
+
+func newWrapAEAD(kek []byte) (cipher.AEAD, error) {
+	block, err := aes.NewCipher(kek)
+	if err != nil {
+		return nil, err
+	}
+	return cipher.NewGCM(block)
+}
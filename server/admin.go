@@ -0,0 +1,479 @@
+package server
+
+import (
+	"context"
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/rsa"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/cloudflare/cfssl/log"
+	"github.com/cloudflare/gokeyless/protocol"
+	"golang.org/x/crypto/ed25519"
+)
+
+// StageKeyRequest is the body of a request to stage a key rotation with the
+// admin handler. Exactly one of File, URI and Wrapped must be set.
+type StageKeyRequest struct {
+	// OldSKI is the hex encoded SKI of the key to replace.
+	OldSKI string `json:"old_ski"`
+	// File is the path of the new key, in PEM or DER.
+	File string `json:"file,omitempty"`
+	// URI is the PKCS#11 URI, Azure Key Vault URI or Google Cloud KMS
+	// resource name of the new key.
+	URI string `json:"uri,omitempty"`
+	// Wrapped is the new key, in PEM or DER, wrapped with protocol.WrapKey
+	// for the public key of the server's certificate.
+	Wrapped []byte `json:"wrapped,omitempty"`
+}
+
+// LoadKeyRequest is the body of a request to load a key with the admin
+// handler. Exactly one of File, URI and Wrapped must be set.
+type LoadKeyRequest struct {
+	// File is the path of the key, in PEM or DER.
+	File string `json:"file,omitempty"`
+	// URI is the PKCS#11 URI, Azure Key Vault URI or Google Cloud KMS
+	// resource name of the key.
+	URI string `json:"uri,omitempty"`
+	// Wrapped is the key, in PEM or DER, wrapped with protocol.WrapKey for
+	// the public key of the server's certificate, so that it is only ever
+	// decrypted in the server's memory.
+	Wrapped []byte `json:"wrapped,omitempty"`
+}
+
+// KeyInfo describes a key loaded by the server, as listed by the admin
+// handler.
+type KeyInfo struct {
+	SKI string `json:"ski"`
+	// Type is "RSA", "ECDSA" or "Ed25519".
+	Type string `json:"type"`
+	// Bits is the size of the RSA modulus or of the curve.
+	Bits int `json:"bits"`
+	// Usage lists the operations the key is restricted to with
+	// SetKeyUsage, out of "sign", "decrypt" and "ocsp". It is omitted if the
+	// key is unrestricted.
+	Usage []string `json:"usage,omitempty"`
+	// Rotation is the state of the rotation replacing the key, if any.
+	Rotation string `json:"rotation,omitempty"`
+}
+
+// LogLevel is the body of requests and responses about the log level with the
+// admin handler.
+type LogLevel struct {
+	// Level is a cfssl log level, from log.LevelDebug (0) to log.LevelFatal
+	// (5).
+	Level int `json:"level"`
+}
+
+// RebalanceResult is the response to a rebalance of a ShardedKeystore with the
+// admin handler.
+type RebalanceResult struct {
+	// Moved is the number of keys moved to another shard.
+	Moved int `json:"moved"`
+}
+
+// A shardedKeystore is a Keystore whose shards can be inspected and
+// rebalanced through the admin API, such as a ShardedKeystore.
+type shardedKeystore interface {
+	ShardStats() []ShardStats
+	Rebalance(ctx context.Context) (int, error)
+}
+
+// An adminKeystore is a Keystore whose keys can be listed, loaded and evicted
+// through the admin API.
+type adminKeystore interface {
+	Keys() []KeyInfo
+	Add(op *protocol.Operation, priv crypto.Signer) error
+	Remove(ski protocol.SKI)
+}
+
+// Keys describes the keys in the keystore, sorted by SKI.
+func (keys *DefaultKeystore) Keys() []KeyInfo {
+	skis := keys.SKIs()
+
+	keys.mtx.RLock()
+	defer keys.mtx.RUnlock()
+	infos := make([]KeyInfo, 0, len(skis))
+	for _, ski := range skis {
+		priv, ok := keys.skis[ski]
+		if !ok {
+			continue
+		}
+		info := KeyInfo{SKI: ski.String()}
+		switch pub := priv.Public().(type) {
+		case *rsa.PublicKey:
+			info.Type, info.Bits = "RSA", pub.N.BitLen()
+		case *ecdsa.PublicKey:
+			info.Type, info.Bits = "ECDSA", pub.Curve.Params().BitSize
+		case ed25519.PublicKey:
+			info.Type, info.Bits = "Ed25519", 256
+		}
+		if u := keys.usage[ski]; u != nil {
+			info.Usage = []string{}
+			for _, op := range []struct {
+				name    string
+				allowed bool
+			}{{"sign", u.Sign}, {"decrypt", u.Decrypt}, {"ocsp", u.OCSP}} {
+				if op.allowed {
+					info.Usage = append(info.Usage, op.name)
+				}
+			}
+		}
+		if r, ok := keys.rotations[ski]; ok {
+			info.Rotation = r.State
+		}
+		infos = append(infos, info)
+	}
+	return infos
+}
+
+// AdminHandler returns a handler for managing the server's keys, if its
+// Keystore supports it as DefaultKeystore does, and inspecting the server:
+//
+//	GET /admin/keys lists the loaded keys as KeyInfos.
+//	POST /admin/keys loads the key described by a LoadKeyRequest.
+//	DELETE /admin/keys/{ski} evicts a key.
+//	GET /admin/rotations lists the key rotations.
+//	POST /admin/rotations stages a rotation described by a StageKeyRequest.
+//	POST /admin/rotations/{old_ski}/switch?grace=10m switches a rotation.
+//	DELETE /admin/rotations/{old_ski} aborts a staged rotation.
+//	GET /admin/shards lists the shards of a ShardedKeystore as ShardStats.
+//	POST /admin/shards/rebalance moves keys to their shards.
+//	GET /admin/connections lists the active connections as ConnInfos.
+//	GET /admin/connections/history dumps the ConnectionHistory.
+//	GET /admin/clients lists the usage of each client as ClientUsages.
+//	GET, PUT /admin/loglevel gets or sets the LogLevel.
+//	GET /admin/certificates?name=&serial=&ski=&expires_before= queries the
+//	CertIndex, listing the matching certificates as CertificateInfos.
+//
+// Rotations are answered with their KeyRotation as JSON. Requests must carry a
+// bearer token accepted by the AdminTokenVerifier of the ServeConfig; without
+// one, every request is refused. The handler loads keys from the server's
+// filesystem and must not be reachable by untrusted clients. Keys can also be pushed in the request,
+// wrapped for the public key of the server's certificate, in which case they
+// are never written to disk.
+func (s *Server) AdminHandler() http.Handler {
+	mux := http.NewServeMux()
+	mux.HandleFunc("/admin/keys", func(w http.ResponseWriter, r *http.Request) {
+		keys, ok := s.keys.(adminKeystore)
+		if !ok {
+			http.Error(w, "keystore does not support listing keys", http.StatusNotImplemented)
+			return
+		}
+		switch r.Method {
+		case http.MethodGet:
+			s.writeJSON(w, keys.Keys())
+		case http.MethodPost:
+			var req LoadKeyRequest
+			if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+				http.Error(w, err.Error(), http.StatusBadRequest)
+				return
+			}
+			priv, err := s.loadKey(req.File, req.URI, req.Wrapped)
+			if err != nil {
+				http.Error(w, err.Error(), http.StatusBadRequest)
+				return
+			}
+			if err := keys.Add(nil, priv); err != nil {
+				http.Error(w, err.Error(), http.StatusBadRequest)
+				return
+			}
+			ski, _ := protocol.GetSKI(priv.Public())
+			s.log.Infof("admin: loaded key %v", ski)
+			for _, info := range keys.Keys() {
+				if info.SKI == ski.String() {
+					s.writeJSON(w, info)
+					return
+				}
+			}
+			http.Error(w, "key was not added", http.StatusInternalServerError)
+		default:
+			http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		}
+	})
+	mux.HandleFunc("/admin/keys/", func(w http.ResponseWriter, r *http.Request) {
+		keys, ok := s.keys.(adminKeystore)
+		if !ok {
+			http.Error(w, "keystore does not support evicting keys", http.StatusNotImplemented)
+			return
+		}
+		ski, err := parseSKI(strings.TrimPrefix(r.URL.Path, "/admin/keys/"))
+		if err != nil {
+			http.NotFound(w, r)
+			return
+		}
+		if r.Method != http.MethodDelete {
+			http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+			return
+		}
+		keys.Remove(ski)
+		s.log.Infof("admin: evicted key %v", ski)
+		w.WriteHeader(http.StatusNoContent)
+	})
+	mux.HandleFunc("/admin/shards", func(w http.ResponseWriter, r *http.Request) {
+		keys, ok := s.keys.(shardedKeystore)
+		if !ok {
+			http.Error(w, "keystore is not sharded", http.StatusNotImplemented)
+			return
+		}
+		if r.Method != http.MethodGet {
+			http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+			return
+		}
+		s.writeJSON(w, keys.ShardStats())
+	})
+	mux.HandleFunc("/admin/shards/rebalance", func(w http.ResponseWriter, r *http.Request) {
+		keys, ok := s.keys.(shardedKeystore)
+		if !ok {
+			http.Error(w, "keystore is not sharded", http.StatusNotImplemented)
+			return
+		}
+		if r.Method != http.MethodPost {
+			http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+			return
+		}
+		moved, err := keys.Rebalance(r.Context())
+		s.log.Infof("admin: rebalanced shards, moved %d keys", moved)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusConflict)
+			return
+		}
+		s.writeJSON(w, RebalanceResult{Moved: moved})
+	})
+	mux.HandleFunc("/admin/connections", func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodGet {
+			http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+			return
+		}
+		s.writeJSON(w, s.Connections())
+	})
+	mux.HandleFunc("/admin/connections/history", func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodGet {
+			http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+			return
+		}
+		s.writeJSON(w, s.ConnectionHistory())
+	})
+	mux.HandleFunc("/admin/clients", func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodGet {
+			http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+			return
+		}
+		s.writeJSON(w, s.ClientUsage())
+	})
+	mux.HandleFunc("/admin/certificates", func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodGet {
+			http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+			return
+		}
+		q, err := parseCertificateQuery(r.URL.Query())
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		infos := []CertificateInfo{}
+		for _, cert := range s.certs.Query(q) {
+			infos = append(infos, certificateInfo(cert))
+		}
+		s.writeJSON(w, infos)
+	})
+	mux.HandleFunc("/admin/loglevel", func(w http.ResponseWriter, r *http.Request) {
+		switch r.Method {
+		case http.MethodGet:
+		case http.MethodPut:
+			var req LogLevel
+			if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+				http.Error(w, err.Error(), http.StatusBadRequest)
+				return
+			}
+			if req.Level < log.LevelDebug || req.Level > log.LevelFatal {
+				http.Error(w, fmt.Sprintf("level must be between %d and %d", log.LevelDebug, log.LevelFatal), http.StatusBadRequest)
+				return
+			}
+			s.log.SetLevel(req.Level)
+			s.log.Infof("admin: set log level to %d", req.Level)
+		default:
+			http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+			return
+		}
+		s.writeJSON(w, LogLevel{Level: s.log.Level()})
+	})
+	mux.HandleFunc("/admin/rotations", func(w http.ResponseWriter, r *http.Request) {
+		keys, ok := s.keys.(rotatingKeystore)
+		if !ok {
+			http.Error(w, "keystore does not support rotation", http.StatusNotImplemented)
+			return
+		}
+		switch r.Method {
+		case http.MethodGet:
+			s.writeJSON(w, keys.Rotations())
+		case http.MethodPost:
+			var req StageKeyRequest
+			if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+				http.Error(w, err.Error(), http.StatusBadRequest)
+				return
+			}
+			old, err := parseSKI(req.OldSKI)
+			if err != nil {
+				http.Error(w, fmt.Sprintf("old_ski: %v", err), http.StatusBadRequest)
+				return
+			}
+			priv, err := s.loadKey(req.File, req.URI, req.Wrapped)
+			if err != nil {
+				http.Error(w, err.Error(), http.StatusBadRequest)
+				return
+			}
+			if _, err := keys.StageKey(old, priv); err != nil {
+				http.Error(w, err.Error(), http.StatusConflict)
+				return
+			}
+			s.writeRotation(w, keys, old.String())
+		default:
+			http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		}
+	})
+	mux.HandleFunc("/admin/rotations/", func(w http.ResponseWriter, r *http.Request) {
+		keys, ok := s.keys.(rotatingKeystore)
+		if !ok {
+			http.Error(w, "keystore does not support rotation", http.StatusNotImplemented)
+			return
+		}
+		path := strings.TrimPrefix(r.URL.Path, "/admin/rotations/")
+		name, action := path, ""
+		if i := strings.IndexByte(path, '/'); i >= 0 {
+			name, action = path[:i], path[i+1:]
+		}
+		old, err := parseSKI(name)
+		if err != nil {
+			http.NotFound(w, r)
+			return
+		}
+		switch {
+		case action == "" && r.Method == http.MethodGet:
+			s.writeRotation(w, keys, old.String())
+		case action == "" && r.Method == http.MethodDelete:
+			if err := keys.AbortRotation(old); err != nil {
+				http.Error(w, err.Error(), http.StatusConflict)
+				return
+			}
+			w.WriteHeader(http.StatusNoContent)
+		case action == "switch" && r.Method == http.MethodPost:
+			var grace time.Duration
+			if g := r.URL.Query().Get("grace"); g != "" {
+				if grace, err = time.ParseDuration(g); err != nil {
+					http.Error(w, fmt.Sprintf("grace: %v", err), http.StatusBadRequest)
+					return
+				}
+			}
+			if err := keys.SwitchKey(old, grace); err != nil {
+				http.Error(w, err.Error(), http.StatusConflict)
+				return
+			}
+			s.writeRotation(w, keys, old.String())
+		default:
+			http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		}
+	})
+
+	verifier := s.config.adminTokenVerifier
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if verifier == nil {
+			s.log.Warningf("admin request %v: rejected (no admin token verifier is configured)", r.RemoteAddr)
+			http.Error(w, "admin endpoints need an admin token verifier", http.StatusUnauthorized)
+			return
+		}
+		identity, err := verifyBearerToken(r, verifier)
+		if err != nil {
+			s.log.Warningf("admin request %v: token rejected: %v", r.RemoteAddr, err)
+			w.Header().Set("WWW-Authenticate", "Bearer")
+			http.Error(w, "unauthorized", http.StatusUnauthorized)
+			return
+		}
+		s.log.Debugf("admin request %v: %s %s by %v", r.RemoteAddr, r.Method, r.URL.Path, identity)
+		mux.ServeHTTP(w, r)
+	})
+}
+
+// AdminListenAndServe serves AdminHandler at adminAddr. It fails if the
+// ServeConfig has no AdminTokenVerifier.
+func (s *Server) AdminListenAndServe(adminAddr string) error {
+	if s.config.adminTokenVerifier == nil {
+		return errors.New("admin endpoints need an admin token verifier")
+	}
+	s.log.Infof("Serving admin endpoints at %s/admin/\n", adminAddr)
+	return http.ListenAndServe(adminAddr, s.AdminHandler())
+}
+
+// loadKey loads the key in file, at uri or wrapped for the server's
+// certificate, exactly one of which must be set.
+func (s *Server) loadKey(file, uri string, wrapped []byte) (priv crypto.Signer, err error) {
+	defer func() {
+		if err == nil {
+			s.warnWeakKey(priv)
+		}
+	}()
+	set := 0
+	for _, ok := range []bool{file != "", uri != "", wrapped != nil} {
+		if ok {
+			set++
+		}
+	}
+	switch {
+	case set > 1:
+		return nil, fmt.Errorf("only one of file, uri and wrapped may be set")
+	case wrapped != nil:
+		return s.unwrapKey(wrapped)
+	case file != "":
+		in, err := ioutil.ReadFile(file)
+		if err != nil {
+			return nil, err
+		}
+		return DefaultLoadKey(in)
+	case uri != "":
+		return loadURI(uri)
+	default:
+		return nil, fmt.Errorf("one of file, uri and wrapped must be set")
+	}
+}
+
+// unwrapKey decrypts a key wrapped for the server's certificate and parses it.
+// The decrypted key is zeroized once parsed.
+func (s *Server) unwrapKey(wrapped []byte) (crypto.Signer, error) {
+	cert, err := s.certificate()
+	if err != nil {
+		return nil, err
+	}
+	in, err := protocol.UnwrapKey(cert.PrivateKey, wrapped)
+	if err != nil {
+		return nil, err
+	}
+	defer zeroizeBytes(in)
+	return DefaultLoadKey(in)
+}
+
+// writeRotation writes the rotation of the key with SKI old, or a 404 if there
+// is none.
+func (s *Server) writeRotation(w http.ResponseWriter, keys rotatingKeystore, old string) {
+	for _, r := range keys.Rotations() {
+		if r.OldSKI == old {
+			s.writeJSON(w, r)
+			return
+		}
+	}
+	http.Error(w, "no rotation of key "+old, http.StatusNotFound)
+}
+
+func (s *Server) writeJSON(w http.ResponseWriter, v interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	enc := json.NewEncoder(w)
+	enc.SetIndent("", "  ")
+	if err := enc.Encode(v); err != nil {
+		s.log.Errorf("admin: writing response: %v", err)
+	}
+}
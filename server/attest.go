@@ -0,0 +1,124 @@
+package server
+
+import (
+	"bytes"
+	"crypto"
+	"crypto/sha256"
+	"crypto/tls"
+	"errors"
+	"sort"
+	"time"
+
+	"github.com/cloudflare/gokeyless/protocol"
+)
+
+// An Attester signs the attestations a Server returns for OpAttest, and the
+// key manifests it returns for OpGetManifest.
+type Attester struct {
+	// Key signs attestations and manifests. Clients must trust its public key
+	// independently of the server's TLS certificate.
+	Key crypto.Signer
+	// BuildHash identifies the server build, e.g. as the SHA-256 hash of its
+	// binary.
+	BuildHash []byte
+}
+
+// SetAttester sets the Attester used by s to answer OpAttest and
+// OpGetManifest. It is NOT safe to call concurrently with any other methods.
+func (s *Server) SetAttester(a *Attester) {
+	s.attester = a
+}
+
+// An enumerableKeystore is a Keystore which can list its keys, so that they
+// can be attested.
+type enumerableKeystore interface {
+	SKIs() []protocol.SKI
+}
+
+// SKIs returns the SKIs of the keys in keys, in ascending order.
+func (keys *DefaultKeystore) SKIs() []protocol.SKI {
+	keys.mtx.RLock()
+	skis := make([]protocol.SKI, 0, len(keys.skis))
+	for ski := range keys.skis {
+		skis = append(skis, ski)
+	}
+	keys.mtx.RUnlock()
+
+	sort.Slice(skis, func(i, j int) bool { return bytes.Compare(skis[i][:], skis[j][:]) < 0 })
+	return skis
+}
+
+// A publicKeystore is a Keystore which can list its public keys, so that they
+// can be published in a manifest.
+type publicKeystore interface {
+	PublicKeys() []protocol.PublicKey
+}
+
+// PublicKeys returns the SKIs and public keys of the keys in keys, in
+// ascending order of SKI.
+func (keys *DefaultKeystore) PublicKeys() []protocol.PublicKey {
+	skis := keys.SKIs()
+
+	keys.mtx.RLock()
+	defer keys.mtx.RUnlock()
+	pubs := make([]protocol.PublicKey, 0, len(skis))
+	for _, ski := range skis {
+		if priv, ok := keys.skis[ski]; ok {
+			pubs = append(pubs, protocol.PublicKey{SKI: ski, Public: priv.Public()})
+		}
+	}
+	return pubs
+}
+
+// manifest returns a signed manifest of the keys held by s.
+func (s *Server) manifest() ([]byte, error) {
+	if s.attester == nil {
+		return nil, errors.New("no Attester set")
+	}
+	keys, ok := s.keys.(publicKeystore)
+	if !ok {
+		return nil, errors.New("keystore cannot list its public keys")
+	}
+
+	m := protocol.Manifest{Issued: time.Now(), Keys: keys.PublicKeys()}
+	if err := m.Sign(s.attester.Key); err != nil {
+		return nil, err
+	}
+	return m.MarshalBinary()
+}
+
+// attest returns a signed attestation of s including nonce. The SKIs are only
+// included if the keystore can list them.
+func (s *Server) attest(nonce []byte) ([]byte, error) {
+	if s.attester == nil {
+		return nil, errors.New("no Attester set")
+	}
+	cert, err := s.certificate()
+	if err != nil {
+		return nil, err
+	}
+
+	a := protocol.Attestation{
+		Nonce:     nonce,
+		CertHash:  sha256.Sum256(cert.Certificate[0]),
+		BuildHash: s.attester.BuildHash,
+	}
+	if keys, ok := s.keys.(enumerableKeystore); ok {
+		a.SKIs = keys.SKIs()
+	}
+	if err := a.Sign(s.attester.Key); err != nil {
+		return nil, err
+	}
+	return a.MarshalBinary()
+}
+
+// certificate returns the certificate s presents to clients.
+func (s *Server) certificate() (*tls.Certificate, error) {
+	if len(s.tlsConfig.Certificates) > 0 {
+		return &s.tlsConfig.Certificates[0], nil
+	}
+	if s.tlsConfig.GetCertificate != nil {
+		return s.tlsConfig.GetCertificate(&tls.ClientHelloInfo{})
+	}
+	return nil, errors.New("no server certificate")
+}
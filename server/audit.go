@@ -0,0 +1,294 @@
+package server
+
+import (
+	"bufio"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"sync"
+	"time"
+
+	"github.com/cloudflare/cfssl/log"
+	"github.com/cloudflare/gokeyless/protocol"
+)
+
+// An AuditRecord describes a single private key operation performed by the
+// server.
+type AuditRecord struct {
+	Time   time.Time   `json:"time"`
+	Client string      `json:"client,omitempty"`
+	Tenant string      `json:"tenant,omitempty"`
+	SKI    string      `json:"ski,omitempty"`
+	SNI    string      `json:"sni,omitempty"`
+	Opcode protocol.Op `json:"-"`
+	// Op is the name of Opcode, included for readability of the log.
+	Op string `json:"op"`
+	// Digest is the hex-encoded SHA-256 digest of the request payload.
+	Digest string         `json:"digest"`
+	Result protocol.Error `json:"result"`
+	// MAC chains this record to the previous one when an HMAC key is set. It
+	// is computed over the previous record's MAC and this record without MAC.
+	MAC string `json:"mac,omitempty"`
+}
+
+// An AuditLogger records private key operations. Audit is called by workers
+// after each signing or decryption operation and must be safe for concurrent
+// use.
+type AuditLogger interface {
+	Audit(*AuditRecord)
+}
+
+// newAuditRecord describes the result of handling req.
+func newAuditRecord(req request, result protocol.Error) *AuditRecord {
+	digest := sha256.Sum256(req.pkt.Operation.Payload)
+	rec := &AuditRecord{
+		Time:   time.Now().UTC(),
+		Tenant: req.tenant,
+		SKI:    req.pkt.Operation.SKI.String(),
+		SNI:    req.pkt.Operation.SNI,
+		Opcode: req.pkt.Operation.Opcode,
+		Op:     req.pkt.Operation.Opcode.String(),
+		Digest: hex.EncodeToString(digest[:]),
+		Result: result,
+	}
+	if req.identity != nil {
+		rec.Client = req.identity.String()
+	}
+	return rec
+}
+
+// isAuditedOp reports whether op uses a private key and should be audited.
+func isAuditedOp(op protocol.Op) bool {
+	switch op.Type() {
+	case "rsa", "ecdsa", "ed25519":
+		return true
+	default:
+		return false
+	}
+}
+
+// WriterAuditLogger writes audit records as JSON lines to an io.Writer, such as
+// a file or a connection to a remote log collector. If an HMAC key is set, each
+// record is chained to the previous one so that removed, reordered or modified
+// records can be detected with VerifyAuditLog.
+type WriterAuditLogger struct {
+	mtx     sync.Mutex
+	w       io.Writer
+	key     []byte
+	lastMAC []byte
+}
+
+// NewWriterAuditLogger creates an AuditLogger writing to w. hmacKey may be nil
+// to disable chaining.
+func NewWriterAuditLogger(w io.Writer, hmacKey []byte) *WriterAuditLogger {
+	return &WriterAuditLogger{w: w, key: hmacKey}
+}
+
+// Audit implements AuditLogger. Write failures are logged, not returned.
+func (l *WriterAuditLogger) Audit(rec *AuditRecord) {
+	l.mtx.Lock()
+	defer l.mtx.Unlock()
+	if err := l.writeLocked(rec); err != nil {
+		log.Errorf("failed to write audit record: %v", err)
+	}
+}
+
+func (l *WriterAuditLogger) writeLocked(rec *AuditRecord) error {
+	rec.MAC = ""
+	if l.key != nil {
+		mac, err := chainMAC(l.key, l.lastMAC, rec)
+		if err != nil {
+			return err
+		}
+		rec.MAC = hex.EncodeToString(mac)
+		l.lastMAC = mac
+	}
+	b, err := json.Marshal(rec)
+	if err != nil {
+		return err
+	}
+	_, err = l.w.Write(append(b, '\n'))
+	return err
+}
+
+// chainMAC computes HMAC-SHA256(key, prev || JSON(rec without MAC)).
+func chainMAC(key, prev []byte, rec *AuditRecord) ([]byte, error) {
+	unsigned := *rec
+	unsigned.MAC = ""
+	b, err := json.Marshal(&unsigned)
+	if err != nil {
+		return nil, err
+	}
+	h := hmac.New(sha256.New, key)
+	h.Write(prev)
+	h.Write(b)
+	return h.Sum(nil), nil
+}
+
+// VerifyAuditLog checks the HMAC chain of the audit records read from r. prev
+// is the MAC of the record preceding the first one in r (nil at the start of
+// the chain, or the result of verifying the previous rotated file). It returns
+// the MAC of the last record.
+func VerifyAuditLog(r io.Reader, hmacKey, prev []byte) ([]byte, error) {
+	scanner := bufio.NewScanner(r)
+	for line := 1; scanner.Scan(); line++ {
+		var rec AuditRecord
+		if err := json.Unmarshal(scanner.Bytes(), &rec); err != nil {
+			return nil, fmt.Errorf("audit log line %d: %v", line, err)
+		}
+		mac, err := hex.DecodeString(rec.MAC)
+		if err != nil {
+			return nil, fmt.Errorf("audit log line %d: invalid MAC: %v", line, err)
+		}
+		expected, err := chainMAC(hmacKey, prev, &rec)
+		if err != nil {
+			return nil, err
+		}
+		if !hmac.Equal(mac, expected) {
+			return nil, fmt.Errorf("audit log line %d: MAC mismatch", line)
+		}
+		prev = mac
+	}
+	return prev, scanner.Err()
+}
+
+// FileAuditLogger appends audit records to a file, rotating it once it grows
+// beyond a maximum size. The HMAC chain continues across rotated files.
+type FileAuditLogger struct {
+	WriterAuditLogger
+	path    string
+	file    *os.File
+	size    int64
+	maxSize int64
+}
+
+// NewFileAuditLogger opens path for appending audit records. hmacKey may be nil
+// to disable chaining. If maxSize is positive, the file is renamed to
+// path.<timestamp> and a new one started once it exceeds maxSize bytes.
+//
+// When appending to an existing file with chaining enabled, the chain is
+// resumed from the file's last record.
+func NewFileAuditLogger(path string, hmacKey []byte, maxSize int64) (*FileAuditLogger, error) {
+	l := &FileAuditLogger{path: path, maxSize: maxSize}
+	l.key = hmacKey
+	if hmacKey != nil {
+		mac, err := lastAuditMAC(path)
+		if err != nil {
+			return nil, err
+		}
+		l.lastMAC = mac
+	}
+	if err := l.open(); err != nil {
+		return nil, err
+	}
+	return l, nil
+}
+
+func lastAuditMAC(path string) ([]byte, error) {
+	f, err := os.Open(path)
+	if os.IsNotExist(err) {
+		return nil, nil
+	} else if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	var last []byte
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		last = append(last[:0], scanner.Bytes()...)
+	}
+	if err := scanner.Err(); err != nil || last == nil {
+		return nil, err
+	}
+	var rec AuditRecord
+	if err := json.Unmarshal(last, &rec); err != nil {
+		return nil, fmt.Errorf("cannot resume audit log %s: %v", path, err)
+	}
+	return hex.DecodeString(rec.MAC)
+}
+
+func (l *FileAuditLogger) open() error {
+	f, err := os.OpenFile(l.path, os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0600)
+	if err != nil {
+		return err
+	}
+	fi, err := f.Stat()
+	if err != nil {
+		f.Close()
+		return err
+	}
+	l.file, l.size = f, fi.Size()
+	l.w = &countingWriter{w: f, n: &l.size}
+	return nil
+}
+
+// Audit implements AuditLogger.
+func (l *FileAuditLogger) Audit(rec *AuditRecord) {
+	l.mtx.Lock()
+	defer l.mtx.Unlock()
+	if l.file == nil {
+		log.Errorf("failed to write audit record: %v", errAuditClosed)
+		return
+	}
+	if err := l.writeLocked(rec); err != nil {
+		log.Errorf("failed to write audit record: %v", err)
+	}
+	if l.maxSize > 0 && l.size >= l.maxSize {
+		if err := l.rotateLocked(); err != nil {
+			log.Errorf("failed to rotate audit log: %v", err)
+		}
+	}
+}
+
+// Rotate renames the current file and starts a new one.
+func (l *FileAuditLogger) Rotate() error {
+	l.mtx.Lock()
+	defer l.mtx.Unlock()
+	return l.rotateLocked()
+}
+
+func (l *FileAuditLogger) rotateLocked() error {
+	if l.file == nil {
+		return errAuditClosed
+	}
+	if err := l.file.Close(); err != nil {
+		return err
+	}
+	l.file = nil
+	rotated := fmt.Sprintf("%s.%s", l.path, time.Now().UTC().Format("20060102T150405.000000000"))
+	if err := os.Rename(l.path, rotated); err != nil {
+		return err
+	}
+	return l.open()
+}
+
+// Close closes the audit log file.
+func (l *FileAuditLogger) Close() error {
+	l.mtx.Lock()
+	defer l.mtx.Unlock()
+	if l.file == nil {
+		return errAuditClosed
+	}
+	err := l.file.Close()
+	l.file = nil
+	return err
+}
+
+var errAuditClosed = errors.New("audit log is closed")
+
+type countingWriter struct {
+	w io.Writer
+	n *int64
+}
+
+func (c *countingWriter) Write(p []byte) (int, error) {
+	n, err := c.w.Write(p)
+	*c.n += int64(n)
+	return n, err
+}
@@ -0,0 +1,283 @@
+package server
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/hex"
+	"fmt"
+	"io/ioutil"
+	"math/big"
+	"net/url"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/cloudflare/cfssl/helpers"
+	"github.com/cloudflare/cfssl/log"
+	"github.com/cloudflare/gokeyless/protocol"
+)
+
+// certExt matches the files AddFromDir indexes.
+var certExt = []string{".pem", ".crt"}
+
+// A CertIndex indexes certificates by the server names they are valid for,
+// serial number, SKI and expiry, so that terminators and tooling can discover
+// which certificates a keyserver can serve, with OpGetCertificates or the
+// admin API. It is safe for concurrent use.
+type CertIndex struct {
+	mtx sync.RWMutex
+	// certs holds the certificates by SHA-256 fingerprint.
+	certs    map[[sha256.Size]byte]*x509.Certificate
+	byName   map[string][]*x509.Certificate
+	bySerial map[string][]*x509.Certificate
+	bySKI    map[protocol.SKI][]*x509.Certificate
+}
+
+// NewCertIndex returns an empty CertIndex.
+func NewCertIndex() *CertIndex {
+	return &CertIndex{
+		certs:    make(map[[sha256.Size]byte]*x509.Certificate),
+		byName:   make(map[string][]*x509.Certificate),
+		bySerial: make(map[string][]*x509.Certificate),
+		bySKI:    make(map[protocol.SKI][]*x509.Certificate),
+	}
+}
+
+// certNames returns the lowercased server names cert is valid for: its DNS
+// and IP SANs, or its common name if it has neither.
+func certNames(cert *x509.Certificate) []string {
+	var names []string
+	for _, name := range cert.DNSNames {
+		names = append(names, strings.ToLower(strings.TrimSuffix(name, ".")))
+	}
+	for _, ip := range cert.IPAddresses {
+		names = append(names, ip.String())
+	}
+	if len(names) == 0 && cert.Subject.CommonName != "" {
+		names = append(names, strings.ToLower(cert.Subject.CommonName))
+	}
+	return names
+}
+
+// Add indexes certs. Certificates already in the index are skipped.
+func (idx *CertIndex) Add(certs ...*x509.Certificate) error {
+	idx.mtx.Lock()
+	defer idx.mtx.Unlock()
+	for _, cert := range certs {
+		ski, err := protocol.GetSKI(cert.PublicKey)
+		if err != nil {
+			return err
+		}
+		fp := sha256.Sum256(cert.Raw)
+		if _, ok := idx.certs[fp]; ok {
+			continue
+		}
+		idx.certs[fp] = cert
+		for _, name := range certNames(cert) {
+			idx.byName[name] = append(idx.byName[name], cert)
+		}
+		serial := cert.SerialNumber.String()
+		idx.bySerial[serial] = append(idx.bySerial[serial], cert)
+		idx.bySKI[ski] = append(idx.bySKI[ski], cert)
+	}
+	return nil
+}
+
+// AddFromDir indexes the leaf certificate, which comes first, of each ".pem"
+// and ".crt" file in dir and its subdirectories, such as the certificates
+// stored next to the keys of a KeyDirWatcher. Files without certificates,
+// such as keys, are skipped.
+func (idx *CertIndex) AddFromDir(dir string) error {
+	return filepath.Walk(dir, func(path string, info os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+		if info.IsDir() || !hasCertExt(path) {
+			return nil
+		}
+		in, err := ioutil.ReadFile(path)
+		if err != nil {
+			return err
+		}
+		certs, err := helpers.ParseCertificatesPEM(in)
+		if err != nil || len(certs) == 0 {
+			log.Debugf("not indexing %s: no certificate", path)
+			return nil
+		}
+		return idx.Add(certs[0])
+	})
+}
+
+func hasCertExt(path string) bool {
+	ext := strings.ToLower(filepath.Ext(path))
+	for _, e := range certExt {
+		if ext == e {
+			return true
+		}
+	}
+	return false
+}
+
+// Replace replaces the certificates of idx with those of other, as one
+// change, for instance after the certificates have been reindexed.
+func (idx *CertIndex) Replace(other *CertIndex) {
+	other.mtx.RLock()
+	certs, byName, bySerial, bySKI := other.certs, other.byName, other.bySerial, other.bySKI
+	other.mtx.RUnlock()
+
+	idx.mtx.Lock()
+	defer idx.mtx.Unlock()
+	idx.certs, idx.byName, idx.bySerial, idx.bySKI = certs, byName, bySerial, bySKI
+}
+
+// Len returns the number of certificates in idx.
+func (idx *CertIndex) Len() int {
+	idx.mtx.RLock()
+	defer idx.mtx.RUnlock()
+	return len(idx.certs)
+}
+
+// Query returns the certificates matching q, sorted by expiry, soonest first.
+// A name matches the certificates valid for it, including those with a
+// wildcard name covering it.
+func (idx *CertIndex) Query(q protocol.CertificateQuery) []*x509.Certificate {
+	idx.mtx.RLock()
+	defer idx.mtx.RUnlock()
+
+	var candidates []*x509.Certificate
+	switch {
+	case q.Name != "":
+		name := strings.ToLower(strings.TrimSuffix(q.Name, "."))
+		candidates = append(candidates, idx.byName[name]...)
+		if i := strings.IndexByte(name, '.'); i > 0 {
+			candidates = append(candidates, idx.byName["*"+name[i:]]...)
+		}
+	case q.Serial != nil:
+		candidates = idx.bySerial[q.Serial.String()]
+	case q.SKI.Valid():
+		candidates = idx.bySKI[q.SKI]
+	default:
+		candidates = make([]*x509.Certificate, 0, len(idx.certs))
+		for _, cert := range idx.certs {
+			candidates = append(candidates, cert)
+		}
+	}
+
+	var certs []*x509.Certificate
+	seen := make(map[*x509.Certificate]bool)
+	for _, cert := range candidates {
+		if seen[cert] || !certMatches(cert, q) {
+			continue
+		}
+		seen[cert] = true
+		certs = append(certs, cert)
+	}
+	sort.Slice(certs, func(i, j int) bool {
+		if !certs[i].NotAfter.Equal(certs[j].NotAfter) {
+			return certs[i].NotAfter.Before(certs[j].NotAfter)
+		}
+		return bytes.Compare(certs[i].Raw, certs[j].Raw) < 0
+	})
+	return certs
+}
+
+// certMatches reports whether cert matches the criteria of q other than its
+// name, which the index was searched by if it is set.
+func certMatches(cert *x509.Certificate, q protocol.CertificateQuery) bool {
+	if q.Serial != nil && cert.SerialNumber.Cmp(q.Serial) != 0 {
+		return false
+	}
+	if q.SKI.Valid() {
+		if ski, err := protocol.GetSKI(cert.PublicKey); err != nil || ski != q.SKI {
+			return false
+		}
+	}
+	if !q.ExpiresBefore.IsZero() && !cert.NotAfter.Before(q.ExpiresBefore) {
+		return false
+	}
+	return true
+}
+
+// CertIndex returns the index of the certificates s lists for
+// OpGetCertificates and the admin API, which is empty until certificates are
+// added to it.
+func (s *Server) CertIndex() *CertIndex {
+	return s.certs
+}
+
+// certificates encodes the certificates matching the query in payload, as many
+// as fit in a response.
+func (s *Server) certificates(payload []byte) ([]byte, error) {
+	var q protocol.CertificateQuery
+	if err := q.UnmarshalBinary(payload); err != nil {
+		return nil, err
+	}
+	var list protocol.CertificateList
+	size := 0
+	for _, cert := range s.certs.Query(q) {
+		// Leave room for the truncation marker.
+		size += 3 + len(cert.Raw)
+		if size+3 > int(serverFeatures.MaxPayload) {
+			list.Truncated = true
+			break
+		}
+		list.Certificates = append(list.Certificates, cert)
+	}
+	return list.MarshalBinary()
+}
+
+// CertificateInfo describes a certificate in the server's CertIndex, as listed
+// by the admin handler.
+type CertificateInfo struct {
+	// SKI is the SKI of the certificate's key.
+	SKI   string   `json:"ski"`
+	Names []string `json:"names"`
+	// Serial is the hex encoded serial number.
+	Serial    string    `json:"serial"`
+	Issuer    string    `json:"issuer"`
+	NotBefore time.Time `json:"not_before"`
+	NotAfter  time.Time `json:"not_after"`
+}
+
+func certificateInfo(cert *x509.Certificate) CertificateInfo {
+	ski, _ := protocol.GetSKI(cert.PublicKey)
+	return CertificateInfo{
+		SKI:       ski.String(),
+		Names:     certNames(cert),
+		Serial:    hex.EncodeToString(cert.SerialNumber.Bytes()),
+		Issuer:    cert.Issuer.String(),
+		NotBefore: cert.NotBefore,
+		NotAfter:  cert.NotAfter,
+	}
+}
+
+// parseCertificateQuery parses the name, serial, ski and expires_before
+// parameters of an admin request. expires_before is either an RFC 3339 time,
+// or a duration from now such as 720h.
+func parseCertificateQuery(params url.Values) (q protocol.CertificateQuery, err error) {
+	q.Name = params.Get("name")
+	if s := params.Get("serial"); s != "" {
+		b, err := hex.DecodeString(s)
+		if err != nil {
+			return q, fmt.Errorf("serial: %v", err)
+		}
+		q.Serial = new(big.Int).SetBytes(b)
+	}
+	if s := params.Get("ski"); s != "" {
+		if q.SKI, err = parseSKI(s); err != nil {
+			return q, fmt.Errorf("ski: %v", err)
+		}
+	}
+	if s := params.Get("expires_before"); s != "" {
+		if d, err := time.ParseDuration(s); err == nil {
+			q.ExpiresBefore = time.Now().Add(d)
+		} else if q.ExpiresBefore, err = time.Parse(time.RFC3339, s); err != nil {
+			return q, fmt.Errorf("expires_before: %v", err)
+		}
+	}
+	return q, nil
+}
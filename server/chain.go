@@ -0,0 +1,158 @@
+package server
+
+import (
+	"bytes"
+	"context"
+	"crypto"
+	"encoding/hex"
+	"fmt"
+	"sort"
+	"strings"
+
+	"github.com/cloudflare/cfssl/log"
+	"github.com/cloudflare/gokeyless/protocol"
+)
+
+// A KeystoreChain is a Keystore which dispatches lookups to other Keystores,
+// so that a single server can mix e.g. keys loaded from files with keys held in
+// an HSM or a cloud KMS. Each backend may be restricted to the SKIs with given
+// prefixes; the backends for an SKI are asked in the order they were added
+// until one has the key. A backend which fails is logged and skipped, so a
+// later backend can serve keys a remote backend also holds while it is down.
+type KeystoreChain struct {
+	backends []chainedKeystore
+}
+
+type chainedKeystore struct {
+	keys Keystore
+	// prefixes are the hex SKI prefixes the backend serves, or nil if it
+	// serves any SKI.
+	prefixes []string
+}
+
+// NewKeystoreChain returns an empty KeystoreChain.
+func NewKeystoreChain() *KeystoreChain {
+	return &KeystoreChain{}
+}
+
+// Add appends keys to the backends of c. If prefixes are given, keys is only
+// asked for the SKIs whose hex encoding starts with one of them. It is NOT
+// safe to call concurrently with any other methods.
+func (c *KeystoreChain) Add(keys Keystore, prefixes ...string) error {
+	backend := chainedKeystore{keys: keys}
+	for _, prefix := range prefixes {
+		prefix = strings.ToLower(prefix)
+		if prefix == "" || len(prefix) > 2*len(protocol.SKI{}) {
+			return fmt.Errorf("invalid SKI prefix %q", prefix)
+		}
+		// Check the prefix is hex, allowing an odd number of digits.
+		if _, err := hex.DecodeString(prefix + strings.Repeat("0", len(prefix)%2)); err != nil {
+			return fmt.Errorf("invalid SKI prefix %q", prefix)
+		}
+		backend.prefixes = append(backend.prefixes, prefix)
+	}
+	c.backends = append(c.backends, backend)
+	return nil
+}
+
+// Backends returns the Keystores of c in lookup order.
+func (c *KeystoreChain) Backends() []Keystore {
+	backends := make([]Keystore, len(c.backends))
+	for i, backend := range c.backends {
+		backends[i] = backend.keys
+	}
+	return backends
+}
+
+// serves reports whether the backend may hold the key with ski.
+func (b *chainedKeystore) serves(ski protocol.SKI) bool {
+	if b.prefixes == nil {
+		return true
+	}
+	s := ski.String()
+	for _, prefix := range b.prefixes {
+		if strings.HasPrefix(s, prefix) {
+			return true
+		}
+	}
+	return false
+}
+
+// Get returns the key requested by op from the first backend which serves its
+// SKI and has it. If none has it, the first backend error is returned, if any.
+func (c *KeystoreChain) Get(ctx context.Context, op *protocol.Operation) (crypto.Signer, error) {
+	var firstErr error
+	for _, backend := range c.backends {
+		if !backend.serves(op.SKI) {
+			continue
+		}
+		priv, err := backend.keys.Get(ctx, op)
+		if err != nil {
+			log.Warningf("keystore chain: failed to get key with SKI %v: %v", op.SKI, err)
+			if firstErr == nil {
+				firstErr = err
+			}
+			continue
+		}
+		if priv != nil {
+			return priv, nil
+		}
+	}
+	return nil, firstErr
+}
+
+// KeyUsage returns the first usage restriction of key among the backends
+// which serve the SKI requested by op and restrict key usage.
+func (c *KeystoreChain) KeyUsage(op *protocol.Operation, key crypto.Signer) *KeyUsage {
+	for _, backend := range c.backends {
+		if keys, ok := backend.keys.(usageKeystore); ok && backend.serves(op.SKI) {
+			if usage := keys.KeyUsage(op, key); usage != nil {
+				return usage
+			}
+		}
+	}
+	return nil
+}
+
+// SKIs returns the SKIs of the keys of the backends which can list them, in
+// ascending order. Keys outside of the prefixes of their backend are left
+// out, since they can't be looked up.
+func (c *KeystoreChain) SKIs() []protocol.SKI {
+	seen := make(map[protocol.SKI]bool)
+	var skis []protocol.SKI
+	for _, backend := range c.backends {
+		keys, ok := backend.keys.(enumerableKeystore)
+		if !ok {
+			continue
+		}
+		for _, ski := range keys.SKIs() {
+			if !seen[ski] && backend.serves(ski) {
+				seen[ski] = true
+				skis = append(skis, ski)
+			}
+		}
+	}
+	sort.Slice(skis, func(i, j int) bool { return bytes.Compare(skis[i][:], skis[j][:]) < 0 })
+	return skis
+}
+
+// PublicKeys returns the public keys of the backends which can list them, in
+// ascending order of SKI, leaving out those SKIs omits.
+func (c *KeystoreChain) PublicKeys() []protocol.PublicKey {
+	seen := make(map[protocol.SKI]bool)
+	var pubs []protocol.PublicKey
+	for _, backend := range c.backends {
+		keys, ok := backend.keys.(publicKeystore)
+		if !ok {
+			continue
+		}
+		for _, pub := range keys.PublicKeys() {
+			if !seen[pub.SKI] && backend.serves(pub.SKI) {
+				seen[pub.SKI] = true
+				pubs = append(pubs, pub)
+			}
+		}
+	}
+	sort.Slice(pubs, func(i, j int) bool { return bytes.Compare(pubs[i].SKI[:], pubs[j].SKI[:]) < 0 })
+	return pubs
+}
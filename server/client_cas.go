@@ -0,0 +1,61 @@
+package server
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"strings"
+)
+
+// ClientCAMap maps the server names clients ask for with SNI, which may be
+// wildcards such as *.partners.example.com, to the pools of CAs the
+// certificates of those clients are verified against, so that the clients of
+// different PKIs, such as internal and partner terminators, are authenticated
+// separately by one server.
+type ClientCAMap map[string]*x509.CertPool
+
+// pool returns the pool of CAs for serverName, or for the wildcard matching
+// it, or nil if there is none.
+func (m ClientCAMap) pool(serverName string) *x509.CertPool {
+	name := strings.ToLower(strings.TrimSuffix(serverName, "."))
+	if pool, ok := m[name]; ok {
+		return pool
+	}
+	if i := strings.IndexByte(name, '.'); i > 0 {
+		if pool, ok := m["*"+name[i:]]; ok {
+			return pool
+		}
+	}
+	return nil
+}
+
+// ConfigureServer sets up config, a server TLS configuration such as
+// Server.TLSConfig(), to verify the certificates of clients against the pool
+// of CAs of the server name they ask for. Clients which ask for other names,
+// or none, are verified against config.ClientCAs. The GetConfigForClient
+// config already has, if any, such as the one set by SPIFFE, is applied
+// first.
+func (m ClientCAMap) ConfigureServer(config *tls.Config) {
+	next := config.GetConfigForClient
+	config.GetConfigForClient = func(hello *tls.ClientHelloInfo) (*tls.Config, error) {
+		pool := m.pool(hello.ServerName)
+		if pool == nil {
+			if next == nil {
+				return nil, nil
+			}
+			return next(hello)
+		}
+		c := config
+		if next != nil {
+			nc, err := next(hello)
+			if err != nil {
+				return nil, err
+			}
+			if nc != nil {
+				c = nc
+			}
+		}
+		c = c.Clone()
+		c.ClientCAs = pool
+		return c, nil
+	}
+}
@@ -1,6 +1,7 @@
 package server
 
 import (
+	"context"
 	"fmt"
 	"io"
 	"net"
@@ -8,7 +9,6 @@ import (
 	"sync/atomic"
 	"time"
 
-	"github.com/cloudflare/cfssl/log"
 	"github.com/cloudflare/gokeyless/protocol"
 	"github.com/cloudflare/gokeyless/server/internal/worker"
 )
@@ -24,36 +24,163 @@ type PoolSelector interface {
 type conn struct {
 	conn net.Conn
 	// name used to identify this client in logs
-	name     string
+	name string
+	// log and metrics receive the logs and metrics of the connection, by
+	// default the cfssl logger and the sinks set with SetMetricsSinks.
+	log      *serverLogger
+	metrics  *serverMetrics
 	timeout  time.Duration
 	selector PoolSelector
+	// identity of the authenticated client, or nil if unknown. It is set by
+	// OpAuthenticate, so identityMtx guards it.
+	identity    *ClientIdentity
+	identityMtx sync.Mutex
+	// verifier, if set, verifies the token of a client without a certificate,
+	// which may not perform other operations until it has authenticated.
+	verifier TokenVerifier
+	// tokenExpiry is when the client's token expires, or zero if it doesn't.
+	tokenExpiry time.Time
+	// config, if set, is the configuration of the server, whose payload limits
+	// apply to the requests.
+	config *ServeConfig
+	// slo, if set, records the latency of each response.
+	slo *sloTracker
+	// usage, if set, aggregates the requests of the client with those of its
+	// other connections.
+	usage *usageTracker
+	// maxOutstanding, if positive, limits the number of outstanding requests.
+	maxOutstanding int64
+	// outstanding is the number of requests read but not yet answered.
+	outstanding int64
+	// keepaliveInterval, if positive, is how long the connection may be idle
+	// before the client is pinged, once it negotiated keepalive. Clients which
+	// don't answer within keepaliveTimeout are disconnected, but those which
+	// do are not closed for being idle.
+	keepaliveInterval, keepaliveTimeout time.Duration
+	// pingID is the ID of the last keepalive ping.
+	pingID uint32
+	// writeMtx serializes writes to conn, which are made by SubmitResult and,
+	// for rejected requests, GetJob.
+	writeMtx sync.Mutex
+	// streams holds the operations streamed with OpStream by their ID, and
+	// streamEnds the IDs of the streams whose StreamEnd request, by packet
+	// ID, is being executed.
+	streams    map[uint32]*stream
+	streamEnds map[uint32]uint32
+	streamMtx  sync.Mutex
 
 	closed        uint32 // set to 1 when the conn is closed
+	noPadding     uint32 // set to 1 once the client agreed to unpadded responses
+	compression   uint32 // the protocol.Compression agreed with the client for responses
+	keepalive     uint32 // set to 1 once the client agreed to keepalive pings
+	keyRemoved    uint32 // set to 1 once the client agreed to OpKeyRemoved messages
+	timing        uint32 // set to 1 once the client agreed to request timings
+	reconnect     uint32 // set to 1 once the client agreed to OpReconnect messages
+	retiring      uint32 // set to 1 once the conn reached its maximum age or size
 	serverClosing uint32 // set to 1 when the conn is being closed by the server (i.e. not an error)
 
 	stats *connStats
 }
 
+const (
+	// connEventHistory is the number of recent events kept per connection.
+	connEventHistory = 64
+	// connErrorHistory is the number of recent error responses kept per
+	// connection.
+	connErrorHistory = 16
+)
+
 type connEvent struct {
 	time   time.Time
 	id     uint32
 	opcode protocol.Op
+	// write is set for the responses written, and err is their error.
+	write bool
+	err   protocol.Error
+}
+
+// An eventRing holds the last size events added to it.
+type eventRing struct {
+	size   int
+	events []connEvent
+	// next is the index of the oldest event once the ring is full.
+	next int
+}
+
+func (r *eventRing) add(e connEvent) {
+	if len(r.events) < r.size {
+		r.events = append(r.events, e)
+		return
+	}
+	r.events[r.next] = e
+	r.next = (r.next + 1) % r.size
+}
+
+// list returns a copy of the events, oldest first.
+func (r *eventRing) list() []connEvent {
+	events := make([]connEvent, 0, len(r.events))
+	events = append(events, r.events[r.next:]...)
+	return append(events, r.events[:r.next]...)
 }
 
 type connStats struct {
+	// bytesRead and bytesWritten are updated atomically.
+	bytesRead    int64
+	bytesWritten int64
+
 	spawnTime time.Time
 	reads     int
 	writes    int
 	lastRead  connEvent
 	lastWrite connEvent
+	// ops counts the requests read by opcode, and errors the error responses
+	// by error.
+	ops    map[protocol.Op]int
+	errors map[protocol.Error]int
+	// events are the recent requests and responses, and errorEvents the recent
+	// error responses.
+	events      eventRing
+	errorEvents eventRing
 
 	lock sync.Mutex
 }
 
+func newConnStats() *connStats {
+	return &connStats{
+		spawnTime:   time.Now(),
+		ops:         make(map[protocol.Op]int),
+		errors:      make(map[protocol.Error]int),
+		events:      eventRing{size: connEventHistory},
+		errorEvents: eventRing{size: connErrorHistory},
+	}
+}
+
+func (s *connStats) recordRead(e connEvent) {
+	s.lock.Lock()
+	s.reads++
+	s.lastRead = e
+	s.ops[e.opcode]++
+	s.events.add(e)
+	s.lock.Unlock()
+}
+
+func (s *connStats) recordWrite(e connEvent) {
+	e.write = true
+	s.lock.Lock()
+	s.writes++
+	s.lastWrite = e
+	s.events.add(e)
+	if e.err != protocol.ErrNone {
+		s.errors[e.err]++
+		s.errorEvents.add(e)
+	}
+	s.lock.Unlock()
+}
+
 func (s *connStats) String() string {
 	s.lock.Lock()
 	str := fmt.Sprintf(
-		"spawnTime=%s read=%d lastReadId=%d lastReadTime=%s written=%d lastWriteId=%d lastWriteTime=%s",
+		"spawnTime=%s read=%d lastReadId=%d lastReadTime=%s written=%d lastWriteId=%d lastWriteTime=%s bytesRead=%d bytesWritten=%d",
 		s.spawnTime.Format(time.RFC3339),
 		s.reads,
 		s.lastRead.id,
@@ -61,103 +188,344 @@ func (s *connStats) String() string {
 		s.writes,
 		s.lastWrite.id,
 		s.lastWrite.time.Format(time.RFC3339),
+		atomic.LoadInt64(&s.bytesRead),
+		atomic.LoadInt64(&s.bytesWritten),
 	)
 	s.lock.Unlock()
 	return str
 }
 
-func newConn(name string, c net.Conn, timeout time.Duration, selector PoolSelector) *conn {
+func newConn(name string, c net.Conn, timeout time.Duration, selector PoolSelector, identity *ClientIdentity) *conn {
 	return &conn{
 		conn:     c,
 		name:     name,
 		timeout:  timeout,
 		selector: selector,
+		identity: identity,
+		log:      &serverLogger{},
+		metrics:  &serverMetrics{},
 		closed:   0,
-		stats: &connStats{
-			spawnTime: time.Now(),
-		},
+		stats:    newConnStats(),
 	}
 }
 
 func (c *conn) GetJob() (job interface{}, pool *worker.Pool, ok bool) {
-	err := c.conn.SetReadDeadline(time.Now().Add(c.timeout))
-	if err != nil {
-		c.LogConnErr(err)
-		c.conn.Close()
-		atomic.StoreUint32(&c.closed, 1)
-		return nil, nil, false
+	for {
+		req, ok := c.readRequest()
+		if !ok {
+			return nil, nil, false
+		}
+		if c.maxOutstanding > 0 && atomic.LoadInt64(&c.outstanding) >= c.maxOutstanding {
+			// Answer right away rather than queueing behind the client's other
+			// requests.
+			c.metrics.logLimitRejected("outstanding_requests")
+			if !c.write(makeErrResponse(req, protocol.ErrThrottled, req.reqBegin)) {
+				return nil, nil, false
+			}
+			continue
+		}
+		if c.config != nil && c.config.payloadTooLarge(&req.pkt.Operation, c.log, c.metrics) {
+			if !c.write(makeErrResponse(req, protocol.ErrFormat, req.reqBegin)) {
+				return nil, nil, false
+			}
+			continue
+		}
+		if c.verifier != nil {
+			handled, ok := c.authenticate(req)
+			if !ok {
+				return nil, nil, false
+			}
+			if handled {
+				continue
+			}
+		}
+		if req.pkt.Opcode == protocol.OpStream {
+			run, resp := c.stream(req)
+			if run == nil {
+				if !c.write(resp) {
+					return nil, nil, false
+				}
+				continue
+			}
+			req = *run
+		}
+		atomic.AddInt64(&c.outstanding, 1)
+		c.checkLifetime()
+		return req, c.selector.SelectPool(req.pkt), true
 	}
+}
 
-	pkt := new(protocol.Packet)
-	_, err = pkt.ReadFrom(c.conn)
-	if err != nil {
-		// If we timeout from the deadline above, call Destroy to indicate the
-		// server is closing an idle connection (as opposed to an actual error).
-		if nerr, ok := err.(net.Error); ok && nerr.Timeout() {
-			c.Destroy()
-			return nil, nil, false
+// tokenVerifyTimeout limits the time taken to verify a token, including any
+// requests to the token issuer.
+const tokenVerifyTimeout = 10 * time.Second
+
+// authenticate handles OpAuthenticate, and refuses requests from clients
+// which have yet to authenticate with a token. It reports whether it answered
+// req itself, and whether the connection is still usable.
+func (c *conn) authenticate(req request) (handled, ok bool) {
+	identity := c.clientIdentity()
+	if identity != nil && !c.tokenExpiry.IsZero() && time.Now().After(c.tokenExpiry) {
+		// Closing the connection makes the client reconnect with a new token.
+		c.log.Infof("connection %v: token of %v expired", c.name, identity)
+		c.Destroy()
+		return true, false
+	}
+
+	switch req.pkt.Opcode {
+	case protocol.OpAuthenticate:
+		ctx, cancel := context.WithTimeout(context.Background(), tokenVerifyTimeout)
+		identity, expiry, err := c.verifier.VerifyToken(ctx, string(req.pkt.Payload))
+		cancel()
+		if err != nil {
+			c.log.Warningf("connection %v: token rejected: %v", c.name, err)
+			return true, c.write(makeErrResponse(req, protocol.ErrUnauthorized, req.reqBegin))
+		}
+		c.identityMtx.Lock()
+		c.identity = identity
+		c.identityMtx.Unlock()
+		c.tokenExpiry = expiry
+		c.log.Debugf("connection %v: authenticated as %v", c.name, identity)
+		return true, c.write(makeRespondResponse(req, nil, req.reqBegin))
+	case protocol.OpPing, protocol.OpHello, protocol.OpAttest:
+		// Clients may check the server before sending it their token.
+		return false, true
+	}
+	if identity == nil {
+		return true, c.write(makeErrResponse(req, protocol.ErrUnauthorized, req.reqBegin))
+	}
+	return false, true
+}
+
+// clientIdentity returns the identity of the client, or nil if it is unknown.
+func (c *conn) clientIdentity() *ClientIdentity {
+	c.identityMtx.Lock()
+	defer c.identityMtx.Unlock()
+	return c.identity
+}
+
+// readRequest reads the next request from the connection. If the client
+// agreed to keepalive pings, it pings the client when the connection is idle,
+// and consumes the pongs.
+func (c *conn) readRequest() (req request, ok bool) {
+	var pkt *protocol.Packet
+	for pinged := false; pkt == nil; {
+		timeout := c.timeout
+		if pinged {
+			timeout = c.keepaliveTimeout
+		} else if c.keepaliveEnabled() {
+			timeout = c.keepaliveInterval
+		}
+		err := c.conn.SetReadDeadline(time.Now().Add(timeout))
+		if err != nil {
+			c.LogConnErr(err)
+			c.conn.Close()
+			atomic.StoreUint32(&c.closed, 1)
+			return request{}, false
+		}
+
+		limit := 0
+		if c.config != nil {
+			limit = c.config.maxPacketLength()
+		}
+		pkt = new(protocol.Packet)
+		n, err := pkt.ReadFromLimit(c.conn, limit)
+		atomic.AddInt64(&c.stats.bytesRead, n)
+		if c.usage != nil {
+			c.usage.recordBytes(c.clientIdentity(), n, false)
+		}
+		if err == protocol.ErrPacketTooLarge {
+			// The body was discarded, so the request is answered without
+			// knowing its opcode.
+			c.log.Warningf("connection %v: rejected %dB request, over the payload limits", c.name, pkt.Length)
+			c.metrics.logLimitRejected("payload")
+			req := request{pkt: pkt, reqBegin: time.Now(), connName: c.name, log: c.log, metrics: c.metrics}
+			if !c.write(makeErrResponse(req, protocol.ErrFormat, req.reqBegin)) {
+				return request{}, false
+			}
+			pkt, pinged = nil, false
+			continue
+		}
+		if err != nil {
+			if nerr, ok := err.(net.Error); ok && nerr.Timeout() {
+				// An idle client which agreed to keepalive is pinged rather
+				// than disconnected. It may have agreed while we were waiting.
+				// A timeout in the middle of a packet leaves the connection
+				// unusable.
+				if !pinged && n == 0 && c.keepaliveEnabled() {
+					if !c.ping() {
+						return request{}, false
+					}
+					pkt, pinged = nil, true
+					continue
+				}
+				if pinged {
+					c.log.Warningf("connection %v: no response to keepalive ping within %v %s", c.name, c.keepaliveTimeout, c.stats)
+					c.metrics.logKeepaliveTimeout()
+				}
+				// Call Destroy to indicate the server is closing an idle or
+				// unresponsive connection (as opposed to an actual error).
+				c.Destroy()
+				return request{}, false
+			}
+			// Otherwise, we've encountered some other kind of error and should
+			// report it appropriately.
+			c.LogConnErr(err)
+			c.conn.Close()
+			atomic.StoreUint32(&c.closed, 1)
+			return request{}, false
+		}
+		if pkt.Opcode == protocol.OpPong && c.keepaliveEnabled() {
+			pkt, pinged = nil, false
+			continue
+		}
+		if c.config != nil && c.config.strictPadding {
+			if err := pkt.CheckPadding(atomic.LoadUint32(&c.noPadding) == 0); err != nil {
+				c.log.Warningf("connection %v: rejected request with invalid padding: %v", c.name, err)
+				c.metrics.logPaddingRejected(pkt.Opcode)
+				req := request{pkt: pkt, reqBegin: time.Now(), connName: c.name, log: c.log, metrics: c.metrics}
+				if !c.write(makeErrResponse(req, protocol.ErrFormat, req.reqBegin)) {
+					return request{}, false
+				}
+				pkt, pinged = nil, false
+			}
 		}
-		// Otherwise, we've encountered some other kind of error and should
-		// report it appropriately.
-		c.LogConnErr(err)
-		c.conn.Close()
-		atomic.StoreUint32(&c.closed, 1)
-		return nil, nil, false
 	}
 
-	logRequest(pkt.Opcode)
-	req := request{
+	identity := c.clientIdentity()
+	req = request{
 		pkt:      pkt,
 		reqBegin: time.Now(),
 		connName: c.name,
+		identity: identity,
+		tenant:   c.config.tenantOf(identity),
+		log:      c.log,
+		metrics:  c.metrics,
+	}
+	c.metrics.logRequest(pkt.Opcode)
+	if req.tenant != "" {
+		c.metrics.logTenantRequest(req.tenant, pkt.Opcode)
+	}
+	if c.usage != nil {
+		c.usage.recordRequest(identity, pkt.Opcode)
 	}
 
-	c.stats.lock.Lock()
-	c.stats.reads++
-	c.stats.lastRead.id = pkt.ID
-	c.stats.lastRead.time = req.reqBegin
-	c.stats.lastRead.opcode = pkt.Opcode
-	c.stats.lock.Unlock()
+	c.stats.recordRead(connEvent{time: req.reqBegin, id: pkt.ID, opcode: pkt.Opcode})
 
-	return req, c.selector.SelectPool(pkt), true
+	return req, true
 }
 
 func (c *conn) SubmitResult(result interface{}) bool {
-	resp := result.(response)
-	pkt := protocol.Packet{
-		Header: protocol.Header{
-			MajorVers: 0x01,
-			MinorVers: 0x00,
-			Length:    resp.op.Bytes(),
-			ID:        resp.id,
-		},
-		Operation: resp.op,
-	}
-
-	buf, err := pkt.MarshalBinary()
-	if err != nil {
-		// According to MarshalBinary's documentation, it will never return a
-		// non-nil error.
-		panic(fmt.Sprintf("unexpected internal error: %v", err))
+	atomic.AddInt64(&c.outstanding, -1)
+	resp := c.streamResponse(result.(response))
+	if c.config != nil {
+		if f, ok := c.config.faults[resp.reqOpcode]; ok {
+			return c.submitWithFault(f, resp)
+		}
+	}
+	if !c.write(resp) {
+		return false
 	}
+	c.closeIfIdle()
+	return true
+}
 
-	_, err = c.conn.Write(buf)
+// write writes resp to the connection.
+func (c *conn) write(resp response) bool {
+	c.writeMtx.Lock()
+	defer c.writeMtx.Unlock()
+
+	resp.op.NoPadding = atomic.LoadUint32(&c.noPadding) == 1
+	if c.config != nil {
+		resp.op.MinLength = c.config.minResponseLength
+	}
+	if atomic.LoadUint32(&c.timing) == 1 {
+		resp.op.Timing = resp.timing()
+	}
+	if err := resp.op.Compress(protocol.Compression(atomic.LoadUint32(&c.compression))); err != nil {
+		c.log.Errorf("connection %v: compressing response: %v", c.name, err)
+	}
+	pkt := protocol.NewPacket(resp.id, resp.op)
+	if !c.writePacket(&pkt) {
+		return false
+	}
+
+	// The features negotiated by OpHello apply to the responses after the one
+	// carrying them.
+	if resp.reqOpcode == protocol.OpHello && resp.err == protocol.ErrNone {
+		var features protocol.Features
+		if err := features.UnmarshalBinary(resp.op.Payload); err == nil {
+			if features.Padding == protocol.PaddingOptional {
+				atomic.StoreUint32(&c.noPadding, 1)
+			}
+			if len(features.Compression) > 0 {
+				atomic.StoreUint32(&c.compression, uint32(features.Compression[0]))
+			}
+			if features.Keepalive {
+				atomic.StoreUint32(&c.keepalive, 1)
+			}
+			if features.KeyRemoved {
+				atomic.StoreUint32(&c.keyRemoved, 1)
+			}
+			if features.Timing {
+				atomic.StoreUint32(&c.timing, 1)
+			}
+			if features.Reconnect {
+				atomic.StoreUint32(&c.reconnect, 1)
+			}
+		}
+	}
+
+	c.metrics.logRequestTotalDuration(resp.reqOpcode, resp.reqBegin, resp.err)
+	if c.slo != nil {
+		c.slo.observe(resp.reqOpcode, time.Since(resp.reqBegin))
+	}
+	if c.usage != nil {
+		c.usage.recordResponse(c.clientIdentity(), resp.err)
+	}
+
+	c.stats.recordWrite(connEvent{time: time.Now(), id: pkt.ID, opcode: resp.reqOpcode, err: resp.err})
+
+	return true
+}
+
+// keepaliveEnabled reports whether the client is to be pinged when idle.
+func (c *conn) keepaliveEnabled() bool {
+	return c.keepaliveInterval > 0 && atomic.LoadUint32(&c.keepalive) == 1
+}
+
+// ping sends a keepalive ping to the client.
+func (c *conn) ping() bool {
+	c.writeMtx.Lock()
+	defer c.writeMtx.Unlock()
+
+	op := protocol.Operation{Opcode: protocol.OpPing, NoPadding: atomic.LoadUint32(&c.noPadding) == 1}
+	pkt := protocol.NewPacket(atomic.AddUint32(&c.pingID, 1), op)
+	return c.writePacket(&pkt)
+}
+
+// notifyKeyRemoved tells the client that the key with ski is no longer served.
+func (c *conn) notifyKeyRemoved(ski protocol.SKI) bool {
+	c.writeMtx.Lock()
+	defer c.writeMtx.Unlock()
+
+	op := protocol.Operation{Opcode: protocol.OpKeyRemoved, SKI: ski, NoPadding: atomic.LoadUint32(&c.noPadding) == 1}
+	pkt := protocol.NewPacket(0, op)
+	return c.writePacket(&pkt)
+}
+
+// writePacket writes pkt to the connection. c.writeMtx must be held.
+func (c *conn) writePacket(pkt *protocol.Packet) bool {
+	n, err := pkt.WriteTo(c.conn)
+	atomic.AddInt64(&c.stats.bytesWritten, n)
+	if c.usage != nil {
+		c.usage.recordBytes(c.clientIdentity(), n, true)
+	}
 	if err != nil {
 		c.LogConnErr(err)
 		c.conn.Close()
 		atomic.StoreUint32(&c.closed, 1)
 		return false
 	}
-
-	logRequestTotalDuration(resp.reqOpcode, resp.reqBegin, resp.err)
-
-	c.stats.lock.Lock()
-	c.stats.writes++
-	c.stats.lastWrite.id = pkt.ID
-	c.stats.lastWrite.time = time.Now()
-	c.stats.lastWrite.opcode = resp.reqOpcode
-	c.stats.lock.Unlock()
-
 	return true
 }
 
@@ -188,11 +556,11 @@ func (c *conn) LogConnErr(err error) {
 	}
 
 	if err == nil { // We're destroying the connection
-		log.Debugf("connection %v: server closing connection %s", c.name, c.stats)
+		c.log.Debugf("connection %v: server closing connection %s", c.name, c.stats)
 	} else if err == io.EOF {
-		log.Debugf("connection %v: closed by client %s", c.name, c.stats)
+		c.log.Debugf("connection %v: closed by client %s", c.name, c.stats)
 	} else {
-		logConnFailure()
-		log.Errorf("connection %v: encountered error: %v %s", c.name, err, c.stats)
+		c.metrics.logConnFailure()
+		c.log.Errorf("connection %v: encountered error: %v %s", c.name, err, c.stats)
 	}
 }
@@ -0,0 +1,26 @@
+package server
+
+import (
+	"math"
+	"runtime"
+)
+
+// AvailableCPUs returns the number of CPUs the server can use at once: the
+// least of runtime.NumCPU, GOMAXPROCS and, on Linux, the CPU quota of the
+// cgroup of the process rounded up, so that worker pools aren't sized for
+// the whole machine in a container limited to a few CPUs. It is at least 1.
+func AvailableCPUs() int {
+	n := runtime.GOMAXPROCS(0)
+	if cpus := runtime.NumCPU(); cpus < n {
+		n = cpus
+	}
+	if quota, ok := cgroupCPUQuota(); ok {
+		if q := int(math.Ceil(quota)); q < n {
+			n = q
+		}
+	}
+	if n < 1 {
+		n = 1
+	}
+	return n
+}
@@ -0,0 +1,46 @@
+package server
+
+import (
+	"io/ioutil"
+	"strconv"
+	"strings"
+)
+
+// cgroupCPUQuota returns the number of CPUs the cgroup of the process may use
+// per period, if it is limited. The cgroup is assumed to be mounted at
+// /sys/fs/cgroup, as it is in containers.
+func cgroupCPUQuota() (float64, bool) {
+	// cgroup v2 has "$MAX $PERIOD" in cpu.max, with "max" for no limit.
+	if b, err := ioutil.ReadFile("/sys/fs/cgroup/cpu.max"); err == nil {
+		fields := strings.Fields(string(b))
+		if len(fields) != 2 {
+			return 0, false
+		}
+		return cpuQuota(fields[0], fields[1])
+	}
+	// cgroup v1 has them in separate files, with -1 for no limit.
+	for _, dir := range []string{"/sys/fs/cgroup/cpu", "/sys/fs/cgroup/cpu,cpuacct"} {
+		quota, err := ioutil.ReadFile(dir + "/cpu.cfs_quota_us")
+		if err != nil {
+			continue
+		}
+		period, err := ioutil.ReadFile(dir + "/cpu.cfs_period_us")
+		if err != nil {
+			continue
+		}
+		return cpuQuota(strings.TrimSpace(string(quota)), strings.TrimSpace(string(period)))
+	}
+	return 0, false
+}
+
+func cpuQuota(quota, period string) (float64, bool) {
+	q, err := strconv.ParseInt(quota, 10, 64)
+	if err != nil || q <= 0 {
+		return 0, false
+	}
+	p, err := strconv.ParseInt(period, 10, 64)
+	if err != nil || p <= 0 {
+		return 0, false
+	}
+	return float64(q) / float64(p), true
+}
@@ -0,0 +1,9 @@
+//go:build !linux
+// +build !linux
+
+package server
+
+// cgroupCPUQuota is only supported on Linux.
+func cgroupCPUQuota() (float64, bool) {
+	return 0, false
+}
@@ -0,0 +1,219 @@
+package server
+
+import (
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/rsa"
+	"errors"
+	"io"
+	"math/big"
+	"sync"
+
+	"golang.org/x/crypto/ed25519"
+
+	"github.com/cloudflare/gokeyless/protocol"
+	"github.com/cloudflare/gokeyless/sm2"
+)
+
+// ErrKeyDestroyed is returned when a CryptoKey is used after it was destroyed.
+var ErrKeyDestroyed = errors.New("key has been destroyed")
+
+// errMarshalKey is returned when a CryptoKey is marshaled.
+var errMarshalKey = errors.New("private keys can't be marshaled")
+
+// A CryptoKey wraps a software private key so that its material can be
+// zeroized once the key is no longer served, and so that it isn't printed or
+// marshaled by mistake: it formats as its SKI and refuses to be marshaled.
+// DefaultKeystore.SetZeroize wraps the keys of a keystore in CryptoKeys.
+type CryptoKey struct {
+	mtx sync.RWMutex
+	// key is nil once the CryptoKey has been destroyed.
+	key crypto.Signer
+	pub crypto.PublicKey
+	ski protocol.SKI
+}
+
+// NewCryptoKey wraps priv, which should not be used directly any more.
+func NewCryptoKey(priv crypto.Signer) (*CryptoKey, error) {
+	pub := priv.Public()
+	ski, err := protocol.GetSKI(pub)
+	if err != nil {
+		return nil, err
+	}
+	return &CryptoKey{key: priv, pub: pub, ski: ski}, nil
+}
+
+// Public returns the public key of k, which remains available once k has been
+// destroyed.
+func (k *CryptoKey) Public() crypto.PublicKey {
+	return k.pub
+}
+
+// Use calls f with the wrapped key, e.g. to check its type, and returns its
+// error. The key must not be retained after f returns. k is not destroyed
+// while f runs.
+func (k *CryptoKey) Use(f func(priv crypto.Signer) error) error {
+	k.mtx.RLock()
+	defer k.mtx.RUnlock()
+	if k.key == nil {
+		return ErrKeyDestroyed
+	}
+	return f(k.key)
+}
+
+// Sign signs digest with the wrapped key.
+func (k *CryptoKey) Sign(rand io.Reader, digest []byte, opts crypto.SignerOpts) (sig []byte, err error) {
+	err = k.Use(func(priv crypto.Signer) error {
+		sig, err = priv.Sign(rand, digest, opts)
+		return err
+	})
+	return sig, err
+}
+
+// Decrypt decrypts msg with the wrapped key, if it is a crypto.Decrypter.
+func (k *CryptoKey) Decrypt(rand io.Reader, msg []byte, opts crypto.DecrypterOpts) (ptxt []byte, err error) {
+	err = k.Use(func(priv crypto.Signer) error {
+		d, ok := priv.(crypto.Decrypter)
+		if !ok {
+			return errors.New("key is not a Decrypter")
+		}
+		ptxt, err = d.Decrypt(rand, msg, opts)
+		return err
+	})
+	return ptxt, err
+}
+
+// Destroy zeroizes the private material of the wrapped key, once any
+// operations in progress complete. Later operations fail with
+// ErrKeyDestroyed.
+func (k *CryptoKey) Destroy() {
+	k.mtx.Lock()
+	defer k.mtx.Unlock()
+	if k.key != nil {
+		zeroize(k.key)
+		k.key = nil
+	}
+}
+
+// String identifies k by its SKI, without revealing private material.
+func (k *CryptoKey) String() string {
+	return "CryptoKey(" + k.ski.String() + ")"
+}
+
+// GoString is like String, so that %#v doesn't print private material either.
+func (k *CryptoKey) GoString() string {
+	return k.String()
+}
+
+// MarshalJSON returns an error, so that k is never encoded.
+func (k *CryptoKey) MarshalJSON() ([]byte, error) {
+	return nil, errMarshalKey
+}
+
+// MarshalText returns an error, so that k is never encoded.
+func (k *CryptoKey) MarshalText() ([]byte, error) {
+	return nil, errMarshalKey
+}
+
+// GobEncode returns an error, so that k is never encoded.
+func (k *CryptoKey) GobEncode() ([]byte, error) {
+	return nil, errMarshalKey
+}
+
+// zeroize overwrites the private material of priv, as far as the standard
+// library exposes it. Keys of other types, e.g. held in an HSM, are left
+// alone.
+func zeroize(priv crypto.Signer) {
+	switch priv := priv.(type) {
+	case *rsa.PrivateKey:
+		zeroizeInt(priv.D)
+		for _, p := range priv.Primes {
+			zeroizeInt(p)
+		}
+		zeroizeInt(priv.Precomputed.Dp)
+		zeroizeInt(priv.Precomputed.Dq)
+		zeroizeInt(priv.Precomputed.Qinv)
+		for _, v := range priv.Precomputed.CRTValues {
+			zeroizeInt(v.Exp)
+			zeroizeInt(v.Coeff)
+			zeroizeInt(v.R)
+		}
+	case *ecdsa.PrivateKey:
+		zeroizeInt(priv.D)
+	case ed25519.PrivateKey:
+		zeroizeBytes(priv)
+	case *sm2.PrivateKey:
+		zeroizeInt(priv.D)
+	}
+}
+
+func zeroizeInt(x *big.Int) {
+	if x == nil {
+		return
+	}
+	words := x.Bits()
+	for i := range words {
+		words[i] = 0
+	}
+	x.SetInt64(0)
+}
+
+// zeroizeBytes overwrites b with zeros, e.g. once a key file has been parsed.
+func zeroizeBytes(b []byte) {
+	for i := range b {
+		b[i] = 0
+	}
+}
+
+// SetZeroize makes keys wrap the software keys added to it from now on in
+// CryptoKeys, which are zeroized when they are removed, retired by a rotation
+// or replaced, or when DestroyKeys is called.
+func (keys *DefaultKeystore) SetZeroize(zeroize bool) {
+	keys.mtx.Lock()
+	defer keys.mtx.Unlock()
+	keys.zeroize = zeroize
+}
+
+// DestroyKeys zeroizes the CryptoKeys of keys, including staged ones, e.g.
+// once keys has been replaced by a reloaded keystore.
+func (keys *DefaultKeystore) DestroyKeys() {
+	keys.mtx.Lock()
+	defer keys.mtx.Unlock()
+	for _, priv := range keys.skis {
+		destroyKey(priv)
+	}
+	for _, r := range keys.rotations {
+		destroyKey(r.staged)
+	}
+}
+
+// protect wraps priv in a CryptoKey if keys zeroizes its keys and priv is a
+// software key. keys.mtx must be held.
+func (keys *DefaultKeystore) protect(priv crypto.Signer) crypto.Signer {
+	if !keys.zeroize {
+		return priv
+	}
+	switch priv.(type) {
+	case *rsa.PrivateKey, *ecdsa.PrivateKey, ed25519.PrivateKey, *sm2.PrivateKey:
+		if k, err := NewCryptoKey(priv); err == nil {
+			return k
+		}
+	}
+	return priv
+}
+
+// destroyKey destroys priv if it is a CryptoKey.
+func destroyKey(priv crypto.Signer) {
+	if k, ok := priv.(*CryptoKey); ok {
+		k.Destroy()
+	}
+}
+
+// useKey calls f with the key wrapped by key if it is a CryptoKey, so that the
+// key's type can be checked, or with key itself.
+func useKey(key crypto.Signer, f func(crypto.Signer) error) error {
+	if k, ok := key.(*CryptoKey); ok {
+		return k.Use(f)
+	}
+	return f(key)
+}
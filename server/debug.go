@@ -0,0 +1,249 @@
+package server
+
+import (
+	"encoding/json"
+	"expvar"
+	"net/http"
+	"net/http/pprof"
+	"sort"
+	"sync/atomic"
+	"time"
+
+	"github.com/cloudflare/gokeyless/protocol"
+)
+
+// maxClosedConnHistory is the number of closed connections whose history is
+// kept.
+const maxClosedConnHistory = 128
+
+// ConnInfo describes an active client connection, as listed by the debug
+// handler.
+type ConnInfo struct {
+	// Name is the client's address.
+	Name string `json:"name"`
+	// Client is the authenticated client, or "<anonymous>".
+	Client      string    `json:"client"`
+	SpawnTime   time.Time `json:"spawn_time"`
+	Reads       int       `json:"reads"`
+	Writes      int       `json:"writes"`
+	LastRead    ConnEvent `json:"last_read"`
+	LastWrite   ConnEvent `json:"last_write"`
+	Outstanding int64     `json:"outstanding"`
+}
+
+// ConnEvent is a request read or a response written on a connection.
+type ConnEvent struct {
+	Time   time.Time `json:"time"`
+	ID     uint32    `json:"id"`
+	Opcode string    `json:"opcode"`
+	// Kind is "read" for requests and "write" for responses.
+	Kind string `json:"kind"`
+	// Error is the error of an error response.
+	Error string `json:"error,omitempty"`
+}
+
+func (e connEvent) info() ConnEvent {
+	info := ConnEvent{Time: e.time, ID: e.id, Opcode: e.opcode.String(), Kind: "read"}
+	if e.write {
+		info.Kind = "write"
+		if e.err != protocol.ErrNone {
+			info.Error = e.err.String()
+		}
+	}
+	return info
+}
+
+func eventInfos(events []connEvent) []ConnEvent {
+	infos := make([]ConnEvent, len(events))
+	for i, e := range events {
+		infos[i] = e.info()
+	}
+	return infos
+}
+
+// ConnHistory is the history of an active or recently closed connection, as
+// dumped by the debug handler for post-incident analysis.
+type ConnHistory struct {
+	ConnInfo
+	// ClosedTime is when the connection was closed, if it was.
+	ClosedTime   *time.Time `json:"closed_time,omitempty"`
+	BytesRead    int64      `json:"bytes_read"`
+	BytesWritten int64      `json:"bytes_written"`
+	// Ops counts the requests read by opcode, and Errors the error responses
+	// by error.
+	Ops    map[string]int `json:"ops"`
+	Errors map[string]int `json:"errors"`
+	// Events are the last requests read and responses written, and
+	// ErrorEvents the last error responses, oldest first.
+	Events      []ConnEvent `json:"events"`
+	ErrorEvents []ConnEvent `json:"error_events"`
+}
+
+// ConnErrorEvent is an error response in the error timeline of a
+// ConnStatsDump.
+type ConnErrorEvent struct {
+	// Conn is the name of the connection the response was written on.
+	Conn string `json:"conn"`
+	ConnEvent
+}
+
+// ConnStatsDump aggregates the histories of the active connections and of
+// the last connections closed.
+type ConnStatsDump struct {
+	Time time.Time `json:"time"`
+	// Connections are the histories, oldest connection first.
+	Connections  []ConnHistory  `json:"connections"`
+	BytesRead    int64          `json:"bytes_read"`
+	BytesWritten int64          `json:"bytes_written"`
+	Ops          map[string]int `json:"ops"`
+	Errors       map[string]int `json:"errors"`
+	// ErrorTimeline merges the ErrorEvents of the connections, oldest first.
+	ErrorTimeline []ConnErrorEvent `json:"error_timeline"`
+}
+
+// info describes c. c.stats.lock must be held.
+func (c *conn) info() ConnInfo {
+	return ConnInfo{
+		Name:        c.name,
+		Client:      c.clientIdentity().String(),
+		SpawnTime:   c.stats.spawnTime,
+		Reads:       c.stats.reads,
+		Writes:      c.stats.writes,
+		LastRead:    c.stats.lastRead.info(),
+		LastWrite:   c.stats.lastWrite.info(),
+		Outstanding: atomic.LoadInt64(&c.outstanding),
+	}
+}
+
+// history returns the history of c.
+func (c *conn) history() ConnHistory {
+	c.stats.lock.Lock()
+	defer c.stats.lock.Unlock()
+	h := ConnHistory{
+		ConnInfo:     c.info(),
+		BytesRead:    atomic.LoadInt64(&c.stats.bytesRead),
+		BytesWritten: atomic.LoadInt64(&c.stats.bytesWritten),
+		Ops:          make(map[string]int, len(c.stats.ops)),
+		Errors:       make(map[string]int, len(c.stats.errors)),
+		Events:       eventInfos(c.stats.events.list()),
+		ErrorEvents:  eventInfos(c.stats.errorEvents.list()),
+	}
+	for op, n := range c.stats.ops {
+		h.Ops[op.String()] += n
+	}
+	for err, n := range c.stats.errors {
+		h.Errors[err.String()] += n
+	}
+	return h
+}
+
+// Connections returns the active keyless protocol connections, oldest first.
+// Requests made over HTTP/2 are not included.
+func (s *Server) Connections() []ConnInfo {
+	s.mtx.Lock()
+	conns := make([]*conn, 0, len(s.conns))
+	for c := range s.conns {
+		conns = append(conns, c)
+	}
+	s.mtx.Unlock()
+
+	infos := make([]ConnInfo, len(conns))
+	for i, c := range conns {
+		c.stats.lock.Lock()
+		infos[i] = c.info()
+		c.stats.lock.Unlock()
+	}
+	sort.Slice(infos, func(i, j int) bool { return infos[i].SpawnTime.Before(infos[j].SpawnTime) })
+	return infos
+}
+
+// ConnectionHistory returns the histories of the active keyless protocol
+// connections and of the last connections closed, with their totals.
+func (s *Server) ConnectionHistory() ConnStatsDump {
+	s.mtx.Lock()
+	conns := make([]*conn, 0, len(s.conns))
+	for c := range s.conns {
+		conns = append(conns, c)
+	}
+	hists := append([]ConnHistory(nil), s.closedConns...)
+	s.mtx.Unlock()
+
+	for _, c := range conns {
+		hists = append(hists, c.history())
+	}
+	sort.Slice(hists, func(i, j int) bool { return hists[i].SpawnTime.Before(hists[j].SpawnTime) })
+
+	dump := ConnStatsDump{
+		Time:          time.Now(),
+		Connections:   hists,
+		Ops:           make(map[string]int),
+		Errors:        make(map[string]int),
+		ErrorTimeline: []ConnErrorEvent{},
+	}
+	for _, h := range hists {
+		dump.BytesRead += h.BytesRead
+		dump.BytesWritten += h.BytesWritten
+		for op, n := range h.Ops {
+			dump.Ops[op] += n
+		}
+		for err, n := range h.Errors {
+			dump.Errors[err] += n
+		}
+		for _, e := range h.ErrorEvents {
+			dump.ErrorTimeline = append(dump.ErrorTimeline, ConnErrorEvent{Conn: h.Name, ConnEvent: e})
+		}
+	}
+	sort.SliceStable(dump.ErrorTimeline, func(i, j int) bool {
+		return dump.ErrorTimeline[i].Time.Before(dump.ErrorTimeline[j].Time)
+	})
+	return dump
+}
+
+// retainHistory keeps the history h of a closed connection for
+// ConnectionHistory, dropping the oldest one kept once there are
+// maxClosedConnHistory. s.mtx must be held.
+func (s *Server) retainHistory(h ConnHistory) {
+	if len(s.closedConns) == maxClosedConnHistory {
+		copy(s.closedConns, s.closedConns[1:])
+		s.closedConns = s.closedConns[:maxClosedConnHistory-1]
+	}
+	s.closedConns = append(s.closedConns, h)
+}
+
+// DebugHandler returns a handler serving pprof profiles at /debug/pprof/,
+// expvar variables at /debug/vars, the active connections as JSON at
+// /debug/connections, and the ConnectionHistory as JSON at
+// /debug/connections/history. It exposes internals of the server and must not be
+// reachable by untrusted clients.
+func (s *Server) DebugHandler() http.Handler {
+	mux := http.NewServeMux()
+	mux.HandleFunc("/debug/pprof/", pprof.Index)
+	mux.HandleFunc("/debug/pprof/cmdline", pprof.Cmdline)
+	mux.HandleFunc("/debug/pprof/profile", pprof.Profile)
+	mux.HandleFunc("/debug/pprof/symbol", pprof.Symbol)
+	mux.HandleFunc("/debug/pprof/trace", pprof.Trace)
+	mux.Handle("/debug/vars", expvar.Handler())
+	mux.HandleFunc("/debug/connections", func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+		enc := json.NewEncoder(w)
+		enc.SetIndent("", "  ")
+		if err := enc.Encode(s.Connections()); err != nil {
+			s.log.Errorf("debug: writing connections: %v", err)
+		}
+	})
+	mux.HandleFunc("/debug/connections/history", func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+		enc := json.NewEncoder(w)
+		enc.SetIndent("", "  ")
+		if err := enc.Encode(s.ConnectionHistory()); err != nil {
+			s.log.Errorf("debug: writing connection history: %v", err)
+		}
+	})
+	return mux
+}
+
+// DebugListenAndServe serves DebugHandler at debugAddr.
+func (s *Server) DebugListenAndServe(debugAddr string) error {
+	s.log.Infof("Serving debug endpoints at %s/debug/\n", debugAddr)
+	return http.ListenAndServe(debugAddr, s.DebugHandler())
+}
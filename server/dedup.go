@@ -0,0 +1,118 @@
+package server
+
+import (
+	"context"
+	"crypto/sha256"
+	"sync"
+	"time"
+
+	"github.com/cloudflare/gokeyless/protocol"
+)
+
+// dedupKey identifies requests which produce interchangeable results: it is a
+// digest of everything in the operation except the tracing span and padding.
+type dedupKey [sha256.Size]byte
+
+func newDedupKey(op protocol.Operation) (dedupKey, error) {
+	op.JaegerSpan = nil
+	op.Budget = 0
+	op.Priority = protocol.PriorityNormal
+	op.NoPadding = true
+	// WriteTo serializes op into a pooled buffer.
+	h := sha256.New()
+	if _, err := op.WriteTo(h); err != nil {
+		return dedupKey{}, err
+	}
+	var key dedupKey
+	h.Sum(key[:0])
+	return key, nil
+}
+
+// forClient returns the key of requests identical to req's from the same
+// client and tenant, so that a result is only shared with requests which
+// could have produced it: another tenant may not have access to the key, nor
+// another client be authorized to use it.
+func (k dedupKey) forClient(req request) dedupKey {
+	h := sha256.New()
+	h.Write(k[:])
+	if req.identity != nil {
+		h.Write([]byte{1})
+		h.Write(req.identity.Fingerprint[:])
+	} else {
+		h.Write([]byte{0})
+	}
+	h.Write([]byte(req.tenant))
+	var key dedupKey
+	h.Sum(key[:0])
+	return key
+}
+
+// inflightCall is a request being executed on behalf of itself and any
+// identical requests which arrived while it was running.
+type inflightCall struct {
+	done chan struct{}
+	resp response
+	// panicked is set if the call panicked, so resp is not set.
+	panicked bool
+}
+
+// inflightGroup coalesces concurrent identical requests so that only one of
+// them runs.
+type inflightGroup struct {
+	mtx   sync.Mutex
+	calls map[dedupKey]*inflightCall
+}
+
+func newInflightGroup() *inflightGroup {
+	return &inflightGroup{calls: make(map[dedupKey]*inflightCall)}
+}
+
+// do runs f and returns its response, unless a call with the same key is
+// already running, in which case it waits for and returns that call's response
+// with shared set to true. If that call panics, f is run instead.
+func (g *inflightGroup) do(key dedupKey, f func() response) (resp response, shared bool) {
+	g.mtx.Lock()
+	if call, ok := g.calls[key]; ok {
+		g.mtx.Unlock()
+		<-call.done
+		if call.panicked {
+			return f(), false
+		}
+		return call.resp, true
+	}
+	call := &inflightCall{done: make(chan struct{}), panicked: true}
+	g.calls[key] = call
+	g.mtx.Unlock()
+
+	defer func() {
+		g.mtx.Lock()
+		delete(g.calls, key)
+		g.mtx.Unlock()
+		close(call.done)
+	}()
+	call.resp = f()
+	call.panicked = false
+	return call.resp, false
+}
+
+// dedup wraps h so that identical requests of the opcodes set with
+// WithDedupOps which arrive while one of them is executing share its result.
+func (s *Server) dedup(h func(context.Context, request, time.Time) response) func(context.Context, request, time.Time) response {
+	return func(ctx context.Context, req request, requestBegin time.Time) response {
+		pkt := req.pkt
+		if !s.config.dedupOps[pkt.Opcode] {
+			return h(ctx, req, requestBegin)
+		}
+		key, err := newDedupKey(pkt.Operation)
+		if err != nil {
+			s.log.Errorf("cannot deduplicate %s request %d: %v", pkt.Opcode, pkt.ID, err)
+			return h(ctx, req, requestBegin)
+		}
+		resp, shared := s.inflight.do(key.forClient(req), func() response { return h(ctx, req, requestBegin) })
+		if shared {
+			s.metrics.logRequestDeduplicated(pkt.Opcode)
+			resp.id, resp.reqBegin = pkt.ID, req.reqBegin
+		}
+		return resp
+	}
+}
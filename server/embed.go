@@ -0,0 +1,133 @@
+package server
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+
+	"github.com/cloudflare/cfssl/log"
+)
+
+// An Option configures a Server created with New.
+type Option func(*options) error
+
+type options struct {
+	config    *ServeConfig
+	cert      *tls.Certificate
+	clientCAs *x509.CertPool
+	keys      Keystore
+	log       serverLogger
+	sinks     []MetricsSink
+}
+
+// WithConfig sets the ServeConfig of the server, DefaultServeConfig() by
+// default.
+func WithConfig(config *ServeConfig) Option {
+	return func(o *options) error {
+		o.config = config
+		return nil
+	}
+}
+
+// WithCertificate sets the certificate the server authenticates with to
+// clients. Without one, connections can only be served with ServeWithTLS,
+// with a configuration of their own or none, or after setting
+// TLSConfig().GetCertificate.
+func WithCertificate(cert tls.Certificate) Option {
+	return func(o *options) error {
+		o.cert = &cert
+		return nil
+	}
+}
+
+// WithClientCAs sets the CAs the certificates of clients are verified against.
+func WithClientCAs(pool *x509.CertPool) Option {
+	return func(o *options) error {
+		o.clientCAs = pool
+		return nil
+	}
+}
+
+// WithKeystore sets the keystore of the server, an empty DefaultKeystore by
+// default.
+func WithKeystore(keys Keystore) Option {
+	return func(o *options) error {
+		if keys == nil {
+			return errors.New("keystore is nil")
+		}
+		o.keys = keys
+		return nil
+	}
+}
+
+// WithLogger sends the server's logs at level and above, from log.LevelDebug
+// to log.LevelFatal, to logger, such as a *syslog.Writer or an adapter to the
+// embedding daemon's logger, rather than to the cfssl logger. Keystores and
+// other components created outside the server still log to the cfssl logger.
+func WithLogger(logger log.SyslogWriter, level int) Option {
+	return func(o *options) error {
+		if logger == nil {
+			return errors.New("logger is nil")
+		}
+		if level < log.LevelDebug || level > log.LevelFatal {
+			return errors.New("invalid log level")
+		}
+		o.log = serverLogger{w: logger, level: int32(level)}
+		return nil
+	}
+}
+
+// WithMetricsSinks sends the server's metrics to sinks rather than to those
+// set with SetMetricsSinks. Include PrometheusSink to also serve them with
+// MetricsListenAndServe.
+func WithMetricsSinks(sinks ...MetricsSink) Option {
+	return func(o *options) error {
+		o.sinks = append([]MetricsSink{}, sinks...)
+		return nil
+	}
+}
+
+// New creates a Server configured by opts, for embedding in another daemon:
+// it parses no flags, reads no files, starts no listeners and sets no process
+// globals. Its logs go to the cfssl logger and its metrics to the sinks set
+// with SetMetricsSinks, unless WithLogger and WithMetricsSinks give it its
+// own. Connections are served with Serve and its variants, which return nil
+// once Close is called:
+//
+//	s, err := server.New(
+//		server.WithCertificate(cert),
+//		server.WithClientCAs(pool),
+//		server.WithKeystore(keys),
+//	)
+//	if err != nil {
+//		return err
+//	}
+//	go s.Serve(l)
+//	defer s.Close()
+func New(opts ...Option) (*Server, error) {
+	var o options
+	for _, opt := range opts {
+		if err := opt(&o); err != nil {
+			return nil, err
+		}
+	}
+	var cert tls.Certificate
+	if o.cert != nil {
+		cert = *o.cert
+	}
+	s, err := NewServer(o.config, cert, o.clientCAs)
+	if err != nil {
+		return nil, err
+	}
+	// The logger and metrics are shared with the server's connections and
+	// workers, so they are updated in place.
+	*s.log = o.log
+	s.metrics.sinks = o.sinks
+	if o.cert == nil {
+		s.tlsConfig.Certificates = nil
+	}
+	if o.keys != nil {
+		s.SetKeystore(o.keys)
+	}
+	return s, nil
+}
@@ -0,0 +1,98 @@
+package server
+
+import (
+	"bytes"
+	"context"
+	"sort"
+	"time"
+
+	"github.com/cloudflare/gokeyless/protocol"
+)
+
+// A KeyExpiry is a key whose certificates, in the server's CertIndex, have
+// all expired or expire within the window set with ServeConfig.WithKeyExpiry.
+type KeyExpiry struct {
+	SKI protocol.SKI
+	// NotAfter is when the last of the key's certificates expires.
+	NotAfter time.Time
+	Expired  bool
+	// Evicted is set if the key was evicted from the keystore because its
+	// certificates have expired.
+	Evicted bool
+}
+
+// CheckKeyExpiry finds the keys held by the server whose certificates have
+// all expired, or expire within the configured window, logs them and counts
+// them in the keyless_keys_expiring metric. With eviction enabled, keys whose
+// certificates have all expired are evicted from the keystore, if it can
+// evict keys like DefaultKeystore, so that stale credentials aren't served
+// silently; they come back if they are reloaded with a renewed certificate.
+// Keys without a certificate in the index are never flagged. The keys are
+// returned in SKI order. Nothing is checked unless a window or eviction is set.
+func (s *Server) CheckKeyExpiry() []KeyExpiry {
+	window, evict := s.config.KeyExpiry()
+	if window <= 0 && !evict {
+		return nil
+	}
+	now := time.Now()
+
+	// A key is only as stale as its latest certificate.
+	notAfter := make(map[protocol.SKI]time.Time)
+	for _, cert := range s.certs.Query(protocol.CertificateQuery{}) {
+		ski, err := protocol.GetSKI(cert.PublicKey)
+		if err != nil {
+			continue
+		}
+		if cert.NotAfter.After(notAfter[ski]) {
+			notAfter[ski] = cert.NotAfter
+		}
+	}
+	var held map[protocol.SKI]bool
+	if keys, ok := s.keys.(enumerableKeystore); ok {
+		held = make(map[protocol.SKI]bool)
+		for _, ski := range keys.SKIs() {
+			held[ski] = true
+		}
+	}
+
+	var flagged []KeyExpiry
+	expired, expiring := 0, 0
+	for ski, t := range notAfter {
+		if held != nil && !held[ski] {
+			continue
+		}
+		if !t.Before(now.Add(window)) {
+			continue
+		}
+		k := KeyExpiry{SKI: ski, NotAfter: t, Expired: !t.After(now)}
+		if !k.Expired {
+			expiring++
+			s.log.Warningf("certificates of key %v expire at %v", ski, t)
+		} else if keys, ok := s.keys.(adminKeystore); evict && ok {
+			keys.Remove(ski)
+			k.Evicted = true
+			s.log.Warningf("evicted key %v: certificates expired at %v", ski, t)
+		} else {
+			expired++
+			s.log.Warningf("certificates of key %v expired at %v", ski, t)
+		}
+		flagged = append(flagged, k)
+	}
+	s.metrics.logKeysExpiring(expired, expiring)
+	sort.Slice(flagged, func(i, j int) bool { return bytes.Compare(flagged[i].SKI[:], flagged[j].SKI[:]) < 0 })
+	return flagged
+}
+
+// WatchKeyExpiry calls CheckKeyExpiry every interval until ctx is done.
+func (s *Server) WatchKeyExpiry(ctx context.Context, interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		s.CheckKeyExpiry()
+		select {
+		case <-ticker.C:
+		case <-ctx.Done():
+			return
+		}
+	}
+}
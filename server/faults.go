@@ -0,0 +1,75 @@
+package server
+
+import (
+	"math/rand"
+	"time"
+
+	"github.com/cloudflare/gokeyless/protocol"
+)
+
+// A Fault injects artificial failures into the responses to requests with an
+// opcode, for client developers to check how their retries and failover
+// handle a misbehaving keyserver. Requests are executed as usual before their
+// responses are tampered with. Rates are probabilities between 0 and 1: each
+// response is either lost to a connection reset, truncated, replaced with an
+// error or sent whole, so ResetRate, TruncateRate and ErrorRate should not
+// add up to more than 1, and independently delayed at LatencyRate.
+type Fault struct {
+	Op protocol.Op
+	// Latency is added to the responses delayed at LatencyRate. Other
+	// responses on the connection aren't held up.
+	Latency     time.Duration
+	LatencyRate float64
+	// ErrorRate is the rate of responses replaced with one of Errors, picked
+	// at random, or protocol.ErrInternal if there are none.
+	ErrorRate float64
+	Errors    []protocol.Error
+	// TruncateRate is the rate of responses of which only a random prefix is
+	// written before the connection is closed.
+	TruncateRate float64
+	// ResetRate is the rate of responses dropped by closing the connection
+	// instead of writing them.
+	ResetRate float64
+}
+
+// submitWithFault writes resp to the connection, or fails to, as f dictates.
+// It returns false once the connection is closed.
+func (c *conn) submitWithFault(f Fault, resp response) bool {
+	switch r := rand.Float64(); {
+	case r < f.ResetRate:
+		c.log.Debugf("connection %v: injecting reset into %s response %d", c.name, resp.reqOpcode, resp.id)
+		c.metrics.logFaultInjected(resp.reqOpcode, "reset")
+		c.Destroy()
+		return false
+	case r < f.ResetRate+f.TruncateRate:
+		c.log.Debugf("connection %v: injecting truncation into %s response %d", c.name, resp.reqOpcode, resp.id)
+		c.metrics.logFaultInjected(resp.reqOpcode, "truncate")
+		c.writeTruncated(resp)
+		return false
+	case r < f.ResetRate+f.TruncateRate+f.ErrorRate:
+		code := protocol.ErrInternal
+		if len(f.Errors) > 0 {
+			code = f.Errors[rand.Intn(len(f.Errors))]
+		}
+		c.log.Debugf("connection %v: injecting %s into %s response %d", c.name, code, resp.reqOpcode, resp.id)
+		c.metrics.logFaultInjected(resp.reqOpcode, "error")
+		resp.op, resp.err = protocol.MakeErrorOp(code), code
+	}
+	if f.Latency > 0 && rand.Float64() < f.LatencyRate {
+		c.metrics.logFaultInjected(resp.reqOpcode, "latency")
+		time.AfterFunc(f.Latency, func() { c.write(resp) })
+		return true
+	}
+	return c.write(resp)
+}
+
+// writeTruncated writes a random prefix of resp, which may be empty, and
+// closes the connection.
+func (c *conn) writeTruncated(resp response) {
+	c.writeMtx.Lock()
+	defer c.writeMtx.Unlock()
+	pkt := protocol.NewPacket(resp.id, resp.op)
+	b, _ := pkt.MarshalBinary()
+	c.conn.Write(b[:rand.Intn(len(b))])
+	c.Destroy()
+}
@@ -0,0 +1,89 @@
+package server
+
+import (
+	"crypto"
+	"crypto/rsa"
+	"errors"
+	"fmt"
+	"math/big"
+
+	"github.com/cloudflare/gokeyless/protocol"
+)
+
+// MinRSABits is the size below which RSA keys are reported as weak in
+// hardened mode.
+const MinRSABits = 2048
+
+// errRSAFault is returned when an RSA result fails its check, which may be the
+// sign of a fault attack on the CRT computation.
+var errRSAFault = errors.New("RSA result failed verification")
+
+// weakKey returns why pub is considered weak, or "" if it isn't.
+func weakKey(pub crypto.PublicKey) string {
+	if pub, ok := pub.(*rsa.PublicKey); ok && pub.N.BitLen() < MinRSABits {
+		return fmt.Sprintf("%d-bit RSA key, shorter than %d bits", pub.N.BitLen(), MinRSABits)
+	}
+	return ""
+}
+
+// WarnWeakKeys logs a warning for each weak key in the server's keystore, such
+// as RSA keys shorter than MinRSABits, if it can list its public keys, and
+// returns their SKIs. In hardened mode it is called by SetKeystore, and keys
+// loaded with OpLoadKey or the admin API are checked as they are loaded; it
+// should be called again when the keystore's keys change otherwise.
+func (s *Server) WarnWeakKeys() []protocol.SKI {
+	keys, ok := s.keys.(publicKeystore)
+	if !ok {
+		return nil
+	}
+	var weak []protocol.SKI
+	for _, key := range keys.PublicKeys() {
+		if reason := weakKey(key.Public); reason != "" {
+			s.log.Warningf("weak key with SKI %v: %s", key.SKI, reason)
+			weak = append(weak, key.SKI)
+		}
+	}
+	return weak
+}
+
+// warnWeakKey logs a warning if priv, which was just loaded, is weak and the
+// server is in hardened mode.
+func (s *Server) warnWeakKey(priv crypto.Signer) {
+	if !s.config.hardened {
+		return
+	}
+	if reason := weakKey(priv.Public()); reason != "" {
+		ski, _ := protocol.GetSKI(priv.Public())
+		s.log.Warningf("weak key with SKI %v: %s", ski, reason)
+	}
+}
+
+// checkRSADecrypt checks that ptxt is the raw RSA decryption of ctxt under
+// pub by encrypting it again.
+func checkRSADecrypt(pub *rsa.PublicKey, ctxt, ptxt []byte) error {
+	m := new(big.Int).SetBytes(ptxt)
+	c := m.Exp(m, big.NewInt(int64(pub.E)), pub.N)
+	if c.Cmp(new(big.Int).SetBytes(ctxt)) != 0 {
+		return errRSAFault
+	}
+	return nil
+}
+
+// checkRSASignature verifies sig, made with opts over digest, if pub is an RSA
+// key, so that a faulty signature which could leak the key is never returned.
+func checkRSASignature(pub crypto.PublicKey, digest, sig []byte, opts crypto.SignerOpts) error {
+	rsaPub, ok := pub.(*rsa.PublicKey)
+	if !ok {
+		return nil
+	}
+	var err error
+	if pss, ok := opts.(*rsa.PSSOptions); ok {
+		err = rsa.VerifyPSS(rsaPub, pss.Hash, digest, sig, pss)
+	} else {
+		err = rsa.VerifyPKCS1v15(rsaPub, opts.HashFunc(), digest, sig)
+	}
+	if err != nil {
+		return errRSAFault
+	}
+	return nil
+}
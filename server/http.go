@@ -0,0 +1,221 @@
+package server
+
+import (
+	"context"
+	"crypto/tls"
+	"errors"
+	"net"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/cloudflare/gokeyless/protocol"
+	"github.com/cloudflare/gokeyless/server/internal/worker"
+)
+
+// HTTPHandler returns a handler which serves keyless requests sent as the body
+// of HTTP POST requests, one packet per request, and replies with the response
+// packet. This allows standard L7 load balancers and middleware to sit between
+// clients and the server.
+//
+// Requests are authorized by the client certificate verified on the request's
+// TLS connection, if any, or else by the bearer token in their Authorization
+// header if the server has a TokenVerifier. Requests without TLS are treated
+// as coming from an anonymous client, so a handler used without TLS client
+// authentication must be wrapped by middleware which authenticates callers.
+func (s *Server) HTTPHandler() http.Handler {
+	return http.HandlerFunc(s.serveHTTP)
+}
+
+func (s *Server) serveHTTP(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		w.Header().Set("Allow", http.MethodPost)
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	if ct := r.Header.Get("Content-Type"); ct != "" && ct != protocol.HTTPContentType {
+		http.Error(w, "unsupported content type", http.StatusUnsupportedMediaType)
+		return
+	}
+
+	pkt := new(protocol.Packet)
+	n, err := pkt.ReadFromLimit(http.MaxBytesReader(w, r.Body, protocol.MaxPacketLength), s.config.maxPacketLength())
+	switch {
+	case err == protocol.ErrPacketTooLarge:
+		s.log.Warningf("http request %v: rejected %dB request, over the payload limits", r.RemoteAddr, pkt.Length)
+		s.metrics.logLimitRejected("payload")
+		http.Error(w, "payload too large", http.StatusRequestEntityTooLarge)
+		return
+	case err != nil:
+		s.log.Debugf("http request %v: invalid packet: %v", r.RemoteAddr, err)
+		http.Error(w, "invalid packet", http.StatusBadRequest)
+		return
+	case s.config.payloadTooLarge(&pkt.Operation, s.log, s.metrics):
+		http.Error(w, "payload too large", http.StatusRequestEntityTooLarge)
+		return
+	case s.config.strictPadding && pkt.CheckPadding(false) != nil:
+		s.log.Warningf("http request %v: rejected request with invalid padding", r.RemoteAddr)
+		s.metrics.logPaddingRejected(pkt.Opcode)
+		http.Error(w, "invalid padding", http.StatusBadRequest)
+		return
+	}
+
+	var state tls.ConnectionState
+	if r.TLS != nil {
+		state = *r.TLS
+	}
+	if err := s.checkRevocation(state.VerifiedChains); err != nil {
+		s.log.Warningf("http request %v: rejected client certificate: %v", r.RemoteAddr, err)
+		http.Error(w, "forbidden", http.StatusForbidden)
+		return
+	}
+	limited, err := s.config.isLimited(state)
+	if err != nil {
+		s.log.Errorf("http request %v: could not determine if limited: %v", r.RemoteAddr, err)
+		http.Error(w, "forbidden", http.StatusForbidden)
+		return
+	}
+
+	identity := newClientIdentity(state)
+	if r.TLS != nil && identity == nil && s.config.tokenVerifier != nil {
+		if identity, err = verifyBearerToken(r, s.config.tokenVerifier); err != nil {
+			s.log.Warningf("http request %v: token rejected: %v", r.RemoteAddr, err)
+			w.Header().Set("WWW-Authenticate", "Bearer")
+			http.Error(w, "unauthorized", http.StatusUnauthorized)
+			return
+		}
+	}
+
+	s.mtx.Lock()
+	shutdown := s.shutdown
+	s.mtx.Unlock()
+	if shutdown {
+		http.Error(w, "server is shutting down", http.StatusServiceUnavailable)
+		return
+	}
+	if s.config.rejectUntilReady && !s.Ready() {
+		w.Header().Set("Retry-After", "1")
+		http.Error(w, "server is not ready", http.StatusServiceUnavailable)
+		return
+	}
+
+	req := request{
+		pkt:      pkt,
+		reqBegin: time.Now(),
+		connName: r.RemoteAddr,
+		identity: identity,
+		tenant:   s.config.tenantOf(identity),
+		log:      s.log,
+		metrics:  s.metrics,
+	}
+	s.metrics.logRequest(pkt.Opcode)
+	if req.tenant != "" {
+		s.metrics.logTenantRequest(req.tenant, pkt.Opcode)
+	}
+	s.usage.recordBytes(identity, n, false)
+	s.usage.recordRequest(identity, pkt.Opcode)
+	// The result channel is buffered so that the worker never blocks if the
+	// client has gone away.
+	results := make(chan response, 1)
+	pool := (&poolSelector{s, limited, s.wp}).SelectPool(pkt)
+	pool.SubmitJob(worker.NewJob(req, func(result interface{}) {
+		results <- result.(response)
+	}))
+
+	var resp response
+	select {
+	case resp = <-results:
+	case <-r.Context().Done():
+		s.log.Debugf("http request %v: client went away", r.RemoteAddr)
+		return
+	}
+
+	resp.op.MinLength = s.config.minResponseLength
+	out := protocol.Packet{
+		Header: protocol.Header{
+			MajorVers: 0x01,
+			MinorVers: 0x00,
+			Length:    resp.op.Bytes(),
+			ID:        resp.id,
+		},
+		Operation: resp.op,
+	}
+	w.Header().Set("Content-Type", protocol.HTTPContentType)
+	n, err = out.WriteTo(w)
+	s.usage.recordBytes(identity, n, true)
+	if err != nil {
+		s.log.Debugf("http request %v: failed to write response: %v", r.RemoteAddr, err)
+		return
+	}
+	s.usage.recordResponse(identity, resp.err)
+	s.metrics.logRequestTotalDuration(resp.reqOpcode, resp.reqBegin, resp.err)
+	s.slo.observe(resp.reqOpcode, time.Since(resp.reqBegin))
+}
+
+// verifyBearerToken verifies the token in the Authorization header of r with v.
+func verifyBearerToken(r *http.Request, v TokenVerifier) (*ClientIdentity, error) {
+	auth := r.Header.Get("Authorization")
+	if !strings.HasPrefix(auth, "Bearer ") {
+		return nil, errors.New("no bearer token")
+	}
+	ctx, cancel := context.WithTimeout(r.Context(), tokenVerifyTimeout)
+	defer cancel()
+	identity, _, err := v.VerifyToken(ctx, strings.TrimPrefix(auth, "Bearer "))
+	return identity, err
+}
+
+// ServeHTTP2 accepts incoming connections on the Listener l and serves keyless
+// requests over HTTP/2 using HTTPHandler, with the same TLS configuration as
+// Serve. It may be called alongside Serve to offer both transports.
+func (s *Server) ServeHTTP2(l net.Listener) error {
+	return s.ServeHTTP2WithTLS(l, s.tlsConfig)
+}
+
+// ServeHTTP2WithTLS is like ServeHTTP2, but authenticates connections with
+// config instead of the server's TLS configuration.
+func (s *Server) ServeHTTP2WithTLS(l net.Listener, config *tls.Config) error {
+	if config == nil {
+		return errors.New("HTTP/2 listeners require a TLS configuration")
+	}
+	config = config.Clone()
+	config.NextProtos = []string{"h2"}
+	if config.CipherSuites != nil {
+		// HTTP/2 requires these suites to be enabled on TLS 1.2 connections.
+		config.CipherSuites = append(config.CipherSuites,
+			tls.TLS_ECDHE_ECDSA_WITH_AES_128_GCM_SHA256,
+			tls.TLS_ECDHE_RSA_WITH_AES_128_GCM_SHA256)
+	}
+	srv := &http.Server{
+		Handler:   s.HTTPHandler(),
+		TLSConfig: config,
+	}
+
+	s.mtx.Lock()
+	if s.shutdown {
+		s.mtx.Unlock()
+		return errors.New("attempt to serve HTTP/2 after calling Close")
+	}
+	s.httpServers = append(s.httpServers, srv)
+	s.mtx.Unlock()
+
+	err := srv.ServeTLS(filterListener{l, s}, "", "")
+	if err == http.ErrServerClosed {
+		return nil
+	}
+	return err
+}
+
+// HTTP2ListenAndServe listens on the TCP network address addr and then calls
+// ServeHTTP2 to handle keyless requests over HTTP/2.
+func (s *Server) HTTP2ListenAndServe(addr string) error {
+	if addr != "" {
+		l, err := net.Listen("tcp", addr)
+		if err != nil {
+			return err
+		}
+
+		s.log.Infof("Listening at https://%s\n", l.Addr())
+		return s.ServeHTTP2(l)
+	}
+	return errors.New("can't listen on empty address")
+}
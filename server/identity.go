@@ -0,0 +1,89 @@
+package server
+
+import (
+	"context"
+	"crypto/sha256"
+	"crypto/tls"
+	"encoding/hex"
+	"net"
+	"net/url"
+)
+
+// ClientIdentity describes the authenticated keyless client which sent a
+// request, as taken from its verified TLS client certificate, from its Noise
+// static key or, for clients which authenticated with a token, from the
+// TokenVerifier.
+type ClientIdentity struct {
+	// CommonName is the subject common name of the client certificate, the
+	// name of the client a token was issued to, or the base64-encoded Noise
+	// static key.
+	CommonName string
+	// DNSNames, IPAddresses and URIs are the certificate's subject alternative names.
+	DNSNames    []string
+	IPAddresses []net.IP
+	URIs        []*url.URL
+	// SPIFFEID is the first spiffe:// URI SAN, if any.
+	SPIFFEID string
+	// Fingerprint is the SHA-256 digest of the DER-encoded client certificate,
+	// of the token, or of the Noise static key.
+	Fingerprint [sha256.Size]byte
+}
+
+// newClientIdentity extracts the identity of the peer of a completed TLS
+// handshake. It returns nil if the peer presented no certificate.
+func newClientIdentity(state tls.ConnectionState) *ClientIdentity {
+	if len(state.PeerCertificates) == 0 {
+		return nil
+	}
+	cert := state.PeerCertificates[0]
+	id := &ClientIdentity{
+		CommonName:  cert.Subject.CommonName,
+		DNSNames:    cert.DNSNames,
+		IPAddresses: cert.IPAddresses,
+		URIs:        cert.URIs,
+		Fingerprint: sha256.Sum256(cert.Raw),
+	}
+	for _, uri := range cert.URIs {
+		if uri.Scheme == "spiffe" {
+			id.SPIFFEID = uri.String()
+			break
+		}
+	}
+	return id
+}
+
+// String returns the SPIFFE ID or common name of the client, followed by its
+// certificate fingerprint.
+func (id *ClientIdentity) String() string {
+	if id == nil {
+		return "<anonymous>"
+	}
+	return id.name() + " (sha256:" + hex.EncodeToString(id.Fingerprint[:]) + ")"
+}
+
+// name returns the SPIFFE ID or common name of the client, or "<anonymous>"
+// if id is nil.
+func (id *ClientIdentity) name() string {
+	if id == nil {
+		return "<anonymous>"
+	}
+	if id.SPIFFEID != "" {
+		return id.SPIFFEID
+	}
+	return id.CommonName
+}
+
+type clientIdentityKey struct{}
+
+// WithClientIdentity returns a copy of ctx carrying id.
+func WithClientIdentity(ctx context.Context, id *ClientIdentity) context.Context {
+	return context.WithValue(ctx, clientIdentityKey{}, id)
+}
+
+// ClientIdentityFromContext returns the identity of the client which sent the
+// request being handled, if known. Keystores, custom operations and RPCs called
+// by the server's workers can use it to make per-client decisions.
+func ClientIdentityFromContext(ctx context.Context) (*ClientIdentity, bool) {
+	id, ok := ctx.Value(clientIdentityKey{}).(*ClientIdentity)
+	return id, ok && id != nil
+}
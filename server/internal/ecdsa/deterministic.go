@@ -0,0 +1,147 @@
+package ecdsa
+
+import (
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/hmac"
+	_ "crypto/sha256" // the default hash of SignDeterministic
+	"encoding/asn1"
+	"errors"
+	"hash"
+	"io"
+	"math/big"
+)
+
+// SignDeterministic computes an ECDSA signature like Sign, but derives the
+// nonce from priv and msg as specified in RFC 6979 instead of from a source of
+// randomness, so that signing the same message with the same key always
+// produces the same signature.
+//
+// The HMAC used to derive the nonce is based on opts.HashFunc(), or on SHA-256
+// if that is not available (e.g. for crypto.MD5SHA1).
+func SignDeterministic(priv *ecdsa.PrivateKey, msg []byte, opts crypto.SignerOpts) ([]byte, error) {
+	h := crypto.SHA256
+	if opts != nil && opts.HashFunc() != crypto.MD5SHA1 && opts.HashFunc().Available() {
+		h = opts.HashFunc()
+	}
+	r, s, err := sign(nil, priv, msg, newRFC6979(priv, msg, h.New))
+	if err != nil {
+		return nil, err
+	}
+	return asn1.Marshal(ecdsaSignature{r, s})
+}
+
+// LowS rewrites the DER-encoded ECDSA signature sig so that its s value is at
+// most half the order of curve. Both s and N - s are valid, but some verifiers
+// reject the larger one to rule out signature malleability.
+func LowS(sig []byte, curve elliptic.Curve) ([]byte, error) {
+	var parsed ecdsaSignature
+	rest, err := asn1.Unmarshal(sig, &parsed)
+	if err != nil {
+		return nil, err
+	} else if len(rest) != 0 {
+		return nil, errors.New("trailing data after ECDSA signature")
+	}
+	N := curve.Params().N
+	if parsed.S.Cmp(new(big.Int).Rsh(N, 1)) <= 0 {
+		return sig, nil
+	}
+	parsed.S.Sub(N, parsed.S)
+	return asn1.Marshal(parsed)
+}
+
+// rfc6979 is a RandProvider which generates the sequence of nonces of RFC 6979,
+// section 3.2 for a single key and message. It must not be reused for another
+// message.
+type rfc6979 struct {
+	crv  elliptic.Curve
+	x    []byte // int2octets(private key)
+	h1   []byte // bits2octets(message hash)
+	newH func() hash.Hash
+	k, v []byte
+	// started is set once the first nonce has been generated.
+	started bool
+}
+
+var _ RandProvider = &rfc6979{}
+
+func newRFC6979(priv *ecdsa.PrivateKey, hash []byte, newH func() hash.Hash) *rfc6979 {
+	c := priv.Curve
+	N := c.Params().N
+	h1 := hashToInt(hash, c)
+	h1.Mod(h1, N)
+	return &rfc6979{
+		crv:  c,
+		x:    int2octets(priv.D, N),
+		h1:   int2octets(h1, N),
+		newH: newH,
+	}
+}
+
+func (g *rfc6979) mac(key []byte, data ...[]byte) []byte {
+	m := hmac.New(g.newH, key)
+	for _, d := range data {
+		m.Write(d)
+	}
+	return m.Sum(nil)
+}
+
+// gen ignores rand and returns the next candidate nonce for the message.
+func (g *rfc6979) gen(_ io.Reader) (kInv, r *big.Int, err error) {
+	N := g.crv.Params().N
+	if !g.started {
+		// Steps b. through g.
+		size := g.newH().Size()
+		g.v = make([]byte, size)
+		for i := range g.v {
+			g.v[i] = 0x01
+		}
+		g.k = make([]byte, size)
+		g.k = g.mac(g.k, g.v, []byte{0x00}, g.x, g.h1)
+		g.v = g.mac(g.k, g.v)
+		g.k = g.mac(g.k, g.v, []byte{0x01}, g.x, g.h1)
+		g.v = g.mac(g.k, g.v)
+		g.started = true
+	} else {
+		// The previous candidate was rejected, either here or by sign.
+		g.k = g.mac(g.k, g.v, []byte{0x00})
+		g.v = g.mac(g.k, g.v)
+	}
+
+	// Step h.
+	rlen := (N.BitLen() + 7) / 8
+	for {
+		var t []byte
+		for len(t) < rlen {
+			g.v = g.mac(g.k, g.v)
+			t = append(t, g.v...)
+		}
+		k := hashToInt(t, g.crv)
+		if k.Sign() > 0 && k.Cmp(N) < 0 {
+			r, _ = g.crv.ScalarBaseMult(k.Bytes())
+			r.Mod(r, N)
+			if r.Sign() != 0 {
+				if in, ok := g.crv.(invertible); ok {
+					kInv = in.Inverse(k)
+				} else {
+					kInv = fermatInverse(k, N)
+				}
+				return kInv, r, nil
+			}
+		}
+		g.k = g.mac(g.k, g.v, []byte{0x00})
+		g.v = g.mac(g.k, g.v)
+	}
+}
+
+func (g *rfc6979) curve() elliptic.Curve { return g.crv }
+
+// int2octets encodes x as a big-endian byte string as long as the curve order
+// N, as specified in RFC 6979, section 2.3.3.
+func int2octets(x, N *big.Int) []byte {
+	out := make([]byte, (N.BitLen()+7)/8)
+	b := x.Bytes()
+	copy(out[len(out)-len(b):], b)
+	return out
+}
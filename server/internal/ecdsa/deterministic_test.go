@@ -0,0 +1,106 @@
+package ecdsa
+
+import (
+	"bytes"
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/sha256"
+	"crypto/sha512"
+	"encoding/asn1"
+	"fmt"
+	"math/big"
+	"testing"
+)
+
+func mustHex(t *testing.T, s string) *big.Int {
+	n, ok := new(big.Int).SetString(s, 16)
+	if !ok {
+		t.Fatalf("bad hex: %s", s)
+	}
+	return n
+}
+
+// TestSignDeterministic checks the P-256 and P-521 test vectors of RFC 6979,
+// A.2.5 and A.2.7.
+func TestSignDeterministic(t *testing.T) {
+	p256 := &ecdsa.PrivateKey{D: mustHex(t, "C9AFA9D845BA75166B5C215767B1D6934E50C3DB36E89B127B8A622B120F6721")}
+	p256.Curve = elliptic.P256()
+	p521 := &ecdsa.PrivateKey{D: mustHex(t, "0FAD06DAA62BA3B25D2FB40133DA757205DE67F5BB0018FEE8C86E1B68C7E75CAA896EB32F1F47C70855836A6D16FCC1466F6D8FBEC67DB89EC0C08B0E996B83538")}
+	p521.Curve = elliptic.P521()
+	for _, priv := range []*ecdsa.PrivateKey{p256, p521} {
+		priv.X, priv.Y = priv.Curve.ScalarBaseMult(priv.D.Bytes())
+	}
+
+	sum256 := sha256.Sum256([]byte("sample"))
+	sum512 := sha512.Sum512([]byte("sample"))
+	for _, test := range []struct {
+		priv   *ecdsa.PrivateKey
+		opts   crypto.Hash
+		digest []byte
+		r, s   string
+	}{
+		{p256, crypto.SHA256, sum256[:],
+			"EFD48B2AACB6A8FD1140DD9CD45E81D69D2C877B56AAF991C34D0EA84EAF3716",
+			"F7CB1C942D657C41D436C7A1B6E29F65F3E900DBB9AFF4064DC4AB2F843ACDA8"},
+		{p256, crypto.SHA512, sum512[:],
+			"8496A60B5E9B47C825488827E0495B0E3FA109EC4568FD3F8D1097678EB97F00",
+			"2362AB1ADBE2B8ADF9CB9EDAB740EA6049C028114F2460F96554F61FAE3302FE"},
+		{p521, crypto.SHA256, sum256[:],
+			"1511BB4D675114FE266FC4372B87682BAECC01D3CC62CF2303C92B3526012659D16876E25C7C1E57648F23B73564D67F61C6F14D527D54972810421E7D87589E1A7",
+			"04A171143A83163D6DF460AAF61522695F207A58B95C0644D87E52AA1A347916E4F7A72930B1BC06DBE22CE3F58264AFD23704CBB63B29B931F7DE6C9D949A7ECFC"},
+		{p521, crypto.SHA512, sum512[:],
+			"0C328FAFCBD79DD77850370C46325D987CB525569FB63C5D3BC53950E6D4C5F174E25A1EE9017B5D450606ADD152B534931D7D4E8455CC91F9B15BF05EC36E377FA",
+			"0617CCE7CF5064806C467F678D3B4080D6F1CC50AF26CA209417308281B68AF282623EAA63E5B5C0723D8B8C37FF0777B1A20F8CCB1DCCC43997F1EE0E44DA4A67A"},
+	} {
+		name := fmt.Sprintf("%s-%v", test.priv.Params().Name, test.opts)
+		sig, err := SignDeterministic(test.priv, test.digest, test.opts)
+		if err != nil {
+			t.Fatal(err)
+		}
+		var got ecdsaSignature
+		if _, err := asn1.Unmarshal(sig, &got); err != nil {
+			t.Fatal(err)
+		}
+		if got.R.Cmp(mustHex(t, test.r)) != 0 || got.S.Cmp(mustHex(t, test.s)) != 0 {
+			t.Errorf("%s: got r=%X s=%X", name, got.R, got.S)
+		}
+		again, err := SignDeterministic(test.priv, test.digest, test.opts)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !bytes.Equal(sig, again) {
+			t.Errorf("%s: signatures differ", name)
+		}
+	}
+}
+
+func TestLowS(t *testing.T) {
+	curve := elliptic.P256()
+	N := curve.Params().N
+	high := new(big.Int).Sub(N, big.NewInt(1))
+	sig, err := asn1.Marshal(ecdsaSignature{big.NewInt(1), high})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	low, err := LowS(sig, curve)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var got ecdsaSignature
+	if _, err := asn1.Unmarshal(low, &got); err != nil {
+		t.Fatal(err)
+	}
+	if got.R.Int64() != 1 || got.S.Int64() != 1 {
+		t.Fatalf("got r=%v s=%v; want r=1 s=1", got.R, got.S)
+	}
+
+	same, err := LowS(low, curve)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(same, low) {
+		t.Fatal("low-S signature was changed")
+	}
+}
@@ -8,19 +8,51 @@ import (
 
 // A Job represents a unit of work to be done by a worker in the pool.
 type Job struct {
-	// job == nil is used as a sentinel value to instruct workers to quit
-	job    interface{}
-	commit func(result interface{})
+	job      interface{}
+	commit   func(result interface{})
+	priority Priority
 }
 
+// Priority orders the pending jobs of a Pool.
+type Priority int
+
+const (
+	// High priority jobs are executed before any other pending jobs.
+	High Priority = iota
+	// Normal is the priority of jobs which don't have one.
+	Normal
+	// Low priority jobs are executed after any other pending jobs.
+	Low
+
+	numPriorities = iota
+)
+
+// A Prioritized job has a priority other than Normal.
+type Prioritized interface {
+	Priority() Priority
+}
+
+// maxSkips is how many times the pending jobs of a priority can be passed over
+// for more urgent ones before the next of them is executed anyway, so that a
+// steady stream of high priority jobs can't starve the others.
+const maxSkips = 16
+
 // NewJob creates a new Job. job will be provided as the input to a worker's Do
 // method, and once the Do method returns, its return value will be passed as
-// the argument to commit.
+// the argument to commit. If job is Prioritized, it is queued with its
+// priority.
 func NewJob(job interface{}, commit func(result interface{})) Job {
 	if job == nil {
 		panic("nil job")
 	}
-	return Job{job: job, commit: commit}
+	priority := Normal
+	if p, ok := job.(Prioritized); ok {
+		priority = p.Priority()
+		if priority < High || priority > Low {
+			priority = Normal
+		}
+	}
+	return Job{job: job, commit: commit, priority: priority}
 }
 
 // A Worker is capable of executing jobs.
@@ -29,22 +61,53 @@ type Worker interface {
 	Do(job interface{}) (result interface{})
 }
 
+// A Recoverer is a Worker which can recover from panics in its Do method. If
+// Do panics, the Pool commits the result of Recover and replaces the worker
+// with the one Recover returns, so that a worker left in a bad state by the
+// panic isn't used again. Panics in Workers which aren't Recoverers are not
+// recovered.
+type Recoverer interface {
+	Worker
+	// Recover returns the result of job, whose execution panicked with v, and
+	// a new worker to take over.
+	Recover(job interface{}, v interface{}) (result interface{}, replacement Worker)
+}
+
 // A Pool is a handle on a pool of worker goroutines that can execute jobs.
+// Pending jobs are executed in order of priority, and in the order they were
+// submitted within a priority.
 type Pool struct {
-	busy    int64
-	jobs    chan Job
-	workers int
-	wg      sync.WaitGroup
+	busy int64
+	wg   sync.WaitGroup
+
+	mtx      sync.Mutex
+	pending  *sync.Cond // signaled when a job is queued or p is destroyed
+	space    *sync.Cond // signaled when a job is dequeued
+	queues   [numPriorities][]Job
+	skipped  [numPriorities]int
+	queued   int
+	queueLen int
+	// destroyed instructs workers to quit once the queues are empty.
+	destroyed bool
 }
 
+// DefaultQueueLen is the number of pending jobs a Pool created with NewPool
+// holds before SubmitJob blocks.
+const DefaultQueueLen = 1024 * 1024
+
 // NewPool constructs a new Pool from the given workers. Each worker is run in
 // its own goroutine. The workers wait jobs to be submitted and execute those
 // jobs as they come in.
 func NewPool(workers ...Worker) *Pool {
-	p := &Pool{
-		jobs:    make(chan Job, 1024*1024),
-		workers: len(workers),
-	}
+	return NewPoolWithQueue(DefaultQueueLen, workers...)
+}
+
+// NewPoolWithQueue is like NewPool, but SubmitJob blocks once queueLen jobs are
+// pending.
+func NewPoolWithQueue(queueLen int, workers ...Worker) *Pool {
+	p := &Pool{queueLen: queueLen}
+	p.pending = sync.NewCond(&p.mtx)
+	p.space = sync.NewCond(&p.mtx)
 
 	p.wg.Add(len(workers))
 	for _, w := range workers {
@@ -60,7 +123,14 @@ func NewPool(workers ...Worker) *Pool {
 // jobs is full. If p has already been destroyed (p.Destroy()), the behavior of
 // SubmitJob is undefined.
 func (p *Pool) SubmitJob(job Job) {
-	p.jobs <- job
+	p.mtx.Lock()
+	for p.queued >= p.queueLen {
+		p.space.Wait()
+	}
+	p.queues[job.priority] = append(p.queues[job.priority], job)
+	p.queued++
+	p.mtx.Unlock()
+	p.pending.Signal()
 }
 
 // Destroy destroys the pool. Any currently-executing calls to Do complete, and
@@ -68,28 +138,82 @@ func (p *Pool) SubmitJob(job Job) {
 // goroutines have quit. If p has already been destroyed, the behavior of
 // Destroy is undefined.
 func (p *Pool) Destroy() {
-	for i := 0; i < p.workers; i++ {
-		// Send the sentinal value (with the 'job' field as nil) indicating to quit;
-		// send one for each worker goroutine.
-		p.jobs <- Job{}
-	}
+	p.mtx.Lock()
+	p.destroyed = true
+	p.mtx.Unlock()
+	p.pending.Broadcast()
 	p.wg.Wait()
 }
 
+// next blocks until a job is pending and dequeues the most urgent one, unless
+// a less urgent one has been skipped maxSkips times. It returns false once p
+// is destroyed and no jobs are left.
+func (p *Pool) next() (Job, bool) {
+	p.mtx.Lock()
+	defer p.mtx.Unlock()
+	for p.queued == 0 {
+		if p.destroyed {
+			return Job{}, false
+		}
+		p.pending.Wait()
+	}
+
+	pick := -1
+	for i := range p.queues {
+		if len(p.queues[i]) > 0 && (pick < 0 || p.skipped[i] >= maxSkips) {
+			pick = i
+			if p.skipped[i] >= maxSkips {
+				break
+			}
+		}
+	}
+	for i := range p.queues {
+		if i != pick && len(p.queues[i]) > 0 {
+			p.skipped[i]++
+		}
+	}
+	p.skipped[pick] = 0
+
+	job := p.queues[pick][0]
+	p.queues[pick][0] = Job{}
+	p.queues[pick] = p.queues[pick][1:]
+	p.queued--
+	p.space.Signal()
+	return job, true
+}
+
 func (p *Pool) worker(w Worker) {
 	for {
-		job := <-p.jobs
-		if job.job == nil {
+		job, ok := p.next()
+		if !ok {
 			return
 		}
 
 		atomic.AddInt64(&p.busy, 1)
-		result := w.Do(job.job)
+		result, replacement := do(w, job.job)
 		job.commit(result)
 		atomic.AddInt64(&p.busy, -1)
+		if replacement != nil {
+			w = replacement
+		}
 	}
 }
 
+// do runs job on w. If w is a Recoverer, panics are recovered, and the result
+// and replacement worker returned by w.Recover are returned.
+func do(w Worker, job interface{}) (result interface{}, replacement Worker) {
+	r, ok := w.(Recoverer)
+	if !ok {
+		return w.Do(job), nil
+	}
+	defer func() {
+		if v := recover(); v != nil {
+			result, replacement = r.Recover(job, v)
+		}
+	}()
+	return w.Do(job), nil
+}
+
 // Busy returns the number of workers that are currently busy.
 func (p *Pool) Busy() int {
 	return int(atomic.LoadInt64(&p.busy))
@@ -0,0 +1,91 @@
+package worker
+
+import "testing"
+
+type recoverWorker struct {
+	funcWorker
+	replaced chan struct{}
+}
+
+func (w recoverWorker) Recover(job interface{}, v interface{}) (interface{}, Worker) {
+	close(w.replaced)
+	return v, funcWorker(func(job interface{}) interface{} { return job })
+}
+
+func TestRecover(t *testing.T) {
+	w := recoverWorker{
+		funcWorker: func(job interface{}) interface{} { panic("poisoned") },
+		replaced:   make(chan struct{}),
+	}
+	pool := NewPool(w)
+	defer pool.Destroy()
+
+	results := make(chan interface{}, 1)
+	commit := func(result interface{}) { results <- result }
+	pool.SubmitJob(NewJob("first", commit))
+	if result := <-results; result != "poisoned" {
+		t.Fatalf("got %v for a job which panicked", result)
+	}
+	<-w.replaced
+
+	pool.SubmitJob(NewJob("second", commit))
+	if result := <-results; result != "second" {
+		t.Fatalf("got %v from the replacement worker", result)
+	}
+	if busy := pool.Busy(); busy != 0 {
+		t.Fatalf("%d workers still busy", busy)
+	}
+}
+
+type prioritizedJob struct {
+	name     string
+	priority Priority
+}
+
+func (j prioritizedJob) Priority() Priority { return j.priority }
+
+func TestPriority(t *testing.T) {
+	started, block := make(chan struct{}), make(chan struct{})
+	pool := NewPool(funcWorker(func(job interface{}) interface{} {
+		if job == "block" {
+			close(started)
+			<-block
+		}
+		return job
+	}))
+	defer pool.Destroy()
+
+	results := make(chan interface{}, 64)
+	commit := func(result interface{}) { results <- result }
+	// Occupy the only worker while the other jobs queue up.
+	pool.SubmitJob(NewJob("block", commit))
+	<-started
+	low := prioritizedJob{"low", Low}
+	pool.SubmitJob(NewJob(low, commit))
+	pool.SubmitJob(NewJob("normal", commit))
+	for i := 0; i < maxSkips+1; i++ {
+		pool.SubmitJob(NewJob(prioritizedJob{"high", High}, commit))
+	}
+	close(block)
+
+	if result := <-results; result != "block" {
+		t.Fatalf("got %v first", result)
+	}
+	var order []interface{}
+	for i := 0; i < maxSkips+3; i++ {
+		order = append(order, <-results)
+	}
+	// The low priority job is only passed over maxSkips times.
+	for i, result := range order {
+		var want interface{} = prioritizedJob{"high", High}
+		switch i {
+		case maxSkips:
+			want = "normal"
+		case maxSkips + 1:
+			want = low
+		}
+		if result != want {
+			t.Fatalf("got %v at %d; want %v", result, i, want)
+		}
+	}
+}
@@ -0,0 +1,118 @@
+package server
+
+import (
+	"fmt"
+	"net"
+	"strings"
+	"sync"
+)
+
+// An IPFilter restricts the client IP addresses which may connect to the
+// server with CIDR allow and deny lists. Its lists can be replaced with Set
+// while the server is running, e.g. on a configuration reload.
+type IPFilter struct {
+	mtx   sync.RWMutex
+	allow []*net.IPNet
+	deny  []*net.IPNet
+}
+
+// NewIPFilter returns an IPFilter with the given allow and deny lists.
+func NewIPFilter(allow, deny []*net.IPNet) *IPFilter {
+	f := new(IPFilter)
+	f.Set(allow, deny)
+	return f
+}
+
+// Set replaces the allow and deny lists of f. Connections already established
+// are not affected.
+func (f *IPFilter) Set(allow, deny []*net.IPNet) {
+	f.mtx.Lock()
+	defer f.mtx.Unlock()
+	f.allow = allow
+	f.deny = deny
+}
+
+// Check returns the name of the list which rejects ip, "denylist" if it is in
+// a denied network or "allowlist" if the allow list is not empty and it is in
+// none of its networks, or "" if ip may connect.
+func (f *IPFilter) Check(ip net.IP) string {
+	f.mtx.RLock()
+	defer f.mtx.RUnlock()
+	for _, n := range f.deny {
+		if n.Contains(ip) {
+			return "denylist"
+		}
+	}
+	if len(f.allow) == 0 {
+		return ""
+	}
+	for _, n := range f.allow {
+		if n.Contains(ip) {
+			return ""
+		}
+	}
+	return "allowlist"
+}
+
+// ParseCIDRs parses networks in CIDR notation, such as "192.0.2.0/24". A
+// single IP address stands for the network of just that address.
+func ParseCIDRs(cidrs []string) ([]*net.IPNet, error) {
+	var nets []*net.IPNet
+	for _, s := range cidrs {
+		if !strings.Contains(s, "/") {
+			ip := net.ParseIP(s)
+			if ip == nil {
+				return nil, fmt.Errorf("invalid IP address %q", s)
+			}
+			bits := 8 * net.IPv6len
+			if ip4 := ip.To4(); ip4 != nil {
+				ip, bits = ip4, 8*net.IPv4len
+			}
+			nets = append(nets, &net.IPNet{IP: ip, Mask: net.CIDRMask(bits, bits)})
+			continue
+		}
+		_, n, err := net.ParseCIDR(s)
+		if err != nil {
+			return nil, err
+		}
+		nets = append(nets, n)
+	}
+	return nets, nil
+}
+
+// filterConn closes c and returns false if the server's IPFilter rejects its
+// client. Only TCP clients are filtered.
+func (s *Server) filterConn(c net.Conn) bool {
+	f := s.config.ipFilter
+	if f == nil {
+		return true
+	}
+	tcp, ok := c.RemoteAddr().(*net.TCPAddr)
+	if !ok {
+		return true
+	}
+	list := f.Check(tcp.IP)
+	if list == "" {
+		return true
+	}
+	s.log.Debugf("connection %v: rejected by the IP %s", c.RemoteAddr(), list)
+	s.metrics.logIPFilterRejected(list)
+	c.Close()
+	return false
+}
+
+// filterListener is a net.Listener which drops the connections rejected by
+// the server's IPFilter.
+type filterListener struct {
+	net.Listener
+	s *Server
+}
+
+func (l filterListener) Accept() (net.Conn, error) {
+	for {
+		c, err := l.Listener.Accept()
+		if err != nil || l.s.filterConn(c) {
+			return c, err
+		}
+	}
+}
@@ -0,0 +1,285 @@
+package server
+
+import (
+	"bytes"
+	"crypto"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/binary"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"sync"
+
+	"github.com/cloudflare/gokeyless/internal/google"
+	"golang.org/x/crypto/pbkdf2"
+)
+
+const (
+	// encryptedKeyPEMType is the PEM type of the key files written by
+	// EncryptKey.
+	encryptedKeyPEMType = "GOKEYLESS ENCRYPTED PRIVATE KEY"
+	// encryptedKeyVersion is the first byte of encrypted keys.
+	encryptedKeyVersion = 0x01
+	// passphraseIterations is the number of PBKDF2-HMAC-SHA256 iterations
+	// deriving the KEKs of passphrases.
+	passphraseIterations = 600000
+	// passphraseSaltLen is the length of the salts of passphrase KEKs.
+	passphraseSaltLen = 16
+)
+
+// ErrEncryptedKey is returned when an encrypted key file is malformed, or
+// was not encrypted under the given KEK.
+var ErrEncryptedKey = errors.New("invalid encrypted key")
+
+// A KEK is a key encryption key, under which the data keys encrypting
+// private keys at rest are wrapped.
+type KEK interface {
+	// Wrap encrypts a data key.
+	Wrap(dek []byte) ([]byte, error)
+	// Unwrap decrypts a data key encrypted by Wrap.
+	Unwrap(wrapped []byte) ([]byte, error)
+}
+
+// aesKEK is a KEK wrapping data keys with AES-256-GCM.
+type aesKEK struct {
+	aead cipher.AEAD
+}
+
+// NewAESKEK returns a KEK wrapping data keys with AES-256-GCM under key,
+// which must be 32 bytes long.
+func NewAESKEK(key []byte) (KEK, error) {
+	if len(key) != 32 {
+		return nil, fmt.Errorf("KEK must be 32 bytes, not %d", len(key))
+	}
+	aead, err := newKeyAEAD(key)
+	if err != nil {
+		return nil, err
+	}
+	return &aesKEK{aead: aead}, nil
+}
+
+// LoadKEKFile returns the AES KEK whose base64-encoded 32-byte key is in
+// file, such as one generated with "head -c 32 /dev/urandom | base64".
+func LoadKEKFile(file string) (KEK, error) {
+	in, err := ioutil.ReadFile(file)
+	if err != nil {
+		return nil, err
+	}
+	key, err := base64.StdEncoding.DecodeString(string(bytes.TrimSpace(in)))
+	zeroizeBytes(in)
+	if err != nil {
+		return nil, fmt.Errorf("%s: invalid KEK: %v", file, err)
+	}
+	defer zeroizeBytes(key)
+	return NewAESKEK(key)
+}
+
+func (k *aesKEK) Wrap(dek []byte) ([]byte, error) {
+	nonce := make([]byte, k.aead.NonceSize(), k.aead.NonceSize()+len(dek)+k.aead.Overhead())
+	if _, err := rand.Read(nonce); err != nil {
+		return nil, err
+	}
+	return k.aead.Seal(nonce, nonce, dek, nil), nil
+}
+
+func (k *aesKEK) Unwrap(wrapped []byte) ([]byte, error) {
+	if len(wrapped) < k.aead.NonceSize() {
+		return nil, ErrEncryptedKey
+	}
+	dek, err := k.aead.Open(nil, wrapped[:k.aead.NonceSize()], wrapped[k.aead.NonceSize():], nil)
+	if err != nil {
+		return nil, ErrEncryptedKey
+	}
+	return dek, nil
+}
+
+// passphraseKEK is a KEK derived from a passphrase with PBKDF2. The salt is
+// prepended to the wrapped data keys; the keys of the salts seen are cached,
+// so that the keys wrapped together are unwrapped with a single derivation.
+type passphraseKEK struct {
+	passphrase []byte
+	salt       []byte
+
+	mtx  sync.Mutex
+	keks map[string]*aesKEK
+}
+
+// NewPassphraseKEK returns a KEK derived from passphrase with
+// PBKDF2-HMAC-SHA256 and a random salt, which is stored with the wrapped data
+// keys.
+func NewPassphraseKEK(passphrase []byte) (KEK, error) {
+	if len(passphrase) == 0 {
+		return nil, errors.New("empty KEK passphrase")
+	}
+	salt := make([]byte, passphraseSaltLen)
+	if _, err := rand.Read(salt); err != nil {
+		return nil, err
+	}
+	return &passphraseKEK{
+		passphrase: append([]byte(nil), passphrase...),
+		salt:       salt,
+		keks:       make(map[string]*aesKEK),
+	}, nil
+}
+
+// kek returns the KEK derived with salt.
+func (k *passphraseKEK) kek(salt []byte) (*aesKEK, error) {
+	k.mtx.Lock()
+	defer k.mtx.Unlock()
+	if kek, ok := k.keks[string(salt)]; ok {
+		return kek, nil
+	}
+	key := pbkdf2.Key(k.passphrase, salt, passphraseIterations, 32, sha256.New)
+	defer zeroizeBytes(key)
+	aead, err := newKeyAEAD(key)
+	if err != nil {
+		return nil, err
+	}
+	kek := &aesKEK{aead: aead}
+	k.keks[string(salt)] = kek
+	return kek, nil
+}
+
+func (k *passphraseKEK) Wrap(dek []byte) ([]byte, error) {
+	kek, err := k.kek(k.salt)
+	if err != nil {
+		return nil, err
+	}
+	wrapped, err := kek.Wrap(dek)
+	if err != nil {
+		return nil, err
+	}
+	return append(append([]byte(nil), k.salt...), wrapped...), nil
+}
+
+func (k *passphraseKEK) Unwrap(wrapped []byte) ([]byte, error) {
+	if len(wrapped) < passphraseSaltLen {
+		return nil, ErrEncryptedKey
+	}
+	kek, err := k.kek(wrapped[:passphraseSaltLen])
+	if err != nil {
+		return nil, err
+	}
+	return kek.Unwrap(wrapped[passphraseSaltLen:])
+}
+
+// NewKMSKEK returns a KEK wrapping data keys with the symmetric Google Cloud
+// KMS crypto key with the given resource name, such as
+// projects/p/locations/l/keyRings/r/cryptoKeys/k.
+func NewKMSKEK(name string) (KEK, error) {
+	if !google.IsKMSCryptoKey(name) {
+		return nil, fmt.Errorf("not a KMS crypto key: %s", name)
+	}
+	return google.NewKEK(name)
+}
+
+func newKeyAEAD(key []byte) (cipher.AEAD, error) {
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, err
+	}
+	return cipher.NewGCM(block)
+}
+
+// EncryptKey encrypts key, a private key file in PEM or DER, for storage on
+// disk: key is encrypted with AES-256-GCM under a random data key, which is
+// wrapped under kek. The result is a PEM block of type
+// "GOKEYLESS ENCRYPTED PRIVATE KEY" holding:
+//
+//	0x01 | uint16 length | wrapped data key | 12-byte nonce | ciphertext
+func EncryptKey(kek KEK, key []byte) ([]byte, error) {
+	dek := make([]byte, 32)
+	if _, err := rand.Read(dek); err != nil {
+		return nil, err
+	}
+	defer zeroizeBytes(dek)
+	wrapped, err := kek.Wrap(dek)
+	if err != nil {
+		return nil, err
+	}
+	if len(wrapped) > 0xffff {
+		return nil, errors.New("wrapped data key too long")
+	}
+	aead, err := newKeyAEAD(dek)
+	if err != nil {
+		return nil, err
+	}
+
+	b := make([]byte, 3, 3+len(wrapped)+aead.NonceSize()+len(key)+aead.Overhead())
+	b[0] = encryptedKeyVersion
+	binary.BigEndian.PutUint16(b[1:], uint16(len(wrapped)))
+	b = append(b, wrapped...)
+	nonce := make([]byte, aead.NonceSize())
+	if _, err := rand.Read(nonce); err != nil {
+		return nil, err
+	}
+	b = append(b, nonce...)
+	// The header is authenticated so that the wrapped data key can't be
+	// swapped.
+	b = aead.Seal(b, nonce, key, b[:3+len(wrapped)])
+	return pem.EncodeToMemory(&pem.Block{Type: encryptedKeyPEMType, Bytes: b}), nil
+}
+
+// IsEncryptedKey reports whether in is a key file encrypted by EncryptKey.
+func IsEncryptedKey(in []byte) bool {
+	block, _ := pem.Decode(in)
+	return block != nil && block.Type == encryptedKeyPEMType
+}
+
+// DecryptKey decrypts a key file encrypted by EncryptKey under kek.
+func DecryptKey(kek KEK, in []byte) ([]byte, error) {
+	block, _ := pem.Decode(in)
+	if block == nil || block.Type != encryptedKeyPEMType {
+		return nil, ErrEncryptedKey
+	}
+	b := block.Bytes
+	if len(b) < 3 || b[0] != encryptedKeyVersion {
+		return nil, ErrEncryptedKey
+	}
+	n := int(binary.BigEndian.Uint16(b[1:]))
+	if len(b) < 3+n {
+		return nil, ErrEncryptedKey
+	}
+	header, wrapped, rest := b[:3+n], b[3:3+n], b[3+n:]
+
+	dek, err := kek.Unwrap(wrapped)
+	if err != nil {
+		return nil, err
+	}
+	defer zeroizeBytes(dek)
+	aead, err := newKeyAEAD(dek)
+	if err != nil {
+		return nil, ErrEncryptedKey
+	}
+	if len(rest) < aead.NonceSize() {
+		return nil, ErrEncryptedKey
+	}
+	key, err := aead.Open(nil, rest[:aead.NonceSize()], rest[aead.NonceSize():], header)
+	if err != nil {
+		return nil, ErrEncryptedKey
+	}
+	return key, nil
+}
+
+// EncryptedLoadKey returns a function for AddFromDir, AddFromFile and
+// WatchDir which decrypts the key files encrypted under kek and parses them
+// with LoadKey. Key files which are not encrypted are refused, so that no
+// plaintext key is served from disk.
+func EncryptedLoadKey(kek KEK, LoadKey func([]byte) (crypto.Signer, error)) func([]byte) (crypto.Signer, error) {
+	return func(in []byte) (crypto.Signer, error) {
+		if !IsEncryptedKey(in) {
+			return nil, errors.New("key file is not encrypted")
+		}
+		key, err := DecryptKey(kek, in)
+		if err != nil {
+			return nil, err
+		}
+		defer zeroizeBytes(key)
+		return LoadKey(key)
+	}
+}
@@ -0,0 +1,133 @@
+package server
+
+import (
+	"crypto"
+	"errors"
+	"sync"
+	"time"
+
+	"github.com/cloudflare/gokeyless/protocol"
+)
+
+// A KeyLimit bounds the number of concurrent operations on a key or a group of
+// keys, such as all keys held by one HSM or remote KMS. Requests beyond the
+// limit wait for a free slot, so that a slow key ties up at most Concurrency +
+// Queue workers instead of starving requests for other keys.
+type KeyLimit struct {
+	// Group identifies the keys which share the limit, e.g. an SKI or the name
+	// of a backend. The limits of a group are fixed by its first request.
+	Group string
+	// Concurrency is the maximum number of concurrent operations. Zero means
+	// no limit.
+	Concurrency int
+	// Queue is the maximum number of requests waiting for a slot. Further
+	// requests fail immediately.
+	Queue int
+	// Timeout is the maximum time a request waits for a slot. Zero means the
+	// request fails immediately if no slot is free.
+	Timeout time.Duration
+}
+
+// A KeyLimitFunc returns the limit which applies to an operation with key.
+type KeyLimitFunc func(op *protocol.Operation, key crypto.Signer) KeyLimit
+
+// PerSKIKeyLimit returns a KeyLimitFunc which limits each key separately.
+func PerSKIKeyLimit(concurrency, queue int, timeout time.Duration) KeyLimitFunc {
+	return func(op *protocol.Operation, key crypto.Signer) KeyLimit {
+		ski := op.SKI
+		if !ski.Valid() {
+			// The key was found by SNI or IP address.
+			ski, _ = protocol.GetSKI(key.Public())
+		}
+		group := ski.String()
+		return KeyLimit{Group: group, Concurrency: concurrency, Queue: queue, Timeout: timeout}
+	}
+}
+
+var (
+	errKeyQueueFull    = errors.New("too many requests waiting for key")
+	errKeyLimitTimeout = errors.New("timed out waiting for key")
+)
+
+// keySemaphore limits the concurrent operations of one KeyLimit group.
+type keySemaphore struct {
+	slots   chan struct{}
+	queue   int
+	timeout time.Duration
+
+	mtx     sync.Mutex
+	waiting int
+}
+
+// acquire takes a slot, returning a function to release it.
+func (sem *keySemaphore) acquire() (func(), error) {
+	release := func() { <-sem.slots }
+	select {
+	case sem.slots <- struct{}{}:
+		return release, nil
+	default:
+	}
+
+	sem.mtx.Lock()
+	if sem.waiting >= sem.queue || sem.timeout <= 0 {
+		sem.mtx.Unlock()
+		return nil, errKeyQueueFull
+	}
+	sem.waiting++
+	sem.mtx.Unlock()
+	defer func() {
+		sem.mtx.Lock()
+		sem.waiting--
+		sem.mtx.Unlock()
+	}()
+
+	timer := time.NewTimer(sem.timeout)
+	defer timer.Stop()
+	select {
+	case sem.slots <- struct{}{}:
+		return release, nil
+	case <-timer.C:
+		return nil, errKeyLimitTimeout
+	}
+}
+
+// keyLimiter holds the semaphores of all KeyLimit groups seen so far.
+type keyLimiter struct {
+	metrics *serverMetrics
+	mtx     sync.Mutex
+	sems    map[string]*keySemaphore
+}
+
+func newKeyLimiter(metrics *serverMetrics) *keyLimiter {
+	return &keyLimiter{metrics: metrics, sems: make(map[string]*keySemaphore)}
+}
+
+// acquire takes a slot for an operation with key according to the server's
+// KeyLimitFunc, returning a function to release it.
+func (l *keyLimiter) acquire(f KeyLimitFunc, op *protocol.Operation, key crypto.Signer) (func(), error) {
+	if f == nil {
+		return func() {}, nil
+	}
+	limit := f(op, key)
+	if limit.Concurrency <= 0 {
+		return func() {}, nil
+	}
+
+	l.mtx.Lock()
+	sem, ok := l.sems[limit.Group]
+	if !ok {
+		sem = &keySemaphore{
+			slots:   make(chan struct{}, limit.Concurrency),
+			queue:   limit.Queue,
+			timeout: limit.Timeout,
+		}
+		l.sems[limit.Group] = sem
+	}
+	l.mtx.Unlock()
+
+	release, err := sem.acquire()
+	if err != nil {
+		l.metrics.logKeyLimitRejected()
+	}
+	return release, err
+}
@@ -0,0 +1,118 @@
+package server
+
+import (
+	"crypto"
+	"errors"
+	"fmt"
+
+	"github.com/cloudflare/gokeyless/protocol"
+)
+
+// A KeyUsage restricts the operations a key may be used for, so that e.g. a
+// compromised client can't use a signing key to decrypt.
+type KeyUsage struct {
+	// Sign allows RSA, ECDSA and Ed25519 signatures.
+	Sign bool
+	// Decrypt allows RSA decryption.
+	Decrypt bool
+	// OCSP allows signing OCSP responses with protocol.OpOCSPSign.
+	OCSP bool
+	// Hashes, if set, lists the hashes signatures may be made with. Ed25519
+	// signatures, which are made over the whole message, are not restricted.
+	Hashes []crypto.Hash
+}
+
+// A KeyUsageFunc returns the usage allowed for key, or nil if key may be used
+// for any operation.
+type KeyUsageFunc func(op *protocol.Operation, key crypto.Signer) *KeyUsage
+
+// PerSKIKeyUsage returns a KeyUsageFunc which restricts the keys in usage by
+// their SKI. Other keys are not restricted.
+func PerSKIKeyUsage(usage map[protocol.SKI]*KeyUsage) KeyUsageFunc {
+	return func(op *protocol.Operation, key crypto.Signer) *KeyUsage {
+		ski := op.SKI
+		if !ski.Valid() {
+			// The key was found by SNI or IP address.
+			ski, _ = protocol.GetSKI(key.Public())
+		}
+		return usage[ski]
+	}
+}
+
+// A usageKeystore is a Keystore which restricts the usage of its keys.
+type usageKeystore interface {
+	KeyUsage(op *protocol.Operation, key crypto.Signer) *KeyUsage
+}
+
+// SetKeyUsage restricts the key with ski to usage, or lifts the restriction
+// if usage is nil. The key need not have been added yet.
+func (keys *DefaultKeystore) SetKeyUsage(ski protocol.SKI, usage *KeyUsage) {
+	keys.mtx.Lock()
+	defer keys.mtx.Unlock()
+
+	if usage == nil {
+		delete(keys.usage, ski)
+		return
+	}
+	if keys.usage == nil {
+		keys.usage = make(map[protocol.SKI]*KeyUsage)
+	}
+	keys.usage[ski] = usage
+}
+
+// KeyUsage returns the usage the key requested by op is restricted to with
+// SetKeyUsage, or nil.
+func (keys *DefaultKeystore) KeyUsage(op *protocol.Operation, key crypto.Signer) *KeyUsage {
+	keys.mtx.RLock()
+	defer keys.mtx.RUnlock()
+	return keys.usage[op.SKI]
+}
+
+// keyOperation classifies the operations constrained by a KeyUsage.
+type keyOperation int
+
+const (
+	keyOpSign keyOperation = iota
+	keyOpDecrypt
+	keyOpOCSP
+)
+
+// allows returns an error unless u, which may be nil, allows kind of
+// operation with hash, which is zero if the operation isn't hashed.
+func (u *KeyUsage) allows(kind keyOperation, hash crypto.Hash) error {
+	if u == nil {
+		return nil
+	}
+	switch {
+	case kind == keyOpSign && !u.Sign:
+		return errors.New("key may not sign")
+	case kind == keyOpDecrypt && !u.Decrypt:
+		return errors.New("key may not decrypt")
+	case kind == keyOpOCSP && !u.OCSP:
+		return errors.New("key may not sign OCSP responses")
+	}
+	if hash == 0 || len(u.Hashes) == 0 {
+		return nil
+	}
+	for _, h := range u.Hashes {
+		if h == hash {
+			return nil
+		}
+	}
+	return fmt.Errorf("key may not sign with hash %v", hash)
+}
+
+// checkKeyUsage returns an error unless both the server's KeyUsageFunc and
+// its keystore, if it restricts key usage, allow op to use key for kind of
+// operation with hash.
+func (s *Server) checkKeyUsage(op *protocol.Operation, key crypto.Signer, kind keyOperation, hash crypto.Hash) error {
+	if s.config.keyUsage != nil {
+		if err := s.config.keyUsage(op, key).allows(kind, hash); err != nil {
+			return err
+		}
+	}
+	if keys, ok := s.keys.(usageKeystore); ok {
+		return keys.KeyUsage(op, key).allows(kind, hash)
+	}
+	return nil
+}
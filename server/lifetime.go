@@ -0,0 +1,63 @@
+package server
+
+import (
+	"sync/atomic"
+	"time"
+
+	"github.com/cloudflare/gokeyless/protocol"
+)
+
+// defaultRetireGrace is how long a retired connection is kept open by default
+// for the client to move to a new one.
+const defaultRetireGrace = 30 * time.Second
+
+// checkLifetime retires the connection if it has carried more bytes than the
+// configured limit.
+func (c *conn) checkLifetime() {
+	if c.config == nil || c.config.connMaxBytes <= 0 {
+		return
+	}
+	if atomic.LoadInt64(&c.stats.bytesRead)+atomic.LoadInt64(&c.stats.bytesWritten) >= c.config.connMaxBytes {
+		c.retire("bytes")
+	}
+}
+
+// retire ends the connection, which reached its maximum age or size, without
+// failing requests: clients which negotiated FeatureReconnect are sent
+// OpReconnect and have the grace period to move to a new connection, and
+// others are disconnected as soon as they have no outstanding request. In
+// both cases, the connection is closed once the grace period is over.
+func (c *conn) retire(reason string) {
+	if !atomic.CompareAndSwapUint32(&c.retiring, 0, 1) {
+		return
+	}
+	c.log.Debugf("connection %v: retiring after reaching its maximum %s %s", c.name, reason, c.stats)
+	c.metrics.logConnRetired(reason)
+	grace := c.config.connRetireGrace
+	if grace <= 0 {
+		grace = defaultRetireGrace
+	}
+	time.AfterFunc(grace, c.Destroy)
+	if atomic.LoadUint32(&c.reconnect) == 1 {
+		c.notifyReconnect()
+		return
+	}
+	c.closeIfIdle()
+}
+
+// closeIfIdle closes a retiring connection once no request is outstanding.
+func (c *conn) closeIfIdle() {
+	if atomic.LoadUint32(&c.retiring) == 1 && atomic.LoadUint32(&c.reconnect) == 0 && atomic.LoadInt64(&c.outstanding) == 0 {
+		c.Destroy()
+	}
+}
+
+// notifyReconnect asks the client to move to a new connection.
+func (c *conn) notifyReconnect() bool {
+	c.writeMtx.Lock()
+	defer c.writeMtx.Unlock()
+
+	op := protocol.Operation{Opcode: protocol.OpReconnect, NoPadding: atomic.LoadUint32(&c.noPadding) == 1}
+	pkt := protocol.NewPacket(0, op)
+	return c.writePacket(&pkt)
+}
@@ -0,0 +1,78 @@
+package server
+
+import (
+	"fmt"
+	"sync/atomic"
+
+	"github.com/cloudflare/cfssl/log"
+)
+
+// A serverLogger writes the logs of a Server to the log.SyslogWriter set with
+// WithLogger, or to the cfssl logger shared by the process if it has none.
+type serverLogger struct {
+	w     log.SyslogWriter
+	level int32
+}
+
+// Level returns the level at and above which l logs.
+func (l *serverLogger) Level() int {
+	if l.w == nil {
+		return log.Level
+	}
+	return int(atomic.LoadInt32(&l.level))
+}
+
+// SetLevel changes the level at and above which l logs.
+func (l *serverLogger) SetLevel(level int) {
+	if l.w == nil {
+		log.Level = level
+		return
+	}
+	atomic.StoreInt32(&l.level, int32(level))
+}
+
+func (l *serverLogger) print(level int, format string, v []interface{}) {
+	if l.w == nil {
+		switch level {
+		case log.LevelDebug:
+			log.Debugf(format, v...)
+		case log.LevelInfo:
+			log.Infof(format, v...)
+		case log.LevelWarning:
+			log.Warningf(format, v...)
+		default:
+			log.Errorf(format, v...)
+		}
+		return
+	}
+	if level < l.Level() {
+		return
+	}
+	msg := fmt.Sprintf(format, v...)
+	switch level {
+	case log.LevelDebug:
+		l.w.Debug(msg)
+	case log.LevelInfo:
+		l.w.Info(msg)
+	case log.LevelWarning:
+		l.w.Warning(msg)
+	default:
+		l.w.Err(msg)
+	}
+}
+
+func (l *serverLogger) Debugf(format string, v ...interface{}) {
+	l.print(log.LevelDebug, format, v)
+}
+
+func (l *serverLogger) Infof(format string, v ...interface{}) {
+	l.print(log.LevelInfo, format, v)
+}
+
+func (l *serverLogger) Warningf(format string, v ...interface{}) {
+	l.print(log.LevelWarning, format, v)
+}
+
+func (l *serverLogger) Errorf(format string, v ...interface{}) {
+	l.print(log.LevelError, format, v)
+}
@@ -0,0 +1,246 @@
+package server
+
+import (
+	"bytes"
+	"context"
+	"crypto"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"net/url"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/cloudflare/cfssl/log"
+	"github.com/cloudflare/gokeyless/internal/etcd"
+	"github.com/cloudflare/gokeyless/internal/redis"
+	"github.com/cloudflare/gokeyless/protocol"
+)
+
+// DefaultMetadataTTL is how long a MetadataKeystore caches keys unless set
+// otherwise.
+const DefaultMetadataTTL = time.Minute
+
+// A KeyRecord tells the keyservers sharing a MetadataStore where to find a key.
+// Exactly one of File, URI and Wrapped must be set, as in a LoadKeyRequest.
+type KeyRecord struct {
+	// File is the path of the key on the keyservers, in PEM or DER.
+	File string `json:"file,omitempty"`
+	// URI is the PKCS#11 URI, Azure Key Vault URI or Google Cloud KMS
+	// resource name of the key.
+	URI string `json:"uri,omitempty"`
+	// Wrapped is the key, in PEM or DER, wrapped with protocol.WrapKey for
+	// the public key of the keyservers' certificate.
+	Wrapped []byte `json:"wrapped,omitempty"`
+}
+
+// A MetadataStore holds the KeyRecords of keys by SKI, e.g. in Redis or etcd,
+// so that a fleet of keyservers shares one source of truth.
+type MetadataStore interface {
+	// Get returns the record of the key with ski, or nil if there is none.
+	Get(ctx context.Context, ski protocol.SKI) (*KeyRecord, error)
+	// SKIs returns the SKIs of the keys with records.
+	SKIs(ctx context.Context) ([]protocol.SKI, error)
+}
+
+// kvClient is a client for a key-value store.
+type kvClient interface {
+	Get(ctx context.Context, key string) ([]byte, error)
+	Keys(ctx context.Context, prefix string) ([]string, error)
+}
+
+// kvMetadataStore is a MetadataStore holding records as JSON under the prefix
+// followed by the hex SKI.
+type kvMetadataStore struct {
+	kv     kvClient
+	prefix string
+}
+
+// NewMetadataStore returns a MetadataStore for a Redis or etcd URL, such as
+// redis://:password@host:6379/0 or etcd://host:2379, holding the KeyRecord of
+// each key as JSON under its hex SKI. The prefix query parameter, e.g.
+// ?prefix=keyless/, is prepended to the SKIs. rediss:// and etcds:// URLs
+// connect with TLS.
+func NewMetadataStore(rawurl string) (MetadataStore, error) {
+	u, err := url.Parse(rawurl)
+	if err != nil {
+		return nil, err
+	}
+	store := &kvMetadataStore{prefix: u.Query().Get("prefix")}
+	switch {
+	case redis.IsURL(rawurl):
+		store.kv, err = redis.New(rawurl)
+	case etcd.IsURL(rawurl):
+		store.kv, err = etcd.New(rawurl)
+	default:
+		return nil, fmt.Errorf("unknown metadata store URL: %s", rawurl)
+	}
+	if err != nil {
+		return nil, err
+	}
+	return store, nil
+}
+
+func (s *kvMetadataStore) Get(ctx context.Context, ski protocol.SKI) (*KeyRecord, error) {
+	b, err := s.kv.Get(ctx, s.prefix+ski.String())
+	if err != nil || b == nil {
+		return nil, err
+	}
+	var record KeyRecord
+	if err := json.Unmarshal(b, &record); err != nil {
+		return nil, fmt.Errorf("invalid record for key %v: %v", ski, err)
+	}
+	return &record, nil
+}
+
+func (s *kvMetadataStore) SKIs(ctx context.Context) ([]protocol.SKI, error) {
+	keys, err := s.kv.Keys(ctx, s.prefix)
+	if err != nil {
+		return nil, err
+	}
+	var skis []protocol.SKI
+	for _, key := range keys {
+		// Other entries may share the prefix.
+		if ski, err := parseSKI(strings.TrimPrefix(key, s.prefix)); err == nil {
+			skis = append(skis, ski)
+		}
+	}
+	return skis, nil
+}
+
+// A MetadataKeystore is a Keystore which looks keys up in a MetadataStore
+// shared by a fleet of keyservers, and loads them where their record says, so
+// that new keys are served by every keyserver as soon as they are published.
+// Loaded keys are cached, and their records are checked again once the cache
+// expires; if the store is unreachable then, the cached key is kept.
+type MetadataKeystore struct {
+	store MetadataStore
+	load  func(*KeyRecord) (crypto.Signer, error)
+
+	mtx   sync.Mutex
+	ttl   time.Duration
+	cache map[protocol.SKI]*metadataEntry
+}
+
+// A metadataEntry is a cached key, loaded as described by record.
+type metadataEntry struct {
+	record  *KeyRecord
+	priv    crypto.Signer
+	expires time.Time
+}
+
+// NewMetadataKeystore returns a MetadataKeystore reading records from store.
+// load loads the key described by a record; if it is nil, only File and URI
+// records can be loaded. Server.LoadKeyRecord can also load wrapped keys.
+func NewMetadataKeystore(store MetadataStore, load func(*KeyRecord) (crypto.Signer, error)) *MetadataKeystore {
+	if load == nil {
+		load = loadKeyRecord
+	}
+	return &MetadataKeystore{
+		store: store,
+		load:  load,
+		ttl:   DefaultMetadataTTL,
+		cache: make(map[protocol.SKI]*metadataEntry),
+	}
+}
+
+// SetTTL sets how long keys are cached before their records are checked again.
+func (keys *MetadataKeystore) SetTTL(ttl time.Duration) {
+	keys.mtx.Lock()
+	defer keys.mtx.Unlock()
+	keys.ttl = ttl
+}
+
+// Get returns the key requested by op, loading it if its record is new or has
+// changed.
+func (keys *MetadataKeystore) Get(ctx context.Context, op *protocol.Operation) (crypto.Signer, error) {
+	ski := op.SKI
+	if !ski.Valid() {
+		return nil, fmt.Errorf("keyless: invalid SKI %s", ski)
+	}
+	now := time.Now()
+	keys.mtx.Lock()
+	cached := keys.cache[ski]
+	ttl := keys.ttl
+	keys.mtx.Unlock()
+	if cached != nil && now.Before(cached.expires) {
+		return cached.priv, nil
+	}
+
+	record, err := keys.store.Get(ctx, ski)
+	if err != nil {
+		if cached != nil {
+			log.Warningf("metadata keystore: failed to check key with SKI %v, keeping cached key: %v", ski, err)
+			return cached.priv, nil
+		}
+		return nil, err
+	}
+	if record == nil {
+		// Lookups of unknown keys aren't cached, so that new keys are served
+		// as soon as they are published.
+		if cached != nil {
+			keys.mtx.Lock()
+			delete(keys.cache, ski)
+			keys.mtx.Unlock()
+		}
+		return nil, nil
+	}
+	entry := &metadataEntry{record: record, expires: now.Add(ttl)}
+	if cached != nil && sameRecord(cached.record, record) {
+		entry.priv = cached.priv
+	} else {
+		if entry.priv, err = keys.load(record); err != nil {
+			return nil, fmt.Errorf("failed to load key with SKI %v: %v", ski, err)
+		}
+		if got, err := protocol.GetSKI(entry.priv.Public()); err != nil || got != ski {
+			return nil, fmt.Errorf("record for SKI %v points to another key", ski)
+		}
+	}
+	keys.mtx.Lock()
+	keys.cache[ski] = entry
+	keys.mtx.Unlock()
+	return entry.priv, nil
+}
+
+func sameRecord(a, b *KeyRecord) bool {
+	return a != nil && b != nil && a.File == b.File && a.URI == b.URI && bytes.Equal(a.Wrapped, b.Wrapped)
+}
+
+// SKIs returns the SKIs of the keys with records, in ascending order, so that
+// they can be attested.
+func (keys *MetadataKeystore) SKIs() []protocol.SKI {
+	skis, err := keys.store.SKIs(context.Background())
+	if err != nil {
+		log.Errorf("metadata keystore: failed to list keys: %v", err)
+		return nil
+	}
+	sort.Slice(skis, func(i, j int) bool { return bytes.Compare(skis[i][:], skis[j][:]) < 0 })
+	return skis
+}
+
+// LoadKeyRecord loads the key described by r, unwrapping wrapped keys with the
+// server's certificate.
+func (s *Server) LoadKeyRecord(r *KeyRecord) (crypto.Signer, error) {
+	return s.loadKey(r.File, r.URI, r.Wrapped)
+}
+
+// loadKeyRecord loads the key described by r, unless it is wrapped.
+func loadKeyRecord(r *KeyRecord) (crypto.Signer, error) {
+	switch {
+	case r.Wrapped != nil:
+		return nil, errors.New("wrapped keys can only be loaded by a server")
+	case r.File != "" && r.URI == "":
+		in, err := ioutil.ReadFile(r.File)
+		if err != nil {
+			return nil, err
+		}
+		return DefaultLoadKey(in)
+	case r.URI != "" && r.File == "":
+		return loadURI(r.URI)
+	default:
+		return nil, errors.New("exactly one of file and uri must be set")
+	}
+}
@@ -4,7 +4,6 @@ import (
 	"net/http"
 	"time"
 
-	"github.com/cloudflare/cfssl/log"
 	"github.com/prometheus/client_golang/prometheus"
 	"github.com/prometheus/client_golang/prometheus/promauto"
 	"github.com/prometheus/client_golang/prometheus/promhttp"
@@ -31,50 +30,275 @@ var (
 		Name: "keyless_requests",
 		Help: "Total number of requests by opcode.",
 	}, []string{"opcode"})
+	requestsDeduplicated = promauto.NewCounterVec(prometheus.CounterOpts{
+		Name: "keyless_requests_deduplicated",
+		Help: "Number of requests answered with the result of an identical in-flight request, by opcode.",
+	}, []string{"opcode"})
+	tenantRequests = promauto.NewCounterVec(prometheus.CounterOpts{
+		Name: "keyless_tenant_requests",
+		Help: "Number of requests from the clients of a tenant, by tenant and opcode.",
+	}, []string{"tenant", "opcode"})
+	clientRequests = promauto.NewCounterVec(prometheus.CounterOpts{
+		Name: "keyless_client_requests",
+		Help: "Number of requests from a client, by client and opcode.",
+	}, []string{"client", "opcode"})
+	clientBytes = promauto.NewCounterVec(prometheus.CounterOpts{
+		Name: "keyless_client_bytes",
+		Help: "Number of bytes read from or written to a client, by client and direction: read or written.",
+	}, []string{"client", "direction"})
+	clientErrors = promauto.NewCounterVec(prometheus.CounterOpts{
+		Name: "keyless_client_errors",
+		Help: "Number of error responses to a client, by client and error.",
+	}, []string{"client", "error"})
+	keyLimitRejected = promauto.NewCounter(prometheus.CounterOpts{
+		Name: "keyless_key_limit_rejected",
+		Help: "Number of requests which failed waiting for a key's concurrency limit.",
+	})
+	limitRejected = promauto.NewCounterVec(prometheus.CounterOpts{
+		Name: "keyless_limit_rejected",
+		Help: "Number of connections and requests rejected for exceeding a server limit, by limit.",
+	}, []string{"limit"})
+	ipFilterRejected = promauto.NewCounterVec(prometheus.CounterOpts{
+		Name: "keyless_ip_filter_rejected",
+		Help: "Number of connections rejected by the IP allow or deny list, by list.",
+	}, []string{"list"})
+	replaysRejected = promauto.NewCounterVec(prometheus.CounterOpts{
+		Name: "keyless_replays_rejected",
+		Help: "Number of requests rejected as replays of recent requests, by opcode.",
+	}, []string{"opcode"})
+	paddingRejected = promauto.NewCounterVec(prometheus.CounterOpts{
+		Name: "keyless_padding_rejected",
+		Help: "Number of requests rejected for invalid padding, by opcode.",
+	}, []string{"opcode"})
+	revocationChecks = promauto.NewCounterVec(prometheus.CounterOpts{
+		Name: "keyless_revocation_checks",
+		Help: "Number of client certificate chains checked for revocation, by result: good, revoked, unknown (rejected) or soft_fail (accepted).",
+	}, []string{"result"})
 	keyLoadDuration = promauto.NewHistogram(prometheus.HistogramOpts{
 		Name:    "keyless_key_load_duration",
 		Help:    "Time to load a requested key.",
 		Buckets: durationBuckets,
 	})
+	rsaProcWait = promauto.NewHistogram(prometheus.HistogramOpts{
+		Name:    "keyless_rsa_proc_wait",
+		Help:    "Time RSA operations waited to start, when their concurrency is bounded.",
+		Buckets: durationBuckets,
+	})
+	signatureVerifyFailures = promauto.NewCounterVec(prometheus.CounterOpts{
+		Name: "keyless_signature_verify_failures",
+		Help: "Number of signatures which failed their verification before being returned, by backend.",
+	}, []string{"backend"})
+	keysExpiring = promauto.NewGaugeVec(prometheus.GaugeOpts{
+		Name: "keyless_keys_expiring",
+		Help: "Number of keys held whose certificates have all expired or expire within the expiry window, by state.",
+	}, []string{"state"})
+	connsRetired = promauto.NewCounterVec(prometheus.CounterOpts{
+		Name: "keyless_connections_retired",
+		Help: "Number of connections retired after reaching their maximum age or size, by reason.",
+	}, []string{"reason"})
 	connFailures = promauto.NewCounter(prometheus.CounterOpts{
 		Name: "keyless_failed_connection",
 		Help: "Number of connection/transport failure, in tls handshake and etc.",
 	})
+	keepaliveTimeouts = promauto.NewCounter(prometheus.CounterOpts{
+		Name: "keyless_keepalive_timeouts",
+		Help: "Number of connections closed for not answering a keepalive ping.",
+	})
+	workerPanics = promauto.NewCounterVec(prometheus.CounterOpts{
+		Name: "keyless_worker_panics",
+		Help: "Number of requests whose execution panicked, by opcode.",
+	}, []string{"opcode"})
+	sloBreaches = promauto.NewCounterVec(prometheus.CounterOpts{
+		Name: "keyless_slo_breaches",
+		Help: "Number of times the latency SLO of an opcode started being breached, by opcode.",
+	}, []string{"opcode"})
+	sloLatency = promauto.NewGaugeVec(prometheus.GaugeOpts{
+		Name: "keyless_slo_latency_seconds",
+		Help: "Latency percentile of the recent requests with an opcode which has a latency SLO, by opcode.",
+	}, []string{"opcode"})
+	shadowResults = promauto.NewCounterVec(prometheus.CounterOpts{
+		Name: "keyless_shadow_results",
+		Help: "Number of requests mirrored to the shadow keystore, by opcode and result: match, mismatch or dropped.",
+	}, []string{"opcode", "result"})
+	shadowDuration = promauto.NewHistogramVec(prometheus.HistogramOpts{
+		Name:    "keyless_shadow_duration",
+		Help:    "Time to execute the requests mirrored to the shadow keystore, by backend: primary or shadow.",
+		Buckets: durationBuckets,
+	}, []string{"backend"})
+	faultsInjected = promauto.NewCounterVec(prometheus.CounterOpts{
+		Name: "keyless_faults_injected",
+		Help: "Number of faults injected into responses, by opcode and fault: latency, error, truncate or reset.",
+	}, []string{"opcode", "fault"})
 	serverUtilization = promauto.NewGaugeVec(prometheus.GaugeOpts{
 		Name: "server_utilization",
 		Help: "The [0,1]-percentage utilization of the server's worker threads.",
 	}, []string{"type"})
 )
 
-func logRequest(opcode protocol.Op) {
-	requests.WithLabelValues(opcode.String()).Inc()
+// promMetrics are the Prometheus metrics updated by PrometheusSink, by name.
+var promMetrics = map[string]interface{}{
+	"keyless_request_exec_duration_per_opcode":  requestExecDuration,
+	"keyless_request_total_duration_per_opcode": requestTotalDuration,
+	"keyless_requests":                          requests,
+	"keyless_requests_deduplicated":             requestsDeduplicated,
+	"keyless_tenant_requests":                   tenantRequests,
+	"keyless_client_requests":                   clientRequests,
+	"keyless_client_bytes":                      clientBytes,
+	"keyless_client_errors":                     clientErrors,
+	"keyless_key_limit_rejected":                keyLimitRejected,
+	"keyless_limit_rejected":                    limitRejected,
+	"keyless_ip_filter_rejected":                ipFilterRejected,
+	"keyless_replays_rejected":                  replaysRejected,
+	"keyless_padding_rejected":                  paddingRejected,
+	"keyless_revocation_checks":                 revocationChecks,
+	"keyless_key_load_duration":                 keyLoadDuration,
+	"keyless_rsa_proc_wait":                     rsaProcWait,
+	"keyless_signature_verify_failures":         signatureVerifyFailures,
+	"keyless_keys_expiring":                     keysExpiring,
+	"keyless_connections_retired":               connsRetired,
+	"keyless_failed_connection":                 connFailures,
+	"keyless_keepalive_timeouts":                keepaliveTimeouts,
+	"keyless_worker_panics":                     workerPanics,
+	"keyless_slo_breaches":                      sloBreaches,
+	"keyless_slo_latency_seconds":               sloLatency,
+	"keyless_shadow_results":                    shadowResults,
+	"keyless_shadow_duration":                   shadowDuration,
+	"keyless_faults_injected":                   faultsInjected,
+	"server_utilization":                        serverUtilization,
+}
+
+func (m *serverMetrics) logRequest(opcode protocol.Op) {
+	m.emitCount("keyless_requests", 1, Labels{"opcode": opcode.String()})
+}
+
+func (m *serverMetrics) logRequestDeduplicated(opcode protocol.Op) {
+	m.emitCount("keyless_requests_deduplicated", 1, Labels{"opcode": opcode.String()})
+}
+
+func (m *serverMetrics) logTenantRequest(tenant string, opcode protocol.Op) {
+	m.emitCount("keyless_tenant_requests", 1, Labels{"tenant": tenant, "opcode": opcode.String()})
+}
+
+func (m *serverMetrics) logClientRequest(client string, opcode protocol.Op) {
+	m.emitCount("keyless_client_requests", 1, Labels{"client": client, "opcode": opcode.String()})
+}
+
+func (m *serverMetrics) logClientBytes(client string, n int64, written bool) {
+	direction := "read"
+	if written {
+		direction = "written"
+	}
+	m.emitCount("keyless_client_bytes", float64(n), Labels{"client": client, "direction": direction})
+}
+
+func (m *serverMetrics) logClientError(client string, err protocol.Error) {
+	m.emitCount("keyless_client_errors", 1, Labels{"client": client, "error": err.String()})
+}
+
+func (m *serverMetrics) logKeyLimitRejected() {
+	m.emitCount("keyless_key_limit_rejected", 1, nil)
+}
+
+func (m *serverMetrics) logLimitRejected(limit string) {
+	m.emitCount("keyless_limit_rejected", 1, Labels{"limit": limit})
+}
+
+func (m *serverMetrics) logIPFilterRejected(list string) {
+	m.emitCount("keyless_ip_filter_rejected", 1, Labels{"list": list})
+}
+
+func (m *serverMetrics) logReplayRejected(opcode protocol.Op) {
+	m.emitCount("keyless_replays_rejected", 1, Labels{"opcode": opcode.String()})
+}
+
+func (m *serverMetrics) logPaddingRejected(opcode protocol.Op) {
+	m.emitCount("keyless_padding_rejected", 1, Labels{"opcode": opcode.String()})
+}
+
+func (m *serverMetrics) logRevocationCheck(result string) {
+	m.emitCount("keyless_revocation_checks", 1, Labels{"result": result})
+}
+
+func (m *serverMetrics) logConnFailure() {
+	m.emitCount("keyless_failed_connection", 1, nil)
+}
+
+func (m *serverMetrics) logKeepaliveTimeout() {
+	m.emitCount("keyless_keepalive_timeouts", 1, nil)
+}
+
+func (m *serverMetrics) logWorkerPanic(opcode protocol.Op) {
+	m.emitCount("keyless_worker_panics", 1, Labels{"opcode": opcode.String()})
+}
+
+func (m *serverMetrics) logSLOStatus(status SLOStatus, changed bool) {
+	labels := Labels{"opcode": status.SLO.Op.String()}
+	m.emitGauge("keyless_slo_latency_seconds", status.Latency.Seconds(), labels)
+	if changed && status.Breached {
+		m.emitCount("keyless_slo_breaches", 1, labels)
+	}
+}
+
+func (m *serverMetrics) logFaultInjected(opcode protocol.Op, fault string) {
+	m.emitCount("keyless_faults_injected", 1, Labels{"opcode": opcode.String(), "fault": fault})
+}
+
+func (m *serverMetrics) logShadowResult(opcode protocol.Op, result string) {
+	m.emitCount("keyless_shadow_results", 1, Labels{"opcode": opcode.String(), "result": result})
+}
+
+func (m *serverMetrics) logShadowDuration(backend string, d time.Duration) {
+	m.emitTiming("keyless_shadow_duration", d, Labels{"backend": backend})
+}
+
+func (m *serverMetrics) logUtilization(pool string, utilization float64) {
+	m.emitGauge("server_utilization", utilization, Labels{"type": pool})
+}
+
+func (m *serverMetrics) logKeyLoadDuration(loadBegin time.Time) {
+	m.emitTiming("keyless_key_load_duration", time.Since(loadBegin), nil)
+}
+
+func (m *serverMetrics) logRSAProcWait(waitBegin time.Time) {
+	m.emitTiming("keyless_rsa_proc_wait", time.Since(waitBegin), nil)
+}
+
+func (m *serverMetrics) logSignatureVerifyFailure(backend string) {
+	m.emitCount("keyless_signature_verify_failures", 1, Labels{"backend": backend})
 }
 
-func logConnFailure() {
-	connFailures.Inc()
+func (m *serverMetrics) logConnRetired(reason string) {
+	m.emitCount("keyless_connections_retired", 1, Labels{"reason": reason})
 }
 
-func logKeyLoadDuration(loadBegin time.Time) {
-	keyLoadDuration.Observe(time.Since(loadBegin).Seconds())
+func (m *serverMetrics) logKeysExpiring(expired, expiring int) {
+	m.emitGauge("keyless_keys_expiring", float64(expired), Labels{"state": "expired"})
+	m.emitGauge("keyless_keys_expiring", float64(expiring), Labels{"state": "expiring"})
 }
 
 // logRequestExecDuration logs the time taken to execute an operation (not
 // including queueing).
-func logRequestExecDuration(opcode protocol.Op, requestBegin time.Time, err protocol.Error) {
-	requestExecDuration.WithLabelValues(opcode.Type(), err.String()).Observe(time.Since(requestBegin).Seconds())
+func (m *serverMetrics) logRequestExecDuration(opcode protocol.Op, requestBegin time.Time, err protocol.Error) {
+	m.emitTiming("keyless_request_exec_duration_per_opcode", time.Since(requestBegin), Labels{"type": opcode.Type(), "error": err.String()})
 }
 
-func logRequestTotalDuration(opcode protocol.Op, requestBegin time.Time, err protocol.Error) {
-	requestTotalDuration.WithLabelValues(opcode.Type(), err.String()).Observe(time.Since(requestBegin).Seconds())
+func (m *serverMetrics) logRequestTotalDuration(opcode protocol.Op, requestBegin time.Time, err protocol.Error) {
+	m.emitTiming("keyless_request_total_duration_per_opcode", time.Since(requestBegin), Labels{"type": opcode.Type(), "error": err.String()})
 }
 
-// MetricsListenAndServe serves Prometheus metrics at metricsAddr
+// MetricsListenAndServe serves Prometheus metrics at metricsAddr, along with
+// the server's readiness at /readyz and its liveness at /healthz.
 func (s *Server) MetricsListenAndServe(metricsAddr string) error {
 	if metricsAddr != "" {
-		http.Handle("/metrics", promhttp.Handler())
+		mux := http.NewServeMux()
+		mux.Handle("/metrics", promhttp.Handler())
+		mux.Handle("/readyz", s.ReadinessHandler())
+		mux.HandleFunc("/healthz", func(w http.ResponseWriter, r *http.Request) {
+			w.Write([]byte("ok\n"))
+		})
 
-		log.Infof("Serving metrics endpoint at %s/metrics\n", metricsAddr)
-		return http.ListenAndServe(metricsAddr, nil)
+		s.log.Infof("Serving metrics endpoint at %s/metrics\n", metricsAddr)
+		return http.ListenAndServe(metricsAddr, mux)
 	}
 	return nil
 }
@@ -0,0 +1,108 @@
+package server
+
+import (
+	"sync/atomic"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+// Labels are the names and values of the dimensions of a metric, e.g. the
+// opcode of a request.
+type Labels map[string]string
+
+// A MetricsSink receives the metrics of the server's dispatch path, so that
+// they can be sent to an existing telemetry stack. Metrics are named like the
+// Prometheus metrics served by MetricsListenAndServe, e.g. keyless_requests,
+// and labeled like them. Methods are called on the path of requests, so they
+// must not block.
+type MetricsSink interface {
+	// Count adds delta to a counter.
+	Count(name string, delta float64, labels Labels)
+	// Gauge sets a gauge to value.
+	Gauge(name string, value float64, labels Labels)
+	// Timing records a duration, e.g. the latency of a request.
+	Timing(name string, d time.Duration, labels Labels)
+}
+
+// PrometheusSink is the MetricsSink which updates the Prometheus metrics
+// served by MetricsListenAndServe. It is the only sink until
+// SetMetricsSinks is called. Metrics it doesn't know about are ignored.
+var PrometheusSink MetricsSink = prometheusSink{}
+
+var metricsSinks atomic.Value // []MetricsSink
+
+func init() {
+	metricsSinks.Store([]MetricsSink{PrometheusSink})
+}
+
+// SetMetricsSinks sets the sinks which receive the metrics of every server in
+// the process without sinks of its own, in place of PrometheusSink. Include PrometheusSink to keep
+// serving Prometheus metrics alongside the others. It is safe to call while
+// servers are running.
+func SetMetricsSinks(sinks ...MetricsSink) {
+	metricsSinks.Store(append([]MetricsSink(nil), sinks...))
+}
+
+// serverMetrics sends the metrics of a Server to the sinks set with
+// WithMetricsSinks, or to those set with SetMetricsSinks if it has none.
+type serverMetrics struct {
+	sinks []MetricsSink
+}
+
+func (m *serverMetrics) get() []MetricsSink {
+	if m.sinks != nil {
+		return m.sinks
+	}
+	return metricsSinks.Load().([]MetricsSink)
+}
+
+func (m *serverMetrics) emitCount(name string, delta float64, labels Labels) {
+	for _, sink := range m.get() {
+		sink.Count(name, delta, labels)
+	}
+}
+
+func (m *serverMetrics) emitGauge(name string, value float64, labels Labels) {
+	for _, sink := range m.get() {
+		sink.Gauge(name, value, labels)
+	}
+}
+
+func (m *serverMetrics) emitTiming(name string, d time.Duration, labels Labels) {
+	for _, sink := range m.get() {
+		sink.Timing(name, d, labels)
+	}
+}
+
+type prometheusSink struct{}
+
+func (prometheusSink) Count(name string, delta float64, labels Labels) {
+	switch m := promMetrics[name].(type) {
+	case *prometheus.CounterVec:
+		if c, err := m.GetMetricWith(prometheus.Labels(labels)); err == nil {
+			c.Add(delta)
+		}
+	case prometheus.Counter:
+		m.Add(delta)
+	}
+}
+
+func (prometheusSink) Gauge(name string, value float64, labels Labels) {
+	if m, ok := promMetrics[name].(*prometheus.GaugeVec); ok {
+		if g, err := m.GetMetricWith(prometheus.Labels(labels)); err == nil {
+			g.Set(value)
+		}
+	}
+}
+
+func (prometheusSink) Timing(name string, d time.Duration, labels Labels) {
+	switch m := promMetrics[name].(type) {
+	case *prometheus.HistogramVec:
+		if h, err := m.GetMetricWith(prometheus.Labels(labels)); err == nil {
+			h.Observe(d.Seconds())
+		}
+	case prometheus.Histogram:
+		m.Observe(d.Seconds())
+	}
+}
@@ -0,0 +1,75 @@
+package server
+
+import (
+	"context"
+	"time"
+
+	"github.com/cloudflare/gokeyless/protocol"
+)
+
+// A Handler executes keyless operations. Handle returns the operation to
+// answer op with, which must be an OpResponse, OpPong or OpError operation,
+// e.g. made with protocol.MakeRespondOp or protocol.MakeErrorOp. The identity
+// of the client, if known, is in ctx; see ClientIdentityFromContext.
+type Handler interface {
+	Handle(ctx context.Context, op *protocol.Operation) protocol.Operation
+}
+
+// HandlerFunc adapts a function to a Handler.
+type HandlerFunc func(ctx context.Context, op *protocol.Operation) protocol.Operation
+
+// Handle calls f(ctx, op).
+func (f HandlerFunc) Handle(ctx context.Context, op *protocol.Operation) protocol.Operation {
+	return f(ctx, op)
+}
+
+// A Middleware wraps the Handler which executes requests, e.g. to authorize,
+// log or modify them or to enforce quotas. It runs in the worker before the
+// key is looked up, and may answer a request without calling next. Requests
+// in a batch are passed through the middleware both as part of the batch and
+// on their own, and requests deduplicated with WithDedupOps each pass through
+// it before sharing a result.
+type Middleware func(next Handler) Handler
+
+// handle passes req through the middleware of s, and executes it with h if it
+// reaches the end of the chain.
+func (s *Server) handle(ctx context.Context, req request, h func(context.Context, request, time.Time) response) response {
+	requestBegin := time.Now()
+	s.canonicalSKI(&req.pkt.Operation)
+	if s.shadow != nil {
+		h = s.shadow.wrap(h)
+	}
+	// Identical requests are coalesced at the end of the chain, so that each
+	// still passes through the middleware.
+	h = s.dedup(h)
+	mw := s.config.middleware
+	if len(mw) == 0 {
+		return h(ctx, req, requestBegin)
+	}
+
+	// The execution duration is logged by h, unless a middleware answers.
+	handled := false
+	var next Handler = HandlerFunc(func(ctx context.Context, op *protocol.Operation) protocol.Operation {
+		handled = true
+		sub := req
+		sub.pkt = &protocol.Packet{Header: req.pkt.Header, Operation: *op}
+		return h(ctx, sub, time.Now()).op
+	})
+	for i := len(mw) - 1; i >= 0; i-- {
+		next = mw[i](next)
+	}
+
+	op := req.pkt.Operation
+	res := next.Handle(ctx, &op)
+	code := protocol.ErrNone
+	if res.Opcode == protocol.OpError {
+		code = protocol.ErrInternal
+		if err, ok := res.GetError().(protocol.Error); ok {
+			code = err
+		}
+	}
+	if !handled {
+		s.metrics.logRequestExecDuration(req.pkt.Opcode, requestBegin, code)
+	}
+	return response{id: req.pkt.ID, op: res, reqOpcode: req.pkt.Opcode, err: code, reqBegin: req.reqBegin}
+}
@@ -0,0 +1,11 @@
+package server
+
+import "syscall"
+
+// LockMemory locks all the current and future memory of the process into
+// RAM, so that private keys are never written to swap. The Go runtime gives
+// no control over where keys are allocated, so the whole process is locked.
+// This needs the CAP_IPC_LOCK capability or a sufficient RLIMIT_MEMLOCK.
+func LockMemory() error {
+	return syscall.Mlockall(syscall.MCL_CURRENT | syscall.MCL_FUTURE)
+}
@@ -0,0 +1,10 @@
+// +build !linux
+
+package server
+
+import "errors"
+
+// LockMemory is only supported on Linux.
+func LockMemory() error {
+	return errors.New("locking memory is only supported on Linux")
+}
@@ -0,0 +1,43 @@
+package server
+
+import (
+	"crypto/sha256"
+	"net"
+
+	"github.com/cloudflare/gokeyless/noise"
+)
+
+// ServeWithNoise is like Serve, but secures connections with the Noise
+// protocol instead of TLS, for deployments which can't run a CA to issue
+// client certificates. Clients authenticate with one of config.ClientKeys, and
+// the server with config.StaticKey. The keyless protocol is unchanged, but
+// attestations and tokens aren't available to Noise clients.
+func (s *Server) ServeWithNoise(l net.Listener, config *noise.Config) error {
+	if err := s.addListener(l); err != nil {
+		return err
+	}
+
+	for {
+		c, err := s.accept(l)
+		if err != nil {
+			if s.closed() {
+				return nil
+			}
+			s.log.Errorf("Accept error: %v; shutting down server", err)
+			return err
+		}
+		if !s.filterConn(c) {
+			continue
+		}
+		go s.spawn(l, noise.Server(c, config), nil)
+	}
+}
+
+// newNoiseIdentity returns the identity of a Noise client with key, whose
+// CommonName is the base64-encoded key and Fingerprint its SHA-256 digest.
+func newNoiseIdentity(key noise.PublicKey) *ClientIdentity {
+	return &ClientIdentity{
+		CommonName:  key.String(),
+		Fingerprint: sha256.Sum256(key[:]),
+	}
+}
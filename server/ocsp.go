@@ -0,0 +1,126 @@
+package server
+
+import (
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/x509/pkix"
+	"encoding/asn1"
+	"errors"
+	"fmt"
+	"time"
+)
+
+// These mirror the OCSP structures of RFC 6960, section 4.2.1.
+type ocspResponse struct {
+	Status   asn1.Enumerated
+	Response ocspResponseBytes `asn1:"explicit,tag:0,optional"`
+}
+
+type ocspResponseBytes struct {
+	ResponseType asn1.ObjectIdentifier
+	Response     []byte
+}
+
+type ocspBasicResponse struct {
+	TBSResponseData    asn1.RawValue
+	SignatureAlgorithm pkix.AlgorithmIdentifier
+	Signature          asn1.BitString
+	Certificates       []asn1.RawValue `asn1:"explicit,tag:0,optional"`
+}
+
+type ocspResponseData struct {
+	Version        int `asn1:"optional,default:0,explicit,tag:0"`
+	RawResponderID asn1.RawValue
+	ProducedAt     time.Time `asn1:"generalized"`
+	Responses      []asn1.RawValue
+	Extensions     []pkix.Extension `asn1:"explicit,tag:1,optional"`
+}
+
+var oidOCSPBasic = asn1.ObjectIdentifier{1, 3, 6, 1, 5, 5, 7, 48, 1, 1}
+
+// ocspSignatureAlgorithms are the signature algorithms OCSP responses may be
+// signed with, and whether they need an ECDSA rather than an RSA key.
+var ocspSignatureAlgorithms = []struct {
+	oid   asn1.ObjectIdentifier
+	hash  crypto.Hash
+	ecdsa bool
+}{
+	{asn1.ObjectIdentifier{1, 2, 840, 113549, 1, 1, 5}, crypto.SHA1, false},
+	{asn1.ObjectIdentifier{1, 2, 840, 113549, 1, 1, 11}, crypto.SHA256, false},
+	{asn1.ObjectIdentifier{1, 2, 840, 113549, 1, 1, 12}, crypto.SHA384, false},
+	{asn1.ObjectIdentifier{1, 2, 840, 113549, 1, 1, 13}, crypto.SHA512, false},
+	{asn1.ObjectIdentifier{1, 2, 840, 10045, 4, 1}, crypto.SHA1, true},
+	{asn1.ObjectIdentifier{1, 2, 840, 10045, 4, 3, 2}, crypto.SHA256, true},
+	{asn1.ObjectIdentifier{1, 2, 840, 10045, 4, 3, 3}, crypto.SHA384, true},
+	{asn1.ObjectIdentifier{1, 2, 840, 10045, 4, 3, 4}, crypto.SHA512, true},
+}
+
+// An unsignedOCSPResponse is a parsed OCSPResponse to be signed.
+type unsignedOCSPResponse struct {
+	resp  ocspResponse
+	basic ocspBasicResponse
+	hash  crypto.Hash
+	ecdsa bool
+}
+
+// parseOCSPResponse parses the DER-encoded OCSPResponse der. Only well-formed
+// basic responses are accepted, so that a responder key cannot be used to
+// sign anything else.
+func parseOCSPResponse(der []byte) (*unsignedOCSPResponse, error) {
+	var u unsignedOCSPResponse
+	if rest, err := asn1.Unmarshal(der, &u.resp); err != nil {
+		return nil, err
+	} else if len(rest) > 0 {
+		return nil, errors.New("trailing data after OCSP response")
+	}
+	if u.resp.Status != 0 || !u.resp.Response.ResponseType.Equal(oidOCSPBasic) {
+		return nil, errors.New("not a successful basic OCSP response")
+	}
+
+	if rest, err := asn1.Unmarshal(u.resp.Response.Response, &u.basic); err != nil {
+		return nil, err
+	} else if len(rest) > 0 {
+		return nil, errors.New("trailing data after basic OCSP response")
+	}
+	var tbs ocspResponseData
+	if rest, err := asn1.Unmarshal(u.basic.TBSResponseData.FullBytes, &tbs); err != nil {
+		return nil, fmt.Errorf("invalid tbsResponseData: %v", err)
+	} else if len(rest) > 0 || len(tbs.Responses) == 0 {
+		return nil, errors.New("invalid tbsResponseData")
+	}
+
+	for _, alg := range ocspSignatureAlgorithms {
+		if alg.oid.Equal(u.basic.SignatureAlgorithm.Algorithm) {
+			u.hash, u.ecdsa = alg.hash, alg.ecdsa
+			return &u, nil
+		}
+	}
+	return nil, fmt.Errorf("unsupported signature algorithm %v", u.basic.SignatureAlgorithm.Algorithm)
+}
+
+// sign signs u with key, replacing its signature, and returns the encoded
+// OCSPResponse.
+func (u *unsignedOCSPResponse) sign(key crypto.Signer) ([]byte, error) {
+	_, isECDSA := key.Public().(*ecdsa.PublicKey)
+	_, isRSA := key.Public().(*rsa.PublicKey)
+	if (u.ecdsa && !isECDSA) || (!u.ecdsa && !isRSA) {
+		return nil, errors.New("signature algorithm does not match the key")
+	}
+
+	h := u.hash.New()
+	h.Write(u.basic.TBSResponseData.FullBytes)
+	sig, err := key.Sign(rand.Reader, h.Sum(nil), u.hash)
+	if err != nil {
+		return nil, err
+	}
+	basic := u.basic
+	basic.Signature = asn1.BitString{Bytes: sig, BitLength: 8 * len(sig)}
+
+	resp := u.resp
+	if resp.Response.Response, err = asn1.Marshal(basic); err != nil {
+		return nil, err
+	}
+	return asn1.Marshal(resp)
+}
@@ -0,0 +1,312 @@
+package server
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/cloudflare/cfssl/log"
+)
+
+const (
+	otlpContentType = "application/json"
+	// otlpCumulative is the cumulative aggregation temporality.
+	otlpCumulative = 2
+)
+
+// An OTLPSink is a MetricsSink which aggregates metrics in memory and exports
+// them periodically to an OpenTelemetry collector, with the OTLP/HTTP
+// protocol's JSON encoding. Counters are exported as cumulative sums, and
+// timings as cumulative histograms in seconds with the buckets of the
+// Prometheus metrics.
+type OTLPSink struct {
+	endpoint string
+	client   *http.Client
+	start    time.Time
+	done     chan struct{}
+	wg       sync.WaitGroup
+
+	mtx    sync.Mutex
+	series map[otlpKey]*otlpSeries
+}
+
+type otlpKind int
+
+const (
+	otlpSum otlpKind = iota
+	otlpGauge
+	otlpHistogram
+)
+
+// otlpKey identifies the series of a metric with some labels.
+type otlpKey struct {
+	name   string
+	labels string
+}
+
+type otlpSeries struct {
+	kind   otlpKind
+	labels Labels
+	// value is the value of a sum or gauge.
+	value float64
+	// count, sum and buckets aggregate the values of a histogram.
+	count   uint64
+	sum     float64
+	buckets []uint64
+}
+
+// NewOTLPSink returns an OTLPSink which exports metrics every interval to
+// endpoint, the metrics URL of a collector, e.g.
+// "http://localhost:4318/v1/metrics".
+func NewOTLPSink(endpoint string, interval time.Duration) *OTLPSink {
+	s := &OTLPSink{
+		endpoint: endpoint,
+		client:   &http.Client{Timeout: interval},
+		start:    time.Now(),
+		done:     make(chan struct{}),
+		series:   make(map[otlpKey]*otlpSeries),
+	}
+	s.wg.Add(1)
+	go func() {
+		defer s.wg.Done()
+		ticker := time.NewTicker(interval)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-ticker.C:
+				if err := s.Flush(context.Background()); err != nil {
+					log.Warningf("failed to export metrics to %s: %v", endpoint, err)
+				}
+			case <-s.done:
+				return
+			}
+		}
+	}()
+	return s
+}
+
+// Count implements MetricsSink.
+func (s *OTLPSink) Count(name string, delta float64, labels Labels) {
+	s.mtx.Lock()
+	s.get(name, otlpSum, labels).value += delta
+	s.mtx.Unlock()
+}
+
+// Gauge implements MetricsSink.
+func (s *OTLPSink) Gauge(name string, value float64, labels Labels) {
+	s.mtx.Lock()
+	s.get(name, otlpGauge, labels).value = value
+	s.mtx.Unlock()
+}
+
+// Timing implements MetricsSink.
+func (s *OTLPSink) Timing(name string, d time.Duration, labels Labels) {
+	v := d.Seconds()
+	s.mtx.Lock()
+	series := s.get(name, otlpHistogram, labels)
+	series.count++
+	series.sum += v
+	series.buckets[sort.SearchFloat64s(durationBuckets, v)]++
+	s.mtx.Unlock()
+}
+
+// get returns the series of the metric name with labels. s.mtx must be held.
+func (s *OTLPSink) get(name string, kind otlpKind, labels Labels) *otlpSeries {
+	pairs := make([]string, 0, len(labels))
+	for k, v := range labels {
+		pairs = append(pairs, k+"="+v)
+	}
+	sort.Strings(pairs)
+	key := otlpKey{name, strings.Join(pairs, ",")}
+	series, ok := s.series[key]
+	if !ok {
+		series = &otlpSeries{kind: kind, labels: labels}
+		if kind == otlpHistogram {
+			series.buckets = make([]uint64, len(durationBuckets)+1)
+		}
+		s.series[key] = series
+	}
+	return series
+}
+
+// Flush exports the current value of every metric.
+func (s *OTLPSink) Flush(ctx context.Context) error {
+	body, err := json.Marshal(s.export(time.Now()))
+	if err != nil {
+		return err
+	}
+	req, err := http.NewRequest(http.MethodPost, s.endpoint, bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", otlpContentType)
+	resp, err := s.client.Do(req.WithContext(ctx))
+	if err != nil {
+		return err
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("collector responded with %s", resp.Status)
+	}
+	return nil
+}
+
+// Close stops the periodic exports, and exports the metrics one last time.
+func (s *OTLPSink) Close() error {
+	close(s.done)
+	s.wg.Wait()
+	return s.Flush(context.Background())
+}
+
+// The types below are the subset of the JSON encoding of an OTLP
+// ExportMetricsServiceRequest used by OTLPSink. 64-bit integers are encoded
+// as strings.
+
+type otlpRequest struct {
+	ResourceMetrics []otlpResourceMetrics `json:"resourceMetrics"`
+}
+
+type otlpResourceMetrics struct {
+	Resource     otlpResource       `json:"resource"`
+	ScopeMetrics []otlpScopeMetrics `json:"scopeMetrics"`
+}
+
+type otlpResource struct {
+	Attributes []otlpAttribute `json:"attributes"`
+}
+
+type otlpScopeMetrics struct {
+	Scope   otlpScope    `json:"scope"`
+	Metrics []otlpMetric `json:"metrics"`
+}
+
+type otlpScope struct {
+	Name string `json:"name"`
+}
+
+type otlpMetric struct {
+	Name      string             `json:"name"`
+	Unit      string             `json:"unit,omitempty"`
+	Sum       *otlpSumData       `json:"sum,omitempty"`
+	Gauge     *otlpGaugeData     `json:"gauge,omitempty"`
+	Histogram *otlpHistogramData `json:"histogram,omitempty"`
+}
+
+type otlpSumData struct {
+	AggregationTemporality int               `json:"aggregationTemporality"`
+	IsMonotonic            bool              `json:"isMonotonic"`
+	DataPoints             []otlpNumberPoint `json:"dataPoints"`
+}
+
+type otlpGaugeData struct {
+	DataPoints []otlpNumberPoint `json:"dataPoints"`
+}
+
+type otlpHistogramData struct {
+	AggregationTemporality int                  `json:"aggregationTemporality"`
+	DataPoints             []otlpHistogramPoint `json:"dataPoints"`
+}
+
+type otlpNumberPoint struct {
+	Attributes        []otlpAttribute `json:"attributes,omitempty"`
+	StartTimeUnixNano string          `json:"startTimeUnixNano,omitempty"`
+	TimeUnixNano      string          `json:"timeUnixNano"`
+	AsDouble          float64         `json:"asDouble"`
+}
+
+type otlpHistogramPoint struct {
+	Attributes        []otlpAttribute `json:"attributes,omitempty"`
+	StartTimeUnixNano string          `json:"startTimeUnixNano"`
+	TimeUnixNano      string          `json:"timeUnixNano"`
+	Count             string          `json:"count"`
+	Sum               float64         `json:"sum"`
+	BucketCounts      []string        `json:"bucketCounts"`
+	ExplicitBounds    []float64       `json:"explicitBounds"`
+}
+
+type otlpAttribute struct {
+	Key   string    `json:"key"`
+	Value otlpValue `json:"value"`
+}
+
+type otlpValue struct {
+	StringValue string `json:"stringValue"`
+}
+
+func otlpAttributes(labels Labels) []otlpAttribute {
+	attrs := make([]otlpAttribute, 0, len(labels))
+	for k, v := range labels {
+		attrs = append(attrs, otlpAttribute{k, otlpValue{v}})
+	}
+	sort.Slice(attrs, func(i, j int) bool { return attrs[i].Key < attrs[j].Key })
+	return attrs
+}
+
+func otlpTime(t time.Time) string {
+	return strconv.FormatInt(t.UnixNano(), 10)
+}
+
+// export returns the request exporting the current value of every metric.
+func (s *OTLPSink) export(now time.Time) *otlpRequest {
+	start, end := otlpTime(s.start), otlpTime(now)
+	metrics := make(map[string]*otlpMetric)
+	var names []string
+
+	s.mtx.Lock()
+	for key, series := range s.series {
+		m, ok := metrics[key.name]
+		if !ok {
+			m = &otlpMetric{Name: key.name}
+			switch series.kind {
+			case otlpSum:
+				m.Sum = &otlpSumData{AggregationTemporality: otlpCumulative, IsMonotonic: true}
+			case otlpGauge:
+				m.Gauge = &otlpGaugeData{}
+			case otlpHistogram:
+				m.Unit = "s"
+				m.Histogram = &otlpHistogramData{AggregationTemporality: otlpCumulative}
+			}
+			metrics[key.name] = m
+			names = append(names, key.name)
+		}
+		attrs := otlpAttributes(series.labels)
+		switch {
+		case m.Sum != nil:
+			m.Sum.DataPoints = append(m.Sum.DataPoints, otlpNumberPoint{attrs, start, end, series.value})
+		case m.Gauge != nil:
+			m.Gauge.DataPoints = append(m.Gauge.DataPoints, otlpNumberPoint{attrs, "", end, series.value})
+		case m.Histogram != nil:
+			buckets := make([]string, len(series.buckets))
+			for i, n := range series.buckets {
+				buckets[i] = strconv.FormatUint(n, 10)
+			}
+			m.Histogram.DataPoints = append(m.Histogram.DataPoints, otlpHistogramPoint{
+				Attributes:        attrs,
+				StartTimeUnixNano: start,
+				TimeUnixNano:      end,
+				Count:             strconv.FormatUint(series.count, 10),
+				Sum:               series.sum,
+				BucketCounts:      buckets,
+				ExplicitBounds:    durationBuckets,
+			})
+		}
+	}
+	s.mtx.Unlock()
+
+	sort.Strings(names)
+	scope := otlpScopeMetrics{Scope: otlpScope{Name: "github.com/cloudflare/gokeyless/server"}}
+	for _, name := range names {
+		scope.Metrics = append(scope.Metrics, *metrics[name])
+	}
+	return &otlpRequest{ResourceMetrics: []otlpResourceMetrics{{
+		Resource:     otlpResource{Attributes: otlpAttributes(Labels{"service.name": "gokeyless"})},
+		ScopeMetrics: []otlpScopeMetrics{scope},
+	}}}
+}
@@ -0,0 +1,206 @@
+package server
+
+import (
+	"context"
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"fmt"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/cloudflare/gokeyless/protocol"
+	"golang.org/x/crypto/ed25519"
+)
+
+// ReadinessStatus is the readiness of a server, as served by its readiness
+// handler.
+type ReadinessStatus struct {
+	Ready bool `json:"ready"`
+	// Pending maps the readiness checks which haven't passed yet to their
+	// last error, or "not run".
+	Pending map[string]string `json:"pending,omitempty"`
+}
+
+// readiness tracks the readiness checks of a server.
+type readiness struct {
+	mtx sync.Mutex
+	// checks are the checks which haven't passed yet, and errors their last
+	// errors.
+	checks map[string]func(context.Context) error
+	errors map[string]error
+}
+
+// AddReadinessCheck makes s report that it isn't ready until check, e.g. a
+// probe of a key backend, has passed once. Checks are run by WaitReady.
+func (s *Server) AddReadinessCheck(name string, check func(context.Context) error) {
+	s.readiness.mtx.Lock()
+	defer s.readiness.mtx.Unlock()
+	if s.readiness.checks == nil {
+		s.readiness.checks = make(map[string]func(context.Context) error)
+		s.readiness.errors = make(map[string]error)
+	}
+	s.readiness.checks[name] = check
+}
+
+// Ready reports whether every readiness check of s has passed.
+func (s *Server) Ready() bool {
+	s.readiness.mtx.Lock()
+	defer s.readiness.mtx.Unlock()
+	return len(s.readiness.checks) == 0
+}
+
+// Readiness describes the readiness of s.
+func (s *Server) Readiness() ReadinessStatus {
+	s.readiness.mtx.Lock()
+	defer s.readiness.mtx.Unlock()
+	status := ReadinessStatus{Ready: len(s.readiness.checks) == 0}
+	for name := range s.readiness.checks {
+		if status.Pending == nil {
+			status.Pending = make(map[string]string)
+		}
+		status.Pending[name] = "not run"
+		if err := s.readiness.errors[name]; err != nil {
+			status.Pending[name] = err.Error()
+		}
+	}
+	return status
+}
+
+// WaitReady runs the pending readiness checks of s, retrying those which fail
+// every interval, until they have all passed or ctx is done.
+func (s *Server) WaitReady(ctx context.Context, interval time.Duration) error {
+	for {
+		s.readiness.mtx.Lock()
+		checks := make(map[string]func(context.Context) error, len(s.readiness.checks))
+		for name, check := range s.readiness.checks {
+			checks[name] = check
+		}
+		s.readiness.mtx.Unlock()
+
+		for name, check := range checks {
+			err := check(ctx)
+			s.readiness.mtx.Lock()
+			if err == nil {
+				delete(s.readiness.checks, name)
+				delete(s.readiness.errors, name)
+			} else {
+				s.readiness.errors[name] = err
+			}
+			s.readiness.mtx.Unlock()
+			if err != nil {
+				s.log.Warningf("readiness check %s failed: %v", name, err)
+			} else {
+				s.log.Infof("readiness check %s passed", name)
+			}
+		}
+		if s.Ready() {
+			return nil
+		}
+
+		t := time.NewTimer(interval)
+		select {
+		case <-t.C:
+		case <-ctx.Done():
+			t.Stop()
+			return ctx.Err()
+		}
+	}
+}
+
+// ReadinessHandler returns a handler answering 200 OK if s is ready, and 503
+// Service Unavailable if not, with its ReadinessStatus as JSON, for load
+// balancers and orchestrators to probe.
+func (s *Server) ReadinessHandler() http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		status := s.Readiness()
+		if !status.Ready {
+			w.Header().Set("Content-Type", "application/json")
+			w.WriteHeader(http.StatusServiceUnavailable)
+		}
+		s.writeJSON(w, status)
+	})
+}
+
+// A probingKeystore is a Keystore which can check that its backends work.
+type probingKeystore interface {
+	Probe(ctx context.Context) error
+}
+
+// ProbeKeystore checks that the backends of keys work, if it can probe them as
+// DefaultKeystore, KeystoreChain, ShardedKeystore and MetadataKeystore can.
+// It is meant to be used as a readiness check.
+func ProbeKeystore(ctx context.Context, keys Keystore) error {
+	if keys, ok := keys.(probingKeystore); ok {
+		return keys.Probe(ctx)
+	}
+	return nil
+}
+
+// Probe signs with each hardware or cloud key of keys, such as keys in an HSM
+// or a KMS, to check that its backend can be reached. Software keys aren't
+// probed.
+func (keys *DefaultKeystore) Probe(ctx context.Context) error {
+	keys.mtx.RLock()
+	var probed []crypto.Signer
+	for _, priv := range keys.skis {
+		switch priv.(type) {
+		case *rsa.PrivateKey, *ecdsa.PrivateKey, ed25519.PrivateKey, *CryptoKey:
+		default:
+			probed = append(probed, priv)
+		}
+	}
+	keys.mtx.RUnlock()
+
+	for _, priv := range probed {
+		if err := ctx.Err(); err != nil {
+			return err
+		}
+		if err := probeKey(priv); err != nil {
+			ski, _ := protocol.GetSKI(priv.Public())
+			return fmt.Errorf("key %v: %v", ski, err)
+		}
+	}
+	return nil
+}
+
+// probeKey signs a fixed digest with priv.
+func probeKey(priv crypto.Signer) error {
+	digest := sha256.Sum256([]byte("gokeyless readiness probe"))
+	if _, ok := priv.Public().(ed25519.PublicKey); ok {
+		_, err := priv.Sign(rand.Reader, digest[:], crypto.Hash(0))
+		return err
+	}
+	_, err := priv.Sign(rand.Reader, digest[:], crypto.SHA256)
+	return err
+}
+
+// Probe probes every backend of c which can be probed.
+func (c *KeystoreChain) Probe(ctx context.Context) error {
+	for i, backend := range c.backends {
+		if err := ProbeKeystore(ctx, backend.keys); err != nil {
+			return fmt.Errorf("backend %d: %v", i, err)
+		}
+	}
+	return nil
+}
+
+// Probe probes every shard of s which can be probed.
+func (s *ShardedKeystore) Probe(ctx context.Context) error {
+	for _, sh := range s.snapshot() {
+		if err := ProbeKeystore(ctx, sh.keys); err != nil {
+			return fmt.Errorf("shard %s: %v", sh.name, err)
+		}
+	}
+	return nil
+}
+
+// Probe checks that the metadata store can be reached by looking up a key
+// which doesn't exist.
+func (keys *MetadataKeystore) Probe(ctx context.Context) error {
+	_, err := keys.store.Get(ctx, protocol.SKI{})
+	return err
+}
@@ -0,0 +1,76 @@
+package server
+
+import (
+	"sync/atomic"
+
+	"github.com/cloudflare/gokeyless/protocol"
+)
+
+// A removalKeystore is a Keystore which reports the keys it stops serving, so
+// that clients can be told about them.
+type removalKeystore interface {
+	// OnRemove sets the function called with the SKI of each key removed
+	// from the keystore. It may be called with the keystore locked, so it
+	// must not block or use the keystore.
+	OnRemove(f func(ski protocol.SKI))
+}
+
+// NotifyKeyRemoved tells the connected clients which negotiated
+// FeatureKeyRemoved that the key with ski is no longer served, so that they
+// can stop sending its requests to this server. It is called for the keys
+// removed from keystores which report them, such as DefaultKeystore; clients
+// can only negotiate the feature once enabled with
+// ServeConfig.WithKeyRemovedNotices.
+func (s *Server) NotifyKeyRemoved(ski protocol.SKI) {
+	s.mtx.Lock()
+	conns := make([]*conn, 0, len(s.conns))
+	for c := range s.conns {
+		conns = append(conns, c)
+	}
+	s.mtx.Unlock()
+
+	notified := 0
+	for _, c := range conns {
+		if atomic.LoadUint32(&c.keyRemoved) == 1 && c.notifyKeyRemoved(ski) {
+			notified++
+		}
+	}
+	s.log.Debugf("notified %d clients of the removal of key with SKI %v", notified, ski)
+}
+
+// OnRemove sets the function called with the SKI of each key removed with
+// Remove or retired at the end of a rotation. It is called with keys locked.
+func (keys *DefaultKeystore) OnRemove(f func(ski protocol.SKI)) {
+	keys.mtx.Lock()
+	defer keys.mtx.Unlock()
+	keys.onRemove = f
+}
+
+// removed reports that the key with ski was removed. keys.mtx must be held.
+func (keys *DefaultKeystore) removed(ski protocol.SKI) {
+	if keys.onRemove != nil {
+		keys.onRemove(ski)
+	}
+}
+
+// OnRemove sets f on each backend of c which reports the keys it removes.
+func (c *KeystoreChain) OnRemove(f func(ski protocol.SKI)) {
+	for _, backend := range c.backends {
+		if keys, ok := backend.keys.(removalKeystore); ok {
+			keys.OnRemove(f)
+		}
+	}
+}
+
+// OnRemove sets f on each shard of s which reports the keys it removes,
+// including shards added later. Keys moved between shards are not reported.
+func (s *ShardedKeystore) OnRemove(f func(ski protocol.SKI)) {
+	s.mtx.Lock()
+	defer s.mtx.Unlock()
+	s.onRemove = f
+	for _, sh := range s.shards {
+		if keys, ok := sh.keys.(removalKeystore); ok {
+			keys.OnRemove(f)
+		}
+	}
+}
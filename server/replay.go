@@ -0,0 +1,76 @@
+package server
+
+import (
+	"crypto/sha256"
+	"encoding/binary"
+	"net"
+	"sync"
+	"time"
+)
+
+// replayKey identifies a request by its client, packet ID, position in its
+// batch and operation.
+type replayKey [sha256.Size]byte
+
+// replaySeen is a request seen by a replayGuard, and when it expires.
+type replaySeen struct {
+	key     replayKey
+	expires time.Time
+}
+
+// replayGuard remembers the requests seen within a time window, so that exact
+// replays of them can be rejected.
+type replayGuard struct {
+	mtx  sync.Mutex
+	seen map[replayKey]bool
+	// queue holds the keys of seen in the order they expire.
+	queue []replaySeen
+}
+
+func newReplayGuard() *replayGuard {
+	return &replayGuard{seen: make(map[replayKey]bool)}
+}
+
+// newReplayKey returns the key of req, whose client is identified by its
+// certificate or token if it has one, or else by its IP address.
+func newReplayKey(req request) (replayKey, error) {
+	op, err := newDedupKey(req.pkt.Operation)
+	if err != nil {
+		return replayKey{}, err
+	}
+	h := sha256.New()
+	if req.identity != nil {
+		h.Write(req.identity.Fingerprint[:])
+	} else if host, _, err := net.SplitHostPort(req.connName); err == nil {
+		h.Write([]byte(host))
+	} else {
+		h.Write([]byte(req.connName))
+	}
+	// Operations batched together share the packet ID of their batch.
+	var id [8]byte
+	binary.BigEndian.PutUint32(id[:4], req.pkt.ID)
+	binary.BigEndian.PutUint32(id[4:], uint32(req.batchIndex))
+	h.Write(id[:])
+	h.Write(op[:])
+	var key replayKey
+	copy(key[:], h.Sum(nil))
+	return key, nil
+}
+
+// check records key as seen for window, and reports whether it was already
+// seen within the window.
+func (g *replayGuard) check(key replayKey, window time.Duration) bool {
+	now := time.Now()
+	g.mtx.Lock()
+	defer g.mtx.Unlock()
+	for len(g.queue) > 0 && !g.queue[0].expires.After(now) {
+		delete(g.seen, g.queue[0].key)
+		g.queue = g.queue[1:]
+	}
+	if g.seen[key] {
+		return true
+	}
+	g.seen[key] = true
+	g.queue = append(g.queue, replaySeen{key, now.Add(window)})
+	return false
+}
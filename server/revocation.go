@@ -0,0 +1,313 @@
+package server
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/cloudflare/cfssl/log"
+	"golang.org/x/crypto/ocsp"
+)
+
+const (
+	// defaultCRLRefresh is how often CRLs are reloaded by default.
+	defaultCRLRefresh = time.Hour
+	// revocationFetchTimeout bounds the fetch of a CRL or OCSP response.
+	revocationFetchTimeout = 10 * time.Second
+	// maxRevocationResponse bounds the size of a CRL or OCSP response.
+	maxRevocationResponse = 64 << 20
+)
+
+// ErrCertificateRevoked is returned by RevocationChecker.Check for the chains
+// with a revoked certificate.
+var ErrCertificateRevoked = errors.New("certificate revoked")
+
+// RevocationConfig configures the revocation checks of client certificates.
+type RevocationConfig struct {
+	// CRLs are the paths or http(s):// URLs of the CRLs of the client CAs,
+	// in PEM or DER. They are reloaded every RefreshInterval (an hour by
+	// default); a CRL which fails to reload is kept until its next update.
+	CRLs            []string
+	RefreshInterval time.Duration
+	// OCSP enables querying the OCSP responders named by certificates which
+	// no CRL covers. Responses are cached until their next update.
+	OCSP bool
+	// SoftFail accepts the clients whose certificates' status can't be
+	// determined, e.g. because no CRL covers them or their OCSP responder
+	// can't be reached. Otherwise they are rejected like revoked ones.
+	SoftFail bool
+}
+
+// A RevocationChecker checks client certificates against CRLs and OCSP
+// responders.
+type RevocationChecker struct {
+	config RevocationConfig
+	client *http.Client
+	done   chan struct{}
+
+	mtx  sync.RWMutex
+	crls map[string]*loadedCRL
+	// ocsp caches OCSP responses by ocspCacheKey.
+	ocsp map[[sha256.Size]byte]*ocsp.Response
+}
+
+// loadedCRL is a parsed CRL and the serial numbers it revokes.
+type loadedCRL struct {
+	list    *pkix.CertificateList
+	revoked map[string]bool
+	mtx     sync.Mutex
+	// verified caches whether issuers, by fingerprint, signed the CRL.
+	verified map[[sha256.Size]byte]bool
+}
+
+// NewRevocationChecker returns a RevocationChecker with config, once its CRLs
+// have been loaded. It fails if a CRL can't be loaded, unless
+// config.SoftFail is set.
+func NewRevocationChecker(config RevocationConfig) (*RevocationChecker, error) {
+	if config.RefreshInterval <= 0 {
+		config.RefreshInterval = defaultCRLRefresh
+	}
+	c := &RevocationChecker{
+		config: config,
+		client: &http.Client{Timeout: revocationFetchTimeout},
+		done:   make(chan struct{}),
+		crls:   make(map[string]*loadedCRL),
+		ocsp:   make(map[[sha256.Size]byte]*ocsp.Response),
+	}
+	if err := c.refresh(); err != nil && !config.SoftFail {
+		return nil, err
+	}
+	if len(config.CRLs) > 0 {
+		go c.refreshLoop()
+	}
+	return c, nil
+}
+
+// Close stops reloading CRLs.
+func (c *RevocationChecker) Close() {
+	close(c.done)
+}
+
+func (c *RevocationChecker) refreshLoop() {
+	ticker := time.NewTicker(c.config.RefreshInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ticker.C:
+			if err := c.refresh(); err != nil {
+				log.Warningf("failed to reload CRLs: %v", err)
+			}
+		case <-c.done:
+			return
+		}
+	}
+}
+
+// refresh reloads every CRL, keeping the previous version of those which fail
+// to load, and returns the first error.
+func (c *RevocationChecker) refresh() error {
+	var firstErr error
+	for _, src := range c.config.CRLs {
+		crl, err := c.loadCRL(src)
+		if err != nil {
+			if firstErr == nil {
+				firstErr = fmt.Errorf("CRL %s: %v", src, err)
+			}
+			continue
+		}
+		c.mtx.Lock()
+		c.crls[src] = crl
+		c.mtx.Unlock()
+		log.Debugf("loaded CRL %s with %d revoked certificates", src, len(crl.revoked))
+	}
+	return firstErr
+}
+
+func (c *RevocationChecker) loadCRL(src string) (*loadedCRL, error) {
+	var der []byte
+	var err error
+	if strings.HasPrefix(src, "http://") || strings.HasPrefix(src, "https://") {
+		der, err = c.fetch(http.MethodGet, src, "", nil)
+	} else {
+		der, err = ioutil.ReadFile(src)
+	}
+	if err != nil {
+		return nil, err
+	}
+	list, err := x509.ParseCRL(der)
+	if err != nil {
+		return nil, err
+	}
+	crl := &loadedCRL{list: list, revoked: make(map[string]bool), verified: make(map[[sha256.Size]byte]bool)}
+	for _, cert := range list.TBSCertList.RevokedCertificates {
+		crl.revoked[cert.SerialNumber.String()] = true
+	}
+	return crl, nil
+}
+
+// fetch performs an HTTP request for a CRL or OCSP response.
+func (c *RevocationChecker) fetch(method, url, contentType string, body []byte) ([]byte, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), revocationFetchTimeout)
+	defer cancel()
+	req, err := http.NewRequest(method, url, bytes.NewReader(body))
+	if err != nil {
+		return nil, err
+	}
+	if contentType != "" {
+		req.Header.Set("Content-Type", contentType)
+	}
+	resp, err := c.client.Do(req.WithContext(ctx))
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("server responded with %s", resp.Status)
+	}
+	return ioutil.ReadAll(io.LimitReader(resp.Body, maxRevocationResponse))
+}
+
+// Check checks every certificate of a verified chain, leaf first, but its
+// root. It returns an error wrapping ErrCertificateRevoked if one is revoked,
+// or another error if the status of one can't be determined and soft-fail is
+// disabled.
+func (c *RevocationChecker) Check(chain []*x509.Certificate) error {
+	_, err := c.check(chain)
+	return err
+}
+
+// check is like Check, but also returns the result of the check for the
+// keyless_revocation_checks metric.
+func (c *RevocationChecker) check(chain []*x509.Certificate) (string, error) {
+	result := "good"
+	for i := 0; i+1 < len(chain); i++ {
+		cert, issuer := chain[i], chain[i+1]
+		revoked, err := c.status(cert, issuer)
+		switch {
+		case revoked:
+			return "revoked", fmt.Errorf("%w: %s (serial %s)", ErrCertificateRevoked, cert.Subject, cert.SerialNumber)
+		case err != nil && !c.config.SoftFail:
+			return "unknown", fmt.Errorf("revocation status of %s unknown: %v", cert.Subject, err)
+		case err != nil:
+			log.Warningf("accepting %s, whose revocation status is unknown: %v", cert.Subject, err)
+			result = "soft_fail"
+		}
+	}
+	return result, nil
+}
+
+// status reports whether cert, issued by issuer, is revoked, or an error if no
+// CRL or OCSP responder tells.
+func (c *RevocationChecker) status(cert, issuer *x509.Certificate) (bool, error) {
+	if revoked, ok := c.crlStatus(cert, issuer); ok {
+		return revoked, nil
+	}
+	if !c.config.OCSP || len(cert.OCSPServer) == 0 {
+		return false, errors.New("no current CRL or OCSP responder covers the certificate")
+	}
+	resp, err := c.ocspStatus(cert, issuer)
+	if err != nil {
+		return false, err
+	}
+	switch resp.Status {
+	case ocsp.Good:
+		return false, nil
+	case ocsp.Revoked:
+		return true, nil
+	default:
+		return false, errors.New("OCSP responder doesn't know the certificate")
+	}
+}
+
+// crlStatus reports whether cert is revoked, if a current CRL of issuer
+// covers it.
+func (c *RevocationChecker) crlStatus(cert, issuer *x509.Certificate) (revoked, ok bool) {
+	now := time.Now()
+	fingerprint := sha256.Sum256(issuer.Raw)
+	c.mtx.RLock()
+	defer c.mtx.RUnlock()
+	for _, crl := range c.crls {
+		if crl.list.TBSCertList.Issuer.String() != issuer.Subject.ToRDNSequence().String() {
+			continue
+		}
+		if next := crl.list.TBSCertList.NextUpdate; !next.IsZero() && now.After(next) {
+			continue
+		}
+		if !crl.signedBy(issuer, fingerprint) {
+			continue
+		}
+		return crl.revoked[cert.SerialNumber.String()], true
+	}
+	return false, false
+}
+
+// signedBy reports whether issuer signed crl.
+func (crl *loadedCRL) signedBy(issuer *x509.Certificate, fingerprint [sha256.Size]byte) bool {
+	crl.mtx.Lock()
+	defer crl.mtx.Unlock()
+	ok, checked := crl.verified[fingerprint]
+	if !checked {
+		ok = issuer.CheckCRLSignature(crl.list) == nil
+		crl.verified[fingerprint] = ok
+	}
+	return ok
+}
+
+// ocspStatus returns the OCSP response for cert, from the cache if it is
+// still current.
+func (c *RevocationChecker) ocspStatus(cert, issuer *x509.Certificate) (*ocsp.Response, error) {
+	key := sha256.Sum256(append(append([]byte(nil), issuer.Raw...), cert.SerialNumber.Bytes()...))
+	c.mtx.RLock()
+	resp, ok := c.ocsp[key]
+	c.mtx.RUnlock()
+	if ok && time.Now().Before(resp.NextUpdate) {
+		return resp, nil
+	}
+
+	req, err := ocsp.CreateRequest(cert, issuer, nil)
+	if err != nil {
+		return nil, err
+	}
+	var lastErr error
+	for _, url := range cert.OCSPServer {
+		der, err := c.fetch(http.MethodPost, url, "application/ocsp-request", req)
+		if err != nil {
+			lastErr = fmt.Errorf("OCSP responder %s: %v", url, err)
+			continue
+		}
+		resp, err := ocsp.ParseResponseForCert(der, cert, issuer)
+		if err != nil {
+			lastErr = fmt.Errorf("OCSP responder %s: %v", url, err)
+			continue
+		}
+		if !resp.NextUpdate.IsZero() {
+			c.mtx.Lock()
+			c.ocsp[key] = resp
+			c.mtx.Unlock()
+		}
+		return resp, nil
+	}
+	return nil, lastErr
+}
+
+// checkRevocation checks the verified chain of a client certificate with the
+// server's RevocationChecker, if any.
+func (s *Server) checkRevocation(chains [][]*x509.Certificate) error {
+	rc := s.config.revocation
+	if rc == nil || len(chains) == 0 {
+		return nil
+	}
+	result, err := rc.check(chains[0])
+	s.metrics.logRevocationCheck(result)
+	return err
+}
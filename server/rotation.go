@@ -0,0 +1,187 @@
+package server
+
+import (
+	"crypto"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"time"
+
+	"github.com/cloudflare/cfssl/log"
+	"github.com/cloudflare/gokeyless/protocol"
+)
+
+// States of a key rotation.
+const (
+	// RotationStaged means that the new key is loaded, but not yet served.
+	RotationStaged = "staged"
+	// RotationSwitched means that both keys are served until the grace period
+	// ends.
+	RotationSwitched = "switched"
+	// RotationComplete means that only the new key is served.
+	RotationComplete = "complete"
+)
+
+// KeyRotation describes the replacement of a key with a new one, e.g. when the
+// certificate it belongs to is reissued.
+type KeyRotation struct {
+	OldSKI string `json:"old_ski"`
+	NewSKI string `json:"new_ski"`
+	// State is RotationStaged, RotationSwitched or RotationComplete.
+	State    string    `json:"state"`
+	StagedAt time.Time `json:"staged_at"`
+	// SwitchedAt and GraceEnds are zero until the rotation is switched.
+	SwitchedAt time.Time `json:"switched_at"`
+	GraceEnds  time.Time `json:"grace_ends"`
+}
+
+// rotation is the state of a KeyRotation in a DefaultKeystore.
+type rotation struct {
+	KeyRotation
+	newSKI protocol.SKI
+	// staged is the new key until the rotation is switched.
+	staged crypto.Signer
+	timer  *time.Timer
+}
+
+// A rotatingKeystore is a Keystore whose keys can be rotated through the
+// admin API.
+type rotatingKeystore interface {
+	StageKey(old protocol.SKI, priv crypto.Signer) (protocol.SKI, error)
+	SwitchKey(old protocol.SKI, grace time.Duration) error
+	AbortRotation(old protocol.SKI) error
+	Rotations() []KeyRotation
+}
+
+// StageKey loads priv to replace the key with SKI old, and returns priv's SKI.
+// priv is not served until SwitchKey is called, so that it can be staged
+// before the certificate it belongs to is deployed.
+func (keys *DefaultKeystore) StageKey(old protocol.SKI, priv crypto.Signer) (protocol.SKI, error) {
+	ski, err := protocol.GetSKI(priv.Public())
+	if err != nil {
+		return ski, err
+	}
+
+	keys.mtx.Lock()
+	defer keys.mtx.Unlock()
+
+	if _, ok := keys.skis[old]; !ok {
+		return ski, fmt.Errorf("no key with SKI %v", old)
+	}
+	if _, ok := keys.skis[ski]; ok {
+		return ski, fmt.Errorf("key with SKI %v is already served", ski)
+	}
+	if r, ok := keys.rotations[old]; ok && r.State != RotationComplete {
+		return ski, fmt.Errorf("key with SKI %v is already being rotated", old)
+	}
+	if keys.rotations == nil {
+		keys.rotations = make(map[protocol.SKI]*rotation)
+	}
+	keys.rotations[old] = &rotation{
+		KeyRotation: KeyRotation{
+			OldSKI:   old.String(),
+			NewSKI:   ski.String(),
+			State:    RotationStaged,
+			StagedAt: time.Now(),
+		},
+		newSKI: ski,
+		staged: keys.protect(priv),
+	}
+	log.Infof("staged key with SKI %v to replace %v", ski, old)
+	return ski, nil
+}
+
+// SwitchKey atomically starts serving the key staged to replace the key with
+// SKI old, which takes over old's usage restrictions unless it has its own.
+// The old key is still served until grace has passed, for clients which don't
+// have the new certificate yet.
+func (keys *DefaultKeystore) SwitchKey(old protocol.SKI, grace time.Duration) error {
+	keys.mtx.Lock()
+	defer keys.mtx.Unlock()
+
+	r, ok := keys.rotations[old]
+	if !ok || r.State != RotationStaged {
+		return fmt.Errorf("no key is staged to replace %v", old)
+	}
+	keys.skis[r.newSKI] = r.staged
+	keys.alias(r.newSKI, r.staged.Public())
+	if usage, ok := keys.usage[old]; ok {
+		if _, ok := keys.usage[r.newSKI]; !ok {
+			keys.usage[r.newSKI] = usage
+		}
+	}
+	now := time.Now()
+	r.staged = nil
+	r.State = RotationSwitched
+	r.SwitchedAt = now
+	r.GraceEnds = now.Add(grace)
+	log.Infof("switched from key with SKI %v to %v", old, r.newSKI)
+
+	if grace <= 0 {
+		keys.retire(old, r)
+		return nil
+	}
+	r.timer = time.AfterFunc(grace, func() {
+		keys.mtx.Lock()
+		defer keys.mtx.Unlock()
+		keys.retire(old, r)
+	})
+	return nil
+}
+
+// retire stops serving the key with SKI old at the end of r. keys.mtx must be
+// held.
+func (keys *DefaultKeystore) retire(old protocol.SKI, r *rotation) {
+	if keys.rotations[old] != r || r.State != RotationSwitched {
+		return
+	}
+	keys.removed(old)
+	keys.unalias(old)
+	destroyKey(keys.skis[old])
+	delete(keys.skis, old)
+	delete(keys.usage, old)
+	r.State = RotationComplete
+	log.Infof("retired key with SKI %v", old)
+}
+
+// AbortRotation discards the key staged to replace the key with SKI old. A
+// rotation can't be aborted once it has been switched.
+func (keys *DefaultKeystore) AbortRotation(old protocol.SKI) error {
+	keys.mtx.Lock()
+	defer keys.mtx.Unlock()
+
+	r, ok := keys.rotations[old]
+	if !ok || r.State != RotationStaged {
+		return fmt.Errorf("no key is staged to replace %v", old)
+	}
+	delete(keys.rotations, old)
+	destroyKey(r.staged)
+	log.Infof("aborted rotation of key with SKI %v", old)
+	return nil
+}
+
+// Rotations returns the keystore's key rotations, including completed ones.
+func (keys *DefaultKeystore) Rotations() []KeyRotation {
+	keys.mtx.RLock()
+	defer keys.mtx.RUnlock()
+
+	rotations := make([]KeyRotation, 0, len(keys.rotations))
+	for _, r := range keys.rotations {
+		rotations = append(rotations, r.KeyRotation)
+	}
+	return rotations
+}
+
+// parseSKI parses a hex encoded SKI.
+func parseSKI(s string) (protocol.SKI, error) {
+	var ski protocol.SKI
+	b, err := hex.DecodeString(s)
+	if err != nil {
+		return ski, err
+	}
+	if len(b) != len(ski) {
+		return ski, errors.New("wrong SKI length")
+	}
+	copy(ski[:], b)
+	return ski, nil
+}
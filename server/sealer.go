@@ -0,0 +1,118 @@
+package server
+
+import (
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"sync"
+
+	"github.com/cloudflare/gokeyless/protocol"
+)
+
+const (
+	// sealFormat is the first byte of blobs sealed by an AEADSealer.
+	sealFormat = 1
+	// sealHeaderLen is the length of the header of sealed blobs: the format
+	// and the big-endian version of the key the blob was sealed with.
+	sealHeaderLen = 1 + 4
+)
+
+// AEADSealer is a Sealer which encrypts blobs such as session cookies or
+// bootstrap secrets with AES-256-GCM, under a set of versioned keys held by
+// the server. Blobs are sealed with the key with the highest version, which is
+// recorded in the sealed blob so that blobs sealed with older keys can still
+// be unsealed until those keys are removed.
+type AEADSealer struct {
+	mtx     sync.RWMutex
+	keys    map[uint32]cipher.AEAD
+	current uint32
+}
+
+// NewAEADSealer returns an AEADSealer using keys, which maps key versions to
+// 32-byte keys.
+func NewAEADSealer(keys map[uint32][]byte) (*AEADSealer, error) {
+	s := &AEADSealer{}
+	if err := s.SetKeys(keys); err != nil {
+		return nil, err
+	}
+	return s, nil
+}
+
+// SetKeys replaces the sealer's keys, e.g. to rotate to a key with a higher
+// version. Blobs sealed with keys which are no longer present fail to unseal
+// with protocol.ErrExpired.
+func (s *AEADSealer) SetKeys(keys map[uint32][]byte) error {
+	if len(keys) == 0 {
+		return errors.New("at least one sealing key is required")
+	}
+	aeads := make(map[uint32]cipher.AEAD, len(keys))
+	var current uint32
+	for version, key := range keys {
+		if len(key) != 32 {
+			return fmt.Errorf("sealing key %d must be 32 bytes", version)
+		}
+		block, err := aes.NewCipher(key)
+		if err != nil {
+			return err
+		}
+		aead, err := cipher.NewGCM(block)
+		if err != nil {
+			return err
+		}
+		aeads[version] = aead
+		if version >= current {
+			current = version
+		}
+	}
+
+	s.mtx.Lock()
+	s.keys, s.current = aeads, current
+	s.mtx.Unlock()
+	return nil
+}
+
+// Seal implements Sealer. The sealed blob is the header, a random nonce, and
+// the ciphertext authenticated together with the header.
+func (s *AEADSealer) Seal(op *protocol.Operation) ([]byte, error) {
+	s.mtx.RLock()
+	version, aead := s.current, s.keys[s.current]
+	s.mtx.RUnlock()
+
+	out := make([]byte, sealHeaderLen+aead.NonceSize(), sealHeaderLen+aead.NonceSize()+len(op.Payload)+aead.Overhead())
+	out[0] = sealFormat
+	binary.BigEndian.PutUint32(out[1:sealHeaderLen], version)
+	nonce := out[sealHeaderLen:]
+	if _, err := rand.Read(nonce); err != nil {
+		return nil, err
+	}
+	return aead.Seal(out, nonce, op.Payload, out[:sealHeaderLen]), nil
+}
+
+// Unseal implements Sealer.
+func (s *AEADSealer) Unseal(op *protocol.Operation) ([]byte, error) {
+	in := op.Payload
+	if len(in) < sealHeaderLen || in[0] != sealFormat {
+		return nil, protocol.ErrFormat
+	}
+	version := binary.BigEndian.Uint32(in[1:sealHeaderLen])
+
+	s.mtx.RLock()
+	aead, ok := s.keys[version]
+	s.mtx.RUnlock()
+	if !ok {
+		return nil, protocol.ErrExpired
+	}
+
+	if len(in) < sealHeaderLen+aead.NonceSize() {
+		return nil, protocol.ErrFormat
+	}
+	nonce := in[sealHeaderLen : sealHeaderLen+aead.NonceSize()]
+	out, err := aead.Open(nil, nonce, in[sealHeaderLen+aead.NonceSize():], in[:sealHeaderLen])
+	if err != nil {
+		return nil, protocol.ErrCrypto
+	}
+	return out, nil
+}
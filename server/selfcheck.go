@@ -0,0 +1,108 @@
+package server
+
+import (
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/ed25519"
+	"crypto/rsa"
+	"errors"
+	"reflect"
+	"strings"
+
+	"github.com/cloudflare/gokeyless/internal/azure"
+	"github.com/cloudflare/gokeyless/internal/google"
+	"github.com/cloudflare/gokeyless/internal/tpm"
+	"github.com/cloudflare/gokeyless/protocol"
+	"github.com/cloudflare/gokeyless/sm2"
+)
+
+// The backends keys are held by, whose signatures may be left unverified with
+// WithSignatureVerification.
+const (
+	// BackendSoftware holds the keys loaded from files, the admin API and
+	// OpLoadKey.
+	BackendSoftware = "software"
+	BackendPKCS11   = "pkcs11"
+	BackendAzure    = "azure"
+	BackendGoogle   = "google"
+	BackendTPM      = "tpm"
+	// BackendOther holds the signers of any other kind, such as those added
+	// to a keystore by embedders.
+	BackendOther = "other"
+)
+
+// errSignatureMismatch is returned when a signature doesn't verify under the
+// public key of the key which made it.
+var errSignatureMismatch = errors.New("signature failed verification")
+
+// keyBackend returns the backend of priv.
+func keyBackend(priv crypto.Signer) string {
+	switch priv.(type) {
+	case *CryptoKey, *rsa.PrivateKey, *ecdsa.PrivateKey, ed25519.PrivateKey, *sm2.PrivateKey:
+		return BackendSoftware
+	case azure.KeyVaultSigner, *azure.KeyVaultSigner:
+		return BackendAzure
+	case google.KMSSigner, *google.KMSSigner:
+		return BackendGoogle
+	case *tpm.Signer:
+		return BackendTPM
+	}
+	// PKCS#11 signers are only available with the pkcs11 build tag.
+	t := reflect.TypeOf(priv)
+	if t.Kind() == reflect.Ptr {
+		t = t.Elem()
+	}
+	if strings.HasSuffix(t.PkgPath(), "/crypto11") {
+		return BackendPKCS11
+	}
+	return BackendOther
+}
+
+// checkSignature verifies sig, made with opts over digest, or over the message
+// itself for Ed25519, under pub.
+func checkSignature(pub crypto.PublicKey, digest, sig []byte, opts crypto.SignerOpts) error {
+	var ok bool
+	switch pub := pub.(type) {
+	case *rsa.PublicKey:
+		var err error
+		if pss, isPSS := opts.(*rsa.PSSOptions); isPSS {
+			err = rsa.VerifyPSS(pub, pss.Hash, digest, sig, pss)
+		} else {
+			err = rsa.VerifyPKCS1v15(pub, opts.HashFunc(), digest, sig)
+		}
+		ok = err == nil
+	case *ecdsa.PublicKey:
+		ok = ecdsa.VerifyASN1(pub, digest, sig)
+	case ed25519.PublicKey:
+		ok = ed25519.Verify(pub, digest, sig)
+	case *sm2.PublicKey:
+		ok = sm2.VerifyASN1(pub, digest, sig)
+	default:
+		// Signatures of other keys can't be verified.
+		return nil
+	}
+	if !ok {
+		return errSignatureMismatch
+	}
+	return nil
+}
+
+// verifySignature verifies sig, just made by key with opts over digest, if
+// signatures are verified and key's backend isn't skipped, so that signatures
+// corrupted by a hardware fault or a buggy backend are never returned.
+func (s *Server) verifySignature(key crypto.Signer, digest, sig []byte, opts crypto.SignerOpts) error {
+	if !s.config.verifySignatures {
+		return nil
+	}
+	backend := keyBackend(key)
+	if s.config.skipVerifyBackends[backend] {
+		return nil
+	}
+	if err := checkSignature(key.Public(), digest, sig, opts); err != nil {
+		ski, _ := protocol.GetSKI(key.Public())
+		s.log.Errorf("signature by %s key with SKI %v failed verification", backend, ski)
+		s.metrics.logSignatureVerifyFailure(backend)
+		return err
+	}
+	return nil
+}
@@ -16,11 +16,13 @@ import (
 	"io"
 	"io/ioutil"
 	"net"
+	"net/http"
 	"net/rpc"
 	"os"
 	"path/filepath"
 	"regexp"
-	"runtime"
+	"runtime/debug"
+	"sort"
 	"sync"
 	"time"
 
@@ -28,6 +30,7 @@ import (
 	"github.com/cloudflare/gokeyless/internal/azure"
 	"github.com/cloudflare/gokeyless/internal/google"
 	"github.com/cloudflare/gokeyless/internal/rfc7512"
+	"github.com/cloudflare/gokeyless/internal/tpm"
 	"github.com/cloudflare/gokeyless/tracing"
 	"github.com/opentracing/opentracing-go"
 	"github.com/opentracing/opentracing-go/ext"
@@ -37,11 +40,14 @@ import (
 	"github.com/cloudflare/cfssl/log"
 	"golang.org/x/crypto/ed25519"
 
+	"github.com/cloudflare/gokeyless/noise"
 	"github.com/cloudflare/gokeyless/protocol"
 	"github.com/cloudflare/gokeyless/server/internal/client"
 	buf_ecdsa "github.com/cloudflare/gokeyless/server/internal/ecdsa"
 	textbook_rsa "github.com/cloudflare/gokeyless/server/internal/rsa"
 	"github.com/cloudflare/gokeyless/server/internal/worker"
+	"github.com/cloudflare/gokeyless/sm2"
+	"github.com/cloudflare/gokeyless/sm3"
 )
 
 var keyExt = regexp.MustCompile(`.+\.key`)
@@ -60,6 +66,17 @@ type Keystore interface {
 type DefaultKeystore struct {
 	mtx  sync.RWMutex
 	skis map[protocol.SKI]crypto.Signer
+	// usage holds the restrictions set with SetKeyUsage.
+	usage map[protocol.SKI]*KeyUsage
+	// rotations maps the SKIs of keys being replaced with StageKey to their
+	// rotations.
+	rotations map[protocol.SKI]*rotation
+	// zeroize is set by SetZeroize.
+	zeroize bool
+	// aliases maps the SHA-256 SKIs of keys to their SHA-1 SKIs.
+	aliases map[protocol.SKI]protocol.SKI
+	// onRemove is set by OnRemove.
+	onRemove func(ski protocol.SKI)
 }
 
 // NewDefaultKeystore returns a new DefaultKeystore.
@@ -106,6 +123,7 @@ func (keys *DefaultKeystore) AddFromFile(path string, LoadKey func([]byte) (cryp
 	}
 
 	priv, err := LoadKey(in)
+	zeroizeBytes(in)
 	if err != nil {
 		return err
 	}
@@ -117,25 +135,31 @@ func (keys *DefaultKeystore) AddFromFile(path string, LoadKey func([]byte) (cryp
 // is called to parse the URL, connect to the module, and populate a crypto.Signer,
 // which is stored in the Keystore.
 func (keys *DefaultKeystore) AddFromURI(uri string) error {
-	log.Infof("loading %s...", uri)
-	var priv crypto.Signer
-	var err error
-	if azure.IsKeyVaultURI(uri) {
-		priv, err = azure.New(uri)
-	} else if rfc7512.IsPKCS11URI(uri) {
-		priv, err = loadPKCS11URI(uri)
-	} else if google.IsKMSResource(uri) {
-		priv, err = google.New(uri)
-	} else {
-		return fmt.Errorf("unknown uri format: %s", uri)
-	}
-
+	priv, err := loadURI(uri)
 	if err != nil {
 		return err
 	}
 	return keys.Add(nil, priv)
 }
 
+// loadURI loads the key at a PKCS#11 URI, Azure Key Vault URI, Google Cloud
+// KMS resource name or TPM URI.
+func loadURI(uri string) (crypto.Signer, error) {
+	log.Infof("loading %s...", uri)
+	switch {
+	case azure.IsKeyVaultURI(uri):
+		return azure.New(uri)
+	case rfc7512.IsPKCS11URI(uri):
+		return loadPKCS11URI(uri)
+	case google.IsKMSResource(uri):
+		return google.New(uri)
+	case tpm.IsTPMURI(uri):
+		return tpm.New(uri)
+	default:
+		return nil, fmt.Errorf("unknown uri format: %s", uri)
+	}
+}
+
 // Add adds a new key to the server's internal store. Stores in maps by SKI and
 // (if possible) Digest, SNI, Server IP, and Client IP.
 func (keys *DefaultKeystore) Add(op *protocol.Operation, priv crypto.Signer) error {
@@ -147,12 +171,31 @@ func (keys *DefaultKeystore) Add(op *protocol.Operation, priv crypto.Signer) err
 	keys.mtx.Lock()
 	defer keys.mtx.Unlock()
 
-	keys.skis[ski] = priv
+	if old, ok := keys.skis[ski].(*CryptoKey); ok && old != priv {
+		old.Destroy()
+	}
+	keys.skis[ski] = keys.protect(priv)
+	keys.alias(ski, priv.Public())
 
 	log.Debugf("add signer with SKI: %v (https://crt.sh/?ski=%v)", ski, ski)
 	return nil
 }
 
+// Remove removes the key with the given SKI from the server's internal store.
+func (keys *DefaultKeystore) Remove(ski protocol.SKI) {
+	keys.mtx.Lock()
+	defer keys.mtx.Unlock()
+
+	if _, ok := keys.skis[ski]; ok {
+		keys.removed(ski)
+	}
+	keys.unalias(ski)
+	destroyKey(keys.skis[ski])
+	delete(keys.skis, ski)
+
+	log.Debugf("remove signer with SKI: %v", ski)
+}
+
 // DefaultLoadKey attempts to load a private key from PEM or DER.
 func DefaultLoadKey(in []byte) (priv crypto.Signer, err error) {
 	priv, err = helpers.ParsePrivateKeyPEM(in)
@@ -160,7 +203,17 @@ func DefaultLoadKey(in []byte) (priv crypto.Signer, err error) {
 		return priv, nil
 	}
 
-	return derhelpers.ParsePrivateKeyDER(in)
+	priv, err = derhelpers.ParsePrivateKeyDER(in)
+	if err == nil {
+		return priv, nil
+	}
+	// crypto/x509 doesn't know the SM2 curve.
+	if sm2Key, sm2Err := sm2.ParsePrivateKeyPEM(in); sm2Err == nil {
+		return sm2Key, nil
+	} else if sm2Key, sm2Err := sm2.ParsePrivateKey(in); sm2Err == nil {
+		return sm2Key, nil
+	}
+	return nil, err
 }
 
 // Get returns a key from keys, mapped from SKI.
@@ -188,23 +241,62 @@ func (keys *DefaultKeystore) Get(ctx context.Context, op *protocol.Operation) (c
 // Server is a Keyless Server capable of performing opaque key operations.
 type Server struct {
 	config *ServeConfig
+	// log and metrics receive the server's logs and metrics, by default the
+	// cfssl logger and the sinks set with SetMetricsSinks.
+	log     *serverLogger
+	metrics *serverMetrics
 	// tlsConfig is initialized with the auth configuration used for communicating with keyless clients.
 	tlsConfig *tls.Config
 	// keys contains the private keys and certificates for the server.
 	keys Keystore
 	// getCert is used for loading certificates.
 	getCert GetCert
+	// certs indexes the certificates listed for OpGetCertificates.
+	certs *CertIndex
 	// sealer is called for Seal and Unseal operations.
 	sealer Sealer
+	// ticketKeys provides the session ticket keys returned for OpGetTicketKeys.
+	ticketKeys TicketKeySource
+	// audit records private key operations, if set.
+	audit AuditLogger
+	// shadow mirrors key operations to the shadow keystore, if set.
+	shadow *shadow
+	// attester signs the attestations returned for OpAttest.
+	attester *Attester
+	// inflight coalesces identical requests for opcodes in config.dedupOps.
+	inflight *inflightGroup
+	// replays remembers recent signing and decryption requests, when replay
+	// detection is enabled.
+	replays *replayGuard
+	// keyLimiter enforces config.keyLimits.
+	keyLimiter *keyLimiter
+	// slo checks request latencies against config.latencySLOs.
+	slo *sloTracker
+	// shedder sheds requests under queue pressure according to
+	// config.loadShed.
+	shedder *loadShedder
+	// usage aggregates the requests of each client.
+	usage *usageTracker
 	// dispatcher is an RPC server that exposes arbitrary APIs to the client.
 	dispatcher *rpc.Server
 	// limitedDispatcher is an RPC server for APIs less trusted clients can be trusted with
 	limitedDispatcher *rpc.Server
+	// readiness holds the readiness checks added with AddReadinessCheck.
+	readiness readiness
 
 	listeners map[net.Listener]map[*client.ConnHandle]struct{}
-	shutdown  bool
-	wp        *workerPool
-	mtx       sync.Mutex
+	// conns are the active connections, and connsPerIP the number from each
+	// client IP address.
+	conns      map[*conn]struct{}
+	connsPerIP map[string]int
+	// closedConns are the histories of the last connections closed, oldest
+	// first.
+	closedConns []ConnHistory
+	// httpServers are the HTTP/2 servers started by ServeHTTP2.
+	httpServers []*http.Server
+	shutdown    bool
+	wp          *workerPool
+	mtx         sync.Mutex
 }
 
 // NewServer prepares a TLS server capable of receiving connections from keyless clients.
@@ -212,8 +304,11 @@ func NewServer(config *ServeConfig, cert tls.Certificate, keylessCA *x509.CertPo
 	if config == nil {
 		config = DefaultServeConfig()
 	}
+	metrics := &serverMetrics{}
 	s := &Server{
-		config: config,
+		config:  config,
+		log:     &serverLogger{},
+		metrics: metrics,
 		tlsConfig: &tls.Config{
 			ClientCAs:    keylessCA,
 			ClientAuth:   tls.RequireAndVerifyClientCert,
@@ -227,6 +322,15 @@ func NewServer(config *ServeConfig, cert tls.Certificate, keylessCA *x509.CertPo
 		dispatcher:        rpc.NewServer(),
 		limitedDispatcher: rpc.NewServer(),
 		listeners:         make(map[net.Listener]map[*client.ConnHandle]struct{}),
+		conns:             make(map[*conn]struct{}),
+		connsPerIP:        make(map[string]int),
+		inflight:          newInflightGroup(),
+		replays:           newReplayGuard(),
+		keyLimiter:        newKeyLimiter(metrics),
+		slo:               newSLOTracker(config, metrics),
+		shedder:           newLoadShedder(config),
+		usage:             newUsageTracker(metrics),
+		certs:             NewCertIndex(),
 	}
 	wp, err := newWorkerPool(s)
 	if err != nil {
@@ -270,6 +374,12 @@ func (s *Server) TLSConfig() *tls.Config {
 // with any other methods.
 func (s *Server) SetKeystore(keys Keystore) {
 	s.keys = keys
+	if keys, ok := keys.(removalKeystore); ok {
+		keys.OnRemove(func(ski protocol.SKI) { go s.NotifyKeyRemoved(ski) })
+	}
+	if s.config.hardened {
+		s.WarnWeakKeys()
+	}
 }
 
 // SetSealer sets the Sealer used by s. It is NOT safe to call concurrently with
@@ -278,6 +388,19 @@ func (s *Server) SetSealer(sealer Sealer) {
 	s.sealer = sealer
 }
 
+// SetAuditLogger sets the AuditLogger which records every signing and
+// decryption operation performed by s. It is NOT safe to call concurrently with
+// any other methods.
+func (s *Server) SetAuditLogger(audit AuditLogger) {
+	s.audit = audit
+}
+
+// SetTicketKeySource sets the TicketKeySource used by s. It is NOT safe to call
+// concurrently with any other methods.
+func (s *Server) SetTicketKeySource(src TicketKeySource) {
+	s.ticketKeys = src
+}
+
 // RegisterRPC publishes in the server the methods on rcvr.
 //
 // When a client sends a message with the opcode OpRPC, the payload of the
@@ -297,6 +420,56 @@ func (s *Server) RegisterLimitedRPC(rcvr interface{}) error {
 // GetCert is a function that returns a certificate given a request.
 type GetCert func(op *protocol.Operation) (certChain []byte, err error)
 
+// supportedOps lists the opcodes a Server handles, as returned for
+// OpGetCapabilities. OpCustom is included even if no CustomOpFunc is set.
+var supportedOps = []protocol.Op{
+	protocol.OpRSADecrypt,
+	protocol.OpRSASignMD5SHA1,
+	protocol.OpRSASignSHA1,
+	protocol.OpRSASignSHA224,
+	protocol.OpRSASignSHA256,
+	protocol.OpRSASignSHA384,
+	protocol.OpRSASignSHA512,
+	protocol.OpECDSASignMD5SHA1,
+	protocol.OpECDSASignSHA1,
+	protocol.OpECDSASignSHA224,
+	protocol.OpECDSASignSHA256,
+	protocol.OpECDSASignSHA384,
+	protocol.OpECDSASignSHA512,
+	protocol.OpEd25519Sign,
+	protocol.OpSM2SignSM3,
+	protocol.OpSeal,
+	protocol.OpUnseal,
+	protocol.OpRPC,
+	protocol.OpCustom,
+	protocol.OpGetTicketKeys,
+	protocol.OpGetCapabilities,
+	protocol.OpHello,
+	protocol.OpAttest,
+	protocol.OpBatch,
+	protocol.OpOCSPSign,
+	protocol.OpAuthenticate,
+	protocol.OpGetManifest,
+	protocol.OpProbeKey,
+	protocol.OpGetCertificates,
+	protocol.OpStream,
+	protocol.OpRSAPSSSignSHA256,
+	protocol.OpRSAPSSSignSHA384,
+	protocol.OpRSAPSSSignSHA512,
+	protocol.OpPing,
+}
+
+// serverFeatures are the protocol features offered by a Server in response to
+// OpHello.
+var serverFeatures = protocol.Features{
+	Version:     protocol.Version,
+	Ops:         supportedOps,
+	MaxPayload:  protocol.V1Features.MaxPayload,
+	Compression: []protocol.Compression{protocol.CompressionDeflate},
+	Padding:     protocol.PaddingOptional,
+	Keepalive:   true,
+}
+
 // Sealer is an interface for an handler for OpSeal and OpUnseal. Seal and
 // Unseal can return a protocol.Error to send a custom error code.
 type Sealer interface {
@@ -309,6 +482,42 @@ type request struct {
 	// time just after the request was deserialized from the connection
 	reqBegin time.Time
 	connName string
+	// identity of the client which sent the request, or nil if unknown
+	identity *ClientIdentity
+	// tenant of the client, or "" if it has none
+	tenant string
+	// batchIndex is one more than the index of the operation in the OpBatch
+	// which carried it, or zero if it wasn't batched.
+	batchIndex int
+	// log and metrics are those of the server which received the request.
+	log     *serverLogger
+	metrics *serverMetrics
+}
+
+// Priority returns the worker pool priority of req, as asked by the client.
+func (req request) Priority() worker.Priority {
+	switch req.pkt.Priority {
+	case protocol.PriorityHigh:
+		return worker.High
+	case protocol.PriorityLow:
+		return worker.Low
+	default:
+		return worker.Normal
+	}
+}
+
+// overBudget reports whether req has waited for longer than the client will
+// wait for its response, so that executing it would be wasted work.
+func (req request) overBudget() bool {
+	return req.pkt.Budget > 0 && time.Since(req.reqBegin) > req.pkt.Budget
+}
+
+// shed answers a request which is over budget with protocol.ErrTimedOut.
+func shed(req request, worker string) response {
+	req.log.Warningf("Worker %v: connection %s: shedding %s request %d, which queued for %v with a budget of %v",
+		worker, req.connName, req.pkt.Opcode, req.pkt.ID, time.Since(req.reqBegin), req.pkt.Budget)
+	req.metrics.logLimitRejected("budget")
+	return makeErrResponse(req, protocol.ErrTimedOut, time.Now())
 }
 
 type response struct {
@@ -318,20 +527,42 @@ type response struct {
 	err       protocol.Error
 	// time just after the request was deserialized from the connection
 	reqBegin time.Time
+	// time a worker started executing the request, or zero if none did
+	execBegin time.Time
+}
+
+// timing returns the time spent on the request resp answers so far.
+func (resp response) timing() protocol.Timing {
+	if resp.execBegin.IsZero() {
+		return protocol.Timing{Processing: time.Since(resp.reqBegin)}
+	}
+	return protocol.Timing{
+		Queue:      resp.execBegin.Sub(resp.reqBegin),
+		Processing: time.Since(resp.execBegin),
+	}
 }
 
 func makeRespondResponse(req request, payload []byte, requestBegin time.Time) response {
-	logRequestExecDuration(req.pkt.Opcode, requestBegin, protocol.ErrNone)
+	req.metrics.logRequestExecDuration(req.pkt.Opcode, requestBegin, protocol.ErrNone)
 	return response{id: req.pkt.ID, op: protocol.MakeRespondOp(payload), reqOpcode: req.pkt.Opcode, err: protocol.ErrNone, reqBegin: req.reqBegin}
 }
 
 func makePongResponse(req request, payload []byte, requestBegin time.Time) response {
-	logRequestExecDuration(req.pkt.Opcode, requestBegin, protocol.ErrNone)
+	req.metrics.logRequestExecDuration(req.pkt.Opcode, requestBegin, protocol.ErrNone)
 	return response{id: req.pkt.ID, op: protocol.MakePongOp(payload), reqOpcode: req.pkt.Opcode, err: protocol.ErrNone, reqBegin: req.reqBegin}
 }
 
+// unbatchedOps are the operations which can't be carried by OpBatch: those of
+// the connection rather than of a request, and those carrying operations.
+var unbatchedOps = map[protocol.Op]bool{
+	protocol.OpBatch:        true,
+	protocol.OpStream:       true,
+	protocol.OpHello:        true,
+	protocol.OpAuthenticate: true,
+}
+
 func makeErrResponse(req request, err protocol.Error, requestBegin time.Time) response {
-	logRequestExecDuration(req.pkt.Opcode, requestBegin, err)
+	req.metrics.logRequestExecDuration(req.pkt.Opcode, requestBegin, err)
 	return response{id: req.pkt.ID, op: protocol.MakeErrorOp(err), reqOpcode: req.pkt.Opcode, err: err, reqBegin: req.reqBegin}
 }
 
@@ -345,21 +576,80 @@ func newKeylessWorker(s *Server, buf *buf_ecdsa.SyncRandBuffer, name string) *ke
 	return &keylessWorker{s: s, buf: buf, name: name}
 }
 
-func (w *keylessWorker) Do(job interface{}) interface{} {
+func (w *keylessWorker) Do(job interface{}) (result interface{}) {
 	req := job.(request)
 	pkt := req.pkt
+	execBegin := time.Now()
+	defer func() {
+		if resp, ok := result.(response); ok {
+			resp.execBegin = execBegin
+			result = resp
+		}
+	}()
+	if w.s.audit != nil && isAuditedOp(pkt.Opcode) {
+		defer func() {
+			if resp, ok := result.(response); ok {
+				w.s.audit.Audit(newAuditRecord(req, resp.err))
+			}
+		}()
+	}
+	if req.overBudget() {
+		return shed(req, w.name)
+	}
+	if w.s.shedder.shed(pkt.Opcode, execBegin.Sub(req.reqBegin)) {
+		return shedLoad(req, w.name)
+	}
+	if window := w.s.config.replayWindow; window > 0 && isAuditedOp(pkt.Opcode) {
+		key, err := newReplayKey(req)
+		if err == nil && w.s.replays.check(key, window) {
+			w.s.log.Warningf("Worker %v: connection %s: rejecting replayed %s request %d from %v on key %v",
+				w.name, req.connName, pkt.Opcode, pkt.ID, req.identity, pkt.SKI)
+			w.s.metrics.logReplayRejected(pkt.Opcode)
+			return makeErrResponse(req, protocol.ErrReplayed, time.Now())
+		}
+	}
+	return w.do(req)
+}
+
+// Recover answers a request whose execution panicked with an internal error,
+// and replaces w with a new worker.
+func (w *keylessWorker) Recover(job interface{}, v interface{}) (interface{}, worker.Worker) {
+	req := job.(request)
+	resp := recoverRequest(req, w.name, v)
+	if w.s.audit != nil && isAuditedOp(req.pkt.Opcode) {
+		w.s.audit.Audit(newAuditRecord(req, resp.err))
+	}
+	return resp, newKeylessWorker(w.s, w.buf, w.name)
+}
+
+// recoverRequest logs the panic v of the worker named name while executing
+// req, and returns an internal error response.
+func recoverRequest(req request, name string, v interface{}) response {
+	req.log.Errorf("Worker %v: panic executing %v request from %s: %v\n%s", name, req.pkt.Opcode, req.connName, v, debug.Stack())
+	req.metrics.logWorkerPanic(req.pkt.Opcode)
+	return makeErrResponse(req, protocol.ErrInternal, time.Now())
+}
 
+func (w *keylessWorker) do(req request) response {
+	pkt := req.pkt
 	spanCtx, err := tracing.SpanContextFromBinary(pkt.Operation.JaegerSpan)
 	if err != nil {
-		log.Errorf("failed to extract span: %v", err)
+		w.s.log.Errorf("failed to extract span: %v", err)
 	}
 	span, ctx := opentracing.StartSpanFromContext(context.Background(), "keylessWorker.Do", ext.RPCServerOption(spanCtx))
 	defer span.Finish()
 	tracing.SetOperationSpanTags(span, &pkt.Operation)
 	span.SetTag("worker", w.name)
+	if req.identity != nil {
+		ctx = WithClientIdentity(ctx, req.identity)
+	}
+	if req.tenant != "" {
+		ctx = WithTenant(ctx, req.tenant)
+	}
 
-	log.Debugf("connection %s: worker=%v opcode=%s id=%d sni=%s ip=%s ski=%v",
+	w.s.log.Debugf("connection %s: client=%v worker=%v opcode=%s id=%d sni=%s ip=%s ski=%v",
 		req.connName,
+		req.identity,
 		w.name,
 		pkt.Operation.Opcode,
 		pkt.Header.ID,
@@ -367,7 +657,12 @@ func (w *keylessWorker) Do(job interface{}) interface{} {
 		pkt.Operation.ServerIP,
 		pkt.Operation.SKI)
 
-	requestBegin := time.Now()
+	return w.s.handle(ctx, req, w.handle)
+}
+
+// handle executes req, which has been through any middleware.
+func (w *keylessWorker) handle(ctx context.Context, req request, requestBegin time.Time) response {
+	pkt := req.pkt
 	var opts crypto.SignerOpts
 	switch pkt.Operation.Opcode {
 	case protocol.OpPing:
@@ -375,7 +670,7 @@ func (w *keylessWorker) Do(job interface{}) interface{} {
 
 	case protocol.OpSeal, protocol.OpUnseal:
 		if w.s.sealer == nil {
-			log.Errorf("Worker %v: Sealer is nil", w.name)
+			w.s.log.Errorf("Worker %v: Sealer is nil", w.name)
 			return makeErrResponse(req, protocol.ErrInternal, requestBegin)
 		}
 
@@ -387,7 +682,7 @@ func (w *keylessWorker) Do(job interface{}) interface{} {
 			res, err = w.s.sealer.Unseal(&pkt.Operation)
 		}
 		if err != nil {
-			log.Errorf("Worker %v: Sealer: %v", w.name, err)
+			w.s.log.Errorf("Worker %v: Sealer: %v", w.name, err)
 			code := protocol.ErrInternal
 			if err, ok := err.(protocol.Error); ok {
 				code = err
@@ -396,12 +691,135 @@ func (w *keylessWorker) Do(job interface{}) interface{} {
 		}
 		return makeRespondResponse(req, res, requestBegin)
 
+	case protocol.OpGetTicketKeys:
+		if w.s.ticketKeys == nil {
+			w.s.log.Errorf("Worker %v: TicketKeySource is nil", w.name)
+			return makeErrResponse(req, protocol.ErrInternal, requestBegin)
+		}
+
+		keys, err := w.s.ticketKeys.TicketKeys()
+		if err != nil {
+			w.s.log.Errorf("Worker %v: TicketKeySource: %v", w.name, err)
+			return makeErrResponse(req, protocol.ErrInternal, requestBegin)
+		}
+		res := make([]byte, 0, len(keys)*32)
+		for _, key := range keys {
+			res = append(res, key[:]...)
+		}
+		return makeRespondResponse(req, res, requestBegin)
+
+	case protocol.OpGetCapabilities:
+		res := make([]byte, len(supportedOps))
+		for i, op := range supportedOps {
+			res[i] = byte(op)
+		}
+		return makeRespondResponse(req, res, requestBegin)
+
+	case protocol.OpBatch:
+		ops, err := protocol.UnmarshalBatch(pkt.Operation.Payload)
+		if err != nil {
+			w.s.log.Errorf("Worker %v: invalid batch: %v", w.name, err)
+			return makeErrResponse(req, protocol.ErrFormat, requestBegin)
+		}
+		results := make([]protocol.Operation, len(ops))
+		for i := range ops {
+			if unbatchedOps[ops[i].Opcode] {
+				w.s.log.Errorf("Worker %v: %s can't be batched", w.name, ops[i].Opcode)
+				results[i] = protocol.MakeErrorOp(protocol.ErrBadOpcode)
+				continue
+			}
+			if w.s.config.payloadTooLarge(&ops[i], w.s.log, w.s.metrics) {
+				results[i] = protocol.MakeErrorOp(protocol.ErrFormat)
+				continue
+			}
+			sub := req
+			sub.pkt = &protocol.Packet{Header: pkt.Header, Operation: ops[i]}
+			sub.batchIndex = i + 1
+			results[i] = w.Do(sub).(response).op
+		}
+		res, err := protocol.MarshalBatch(results)
+		if err != nil {
+			w.s.log.Errorf("Worker %v: batch: %v", w.name, err)
+			return makeErrResponse(req, protocol.ErrInternal, requestBegin)
+		}
+		if len(res) > int(serverFeatures.MaxPayload) {
+			w.s.log.Errorf("Worker %v: batch response of %dB is too long", w.name, len(res))
+			return makeErrResponse(req, protocol.ErrInternal, requestBegin)
+		}
+		return makeRespondResponse(req, res, requestBegin)
+
+	case protocol.OpStream:
+		// Streams are assembled by the connection, which requests over the
+		// HTTP/2 transport don't have.
+		return makeErrResponse(req, protocol.ErrUnexpectedOpcode, requestBegin)
+
+	case protocol.OpAuthenticate:
+		// Tokens are verified by the connection, and only for clients which
+		// presented no certificate.
+		return makeErrResponse(req, protocol.ErrUnexpectedOpcode, requestBegin)
+
+	case protocol.OpAttest:
+		res, err := w.s.attest(pkt.Operation.Payload)
+		if err != nil {
+			w.s.log.Errorf("Worker %v: attest: %v", w.name, err)
+			return makeErrResponse(req, protocol.ErrInternal, requestBegin)
+		}
+		return makeRespondResponse(req, res, requestBegin)
+
+	case protocol.OpGetManifest:
+		res, err := w.s.manifest()
+		if err != nil {
+			w.s.log.Errorf("Worker %v: manifest: %v", w.name, err)
+			return makeErrResponse(req, protocol.ErrInternal, requestBegin)
+		}
+		if len(res) > int(serverFeatures.MaxPayload) {
+			w.s.log.Errorf("Worker %v: manifest of %dB is too long", w.name, len(res))
+			return makeErrResponse(req, protocol.ErrInternal, requestBegin)
+		}
+		return makeRespondResponse(req, res, requestBegin)
+
+	case protocol.OpProbeKey:
+		key, err := w.s.keys.Get(ctx, &pkt.Operation)
+		if err != nil {
+			w.s.log.Errorf("failed to load key with sni=%s ip=%s ski=%v: %v", pkt.Operation.SNI, pkt.Operation.ServerIP, pkt.Operation.SKI, err)
+			return makeErrResponse(req, protocol.ErrInternal, requestBegin)
+		} else if key == nil {
+			return makeErrResponse(req, protocol.ErrKeyNotFound, requestBegin)
+		}
+		return makeRespondResponse(req, nil, requestBegin)
+
+	case protocol.OpGetCertificates:
+		res, err := w.s.certificates(pkt.Payload)
+		if err != nil {
+			w.s.log.Errorf("Worker %v: invalid certificate query: %v", w.name, err)
+			return makeErrResponse(req, protocol.ErrFormat, requestBegin)
+		}
+		return makeRespondResponse(req, res, requestBegin)
+
+	case protocol.OpHello:
+		var features protocol.Features
+		if err := features.UnmarshalBinary(pkt.Operation.Payload); err != nil {
+			w.s.log.Errorf("Worker %v: invalid hello: %v", w.name, err)
+			return makeErrResponse(req, protocol.ErrFormat, requestBegin)
+		}
+		local := serverFeatures
+		local.SKISchemes = w.s.config.SKISchemes()
+		local.KeyRemoved = w.s.config.keyRemovedNotices
+		local.Timing = w.s.config.timingHints
+		local.Reconnect = w.s.config.connMaxAge > 0 || w.s.config.connMaxBytes > 0
+		negotiated := protocol.Negotiate(local, features)
+		res, err := negotiated.MarshalBinary()
+		if err != nil {
+			return makeErrResponse(req, protocol.ErrInternal, requestBegin)
+		}
+		return makeRespondResponse(req, res, requestBegin)
+
 	case protocol.OpRPC:
 		codec := newServerCodec(pkt.Payload)
 
 		err := w.s.dispatcher.ServeRequest(codec)
 		if err != nil {
-			log.Errorf("Worker %v: ServeRPC: %v", w.name, err)
+			w.s.log.Errorf("Worker %v: ServeRPC: %v", w.name, err)
 			return makeErrResponse(req, protocol.ErrInternal, requestBegin)
 		}
 		return makeRespondResponse(req, codec.response, requestBegin)
@@ -409,13 +827,13 @@ func (w *keylessWorker) Do(job interface{}) interface{} {
 	case protocol.OpCustom:
 		customOpFunc := w.s.config.CustomOpFunc()
 		if customOpFunc == nil {
-			log.Errorf("Worker %v: OpCustom is undefined", w.name)
+			w.s.log.Errorf("Worker %v: OpCustom is undefined", w.name)
 			return makeErrResponse(req, protocol.ErrBadOpcode, requestBegin)
 		}
 
 		res, err := customOpFunc(ctx, pkt.Operation)
 		if err != nil {
-			log.Errorf("Worker %v: OpCustom returned error: %v", w.name, err)
+			w.s.log.Errorf("Worker %v: OpCustom returned error: %v", w.name, err)
 			code := protocol.ErrInternal
 			if err, ok := err.(protocol.Error); ok {
 				code = err
@@ -424,66 +842,187 @@ func (w *keylessWorker) Do(job interface{}) interface{} {
 		}
 		return makeRespondResponse(req, res, requestBegin)
 
+	case protocol.OpOCSPSign:
+		unsigned, err := parseOCSPResponse(pkt.Operation.Payload)
+		if err != nil {
+			w.s.log.Errorf("Worker %v: invalid OCSP response: %v", w.name, err)
+			return makeErrResponse(req, protocol.ErrFormat, requestBegin)
+		}
+
+		keyLoadBegin := time.Now()
+		key, err := w.s.keys.Get(ctx, &pkt.Operation)
+		if err != nil {
+			w.s.log.Errorf("failed to load key with sni=%s ip=%s ski=%v: %v", pkt.Operation.SNI, pkt.Operation.ServerIP, pkt.Operation.SKI, err)
+			return makeErrResponse(req, protocol.ErrInternal, requestBegin)
+		} else if key == nil {
+			w.s.log.Errorf("failed to load key with sni=%s ip=%s ski=%v: %v", pkt.Operation.SNI, pkt.Operation.ServerIP, pkt.Operation.SKI, protocol.ErrKeyNotFound)
+			return makeErrResponse(req, protocol.ErrKeyNotFound, requestBegin)
+		}
+		w.s.metrics.logKeyLoadDuration(keyLoadBegin)
+
+		if err := w.s.checkKeyUsage(&pkt.Operation, key, keyOpOCSP, unsigned.hash); err != nil {
+			w.s.log.Errorf("Worker %v: ski=%v: %s: %v", w.name, pkt.Operation.SKI, pkt.Operation.Opcode, err)
+			return makeErrResponse(req, protocol.ErrKeyUsage, requestBegin)
+		}
+
+		release, err := w.s.keyLimiter.acquire(w.s.config.keyLimits, &pkt.Operation, key)
+		if err != nil {
+			w.s.log.Errorf("Worker %v: ski=%v: %v", w.name, pkt.Operation.SKI, err)
+			return makeErrResponse(req, protocol.ErrThrottled, requestBegin)
+		}
+		defer release()
+
+		res, err := unsigned.sign(key)
+		if err != nil {
+			w.s.log.Errorf("Worker %v: %s: OCSP signing error: %v", w.name, protocol.ErrCrypto, err)
+			return makeErrResponse(req, protocol.ErrCrypto, requestBegin)
+		}
+		return makeRespondResponse(req, res, requestBegin)
+
 	case protocol.OpEd25519Sign:
 		keyLoadBegin := time.Now()
 		key, err := w.s.keys.Get(ctx, &pkt.Operation)
 		if err != nil {
-			log.Errorf("failed to load key with sni=%s ip=%s ski=%v: %v", pkt.Operation.SNI, pkt.Operation.ServerIP, pkt.Operation.SKI, err)
+			w.s.log.Errorf("failed to load key with sni=%s ip=%s ski=%v: %v", pkt.Operation.SNI, pkt.Operation.ServerIP, pkt.Operation.SKI, err)
 			return makeErrResponse(req, protocol.ErrInternal, requestBegin)
 		} else if key == nil {
-			log.Errorf("failed to load key with sni=%s ip=%s ski=%v: %v", pkt.Operation.SNI, pkt.Operation.ServerIP, pkt.Operation.SKI, protocol.ErrKeyNotFound)
+			w.s.log.Errorf("failed to load key with sni=%s ip=%s ski=%v: %v", pkt.Operation.SNI, pkt.Operation.ServerIP, pkt.Operation.SKI, protocol.ErrKeyNotFound)
 			return makeErrResponse(req, protocol.ErrKeyNotFound, requestBegin)
 		}
-		logKeyLoadDuration(keyLoadBegin)
+		w.s.metrics.logKeyLoadDuration(keyLoadBegin)
 
-		if ed25519Key, ok := key.(ed25519.PrivateKey); ok {
-			sig := ed25519.Sign(ed25519Key, pkt.Operation.Payload)
-			return makeRespondResponse(req, sig, requestBegin)
+		if err := w.s.checkKeyUsage(&pkt.Operation, key, keyOpSign, 0); err != nil {
+			w.s.log.Errorf("Worker %v: ski=%v: %s: %v", w.name, pkt.Operation.SKI, pkt.Operation.Opcode, err)
+			return makeErrResponse(req, protocol.ErrKeyUsage, requestBegin)
 		}
 
-		sig, err := key.Sign(rand.Reader, pkt.Operation.Payload, crypto.Hash(0))
+		release, err := w.s.keyLimiter.acquire(w.s.config.keyLimits, &pkt.Operation, key)
 		if err != nil {
-			log.Errorf("Worker %v: %s: Signing error: %v", w.name, protocol.ErrCrypto, err)
+			w.s.log.Errorf("Worker %v: ski=%v: %v", w.name, pkt.Operation.SKI, err)
+			return makeErrResponse(req, protocol.ErrThrottled, requestBegin)
+		}
+		defer release()
+
+		var sig []byte
+		err = useKey(key, func(key crypto.Signer) (err error) {
+			if ed25519Key, ok := key.(ed25519.PrivateKey); ok {
+				sig = ed25519.Sign(ed25519Key, pkt.Operation.Payload)
+			} else if sig, err = key.Sign(rand.Reader, pkt.Operation.Payload, crypto.Hash(0)); err != nil {
+				return err
+			}
+			return w.s.verifySignature(key, pkt.Operation.Payload, sig, crypto.Hash(0))
+		})
+		if err != nil {
+			w.s.log.Errorf("Worker %v: %s: Signing error: %v", w.name, protocol.ErrCrypto, err)
 			return makeErrResponse(req, protocol.ErrCrypto, requestBegin)
 		}
 		return makeRespondResponse(req, sig, requestBegin)
 
-	case protocol.OpRSADecrypt:
+	case protocol.OpSM2SignSM3:
 		keyLoadBegin := time.Now()
 		key, err := w.s.keys.Get(ctx, &pkt.Operation)
 		if err != nil {
-			log.Errorf("failed to load key with sni=%s ip=%s ski=%v: %v", pkt.Operation.SNI, pkt.Operation.ServerIP, pkt.Operation.SKI, err)
+			w.s.log.Errorf("failed to load key with sni=%s ip=%s ski=%v: %v", pkt.Operation.SNI, pkt.Operation.ServerIP, pkt.Operation.SKI, err)
 			return makeErrResponse(req, protocol.ErrInternal, requestBegin)
 		} else if key == nil {
-			log.Errorf("failed to load key with sni=%s ip=%s ski=%v: %v", pkt.Operation.SNI, pkt.Operation.ServerIP, pkt.Operation.SKI, protocol.ErrKeyNotFound)
+			w.s.log.Errorf("failed to load key with sni=%s ip=%s ski=%v: %v", pkt.Operation.SNI, pkt.Operation.ServerIP, pkt.Operation.SKI, protocol.ErrKeyNotFound)
 			return makeErrResponse(req, protocol.ErrKeyNotFound, requestBegin)
 		}
-		logKeyLoadDuration(keyLoadBegin)
+		w.s.metrics.logKeyLoadDuration(keyLoadBegin)
 
-		if _, ok := key.Public().(*rsa.PublicKey); !ok {
-			log.Errorf("Worker %v: %s: Key is not RSA", w.name, protocol.ErrCrypto)
+		if err := w.s.checkKeyUsage(&pkt.Operation, key, keyOpSign, 0); err != nil {
+			w.s.log.Errorf("Worker %v: ski=%v: %s: %v", w.name, pkt.Operation.SKI, pkt.Operation.Opcode, err)
+			return makeErrResponse(req, protocol.ErrKeyUsage, requestBegin)
+		}
+
+		if _, ok := key.Public().(*sm2.PublicKey); !ok {
+			w.s.log.Errorf("Worker %v: %s: %s requested for non-SM2 key", w.name, protocol.ErrCrypto, pkt.Operation.Opcode)
 			return makeErrResponse(req, protocol.ErrCrypto, requestBegin)
 		}
+		if len(pkt.Operation.Payload) != sm3.Size {
+			w.s.log.Errorf("Worker %v: %s: payload is not an SM3 hash", w.name, protocol.ErrFormat)
+			return makeErrResponse(req, protocol.ErrFormat, requestBegin)
+		}
+
+		release, err := w.s.keyLimiter.acquire(w.s.config.keyLimits, &pkt.Operation, key)
+		if err != nil {
+			w.s.log.Errorf("Worker %v: ski=%v: %v", w.name, pkt.Operation.SKI, err)
+			return makeErrResponse(req, protocol.ErrThrottled, requestBegin)
+		}
+		defer release()
 
-		if rsaKey, ok := key.(*rsa.PrivateKey); ok {
-			// Decrypt without removing padding; that's the client's responsibility.
-			ptxt, err := textbook_rsa.Decrypt(rsaKey, pkt.Operation.Payload)
-			if err != nil {
-				log.Errorf("Worker %v: %v", w.name, err)
-				return makeErrResponse(req, protocol.ErrCrypto, requestBegin)
+		var sig []byte
+		err = useKey(key, func(key crypto.Signer) (err error) {
+			if sig, err = key.Sign(rand.Reader, pkt.Operation.Payload, sm2.SignerOpts{}); err != nil {
+				return err
 			}
-			return makeRespondResponse(req, ptxt, requestBegin)
+			return w.s.verifySignature(key, pkt.Operation.Payload, sig, sm2.SignerOpts{})
+		})
+		if err != nil {
+			w.s.log.Errorf("Worker %v: %s: Signing error: %v", w.name, protocol.ErrCrypto, err)
+			return makeErrResponse(req, protocol.ErrCrypto, requestBegin)
+		}
+		return makeRespondResponse(req, sig, requestBegin)
+
+	case protocol.OpRSADecrypt:
+		keyLoadBegin := time.Now()
+		key, err := w.s.keys.Get(ctx, &pkt.Operation)
+		if err != nil {
+			w.s.log.Errorf("failed to load key with sni=%s ip=%s ski=%v: %v", pkt.Operation.SNI, pkt.Operation.ServerIP, pkt.Operation.SKI, err)
+			return makeErrResponse(req, protocol.ErrInternal, requestBegin)
+		} else if key == nil {
+			w.s.log.Errorf("failed to load key with sni=%s ip=%s ski=%v: %v", pkt.Operation.SNI, pkt.Operation.ServerIP, pkt.Operation.SKI, protocol.ErrKeyNotFound)
+			return makeErrResponse(req, protocol.ErrKeyNotFound, requestBegin)
+		}
+		w.s.metrics.logKeyLoadDuration(keyLoadBegin)
+
+		if err := w.s.checkKeyUsage(&pkt.Operation, key, keyOpDecrypt, 0); err != nil {
+			w.s.log.Errorf("Worker %v: ski=%v: %s: %v", w.name, pkt.Operation.SKI, pkt.Operation.Opcode, err)
+			return makeErrResponse(req, protocol.ErrKeyUsage, requestBegin)
+		}
+		if w.s.config.hardened && !w.s.config.allowRSADecrypt {
+			w.s.log.Errorf("Worker %v: ski=%v: %s: RSA decryption is disabled in hardened mode", w.name, pkt.Operation.SKI, protocol.ErrKeyUsage)
+			return makeErrResponse(req, protocol.ErrKeyUsage, requestBegin)
 		}
 
-		rsaKey, ok := key.(crypto.Decrypter)
+		release, err := w.s.keyLimiter.acquire(w.s.config.keyLimits, &pkt.Operation, key)
+		if err != nil {
+			w.s.log.Errorf("Worker %v: ski=%v: %v", w.name, pkt.Operation.SKI, err)
+			return makeErrResponse(req, protocol.ErrThrottled, requestBegin)
+		}
+		defer release()
+		defer w.s.wp.acquireRSAProc(key)()
+
+		pub, ok := key.Public().(*rsa.PublicKey)
 		if !ok {
-			log.Errorf("Worker %v: %s: Key is not Decrypter", w.name, protocol.ErrCrypto)
+			w.s.log.Errorf("Worker %v: %s: Key is not RSA", w.name, protocol.ErrCrypto)
 			return makeErrResponse(req, protocol.ErrCrypto, requestBegin)
 		}
 
-		ptxt, err := rsaKey.Decrypt(nil, pkt.Operation.Payload, nil)
+		var ptxt []byte
+		err = useKey(key, func(key crypto.Signer) (err error) {
+			if rsaKey, ok := key.(*rsa.PrivateKey); ok {
+				// Decrypt without removing padding; that's the client's responsibility.
+				ptxt, err = textbook_rsa.Decrypt(rsaKey, pkt.Operation.Payload)
+				if err == nil && w.s.config.hardened {
+					err = checkRSADecrypt(pub, pkt.Operation.Payload, ptxt)
+				}
+				return err
+			}
+			rsaKey, ok := key.(crypto.Decrypter)
+			if !ok {
+				return errors.New("key is not a Decrypter")
+			}
+			var random io.Reader
+			if w.s.config.hardened {
+				// Let decrypters which blind only when given randomness do so.
+				random = rand.Reader
+			}
+			ptxt, err = rsaKey.Decrypt(random, pkt.Operation.Payload, nil)
+			return err
+		})
 		if err != nil {
-			log.Errorf("Worker %v: %s: Decryption error: %v", w.name, protocol.ErrCrypto, err)
+			w.s.log.Errorf("Worker %v: %s: Decryption error: %v", w.name, protocol.ErrCrypto, err)
 			return makeErrResponse(req, protocol.ErrCrypto, requestBegin)
 		}
 
@@ -502,7 +1041,7 @@ func (w *keylessWorker) Do(job interface{}) interface{} {
 	case protocol.OpRSASignSHA512, protocol.OpRSAPSSSignSHA512, protocol.OpECDSASignSHA512:
 		opts = crypto.SHA512
 	case protocol.OpPong, protocol.OpResponse, protocol.OpError:
-		log.Errorf("Worker %v: %s: %s is not a valid request Opcode\n", w.name, protocol.ErrUnexpectedOpcode, pkt.Operation.Opcode)
+		w.s.log.Errorf("Worker %v: %s: %s is not a valid request Opcode\n", w.name, protocol.ErrUnexpectedOpcode, pkt.Operation.Opcode)
 		return makeErrResponse(req, protocol.ErrUnexpectedOpcode, requestBegin)
 	default:
 		return makeErrResponse(req, protocol.ErrBadOpcode, requestBegin)
@@ -516,25 +1055,61 @@ func (w *keylessWorker) Do(job interface{}) interface{} {
 	keyLoadBegin := time.Now()
 	key, err := w.s.keys.Get(ctx, &pkt.Operation)
 	if err != nil {
-		log.Errorf("failed to load key with sni=%s ip=%s ski=%v: %v", pkt.Operation.SNI, pkt.Operation.ServerIP, pkt.Operation.SKI, err)
+		w.s.log.Errorf("failed to load key with sni=%s ip=%s ski=%v: %v", pkt.Operation.SNI, pkt.Operation.ServerIP, pkt.Operation.SKI, err)
 		return makeErrResponse(req, protocol.ErrInternal, requestBegin)
 	} else if key == nil {
-		log.Errorf("failed to load key with sni=%s ip=%s ski=%v: %v", pkt.Operation.SNI, pkt.Operation.ServerIP, pkt.Operation.SKI, protocol.ErrKeyNotFound)
+		w.s.log.Errorf("failed to load key with sni=%s ip=%s ski=%v: %v", pkt.Operation.SNI, pkt.Operation.ServerIP, pkt.Operation.SKI, protocol.ErrKeyNotFound)
 		return makeErrResponse(req, protocol.ErrKeyNotFound, requestBegin)
 	}
-	logKeyLoadDuration(keyLoadBegin)
+	w.s.metrics.logKeyLoadDuration(keyLoadBegin)
+
+	if err := w.s.checkKeyUsage(&pkt.Operation, key, keyOpSign, opts.HashFunc()); err != nil {
+		w.s.log.Errorf("Worker %v: ski=%v: %s: %v", w.name, pkt.Operation.SKI, pkt.Operation.Opcode, err)
+		return makeErrResponse(req, protocol.ErrKeyUsage, requestBegin)
+	}
+
+	if _, ok := opts.(*rsa.PSSOptions); ok {
+		if _, ok := key.Public().(*rsa.PublicKey); !ok {
+			w.s.log.Errorf("Worker %v: %s: %s requested for non-RSA key", w.name, protocol.ErrCrypto, pkt.Operation.Opcode)
+			return makeErrResponse(req, protocol.ErrCrypto, requestBegin)
+		}
+	}
+
+	release, err := w.s.keyLimiter.acquire(w.s.config.keyLimits, &pkt.Operation, key)
+	if err != nil {
+		w.s.log.Errorf("Worker %v: ski=%v: %v", w.name, pkt.Operation.SKI, err)
+		return makeErrResponse(req, protocol.ErrThrottled, requestBegin)
+	}
+	defer release()
+	defer w.s.wp.acquireRSAProc(key)()
 
 	signSpan, _ := opentracing.StartSpanFromContext(ctx, "keylessWorker.Sign")
 	defer signSpan.Finish()
 	var sig []byte
-	if k, ok := key.(*ecdsa.PrivateKey); ok && k.Curve == elliptic.P256() {
-		sig, err = buf_ecdsa.Sign(rand.Reader, k, pkt.Operation.Payload, opts, w.buf)
-	} else {
-		sig, err = key.Sign(rand.Reader, pkt.Operation.Payload, opts)
+	err = useKey(key, func(key crypto.Signer) (err error) {
+		if k, ok := key.(*ecdsa.PrivateKey); ok && w.s.config.deterministicECDSA {
+			sig, err = buf_ecdsa.SignDeterministic(k, pkt.Operation.Payload, opts)
+		} else if ok && k.Curve == elliptic.P256() {
+			sig, err = buf_ecdsa.Sign(rand.Reader, k, pkt.Operation.Payload, opts, w.buf)
+		} else {
+			sig, err = key.Sign(rand.Reader, pkt.Operation.Payload, opts)
+		}
+		return err
+	})
+	if pub, ok := key.Public().(*ecdsa.PublicKey); ok && err == nil && w.s.config.lowS {
+		sig, err = buf_ecdsa.LowS(sig, pub.Curve)
+	}
+	if err == nil && w.s.config.hardened {
+		err = checkRSASignature(key.Public(), pkt.Operation.Payload, sig, opts)
+	}
+	if err == nil {
+		err = w.s.verifySignature(key, pkt.Operation.Payload, sig, opts)
 	}
 	if err != nil {
-		tracing.LogError(span, err)
-		log.Errorf("Worker %v: %s: Signing error: %v\n", w.name, protocol.ErrCrypto, err)
+		if span := opentracing.SpanFromContext(ctx); span != nil {
+			tracing.LogError(span, err)
+		}
+		w.s.log.Errorf("Worker %v: %s: Signing error: %v\n", w.name, protocol.ErrCrypto, err)
 		return makeErrResponse(req, protocol.ErrCrypto, requestBegin)
 	}
 
@@ -553,25 +1128,41 @@ func newLimitedWorker(s *Server, name string) *limitedWorker {
 func (w *limitedWorker) Do(job interface{}) interface{} {
 	req := job.(request)
 	pkt := req.pkt
+	if req.overBudget() {
+		return shed(req, w.name)
+	}
 
 	spanCtx, err := tracing.SpanContextFromBinary(pkt.Operation.JaegerSpan)
 	if err != nil {
-		log.Errorf("failed to extract span: %v", err)
+		w.s.log.Errorf("failed to extract span: %v", err)
 	}
-	span, _ := opentracing.StartSpanFromContext(context.Background(), "limitedWorker.Do", ext.RPCServerOption(spanCtx))
+	span, ctx := opentracing.StartSpanFromContext(context.Background(), "limitedWorker.Do", ext.RPCServerOption(spanCtx))
 	defer span.Finish()
 	tracing.SetOperationSpanTags(span, &pkt.Operation)
 	span.SetTag("worker", w.name)
+	if req.identity != nil {
+		ctx = WithClientIdentity(ctx, req.identity)
+	}
+	if req.tenant != "" {
+		ctx = WithTenant(ctx, req.tenant)
+	}
 
-	requestBegin := time.Now()
-	log.Debugf("connection %s: worker=%v opcode=%s id=%d sni=%s ip=%s ski=%v",
+	w.s.log.Debugf("connection %s: client=%v worker=%v opcode=%s id=%d sni=%s ip=%s ski=%v",
 		req.connName,
+		req.identity,
 		w.name,
 		pkt.Operation.Opcode,
 		pkt.Header.ID,
 		pkt.Operation.SNI,
 		pkt.Operation.ServerIP,
 		pkt.Operation.SKI)
+
+	return w.s.handle(ctx, req, w.handle)
+}
+
+// handle executes req, which has been through any middleware.
+func (w *limitedWorker) handle(ctx context.Context, req request, requestBegin time.Time) response {
+	pkt := req.pkt
 	switch pkt.Operation.Opcode {
 	case protocol.OpPing:
 		return makePongResponse(req, pkt.Operation.Payload, requestBegin)
@@ -580,7 +1171,7 @@ func (w *limitedWorker) Do(job interface{}) interface{} {
 
 		err := w.s.limitedDispatcher.ServeRequest(codec)
 		if err != nil {
-			log.Errorf("Worker %v: ServeRPC: %v", w.name, err)
+			w.s.log.Errorf("Worker %v: ServeRPC: %v", w.name, err)
 			return makeErrResponse(req, protocol.ErrInternal, requestBegin)
 		}
 		return makeRespondResponse(req, codec.response, requestBegin)
@@ -589,6 +1180,12 @@ func (w *limitedWorker) Do(job interface{}) interface{} {
 	}
 }
 
+// Recover answers a request whose execution panicked with an internal error,
+// and replaces w with a new worker.
+func (w *limitedWorker) Recover(job interface{}, v interface{}) (interface{}, worker.Worker) {
+	return recoverRequest(job.(request), w.name, v), newLimitedWorker(w.s, w.name)
+}
+
 type randGenWorker struct {
 	buf *buf_ecdsa.SyncRandBuffer
 }
@@ -620,46 +1217,61 @@ func (s *Server) addListener(l net.Listener) error {
 
 // Serve accepts incoming connections on the Listener l, creating a new
 // pair of service goroutines for each. The first time l.Accept returns a
-// non-temporary error, everything will be torn down.
+// non-temporary error, everything will be torn down. Serve returns nil once
+// Close is called.
 //
 // If l is neither a TCP listener nor a Unix listener, then the timeout will be
 // taken to be the lower of the TCP timeout and the Unix timeout specified in
 // the server's config.
 func (s *Server) Serve(l net.Listener) error {
+	return s.ServeWithTLS(l, s.tlsConfig)
+}
+
+// ServeWithTLS is like Serve, but authenticates connections with config
+// instead of the server's TLS configuration, so that each listener can have
+// its own certificate and client CAs. If config is nil, connections are not
+// encrypted or authenticated, and their clients are trusted like those with a
+// valid certificate; this is only appropriate for listeners, such as Unix
+// sockets, whose access is controlled by other means. Attestations cover the
+// server's own certificate, so clients which require them must connect to
+// listeners which present it.
+func (s *Server) ServeWithTLS(l net.Listener, config *tls.Config) error {
 	if err := s.addListener(l); err != nil {
 		return err
 	}
 
 	for {
-		c, err := accept(l)
+		c, err := s.accept(l)
 		if err != nil {
-			log.Errorf("Accept error: %v; shutting down server", err)
+			if s.closed() {
+				return nil
+			}
+			s.log.Errorf("Accept error: %v; shutting down server", err)
 			return err
 		}
-		go s.spawn(l, c)
+		if !s.filterConn(c) {
+			continue
+		}
+		go s.spawn(l, c, config)
 	}
 }
 
 type poolSelector struct {
+	s       *Server
 	limited bool
 	wp      *workerPool
 }
 
 func (s *poolSelector) SelectPool(pkt *protocol.Packet) *worker.Pool {
+	// Key routes are set for SHA-1 SKIs.
+	s.s.canonicalSKI(&pkt.Operation)
 	if s.limited {
 		return s.wp.Limited
 	}
-	switch s.wp.selector(pkt) {
-	case PoolRSA:
-		return s.wp.RSA
-	case PoolECDSA:
-		return s.wp.ECDSA
-	default:
-		return s.wp.Other
-	}
+	return s.wp.pool(pkt)
 }
 
-func (s *Server) spawn(l net.Listener, c net.Conn) {
+func (s *Server) spawn(l net.Listener, c net.Conn, config *tls.Config) {
 	timeout := s.config.tcpTimeout
 	switch l.(type) {
 	case *net.TCPListener:
@@ -671,27 +1283,50 @@ func (s *Server) spawn(l net.Listener, c net.Conn) {
 		}
 	}
 
-	// Perform the TLS handshake explicitly so we can determine if this is a
-	// limited connection.
-	tconn := tls.Server(c, s.tlsConfig)
-	err := tconn.Handshake()
-	if err != nil {
-		// We get EOF here if the client closes the connection immediately after
-		// it's accepted, which is typical of a TCP health check.
-		if err == io.EOF {
-			log.Debugf("connection %v: closed by client before TLS handshake", c.RemoteAddr())
-		} else {
-			log.Errorf("connection %v: TLS handshake failed: %v", c.RemoteAddr(), err)
+	nc := c
+	var connState tls.ConnectionState
+	var identity *ClientIdentity
+	if noiseConn, ok := c.(*noise.Conn); ok {
+		if err := noiseConn.Handshake(); err != nil {
+			if errors.Is(err, io.EOF) {
+				s.log.Debugf("connection %v: closed by client before Noise handshake", c.RemoteAddr())
+			} else {
+				s.log.Errorf("connection %v: %v", c.RemoteAddr(), err)
+			}
+			noiseConn.Close()
+			return
 		}
-		tconn.Close()
-		return
+		identity = newNoiseIdentity(noiseConn.RemoteKey())
+	} else if config != nil {
+		// Perform the TLS handshake explicitly so we can determine if this is a
+		// limited connection.
+		tlsConn := tls.Server(c, config)
+		err := tlsConn.Handshake()
+		if err != nil {
+			// We get EOF here if the client closes the connection immediately after
+			// it's accepted, which is typical of a TCP health check.
+			if err == io.EOF {
+				s.log.Debugf("connection %v: closed by client before TLS handshake", c.RemoteAddr())
+			} else {
+				s.log.Errorf("connection %v: TLS handshake failed: %v", c.RemoteAddr(), err)
+			}
+			tlsConn.Close()
+			return
+		}
+		nc = tlsConn
+		connState = tlsConn.ConnectionState()
+		certmetrics.Observe(connState.PeerCertificates...)
+		if err := s.checkRevocation(connState.VerifiedChains); err != nil {
+			s.log.Warningf("connection %v: rejected client certificate: %v", c.RemoteAddr(), err)
+			tlsConn.Close()
+			return
+		}
+		identity = newClientIdentity(connState)
 	}
-	connState := tconn.ConnectionState()
-	certmetrics.Observe(connState.PeerCertificates...)
 	limited, err := s.config.isLimited(connState)
 	if err != nil {
-		log.Errorf("connection %v: could not determine if limited: %v", c.RemoteAddr(), err)
-		tconn.Close()
+		s.log.Errorf("connection %v: could not determine if limited: %v", c.RemoteAddr(), err)
+		nc.Close()
 		return
 	}
 
@@ -701,43 +1336,125 @@ func (s *Server) spawn(l net.Listener, c net.Conn) {
 	} else {
 		connStr = fmt.Sprintf("connection %v", c.RemoteAddr())
 	}
-	conn := newConn(c.RemoteAddr().String(), tconn, timeout, &poolSelector{limited, s.wp})
+	conn := newConn(c.RemoteAddr().String(), nc, timeout, &poolSelector{s, limited, s.wp}, identity)
+	conn.maxOutstanding = int64(s.config.maxOutstanding)
+	conn.log, conn.metrics = s.log, s.metrics
+	conn.config = s.config
+	conn.slo = s.slo
+	conn.usage = s.usage
+	conn.keepaliveInterval, conn.keepaliveTimeout = s.config.keepaliveInterval, s.config.keepaliveTimeout
+	if config != nil && len(connState.PeerCertificates) == 0 {
+		conn.verifier = s.config.tokenVerifier
+	}
+	ip := connIP(c.RemoteAddr())
 
 	// Acquire the lock to atomically spawn the reader/writer goroutines for
 	// this connection and add it to the connections map.
 	s.mtx.Lock()
 	if s.shutdown {
 		s.mtx.Unlock()
-		log.Debugf("%s: rejected (server is shutting down)", connStr)
-		tconn.Close()
+		s.log.Debugf("%s: rejected (server is shutting down)", connStr)
+		nc.Close()
+		return
+	}
+	if limit := s.connLimitExceeded(ip); limit != "" {
+		s.mtx.Unlock()
+		s.log.Warningf("%s: rejected (%s limit reached)", connStr, limit)
+		s.metrics.logLimitRejected(limit)
+		rejectConn(nc, timeout, protocol.ErrThrottled)
 		return
 	}
+	if s.config.rejectUntilReady && !s.Ready() {
+		s.mtx.Unlock()
+		s.log.Warningf("%s: rejected (server is not ready)", connStr)
+		rejectConn(nc, timeout, protocol.ErrNotReady)
+		return
+	}
+	s.conns[conn] = struct{}{}
+	if ip != "" {
+		s.connsPerIP[ip]++
+	}
 	handle := client.SpawnConn(conn)
 	s.listeners[l][handle] = struct{}{}
 	s.mtx.Unlock()
-	log.Debugf("%s: spawned", connStr)
+	s.log.Debugf("%s: spawned", connStr)
+	if s.config.connMaxAge > 0 {
+		t := time.AfterFunc(s.config.connMaxAge, func() { conn.retire("age") })
+		defer t.Stop()
+	}
 
 	// Block here until the connection and associated goroutines have completed.
 	handle.Wait()
-	log.Debugf("%s: closed", connStr)
+	s.log.Debugf("%s: closed", connStr)
+	hist := conn.history()
+	closed := time.Now()
+	hist.ClosedTime = &closed
 
 	// Acquire the lock again to remove the handle from the connections map. If
 	// we've shutdown in the meantime this is a safe no-op.
 	s.mtx.Lock()
 	delete(s.listeners[l], handle)
+	delete(s.conns, conn)
+	s.retainHistory(hist)
+	if ip != "" {
+		if s.connsPerIP[ip]--; s.connsPerIP[ip] == 0 {
+			delete(s.connsPerIP, ip)
+		}
+	}
 	s.mtx.Unlock()
-	log.Debugf("%s: removed", connStr)
+	s.log.Debugf("%s: removed", connStr)
+}
+
+// connLimitExceeded returns the name of the connection limit which a new
+// connection from ip would exceed, or "" if there is none. s.mtx must be held.
+func (s *Server) connLimitExceeded(ip string) string {
+	if s.config.maxConns > 0 && len(s.conns) >= s.config.maxConns {
+		return "connections"
+	}
+	if ip != "" && s.config.maxConnsPerIP > 0 && s.connsPerIP[ip] >= s.config.maxConnsPerIP {
+		return "connections_per_ip"
+	}
+	return ""
+}
+
+// connIP returns the IP address of a TCP client, or "" for other clients.
+func connIP(addr net.Addr) string {
+	if tcp, ok := addr.(*net.TCPAddr); ok {
+		return tcp.IP.String()
+	}
+	return ""
+}
+
+// rejectTimeout bounds how long a rejected connection is kept open waiting for
+// its first request, so that rejected clients don't hold on to connections.
+const rejectTimeout = time.Second
+
+// rejectConn answers the first request on a connection with code and closes
+// it, so that the client learns why it was rejected. The request must arrive
+// within timeout, and at most rejectTimeout.
+func rejectConn(c net.Conn, timeout time.Duration, code protocol.Error) {
+	defer c.Close()
+	if timeout <= 0 || timeout > rejectTimeout {
+		timeout = rejectTimeout
+	}
+	c.SetDeadline(time.Now().Add(timeout))
+	pkt := new(protocol.Packet)
+	if _, err := pkt.ReadFrom(c); err != nil {
+		return
+	}
+	resp := protocol.NewPacket(pkt.ID, protocol.MakeErrorOp(code))
+	resp.WriteTo(c)
 }
 
 // accept wraps l.Accept with capped exponential-backoff in the case of
 // temporary errors such as a lack of FDs.
-func accept(l net.Listener) (net.Conn, error) {
+func (s *Server) accept(l net.Listener) (net.Conn, error) {
 	backoff := 5 * time.Millisecond
 	for {
 		c, err := l.Accept()
 		if err != nil {
 			if ne, ok := err.(net.Error); ok && ne.Temporary() {
-				log.Errorf("Accept error: %v; retrying in %v", err, backoff)
+				s.log.Errorf("Accept error: %v; retrying in %v", err, backoff)
 				time.Sleep(backoff)
 
 				backoff = 2 * backoff
@@ -763,7 +1480,7 @@ func (s *Server) ListenAndServe(addr string) error {
 			return err
 		}
 
-		log.Infof("Listening at tcp://%s\n", l.Addr())
+		s.log.Infof("Listening at tcp://%s\n", l.Addr())
 		return s.Serve(l)
 	}
 	return errors.New("can't listen on empty address")
@@ -778,12 +1495,19 @@ func (s *Server) UnixListenAndServe(path string) error {
 			return err
 		}
 
-		log.Infof("Listening at unix://%s\n", l.Addr())
+		s.log.Infof("Listening at unix://%s\n", l.Addr())
 		return s.Serve(l)
 	}
 	return errors.New("can't listen on empty path")
 }
 
+// closed reports whether Close was called.
+func (s *Server) closed() bool {
+	s.mtx.Lock()
+	defer s.mtx.Unlock()
+	return s.shutdown
+}
+
 // Close shuts down the listeners and their active connections.
 func (s *Server) Close() error {
 	// Close each active listener. This will result in the blocking calls to
@@ -799,13 +1523,20 @@ func (s *Server) Close() error {
 	for l, conns := range s.listeners {
 		delete(s.listeners, l)
 
-		log.Debugf("Shutting down %v; closing %d active connections", l.Addr().String(), len(conns))
+		s.log.Debugf("Shutting down %v; closing %d active connections", l.Addr().String(), len(conns))
 		l.Close()
 		for conn := range conns {
 			conn.Destroy()
 		}
 	}
+	for _, srv := range s.httpServers {
+		srv.Close()
+	}
+	s.httpServers = nil
 	s.wp.Destroy()
+	if s.shadow != nil {
+		s.shadow.stop()
+	}
 
 	return nil
 }
@@ -816,6 +1547,7 @@ func (s *Server) Close() error {
 type ServeConfig struct {
 	rsaWorkers              int
 	ecdsaWorkers            int
+	rsaProcs                int
 	otherWorkers            int
 	limitedWorkers          int
 	bgWorkers               int
@@ -823,6 +1555,47 @@ type ServeConfig struct {
 	isLimited               func(state tls.ConnectionState) (bool, error)
 	customOpFunc            CustomOpFunction
 	poolSelector            WorkerPoolSelector
+	pools                   []WorkerPoolConfig
+	opRoutes                map[protocol.Op]WorkerPoolType
+	skiRoutes               map[protocol.SKI]WorkerPoolType
+	dedupOps                map[protocol.Op]bool
+	replayWindow            time.Duration
+	minResponseLength       int
+	strictPadding           bool
+	keyLimits               KeyLimitFunc
+	keyUsage                KeyUsageFunc
+	tokenVerifier           TokenVerifier
+	tenants                 TenantFunc
+	adminTokenVerifier      TokenVerifier
+	maxConns, maxConnsPerIP int
+	ipFilter                *IPFilter
+	revocation              *RevocationChecker
+	maxOutstanding          int
+	keepaliveInterval       time.Duration
+	keepaliveTimeout        time.Duration
+	middleware              []Middleware
+	deterministicECDSA      bool
+	lowS                    bool
+	rejectUntilReady        bool
+	hardened                bool
+	allowRSADecrypt         bool
+	verifySignatures        bool
+	skipVerifyBackends      map[string]bool
+	keyExpiryWindow         time.Duration
+	evictExpiredKeys        bool
+	skiSchemes              []protocol.SKIScheme
+	keyRemovedNotices       bool
+	maxStreamLength         int
+	connMaxAge              time.Duration
+	connMaxBytes            int64
+	connRetireGrace         time.Duration
+	timingHints             bool
+	payloadLimits           map[protocol.Op]int
+	defaultPayloadLimit     int
+	latencySLOs             map[protocol.Op]LatencySLO
+	sloFunc                 func(SLOStatus)
+	loadShed                map[protocol.Op]LoadShedPolicy
+	faults                  map[protocol.Op]Fault
 }
 
 const (
@@ -832,16 +1605,17 @@ const (
 
 // DefaultServeConfig constructs a default ServeConfig with the following
 // values:
-//  - The number of ECDSA workers is max(2, runtime.NumCPU())
-//  - The number of RSA workers is max(2, runtime.NumCPU())
-//  - The number of other workers is 2
-//  - The number of background workers is 1
-//  - The TCP connection timeout is 30 seconds
-//  - The Unix connection timeout is 1 hour
-//  - All connections have full power
+//   - The number of ECDSA workers is max(2, AvailableCPUs())
+//   - The number of RSA workers is max(2, AvailableCPUs())
+//   - RSA operations may use all CPUs
+//   - The number of other workers is 2
+//   - The number of background workers is 1
+//   - The TCP connection timeout is 30 seconds
+//   - The Unix connection timeout is 1 hour
+//   - All connections have full power
 func DefaultServeConfig() *ServeConfig {
-	n := runtime.NumCPU()
-	if runtime.NumCPU() < 2 {
+	n := AvailableCPUs()
+	if n < 2 {
 		n = 2
 	}
 	return &ServeConfig{
@@ -885,6 +1659,64 @@ func (s *ServeConfig) WorkerPoolSelector() WorkerPoolSelector {
 	return s.poolSelector
 }
 
+// WithWorkerPool defines an additional worker pool, to which requests can be
+// routed with WithOpcodePool, WithKeyPool or a WorkerPoolSelector, e.g. to
+// keep slow RSA-4096 operations from delaying ECDSA traffic.
+func (s *ServeConfig) WithWorkerPool(pool WorkerPoolConfig) *ServeConfig {
+	s.pools = append(s.pools, pool)
+	return s
+}
+
+// WorkerPools returns the additional worker pools.
+func (s *ServeConfig) WorkerPools() []WorkerPoolConfig {
+	return s.pools
+}
+
+// WithOpcodePool routes requests with opcode op to the named pool, which is
+// either built in or defined with WithWorkerPool, instead of the pool chosen
+// by the WorkerPoolSelector.
+func (s *ServeConfig) WithOpcodePool(op protocol.Op, pool WorkerPoolType) *ServeConfig {
+	if s.opRoutes == nil {
+		s.opRoutes = make(map[protocol.Op]WorkerPoolType)
+	}
+	s.opRoutes[op] = pool
+	return s
+}
+
+// OpcodePools returns the pools requests are routed to by opcode.
+func (s *ServeConfig) OpcodePools() map[protocol.Op]WorkerPoolType {
+	return s.opRoutes
+}
+
+// WithKeyPool routes requests for the key ski to the named pool, which is
+// either built in or defined with WithWorkerPool. Key routes take precedence
+// over opcode routes.
+func (s *ServeConfig) WithKeyPool(ski protocol.SKI, pool WorkerPoolType) *ServeConfig {
+	if s.skiRoutes == nil {
+		s.skiRoutes = make(map[protocol.SKI]WorkerPoolType)
+	}
+	s.skiRoutes[ski] = pool
+	return s
+}
+
+// KeyPools returns the pools requests are routed to by key.
+func (s *ServeConfig) KeyPools() map[protocol.SKI]WorkerPoolType {
+	return s.skiRoutes
+}
+
+func (s *ServeConfig) hasPool(name WorkerPoolType) bool {
+	switch name {
+	case PoolRSA, PoolECDSA, PoolOther:
+		return true
+	}
+	for _, pc := range s.pools {
+		if pc.Name == name {
+			return true
+		}
+	}
+	return false
+}
+
 // WithRSAWorkers specifies the number of RSA worker goroutines to use.
 func (s *ServeConfig) WithRSAWorkers(n int) *ServeConfig {
 	s.rsaWorkers = n
@@ -896,6 +1728,24 @@ func (s *ServeConfig) RSAWorkers() int {
 	return s.rsaWorkers
 }
 
+// WithRSAProcs bounds the number of RSA private key operations executed at
+// once, by the RSA pool or any other, to n, so that a burst of RSA-4096
+// signatures keeps at most n Ps busy and leaves the others to the goroutines
+// reading and writing connections. The Go scheduler can't pin goroutines to
+// Ps, so the bound is on concurrency rather than on particular CPUs. Further
+// operations wait in their worker for one to finish. Zero, the default, means
+// no bound; n should be less than AvailableCPUs to have any effect.
+func (s *ServeConfig) WithRSAProcs(n int) *ServeConfig {
+	s.rsaProcs = n
+	return s
+}
+
+// RSAProcs returns the bound on concurrent RSA private key operations, or
+// zero if there is none.
+func (s *ServeConfig) RSAProcs() int {
+	return s.rsaProcs
+}
+
 // WithECDSAWorkers specifies the number of ECDSA worker goroutines to use.
 func (s *ServeConfig) WithECDSAWorkers(n int) *ServeConfig {
 	s.ecdsaWorkers = n
@@ -978,6 +1828,567 @@ func (s *ServeConfig) WithIsLimited(f func(state tls.ConnectionState) (bool, err
 	return s
 }
 
+// WithDedupOps enables deduplication of requests with the given opcodes: while
+// a request is being executed, identical requests (same opcode, key identifiers
+// and payload) from the same client and tenant wait for it and receive a copy
+// of its result instead of performing the operation again. This protects slow
+// keys from retry storms.
+func (s *ServeConfig) WithDedupOps(ops ...protocol.Op) *ServeConfig {
+	s.dedupOps = make(map[protocol.Op]bool, len(ops))
+	for _, op := range ops {
+		s.dedupOps[op] = true
+	}
+	return s
+}
+
+// DedupOps returns the opcodes for which identical requests are deduplicated.
+func (s *ServeConfig) DedupOps() []protocol.Op {
+	var ops []protocol.Op
+	for op := range s.dedupOps {
+		ops = append(ops, op)
+	}
+	sort.Slice(ops, func(i, j int) bool { return ops[i] < ops[j] })
+	return ops
+}
+
+// WithReplayDetection rejects signing and decryption requests which repeat
+// one seen within window, with the same client, packet ID and operation, as
+// when a captured request is replayed. They are answered with
+// protocol.ErrReplayed, logged and counted by the keyless_replays_rejected
+// metric. Clients are identified by their certificate or token, or else by
+// their IP address. Zero disables detection.
+func (s *ServeConfig) WithReplayDetection(window time.Duration) *ServeConfig {
+	s.replayWindow = window
+	return s
+}
+
+// ReplayDetection returns the window within which replayed requests are
+// rejected, or zero if they aren't.
+func (s *ServeConfig) ReplayDetection() time.Duration {
+	return s.replayWindow
+}
+
+// WithMinResponseLength pads every response to at least n bytes, header
+// included, even to clients which negotiated protocol.PaddingOptional, so
+// that the lengths of responses don't give away their operations or keys to
+// an observer of the traffic. Responses are always padded to 1024 bytes
+// otherwise. Zero disables it.
+func (s *ServeConfig) WithMinResponseLength(n int) *ServeConfig {
+	s.minResponseLength = n
+	return s
+}
+
+// MinResponseLength returns the length responses are padded to, or zero if
+// they are only padded as the protocol requires.
+func (s *ServeConfig) MinResponseLength() int {
+	return s.minResponseLength
+}
+
+// WithStrictPadding rejects requests whose padding items aren't all zero
+// bytes, or which aren't padded to 1024 bytes although the client didn't
+// negotiate protocol.PaddingOptional. They are answered with
+// protocol.ErrFormat, logged and counted by the keyless_padding_rejected
+// metric. Otherwise any padding is accepted.
+func (s *ServeConfig) WithStrictPadding(strict bool) *ServeConfig {
+	s.strictPadding = strict
+	return s
+}
+
+// StrictPadding reports whether requests with invalid padding are rejected.
+func (s *ServeConfig) StrictPadding() bool {
+	return s.strictPadding
+}
+
+// WithKeyLimits limits the number of concurrent operations per key or group of
+// keys as returned by f, e.g. PerSKIKeyLimit. Requests which can't get a slot
+// in time fail with protocol.ErrThrottled.
+func (s *ServeConfig) WithKeyLimits(f KeyLimitFunc) *ServeConfig {
+	s.keyLimits = f
+	return s
+}
+
+// KeyLimits returns the KeyLimitFunc, or nil if keys are not limited.
+func (s *ServeConfig) KeyLimits() KeyLimitFunc {
+	return s.keyLimits
+}
+
+// WithKeyUsage restricts the operations each key may be used for to those
+// allowed by f, e.g. PerSKIKeyUsage. Requests for other operations fail with
+// protocol.ErrKeyUsage. Keys can also be restricted in the keystore with
+// DefaultKeystore.SetKeyUsage.
+func (s *ServeConfig) WithKeyUsage(f KeyUsageFunc) *ServeConfig {
+	s.keyUsage = f
+	return s
+}
+
+// KeyUsage returns the KeyUsageFunc, or nil if keys are not restricted.
+func (s *ServeConfig) KeyUsage() KeyUsageFunc {
+	return s.keyUsage
+}
+
+// WithMiddleware appends mw to the middleware every request is passed through
+// before it is executed. The first middleware added is the outermost.
+func (s *ServeConfig) WithMiddleware(mw ...Middleware) *ServeConfig {
+	s.middleware = append(s.middleware, mw...)
+	return s
+}
+
+// Middleware returns the middleware requests are passed through.
+func (s *ServeConfig) Middleware() []Middleware {
+	return s.middleware
+}
+
+// WithTokenVerifier lets clients which present no certificate authenticate
+// with a bearer token verified by v instead. Such clients can only ping, hello
+// and attest until they have. The server's TLS configuration must not require
+// client certificates for them to connect, e.g. with
+// tls.VerifyClientCertIfGiven.
+func (s *ServeConfig) WithTokenVerifier(v TokenVerifier) *ServeConfig {
+	s.tokenVerifier = v
+	return s
+}
+
+// TokenVerifier returns the verifier of the tokens clients authenticate with,
+// if any.
+func (s *ServeConfig) TokenVerifier() TokenVerifier {
+	return s.tokenVerifier
+}
+
+// WithTenants makes the server serve several tenants, whose IDs f derives
+// from the identities of clients. The tenant of each request is available to
+// keystores with TenantFromContext, so that a TenantKeystore only finds the
+// keys of the client's tenant. Requests are counted by tenant by the
+// keyless_tenant_requests metric, and audit records name the tenant.
+func (s *ServeConfig) WithTenants(f TenantFunc) *ServeConfig {
+	s.tenants = f
+	return s
+}
+
+// Tenants returns the function deriving the tenants of clients, if any.
+func (s *ServeConfig) Tenants() TenantFunc {
+	return s.tenants
+}
+
+// WithAdminTokenVerifier requires requests to AdminHandler to carry a bearer
+// token verified by v. AdminHandler refuses every request without one.
+func (s *ServeConfig) WithAdminTokenVerifier(v TokenVerifier) *ServeConfig {
+	s.adminTokenVerifier = v
+	return s
+}
+
+// AdminTokenVerifier returns the verifier of the tokens admin requests are
+// authenticated with, if any.
+func (s *ServeConfig) AdminTokenVerifier() TokenVerifier {
+	return s.adminTokenVerifier
+}
+
+// WithConnectionLimits limits the number of concurrent client connections in
+// total and from each client IP address. Zero means no limit. A connection
+// beyond either limit gets protocol.ErrThrottled in response to its first
+// request and is then closed.
+func (s *ServeConfig) WithConnectionLimits(total, perIP int) *ServeConfig {
+	s.maxConns = total
+	s.maxConnsPerIP = perIP
+	return s
+}
+
+// ConnectionLimits returns the maximum number of concurrent client connections
+// in total and from each client IP address.
+func (s *ServeConfig) ConnectionLimits() (total, perIP int) {
+	return s.maxConns, s.maxConnsPerIP
+}
+
+// WithIPFilter restricts the client IP addresses which may connect to the
+// server, for both keyless and HTTP/2 listeners. Connections from other
+// addresses are closed before the TLS handshake, and counted by the
+// keyless_ip_filter_rejected metric. Clients on Unix sockets are not
+// filtered.
+func (s *ServeConfig) WithIPFilter(f *IPFilter) *ServeConfig {
+	s.ipFilter = f
+	return s
+}
+
+// IPFilter returns the filter of the client IP addresses which may connect to
+// the server, if any.
+func (s *ServeConfig) IPFilter() *IPFilter {
+	return s.ipFilter
+}
+
+// WithRevocationChecker checks the certificates of clients with rc once they
+// have been verified, and closes the connections of clients whose
+// certificates are revoked, or whose status is unknown unless rc soft-fails.
+// Checks are counted by the keyless_revocation_checks metric, by result.
+func (s *ServeConfig) WithRevocationChecker(rc *RevocationChecker) *ServeConfig {
+	s.revocation = rc
+	return s
+}
+
+// RevocationChecker returns the checker of the revocation of client
+// certificates, if any.
+func (s *ServeConfig) RevocationChecker() *RevocationChecker {
+	return s.revocation
+}
+
+// WithMaxOutstandingRequests limits the number of unanswered requests on each
+// connection. Zero means no limit. Requests beyond the limit are answered
+// with protocol.ErrThrottled immediately instead of being queued.
+func (s *ServeConfig) WithMaxOutstandingRequests(n int) *ServeConfig {
+	s.maxOutstanding = n
+	return s
+}
+
+// MaxOutstandingRequests returns the maximum number of unanswered requests on
+// each connection.
+func (s *ServeConfig) MaxOutstandingRequests() int {
+	return s.maxOutstanding
+}
+
+// WithLatencySLOs sets latency objectives for the requests with some opcodes,
+// at most one per opcode. Each is checked at most every second against the
+// latencies of the last 1024 requests with its opcode, once there are 100.
+// The keyless_slo_latency_seconds metric reports the latency percentile of
+// each, and keyless_slo_breaches counts the times they started being
+// breached. If f is set, it is called with the status of an SLO whenever it
+// starts or stops being breached, e.g. to page through an alerting pipeline;
+// it must not block.
+func (s *ServeConfig) WithLatencySLOs(f func(SLOStatus), slos ...LatencySLO) *ServeConfig {
+	s.latencySLOs = make(map[protocol.Op]LatencySLO, len(slos))
+	for _, slo := range slos {
+		s.latencySLOs[slo.Op] = slo
+	}
+	s.sloFunc = f
+	return s
+}
+
+// LatencySLOs returns the latency objectives set with WithLatencySLOs.
+func (s *ServeConfig) LatencySLOs() []LatencySLO {
+	slos := make([]LatencySLO, 0, len(s.latencySLOs))
+	for _, slo := range s.latencySLOs {
+		slos = append(slos, slo)
+	}
+	sort.Slice(slos, func(i, j int) bool { return slos[i].Op < slos[j].Op })
+	return slos
+}
+
+// WithLoadShedding sets load shedding policies, at most one per opcode. The
+// queueing delay of the requests executed by the workers is smoothed, and
+// while it stays over the QueueDelay of a policy for longer than its Sustain,
+// the requests with its opcode are answered with protocol.ErrThrottled, which
+// clients may retry later or on another server, instead of being executed.
+// Shedding RSA decryptions and signatures leaves the CPUs to ECDSA signatures,
+// which are much cheaper, so that more handshakes complete overall. Shed
+// requests are counted by keyless_limit_rejected with the "load" limit.
+func (s *ServeConfig) WithLoadShedding(policies ...LoadShedPolicy) *ServeConfig {
+	s.loadShed = make(map[protocol.Op]LoadShedPolicy, len(policies))
+	for _, policy := range policies {
+		s.loadShed[policy.Op] = policy
+	}
+	return s
+}
+
+// LoadShedding returns the load shedding policies set with WithLoadShedding.
+func (s *ServeConfig) LoadShedding() []LoadShedPolicy {
+	policies := make([]LoadShedPolicy, 0, len(s.loadShed))
+	for _, policy := range s.loadShed {
+		policies = append(policies, policy)
+	}
+	sort.Slice(policies, func(i, j int) bool { return policies[i].Op < policies[j].Op })
+	return policies
+}
+
+// WithFaultInjection injects faults into the responses to requests with some
+// opcodes on keyless protocol connections, at most one fault per opcode, so
+// that clients can be tested against a misbehaving keyserver. It must not be used in production. Injected faults
+// are counted by keyless_faults_injected.
+func (s *ServeConfig) WithFaultInjection(faults ...Fault) *ServeConfig {
+	s.faults = make(map[protocol.Op]Fault, len(faults))
+	for _, f := range faults {
+		s.faults[f.Op] = f
+	}
+	return s
+}
+
+// FaultInjection returns the faults set with WithFaultInjection.
+func (s *ServeConfig) FaultInjection() []Fault {
+	faults := make([]Fault, 0, len(s.faults))
+	for _, f := range s.faults {
+		faults = append(faults, f)
+	}
+	sort.Slice(faults, func(i, j int) bool { return faults[i].Op < faults[j].Op })
+	return faults
+}
+
+// payloadLimitSlack is the room left for the other items and padding of a
+// request when its packet length is bounded by the payload limits.
+const payloadLimitSlack = 2048
+
+// WithPayloadLimit limits the payload of requests with opcode op to n bytes,
+// e.g. to a few hundred bytes for signatures of digests, overriding any
+// default limit. Zero means no limit. Requests with larger payloads are
+// answered with protocol.ErrFormat before they are queued.
+func (s *ServeConfig) WithPayloadLimit(op protocol.Op, n int) *ServeConfig {
+	if s.payloadLimits == nil {
+		s.payloadLimits = make(map[protocol.Op]int)
+	}
+	s.payloadLimits[op] = n
+	return s
+}
+
+// WithDefaultPayloadLimit limits the payload of requests whose opcode has no
+// limit set with WithPayloadLimit to n bytes. Zero means no limit. Once set,
+// the body of packets too long for any payload limit is discarded as it is
+// read rather than buffered, which bounds the memory held for each
+// connection.
+func (s *ServeConfig) WithDefaultPayloadLimit(n int) *ServeConfig {
+	s.defaultPayloadLimit = n
+	return s
+}
+
+// PayloadLimit returns the largest payload accepted in requests with opcode
+// op, or zero if there is no limit.
+func (s *ServeConfig) PayloadLimit(op protocol.Op) int {
+	if n, ok := s.payloadLimits[op]; ok {
+		return n
+	}
+	return s.defaultPayloadLimit
+}
+
+// WithMaxStreamLength limits the payload of operations streamed with
+// OpStream, such as OpSeal and OpUnseal of blobs too large for a packet, to n
+// bytes, which each connection may buffer for up to 4 streams at once. Zero
+// restores the default of 16 MiB. The payload limits apply to the chunks, as
+// requests with opcode OpStream, rather than to the whole payload.
+func (s *ServeConfig) WithMaxStreamLength(n int) *ServeConfig {
+	s.maxStreamLength = n
+	return s
+}
+
+// MaxStreamLength returns the largest payload of an operation streamed with
+// OpStream.
+func (s *ServeConfig) MaxStreamLength() int {
+	if s.maxStreamLength <= 0 {
+		return defaultMaxStreamLength
+	}
+	return s.maxStreamLength
+}
+
+// maxPacketLength returns the length of the body of the largest request
+// allowed by the payload limits, or zero if some opcodes have no limit.
+func (s *ServeConfig) maxPacketLength() int {
+	if s.defaultPayloadLimit <= 0 {
+		return 0
+	}
+	max := s.defaultPayloadLimit
+	for _, n := range s.payloadLimits {
+		if n <= 0 {
+			return 0
+		}
+		if n > max {
+			max = n
+		}
+	}
+	return max + payloadLimitSlack
+}
+
+// payloadTooLarge reports whether the payload of op is over its limit, which
+// is logged to log and counted in metrics.
+func (s *ServeConfig) payloadTooLarge(op *protocol.Operation, log *serverLogger, metrics *serverMetrics) bool {
+	limit := s.PayloadLimit(op.Opcode)
+	if limit <= 0 || len(op.Payload) <= limit {
+		return false
+	}
+	log.Warningf("rejected %s request with a %dB payload, over the limit of %dB", op.Opcode, len(op.Payload), limit)
+	metrics.logLimitRejected("payload")
+	return true
+}
+
+// WithKeepalive pings clients which negotiated keepalive with OpHello once
+// their connection has been idle for interval, and disconnects them if they
+// don't answer within timeout (interval if zero). Such clients are no longer
+// disconnected for being idle for the TCP or Unix timeout, which then only
+// applies to others. Zero interval disables keepalive pings.
+func (s *ServeConfig) WithKeepalive(interval, timeout time.Duration) *ServeConfig {
+	if timeout <= 0 {
+		timeout = interval
+	}
+	s.keepaliveInterval, s.keepaliveTimeout = interval, timeout
+	return s
+}
+
+// Keepalive returns the idle interval after which clients are pinged, and how
+// long they have to answer.
+func (s *ServeConfig) Keepalive() (interval, timeout time.Duration) {
+	return s.keepaliveInterval, s.keepaliveTimeout
+}
+
+// WithDeterministicECDSA makes ECDSA signatures by software keys deterministic,
+// with nonces derived from the key and message as specified in RFC 6979,
+// instead of random.
+func (s *ServeConfig) WithDeterministicECDSA(enabled bool) *ServeConfig {
+	s.deterministicECDSA = enabled
+	return s
+}
+
+// DeterministicECDSA reports whether ECDSA signatures by software keys are
+// deterministic.
+func (s *ServeConfig) DeterministicECDSA() bool {
+	return s.deterministicECDSA
+}
+
+// WithLowSECDSA normalizes all ECDSA signatures, including those made by
+// hardware and cloud keys, to the low-S form for verifiers which reject
+// high-S signatures as malleable.
+func (s *ServeConfig) WithLowSECDSA(enabled bool) *ServeConfig {
+	s.lowS = enabled
+	return s
+}
+
+// LowSECDSA reports whether ECDSA signatures are normalized to the low-S form.
+func (s *ServeConfig) LowSECDSA() bool {
+	return s.lowS
+}
+
+// WithHardenedSigning enables the hardened mode, in which RSA signatures and
+// decryptions are checked before they are returned, so that a fault in the
+// CRT computation can't leak the key, decrypters are always given randomness
+// to blind with, and weak keys, such as RSA keys shorter than MinRSABits, are
+// reported as they are loaded. Software RSA keys are always blinded. RSA
+// decryption (OpRSADecrypt), which exposes PKCS#1 v1.5 padding oracles to
+// Bleichenbacher's attack, is rejected with protocol.ErrKeyUsage unless
+// allowRSADecrypt is set.
+func (s *ServeConfig) WithHardenedSigning(enabled, allowRSADecrypt bool) *ServeConfig {
+	s.hardened = enabled
+	s.allowRSADecrypt = allowRSADecrypt
+	return s
+}
+
+// HardenedSigning reports whether the hardened mode is enabled, and whether it
+// allows RSA decryption.
+func (s *ServeConfig) HardenedSigning() (enabled, allowRSADecrypt bool) {
+	return s.hardened, s.allowRSADecrypt
+}
+
+// WithSignatureVerification verifies every signature under the public key of
+// the key which made it before returning it, so that signatures corrupted by a
+// hardware fault or a buggy backend are never returned; they are answered
+// with protocol.ErrCrypto and counted by backend. Signatures made by keys of
+// the skipBackends, such as BackendPKCS11, aren't verified, to turn the check
+// off for a backend which is trusted or known to verify its signatures.
+func (s *ServeConfig) WithSignatureVerification(enabled bool, skipBackends ...string) *ServeConfig {
+	s.verifySignatures = enabled
+	s.skipVerifyBackends = make(map[string]bool, len(skipBackends))
+	for _, backend := range skipBackends {
+		s.skipVerifyBackends[backend] = true
+	}
+	return s
+}
+
+// SignatureVerification reports whether signatures are verified before they
+// are returned, and the backends whose signatures aren't, sorted.
+func (s *ServeConfig) SignatureVerification() (enabled bool, skipBackends []string) {
+	for backend := range s.skipVerifyBackends {
+		skipBackends = append(skipBackends, backend)
+	}
+	sort.Strings(skipBackends)
+	return s.verifySignatures, skipBackends
+}
+
+// WithKeyExpiry sets how Server.CheckKeyExpiry treats the keys whose
+// certificates, in the server's CertIndex, have all expired or expire within
+// window: they are flagged in logs and metrics, and with evict, the expired
+// ones are evicted from the keystore.
+func (s *ServeConfig) WithKeyExpiry(window time.Duration, evict bool) *ServeConfig {
+	s.keyExpiryWindow = window
+	s.evictExpiredKeys = evict
+	return s
+}
+
+// KeyExpiry returns the window within which the expiry of keys' certificates
+// is flagged, and whether keys with expired certificates are evicted.
+func (s *ServeConfig) KeyExpiry() (window time.Duration, evict bool) {
+	return s.keyExpiryWindow, s.evictExpiredKeys
+}
+
+// WithRejectUntilReady rejects connections until every readiness check added
+// with Server.AddReadinessCheck has passed. Their first request gets
+// protocol.ErrNotReady, which clients can retry on another server.
+func (s *ServeConfig) WithRejectUntilReady(enabled bool) *ServeConfig {
+	s.rejectUntilReady = enabled
+	return s
+}
+
+// RejectUntilReady reports whether connections are rejected until the server
+// is ready.
+func (s *ServeConfig) RejectUntilReady() bool {
+	return s.rejectUntilReady
+}
+
+// WithSKISchemes sets the SKI schemes offered to clients in OpHello, in order
+// of preference. Clients which negotiate SKISchemeSHA256 send the SHA-256 SKIs
+// of keys, which keystores implementing CanonicalSKI resolve to the SHA-1 SKIs
+// keys are added under; clients which don't keep sending SHA-1 SKIs. Only
+// protocol.SKISchemeSHA1 should be offered if the keystore can't resolve
+// SHA-256 SKIs.
+func (s *ServeConfig) WithSKISchemes(schemes ...protocol.SKIScheme) *ServeConfig {
+	s.skiSchemes = schemes
+	return s
+}
+
+// WithKeyRemovedNotices offers clients to be told with protocol.OpKeyRemoved
+// when a key is removed from the keystore, e.g. with the admin API or when its
+// file is deleted, so that they can prune their maps of which servers hold a
+// key rather than finding out with a failed request.
+func (s *ServeConfig) WithKeyRemovedNotices(enabled bool) *ServeConfig {
+	s.keyRemovedNotices = enabled
+	return s
+}
+
+// KeyRemovedNotices reports whether clients are offered key removal notices.
+func (s *ServeConfig) KeyRemovedNotices() bool {
+	return s.keyRemovedNotices
+}
+
+// WithConnLifetime retires each connection once it has been open for maxAge or
+// carried maxBytes in both directions, if they are positive, so that clients
+// reconnect periodically and the TLS keys of connections are renewed. Clients
+// which negotiated protocol.FeatureReconnect are asked to reconnect with
+// protocol.OpReconnect, and others are disconnected once they have no
+// outstanding request; in both cases, connections are closed after grace, 30
+// seconds if it isn't positive. Retirements are counted by the
+// keyless_connections_retired metric, by reason.
+func (s *ServeConfig) WithConnLifetime(maxAge time.Duration, maxBytes int64, grace time.Duration) *ServeConfig {
+	s.connMaxAge, s.connMaxBytes, s.connRetireGrace = maxAge, maxBytes, grace
+	return s
+}
+
+// ConnLifetime returns the maximum age and size of connections, and the grace
+// period retired connections are kept open for.
+func (s *ServeConfig) ConnLifetime() (maxAge time.Duration, maxBytes int64, grace time.Duration) {
+	return s.connMaxAge, s.connMaxBytes, s.connRetireGrace
+}
+
+// WithTimingHints offers clients to be told with protocol.Timing how long each
+// of their requests queued and was processed, so that they can tell network
+// latency from server-side queueing.
+func (s *ServeConfig) WithTimingHints(enabled bool) *ServeConfig {
+	s.timingHints = enabled
+	return s
+}
+
+// TimingHints reports whether clients are offered timing hints.
+func (s *ServeConfig) TimingHints() bool {
+	return s.timingHints
+}
+
+// SKISchemes returns the SKI schemes offered to clients, DefaultSKISchemes
+// unless set with WithSKISchemes.
+func (s *ServeConfig) SKISchemes() []protocol.SKIScheme {
+	if s.skiSchemes == nil {
+		return DefaultSKISchemes
+	}
+	return s.skiSchemes
+}
+
 // CustomOpFunction is the signature for custom opcode functions.
 //
 // If it returns a non-nil error which implements protocol.Error, the server
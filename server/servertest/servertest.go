@@ -0,0 +1,160 @@
+// Package servertest runs in-process keyservers on loopback addresses, with
+// certificates generated for each test, so that downstream projects can write
+// integration tests against a real keyserver and client without managing
+// testdata PEMs.
+package servertest
+
+import (
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"math/big"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/cloudflare/gokeyless/client"
+	"github.com/cloudflare/gokeyless/server"
+)
+
+// A TestServer is a keyserver listening on a loopback address, and a client
+// configured to use it.
+type TestServer struct {
+	// Server is the keyserver, which may be configured further.
+	Server *server.Server
+	// Keys is the keystore of Server, holding the keys it was started with.
+	Keys *server.DefaultKeystore
+	// Client trusts Server, authenticates to it with a certificate Server
+	// trusts, and has Server as its DefaultRemote, so that the keyserver
+	// argument of its methods may be empty.
+	Client *client.Client
+	// Addr is the host:port Server listens on.
+	Addr string
+	// CA is the pool of the CA which issued the certificates of Server and
+	// Client, for further clients and servers.
+	CA *x509.CertPool
+	// ClientCertificate is Client's certificate, signed by the CA.
+	ClientCertificate tls.Certificate
+}
+
+// StartTestServer starts a keyserver holding keys with the default
+// configuration, and returns a client configured to use it: the keys' remote
+// signers are returned by its NewRemoteSignerByPublicKey with an empty
+// keyserver. The server is closed when the test completes.
+func StartTestServer(t testing.TB, keys ...crypto.Signer) *client.Client {
+	return NewTestServer(t, nil, keys...).Client
+}
+
+// NewTestServer is like StartTestServer, but starts the keyserver with config,
+// which is server.DefaultServeConfig() if nil, and returns the TestServer.
+func NewTestServer(t testing.TB, config *server.ServeConfig, keys ...crypto.Signer) *TestServer {
+	t.Helper()
+	caKey, ca, err := newCA()
+	if err != nil {
+		t.Fatalf("servertest: cannot create CA: %v", err)
+	}
+	pool := x509.NewCertPool()
+	pool.AddCert(ca)
+	serverCert, err := issue(ca, caKey, &x509.Certificate{
+		Subject:     pkix.Name{CommonName: "localhost"},
+		DNSNames:    []string{"localhost"},
+		IPAddresses: []net.IP{net.IPv4(127, 0, 0, 1)},
+		ExtKeyUsage: []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth},
+	})
+	if err != nil {
+		t.Fatalf("servertest: cannot issue server certificate: %v", err)
+	}
+	clientCert, err := issue(ca, caKey, &x509.Certificate{
+		Subject:     pkix.Name{CommonName: "servertest client"},
+		ExtKeyUsage: []x509.ExtKeyUsage{x509.ExtKeyUsageClientAuth},
+	})
+	if err != nil {
+		t.Fatalf("servertest: cannot issue client certificate: %v", err)
+	}
+
+	s, err := server.NewServer(config, serverCert, pool)
+	if err != nil {
+		t.Fatalf("servertest: cannot create server: %v", err)
+	}
+	keystore := server.NewDefaultKeystore()
+	for _, key := range keys {
+		if err := keystore.Add(nil, key); err != nil {
+			t.Fatalf("servertest: cannot add key: %v", err)
+		}
+	}
+	s.SetKeystore(keystore)
+
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("servertest: cannot listen: %v", err)
+	}
+	go s.Serve(l)
+	t.Cleanup(func() {
+		s.Close()
+		// Serve may not have added the listener by the time s is closed.
+		l.Close()
+	})
+
+	c := client.NewClient(clientCert, pool)
+	c.DefaultRemote = client.NewServer(l.Addr(), "localhost")
+	return &TestServer{
+		Server:            s,
+		Keys:              keystore,
+		Client:            c,
+		Addr:              l.Addr().String(),
+		CA:                pool,
+		ClientCertificate: clientCert,
+	}
+}
+
+// newCA returns the key and self-signed certificate of a new CA.
+func newCA() (*ecdsa.PrivateKey, *x509.Certificate, error) {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		return nil, nil, err
+	}
+	tmpl := &x509.Certificate{
+		SerialNumber:          big.NewInt(1),
+		Subject:               pkix.Name{CommonName: "servertest CA"},
+		NotBefore:             time.Now().Add(-time.Hour),
+		NotAfter:              time.Now().Add(24 * time.Hour),
+		KeyUsage:              x509.KeyUsageCertSign,
+		BasicConstraintsValid: true,
+		IsCA:                  true,
+	}
+	der, err := x509.CreateCertificate(rand.Reader, tmpl, tmpl, &key.PublicKey, key)
+	if err != nil {
+		return nil, nil, err
+	}
+	cert, err := x509.ParseCertificate(der)
+	return key, cert, err
+}
+
+// issue returns a certificate from tmpl, with a new key, signed by the CA.
+func issue(ca *x509.Certificate, caKey crypto.Signer, tmpl *x509.Certificate) (tls.Certificate, error) {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		return tls.Certificate{}, err
+	}
+	serial, err := rand.Int(rand.Reader, new(big.Int).Lsh(big.NewInt(1), 128))
+	if err != nil {
+		return tls.Certificate{}, err
+	}
+	tmpl.SerialNumber = serial
+	tmpl.NotBefore = ca.NotBefore
+	tmpl.NotAfter = ca.NotAfter
+	tmpl.KeyUsage = x509.KeyUsageDigitalSignature
+	der, err := x509.CreateCertificate(rand.Reader, tmpl, ca, &key.PublicKey, caKey)
+	if err != nil {
+		return tls.Certificate{}, err
+	}
+	leaf, err := x509.ParseCertificate(der)
+	if err != nil {
+		return tls.Certificate{}, err
+	}
+	return tls.Certificate{Certificate: [][]byte{der}, PrivateKey: key, Leaf: leaf}, nil
+}
@@ -0,0 +1,92 @@
+package servertest
+
+import (
+	"context"
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"testing"
+
+	"github.com/cloudflare/gokeyless/server"
+)
+
+func TestStartTestServer(t *testing.T) {
+	ecdsaKey, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	rsaKey, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatal(err)
+	}
+	c := StartTestServer(t, ecdsaKey, rsaKey)
+
+	digest := sha256.Sum256([]byte("Hello World!"))
+	signer, err := c.NewRemoteSignerByPublicKey(context.Background(), "", ecdsaKey.Public())
+	if err != nil {
+		t.Fatal(err)
+	}
+	sig, err := signer.Sign(rand.Reader, digest[:], crypto.SHA256)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !ecdsa.VerifyASN1(&ecdsaKey.PublicKey, digest[:], sig) {
+		t.Fatal("ECDSA signature doesn't verify")
+	}
+
+	signer, err = c.NewRemoteSignerByPublicKey(context.Background(), "", rsaKey.Public())
+	if err != nil {
+		t.Fatal(err)
+	}
+	sig, err = signer.Sign(rand.Reader, digest[:], crypto.SHA256)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := rsa.VerifyPKCS1v15(&rsaKey.PublicKey, crypto.SHA256, digest[:], sig); err != nil {
+		t.Fatalf("RSA signature doesn't verify: %v", err)
+	}
+
+	// Keys the server doesn't hold aren't found.
+	other, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	signer, err = c.NewRemoteSignerByPublicKey(context.Background(), "", other.Public())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := signer.Sign(rand.Reader, digest[:], crypto.SHA256); err == nil {
+		t.Fatal("signed with a key the server doesn't hold")
+	}
+}
+
+func TestNewTestServer(t *testing.T) {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ts := NewTestServer(t, server.DefaultServeConfig().WithTimingHints(true))
+	if !ts.Server.Config().TimingHints() {
+		t.Fatal("server doesn't use the given configuration")
+	}
+
+	// Keys may be added once the server runs.
+	if err := ts.Keys.Add(nil, key); err != nil {
+		t.Fatal(err)
+	}
+	digest := sha256.Sum256([]byte("Hello World!"))
+	signer, err := ts.Client.NewRemoteSignerByPublicKey(context.Background(), ts.Addr, key.Public())
+	if err != nil {
+		t.Fatal(err)
+	}
+	sig, err := signer.Sign(rand.Reader, digest[:], crypto.SHA256)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !ecdsa.VerifyASN1(&key.PublicKey, digest[:], sig) {
+		t.Fatal("signature doesn't verify")
+	}
+}
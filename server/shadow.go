@@ -0,0 +1,341 @@
+package server
+
+import (
+	"bytes"
+	"context"
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/ed25519"
+	"crypto/rand"
+	"crypto/rsa"
+	"errors"
+	"fmt"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/cloudflare/gokeyless/protocol"
+	textbook_rsa "github.com/cloudflare/gokeyless/server/internal/rsa"
+	"github.com/cloudflare/gokeyless/sm2"
+)
+
+const (
+	// shadowQueueSize is the number of mirrored requests which can wait for
+	// a shadow worker; requests mirrored while the queue is full are dropped.
+	shadowQueueSize = 128
+	// shadowTimeout bounds the execution of a mirrored request.
+	shadowTimeout = 10 * time.Second
+)
+
+// ShadowStats counts the requests mirrored to the shadow keystore, by the
+// result of comparing the shadow backend with the primary one.
+type ShadowStats struct {
+	// Matches is the number of requests whose results were equivalent.
+	Matches uint64 `json:"matches"`
+	// Mismatches is the number of requests whose results diverged.
+	Mismatches uint64 `json:"mismatches"`
+	// Dropped is the number of requests which were not mirrored because the
+	// shadow backend was falling behind.
+	Dropped uint64 `json:"dropped"`
+}
+
+// shadow mirrors the signing and decryption requests served by a Server to
+// a shadow keystore, and compares the results.
+type shadow struct {
+	s    *Server
+	keys Keystore
+	wg   sync.WaitGroup
+
+	// mtx guards jobs from being closed while requests are queued.
+	mtx    sync.RWMutex
+	jobs   chan shadowJob
+	closed bool
+
+	matches, mismatches, dropped uint64
+}
+
+// shadowJob is a request served by the primary backend, to be executed again
+// by the shadow one.
+type shadowJob struct {
+	ctx    context.Context
+	op     protocol.Operation
+	result []byte
+	err    protocol.Error
+	// duration is the time the primary backend took to execute the request.
+	duration time.Duration
+}
+
+// SetShadowKeystore mirrors the signing and decryption requests served by s
+// to keys, e.g. a new KMS integration which is to replace the current
+// keystore. Each request is answered with the result of the primary keystore
+// as usual, and executed again in the background by one of workers
+// goroutines with the key keys returns. The results and latencies of both
+// backends are compared, divergences are logged, and they are counted by the
+// keyless_shadow_results metric and ShadowStats. A nil keys stops mirroring.
+// It is NOT safe to call concurrently with any other methods.
+func (s *Server) SetShadowKeystore(keys Keystore, workers int) {
+	if s.shadow != nil {
+		s.shadow.stop()
+		s.shadow = nil
+	}
+	if keys == nil {
+		return
+	}
+	if workers < 1 {
+		workers = 1
+	}
+	sh := &shadow{s: s, keys: keys, jobs: make(chan shadowJob, shadowQueueSize)}
+	sh.wg.Add(workers)
+	for i := 0; i < workers; i++ {
+		go sh.work()
+	}
+	s.shadow = sh
+}
+
+// ShadowStats returns the counts of the requests mirrored to the shadow
+// keystore since it was set.
+func (s *Server) ShadowStats() ShadowStats {
+	sh := s.shadow
+	if sh == nil {
+		return ShadowStats{}
+	}
+	return ShadowStats{
+		Matches:    atomic.LoadUint64(&sh.matches),
+		Mismatches: atomic.LoadUint64(&sh.mismatches),
+		Dropped:    atomic.LoadUint64(&sh.dropped),
+	}
+}
+
+// stop stops the shadow workers once they have executed the queued requests.
+func (sh *shadow) stop() {
+	sh.mtx.Lock()
+	if !sh.closed {
+		sh.closed = true
+		close(sh.jobs)
+	}
+	sh.mtx.Unlock()
+	sh.wg.Wait()
+}
+
+// wrap returns a function executing requests like h, which also mirrors
+// them.
+func (sh *shadow) wrap(h func(context.Context, request, time.Time) response) func(context.Context, request, time.Time) response {
+	return func(ctx context.Context, req request, requestBegin time.Time) response {
+		res := h(ctx, req, requestBegin)
+		sh.mirror(ctx, &req.pkt.Operation, res, time.Since(requestBegin))
+		return res
+	}
+}
+
+// mirror queues op, which the primary backend answered with res, for
+// execution by the shadow backend.
+func (sh *shadow) mirror(ctx context.Context, op *protocol.Operation, res response, duration time.Duration) {
+	if !shadowed(op.Opcode) {
+		return
+	}
+	switch res.err {
+	case protocol.ErrNone, protocol.ErrKeyNotFound, protocol.ErrCrypto:
+	default:
+		// The request was refused before reaching the backend.
+		return
+	}
+
+	// The request's buffers are reused once it has been answered.
+	job := shadowJob{
+		ctx:      detachedContext{ctx},
+		op:       *op,
+		err:      res.err,
+		duration: duration,
+	}
+	job.op.Payload = append([]byte(nil), op.Payload...)
+	job.op.Extra = append([]byte(nil), op.Extra...)
+	job.op.ClientIP = append([]byte(nil), op.ClientIP...)
+	job.op.ServerIP = append([]byte(nil), op.ServerIP...)
+	job.op.JaegerSpan = nil
+	if res.err == protocol.ErrNone {
+		job.result = append([]byte(nil), res.op.Payload...)
+	}
+
+	sh.mtx.RLock()
+	defer sh.mtx.RUnlock()
+	if sh.closed {
+		return
+	}
+	select {
+	case sh.jobs <- job:
+	default:
+		atomic.AddUint64(&sh.dropped, 1)
+		sh.s.metrics.logShadowResult(op.Opcode, "dropped")
+	}
+}
+
+func (sh *shadow) work() {
+	defer sh.wg.Done()
+	for job := range sh.jobs {
+		sh.run(job)
+	}
+}
+
+// run executes job with the shadow backend and compares the results.
+func (sh *shadow) run(job shadowJob) {
+	ctx, cancel := context.WithTimeout(job.ctx, shadowTimeout)
+	defer cancel()
+
+	begin := time.Now()
+	result, code := sh.execute(ctx, &job.op)
+	duration := time.Since(begin)
+	sh.s.metrics.logShadowDuration("primary", job.duration)
+	sh.s.metrics.logShadowDuration("shadow", duration)
+
+	err := sh.compare(ctx, &job, result, code)
+	if err == nil {
+		atomic.AddUint64(&sh.matches, 1)
+		sh.s.metrics.logShadowResult(job.op.Opcode, "match")
+		return
+	}
+	atomic.AddUint64(&sh.mismatches, 1)
+	sh.s.metrics.logShadowResult(job.op.Opcode, "mismatch")
+	sh.s.log.Warningf("shadow keystore diverged: %s ski=%v: %v (primary took %v, shadow took %v)",
+		job.op.Opcode, job.op.SKI, err, job.duration, duration)
+}
+
+// execute executes op with the key of the shadow keystore.
+func (sh *shadow) execute(ctx context.Context, op *protocol.Operation) ([]byte, protocol.Error) {
+	key, err := sh.keys.Get(ctx, op)
+	if err != nil {
+		sh.s.log.Errorf("shadow keystore: failed to load key with ski=%v: %v", op.SKI, err)
+		return nil, protocol.ErrInternal
+	} else if key == nil {
+		return nil, protocol.ErrKeyNotFound
+	}
+
+	var out []byte
+	err = useKey(key, func(key crypto.Signer) (err error) {
+		switch op.Opcode {
+		case protocol.OpRSADecrypt:
+			if rsaKey, ok := key.(*rsa.PrivateKey); ok {
+				out, err = textbook_rsa.Decrypt(rsaKey, op.Payload)
+				return err
+			}
+			decrypter, ok := key.(crypto.Decrypter)
+			if !ok {
+				return errors.New("key is not a Decrypter")
+			}
+			out, err = decrypter.Decrypt(nil, op.Payload, nil)
+		case protocol.OpEd25519Sign:
+			out, err = key.Sign(rand.Reader, op.Payload, crypto.Hash(0))
+		case protocol.OpSM2SignSM3:
+			out, err = key.Sign(rand.Reader, op.Payload, sm2.SignerOpts{})
+		default:
+			out, err = key.Sign(rand.Reader, op.Payload, shadowSignerOpts(op.Opcode))
+		}
+		return err
+	})
+	if err != nil {
+		sh.s.log.Errorf("shadow keystore: ski=%v: %s: %v", op.SKI, op.Opcode, err)
+		return nil, protocol.ErrCrypto
+	}
+	return out, protocol.ErrNone
+}
+
+// compare returns an error describing how the result of the shadow backend
+// diverges from that of the primary one, if it does. Signatures which differ
+// are equivalent if the shadow one verifies under the primary key, as ECDSA
+// RSA-PSS and SM2 signatures are randomized.
+func (sh *shadow) compare(ctx context.Context, job *shadowJob, result []byte, code protocol.Error) error {
+	if code != job.err {
+		return fmt.Errorf("primary returned %v, shadow returned %v", job.err, code)
+	}
+	if code != protocol.ErrNone || bytes.Equal(result, job.result) {
+		return nil
+	}
+	if job.op.Opcode == protocol.OpRSADecrypt {
+		return errors.New("decryptions differ")
+	}
+
+	key, err := sh.s.keys.Get(ctx, &job.op)
+	if err != nil || key == nil {
+		return fmt.Errorf("signatures differ, and the primary key can't be loaded to verify them: %v", err)
+	}
+	if err := verifyShadowSignature(key.Public(), &job.op, result); err != nil {
+		return fmt.Errorf("signatures differ: %v", err)
+	}
+	return nil
+}
+
+// verifyShadowSignature verifies sig, made by the shadow backend for op,
+// under pub.
+func verifyShadowSignature(pub crypto.PublicKey, op *protocol.Operation, sig []byte) error {
+	switch pub := pub.(type) {
+	case *rsa.PublicKey:
+		opts := shadowSignerOpts(op.Opcode)
+		if pss, ok := opts.(*rsa.PSSOptions); ok {
+			return rsa.VerifyPSS(pub, pss.Hash, op.Payload, sig, pss)
+		}
+		return rsa.VerifyPKCS1v15(pub, opts.HashFunc(), op.Payload, sig)
+	case *ecdsa.PublicKey:
+		if !ecdsa.VerifyASN1(pub, op.Payload, sig) {
+			return errors.New("invalid ECDSA signature")
+		}
+		return nil
+	case ed25519.PublicKey:
+		if !ed25519.Verify(pub, op.Payload, sig) {
+			return errors.New("invalid Ed25519 signature")
+		}
+		return nil
+	case *sm2.PublicKey:
+		if !sm2.VerifyASN1(pub, op.Payload, sig) {
+			return errors.New("invalid SM2 signature")
+		}
+		return nil
+	default:
+		return fmt.Errorf("unsupported public key type %T", pub)
+	}
+}
+
+// shadowed reports whether requests with opcode op are mirrored to the
+// shadow keystore.
+func shadowed(op protocol.Op) bool {
+	switch op {
+	case protocol.OpRSADecrypt, protocol.OpEd25519Sign, protocol.OpSM2SignSM3:
+		return true
+	}
+	return shadowSignerOpts(op) != nil
+}
+
+// shadowSignerOpts returns the options the worker signs with for the signing
+// opcode op, or nil if op doesn't sign a digest.
+func shadowSignerOpts(op protocol.Op) crypto.SignerOpts {
+	switch op {
+	case protocol.OpRSASignMD5SHA1, protocol.OpECDSASignMD5SHA1:
+		return crypto.MD5SHA1
+	case protocol.OpRSASignSHA1, protocol.OpECDSASignSHA1:
+		return crypto.SHA1
+	case protocol.OpRSASignSHA224, protocol.OpECDSASignSHA224:
+		return crypto.SHA224
+	case protocol.OpRSASignSHA256, protocol.OpECDSASignSHA256:
+		return crypto.SHA256
+	case protocol.OpRSASignSHA384, protocol.OpECDSASignSHA384:
+		return crypto.SHA384
+	case protocol.OpRSASignSHA512, protocol.OpECDSASignSHA512:
+		return crypto.SHA512
+	case protocol.OpRSAPSSSignSHA256:
+		return &rsa.PSSOptions{SaltLength: rsa.PSSSaltLengthEqualsHash, Hash: crypto.SHA256}
+	case protocol.OpRSAPSSSignSHA384:
+		return &rsa.PSSOptions{SaltLength: rsa.PSSSaltLengthEqualsHash, Hash: crypto.SHA384}
+	case protocol.OpRSAPSSSignSHA512:
+		return &rsa.PSSOptions{SaltLength: rsa.PSSSaltLengthEqualsHash, Hash: crypto.SHA512}
+	}
+	return nil
+}
+
+// detachedContext carries the values of a request's context, such as the
+// client's identity and tenant, without its deadline and cancellation, so
+// that the request can be mirrored once it has been answered.
+type detachedContext struct {
+	context.Context
+}
+
+func (detachedContext) Deadline() (time.Time, bool) { return time.Time{}, false }
+func (detachedContext) Done() <-chan struct{}       { return nil }
+func (detachedContext) Err() error                  { return nil }
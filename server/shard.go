@@ -0,0 +1,487 @@
+package server
+
+import (
+	"bytes"
+	"context"
+	"crypto"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"hash/fnv"
+	"sort"
+	"strconv"
+	"sync"
+	"sync/atomic"
+
+	"github.com/cloudflare/cfssl/log"
+	"github.com/cloudflare/gokeyless/protocol"
+)
+
+// DefaultShardReplicas is the number of points each shard of a
+// ShardedKeystore has on the hash ring, unless set otherwise.
+const DefaultShardReplicas = 128
+
+// A ShardedKeystore is a Keystore which partitions keys across other
+// Keystores, its shards, by consistent hashing of their SKIs, so that
+// deployments with millions of keys can spread them over several stores.
+// Adding or removing a shard only changes the shard of the keys it gains or
+// loses. Until Rebalance has moved those keys, they are looked up on both
+// their new shard and the one they were placed on, so shards can be changed
+// while the server is running.
+type ShardedKeystore struct {
+	mtx      sync.RWMutex
+	replicas int
+	shards   map[string]*shard
+	// ring is the hash ring of the shards. prev is the ring the keys were
+	// placed with if the shards have changed since the last Rebalance, or
+	// nil.
+	ring, prev hashRing
+	// gen counts the changes to the shards, so that Rebalance can tell
+	// whether they changed while it was moving keys.
+	gen uint64
+	// onRemove is set by OnRemove.
+	onRemove func(ski protocol.SKI)
+}
+
+type shard struct {
+	name string
+	keys Keystore
+	// removed is set once the shard has been removed from the ring. It is
+	// dropped by Rebalance once its keys have been moved.
+	removed bool
+
+	lookups, hits, errors uint64
+}
+
+// ShardStats describes a shard of a ShardedKeystore.
+type ShardStats struct {
+	Name string `json:"name"`
+	// Keys is the number of keys held by the shard, or -1 if it can't list
+	// them.
+	Keys int `json:"keys"`
+	// Share is the fraction of the hash ring owned by the shard.
+	Share float64 `json:"share"`
+	// Lookups, Hits and Errors count the lookups of keys in the shard, those
+	// which found the key and those which failed.
+	Lookups uint64 `json:"lookups"`
+	Hits    uint64 `json:"hits"`
+	Errors  uint64 `json:"errors"`
+	// Removed is set for shards which have been removed, but still hold keys
+	// which Rebalance hasn't moved yet.
+	Removed bool `json:"removed,omitempty"`
+}
+
+type ringPoint struct {
+	hash  uint64
+	shard *shard
+}
+
+// A hashRing is sorted by hash.
+type hashRing []ringPoint
+
+// owner returns the shard of the key with ski, or nil if r is empty.
+func (r hashRing) owner(ski protocol.SKI) *shard {
+	if len(r) == 0 {
+		return nil
+	}
+	// SKIs are hashes already.
+	h := binary.BigEndian.Uint64(ski[:8])
+	i := sort.Search(len(r), func(i int) bool { return r[i].hash >= h })
+	if i == len(r) {
+		i = 0
+	}
+	return r[i].shard
+}
+
+// share returns the fraction of the hash space owned by s.
+func (r hashRing) share(s *shard) float64 {
+	var owned float64
+	for i, p := range r {
+		if p.shard != s {
+			continue
+		}
+		// A point owns the hashes after the previous point, up to itself.
+		prev := r[(i+len(r)-1)%len(r)].hash
+		owned += float64(p.hash - prev)
+	}
+	if len(r) == 1 {
+		return 1
+	}
+	return owned / (1 << 64)
+}
+
+// NewShardedKeystore returns a ShardedKeystore without shards, which gives each
+// shard replicas points on the hash ring, or DefaultShardReplicas if replicas
+// isn't positive. More points spread keys more evenly, at the cost of memory.
+func NewShardedKeystore(replicas int) *ShardedKeystore {
+	if replicas <= 0 {
+		replicas = DefaultShardReplicas
+	}
+	return &ShardedKeystore{replicas: replicas, shards: make(map[string]*shard)}
+}
+
+// AddShard adds keys to the shards of s under name, which must be unique.
+// Rebalance moves the keys it now owns to it.
+func (s *ShardedKeystore) AddShard(name string, keys Keystore) error {
+	if name == "" {
+		return errors.New("shard name must not be empty")
+	}
+	s.mtx.Lock()
+	defer s.mtx.Unlock()
+	if old, ok := s.shards[name]; ok {
+		if old.removed {
+			return fmt.Errorf("shard %q is being removed", name)
+		}
+		return fmt.Errorf("shard %q already exists", name)
+	}
+	if r, ok := keys.(removalKeystore); ok && s.onRemove != nil {
+		r.OnRemove(s.onRemove)
+	}
+	s.shards[name] = &shard{name: name, keys: keys}
+	s.rebuild()
+	return nil
+}
+
+// RemoveShard removes the shard with name from the hash ring. Its keys are
+// still looked up until Rebalance has moved them to the remaining shards.
+func (s *ShardedKeystore) RemoveShard(name string) error {
+	s.mtx.Lock()
+	defer s.mtx.Unlock()
+	sh, ok := s.shards[name]
+	if !ok || sh.removed {
+		return fmt.Errorf("no shard %q", name)
+	}
+	sh.removed = true
+	s.rebuild()
+	return nil
+}
+
+// rebuild rebuilds the hash ring after the shards have changed. s.mtx must be
+// held.
+func (s *ShardedKeystore) rebuild() {
+	if s.prev == nil && len(s.ring) > 0 {
+		s.prev = s.ring
+	}
+	var ring hashRing
+	for _, sh := range s.shards {
+		if sh.removed {
+			continue
+		}
+		for i := 0; i < s.replicas; i++ {
+			h := fnv.New64a()
+			h.Write([]byte(sh.name + "#" + strconv.Itoa(i)))
+			ring = append(ring, ringPoint{hash: h.Sum64(), shard: sh})
+		}
+	}
+	sort.Slice(ring, func(i, j int) bool {
+		if ring[i].hash != ring[j].hash {
+			return ring[i].hash < ring[j].hash
+		}
+		return ring[i].shard.name < ring[j].shard.name
+	})
+	s.ring = ring
+	s.gen++
+}
+
+// owners returns the shard of the key with ski and, if the key may not have
+// been moved there yet, the shard it was placed on.
+func (s *ShardedKeystore) owners(ski protocol.SKI) (cur, prev *shard) {
+	s.mtx.RLock()
+	defer s.mtx.RUnlock()
+	cur = s.ring.owner(ski)
+	if s.prev != nil {
+		if prev = s.prev.owner(ski); prev == cur {
+			prev = nil
+		}
+	}
+	return cur, prev
+}
+
+// Get returns the key requested by op from its shard or, if it hasn't been
+// moved there yet, the shard it was placed on.
+func (s *ShardedKeystore) Get(ctx context.Context, op *protocol.Operation) (crypto.Signer, error) {
+	cur, prev := s.owners(op.SKI)
+	var firstErr error
+	for _, sh := range []*shard{cur, prev} {
+		if sh == nil {
+			continue
+		}
+		atomic.AddUint64(&sh.lookups, 1)
+		priv, err := sh.keys.Get(ctx, op)
+		if err != nil {
+			atomic.AddUint64(&sh.errors, 1)
+			log.Warningf("sharded keystore: failed to get key with SKI %v from shard %s: %v", op.SKI, sh.name, err)
+			if firstErr == nil {
+				firstErr = err
+			}
+			continue
+		}
+		if priv != nil {
+			atomic.AddUint64(&sh.hits, 1)
+			return priv, nil
+		}
+	}
+	return nil, firstErr
+}
+
+// KeyUsage returns the usage restriction of key in the shard it was found in.
+func (s *ShardedKeystore) KeyUsage(op *protocol.Operation, key crypto.Signer) *KeyUsage {
+	cur, prev := s.owners(op.SKI)
+	for _, sh := range []*shard{cur, prev} {
+		if sh == nil {
+			continue
+		}
+		if keys, ok := sh.keys.(usageKeystore); ok {
+			if usage := keys.KeyUsage(op, key); usage != nil {
+				return usage
+			}
+		}
+	}
+	return nil
+}
+
+// snapshot returns the shards of s, sorted by name.
+func (s *ShardedKeystore) snapshot() []*shard {
+	s.mtx.RLock()
+	defer s.mtx.RUnlock()
+	shards := make([]*shard, 0, len(s.shards))
+	for _, sh := range s.shards {
+		shards = append(shards, sh)
+	}
+	sort.Slice(shards, func(i, j int) bool { return shards[i].name < shards[j].name })
+	return shards
+}
+
+// ShardStats describes the shards of s, sorted by name.
+func (s *ShardedKeystore) ShardStats() []ShardStats {
+	shards := s.snapshot()
+	stats := make([]ShardStats, len(shards))
+	s.mtx.RLock()
+	for i, sh := range shards {
+		stats[i] = ShardStats{
+			Name:    sh.name,
+			Keys:    -1,
+			Lookups: atomic.LoadUint64(&sh.lookups),
+			Hits:    atomic.LoadUint64(&sh.hits),
+			Errors:  atomic.LoadUint64(&sh.errors),
+			Removed: sh.removed,
+		}
+		if !sh.removed {
+			stats[i].Share = s.ring.share(sh)
+		}
+	}
+	s.mtx.RUnlock()
+	// Shards are listed without holding s.mtx, since they may be remote.
+	for i, sh := range shards {
+		if keys, ok := sh.keys.(enumerableKeystore); ok {
+			stats[i].Keys = len(keys.SKIs())
+		}
+	}
+	return stats
+}
+
+// A movableKeystore is a shard whose keys can be moved to another shard by
+// Rebalance, such as a DefaultKeystore.
+type movableKeystore interface {
+	enumerableKeystore
+	// key returns the key with ski and its usage restriction, or nil if
+	// there's no such key or it can't be moved.
+	key(ski protocol.SKI) (crypto.Signer, *KeyUsage)
+	// attach adds a key moved from another shard.
+	attach(priv crypto.Signer, usage *KeyUsage) error
+	// detach removes the key with ski, which has been moved to another
+	// shard, without destroying it.
+	detach(ski protocol.SKI)
+}
+
+// Rebalance moves the keys which aren't in their shard since shards were added
+// or removed, and drops the removed shards once they are empty. Keys keep
+// being served while they are moved. It returns the number of keys moved, and
+// an error if some keys couldn't be moved, e.g. because their shards can't
+// list or add keys, in which case they are still looked up where they are.
+func (s *ShardedKeystore) Rebalance(ctx context.Context) (int, error) {
+	s.mtx.RLock()
+	ring, gen, pending := s.ring, s.gen, s.prev != nil
+	s.mtx.RUnlock()
+
+	moved := 0
+	var stuck []string
+	for _, src := range s.snapshot() {
+		if err := ctx.Err(); err != nil {
+			return moved, err
+		}
+		keys, ok := src.keys.(movableKeystore)
+		if !ok {
+			// Without a change to the shards, the keys of a shard which
+			// can't list them are assumed to be in place.
+			if pending {
+				stuck = append(stuck, src.name)
+			}
+			continue
+		}
+		ok = true
+		for _, ski := range keys.SKIs() {
+			dst := ring.owner(ski)
+			if dst == src {
+				continue
+			}
+			dstKeys, movable := keys, false
+			if dst != nil {
+				dstKeys, movable = dst.keys.(movableKeystore)
+			}
+			priv, usage := keys.key(ski)
+			if !movable || priv == nil {
+				ok = false
+				continue
+			}
+			// The key is added to its shard before being removed from this
+			// one, so that lookups keep finding it.
+			if err := dstKeys.attach(priv, usage); err != nil {
+				log.Errorf("sharded keystore: failed to move key with SKI %v to shard %s: %v", ski, dst.name, err)
+				ok = false
+				continue
+			}
+			keys.detach(ski)
+			moved++
+		}
+		if !ok {
+			stuck = append(stuck, src.name)
+		}
+	}
+
+	s.mtx.Lock()
+	defer s.mtx.Unlock()
+	if len(stuck) > 0 {
+		return moved, fmt.Errorf("keys of shards %s could not be moved", stuck)
+	}
+	if s.gen == gen {
+		// Every key is in its shard.
+		s.prev = nil
+		for name, sh := range s.shards {
+			if sh.removed {
+				delete(s.shards, name)
+			}
+		}
+	}
+	return moved, nil
+}
+
+// Keys describes the keys of the shards which can list them, sorted by SKI.
+func (s *ShardedKeystore) Keys() []KeyInfo {
+	seen := make(map[string]bool)
+	var infos []KeyInfo
+	for _, sh := range s.snapshot() {
+		keys, ok := sh.keys.(adminKeystore)
+		if !ok {
+			continue
+		}
+		for _, info := range keys.Keys() {
+			if !seen[info.SKI] {
+				seen[info.SKI] = true
+				infos = append(infos, info)
+			}
+		}
+	}
+	sort.Slice(infos, func(i, j int) bool { return infos[i].SKI < infos[j].SKI })
+	return infos
+}
+
+// Add adds priv to its shard, which must support adding keys.
+func (s *ShardedKeystore) Add(op *protocol.Operation, priv crypto.Signer) error {
+	ski, err := protocol.GetSKI(priv.Public())
+	if err != nil {
+		return err
+	}
+	cur, _ := s.owners(ski)
+	if cur == nil {
+		return errors.New("sharded keystore has no shards")
+	}
+	keys, ok := cur.keys.(adminKeystore)
+	if !ok {
+		return fmt.Errorf("shard %s does not support adding keys", cur.name)
+	}
+	return keys.Add(op, priv)
+}
+
+// Remove removes the key with ski from the shards which support it.
+func (s *ShardedKeystore) Remove(ski protocol.SKI) {
+	for _, sh := range s.snapshot() {
+		if keys, ok := sh.keys.(adminKeystore); ok {
+			keys.Remove(ski)
+		}
+	}
+}
+
+// SKIs returns the SKIs of the keys of the shards which can list them, in
+// ascending order.
+func (s *ShardedKeystore) SKIs() []protocol.SKI {
+	seen := make(map[protocol.SKI]bool)
+	var skis []protocol.SKI
+	for _, sh := range s.snapshot() {
+		keys, ok := sh.keys.(enumerableKeystore)
+		if !ok {
+			continue
+		}
+		for _, ski := range keys.SKIs() {
+			if !seen[ski] {
+				seen[ski] = true
+				skis = append(skis, ski)
+			}
+		}
+	}
+	sort.Slice(skis, func(i, j int) bool { return bytes.Compare(skis[i][:], skis[j][:]) < 0 })
+	return skis
+}
+
+// PublicKeys returns the public keys of the shards which can list them, in
+// ascending order of SKI.
+func (s *ShardedKeystore) PublicKeys() []protocol.PublicKey {
+	seen := make(map[protocol.SKI]bool)
+	var pubs []protocol.PublicKey
+	for _, sh := range s.snapshot() {
+		keys, ok := sh.keys.(publicKeystore)
+		if !ok {
+			continue
+		}
+		for _, pub := range keys.PublicKeys() {
+			if !seen[pub.SKI] {
+				seen[pub.SKI] = true
+				pubs = append(pubs, pub)
+			}
+		}
+	}
+	sort.Slice(pubs, func(i, j int) bool { return bytes.Compare(pubs[i].SKI[:], pubs[j].SKI[:]) < 0 })
+	return pubs
+}
+
+// key returns the key with ski and its usage restriction, unless it is being
+// rotated.
+func (keys *DefaultKeystore) key(ski protocol.SKI) (crypto.Signer, *KeyUsage) {
+	keys.mtx.RLock()
+	defer keys.mtx.RUnlock()
+	if _, ok := keys.rotations[ski]; ok {
+		return nil, nil
+	}
+	return keys.skis[ski], keys.usage[ski]
+}
+
+// attach adds priv, moved from another keystore, with its usage restriction.
+func (keys *DefaultKeystore) attach(priv crypto.Signer, usage *KeyUsage) error {
+	if err := keys.Add(nil, priv); err != nil {
+		return err
+	}
+	if usage != nil {
+		ski, _ := protocol.GetSKI(priv.Public())
+		keys.SetKeyUsage(ski, usage)
+	}
+	return nil
+}
+
+// detach removes the key with ski without destroying it.
+func (keys *DefaultKeystore) detach(ski protocol.SKI) {
+	keys.mtx.Lock()
+	defer keys.mtx.Unlock()
+	keys.unalias(ski)
+	delete(keys.skis, ski)
+	delete(keys.usage, ski)
+}
@@ -0,0 +1,76 @@
+package server
+
+import (
+	"sync"
+	"time"
+
+	"github.com/cloudflare/gokeyless/protocol"
+)
+
+// shedSmoothing is the weight of each request's queueing delay in the
+// smoothed delay load shedding policies are checked against.
+const shedSmoothing = 0.05
+
+// A LoadShedPolicy sheds the requests with an opcode, such as the expensive
+// RSA decryptions and signatures, while the server is under sustained queue
+// pressure, so that the cheaper requests which remain, such as ECDSA
+// signatures, keep being answered in time.
+type LoadShedPolicy struct {
+	Op protocol.Op
+	// QueueDelay is the smoothed time requests wait for a worker above which
+	// the server is under pressure.
+	QueueDelay time.Duration
+	// Sustain is how long the pressure must last before requests with Op are
+	// shed. They are executed again as soon as it eases.
+	Sustain time.Duration
+}
+
+// loadShedder tracks the queue pressure on the server, and decides which
+// requests to shed according to ServeConfig.WithLoadShedding.
+type loadShedder struct {
+	config *ServeConfig
+	mtx    sync.Mutex
+	// delay is the smoothed queueing delay of recent requests.
+	delay time.Duration
+	// since holds, by opcode, the time the delay went over the QueueDelay of
+	// the opcode's policy, while it stays over it.
+	since map[protocol.Op]time.Time
+}
+
+func newLoadShedder(config *ServeConfig) *loadShedder {
+	return &loadShedder{config: config, since: make(map[protocol.Op]time.Time)}
+}
+
+// shed records that a request with opcode op waited for queued before a
+// worker took it, and reports whether it should be shed.
+func (l *loadShedder) shed(op protocol.Op, queued time.Duration) bool {
+	if len(l.config.loadShed) == 0 {
+		return false
+	}
+	now := time.Now()
+	l.mtx.Lock()
+	defer l.mtx.Unlock()
+	l.delay += time.Duration(shedSmoothing * float64(queued-l.delay))
+	for _, policy := range l.config.loadShed {
+		if l.delay <= policy.QueueDelay {
+			delete(l.since, policy.Op)
+		} else if _, ok := l.since[policy.Op]; !ok {
+			l.since[policy.Op] = now
+		}
+	}
+	policy, ok := l.config.loadShed[op]
+	if !ok {
+		return false
+	}
+	since, ok := l.since[op]
+	return ok && now.Sub(since) >= policy.Sustain
+}
+
+// shedLoad answers a request shed under queue pressure with
+// protocol.ErrThrottled, which clients may retry later or on another server.
+func shedLoad(req request, worker string) response {
+	req.log.Debugf("Worker %v: connection %s: shedding %s request %d under queue pressure",
+		worker, req.connName, req.pkt.Opcode, req.pkt.ID)
+	req.metrics.logLimitRejected("load")
+	return makeErrResponse(req, protocol.ErrThrottled, time.Now())
+}
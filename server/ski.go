@@ -0,0 +1,90 @@
+package server
+
+import (
+	"crypto"
+
+	"github.com/cloudflare/gokeyless/protocol"
+)
+
+// DefaultSKISchemes are the SKI schemes a server accepts unless set with
+// ServeConfig.WithSKISchemes, in order of preference.
+var DefaultSKISchemes = []protocol.SKIScheme{protocol.SKISchemeSHA256, protocol.SKISchemeSHA1}
+
+// A canonicalKeystore is a Keystore which can resolve the SKIs of its keys in
+// other schemes to the SHA-1 SKIs they are stored under.
+type canonicalKeystore interface {
+	// CanonicalSKI returns the SHA-1 SKI of the key with ski, and whether it
+	// is an alias of one.
+	CanonicalSKI(ski protocol.SKI) (protocol.SKI, bool)
+}
+
+// canonicalSKI rewrites the SKI of op to the SHA-1 SKI it is an alias of, if
+// the server's keystore knows it, so that key limits, usage restrictions and
+// keystores see the SKI a key was added under whichever scheme clients use.
+func (s *Server) canonicalSKI(op *protocol.Operation) {
+	keys, ok := s.keys.(canonicalKeystore)
+	if !ok || !op.SKI.Valid() {
+		return
+	}
+	if ski, ok := keys.CanonicalSKI(op.SKI); ok {
+		op.SKI = ski
+	}
+}
+
+// CanonicalSKI returns the SHA-1 SKI of the key whose SHA-256 SKI is ski.
+func (keys *DefaultKeystore) CanonicalSKI(ski protocol.SKI) (protocol.SKI, bool) {
+	keys.mtx.RLock()
+	defer keys.mtx.RUnlock()
+	canonical, ok := keys.aliases[ski]
+	return canonical, ok
+}
+
+// alias registers the SHA-256 SKI of pub as an alias of ski, so that the key
+// is found by clients of either scheme. keys.mtx must be held.
+func (keys *DefaultKeystore) alias(ski protocol.SKI, pub crypto.PublicKey) {
+	alias, err := protocol.GetSKIScheme(pub, protocol.SKISchemeSHA256)
+	if err != nil {
+		return
+	}
+	if keys.aliases == nil {
+		keys.aliases = make(map[protocol.SKI]protocol.SKI)
+	}
+	keys.aliases[alias] = ski
+}
+
+// unalias removes the alias of the key with ski, before it is removed.
+// keys.mtx must be held.
+func (keys *DefaultKeystore) unalias(ski protocol.SKI) {
+	priv, ok := keys.skis[ski]
+	if !ok {
+		return
+	}
+	if alias, err := protocol.GetSKIScheme(priv.Public(), protocol.SKISchemeSHA256); err == nil {
+		delete(keys.aliases, alias)
+	}
+}
+
+// CanonicalSKI asks each backend of c to resolve ski.
+func (c *KeystoreChain) CanonicalSKI(ski protocol.SKI) (protocol.SKI, bool) {
+	for _, backend := range c.backends {
+		if keys, ok := backend.keys.(canonicalKeystore); ok {
+			if canonical, ok := keys.CanonicalSKI(ski); ok {
+				return canonical, true
+			}
+		}
+	}
+	return ski, false
+}
+
+// CanonicalSKI asks each shard of s to resolve ski, since the shards of an
+// alias are not those of the key.
+func (s *ShardedKeystore) CanonicalSKI(ski protocol.SKI) (protocol.SKI, bool) {
+	for _, sh := range s.snapshot() {
+		if keys, ok := sh.keys.(canonicalKeystore); ok {
+			if canonical, ok := keys.CanonicalSKI(ski); ok {
+				return canonical, true
+			}
+		}
+	}
+	return ski, false
+}
@@ -0,0 +1,112 @@
+package server
+
+import (
+	"math"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/cloudflare/gokeyless/protocol"
+)
+
+const (
+	// sloWindow is the number of recent requests with an opcode whose
+	// latencies are checked against its SLO.
+	sloWindow = 1024
+	// sloMinSamples is the number of latencies needed before an SLO is
+	// checked.
+	sloMinSamples = 100
+	// sloCheckInterval is how often an SLO is checked while requests arrive.
+	sloCheckInterval = time.Second
+)
+
+// A LatencySLO is a latency objective for the requests with an opcode: the
+// given percentile of the latencies of recent requests, from the time they
+// were read to the time they were answered, must stay within Threshold.
+type LatencySLO struct {
+	Op protocol.Op
+	// Percentile of the latencies checked, e.g. 0.99.
+	Percentile float64
+	Threshold  time.Duration
+}
+
+// An SLOStatus reports whether a LatencySLO is breached.
+type SLOStatus struct {
+	SLO LatencySLO
+	// Latency is the percentile of the latencies of recent requests.
+	Latency  time.Duration
+	Breached bool
+}
+
+// sloTracker checks the latencies of requests against the SLOs set with
+// ServeConfig.WithLatencySLOs.
+type sloTracker struct {
+	config  *ServeConfig
+	metrics *serverMetrics
+	mtx     sync.Mutex
+	windows map[protocol.Op]*sloLatencies
+}
+
+// sloLatencies holds the latencies of the recent requests with an opcode.
+type sloLatencies struct {
+	samples [sloWindow]time.Duration
+	// n is the number of samples recorded, which wrap around the window.
+	n        int
+	checked  time.Time
+	breached bool
+}
+
+func newSLOTracker(config *ServeConfig, metrics *serverMetrics) *sloTracker {
+	return &sloTracker{config: config, metrics: metrics, windows: make(map[protocol.Op]*sloLatencies)}
+}
+
+// observe records the latency of a request with opcode op, and checks its SLO
+// if it is due.
+func (t *sloTracker) observe(op protocol.Op, latency time.Duration) {
+	slo, ok := t.config.latencySLOs[op]
+	if !ok {
+		return
+	}
+
+	t.mtx.Lock()
+	w, ok := t.windows[op]
+	if !ok {
+		w = new(sloLatencies)
+		t.windows[op] = w
+	}
+	w.samples[w.n%sloWindow] = latency
+	w.n++
+	now := time.Now()
+	if w.n < sloMinSamples || now.Sub(w.checked) < sloCheckInterval {
+		t.mtx.Unlock()
+		return
+	}
+	w.checked = now
+	n := w.n
+	if n > sloWindow {
+		n = sloWindow
+	}
+	samples := make([]time.Duration, n)
+	copy(samples, w.samples[:n])
+	t.mtx.Unlock()
+
+	sort.Slice(samples, func(i, j int) bool { return samples[i] < samples[j] })
+	i := int(math.Ceil(slo.Percentile*float64(n))) - 1
+	if i < 0 {
+		i = 0
+	} else if i >= n {
+		i = n - 1
+	}
+	status := SLOStatus{SLO: slo, Latency: samples[i], Breached: samples[i] > slo.Threshold}
+
+	// Checks are at least sloCheckInterval apart, so they don't race.
+	t.mtx.Lock()
+	changed := w.breached != status.Breached
+	w.breached = status.Breached
+	t.mtx.Unlock()
+
+	t.metrics.logSLOStatus(status, changed)
+	if changed && t.config.sloFunc != nil {
+		t.config.sloFunc(status)
+	}
+}
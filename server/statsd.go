@@ -0,0 +1,69 @@
+package server
+
+import (
+	"net"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// A StatsdSink is a MetricsSink which sends each metric to a statsd server
+// over UDP, with its labels as DogStatsD tags. Timings are sent in
+// milliseconds.
+type StatsdSink struct {
+	conn   net.Conn
+	prefix string
+}
+
+// NewStatsdSink returns a StatsdSink which sends metrics to the statsd server
+// at addr, with their names prefixed by prefix, e.g. "edge.".
+func NewStatsdSink(addr, prefix string) (*StatsdSink, error) {
+	conn, err := net.Dial("udp", addr)
+	if err != nil {
+		return nil, err
+	}
+	return &StatsdSink{conn: conn, prefix: prefix}, nil
+}
+
+// Count implements MetricsSink.
+func (s *StatsdSink) Count(name string, delta float64, labels Labels) {
+	s.send(name, delta, "c", labels)
+}
+
+// Gauge implements MetricsSink.
+func (s *StatsdSink) Gauge(name string, value float64, labels Labels) {
+	s.send(name, value, "g", labels)
+}
+
+// Timing implements MetricsSink.
+func (s *StatsdSink) Timing(name string, d time.Duration, labels Labels) {
+	s.send(name, d.Seconds()*1000, "ms", labels)
+}
+
+func (s *StatsdSink) send(name string, value float64, typ string, labels Labels) {
+	var b strings.Builder
+	b.WriteString(s.prefix)
+	b.WriteString(name)
+	b.WriteByte(':')
+	b.WriteString(strconv.FormatFloat(value, 'f', -1, 64))
+	b.WriteByte('|')
+	b.WriteString(typ)
+	if len(labels) > 0 {
+		tags := make([]string, 0, len(labels))
+		for k, v := range labels {
+			tags = append(tags, k+":"+v)
+		}
+		sort.Strings(tags)
+		b.WriteString("|#")
+		b.WriteString(strings.Join(tags, ","))
+	}
+	// Metrics are best effort: UDP writes don't block, and failures, e.g.
+	// while the statsd server restarts, are ignored.
+	s.conn.Write([]byte(b.String()))
+}
+
+// Close closes the connection to the statsd server.
+func (s *StatsdSink) Close() error {
+	return s.conn.Close()
+}
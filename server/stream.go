@@ -0,0 +1,157 @@
+package server
+
+import (
+	"github.com/cloudflare/gokeyless/protocol"
+)
+
+const (
+	// defaultMaxStreamLength is the default limit on the payload of an
+	// operation streamed with OpStream.
+	defaultMaxStreamLength = 16 << 20
+	// maxStreams limits the streams open at once on a connection.
+	maxStreams = 4
+)
+
+// streamedOps are the operations which may be streamed with OpStream.
+var streamedOps = map[protocol.Op]bool{
+	protocol.OpSeal:   true,
+	protocol.OpUnseal: true,
+}
+
+// streamChunkSize is the length of the chunks results are read in.
+var streamChunkSize = int(serverFeatures.MaxPayload) - protocol.StreamOverhead
+
+// A stream is an operation streamed with OpStream.
+type stream struct {
+	// op is the operation, whose payload is appended to until StreamEnd.
+	op     protocol.Operation
+	length int
+	// running is set from StreamEnd until the operation is answered.
+	running bool
+	// result is the result of the operation, once it has been answered.
+	result []byte
+}
+
+// maxStreamLength returns the largest payload of a streamed operation.
+func (c *conn) maxStreamLength() int {
+	if c.config == nil {
+		return defaultMaxStreamLength
+	}
+	return c.config.MaxStreamLength()
+}
+
+// stream handles the OpStream request req. StreamBegin, StreamContinue and
+// StreamRead requests are answered with resp right away. For StreamEnd, run is
+// the operation streamed, with its whole payload, which is executed like any
+// other request; its response is turned into the first chunk of the result by
+// streamResponse.
+func (c *conn) stream(req request) (run *request, resp response) {
+	fail := func(err protocol.Error, format string, args ...interface{}) (*request, response) {
+		c.log.Warningf("connection %v: stream request %d: "+format, append([]interface{}{c.name, req.pkt.ID}, args...)...)
+		return nil, makeErrResponse(req, err, req.reqBegin)
+	}
+	var chunk protocol.StreamChunk
+	if err := chunk.UnmarshalBinary(req.pkt.Payload); err != nil {
+		return fail(protocol.ErrFormat, "%v", err)
+	}
+
+	c.streamMtx.Lock()
+	defer c.streamMtx.Unlock()
+	if c.streams == nil {
+		c.streams = make(map[uint32]*stream)
+		c.streamEnds = make(map[uint32]uint32)
+	}
+	s := c.streams[chunk.ID]
+	switch chunk.Phase {
+	case protocol.StreamBegin:
+		if !streamedOps[chunk.Opcode] {
+			return fail(protocol.ErrBadOpcode, "%s can't be streamed", chunk.Opcode)
+		}
+		if s == nil && len(c.streams) >= maxStreams {
+			c.metrics.logLimitRejected("streams")
+			return fail(protocol.ErrThrottled, "too many streams")
+		}
+		if max := c.maxStreamLength(); chunk.Length > max {
+			c.metrics.logLimitRejected("payload")
+			return fail(protocol.ErrFormat, "%dB payload is over the limit of %dB", chunk.Length, max)
+		}
+		// The stream carries the items of the operation streamed.
+		op := req.pkt.Operation
+		op.Opcode = chunk.Opcode
+		op.Payload = make([]byte, 0, chunk.Length)
+		c.streams[chunk.ID] = &stream{op: op, length: chunk.Length}
+		return nil, makeRespondResponse(req, nil, req.reqBegin)
+
+	case protocol.StreamContinue, protocol.StreamEnd:
+		if s == nil || s.running || s.result != nil {
+			return fail(protocol.ErrFormat, "no stream %d to append to", chunk.ID)
+		}
+		if chunk.Offset != len(s.op.Payload) || chunk.Offset+len(chunk.Data) > s.length {
+			delete(c.streams, chunk.ID)
+			return fail(protocol.ErrFormat, "chunk of %dB at %d is out of order in a %dB payload", len(chunk.Data), chunk.Offset, s.length)
+		}
+		s.op.Payload = append(s.op.Payload, chunk.Data...)
+		if chunk.Phase == protocol.StreamContinue {
+			return nil, makeRespondResponse(req, nil, req.reqBegin)
+		}
+		if len(s.op.Payload) != s.length {
+			delete(c.streams, chunk.ID)
+			return fail(protocol.ErrFormat, "stream ended after %dB of a %dB payload", len(s.op.Payload), s.length)
+		}
+		s.running = true
+		c.streamEnds[req.pkt.ID] = chunk.ID
+		pkt := *req.pkt
+		pkt.Operation, s.op = s.op, protocol.Operation{}
+		run := req
+		run.pkt = &pkt
+		return &run, response{}
+
+	case protocol.StreamRead:
+		if s == nil || s.result == nil {
+			return fail(protocol.ErrFormat, "no result of stream %d to read", chunk.ID)
+		}
+		if chunk.Offset >= len(s.result) {
+			return fail(protocol.ErrFormat, "offset %d is past the %dB result", chunk.Offset, len(s.result))
+		}
+		return nil, makeRespondResponse(req, c.streamChunk(chunk.ID, s, chunk.Offset), req.reqBegin)
+
+	default:
+		return fail(protocol.ErrFormat, "unknown phase %d", chunk.Phase)
+	}
+}
+
+// streamResponse turns the response to a StreamEnd request into the first
+// chunk of the result. Other responses are returned unchanged.
+func (c *conn) streamResponse(resp response) response {
+	c.streamMtx.Lock()
+	defer c.streamMtx.Unlock()
+	id, ok := c.streamEnds[resp.id]
+	if !ok {
+		return resp
+	}
+	delete(c.streamEnds, resp.id)
+	s := c.streams[id]
+	if resp.err != protocol.ErrNone {
+		delete(c.streams, id)
+		return resp
+	}
+	s.running, s.result = false, resp.op.Payload
+	if s.result == nil {
+		s.result = []byte{}
+	}
+	resp.op.Payload = c.streamChunk(id, s, 0)
+	return resp
+}
+
+// streamChunk encodes the chunk of the result of s at offset. The stream is
+// closed once its last chunk has been read. streamMtx must be held.
+func (c *conn) streamChunk(id uint32, s *stream, offset int) []byte {
+	end := offset + streamChunkSize
+	if end >= len(s.result) {
+		end = len(s.result)
+		delete(c.streams, id)
+	}
+	chunk := protocol.StreamChunk{ID: id, Offset: offset, Length: len(s.result), Data: s.result[offset:end]}
+	payload, _ := chunk.MarshalBinary()
+	return payload
+}
@@ -0,0 +1,153 @@
+package server
+
+import (
+	"context"
+	"crypto"
+	"errors"
+	"io/ioutil"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+
+	"github.com/cloudflare/cfssl/log"
+	"github.com/cloudflare/gokeyless/protocol"
+)
+
+// A TenantFunc returns the ID of the tenant a client belongs to, or "" if it
+// belongs to none. It is set with ServeConfig.WithTenants.
+type TenantFunc func(*ClientIdentity) string
+
+// TenantByCommonName makes the common name of a client's certificate, or the
+// name of the client its token was issued to, its tenant ID.
+func TenantByCommonName(id *ClientIdentity) string {
+	return id.CommonName
+}
+
+// TenantBySPIFFETrustDomain makes the trust domain of a client's SPIFFE ID,
+// e.g. example.org for spiffe://example.org/frontend, its tenant ID. Clients
+// without a SPIFFE ID belong to no tenant.
+func TenantBySPIFFETrustDomain(id *ClientIdentity) string {
+	domain := strings.TrimPrefix(id.SPIFFEID, "spiffe://")
+	if i := strings.IndexByte(domain, '/'); i >= 0 {
+		domain = domain[:i]
+	}
+	return domain
+}
+
+type tenantKey struct{}
+
+// WithTenant returns a copy of ctx carrying tenant.
+func WithTenant(ctx context.Context, tenant string) context.Context {
+	return context.WithValue(ctx, tenantKey{}, tenant)
+}
+
+// TenantFromContext returns the tenant of the client which sent the request
+// being handled, if the server has a TenantFunc and the client belongs to a
+// tenant.
+func TenantFromContext(ctx context.Context) (string, bool) {
+	tenant, ok := ctx.Value(tenantKey{}).(string)
+	return tenant, ok && tenant != ""
+}
+
+// A TenantKeystore is a Keystore which lets a single keyserver serve several
+// customers: the keys of each tenant are registered in a Keystore of its own,
+// and requests only find the keys of their client's tenant, as returned by
+// the ServeConfig's TenantFunc. Requests from clients without a tenant find
+// no key.
+type TenantKeystore struct {
+	mtx     sync.RWMutex
+	tenants map[string]Keystore
+}
+
+// NewTenantKeystore returns a TenantKeystore without tenants.
+func NewTenantKeystore() *TenantKeystore {
+	return &TenantKeystore{tenants: make(map[string]Keystore)}
+}
+
+// SetTenant registers keys as the keys of tenant, replacing its previous
+// ones.
+func (t *TenantKeystore) SetTenant(tenant string, keys Keystore) error {
+	if tenant == "" {
+		return errors.New("keyless: empty tenant ID")
+	}
+	t.mtx.Lock()
+	defer t.mtx.Unlock()
+	t.tenants[tenant] = keys
+	log.Debugf("registered the keys of tenant %s", tenant)
+	return nil
+}
+
+// RemoveTenant removes the keys of tenant.
+func (t *TenantKeystore) RemoveTenant(tenant string) {
+	t.mtx.Lock()
+	defer t.mtx.Unlock()
+	delete(t.tenants, tenant)
+}
+
+// Tenant returns the keys of tenant.
+func (t *TenantKeystore) Tenant(tenant string) (Keystore, bool) {
+	t.mtx.RLock()
+	defer t.mtx.RUnlock()
+	keys, ok := t.tenants[tenant]
+	return keys, ok
+}
+
+// Tenants returns the IDs of the tenants, sorted.
+func (t *TenantKeystore) Tenants() []string {
+	t.mtx.RLock()
+	defer t.mtx.RUnlock()
+	tenants := make([]string, 0, len(t.tenants))
+	for tenant := range t.tenants {
+		tenants = append(tenants, tenant)
+	}
+	sort.Strings(tenants)
+	return tenants
+}
+
+// AddFromDir registers each subdirectory of dir as a tenant named after it,
+// with the ".key" files it contains, as DefaultKeystore.AddFromDir loads
+// them.
+func (t *TenantKeystore) AddFromDir(dir string, LoadKey func([]byte) (crypto.Signer, error)) error {
+	entries, err := ioutil.ReadDir(dir)
+	if err != nil {
+		return err
+	}
+	for _, entry := range entries {
+		if !entry.IsDir() {
+			continue
+		}
+		keys := NewDefaultKeystore()
+		if err := keys.AddFromDir(filepath.Join(dir, entry.Name()), LoadKey); err != nil {
+			return err
+		}
+		if err := t.SetTenant(entry.Name(), keys); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Get looks the key up in the keys of the tenant of the request's client.
+func (t *TenantKeystore) Get(ctx context.Context, op *protocol.Operation) (crypto.Signer, error) {
+	tenant, ok := TenantFromContext(ctx)
+	if !ok {
+		log.Infof("no tenant for key with SKI: %s", op.SKI)
+		return nil, nil
+	}
+	keys, ok := t.Tenant(tenant)
+	if !ok {
+		log.Infof("no keys for tenant %s", tenant)
+		return nil, nil
+	}
+	return keys.Get(ctx, op)
+}
+
+// tenantOf returns the tenant of the client with identity id, or "" if it
+// has none or s has no TenantFunc.
+func (s *ServeConfig) tenantOf(id *ClientIdentity) string {
+	if s == nil || s.tenants == nil || id == nil {
+		return ""
+	}
+	return s.tenants(id)
+}
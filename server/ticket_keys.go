@@ -0,0 +1,90 @@
+package server
+
+import (
+	"crypto/rand"
+	"errors"
+	"sync"
+	"time"
+
+	"github.com/cloudflare/cfssl/log"
+)
+
+// TicketKeySource is an interface for a handler for OpGetTicketKeys. The
+// returned keys are suitable for tls.Config.SetSessionTicketKeys: the first key
+// is used to encrypt new tickets and all keys are used to decrypt.
+type TicketKeySource interface {
+	TicketKeys() ([][32]byte, error)
+}
+
+// TicketKeyRotator is a TicketKeySource which generates a new random session
+// ticket key every interval, keeping a fixed number of previous keys so that
+// tickets issued before a rotation can still be resumed.
+type TicketKeyRotator struct {
+	mtx  sync.RWMutex
+	keys [][32]byte
+	keep int
+	done chan struct{}
+}
+
+// NewTicketKeyRotator creates a TicketKeyRotator holding at most keep keys and
+// starts rotating them every interval. Call Stop to stop rotation.
+func NewTicketKeyRotator(interval time.Duration, keep int) (*TicketKeyRotator, error) {
+	if interval <= 0 {
+		return nil, errors.New("ticket key rotation interval must be positive")
+	}
+	if keep < 1 {
+		return nil, errors.New("must keep at least one ticket key")
+	}
+
+	r := &TicketKeyRotator{keep: keep, done: make(chan struct{})}
+	if err := r.Rotate(); err != nil {
+		return nil, err
+	}
+	go r.run(interval)
+	return r, nil
+}
+
+func (r *TicketKeyRotator) run(interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ticker.C:
+			if err := r.Rotate(); err != nil {
+				log.Errorf("failed to rotate session ticket keys: %v", err)
+			}
+		case <-r.done:
+			return
+		}
+	}
+}
+
+// Rotate generates a new session ticket key, making it the current key and
+// discarding the oldest key if more than the configured number are held.
+func (r *TicketKeyRotator) Rotate() error {
+	var key [32]byte
+	if _, err := rand.Read(key[:]); err != nil {
+		return err
+	}
+
+	r.mtx.Lock()
+	defer r.mtx.Unlock()
+	keys := append([][32]byte{key}, r.keys...)
+	if len(keys) > r.keep {
+		keys = keys[:r.keep]
+	}
+	r.keys = keys
+	return nil
+}
+
+// TicketKeys returns the current session ticket keys, newest first.
+func (r *TicketKeyRotator) TicketKeys() ([][32]byte, error) {
+	r.mtx.RLock()
+	defer r.mtx.RUnlock()
+	return append([][32]byte(nil), r.keys...), nil
+}
+
+// Stop stops rotating keys. The current keys continue to be served.
+func (r *TicketKeyRotator) Stop() {
+	close(r.done)
+}
@@ -0,0 +1,206 @@
+package server
+
+import (
+	"context"
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"strings"
+	"sync"
+	"time"
+
+	"gopkg.in/square/go-jose.v2"
+	"gopkg.in/square/go-jose.v2/jwt"
+)
+
+// A TokenVerifier verifies the bearer tokens which clients without a
+// certificate authenticate with, using protocol.OpAuthenticate or, over
+// HTTP, an "Authorization: Bearer" header.
+type TokenVerifier interface {
+	// VerifyToken returns the identity of the client token was issued to,
+	// and when the token expires, or the zero time if it doesn't.
+	VerifyToken(ctx context.Context, token string) (*ClientIdentity, time.Time, error)
+}
+
+// tokenIdentity returns the identity of the client named name which
+// authenticated with token.
+func tokenIdentity(name, token string) *ClientIdentity {
+	id := &ClientIdentity{
+		CommonName:  name,
+		Fingerprint: sha256.Sum256([]byte(token)),
+	}
+	if strings.HasPrefix(name, "spiffe://") {
+		if u, err := url.Parse(name); err == nil {
+			id.SPIFFEID = name
+			id.URIs = []*url.URL{u}
+		}
+	}
+	return id
+}
+
+// StaticTokenVerifier accepts a fixed set of tokens, which never expire.
+type StaticTokenVerifier struct {
+	// names maps the SHA-256 digests of the tokens to the clients' names.
+	names map[[sha256.Size]byte]string
+}
+
+// NewStaticTokenVerifier returns a StaticTokenVerifier which accepts the
+// tokens in tokens, mapped to the names of the clients they were issued to.
+func NewStaticTokenVerifier(tokens map[string]string) *StaticTokenVerifier {
+	v := &StaticTokenVerifier{names: make(map[[sha256.Size]byte]string)}
+	for token, name := range tokens {
+		v.names[sha256.Sum256([]byte(token))] = name
+	}
+	return v
+}
+
+// VerifyToken implements TokenVerifier.
+func (v *StaticTokenVerifier) VerifyToken(ctx context.Context, token string) (*ClientIdentity, time.Time, error) {
+	// The tokens are looked up by digest so that the lookup doesn't leak them
+	// through its timing.
+	digest := sha256.Sum256([]byte(token))
+	for d, name := range v.names {
+		if subtle.ConstantTimeCompare(d[:], digest[:]) == 1 {
+			return tokenIdentity(name, token), time.Time{}, nil
+		}
+	}
+	return nil, time.Time{}, errors.New("unknown token")
+}
+
+const (
+	// jwksRefresh is how long a JSON Web Key Set is cached.
+	jwksRefresh = time.Hour
+	// jwksMinRefresh is how soon a JSON Web Key Set may be fetched again
+	// when a token is signed by an unknown key.
+	jwksMinRefresh = time.Minute
+	// maxDiscoveryLength limits the size of JWKS and OIDC discovery
+	// documents.
+	maxDiscoveryLength = 1 << 20
+)
+
+// A JWTTokenVerifier accepts JSON Web Tokens signed by one of the keys of a
+// JSON Web Key Set, such as the access tokens of an OAuth 2.0 authorization
+// server. The client is named by the token's subject.
+type JWTTokenVerifier struct {
+	jwksURL  string
+	issuer   string
+	audience string
+	// Client is used to fetch the key set.
+	Client *http.Client
+
+	mtx     sync.Mutex
+	keys    *jose.JSONWebKeySet
+	fetched time.Time
+}
+
+// NewJWTTokenVerifier returns a JWTTokenVerifier which accepts tokens issued
+// by issuer for audience, and signed with the keys published at jwksURL.
+// Tokens must have an expiry.
+func NewJWTTokenVerifier(jwksURL, issuer, audience string) *JWTTokenVerifier {
+	return &JWTTokenVerifier{
+		jwksURL:  jwksURL,
+		issuer:   issuer,
+		audience: audience,
+		Client:   http.DefaultClient,
+	}
+}
+
+// NewOIDCTokenVerifier returns a JWTTokenVerifier which accepts the ID tokens
+// issued by the OpenID Connect provider issuer for audience, whose keys are
+// found through OpenID Connect Discovery.
+func NewOIDCTokenVerifier(ctx context.Context, issuer, audience string) (*JWTTokenVerifier, error) {
+	var discovery struct {
+		Issuer  string `json:"issuer"`
+		JWKSURI string `json:"jwks_uri"`
+	}
+	u := strings.TrimSuffix(issuer, "/") + "/.well-known/openid-configuration"
+	if err := getJSON(ctx, http.DefaultClient, u, &discovery); err != nil {
+		return nil, err
+	}
+	if discovery.Issuer != issuer {
+		return nil, fmt.Errorf("OpenID Connect provider %s claims to be %s", issuer, discovery.Issuer)
+	}
+	if discovery.JWKSURI == "" {
+		return nil, fmt.Errorf("OpenID Connect provider %s has no jwks_uri", issuer)
+	}
+	return NewJWTTokenVerifier(discovery.JWKSURI, issuer, audience), nil
+}
+
+// VerifyToken implements TokenVerifier.
+func (v *JWTTokenVerifier) VerifyToken(ctx context.Context, token string) (*ClientIdentity, time.Time, error) {
+	tok, err := jwt.ParseSigned(token)
+	if err != nil {
+		return nil, time.Time{}, err
+	}
+	if len(tok.Headers) != 1 {
+		return nil, time.Time{}, errors.New("token must have exactly one signature")
+	}
+	key, err := v.key(ctx, tok.Headers[0].KeyID)
+	if err != nil {
+		return nil, time.Time{}, err
+	}
+
+	var claims jwt.Claims
+	if err := tok.Claims(key.Key, &claims); err != nil {
+		return nil, time.Time{}, err
+	}
+	expected := jwt.Expected{Issuer: v.issuer, Time: time.Now()}
+	if v.audience != "" {
+		expected.Audience = jwt.Audience{v.audience}
+	}
+	if err := claims.ValidateWithLeeway(expected, jwt.DefaultLeeway); err != nil {
+		return nil, time.Time{}, err
+	}
+	if claims.Expiry == nil {
+		return nil, time.Time{}, errors.New("token has no expiry")
+	}
+	return tokenIdentity(claims.Subject, token), claims.Expiry.Time(), nil
+}
+
+// key returns the signing key with ID kid, fetching the key set if it is
+// unknown or the cached set is stale.
+func (v *JWTTokenVerifier) key(ctx context.Context, kid string) (*jose.JSONWebKey, error) {
+	v.mtx.Lock()
+	defer v.mtx.Unlock()
+
+	if v.keys == nil || time.Since(v.fetched) > jwksRefresh ||
+		(len(v.keys.Key(kid)) == 0 && time.Since(v.fetched) > jwksMinRefresh) {
+		var keys jose.JSONWebKeySet
+		if err := getJSON(ctx, v.Client, v.jwksURL, &keys); err != nil {
+			if v.keys == nil {
+				return nil, fmt.Errorf("fetching JWKS: %v", err)
+			}
+			// Keep using the stale set rather than failing every request.
+		} else {
+			v.keys, v.fetched = &keys, time.Now()
+		}
+	}
+	for _, key := range v.keys.Key(kid) {
+		if key.Use == "" || key.Use == "sig" {
+			return &key, nil
+		}
+	}
+	return nil, fmt.Errorf("unknown signing key %q", kid)
+}
+
+// getJSON fetches the JSON document at u into v.
+func getJSON(ctx context.Context, client *http.Client, u string, v interface{}) error {
+	req, err := http.NewRequest(http.MethodGet, u, nil)
+	if err != nil {
+		return err
+	}
+	resp, err := client.Do(req.WithContext(ctx))
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("%s: %s", u, resp.Status)
+	}
+	return json.NewDecoder(io.LimitReader(resp.Body, maxDiscoveryLength)).Decode(v)
+}
@@ -0,0 +1,154 @@
+package server
+
+import (
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/cloudflare/gokeyless/protocol"
+)
+
+const (
+	// maxUsageClients bounds the number of clients whose usage is tracked, so
+	// that clients with many distinct identities can't exhaust memory or the
+	// metrics' label space. Further clients are counted as otherClients.
+	maxUsageClients = 1024
+	otherClients    = "<other>"
+)
+
+// ClientUsage aggregates the requests of a client over all its connections,
+// for chargeback and anomaly detection, as listed by the admin handler.
+type ClientUsage struct {
+	// Client is the SPIFFE ID or common name of the client, "<anonymous>"
+	// for clients which didn't authenticate, or "<other>" for the clients
+	// seen once the usage of 1024 others was being tracked.
+	Client       string    `json:"client"`
+	FirstSeen    time.Time `json:"first_seen"`
+	LastSeen     time.Time `json:"last_seen"`
+	Requests     int       `json:"requests"`
+	BytesRead    int64     `json:"bytes_read"`
+	BytesWritten int64     `json:"bytes_written"`
+	// Ops counts the requests by opcode, and Errors the error responses by
+	// error.
+	Ops    map[string]int `json:"ops"`
+	Errors map[string]int `json:"errors"`
+}
+
+type clientUsage struct {
+	firstSeen, lastSeen     time.Time
+	requests                int
+	bytesRead, bytesWritten int64
+	ops                     map[protocol.Op]int
+	errors                  map[protocol.Error]int
+}
+
+// usageTracker aggregates the usage of the server by client.
+type usageTracker struct {
+	metrics *serverMetrics
+	mtx     sync.Mutex
+	clients map[string]*clientUsage
+}
+
+func newUsageTracker(metrics *serverMetrics) *usageTracker {
+	return &usageTracker{metrics: metrics, clients: make(map[string]*clientUsage)}
+}
+
+// client returns the name the usage of the client with identity id is
+// tracked under, and its usage. t.mtx must be held.
+func (t *usageTracker) client(id *ClientIdentity) (string, *clientUsage) {
+	name := id.name()
+	u, ok := t.clients[name]
+	if !ok {
+		if len(t.clients) >= maxUsageClients {
+			name = otherClients
+			if u, ok = t.clients[name]; ok {
+				return name, u
+			}
+		}
+		u = &clientUsage{
+			firstSeen: time.Now(),
+			ops:       make(map[protocol.Op]int),
+			errors:    make(map[protocol.Error]int),
+		}
+		t.clients[name] = u
+	}
+	return name, u
+}
+
+// recordRequest records a request with opcode op from the client with
+// identity id.
+func (t *usageTracker) recordRequest(id *ClientIdentity, op protocol.Op) {
+	t.mtx.Lock()
+	name, u := t.client(id)
+	u.requests++
+	u.ops[op]++
+	u.lastSeen = time.Now()
+	t.mtx.Unlock()
+	t.metrics.logClientRequest(name, op)
+}
+
+// recordResponse records a response with error err to the client with
+// identity id.
+func (t *usageTracker) recordResponse(id *ClientIdentity, err protocol.Error) {
+	if err == protocol.ErrNone {
+		return
+	}
+	t.mtx.Lock()
+	name, u := t.client(id)
+	u.errors[err]++
+	t.mtx.Unlock()
+	t.metrics.logClientError(name, err)
+}
+
+// recordBytes records n bytes read from or, if written is set, written to
+// the client with identity id.
+func (t *usageTracker) recordBytes(id *ClientIdentity, n int64, written bool) {
+	if n <= 0 {
+		return
+	}
+	t.mtx.Lock()
+	name, u := t.client(id)
+	if written {
+		u.bytesWritten += n
+	} else {
+		u.bytesRead += n
+	}
+	t.mtx.Unlock()
+	t.metrics.logClientBytes(name, n, written)
+}
+
+// list describes the usage of each client, sorted by client.
+func (t *usageTracker) list() []ClientUsage {
+	t.mtx.Lock()
+	defer t.mtx.Unlock()
+	usage := make([]ClientUsage, 0, len(t.clients))
+	for name, u := range t.clients {
+		cu := ClientUsage{
+			Client:       name,
+			FirstSeen:    u.firstSeen,
+			LastSeen:     u.lastSeen,
+			Requests:     u.requests,
+			BytesRead:    u.bytesRead,
+			BytesWritten: u.bytesWritten,
+			Ops:          make(map[string]int, len(u.ops)),
+			Errors:       make(map[string]int, len(u.errors)),
+		}
+		for op, n := range u.ops {
+			cu.Ops[op.String()] += n
+		}
+		for err, n := range u.errors {
+			cu.Errors[err.String()] += n
+		}
+		usage = append(usage, cu)
+	}
+	sort.Slice(usage, func(i, j int) bool { return usage[i].Client < usage[j].Client })
+	return usage
+}
+
+// ClientUsage returns the usage of the server by each client since it
+// started, over the keyless protocol and HTTP/2, sorted by client. Clients
+// are told apart by their SPIFFE ID or common name, so that the usage of a
+// client outlives the rotation of its certificate.
+func (s *Server) ClientUsage() []ClientUsage {
+	return s.usage.list()
+}
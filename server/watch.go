@@ -0,0 +1,257 @@
+package server
+
+import (
+	"crypto"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+
+	"github.com/cloudflare/cfssl/helpers"
+	"github.com/cloudflare/cfssl/log"
+	"github.com/cloudflare/gokeyless/protocol"
+	"github.com/fsnotify/fsnotify"
+)
+
+// A KeyDirWatcher keeps a DefaultKeystore in sync with the ".key" files in a
+// directory: keys are added as soon as their files appear or change, and
+// removed when their files are deleted. If a ".pem" certificate with the same
+// base name as a key file exists, the key is only loaded if it matches the
+// certificate. Subdirectories are not watched.
+type KeyDirWatcher struct {
+	keys    *DefaultKeystore
+	dir     string
+	loadKey func([]byte) (crypto.Signer, error)
+	watcher *fsnotify.Watcher
+	// loaded maps the path of each key file in the keystore to its key.
+	loaded map[string]watchedKey
+	done   chan struct{}
+
+	mtx sync.Mutex
+	// certs indexes the certificates of the loaded keys, if set.
+	certs *CertIndex
+}
+
+type watchedKey struct {
+	ski protocol.SKI
+	// stamp identifies the versions of the key and certificate files loaded.
+	stamp string
+}
+
+// WatchDir adds all of the ".key" files in dir to the keystore, like
+// AddFromDir, and then keeps watching dir for changes until the returned
+// KeyDirWatcher is closed. Files which can't be loaded are logged and skipped,
+// since they may still be being written.
+func (keys *DefaultKeystore) WatchDir(dir string, LoadKey func([]byte) (crypto.Signer, error)) (*KeyDirWatcher, error) {
+	watcher, err := fsnotify.NewWatcher()
+	if err != nil {
+		return nil, err
+	}
+	if err := watcher.Add(dir); err != nil {
+		watcher.Close()
+		return nil, err
+	}
+
+	w := &KeyDirWatcher{
+		keys:    keys,
+		dir:     dir,
+		loadKey: LoadKey,
+		watcher: watcher,
+		loaded:  make(map[string]watchedKey),
+		done:    make(chan struct{}),
+	}
+	log.Infof("watching %s for keys...", dir)
+	w.scan()
+	go w.run()
+	return w, nil
+}
+
+// Close stops watching the directory. Keys already loaded stay in the
+// keystore.
+func (w *KeyDirWatcher) Close() error {
+	err := w.watcher.Close()
+	<-w.done
+	return err
+}
+
+// IndexCertificates adds the certificate of each key loaded from now on, if it
+// has one, to certs, such as Server.CertIndex(), so that renewed certificates
+// are indexed as soon as they are written.
+func (w *KeyDirWatcher) IndexCertificates(certs *CertIndex) {
+	w.mtx.Lock()
+	defer w.mtx.Unlock()
+	w.certs = certs
+}
+
+func (w *KeyDirWatcher) run() {
+	defer close(w.done)
+	for {
+		select {
+		case _, ok := <-w.watcher.Events:
+			if !ok {
+				return
+			}
+		case err, ok := <-w.watcher.Errors:
+			if !ok {
+				return
+			}
+			// Events may have been dropped, so rescan regardless.
+			log.Errorf("watching %s: %v", w.dir, err)
+		}
+		// Rescanning the whole directory, rather than the file named by the
+		// event, also handles files swapped in through symlinks.
+		w.scan()
+	}
+}
+
+// scan brings the keystore in line with the key files in the directory.
+func (w *KeyDirWatcher) scan() {
+	infos, err := ioutil.ReadDir(w.dir)
+	if err != nil {
+		log.Errorf("watching %s: %v", w.dir, err)
+		return
+	}
+
+	present := make(map[string]bool)
+	for _, info := range infos {
+		if info.IsDir() || !keyExt.MatchString(info.Name()) {
+			continue
+		}
+		path := filepath.Join(w.dir, info.Name())
+		present[path] = true
+		w.sync(path)
+	}
+	for path := range w.loaded {
+		if !present[path] {
+			w.evict(path)
+		}
+	}
+}
+
+// sync loads the key file at path if it has changed since it was last loaded.
+func (w *KeyDirWatcher) sync(path string) {
+	certPath := strings.TrimSuffix(path, filepath.Ext(path)) + ".pem"
+	stamp, err := fileStamp(path, certPath)
+	if os.IsNotExist(err) {
+		w.evict(path)
+		return
+	} else if err != nil {
+		log.Errorf("watching %s: %v", path, err)
+		return
+	}
+	old, ok := w.loaded[path]
+	if ok && old.stamp == stamp {
+		return
+	}
+
+	priv, err := w.load(path, certPath)
+	if err != nil {
+		log.Warningf("not loading %s: %v", path, err)
+		if err == errCertMismatch {
+			w.evict(path)
+		}
+		return
+	}
+	ski, err := protocol.GetSKI(priv.Public())
+	if err != nil {
+		log.Warningf("not loading %s: %v", path, err)
+		return
+	}
+	if err := w.keys.Add(nil, priv); err != nil {
+		log.Warningf("not loading %s: %v", path, err)
+		return
+	}
+	w.loaded[path] = watchedKey{ski: ski, stamp: stamp}
+	if ok && old.ski != ski {
+		w.release(old.ski)
+	}
+	log.Infof("loaded %s with SKI %v", path, ski)
+}
+
+var errCertMismatch = errors.New("key does not match certificate")
+
+// load reads the key at path and checks it against the certificate at
+// certPath, if there is one.
+func (w *KeyDirWatcher) load(path, certPath string) (crypto.Signer, error) {
+	in, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	priv, err := w.loadKey(in)
+	zeroizeBytes(in)
+	if err != nil {
+		return nil, err
+	}
+
+	in, err = ioutil.ReadFile(certPath)
+	if os.IsNotExist(err) {
+		return priv, nil
+	} else if err != nil {
+		return nil, err
+	}
+	cert, err := helpers.ParseCertificatePEM(in)
+	if err != nil {
+		return nil, fmt.Errorf("%s: %v", certPath, err)
+	}
+	certSKI, err := protocol.GetSKI(cert.PublicKey)
+	if err != nil {
+		return nil, fmt.Errorf("%s: %v", certPath, err)
+	}
+	keySKI, err := protocol.GetSKI(priv.Public())
+	if err != nil {
+		return nil, err
+	}
+	if certSKI != keySKI {
+		return nil, errCertMismatch
+	}
+	w.mtx.Lock()
+	certs := w.certs
+	w.mtx.Unlock()
+	if certs != nil {
+		if err := certs.Add(cert); err != nil {
+			log.Warningf("not indexing %s: %v", certPath, err)
+		}
+	}
+	return priv, nil
+}
+
+// evict removes the key loaded from path.
+func (w *KeyDirWatcher) evict(path string) {
+	k, ok := w.loaded[path]
+	if !ok {
+		return
+	}
+	delete(w.loaded, path)
+	w.release(k.ski)
+	log.Infof("unloaded %s with SKI %v", path, k.ski)
+}
+
+// release removes the key with ski from the keystore unless another file
+// still provides it.
+func (w *KeyDirWatcher) release(ski protocol.SKI) {
+	for _, k := range w.loaded {
+		if k.ski == ski {
+			return
+		}
+	}
+	w.keys.Remove(ski)
+}
+
+// fileStamp identifies the current versions of a key file and its optional
+// certificate.
+func fileStamp(keyPath, certPath string) (string, error) {
+	key, err := os.Stat(keyPath)
+	if err != nil {
+		return "", err
+	}
+	stamp := fmt.Sprintf("%d:%d", key.ModTime().UnixNano(), key.Size())
+	if cert, err := os.Stat(certPath); err == nil {
+		stamp += fmt.Sprintf(" %d:%d", cert.ModTime().UnixNano(), cert.Size())
+	} else if !os.IsNotExist(err) {
+		return "", err
+	}
+	return stamp, nil
+}
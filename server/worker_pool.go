@@ -1,7 +1,9 @@
 package server
 
 import (
+	"crypto"
 	"crypto/elliptic"
+	"crypto/rsa"
 	"fmt"
 	"sync"
 	"time"
@@ -22,19 +24,41 @@ const (
 )
 
 // A WorkerPoolSelector returns the appropriate WorkerPoolType based on the
-// request.
+// request. It may return the name of a pool defined with
+// ServeConfig.WithWorkerPool; any unknown name selects PoolOther.
 type WorkerPoolSelector func(pkt *protocol.Packet) WorkerPoolType
 
+// A WorkerPoolConfig defines an additional worker pool.
+type WorkerPoolConfig struct {
+	// Name identifies the pool in routes and metrics. It must differ from the
+	// built-in pool types.
+	Name WorkerPoolType
+	// Workers is the number of worker goroutines, which must be positive.
+	Workers int
+	// Queue is the number of requests which may wait for a worker before
+	// reading further requests blocks. If zero, the queue is effectively
+	// unbounded.
+	Queue int
+}
+
 type workerPool struct {
 	RSA     *worker.Pool
 	ECDSA   *worker.Pool
 	Other   *worker.Pool
 	Limited *worker.Pool
+	// Custom holds the pools defined with ServeConfig.WithWorkerPool.
+	Custom map[WorkerPoolType]*worker.Pool
 
-	selector WorkerPoolSelector
-	bg       *worker.BackgroundPool
-	utilCh   chan struct{}
-	utilWg   sync.WaitGroup
+	selector  WorkerPoolSelector
+	opRoutes  map[protocol.Op]WorkerPoolType
+	skiRoutes map[protocol.SKI]WorkerPoolType
+	bg        *worker.BackgroundPool
+	utilCh    chan struct{}
+	utilWg    sync.WaitGroup
+	// rsaProcs bounds the concurrent RSA private key operations, if
+	// ServeConfig.WithRSAProcs is set.
+	rsaProcs chan struct{}
+	metrics  *serverMetrics
 }
 
 const randBufferLen = 1024
@@ -47,6 +71,33 @@ func newWorkerPool(s *Server) (*workerPool, error) {
 		s.config.otherWorkers <= 0 {
 		return nil, fmt.Errorf("non-zero number of RSA, ECDSA, and Other workers is required")
 	}
+	if s.config.rsaProcs < 0 {
+		return nil, fmt.Errorf("the bound on RSA operations must not be negative")
+	}
+	seen := make(map[WorkerPoolType]bool)
+	for _, pc := range s.config.pools {
+		if seen[pc.Name] {
+			return nil, fmt.Errorf("worker pool %q is defined twice", pc.Name)
+		}
+		seen[pc.Name] = true
+		switch pc.Name {
+		case PoolRSA, PoolECDSA, PoolOther, "limited":
+			return nil, fmt.Errorf("worker pool %q is built in", pc.Name)
+		}
+		if pc.Workers <= 0 || pc.Queue < 0 {
+			return nil, fmt.Errorf("worker pool %q needs a positive number of workers and a non-negative queue", pc.Name)
+		}
+	}
+	for op, name := range s.config.opRoutes {
+		if !s.config.hasPool(name) {
+			return nil, fmt.Errorf("%v is routed to undefined worker pool %q", op, name)
+		}
+	}
+	for ski, name := range s.config.skiRoutes {
+		if !s.config.hasPool(name) {
+			return nil, fmt.Errorf("key %v is routed to undefined worker pool %q", ski, name)
+		}
+	}
 
 	var ecdsas []worker.Worker
 	var rsas []worker.Worker
@@ -71,29 +122,53 @@ func newWorkerPool(s *Server) (*workerPool, error) {
 	}
 
 	wp := &workerPool{
-		RSA:      worker.NewPool(rsas...),
-		ECDSA:    worker.NewPool(ecdsas...),
-		Other:    worker.NewPool(others...),
-		Limited:  worker.NewPool(limiteds...),
-		selector: s.config.poolSelector,
-		bg:       worker.NewBackgroundPool(background...),
-		utilCh:   make(chan struct{}),
+		RSA:       worker.NewPool(rsas...),
+		ECDSA:     worker.NewPool(ecdsas...),
+		Other:     worker.NewPool(others...),
+		Limited:   worker.NewPool(limiteds...),
+		Custom:    make(map[WorkerPoolType]*worker.Pool),
+		selector:  s.config.poolSelector,
+		opRoutes:  s.config.opRoutes,
+		skiRoutes: s.config.skiRoutes,
+		bg:        worker.NewBackgroundPool(background...),
+		utilCh:    make(chan struct{}),
+		metrics:   s.metrics,
+	}
+	if s.config.rsaProcs > 0 {
+		wp.rsaProcs = make(chan struct{}, s.config.rsaProcs)
+	}
+	for _, pc := range s.config.pools {
+		var workers []worker.Worker
+		for i := 0; i < pc.Workers; i++ {
+			workers = append(workers, newKeylessWorker(s, rbuf, fmt.Sprintf("%s-%v", pc.Name, i)))
+		}
+		queue := pc.Queue
+		if queue == 0 {
+			queue = worker.DefaultQueueLen
+		}
+		wp.Custom[pc.Name] = worker.NewPoolWithQueue(queue, workers...)
 	}
 
 	for _, label := range []string{"rsa", "ecdsa", "other", "limited"} {
 		serverUtilization.WithLabelValues(label)
 	}
+	for _, pc := range s.config.pools {
+		serverUtilization.WithLabelValues(string(pc.Name))
+	}
 	wp.utilWg.Add(1)
 	go func() {
 		ticker := time.NewTicker(1 * time.Second)
 		for {
 			select {
 			case <-ticker.C:
-				serverUtilization.WithLabelValues("rsa").Set(float64(wp.RSA.Busy()) / float64(s.config.rsaWorkers))
-				serverUtilization.WithLabelValues("ecdsa").Set(float64(wp.ECDSA.Busy()) / float64(s.config.ecdsaWorkers))
-				serverUtilization.WithLabelValues("other").Set(float64(wp.Other.Busy()) / float64(s.config.otherWorkers))
+				s.metrics.logUtilization("rsa", float64(wp.RSA.Busy())/float64(s.config.rsaWorkers))
+				s.metrics.logUtilization("ecdsa", float64(wp.ECDSA.Busy())/float64(s.config.ecdsaWorkers))
+				s.metrics.logUtilization("other", float64(wp.Other.Busy())/float64(s.config.otherWorkers))
 				if s.config.limitedWorkers > 0 {
-					serverUtilization.WithLabelValues("limited").Set(float64(wp.Limited.Busy()) / float64(s.config.limitedWorkers))
+					s.metrics.logUtilization("limited", float64(wp.Limited.Busy())/float64(s.config.limitedWorkers))
+				}
+				for _, pc := range s.config.pools {
+					s.metrics.logUtilization(string(pc.Name), float64(wp.Custom[pc.Name].Busy())/float64(pc.Workers))
 				}
 
 			case <-wp.utilCh:
@@ -112,7 +187,48 @@ func (wp *workerPool) Destroy() {
 	wp.bg.Destroy()
 	wp.Other.Destroy()
 	wp.ECDSA.Destroy()
+	for _, p := range wp.Custom {
+		p.Destroy()
+	}
 	// Stop publishing utilization info.
 	close(wp.utilCh)
 	wp.utilWg.Wait()
 }
+
+// pool returns the pool to handle pkt. Key routes take precedence over opcode
+// routes, which take precedence over the selector.
+func (wp *workerPool) pool(pkt *protocol.Packet) *worker.Pool {
+	name, ok := wp.skiRoutes[pkt.Operation.SKI]
+	if !ok {
+		name, ok = wp.opRoutes[pkt.Operation.Opcode]
+	}
+	if !ok {
+		name = wp.selector(pkt)
+	}
+	switch name {
+	case PoolRSA:
+		return wp.RSA
+	case PoolECDSA:
+		return wp.ECDSA
+	}
+	if p, ok := wp.Custom[name]; ok {
+		return p
+	}
+	return wp.Other
+}
+
+// acquireRSAProc waits until an RSA private key operation with key may start,
+// if their concurrency is bounded and key is an RSA key, and returns the
+// function to call once it is done.
+func (wp *workerPool) acquireRSAProc(key crypto.Signer) func() {
+	if wp.rsaProcs == nil {
+		return func() {}
+	}
+	if _, ok := key.Public().(*rsa.PublicKey); !ok {
+		return func() {}
+	}
+	begin := time.Now()
+	wp.rsaProcs <- struct{}{}
+	wp.metrics.logRSAProcWait(begin)
+	return func() { <-wp.rsaProcs }
+}
@@ -0,0 +1,222 @@
+// Package sm2 implements SM2 signatures with SM3, as defined in GB/T 32918
+// (GM/T 0003-2012), over the recommended 256-bit curve, and the encodings of
+// SM2 keys used by GmSSL and OpenSSL.
+//
+// The curve arithmetic is that of elliptic.CurveParams, which is not
+// constant-time.
+package sm2
+
+import (
+	"crypto"
+	"crypto/elliptic"
+	"encoding/asn1"
+	"errors"
+	"fmt"
+	"io"
+	"math/big"
+	"sync"
+
+	"github.com/cloudflare/gokeyless/sm3"
+)
+
+// DefaultUID is the user ID signatures are made with unless another is
+// agreed on, as recommended by GM/T 0009-2012.
+var DefaultUID = []byte("1234567812345678")
+
+var (
+	initOnce sync.Once
+	p256     *elliptic.CurveParams
+)
+
+func initP256() {
+	p256 = &elliptic.CurveParams{Name: "SM2-P-256", BitSize: 256}
+	p256.P, _ = new(big.Int).SetString("FFFFFFFEFFFFFFFFFFFFFFFFFFFFFFFFFFFFFFFF00000000FFFFFFFFFFFFFFFF", 16)
+	p256.N, _ = new(big.Int).SetString("FFFFFFFEFFFFFFFFFFFFFFFFFFFFFFFF7203DF6B21C6052B53BBF40939D54123", 16)
+	p256.B, _ = new(big.Int).SetString("28E9FA9E9D9F5E344D5A9E4BCF6509A7F39789F515AB8F92DDBCBD414D940E93", 16)
+	p256.Gx, _ = new(big.Int).SetString("32C4AE2C1F1981195F9904466A39C9948FE30BBFF2660BE1715A4589334C74C7", 16)
+	p256.Gy, _ = new(big.Int).SetString("BC3736A2F4F6779C59BDCEE36B692153D0A9877CC62A474002DF32E52139F0A0", 16)
+}
+
+// P256 returns the curve recommended for SM2. Its coefficient a is -3, so
+// that elliptic.CurveParams implements it.
+func P256() elliptic.Curve {
+	initOnce.Do(initP256)
+	return p256
+}
+
+// PublicKey is an SM2 public key.
+type PublicKey struct {
+	X, Y *big.Int
+}
+
+// PrivateKey is an SM2 private key. It implements crypto.Signer.
+type PrivateKey struct {
+	PublicKey
+	D *big.Int
+}
+
+// SignerOpts are the options of SM2 signatures: their digest is computed
+// with SM3 over the signer's identity and the message by Digest, rather than
+// with a crypto.Hash, so HashFunc returns 0.
+type SignerOpts struct{}
+
+// HashFunc returns 0.
+func (SignerOpts) HashFunc() crypto.Hash { return 0 }
+
+// Equal reports whether pub and x are the same public key.
+func (pub *PublicKey) Equal(x crypto.PublicKey) bool {
+	other, ok := x.(*PublicKey)
+	return ok && pub.X.Cmp(other.X) == 0 && pub.Y.Cmp(other.Y) == 0
+}
+
+// Public returns the public key of priv.
+func (priv *PrivateKey) Public() crypto.PublicKey {
+	return &priv.PublicKey
+}
+
+// GenerateKey generates an SM2 private key with randomness from rand.
+func GenerateKey(rand io.Reader) (*PrivateKey, error) {
+	c := P256()
+	// The private key must be below n-1, so that 1+d is invertible.
+	d, err := randScalar(rand, new(big.Int).Sub(c.Params().N, big.NewInt(1)))
+	if err != nil {
+		return nil, err
+	}
+	return newPrivateKey(d), nil
+}
+
+func newPrivateKey(d *big.Int) *PrivateKey {
+	priv := &PrivateKey{D: d}
+	priv.X, priv.Y = P256().ScalarBaseMult(d.Bytes())
+	return priv
+}
+
+// randScalar returns a random integer in [1, max-1].
+func randScalar(rand io.Reader, max *big.Int) (*big.Int, error) {
+	// The extra 64 bits make the bias of the reduction negligible.
+	b := make([]byte, max.BitLen()/8+8)
+	if _, err := io.ReadFull(rand, b); err != nil {
+		return nil, err
+	}
+	k := new(big.Int).SetBytes(b)
+	k.Mod(k, new(big.Int).Sub(max, big.NewInt(1)))
+	return k.Add(k, big.NewInt(1)), nil
+}
+
+// ZA returns the hash of the identity of the signer with public key pub and
+// user ID uid, which is hashed along with the messages it signs.
+func ZA(pub *PublicKey, uid []byte) ([]byte, error) {
+	if len(uid) >= 1<<13 {
+		return nil, errors.New("sm2: user ID too long")
+	}
+	params := P256().Params()
+	h := sm3.New()
+	bitLen := len(uid) * 8
+	h.Write([]byte{byte(bitLen >> 8), byte(bitLen)})
+	h.Write(uid)
+	a := new(big.Int).Sub(params.P, big.NewInt(3))
+	for _, x := range []*big.Int{a, params.B, params.Gx, params.Gy, pub.X, pub.Y} {
+		h.Write(x.FillBytes(make([]byte, 32)))
+	}
+	return h.Sum(nil), nil
+}
+
+// Digest returns the digest e = SM3(ZA || msg) which the signer with public
+// key pub and user ID uid signs for msg. A nil uid is DefaultUID.
+func Digest(pub *PublicKey, uid, msg []byte) ([]byte, error) {
+	if uid == nil {
+		uid = DefaultUID
+	}
+	za, err := ZA(pub, uid)
+	if err != nil {
+		return nil, err
+	}
+	h := sm3.New()
+	h.Write(za)
+	h.Write(msg)
+	return h.Sum(nil), nil
+}
+
+type signature struct {
+	R, S *big.Int
+}
+
+// Sign signs digest, as computed by Digest, and returns the ASN.1 encoding of
+// the signature. opts must not name a hash function, e.g. be SignerOpts.
+func (priv *PrivateKey) Sign(rand io.Reader, digest []byte, opts crypto.SignerOpts) ([]byte, error) {
+	if opts != nil && opts.HashFunc() != 0 {
+		return nil, fmt.Errorf("sm2: can't sign a %v digest", opts.HashFunc())
+	}
+	if len(digest) != sm3.Size {
+		return nil, errors.New("sm2: digest must be an SM3 hash")
+	}
+	r, s, err := sign(rand, priv, digest)
+	if err != nil {
+		return nil, err
+	}
+	return asn1.Marshal(signature{r, s})
+}
+
+func sign(rand io.Reader, priv *PrivateKey, digest []byte) (r, s *big.Int, err error) {
+	c := P256()
+	n := c.Params().N
+	e := new(big.Int).SetBytes(digest)
+	// s = (1+d)^-1 * (k - r*d) mod n
+	dInv := new(big.Int).Add(priv.D, big.NewInt(1))
+	if dInv.ModInverse(dInv, n) == nil {
+		return nil, nil, errors.New("sm2: invalid private key")
+	}
+	for {
+		k, err := randScalar(rand, n)
+		if err != nil {
+			return nil, nil, err
+		}
+		x1, _ := c.ScalarBaseMult(k.Bytes())
+		r = new(big.Int).Add(e, x1)
+		r.Mod(r, n)
+		if r.Sign() == 0 || new(big.Int).Add(r, k).Cmp(n) == 0 {
+			continue
+		}
+		s = new(big.Int).Mul(r, priv.D)
+		s.Sub(k, s)
+		s.Mul(s, dInv)
+		s.Mod(s, n)
+		if s.Sign() != 0 {
+			return r, s, nil
+		}
+	}
+}
+
+// VerifyASN1 reports whether sig, an ASN.1-encoded signature, is a valid
+// signature of digest, as computed by Digest, by pub.
+func VerifyASN1(pub *PublicKey, digest, sig []byte) bool {
+	var rs signature
+	if rest, err := asn1.Unmarshal(sig, &rs); err != nil || len(rest) != 0 || rs.R == nil || rs.S == nil {
+		return false
+	}
+	return Verify(pub, digest, rs.R, rs.S)
+}
+
+// Verify reports whether (r, s) is a valid signature of digest, as computed
+// by Digest, by pub.
+func Verify(pub *PublicKey, digest []byte, r, s *big.Int) bool {
+	c := P256()
+	n := c.Params().N
+	if r.Sign() <= 0 || s.Sign() <= 0 || r.Cmp(n) >= 0 || s.Cmp(n) >= 0 || len(digest) != sm3.Size {
+		return false
+	}
+	if !c.IsOnCurve(pub.X, pub.Y) {
+		return false
+	}
+	t := new(big.Int).Add(r, s)
+	t.Mod(t, n)
+	if t.Sign() == 0 {
+		return false
+	}
+	x1, y1 := c.ScalarBaseMult(s.Bytes())
+	x2, y2 := c.ScalarMult(pub.X, pub.Y, t.Bytes())
+	x, _ := c.Add(x1, y1, x2, y2)
+	x.Add(x, new(big.Int).SetBytes(digest))
+	x.Mod(x, n)
+	return x.Cmp(r) == 0
+}
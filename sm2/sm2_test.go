@@ -0,0 +1,172 @@
+package sm2
+
+import (
+	"bytes"
+	"crypto"
+	"crypto/rand"
+	"encoding/asn1"
+	"encoding/pem"
+	"io/ioutil"
+	"math/big"
+	"testing"
+)
+
+// The files in testdata were generated with OpenSSL 3.0:
+//
+//	openssl genpkey -algorithm SM2 -out pkcs8.key
+//	openssl ec -in pkcs8.key -out sec1.key
+//	openssl pkey -in pkcs8.key -pubout -out pub.pem
+//	openssl req -new -x509 -key pkcs8.key -sm3 -sigopt distid:1234567812345678 -subj /CN=sm2.example.com -days 3650 -out cert.pem
+//	openssl dgst -sm3 -sign pkcs8.key -sigopt distid:1234567812345678 -out msg.sig msg.txt
+
+func readPEM(t *testing.T, file string) []byte {
+	in, err := ioutil.ReadFile(file)
+	if err != nil {
+		t.Fatal(err)
+	}
+	block, _ := pem.Decode(in)
+	if block == nil {
+		t.Fatalf("%s: no PEM data", file)
+	}
+	return block.Bytes
+}
+
+func TestCurve(t *testing.T) {
+	c := P256()
+	params := c.Params()
+	if !c.IsOnCurve(params.Gx, params.Gy) {
+		t.Fatal("generator is not on the curve")
+	}
+	// n-1 times the generator is its opposite.
+	x, y := c.ScalarBaseMult(new(big.Int).Sub(params.N, big.NewInt(1)).Bytes())
+	if x.Cmp(params.Gx) != 0 || new(big.Int).Add(y, params.Gy).Cmp(params.P) != 0 {
+		t.Fatal("the order of the generator is not n")
+	}
+}
+
+func TestParseKeys(t *testing.T) {
+	pkcs8, err := ioutil.ReadFile("testdata/pkcs8.key")
+	if err != nil {
+		t.Fatal(err)
+	}
+	priv, err := ParsePrivateKeyPEM(pkcs8)
+	if err != nil {
+		t.Fatal(err)
+	}
+	sec1, err := ParsePrivateKey(readPEM(t, "testdata/sec1.key"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if priv.D.Cmp(sec1.D) != 0 {
+		t.Fatal("PKCS #8 and SEC 1 keys differ")
+	}
+
+	pub, err := ParsePKIXPublicKey(readPEM(t, "testdata/pub.pem"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !pub.Equal(priv.Public()) {
+		t.Fatal("public key doesn't match the private key")
+	}
+	der, err := MarshalPKIXPublicKey(pub)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(der, readPEM(t, "testdata/pub.pem")) {
+		t.Fatal("MarshalPKIXPublicKey doesn't match OpenSSL")
+	}
+
+	der, err = MarshalPrivateKey(priv)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if again, err := ParsePrivateKey(der); err != nil || again.D.Cmp(priv.D) != 0 {
+		t.Fatalf("MarshalPrivateKey doesn't round trip: %v", err)
+	}
+}
+
+func TestVerifyOpenSSL(t *testing.T) {
+	pub, err := ParsePKIXPublicKey(readPEM(t, "testdata/pub.pem"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	msg, err := ioutil.ReadFile("testdata/msg.txt")
+	if err != nil {
+		t.Fatal(err)
+	}
+	sig, err := ioutil.ReadFile("testdata/msg.sig")
+	if err != nil {
+		t.Fatal(err)
+	}
+	digest, err := Digest(pub, nil, msg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !VerifyASN1(pub, digest, sig) {
+		t.Fatal("OpenSSL signature doesn't verify")
+	}
+	if digest, _ := Digest(pub, []byte("ALICE123@YAHOO.COM"), msg); VerifyASN1(pub, digest, sig) {
+		t.Fatal("OpenSSL signature verifies with another user ID")
+	}
+}
+
+func TestCertificate(t *testing.T) {
+	der := readPEM(t, "testdata/cert.pem")
+	pub, err := ParseCertificatePublicKey(der)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !pub.Equal(mustParsePub(t)) {
+		t.Fatal("certificate public key doesn't match")
+	}
+
+	// The certificate is self-signed with SM2 and SM3.
+	var cert certificate
+	if _, err := asn1.Unmarshal(der, &cert); err != nil {
+		t.Fatal(err)
+	}
+	digest, err := Digest(pub, nil, cert.TBSCertificate.Raw)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !VerifyASN1(pub, digest, cert.SignatureValue.RightAlign()) {
+		t.Fatal("certificate signature doesn't verify")
+	}
+}
+
+func mustParsePub(t *testing.T) *PublicKey {
+	pub, err := ParsePKIXPublicKey(readPEM(t, "testdata/pub.pem"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	return pub
+}
+
+func TestSignVerify(t *testing.T) {
+	priv, err := GenerateKey(rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	pub := priv.Public().(*PublicKey)
+	digest, err := Digest(pub, nil, []byte("hello"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	sig, err := priv.Sign(rand.Reader, digest, SignerOpts{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !VerifyASN1(pub, digest, sig) {
+		t.Fatal("signature doesn't verify")
+	}
+	digest[0] ^= 1
+	if VerifyASN1(pub, digest, sig) {
+		t.Fatal("signature verifies for another digest")
+	}
+	if _, err := priv.Sign(rand.Reader, digest[:20], SignerOpts{}); err == nil {
+		t.Fatal("signed a digest which isn't an SM3 hash")
+	}
+	if _, err := priv.Sign(rand.Reader, digest, crypto.SHA256); err == nil {
+		t.Fatal("signed a SHA-256 digest")
+	}
+}
@@ -0,0 +1,182 @@
+package sm2
+
+import (
+	"crypto/elliptic"
+	"crypto/x509/pkix"
+	"encoding/asn1"
+	"encoding/pem"
+	"errors"
+	"math/big"
+	"strings"
+)
+
+var (
+	oidPublicKeyECDSA = asn1.ObjectIdentifier{1, 2, 840, 10045, 2, 1}
+	// oidSM2 identifies the SM2 curve, and SM2 keys in the encodings which
+	// use it as the algorithm rather than as the parameters of an EC key.
+	oidSM2 = asn1.ObjectIdentifier{1, 2, 156, 10197, 1, 301}
+)
+
+type publicKeyInfo struct {
+	Raw       asn1.RawContent
+	Algorithm pkix.AlgorithmIdentifier
+	PublicKey asn1.BitString
+}
+
+type ecPrivateKey struct {
+	Version       int
+	PrivateKey    []byte
+	NamedCurveOID asn1.ObjectIdentifier `asn1:"optional,explicit,tag:0"`
+	PublicKey     asn1.BitString        `asn1:"optional,explicit,tag:1"`
+}
+
+type pkcs8 struct {
+	Version    int
+	Algo       pkix.AlgorithmIdentifier
+	PrivateKey []byte
+}
+
+// tbsCertificate is the signed part of a certificate.
+type tbsCertificate struct {
+	Raw                asn1.RawContent
+	Version            int `asn1:"optional,explicit,default:0,tag:0"`
+	SerialNumber       *big.Int
+	SignatureAlgorithm pkix.AlgorithmIdentifier
+	Issuer             asn1.RawValue
+	Validity           asn1.RawValue
+	Subject            asn1.RawValue
+	PublicKey          publicKeyInfo
+	UniqueID           asn1.BitString `asn1:"optional,tag:1"`
+	SubjectUniqueID    asn1.BitString `asn1:"optional,tag:2"`
+	Extensions         asn1.RawValue  `asn1:"optional,explicit,tag:3"`
+}
+
+type certificate struct {
+	TBSCertificate     tbsCertificate
+	SignatureAlgorithm pkix.AlgorithmIdentifier
+	SignatureValue     asn1.BitString
+}
+
+// isSM2Algorithm reports whether algo identifies an SM2 key.
+func isSM2Algorithm(algo pkix.AlgorithmIdentifier) bool {
+	if algo.Algorithm.Equal(oidSM2) {
+		return true
+	}
+	var curve asn1.ObjectIdentifier
+	if !algo.Algorithm.Equal(oidPublicKeyECDSA) {
+		return false
+	}
+	rest, err := asn1.Unmarshal(algo.Parameters.FullBytes, &curve)
+	return err == nil && len(rest) == 0 && curve.Equal(oidSM2)
+}
+
+// MarshalPKIXPublicKey returns the DER encoding of the SubjectPublicKeyInfo
+// of pub.
+func MarshalPKIXPublicKey(pub *PublicKey) ([]byte, error) {
+	params, err := asn1.Marshal(oidSM2)
+	if err != nil {
+		return nil, err
+	}
+	point := elliptic.Marshal(P256(), pub.X, pub.Y)
+	return asn1.Marshal(publicKeyInfo{
+		Algorithm: pkix.AlgorithmIdentifier{
+			Algorithm:  oidPublicKeyECDSA,
+			Parameters: asn1.RawValue{FullBytes: params},
+		},
+		PublicKey: asn1.BitString{Bytes: point, BitLength: 8 * len(point)},
+	})
+}
+
+// ParsePKIXPublicKey parses the DER encoding of the SubjectPublicKeyInfo of
+// an SM2 key.
+func ParsePKIXPublicKey(der []byte) (*PublicKey, error) {
+	var info publicKeyInfo
+	if rest, err := asn1.Unmarshal(der, &info); err != nil {
+		return nil, err
+	} else if len(rest) != 0 {
+		return nil, errors.New("sm2: trailing data after public key")
+	}
+	return parsePublicKey(&info)
+}
+
+func parsePublicKey(info *publicKeyInfo) (*PublicKey, error) {
+	if !isSM2Algorithm(info.Algorithm) {
+		return nil, errors.New("sm2: not an SM2 public key")
+	}
+	x, y := elliptic.Unmarshal(P256(), info.PublicKey.RightAlign())
+	if x == nil {
+		return nil, errors.New("sm2: invalid public key")
+	}
+	return &PublicKey{X: x, Y: y}, nil
+}
+
+// ParseCertificatePublicKey returns the SM2 public key of the DER-encoded
+// X.509 certificate der, which crypto/x509 can't parse. The certificate is
+// not verified.
+func ParseCertificatePublicKey(der []byte) (*PublicKey, error) {
+	var cert certificate
+	if _, err := asn1.Unmarshal(der, &cert); err != nil {
+		return nil, err
+	}
+	return parsePublicKey(&cert.TBSCertificate.PublicKey)
+}
+
+// ParsePrivateKey parses an SM2 private key in SEC 1 ("EC PRIVATE KEY") or
+// PKCS #8 ("PRIVATE KEY") DER form, as written by GmSSL and OpenSSL.
+func ParsePrivateKey(der []byte) (*PrivateKey, error) {
+	var p8 pkcs8
+	if _, err := asn1.Unmarshal(der, &p8); err == nil {
+		if !isSM2Algorithm(p8.Algo) {
+			return nil, errors.New("sm2: not an SM2 private key")
+		}
+		return parseECPrivateKey(p8.PrivateKey, true)
+	}
+	return parseECPrivateKey(der, false)
+}
+
+// parseECPrivateKey parses a SEC 1 private key, whose curve may be implied if
+// it is wrapped in PKCS #8.
+func parseECPrivateKey(der []byte, implicitCurve bool) (*PrivateKey, error) {
+	var key ecPrivateKey
+	if _, err := asn1.Unmarshal(der, &key); err != nil {
+		return nil, err
+	}
+	if key.Version != 1 {
+		return nil, errors.New("sm2: unknown EC private key version")
+	}
+	if !key.NamedCurveOID.Equal(oidSM2) && !(implicitCurve && len(key.NamedCurveOID) == 0) {
+		return nil, errors.New("sm2: not an SM2 private key")
+	}
+	d := new(big.Int).SetBytes(key.PrivateKey)
+	if d.Sign() <= 0 || d.Cmp(new(big.Int).Sub(P256().Params().N, big.NewInt(1))) >= 0 {
+		return nil, errors.New("sm2: invalid private key")
+	}
+	return newPrivateKey(d), nil
+}
+
+// MarshalPrivateKey returns the SEC 1 DER encoding of priv.
+func MarshalPrivateKey(priv *PrivateKey) ([]byte, error) {
+	point := elliptic.Marshal(P256(), priv.X, priv.Y)
+	return asn1.Marshal(ecPrivateKey{
+		Version:       1,
+		PrivateKey:    priv.D.FillBytes(make([]byte, 32)),
+		NamedCurveOID: oidSM2,
+		PublicKey:     asn1.BitString{Bytes: point, BitLength: 8 * len(point)},
+	})
+}
+
+// ParsePrivateKeyPEM parses the first PEM block of in as an SM2 private key.
+func ParsePrivateKeyPEM(in []byte) (*PrivateKey, error) {
+	for {
+		var block *pem.Block
+		block, in = pem.Decode(in)
+		if block == nil {
+			return nil, errors.New("sm2: no private key in PEM data")
+		}
+		// OpenSSL may write the curve parameters before SEC 1 keys.
+		if strings.HasSuffix(block.Type, " PARAMETERS") {
+			continue
+		}
+		return ParsePrivateKey(block.Bytes)
+	}
+}
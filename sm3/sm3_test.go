@@ -0,0 +1,52 @@
+package sm3
+
+import (
+	"bytes"
+	"encoding/hex"
+	"strings"
+	"testing"
+)
+
+var vectors = []struct {
+	in, out string
+}{
+	// The examples of GB/T 32905-2016, appendix A.
+	{"abc", "66c7f0f462eeedd9d1f2d46bdc10e4e24167c4875cf2f7a2297da02b8f4ba8e0"},
+	{strings.Repeat("abcd", 16), "debe9ff92275b8a138604889c18e5a4d6fdb70e5387e5765293dcba39c0c5732"},
+	// Computed with "openssl dgst -sm3".
+	{"", "1ab21d8355cfa17f8e61194831e81a8f22bec8c728fefb747ed035eb5082aa2b"},
+	{strings.Repeat("\x00", 1000), "61309912e8d2f178c914f662072a9e2eda315ab9f279f8a50e7063f245f19031"},
+}
+
+func TestSum(t *testing.T) {
+	for _, v := range vectors {
+		sum := Sum([]byte(v.in))
+		if got := hex.EncodeToString(sum[:]); got != v.out {
+			t.Errorf("Sum(%q) = %s, want %s", v.in, got, v.out)
+		}
+	}
+}
+
+func TestWrite(t *testing.T) {
+	for _, v := range vectors {
+		h := New()
+		// Write the input in uneven pieces, and sum it halfway through.
+		for in := []byte(v.in); len(in) > 0; {
+			n := 7
+			if n > len(in) {
+				n = len(in)
+			}
+			h.Write(in[:n])
+			in = in[n:]
+			h.Sum(nil)
+		}
+		if got := hex.EncodeToString(h.Sum(nil)); got != v.out {
+			t.Errorf("New().Write(%q) = %s, want %s", v.in, got, v.out)
+		}
+		h.Reset()
+		h.Write([]byte(v.in))
+		if sum := Sum([]byte(v.in)); !bytes.Equal(h.Sum(nil), sum[:]) {
+			t.Errorf("Reset did not reset the hash of %q", v.in)
+		}
+	}
+}
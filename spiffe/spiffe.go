@@ -0,0 +1,175 @@
+// Package spiffe obtains keyless client and server TLS certificates and trust
+// bundles from a SPIFFE Workload API (e.g. a SPIRE agent), keeping them up to
+// date as they are rotated.
+package spiffe
+
+import (
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"os"
+	"sync"
+	"time"
+
+	"github.com/cloudflare/backoff"
+	"github.com/cloudflare/cfssl/log"
+	"google.golang.org/grpc"
+)
+
+// EndpointSocketEnv is the environment variable which conventionally holds the
+// address of the Workload API.
+const EndpointSocketEnv = "SPIFFE_ENDPOINT_SOCKET"
+
+// A Source holds the current X.509 SVID and trust bundle received from the
+// Workload API.
+type Source struct {
+	mtx    sync.RWMutex
+	svid   *svid
+	bundle *x509.CertPool
+
+	conn   *grpc.ClientConn
+	cancel context.CancelFunc
+	done   chan struct{}
+}
+
+// NewSource connects to the Workload API at addr and waits until the first SVID
+// has been received or ctx is done. If addr is empty, the value of
+// SPIFFE_ENDPOINT_SOCKET is used. The Source keeps watching for updates until it
+// is closed.
+func NewSource(ctx context.Context, addr string) (*Source, error) {
+	if addr == "" {
+		addr = os.Getenv(EndpointSocketEnv)
+	}
+	if addr == "" {
+		return nil, errors.New("spiffe: no workload API address")
+	}
+
+	conn, err := dialWorkloadAPI(ctx, addr)
+	if err != nil {
+		return nil, err
+	}
+
+	watchCtx, cancel := context.WithCancel(context.Background())
+	s := &Source{conn: conn, cancel: cancel, done: make(chan struct{})}
+	ready := make(chan struct{})
+	go s.watch(watchCtx, ready)
+
+	select {
+	case <-ready:
+		return s, nil
+	case <-ctx.Done():
+		s.Close()
+		return nil, ctx.Err()
+	}
+}
+
+func (s *Source) watch(ctx context.Context, ready chan struct{}) {
+	defer close(s.done)
+	var once sync.Once
+	b := backoff.New(time.Minute, time.Second)
+	for {
+		err := streamX509SVIDs(ctx, s.conn, func(v *svid) {
+			s.update(v)
+			b.Reset()
+			once.Do(func() { close(ready) })
+		})
+		if ctx.Err() != nil {
+			return
+		}
+		log.Warningf("spiffe: workload API stream failed: %v", err)
+
+		select {
+		case <-time.After(b.Duration()):
+		case <-ctx.Done():
+			return
+		}
+	}
+}
+
+func (s *Source) update(v *svid) {
+	pool := x509.NewCertPool()
+	for _, cert := range v.bundle {
+		pool.AddCert(cert)
+	}
+
+	s.mtx.Lock()
+	s.svid = v
+	s.bundle = pool
+	s.mtx.Unlock()
+	log.Infof("spiffe: received SVID %s expiring %s", v.id, v.cert.Leaf.NotAfter.Format(time.RFC3339))
+}
+
+// Close stops watching the Workload API.
+func (s *Source) Close() error {
+	s.cancel()
+	err := s.conn.Close()
+	<-s.done
+	return err
+}
+
+// ID returns the SPIFFE ID of the current SVID.
+func (s *Source) ID() string {
+	s.mtx.RLock()
+	defer s.mtx.RUnlock()
+	return s.svid.id
+}
+
+// Certificate returns the current SVID as a TLS certificate.
+func (s *Source) Certificate() *tls.Certificate {
+	s.mtx.RLock()
+	defer s.mtx.RUnlock()
+	return &s.svid.cert
+}
+
+// Bundle returns the current trust bundle.
+func (s *Source) Bundle() *x509.CertPool {
+	s.mtx.RLock()
+	defer s.mtx.RUnlock()
+	return s.bundle
+}
+
+// ConfigureServer sets up config, a keyless server TLS configuration, to present
+// the current SVID and to verify clients against the current trust bundle.
+func (s *Source) ConfigureServer(config *tls.Config) {
+	config.Certificates = nil
+	config.GetCertificate = func(*tls.ClientHelloInfo) (*tls.Certificate, error) {
+		return s.Certificate(), nil
+	}
+	config.GetConfigForClient = func(*tls.ClientHelloInfo) (*tls.Config, error) {
+		c := config.Clone()
+		c.ClientCAs = s.Bundle()
+		return c, nil
+	}
+}
+
+// ConfigureClient sets up config, a keyless client TLS configuration, to
+// present the current SVID and to verify keyservers against the current trust
+// bundle.
+func (s *Source) ConfigureClient(config *tls.Config) {
+	config.Certificates = nil
+	config.GetClientCertificate = func(*tls.CertificateRequestInfo) (*tls.Certificate, error) {
+		return s.Certificate(), nil
+	}
+	// The trust bundle changes over time, so verification is done against the
+	// current bundle rather than a fixed RootCAs pool.
+	config.InsecureSkipVerify = true
+	config.VerifyConnection = func(state tls.ConnectionState) error {
+		if len(state.PeerCertificates) == 0 {
+			return errors.New("spiffe: keyserver presented no certificate")
+		}
+		opts := x509.VerifyOptions{
+			DNSName:       state.ServerName,
+			Roots:         s.Bundle(),
+			Intermediates: x509.NewCertPool(),
+		}
+		if config.Time != nil {
+			opts.CurrentTime = config.Time()
+		}
+		for _, cert := range state.PeerCertificates[1:] {
+			opts.Intermediates.AddCert(cert)
+		}
+		_, err := state.PeerCertificates[0].Verify(opts)
+		return err
+	}
+}
@@ -0,0 +1,189 @@
+package spiffe
+
+import (
+	"context"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"io/ioutil"
+	"math/big"
+	"net"
+	"net/url"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/metadata"
+	"google.golang.org/protobuf/encoding/protowire"
+)
+
+type testCA struct {
+	cert *x509.Certificate
+	key  *ecdsa.PrivateKey
+}
+
+func newTestCA(t *testing.T) *testCA {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	tmpl := &x509.Certificate{
+		SerialNumber:          big.NewInt(1),
+		Subject:               pkix.Name{CommonName: "test CA"},
+		NotBefore:             time.Now().Add(-time.Hour),
+		NotAfter:              time.Now().Add(time.Hour),
+		IsCA:                  true,
+		BasicConstraintsValid: true,
+		KeyUsage:              x509.KeyUsageCertSign,
+	}
+	der, err := x509.CreateCertificate(rand.Reader, tmpl, tmpl, &key.PublicKey, key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	cert, err := x509.ParseCertificate(der)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return &testCA{cert: cert, key: key}
+}
+
+// svidResponse encodes an X509SVIDResponse for id, issued by ca.
+func (ca *testCA) svidResponse(t *testing.T, id string) []byte {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	uri, _ := url.Parse(id)
+	tmpl := &x509.Certificate{
+		SerialNumber: big.NewInt(time.Now().UnixNano()),
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+		DNSNames:     []string{"localhost"},
+		URIs:         []*url.URL{uri},
+		KeyUsage:     x509.KeyUsageDigitalSignature,
+		ExtKeyUsage:  []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth, x509.ExtKeyUsageClientAuth},
+	}
+	der, err := x509.CreateCertificate(rand.Reader, tmpl, ca.cert, &key.PublicKey, ca.key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	pkcs8, err := x509.MarshalPKCS8PrivateKey(key)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var svid []byte
+	svid = protowire.AppendTag(svid, 1, protowire.BytesType)
+	svid = protowire.AppendString(svid, id)
+	svid = protowire.AppendTag(svid, 2, protowire.BytesType)
+	svid = protowire.AppendBytes(svid, der)
+	svid = protowire.AppendTag(svid, 3, protowire.BytesType)
+	svid = protowire.AppendBytes(svid, pkcs8)
+	svid = protowire.AppendTag(svid, 4, protowire.BytesType)
+	svid = protowire.AppendBytes(svid, ca.cert.Raw)
+
+	var resp []byte
+	resp = protowire.AppendTag(resp, 1, protowire.BytesType)
+	return protowire.AppendBytes(resp, svid)
+}
+
+// startWorkloadAPI serves a fake Workload API on a unix socket, sending each
+// response written to updates on every FetchX509SVID stream.
+func startWorkloadAPI(t *testing.T, updates <-chan []byte) string {
+	dir, err := ioutil.TempDir("", "spiffe")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { os.RemoveAll(dir) })
+	path := filepath.Join(dir, "agent.sock")
+	l, err := net.Listen("unix", path)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	handler := func(_ interface{}, stream grpc.ServerStream) error {
+		method, _ := grpc.MethodFromServerStream(stream)
+		if method != fetchX509SVID {
+			t.Errorf("unexpected method %s", method)
+		}
+		if md, _ := metadata.FromIncomingContext(stream.Context()); len(md.Get("workload.spiffe.io")) == 0 {
+			t.Error("missing workload.spiffe.io header")
+		}
+		var req []byte
+		if err := stream.RecvMsg(&req); err != nil {
+			return err
+		}
+		for {
+			select {
+			case resp := <-updates:
+				if err := stream.SendMsg(&resp); err != nil {
+					return err
+				}
+			case <-stream.Context().Done():
+				return nil
+			}
+		}
+	}
+	srv := grpc.NewServer(grpc.CustomCodec(rawCodec{}), grpc.UnknownServiceHandler(handler))
+	go srv.Serve(l)
+	t.Cleanup(srv.Stop)
+	return "unix://" + path
+}
+
+func TestSource(t *testing.T) {
+	ca := newTestCA(t)
+	updates := make(chan []byte, 1)
+	updates <- ca.svidResponse(t, "spiffe://example.org/keyless")
+	addr := startWorkloadAPI(t, updates)
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	src, err := NewSource(ctx, addr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer src.Close()
+
+	if id := src.ID(); id != "spiffe://example.org/keyless" {
+		t.Fatalf("got ID %s", id)
+	}
+
+	serverConfig := &tls.Config{ClientAuth: tls.RequireAndVerifyClientCert}
+	src.ConfigureServer(serverConfig)
+	clientConfig := &tls.Config{ServerName: "localhost"}
+	src.ConfigureClient(clientConfig)
+
+	handshake := func() error {
+		c, s := net.Pipe()
+		defer c.Close()
+		defer s.Close()
+		errs := make(chan error, 1)
+		go func() { errs <- tls.Server(s, serverConfig).Handshake() }()
+		if err := tls.Client(c, clientConfig).Handshake(); err != nil {
+			return err
+		}
+		return <-errs
+	}
+	if err := handshake(); err != nil {
+		t.Fatal(err)
+	}
+
+	// Rotate to an SVID from a different trust domain CA.
+	ca = newTestCA(t)
+	updates <- ca.svidResponse(t, "spiffe://example.org/rotated")
+	deadline := time.Now().Add(5 * time.Second)
+	for src.ID() != "spiffe://example.org/rotated" {
+		if time.Now().After(deadline) {
+			t.Fatal("SVID was not rotated")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	if err := handshake(); err != nil {
+		t.Fatal(err)
+	}
+}
@@ -0,0 +1,209 @@
+package spiffe
+
+import (
+	"context"
+	"crypto"
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"fmt"
+	"net"
+	"net/url"
+
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/metadata"
+	"google.golang.org/protobuf/encoding/protowire"
+)
+
+// fetchX509SVID is the full name of the Workload API's streaming RPC which
+// delivers X.509 SVIDs and trust bundles.
+const fetchX509SVID = "/SpiffeWorkloadAPI/FetchX509SVID"
+
+// rawCodec passes already-encoded protobuf messages through gRPC unchanged, so
+// the Workload API can be spoken without generated code.
+type rawCodec struct{}
+
+func (rawCodec) Marshal(v interface{}) ([]byte, error) {
+	b, ok := v.(*[]byte)
+	if !ok {
+		return nil, fmt.Errorf("spiffe: cannot marshal %T", v)
+	}
+	return *b, nil
+}
+
+func (rawCodec) Unmarshal(data []byte, v interface{}) error {
+	b, ok := v.(*[]byte)
+	if !ok {
+		return fmt.Errorf("spiffe: cannot unmarshal into %T", v)
+	}
+	*b = append((*b)[:0], data...)
+	return nil
+}
+
+func (rawCodec) Name() string   { return "proto" }
+func (rawCodec) String() string { return "proto" }
+
+// dialWorkloadAPI connects to the Workload API at addr, which is either a
+// unix:///path/to/socket or tcp://host:port URL as found in
+// SPIFFE_ENDPOINT_SOCKET.
+func dialWorkloadAPI(ctx context.Context, addr string) (*grpc.ClientConn, error) {
+	u, err := url.Parse(addr)
+	if err != nil {
+		return nil, fmt.Errorf("spiffe: invalid workload API address %q: %v", addr, err)
+	}
+	var network, address string
+	switch u.Scheme {
+	case "unix":
+		network, address = "unix", u.Path
+	case "tcp":
+		network, address = "tcp", u.Host
+	default:
+		return nil, fmt.Errorf("spiffe: unsupported workload API address %q", addr)
+	}
+
+	dialer := func(ctx context.Context, _ string) (net.Conn, error) {
+		var d net.Dialer
+		return d.DialContext(ctx, network, address)
+	}
+	return grpc.DialContext(ctx, addr,
+		grpc.WithInsecure(),
+		grpc.WithContextDialer(dialer),
+		grpc.WithDefaultCallOptions(grpc.ForceCodec(rawCodec{})),
+	)
+}
+
+// svid is an X.509 SVID together with the trust bundle of its trust domain.
+type svid struct {
+	id     string
+	cert   tls.Certificate
+	bundle []*x509.Certificate
+}
+
+// streamX509SVIDs calls FetchX509SVID and invokes update with the default SVID
+// from each response until the stream fails or ctx is done.
+func streamX509SVIDs(ctx context.Context, conn *grpc.ClientConn, update func(*svid)) error {
+	ctx = metadata.AppendToOutgoingContext(ctx, "workload.spiffe.io", "true")
+	stream, err := conn.NewStream(ctx, &grpc.StreamDesc{ServerStreams: true}, fetchX509SVID)
+	if err != nil {
+		return err
+	}
+	req := []byte{} // X509SVIDRequest has no fields.
+	if err := stream.SendMsg(&req); err != nil {
+		return err
+	}
+	if err := stream.CloseSend(); err != nil {
+		return err
+	}
+
+	for {
+		var resp []byte
+		if err := stream.RecvMsg(&resp); err != nil {
+			return err
+		}
+		s, err := parseX509SVIDResponse(resp)
+		if err != nil {
+			return err
+		}
+		update(s)
+	}
+}
+
+// parseX509SVIDResponse decodes the first SVID of an X509SVIDResponse:
+//
+//	message X509SVIDResponse { repeated X509SVID svids = 1; ... }
+//	message X509SVID {
+//	  string spiffe_id = 1;
+//	  bytes x509_svid = 2;     // ASN.1 DER certificate chain
+//	  bytes x509_svid_key = 3; // PKCS#8 private key
+//	  bytes bundle = 4;        // ASN.1 DER trust bundle certificates
+//	}
+func parseX509SVIDResponse(b []byte) (*svid, error) {
+	var first []byte
+	err := walkFields(b, func(num protowire.Number, v []byte) error {
+		if num == 1 && first == nil {
+			first = v
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	if first == nil {
+		return nil, errors.New("spiffe: workload API returned no SVIDs")
+	}
+
+	var chain, key, bundle []byte
+	s := new(svid)
+	err = walkFields(first, func(num protowire.Number, v []byte) error {
+		switch num {
+		case 1:
+			s.id = string(v)
+		case 2:
+			chain = v
+		case 3:
+			key = v
+		case 4:
+			bundle = v
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	certs, err := x509.ParseCertificates(chain)
+	if err != nil {
+		return nil, fmt.Errorf("spiffe: invalid SVID certificates: %v", err)
+	}
+	if len(certs) == 0 {
+		return nil, errors.New("spiffe: SVID has no certificates")
+	}
+	priv, err := x509.ParsePKCS8PrivateKey(key)
+	if err != nil {
+		return nil, fmt.Errorf("spiffe: invalid SVID key: %v", err)
+	}
+	signer, ok := priv.(crypto.Signer)
+	if !ok {
+		return nil, errors.New("spiffe: SVID key is not a signer")
+	}
+	s.cert.PrivateKey = signer
+	s.cert.Leaf = certs[0]
+	for _, cert := range certs {
+		s.cert.Certificate = append(s.cert.Certificate, cert.Raw)
+	}
+
+	s.bundle, err = x509.ParseCertificates(bundle)
+	if err != nil {
+		return nil, fmt.Errorf("spiffe: invalid trust bundle: %v", err)
+	}
+	return s, nil
+}
+
+// walkFields calls f with the number and contents of each length-delimited
+// field in the protobuf message b, skipping fields of other wire types.
+func walkFields(b []byte, f func(protowire.Number, []byte) error) error {
+	for len(b) > 0 {
+		num, typ, n := protowire.ConsumeTag(b)
+		if n < 0 {
+			return protowire.ParseError(n)
+		}
+		b = b[n:]
+		if typ != protowire.BytesType {
+			n = protowire.ConsumeFieldValue(num, typ, b)
+			if n < 0 {
+				return protowire.ParseError(n)
+			}
+			b = b[n:]
+			continue
+		}
+		v, n := protowire.ConsumeBytes(b)
+		if n < 0 {
+			return protowire.ParseError(n)
+		}
+		b = b[n:]
+		if err := f(num, v); err != nil {
+			return err
+		}
+	}
+	return nil
+}
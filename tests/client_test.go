@@ -5,24 +5,47 @@ import (
 	"context"
 	"crypto"
 	"crypto/ecdsa"
+	"crypto/elliptic"
 	"crypto/rand"
 	"crypto/rsa"
+	"crypto/sha256"
+	"crypto/tls"
 	"crypto/x509"
+	"crypto/x509/pkix"
 	"encoding/asn1"
+	"encoding/hex"
+	"encoding/json"
+	"encoding/pem"
 	"errors"
 	"fmt"
+	"io"
+	"io/ioutil"
 	"math/big"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
 	"runtime"
+	"strings"
 	"sync"
 	"sync/atomic"
 	"testing"
 	"time"
 
+	"github.com/cloudflare/cfssl/log"
 	"github.com/stretchr/testify/require"
 	"golang.org/x/crypto/ed25519"
+	"golang.org/x/crypto/ocsp"
+	"gopkg.in/square/go-jose.v2"
+	"gopkg.in/square/go-jose.v2/jwt"
 
 	"github.com/cloudflare/gokeyless/client"
+	"github.com/cloudflare/gokeyless/conn"
+	"github.com/cloudflare/gokeyless/noise"
 	"github.com/cloudflare/gokeyless/protocol"
+	"github.com/cloudflare/gokeyless/server"
+	"github.com/cloudflare/gokeyless/sm2"
 )
 
 func (s *IntegrationTestSuite) TestConnect() {
@@ -126,6 +149,316 @@ func (s *IntegrationTestSuite) TestSign() {
 	}
 }
 
+func (s *IntegrationTestSuite) TestSignPSS() {
+	if testing.Short() {
+		s.T().SkipNow()
+	}
+
+	for _, h := range []crypto.Hash{crypto.SHA256, crypto.SHA384, crypto.SHA512} {
+		for _, saltLen := range []int{rsa.PSSSaltLengthEqualsHash, h.Size()} {
+			s.T().Run(fmt.Sprintf("%v-salt%d", h, saltLen), func(t *testing.T) {
+				require := require.New(t)
+
+				opts := &rsa.PSSOptions{SaltLength: saltLen, Hash: h}
+				b, err := s.rsaKey.Sign(rand.Reader, hashMsg(h), opts)
+				require.NoError(err)
+				require.NoError(rsa.VerifyPSS(s.rsaKey.Public().(*rsa.PublicKey), h, hashMsg(h), b, opts))
+			})
+		}
+	}
+
+	require := require.New(s.T())
+	// Only salt length == hash length is supported.
+	_, err := s.rsaKey.Sign(rand.Reader, hashMsg(crypto.SHA256), &rsa.PSSOptions{SaltLength: 20, Hash: crypto.SHA256})
+	require.Error(err)
+	_, err = s.rsaKey.Sign(rand.Reader, hashMsg(crypto.SHA1), &rsa.PSSOptions{SaltLength: rsa.PSSSaltLengthEqualsHash, Hash: crypto.SHA1})
+	require.Error(err)
+	_, err = s.ecdsaKey.Sign(rand.Reader, hashMsg(crypto.SHA256), &rsa.PSSOptions{SaltLength: rsa.PSSSaltLengthEqualsHash, Hash: crypto.SHA256})
+	require.Error(err)
+
+	// The server must also refuse RSA-PSS with a non-RSA key.
+	ski, err := protocol.GetSKI(s.ecdsaKey.Public())
+	require.NoError(err)
+	conn, err := s.remote.Dial(s.client)
+	require.NoError(err)
+	defer conn.Close()
+	resp, err := conn.DoOperation(context.Background(), protocol.Operation{
+		Opcode:  protocol.OpRSAPSSSignSHA256,
+		Payload: hashMsg(crypto.SHA256),
+		SKI:     ski,
+	})
+	require.NoError(err)
+	require.Equal(protocol.OpError, resp.Opcode)
+	require.Equal(protocol.ErrCrypto, resp.GetError())
+}
+
+func (s *IntegrationTestSuite) TestGetCapabilities() {
+	require := require.New(s.T())
+
+	caps, err := s.client.GetCapabilities(context.Background(), "")
+	require.NoError(err)
+	for _, op := range []protocol.Op{
+		protocol.OpRSAPSSSignSHA256, protocol.OpRSAPSSSignSHA384, protocol.OpRSAPSSSignSHA512,
+		protocol.OpEd25519Sign, protocol.OpSM2SignSM3, protocol.OpGetCapabilities, protocol.OpProbeKey, protocol.OpGetCertificates, protocol.OpStream,
+	} {
+		require.True(caps.Supports(op), "%v not supported", op)
+	}
+	require.False(caps.Supports(protocol.Op(0x7F)))
+
+	// Old servers reject unknown opcodes with ErrBadOpcode.
+	conn, err := s.remote.Dial(s.client)
+	require.NoError(err)
+	defer conn.Close()
+	resp, err := conn.DoOperation(context.Background(), protocol.Operation{Opcode: protocol.Op(0x7F)})
+	require.NoError(err)
+	require.Equal(protocol.ErrBadOpcode, resp.GetError())
+}
+
+func (s *IntegrationTestSuite) TestHello() {
+	require := require.New(s.T())
+
+	conn, err := s.remote.Dial(s.client)
+	require.NoError(err)
+	defer conn.Close()
+	require.Equal(protocol.V1Features, conn.Features())
+
+	features, err := conn.Hello(context.Background(), protocol.Features{
+		Version:    protocol.Version,
+		MaxPayload: 512,
+		Padding:    protocol.PaddingOptional,
+	})
+	require.NoError(err)
+	require.Equal(uint8(protocol.Version), features.Version)
+	require.Equal(uint16(512), features.MaxPayload)
+	require.Equal(protocol.PaddingOptional, features.Padding)
+	require.True(features.Supports(protocol.OpEd25519Sign))
+	require.False(features.Supports(protocol.Op(0x7F)))
+	require.Equal(features, conn.Features())
+
+	// Unpadded requests and responses work once negotiated.
+	require.NoError(conn.Ping(context.Background(), []byte("unpadded")))
+	_, err = conn.DoOperation(context.Background(), protocol.Operation{Opcode: protocol.OpPing, Payload: make([]byte, 513)})
+	require.Error(err)
+}
+
+func (s *IntegrationTestSuite) TestSKISchemes() {
+	require := require.New(s.T())
+
+	ski, err := protocol.GetSKI(s.ecdsaKey.Public())
+	require.NoError(err)
+	ski256, err := protocol.GetSKIScheme(s.ecdsaKey.Public(), protocol.SKISchemeSHA256)
+	require.NoError(err)
+	local := protocol.Features{
+		Version:    protocol.Version,
+		MaxPayload: protocol.V1Features.MaxPayload,
+		SKISchemes: []protocol.SKIScheme{protocol.SKISchemeSHA256, protocol.SKISchemeSHA1},
+	}
+
+	conn, err := s.remote.Dial(s.client)
+	require.NoError(err)
+	defer conn.Close()
+	features, err := conn.Hello(context.Background(), local)
+	require.NoError(err)
+	require.Equal(protocol.SKISchemeSHA256, features.SKIScheme())
+
+	// Keys are found by either SKI.
+	for _, ski := range []protocol.SKI{ski256, ski} {
+		resp, err := conn.DoOperation(context.Background(), protocol.Operation{
+			Opcode:  protocol.OpECDSASignSHA256,
+			Payload: hashMsg(crypto.SHA256),
+			SKI:     ski,
+		})
+		require.NoError(err)
+		require.Equal(protocol.OpResponse, resp.Opcode, "got %v for SKI %v", resp.GetError(), ski)
+	}
+
+	// Clients send SHA-256 SKIs once negotiated, which are subject to the
+	// restrictions of the key.
+	s.client.Features = &local
+	_, err = s.ecdsaKey.Sign(rand.Reader, hashMsg(crypto.SHA256), crypto.SHA256)
+	require.NoError(err)
+	s.server.Config().WithKeyUsage(server.PerSKIKeyUsage(map[protocol.SKI]*server.KeyUsage{
+		ski: {Sign: true, Hashes: []crypto.Hash{crypto.SHA384}},
+	}))
+	_, err = s.ecdsaKey.Sign(rand.Reader, hashMsg(crypto.SHA256), crypto.SHA256)
+	require.True(errors.Is(err, protocol.ErrKeyUsage), "got %v", err)
+
+	// Servers which only offer SHA-1 SKIs get them.
+	s.server.Config().WithSKISchemes(protocol.SKISchemeSHA1)
+	conn2, err := s.remote.Dial(s.client)
+	require.NoError(err)
+	defer conn2.Close()
+	features, err = conn2.Hello(context.Background(), local)
+	require.NoError(err)
+	require.Equal(protocol.SKISchemeSHA1, features.SKIScheme())
+}
+
+func (s *IntegrationTestSuite) TestKeyRemovedNotices() {
+	require := require.New(s.T())
+
+	s.server.Config().WithKeyRemovedNotices(true)
+	keys := server.NewDefaultKeystore()
+	require.NoError(keys.AddFromDir("testdata", server.DefaultLoadKey))
+	s.server.SetKeystore(keys)
+
+	removed := make(chan protocol.SKI, 1)
+	s.client.Features = &protocol.Features{
+		Version:    protocol.Version,
+		MaxPayload: protocol.V1Features.MaxPayload,
+		KeyRemoved: true,
+	}
+	s.client.OnKeyRemoved = func(addr string, ski protocol.SKI) { removed <- ski }
+	conn, err := s.remote.Dial(s.client)
+	require.NoError(err)
+	defer conn.Close()
+	require.True(conn.Conn.Features().KeyRemoved)
+
+	ski, err := protocol.GetSKI(s.ecdsaKey.Public())
+	require.NoError(err)
+	keys.Remove(ski)
+	select {
+	case got := <-removed:
+		require.Equal(ski, got)
+	case <-time.After(5 * time.Second):
+		require.Fail("no key removal notice")
+	}
+	_, err = s.ecdsaKey.Sign(rand.Reader, hashMsg(crypto.SHA256), crypto.SHA256)
+	require.True(errors.Is(err, protocol.ErrKeyNotFound), "got %v", err)
+}
+
+func (s *IntegrationTestSuite) TestConnLifetime() {
+	require := require.New(s.T())
+
+	// Clients which support it are asked to reconnect, and keep the
+	// connection for the grace period.
+	s.server.Config().WithConnLifetime(200*time.Millisecond, 0, time.Second)
+	s.client.Features = &protocol.Features{
+		Version:    protocol.Version,
+		MaxPayload: protocol.V1Features.MaxPayload,
+		Reconnect:  true,
+	}
+	conn, err := s.remote.Dial(s.client)
+	require.NoError(err)
+	defer conn.Close()
+	require.True(conn.Conn.Features().Reconnect)
+	time.Sleep(400 * time.Millisecond)
+	require.NoError(conn.Ping(context.Background(), nil))
+	require.Eventually(func() bool {
+		return conn.Ping(context.Background(), nil) != nil
+	}, 5*time.Second, 100*time.Millisecond)
+
+	// Others are disconnected once their requests are answered.
+	s.server.Config().WithConnLifetime(0, 1, time.Minute)
+	s.client.Features = nil
+	conn, err = s.remote.Dial(s.client)
+	require.NoError(err)
+	defer conn.Close()
+	require.NoError(conn.Ping(context.Background(), nil))
+	require.Eventually(func() bool {
+		return conn.Ping(context.Background(), nil) != nil
+	}, 5*time.Second, 100*time.Millisecond)
+}
+
+func (s *IntegrationTestSuite) TestRevalidate() {
+	require := require.New(s.T())
+	if testSoftHSM {
+		s.T().Skip("the keystore is loaded from testdata")
+	}
+	keys := server.NewDefaultKeystore()
+	require.NoError(keys.AddFromDir("testdata", server.DefaultLoadKey))
+	s.server.SetKeystore(keys)
+
+	type removal struct {
+		addr string
+		ski  protocol.SKI
+	}
+	removed := make(chan removal, 1)
+	s.client.Revalidate = true
+	s.client.OnKeyRemoved = func(addr string, ski protocol.SKI) { removed <- removal{addr, ski} }
+	ski, err := protocol.GetSKI(s.ecdsaKey.Public())
+	require.NoError(err)
+	_, err = s.ecdsaKey.Sign(rand.Reader, hashMsg(crypto.SHA256), crypto.SHA256)
+	require.NoError(err)
+
+	// Connections aren't pooled in tests, so the next operation reconnects,
+	// as the client would once the server restarted without the key.
+	keys.Remove(ski)
+	_, err = s.rsaKey.Sign(rand.Reader, hashMsg(crypto.SHA256), crypto.SHA256)
+	require.NoError(err)
+	var got removal
+	select {
+	case got = <-removed:
+		require.Equal(ski, got.ski)
+	case <-time.After(5 * time.Second):
+		require.Fail("the removed key was not found by revalidation")
+	}
+	require.False(s.client.KeyAvailable(got.addr, ski))
+	rsaSKI, err := protocol.GetSKI(s.rsaKey.Public())
+	require.NoError(err)
+	require.True(s.client.KeyAvailable(got.addr, rsaSKI))
+
+	// The key is available again once an operation with it succeeds.
+	require.NoError(keys.AddFromDir("testdata", server.DefaultLoadKey))
+	_, err = s.ecdsaKey.Sign(rand.Reader, hashMsg(crypto.SHA256), crypto.SHA256)
+	require.NoError(err)
+	require.True(s.client.KeyAvailable(got.addr, ski))
+
+	// Servers answer probes directly too.
+	conn, err := s.remote.Dial(s.client)
+	require.NoError(err)
+	defer conn.Close()
+	resp, err := conn.Conn.DoOperation(context.Background(), protocol.Operation{Opcode: protocol.OpProbeKey, SKI: ski})
+	require.NoError(err)
+	require.Equal(protocol.OpResponse, resp.Opcode)
+	resp, err = conn.Conn.DoOperation(context.Background(), protocol.Operation{Opcode: protocol.OpProbeKey, SKI: protocol.SKI{1}})
+	require.NoError(err)
+	require.Equal(protocol.ErrKeyNotFound, resp.GetError())
+}
+
+// timingRecorder is a client.TimingMetrics which records the timing hints.
+type timingRecorder struct {
+	mtx     sync.Mutex
+	timings []protocol.Timing
+}
+
+func (r *timingRecorder) ObserveRequest(string, protocol.Op, time.Duration, error) {}
+
+func (r *timingRecorder) ObserveDial(string, time.Duration, error) {}
+
+func (r *timingRecorder) ObserveServerTiming(addr string, op protocol.Op, timing protocol.Timing) {
+	r.mtx.Lock()
+	defer r.mtx.Unlock()
+	r.timings = append(r.timings, timing)
+}
+
+func (s *IntegrationTestSuite) TestTimingHints() {
+	require := require.New(s.T())
+
+	// Clients which don't negotiate the feature get no hints.
+	conn, err := s.remote.Dial(s.client)
+	require.NoError(err)
+	resp, err := conn.Conn.DoOperation(context.Background(), protocol.Operation{Opcode: protocol.OpPing})
+	require.NoError(err)
+	require.True(resp.Timing.IsZero())
+	conn.Close()
+
+	s.server.Config().WithTimingHints(true)
+	metrics := new(timingRecorder)
+	s.client.Metrics = metrics
+	s.client.Features = &protocol.Features{
+		Version:    protocol.Version,
+		MaxPayload: protocol.V1Features.MaxPayload,
+		Timing:     true,
+	}
+	_, err = s.ecdsaKey.Sign(rand.Reader, hashMsg(crypto.SHA256), crypto.SHA256)
+	require.NoError(err)
+	metrics.mtx.Lock()
+	defer metrics.mtx.Unlock()
+	require.Len(metrics.timings, 1)
+	require.True(metrics.timings[0].Processing > 0)
+	require.True(metrics.timings[0].Queue >= 0)
+}
+
 // testEd25519Msg is the message that would be signed to produce the
 // CertificateVerify message in the TLS 1.3 handshake: see
 // https://tlswg.github.io/tls13-spec/draft-ietf-tls-tls13.html#rfc.section.4.4.3.
@@ -150,80 +483,2993 @@ var testEd25519Msg = []byte{
 	0x01, 0x01, 0x01, 0x01, 0x01, 0x01, 0x01, 0x01,
 }
 
-func (s *IntegrationTestSuite) TestEd25519Sign() {
+func (s *IntegrationTestSuite) TestEd25519Sign() {
+	require := require.New(s.T())
+
+	if testing.Short() {
+		s.T().SkipNow()
+	}
+	if testSoftHSM {
+		// TODO(cjpatton) Decide if it's worth adding an Ed25519 test for
+		// SoftHSM. If so, then move this test to `TestSign()` above.
+		s.T().Skip("skipping test")
+	}
+
+	b, err := s.ed25519Key.Sign(rand.Reader, testEd25519Msg, crypto.Hash(0))
+	require.NoError(err)
+	require.NoError(checkSignature(s.ed25519Key.Public(), crypto.Hash(0), b))
+}
+
+func (s *IntegrationTestSuite) TestRSADecrypt() {
+	require := require.New(s.T())
+
+	if testing.Short() {
+		s.T().SkipNow()
+	}
+	if testSoftHSM {
+		s.T().Skip("skipping test; SoftHSM2 does not support PKCS1v15")
+	}
+
+	pub, ok := s.rsaKey.Public().(*rsa.PublicKey)
+	require.True(ok, "couldn't use public key as RSA key")
+
+	c, err := rsa.EncryptPKCS1v15(rand.Reader, pub, ptxt)
+	require.NoError(err)
+
+	m, err := s.rsaKey.Decrypt(rand.Reader, c, &rsa.PKCS1v15DecryptOptions{})
+	require.NoError(err)
+	require.Equal(0, bytes.Compare(ptxt, m), fmt.Sprintf("rsa decrypt failed m: %dB\tptxt: %dB", len(m), len(ptxt)))
+
+	m, err = s.rsaKey.Decrypt(rand.Reader, c, &rsa.PKCS1v15DecryptOptions{SessionKeyLen: len(ptxt)})
+	require.NoError(err)
+	require.Equal(0, bytes.Compare(ptxt, m), fmt.Sprintf("rsa decrypt failed m: %dB\tptxt: %dB", len(m), len(ptxt)))
+
+	m, err = s.rsaKey.Decrypt(rand.Reader, c, &rsa.PKCS1v15DecryptOptions{SessionKeyLen: len(ptxt) + 1})
+	require.NoError(err)
+	require.NotEqual(0, bytes.Compare(ptxt, m), fmt.Sprintf("rsa decrypt succeeded despite incorrect SessionKeyLen m: %dB\tptxt: %dB", len(m), len(ptxt)))
+
+	m, err = s.rsaKey.DecryptContext(context.Background(), rand.Reader, c, &rsa.PKCS1v15DecryptOptions{})
+	require.NoError(err)
+	require.Equal(ptxt, m)
+
+	// crypto/tls refuses ECDSA keys which implement crypto.Decrypter.
+	_, ok = interface{}(s.ecdsaKey).(crypto.Decrypter)
+	require.False(ok)
+	_, err = s.ecdsaKey.DecryptContext(context.Background(), rand.Reader, c, nil)
+	require.Error(err)
+}
+
+func (s *IntegrationTestSuite) TestHardenedSigning() {
+	require := require.New(s.T())
+
+	if testSoftHSM {
+		s.T().Skip("skipping test; SoftHSM2 does not support PKCS1v15")
+	}
+	s.server.Config().WithHardenedSigning(true, false)
+
+	// Signatures are checked, and still returned.
+	pub := s.rsaKey.Public().(*rsa.PublicKey)
+	digest := sha256.Sum256([]byte("hardened"))
+	sig, err := s.rsaKey.Sign(rand.Reader, digest[:], crypto.SHA256)
+	require.NoError(err)
+	require.NoError(rsa.VerifyPKCS1v15(pub, crypto.SHA256, digest[:], sig))
+	pss := &rsa.PSSOptions{SaltLength: rsa.PSSSaltLengthEqualsHash, Hash: crypto.SHA256}
+	sig, err = s.rsaKey.Sign(rand.Reader, digest[:], pss)
+	require.NoError(err)
+	require.NoError(rsa.VerifyPSS(pub, crypto.SHA256, digest[:], sig, pss))
+
+	// RSA decryption must be allowed explicitly.
+	c, err := rsa.EncryptPKCS1v15(rand.Reader, pub, ptxt)
+	require.NoError(err)
+	_, err = s.rsaKey.Decrypt(rand.Reader, c, &rsa.PKCS1v15DecryptOptions{})
+	require.True(errors.Is(err, protocol.ErrKeyUsage), "got %v", err)
+	s.server.Config().WithHardenedSigning(true, true)
+	m, err := s.rsaKey.Decrypt(rand.Reader, c, &rsa.PKCS1v15DecryptOptions{})
+	require.NoError(err)
+	require.Equal(ptxt, m)
+
+	// Weak keys are reported.
+	weak, err := rsa.GenerateKey(rand.Reader, 1024)
+	require.NoError(err)
+	strong, err := rsa.GenerateKey(rand.Reader, 2048)
+	require.NoError(err)
+	keys := server.NewDefaultKeystore()
+	require.NoError(keys.Add(nil, weak))
+	require.NoError(keys.Add(nil, strong))
+	s.server.SetKeystore(keys)
+	weakSKI, err := protocol.GetSKI(weak.Public())
+	require.NoError(err)
+	require.Equal([]protocol.SKI{weakSKI}, s.server.WarnWeakKeys())
+}
+
+// faultySigner corrupts every signature it makes.
+type faultySigner struct {
+	crypto.Signer
+}
+
+func (s faultySigner) Sign(rand io.Reader, digest []byte, opts crypto.SignerOpts) ([]byte, error) {
+	sig, err := s.Signer.Sign(rand, digest, opts)
+	if err == nil {
+		sig[len(sig)-1] ^= 1
+	}
+	return sig, err
+}
+
+func (s *IntegrationTestSuite) TestSignatureVerification() {
+	require := require.New(s.T())
+
+	good, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	require.NoError(err)
+	priv, err := rsa.GenerateKey(rand.Reader, 2048)
+	require.NoError(err)
+	keys := server.NewDefaultKeystore()
+	require.NoError(keys.Add(nil, good))
+	require.NoError(keys.Add(nil, faultySigner{priv}))
+	s.server.SetKeystore(keys)
+	goodKey, err := s.client.NewRemoteSignerByPublicKey(context.Background(), "", good.Public())
+	require.NoError(err)
+	faultyKey, err := s.client.NewRemoteSignerByPublicKey(context.Background(), "", priv.Public())
+	require.NoError(err)
+	digest := hashMsg(crypto.SHA256)
+
+	// Without verification, corrupted signatures are returned.
+	sig, err := faultyKey.Sign(rand.Reader, digest, crypto.SHA256)
+	require.NoError(err)
+	require.Error(checkSignature(priv.Public(), crypto.SHA256, sig))
+
+	s.server.Config().WithSignatureVerification(true)
+	sig, err = goodKey.Sign(rand.Reader, digest, crypto.SHA256)
+	require.NoError(err)
+	require.NoError(checkSignature(good.Public(), crypto.SHA256, sig))
+	_, err = faultyKey.Sign(rand.Reader, digest, crypto.SHA256)
+	require.True(errors.Is(err, protocol.ErrCrypto), "got %v", err)
+	pss := &rsa.PSSOptions{SaltLength: rsa.PSSSaltLengthEqualsHash, Hash: crypto.SHA256}
+	_, err = faultyKey.Sign(rand.Reader, digest, pss)
+	require.True(errors.Is(err, protocol.ErrCrypto), "got %v", err)
+
+	// Verification can be turned off for the backend of the key.
+	s.server.Config().WithSignatureVerification(true, server.BackendOther)
+	enabled, skip := s.server.Config().SignatureVerification()
+	require.True(enabled)
+	require.Equal([]string{server.BackendOther}, skip)
+	_, err = faultyKey.Sign(rand.Reader, digest, crypto.SHA256)
+	require.NoError(err)
+}
+
+func (s *IntegrationTestSuite) TestSeal() {
+	require := require.New(s.T())
+
+	conn, err := s.remote.Dial(s.client)
+	require.NoError(err)
+	defer conn.Close()
+
+	r := make([]byte, 20)
+	_, err = rand.Read(r)
+	require.NoError(err)
+
+	resp, err := conn.DoOperation(context.Background(), protocol.Operation{
+		Opcode:  protocol.OpSeal,
+		Payload: r,
+	})
+	require.NoError(err)
+	require.NotEqual(protocol.OpError, resp.Opcode, resp.GetError())
+	require.True(bytes.Equal([]byte("OpSeal "), resp.Payload[:len("OpSeal ")]), "payload type mismatch")
+	require.True(bytes.Equal(r, resp.Payload[len("OpSeal "):]), "payload value mismatch")
+
+	resp, err = conn.DoOperation(context.Background(), protocol.Operation{
+		Opcode:  protocol.OpUnseal,
+		Payload: r,
+	})
+	require.NoError(err)
+	require.NotEqual(protocol.OpError, resp.Opcode, resp.GetError())
+	require.True(bytes.Equal([]byte("OpUnseal "), resp.Payload[:len("OpUnseal ")]), "payload type mismatch")
+	require.True(bytes.Equal(r, resp.Payload[len("OpUnseal "):]), "payload value mismatch")
+}
+
+func (s *IntegrationTestSuite) TestSealStream() {
+	require := require.New(s.T())
+
+	// Blobs too large for a packet are streamed.
+	blob := make([]byte, 1<<20)
+	_, err := rand.Read(blob)
+	require.NoError(err)
+	sealed, err := s.client.Seal(context.Background(), "", blob)
+	require.NoError(err)
+	require.Equal(append([]byte("OpSeal "), blob...), sealed)
+	unsealed, err := s.client.Unseal(context.Background(), "", blob)
+	require.NoError(err)
+	require.Equal(append([]byte("OpUnseal "), blob...), unsealed)
+
+	conn, err := s.remote.Dial(s.client)
+	require.NoError(err)
+	defer conn.Close()
+
+	// Small blobs can be streamed too.
+	resp, err := conn.Conn.DoStream(context.Background(), protocol.Operation{Opcode: protocol.OpSeal, Payload: []byte("blob")})
+	require.NoError(err)
+	require.Equal(protocol.OpResponse, resp.Opcode, resp.GetError())
+	require.Equal([]byte("OpSeal blob"), resp.Payload)
+
+	// Only some operations can be streamed.
+	resp, err = conn.Conn.DoStream(context.Background(), protocol.Operation{Opcode: protocol.OpPing, Payload: blob})
+	require.NoError(err)
+	require.Equal(protocol.ErrBadOpcode, resp.GetError())
+
+	s.server.Config().WithMaxStreamLength(len(blob) - 1)
+	resp, err = conn.Conn.DoStream(context.Background(), protocol.Operation{Opcode: protocol.OpSeal, Payload: blob})
+	require.NoError(err)
+	require.Equal(protocol.ErrFormat, resp.GetError())
+
+	// Chunks must arrive in order.
+	chunk := protocol.StreamChunk{Phase: protocol.StreamBegin, ID: 42, Opcode: protocol.OpSeal, Length: 8}
+	payload, err := chunk.MarshalBinary()
+	require.NoError(err)
+	resp, err = conn.DoOperation(context.Background(), protocol.Operation{Opcode: protocol.OpStream, Payload: payload})
+	require.NoError(err)
+	require.Equal(protocol.OpResponse, resp.Opcode, resp.GetError())
+	chunk = protocol.StreamChunk{Phase: protocol.StreamEnd, ID: 42, Offset: 4, Data: []byte("blob")}
+	payload, err = chunk.MarshalBinary()
+	require.NoError(err)
+	resp, err = conn.DoOperation(context.Background(), protocol.Operation{Opcode: protocol.OpStream, Payload: payload})
+	require.NoError(err)
+	require.Equal(protocol.ErrFormat, resp.GetError())
+}
+
+func (s *IntegrationTestSuite) TestGetTicketKeys() {
+	require := require.New(s.T())
+
+	// No TicketKeySource configured.
+	_, err := s.client.GetTicketKeys(context.Background(), "")
+	require.True(errors.Is(err, protocol.ErrInternal))
+
+	rotator, err := server.NewTicketKeyRotator(time.Hour, 2)
+	require.NoError(err)
+	defer rotator.Stop()
+	s.server.SetTicketKeySource(rotator)
+
+	keys, err := s.client.GetTicketKeys(context.Background(), "")
+	require.NoError(err)
+	require.Len(keys, 1)
+
+	require.NoError(rotator.Rotate())
+	expected, err := rotator.TicketKeys()
+	require.NoError(err)
+	require.Len(expected, 2)
+	require.Equal(keys[0], expected[1])
+
+	keys, err = s.client.GetTicketKeys(context.Background(), "")
+	require.NoError(err)
+	require.Equal(expected, keys)
+}
+
+func (s *IntegrationTestSuite) TestClientIdentity() {
+	require := require.New(s.T())
+
+	s.server.Config().WithCustomOpFunction(func(ctx context.Context, op protocol.Operation) ([]byte, error) {
+		id, ok := server.ClientIdentityFromContext(ctx)
+		if !ok {
+			return nil, errors.New("no client identity")
+		}
+		return append(id.Fingerprint[:], strings.Join(id.DNSNames, ",")...), nil
+	})
+
+	cert, err := tls.LoadX509KeyPair(clientCert, clientKey)
+	require.NoError(err)
+	fingerprint := sha256.Sum256(cert.Certificate[0])
+
+	conn, err := s.remote.Dial(s.client)
+	require.NoError(err)
+	defer conn.Close()
+
+	resp, err := conn.DoOperation(context.Background(), protocol.Operation{
+		Opcode:         protocol.OpCustom,
+		CustomFuncName: "identity",
+	})
+	require.NoError(err)
+	require.Equal(protocol.OpResponse, resp.Opcode, resp.GetError())
+	require.Equal(fingerprint[:], resp.Payload[:sha256.Size])
+	require.Equal("localhost", string(resp.Payload[sha256.Size:]))
+}
+
+func (s *IntegrationTestSuite) TestDedup() {
+	require := require.New(s.T())
+
+	var calls, handled uint32
+	release := make(chan struct{})
+	s.server.Config().WithDedupOps(protocol.OpCustom)
+	defer s.server.Config().WithDedupOps()
+	// Every request passes through the middleware, including those which
+	// share the result of another.
+	s.server.Config().WithMiddleware(func(next server.Handler) server.Handler {
+		return server.HandlerFunc(func(ctx context.Context, op *protocol.Operation) protocol.Operation {
+			if op.Opcode == protocol.OpCustom {
+				atomic.AddUint32(&handled, 1)
+			}
+			return next.Handle(ctx, op)
+		})
+	})
+	s.server.Config().WithCustomOpFunction(func(ctx context.Context, op protocol.Operation) ([]byte, error) {
+		n := atomic.AddUint32(&calls, 1)
+		<-release
+		return []byte{byte(n)}, nil
+	})
+	require.Equal([]protocol.Op{protocol.OpCustom}, s.server.Config().DedupOps())
+
+	conn, err := s.remote.Dial(s.client)
+	require.NoError(err)
+	defer conn.Close()
+
+	const n = 8
+	results := make(chan []byte, n)
+	for i := 0; i < n; i++ {
+		go func() {
+			resp, err := conn.DoOperation(context.Background(), protocol.Operation{
+				Opcode:         protocol.OpCustom,
+				CustomFuncName: "dedup",
+				Payload:        []byte("same"),
+			})
+			if err != nil || resp.Opcode != protocol.OpResponse {
+				results <- nil
+				return
+			}
+			results <- resp.Payload
+		}()
+	}
+	// Give the duplicates time to reach a worker before the first completes.
+	for atomic.LoadUint32(&calls) == 0 {
+		time.Sleep(time.Millisecond)
+	}
+	time.Sleep(100 * time.Millisecond)
+	close(release)
+
+	first := 0
+	for i := 0; i < n; i++ {
+		res := <-results
+		require.Len(res, 1)
+		if res[0] == 1 {
+			first++
+		}
+	}
+	require.True(atomic.LoadUint32(&calls) < n)
+	require.True(first > 1, "no request shared the first result")
+	require.Equal(uint32(n), atomic.LoadUint32(&handled))
+}
+
+// blockingKeystore is a Keystore whose lookups wait until release is closed.
+type blockingKeystore struct {
+	server.Keystore
+	blocked chan struct{}
+	release chan struct{}
+}
+
+func (k *blockingKeystore) Get(ctx context.Context, op *protocol.Operation) (crypto.Signer, error) {
+	k.blocked <- struct{}{}
+	<-k.release
+	return k.Keystore.Get(ctx, op)
+}
+
+func (s *IntegrationTestSuite) TestDedupTenants() {
+	require := require.New(s.T())
+
+	// Only tenant a has the key, so tenant b must not be handed a's signature
+	// when it sends the same request while a's is executing.
+	s.server.Config().WithDedupOps(protocol.OpECDSASignSHA256)
+	defer s.server.Config().WithDedupOps()
+	s.server.Config().WithTokenVerifier(server.NewStaticTokenVerifier(map[string]string{"token-a": "a", "token-b": "b"}))
+	s.server.Config().WithTenants(func(id *server.ClientIdentity) string { return id.CommonName })
+	keys := server.NewDefaultKeystore()
+	require.NoError(keys.AddFromFile("testdata/ecdsa.key", server.DefaultLoadKey))
+	blocking := &blockingKeystore{Keystore: keys, blocked: make(chan struct{}, 1), release: make(chan struct{})}
+	tenants := server.NewTenantKeystore()
+	require.NoError(tenants.SetTenant("a", blocking))
+	require.NoError(tenants.SetTenant("b", server.NewDefaultKeystore()))
+	s.server.SetKeystore(tenants)
+
+	config := s.server.TLSConfig().Clone()
+	config.ClientAuth = tls.VerifyClientCertIfGiven
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	require.NoError(err)
+	go s.server.ServeWithTLS(l, config)
+	digest := hashMsg(crypto.SHA256)
+	sign := func(token string) chan error {
+		c := client.NewClient(tls.Certificate{}, s.client.Config.RootCAs)
+		c.Config.Time = fixedCurrentTime
+		c.Token = func(context.Context) (string, error) { return token, nil }
+		c.DefaultRemote = client.NewServer(l.Addr(), "localhost")
+		key, err := c.NewRemoteSignerByPublicKey(context.Background(), "", s.ecdsaKey.Public())
+		require.NoError(err)
+		errs := make(chan error, 1)
+		go func() {
+			_, err := key.Sign(rand.Reader, digest, crypto.SHA256)
+			errs <- err
+		}()
+		return errs
+	}
+
+	a := sign("token-a")
+	<-blocking.blocked
+	b := sign("token-b")
+	// Give b's request time to reach a worker before a's completes.
+	time.Sleep(100 * time.Millisecond)
+	close(blocking.release)
+	require.NoError(<-a)
+	require.True(errors.Is(<-b, protocol.ErrKeyNotFound))
+}
+
+func (s *IntegrationTestSuite) TestLoadTester() {
+	require := require.New(s.T())
+
+	ski, err := protocol.GetSKI(s.ecdsaKey.Public())
+	require.NoError(err)
+	lt := &client.LoadTester{
+		Client:      s.client,
+		Concurrency: 4,
+		Requests:    40,
+		Ops: []protocol.Operation{
+			{Opcode: protocol.OpPing},
+			{Opcode: protocol.OpECDSASignSHA256, SKI: ski, Payload: hashMsg(crypto.SHA256)},
+			{Opcode: protocol.OpECDSASignSHA256, Payload: hashMsg(crypto.SHA256)}, // unknown key
+		},
+	}
+	res, err := lt.Run(context.Background())
+	require.NoError(err)
+	require.Equal(40, res.Total.Requests)
+	require.Len(res.ByOpcode, 2)
+
+	ping, sign := res.ByOpcode[protocol.OpPing], res.ByOpcode[protocol.OpECDSASignSHA256]
+	require.Zero(ping.Errors)
+	require.Equal(40, ping.Requests+sign.Requests)
+	require.Equal(sign.Errors, res.Total.Errors)
+	require.True(sign.Errors > 0 && sign.Errors < sign.Requests)
+	require.True(res.Total.P50 <= res.Total.P95 && res.Total.P95 <= res.Total.P99 && res.Total.P99 <= res.Total.Max)
+	require.True(res.Throughput() > 0)
+	require.Contains(res.String(), "total")
+
+	_, err = (&client.LoadTester{Client: s.client, Requests: 1}).Run(context.Background())
+	require.Error(err)
+}
+
+func (s *IntegrationTestSuite) TestHTTP2Transport() {
+	require := require.New(s.T())
+
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	require.NoError(err)
+	served := make(chan error, 1)
+	go func() { served <- s.server.ServeHTTP2(l) }()
+	url := fmt.Sprintf("https://localhost:%d/keyless", l.Addr().(*net.TCPAddr).Port)
+
+	remote, err := client.NewHTTPRemote(url)
+	require.NoError(err)
+	conn, err := remote.Dial(s.client)
+	require.NoError(err)
+	defer conn.Close()
+
+	ski, err := protocol.GetSKI(s.ecdsaKey.Public())
+	require.NoError(err)
+	digest := hashMsg(crypto.SHA256)
+	// Requests are multiplexed over the one HTTP/2 connection.
+	var wg sync.WaitGroup
+	errs := make(chan error, 8)
+	for i := 0; i < 8; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			resp, err := conn.DoOperation(context.Background(), protocol.Operation{
+				Opcode:  protocol.OpECDSASignSHA256,
+				SKI:     ski,
+				Payload: digest,
+			})
+			if err == nil && resp.Opcode != protocol.OpResponse {
+				err = resp.GetError()
+			}
+			if err == nil && !ecdsa.VerifyASN1(s.ecdsaKey.Public().(*ecdsa.PublicKey), digest, resp.Payload) {
+				err = errors.New("invalid signature")
+			}
+			errs <- err
+		}()
+	}
+	wg.Wait()
+	close(errs)
+	for err := range errs {
+		require.NoError(err)
+	}
+
+	// Errors are returned in-band, as on the keyless transport.
+	resp, err := conn.DoOperation(context.Background(), protocol.Operation{Opcode: protocol.OpECDSASignSHA256, Payload: digest})
+	require.NoError(err)
+	require.Equal(protocol.OpError, resp.Opcode)
+
+	// The keyless transport keeps working alongside.
+	kconn, err := s.remote.Dial(s.client)
+	require.NoError(err)
+	defer kconn.Close()
+	require.NoError(kconn.Ping(context.Background(), nil))
+
+	// Only POSTs are keyless requests.
+	config := s.client.Config.Clone()
+	config.ServerName = "localhost"
+	httpClient := &http.Client{Transport: &http.Transport{TLSClientConfig: config}}
+	get, err := httpClient.Get(url)
+	require.NoError(err)
+	get.Body.Close()
+	require.Equal(http.StatusMethodNotAllowed, get.StatusCode)
+	httpClient.CloseIdleConnections()
+
+	require.NoError(shutdownServer(s.server, 2*time.Second))
+	s.server = nil
+	require.NoError(<-served)
+}
+
+func (s *IntegrationTestSuite) TestWatchDir() {
+	require := require.New(s.T())
+
+	dir, err := ioutil.TempDir("", "keys")
+	require.NoError(err)
+	defer os.RemoveAll(dir)
+
+	keys := server.NewDefaultKeystore()
+	w, err := keys.WatchDir(dir, server.DefaultLoadKey)
+	require.NoError(err)
+	defer w.Close()
+	s.server.SetKeystore(keys)
+
+	sign := func() error {
+		_, err := s.ecdsaKey.Sign(rand.Reader, hashMsg(crypto.SHA256), crypto.SHA256)
+		return err
+	}
+	eventually := func(ok func() bool) {
+		for deadline := time.Now().Add(5 * time.Second); !ok(); {
+			require.True(time.Now().Before(deadline), "keystore not updated")
+			time.Sleep(10 * time.Millisecond)
+		}
+	}
+	require.Error(sign())
+
+	in, err := ioutil.ReadFile("testdata/ecdsa.key")
+	require.NoError(err)
+	path := filepath.Join(dir, "ecdsa.key")
+	require.NoError(ioutil.WriteFile(path, in, 0600))
+	eventually(func() bool { return sign() == nil })
+
+	require.NoError(os.Remove(path))
+	eventually(func() bool { return sign() != nil })
+
+	// A key is not loaded next to a certificate for another key.
+	cert, err := ioutil.ReadFile(serverCert)
+	require.NoError(err)
+	require.NoError(ioutil.WriteFile(filepath.Join(dir, "ecdsa.pem"), cert, 0600))
+	require.NoError(ioutil.WriteFile(path, in, 0600))
+	time.Sleep(100 * time.Millisecond)
+	require.Error(sign())
+}
+
+// failingKeystore is a Keystore whose lookups always fail, like an
+// unreachable remote backend.
+type failingKeystore struct{}
+
+func (failingKeystore) Get(context.Context, *protocol.Operation) (crypto.Signer, error) {
+	return nil, errors.New("backend unavailable")
+}
+
+func (s *IntegrationTestSuite) TestKeystoreChain() {
+	require := require.New(s.T())
+
+	rsaSKI, err := protocol.GetSKI(s.rsaKey.Public())
+	require.NoError(err)
+	ecdsaSKI, err := protocol.GetSKI(s.ecdsaKey.Public())
+	require.NoError(err)
+
+	rsaKeys := server.NewDefaultKeystore()
+	require.NoError(rsaKeys.AddFromFile("testdata/rsa.key", server.DefaultLoadKey))
+	ecdsaKeys := server.NewDefaultKeystore()
+	require.NoError(ecdsaKeys.AddFromFile("testdata/ecdsa.key", server.DefaultLoadKey))
+
+	// The ECDSA key is only looked up in the last backend, after the failing
+	// one, and the RSA key only in the backend for its prefix.
+	chain := server.NewKeystoreChain()
+	require.NoError(chain.Add(rsaKeys, rsaSKI.String()[:3]))
+	require.NoError(chain.Add(failingKeystore{}))
+	require.NoError(chain.Add(ecdsaKeys, ecdsaSKI.String()[:2], "ff"))
+	require.Error(chain.Add(ecdsaKeys, "xyz"))
+	s.server.SetKeystore(chain)
+
+	_, err = s.ecdsaKey.Sign(rand.Reader, hashMsg(crypto.SHA256), crypto.SHA256)
+	require.NoError(err)
+	_, err = s.rsaKey.Sign(rand.Reader, hashMsg(crypto.SHA256), crypto.SHA256)
+	require.NoError(err)
+	require.ElementsMatch([]protocol.SKI{rsaSKI, ecdsaSKI}, chain.SKIs())
+
+	// Keys outside of the prefixes of their backend are not served.
+	other := "0"
+	if ecdsaSKI.String()[0] == '0' {
+		other = "1"
+	}
+	chain = server.NewKeystoreChain()
+	require.NoError(chain.Add(ecdsaKeys, other))
+	s.server.SetKeystore(chain)
+	_, err = s.ecdsaKey.Sign(rand.Reader, hashMsg(crypto.SHA256), crypto.SHA256)
+	require.Error(err)
+	require.Empty(chain.SKIs())
+}
+
+func (s *IntegrationTestSuite) TestShardedKeystore() {
+	require := require.New(s.T())
+
+	sign := func() {
+		_, err := s.ecdsaKey.Sign(rand.Reader, hashMsg(crypto.SHA256), crypto.SHA256)
+		require.NoError(err)
+		_, err = s.rsaKey.Sign(rand.Reader, hashMsg(crypto.SHA256), crypto.SHA256)
+		require.NoError(err)
+	}
+	keys := func(stats []server.ShardStats) map[string]int {
+		m := make(map[string]int)
+		for _, shard := range stats {
+			m[shard.Name] = shard.Keys
+		}
+		return m
+	}
+
+	// The keys are loaded into one shard, and are served from it until they
+	// have been moved to their shards.
+	a := server.NewDefaultKeystore()
+	require.NoError(a.AddFromFile("testdata/rsa.key", server.DefaultLoadKey))
+	require.NoError(a.AddFromFile("testdata/ecdsa.key", server.DefaultLoadKey))
+	sharded := server.NewShardedKeystore(0)
+	require.NoError(sharded.AddShard("a", a))
+	require.NoError(sharded.AddShard("b", server.NewDefaultKeystore()))
+	require.NoError(sharded.AddShard("c", server.NewDefaultKeystore()))
+	require.Error(sharded.AddShard("a", server.NewDefaultKeystore()))
+	s.server.SetKeystore(sharded)
+	sign()
+	_, err := sharded.Rebalance(context.Background())
+	require.NoError(err)
+	sign()
+	require.Len(sharded.SKIs(), 2)
+
+	var share float64
+	for _, shard := range sharded.ShardStats() {
+		share += shard.Share
+	}
+	require.InDelta(1, share, 0.001)
+
+	// Removed shards are still looked up until their keys have been moved.
+	for _, name := range []string{"a", "b"} {
+		require.NoError(sharded.RemoveShard(name))
+		sign()
+		_, err = sharded.Rebalance(context.Background())
+		require.NoError(err)
+		sign()
+	}
+	stats := sharded.ShardStats()
+	require.Equal(map[string]int{"c": 2}, keys(stats))
+	require.InDelta(1, stats[0].Share, 0.001)
+	require.NotZero(stats[0].Hits)
+
+	// Keys can't be moved to a remote shard, but are still found where they
+	// are.
+	require.NoError(sharded.AddShard("remote", failingKeystore{}))
+	admin, adminClient := s.newAdmin()
+	defer admin.Close()
+	resp, err := adminClient.Post(admin.URL+"/admin/shards/rebalance", "application/json", nil)
+	require.NoError(err)
+	resp.Body.Close()
+	require.Equal(http.StatusConflict, resp.StatusCode)
+	sign()
+	resp, err = adminClient.Get(admin.URL + "/admin/shards")
+	require.NoError(err)
+	defer resp.Body.Close()
+	require.NoError(json.NewDecoder(resp.Body).Decode(&stats))
+	require.Equal(map[string]int{"c": 2, "remote": -1}, keys(stats))
+}
+
+func (s *IntegrationTestSuite) TestTenantKeystore() {
+	require := require.New(s.T())
+
+	// The test client's certificate has no common name, so its tenant is
+	// its DNS name.
+	s.server.Config().WithTenants(func(id *server.ClientIdentity) string {
+		return id.DNSNames[0]
+	})
+	ecdsaKeys := server.NewDefaultKeystore()
+	require.NoError(ecdsaKeys.AddFromFile("testdata/ecdsa.key", server.DefaultLoadKey))
+	rsaKeys := server.NewDefaultKeystore()
+	require.NoError(rsaKeys.AddFromFile("testdata/rsa.key", server.DefaultLoadKey))
+	tenants := server.NewTenantKeystore()
+	require.NoError(tenants.SetTenant("localhost", ecdsaKeys))
+	require.NoError(tenants.SetTenant("other", rsaKeys))
+	require.Error(tenants.SetTenant("", rsaKeys))
+	require.Equal([]string{"localhost", "other"}, tenants.Tenants())
+	s.server.SetKeystore(tenants)
+	var audit bytes.Buffer
+	s.server.SetAuditLogger(server.NewWriterAuditLogger(&audit, nil))
+
+	// Only the keys of the client's tenant are found.
+	_, err := s.ecdsaKey.Sign(rand.Reader, hashMsg(crypto.SHA256), crypto.SHA256)
+	require.NoError(err)
+	_, err = s.rsaKey.Sign(rand.Reader, hashMsg(crypto.SHA256), crypto.SHA256)
+	require.Error(err)
+
+	var rec server.AuditRecord
+	require.NoError(json.NewDecoder(&audit).Decode(&rec))
+	require.Equal("localhost", rec.Tenant)
+	require.Equal(protocol.ErrNone, rec.Result)
+
+	tenants.RemoveTenant("localhost")
+	_, err = s.ecdsaKey.Sign(rand.Reader, hashMsg(crypto.SHA256), crypto.SHA256)
+	require.Error(err)
+
+	require.Equal("example.org", server.TenantBySPIFFETrustDomain(&server.ClientIdentity{SPIFFEID: "spiffe://example.org/frontend"}))
+	require.Equal("", server.TenantBySPIFFETrustDomain(&server.ClientIdentity{CommonName: "frontend"}))
+}
+
+func (s *IntegrationTestSuite) TestEncryptedKeys() {
+	require := require.New(s.T())
+
+	kek, err := server.NewAESKEK(make([]byte, 32))
+	require.NoError(err)
+	passphrase, err := server.NewPassphraseKEK([]byte("correct horse battery staple"))
+	require.NoError(err)
+	plaintext, err := ioutil.ReadFile("testdata/ecdsa.key")
+	require.NoError(err)
+
+	// Keys encrypted under passphrases are unwrapped with their salt.
+	encrypted, err := server.EncryptKey(passphrase, plaintext)
+	require.NoError(err)
+	require.True(server.IsEncryptedKey(encrypted))
+	decrypted, err := server.DecryptKey(passphrase, encrypted)
+	require.NoError(err)
+	require.Equal(plaintext, decrypted)
+	_, err = server.DecryptKey(kek, encrypted)
+	require.Equal(server.ErrEncryptedKey, err)
+
+	dir, err := ioutil.TempDir("", "encrypted-keys")
+	require.NoError(err)
+	defer os.RemoveAll(dir)
+	encrypted, err = server.EncryptKey(kek, plaintext)
+	require.NoError(err)
+	require.NotContains(string(encrypted), string(plaintext))
+	require.NoError(ioutil.WriteFile(filepath.Join(dir, "ecdsa.key"), encrypted, 0600))
+	keys := server.NewDefaultKeystore()
+	require.NoError(keys.AddFromDir(dir, server.EncryptedLoadKey(kek, server.DefaultLoadKey)))
+	s.server.SetKeystore(keys)
+	_, err = s.ecdsaKey.Sign(rand.Reader, hashMsg(crypto.SHA256), crypto.SHA256)
+	require.NoError(err)
+
+	// Plaintext keys are refused.
+	require.NoError(ioutil.WriteFile(filepath.Join(dir, "rsa.key"), plaintext, 0600))
+	require.Error(server.NewDefaultKeystore().AddFromDir(dir, server.EncryptedLoadKey(kek, server.DefaultLoadKey)))
+}
+
+func (s *IntegrationTestSuite) TestShadowKeystore() {
+	require := require.New(s.T())
+
+	// The shadow keystore holds the same keys: RSA signatures are identical,
+	// and ECDSA ones verify under the primary key.
+	keys := server.NewDefaultKeystore()
+	require.NoError(keys.AddFromFile("testdata/rsa.key", server.DefaultLoadKey))
+	require.NoError(keys.AddFromFile("testdata/ecdsa.key", server.DefaultLoadKey))
+	s.server.SetShadowKeystore(keys, 2)
+	_, err := s.rsaKey.Sign(rand.Reader, hashMsg(crypto.SHA256), crypto.SHA256)
+	require.NoError(err)
+	_, err = s.ecdsaKey.Sign(rand.Reader, hashMsg(crypto.SHA256), crypto.SHA256)
+	require.NoError(err)
+	require.Eventually(func() bool {
+		return s.server.ShadowStats() == server.ShadowStats{Matches: 2}
+	}, 5*time.Second, 10*time.Millisecond)
+
+	// The shadow keystore misses the ECDSA key.
+	keys = server.NewDefaultKeystore()
+	require.NoError(keys.AddFromFile("testdata/rsa.key", server.DefaultLoadKey))
+	s.server.SetShadowKeystore(keys, 1)
+	_, err = s.ecdsaKey.Sign(rand.Reader, hashMsg(crypto.SHA256), crypto.SHA256)
+	require.NoError(err)
+	require.Eventually(func() bool {
+		return s.server.ShadowStats() == server.ShadowStats{Mismatches: 1}
+	}, 5*time.Second, 10*time.Millisecond)
+
+	s.server.SetShadowKeystore(nil, 0)
+	require.Equal(server.ShadowStats{}, s.server.ShadowStats())
+}
+
+// fakeEtcd serves the etcd v3 JSON gateway's range method from data.
+func fakeEtcd(mtx *sync.Mutex, data map[string][]byte) *httptest.Server {
+	type kv struct {
+		Key   []byte `json:"key"`
+		Value []byte `json:"value,omitempty"`
+	}
+	return httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		var req struct {
+			Key      []byte `json:"key"`
+			RangeEnd []byte `json:"range_end"`
+		}
+		if r.URL.Path != "/v3/kv/range" || json.NewDecoder(r.Body).Decode(&req) != nil {
+			http.Error(w, "bad request", http.StatusBadRequest)
+			return
+		}
+		var resp struct {
+			KVs []kv `json:"kvs"`
+		}
+		mtx.Lock()
+		for k, v := range data {
+			if k == string(req.Key) || (req.RangeEnd != nil && k >= string(req.Key) && k < string(req.RangeEnd)) {
+				resp.KVs = append(resp.KVs, kv{Key: []byte(k), Value: v})
+			}
+		}
+		mtx.Unlock()
+		json.NewEncoder(w).Encode(resp)
+	}))
+}
+
+func (s *IntegrationTestSuite) TestMetadataKeystore() {
+	require := require.New(s.T())
+
+	rsaSKI, err := protocol.GetSKI(s.rsaKey.Public())
+	require.NoError(err)
+	ecdsaSKI, err := protocol.GetSKI(s.ecdsaKey.Public())
+	require.NoError(err)
+	var mtx sync.Mutex
+	data := make(map[string][]byte)
+	publish := func(ski protocol.SKI, record *server.KeyRecord) {
+		mtx.Lock()
+		defer mtx.Unlock()
+		if record == nil {
+			delete(data, "keyless/"+ski.String())
+			return
+		}
+		b, err := json.Marshal(record)
+		require.NoError(err)
+		data["keyless/"+ski.String()] = b
+	}
+	etcd := fakeEtcd(&mtx, data)
+	defer etcd.Close()
+
+	store, err := server.NewMetadataStore("etcd://" + strings.TrimPrefix(etcd.URL, "http://") + "?prefix=keyless/")
+	require.NoError(err)
+	keys := server.NewMetadataKeystore(store, s.server.LoadKeyRecord)
+	// Check the records on every lookup.
+	keys.SetTTL(0)
+	s.server.SetKeystore(keys)
+	sign := func(key crypto.Signer) error {
+		_, err := key.Sign(rand.Reader, hashMsg(crypto.SHA256), crypto.SHA256)
+		return err
+	}
+
+	// Keys are served as soon as they are published, from a file or wrapped
+	// for the server's certificate.
+	require.True(errors.Is(sign(s.rsaKey), protocol.ErrKeyNotFound))
+	publish(rsaSKI, &server.KeyRecord{File: rsaPrivKey})
+	require.NoError(sign(s.rsaKey))
+	cert, err := x509.ParseCertificate(s.server.TLSConfig().Certificates[0].Certificate[0])
+	require.NoError(err)
+	in, err := ioutil.ReadFile(ecdsaPrivKey)
+	require.NoError(err)
+	wrapped, err := protocol.WrapKey(cert.PublicKey, in)
+	require.NoError(err)
+	publish(ecdsaSKI, &server.KeyRecord{Wrapped: wrapped})
+	require.NoError(sign(s.ecdsaKey))
+	require.ElementsMatch([]protocol.SKI{ecdsaSKI, rsaSKI}, keys.SKIs())
+
+	// A record pointing to another key is rejected.
+	publish(ecdsaSKI, &server.KeyRecord{File: rsaPrivKey})
+	require.Error(sign(s.ecdsaKey))
+
+	// Cached keys are kept while the store is unreachable, and removed keys
+	// are dropped once the cache expires.
+	require.NoError(sign(s.rsaKey))
+	etcd.Close()
+	require.NoError(sign(s.rsaKey))
+	etcd = fakeEtcd(&mtx, data)
+	defer etcd.Close()
+	store, err = server.NewMetadataStore("etcd://" + strings.TrimPrefix(etcd.URL, "http://") + "?prefix=keyless/")
+	require.NoError(err)
+	keys = server.NewMetadataKeystore(store, nil)
+	keys.SetTTL(0)
+	s.server.SetKeystore(keys)
+	require.NoError(sign(s.rsaKey))
+	publish(rsaSKI, nil)
+	require.True(errors.Is(sign(s.rsaKey), protocol.ErrKeyNotFound))
+
+	// Without a server, wrapped keys can't be loaded.
+	publish(ecdsaSKI, &server.KeyRecord{Wrapped: wrapped})
+	require.Error(sign(s.ecdsaKey))
+}
+
+// slowKeystore delays every signature made with its keys.
+type slowKeystore struct {
+	server.Keystore
+	delay time.Duration
+}
+
+type slowSigner struct {
+	crypto.Signer
+	delay time.Duration
+}
+
+func (ks slowKeystore) Get(ctx context.Context, op *protocol.Operation) (crypto.Signer, error) {
+	key, err := ks.Keystore.Get(ctx, op)
+	if key == nil || err != nil {
+		return key, err
+	}
+	return slowSigner{key, ks.delay}, nil
+}
+
+func (s slowSigner) Sign(rand io.Reader, digest []byte, opts crypto.SignerOpts) ([]byte, error) {
+	time.Sleep(s.delay)
+	return s.Signer.Sign(rand, digest, opts)
+}
+
+func (s *IntegrationTestSuite) TestTLSOptions() {
+	require := require.New(s.T())
+
+	// The group remote may also dial in the background to ping its servers,
+	// so only check that the callback ran.
+	var verified, reject int32
+	c, err := client.NewClientWithTLSOptions(s.client.Config.Certificates[0], s.client.Config.RootCAs, client.TLSOptions{
+		MinVersion:   tls.VersionTLS12,
+		MaxVersion:   tls.VersionTLS13,
+		CipherSuites: []uint16{tls.TLS_ECDHE_RSA_WITH_AES_256_GCM_SHA384, tls.TLS_ECDHE_ECDSA_WITH_CHACHA20_POLY1305},
+		VerifyPeerCertificate: func(rawCerts [][]byte, verifiedChains [][]*x509.Certificate) error {
+			atomic.AddInt32(&verified, 1)
+			if atomic.LoadInt32(&reject) != 0 {
+				return errors.New("pinned key mismatch")
+			}
+			return nil
+		},
+	})
+	require.NoError(err)
+	c.Config.Time = fixedCurrentTime
+
+	conn, err := s.remote.Dial(c)
+	require.NoError(err)
+	conn.Close()
+	require.NotZero(atomic.LoadInt32(&verified))
+
+	atomic.StoreInt32(&reject, 1)
+	_, err = s.remote.Dial(c)
+	require.Error(err)
+}
+
+func (s *IntegrationTestSuite) TestCertPolicy() {
+	require := require.New(s.T())
+
+	atomic.StoreUint32(&client.TestDisableConnectionPool, 0)
+	defer atomic.StoreUint32(&client.TestDisableConnectionPool, 1)
+	policy := client.NewCertPolicy()
+	s.client.CertPolicy = policy
+	defer func() { s.client.CertPolicy = nil }()
+
+	pair, err := tls.LoadX509KeyPair(serverCert, serverKey)
+	require.NoError(err)
+	leaf, err := x509.ParseCertificate(pair.Certificate[0])
+	require.NoError(err)
+	fp, err := client.ParseFingerprint(fmt.Sprintf("sha256:%x", sha256.Sum256(leaf.Raw)))
+	require.NoError(err)
+	require.Equal(client.CertificateFingerprint(leaf), fp)
+
+	// The pinned certificate of the server is accepted.
+	policy.Pin(fp)
+	conn, err := s.remote.Dial(s.client)
+	require.NoError(err)
+	require.NoError(conn.Ping(context.Background(), nil))
+
+	// Blocking it closes the connection, and later dials fail.
+	policy.Block(fp)
+	require.Error(conn.Ping(context.Background(), nil))
+	_, err = s.remote.Dial(s.client)
+	require.True(errors.Is(err, client.ErrCertificateBlocked), "got %v", err)
+
+	policy.Unblock(fp)
+	conn, err = s.remote.Dial(s.client)
+	require.NoError(err)
+	conn.Close()
+}
+
+func (s *IntegrationTestSuite) TestMiddleware() {
+	require := require.New(s.T())
+
+	rsaSKI, err := protocol.GetSKI(s.rsaKey.Public())
+	require.NoError(err)
+
+	var mtx sync.Mutex
+	var seen []protocol.Op
+	var identified bool
+	record := func(next server.Handler) server.Handler {
+		return server.HandlerFunc(func(ctx context.Context, op *protocol.Operation) protocol.Operation {
+			_, ok := server.ClientIdentityFromContext(ctx)
+			mtx.Lock()
+			seen = append(seen, op.Opcode)
+			identified = ok
+			mtx.Unlock()
+			return next.Handle(ctx, op)
+		})
+	}
+	denyRSA := func(next server.Handler) server.Handler {
+		return server.HandlerFunc(func(ctx context.Context, op *protocol.Operation) protocol.Operation {
+			if op.SKI == rsaSKI {
+				return protocol.MakeErrorOp(protocol.ErrKeyUsage)
+			}
+			return next.Handle(ctx, op)
+		})
+	}
+	s.server.Config().WithMiddleware(record, denyRSA)
+
+	_, err = s.ecdsaKey.Sign(rand.Reader, hashMsg(crypto.SHA256), crypto.SHA256)
+	require.NoError(err)
+	_, err = s.rsaKey.Sign(rand.Reader, hashMsg(crypto.SHA256), crypto.SHA256)
+	require.Error(err)
+	require.Contains(err.Error(), protocol.ErrKeyUsage.Error())
+
+	mtx.Lock()
+	defer mtx.Unlock()
+	require.Contains(seen, protocol.OpECDSASignSHA256)
+	require.Contains(seen, protocol.OpRSASignSHA256)
+	require.True(identified, "middleware should see the client identity")
+}
+
+// panickingKeystore returns signers which panic instead of signing.
+type panickingKeystore struct {
+	server.Keystore
+}
+
+type panickingSigner struct {
+	crypto.Signer
+}
+
+func (ks panickingKeystore) Get(ctx context.Context, op *protocol.Operation) (crypto.Signer, error) {
+	key, err := ks.Keystore.Get(ctx, op)
+	if key == nil || err != nil {
+		return key, err
+	}
+	return panickingSigner{key}, nil
+}
+
+func (panickingSigner) Sign(io.Reader, []byte, crypto.SignerOpts) ([]byte, error) {
+	panic("signer crashed")
+}
+
+func (s *IntegrationTestSuite) TestWorkerPanic() {
+	require := require.New(s.T())
+
+	keys, err := server.NewKeystoreFromDir("testdata", server.DefaultLoadKey)
+	require.NoError(err)
+	s.server.SetKeystore(panickingKeystore{keys})
+
+	// Each panic fails only its own request, and the server keeps serving.
+	for i := 0; i < 2*s.server.Config().ECDSAWorkers(); i++ {
+		_, err = s.ecdsaKey.Sign(rand.Reader, hashMsg(crypto.SHA256), crypto.SHA256)
+		require.Error(err)
+		require.Contains(err.Error(), protocol.ErrInternal.Error())
+	}
+
+	s.server.SetKeystore(keys)
+	_, err = s.ecdsaKey.Sign(rand.Reader, hashMsg(crypto.SHA256), crypto.SHA256)
+	require.NoError(err)
+}
+
+func (s *IntegrationTestSuite) TestLatencySLOs() {
+	require := require.New(s.T())
+
+	statuses := make(chan server.SLOStatus, 2)
+	report := func(status server.SLOStatus) { statuses <- status }
+	s.server.Config().WithLatencySLOs(report, server.LatencySLO{Op: protocol.OpPing, Percentile: 0.5, Threshold: time.Nanosecond})
+	conn, err := s.remote.Dial(s.client)
+	require.NoError(err)
+	defer conn.Close()
+
+	// The SLO is checked once there are enough requests.
+	for i := 0; i < 100; i++ {
+		require.NoError(conn.Ping(context.Background(), nil))
+	}
+	status := <-statuses
+	require.True(status.Breached)
+	require.Equal(protocol.OpPing, status.SLO.Op)
+	require.True(status.Latency > time.Nanosecond)
+
+	// Recovery is reported at the next check.
+	s.server.Config().WithLatencySLOs(report, server.LatencySLO{Op: protocol.OpPing, Percentile: 0.5, Threshold: time.Hour})
+	time.Sleep(time.Second)
+	require.NoError(conn.Ping(context.Background(), nil))
+	status = <-statuses
+	require.False(status.Breached)
+}
+
+func (s *IntegrationTestSuite) TestLoadShedding() {
+	require := require.New(s.T())
+
+	// Any queueing puts the server under pressure.
+	s.server.Config().WithLoadShedding(server.LoadShedPolicy{Op: protocol.OpRSASignSHA256, QueueDelay: time.Nanosecond})
+	require.Len(s.server.Config().LoadShedding(), 1)
+	_, err := s.rsaKey.Sign(rand.Reader, hashMsg(crypto.SHA256), crypto.SHA256)
+	require.True(errors.Is(err, protocol.ErrThrottled), "got %v", err)
+	var opErr *client.OperationError
+	require.True(errors.As(err, &opErr))
+	require.True(opErr.Temporary())
+	sig, err := s.ecdsaKey.Sign(rand.Reader, hashMsg(crypto.SHA256), crypto.SHA256)
+	require.NoError(err)
+	require.NoError(checkSignature(s.ecdsaKey.Public(), crypto.SHA256, sig))
+
+	// Requests aren't shed until the pressure is sustained.
+	s.server.Config().WithLoadShedding(server.LoadShedPolicy{Op: protocol.OpRSASignSHA256, QueueDelay: time.Nanosecond, Sustain: time.Hour})
+	_, err = s.rsaKey.Sign(rand.Reader, hashMsg(crypto.SHA256), crypto.SHA256)
+	require.NoError(err)
+
+	// Nor without pressure.
+	s.server.Config().WithLoadShedding(server.LoadShedPolicy{Op: protocol.OpRSASignSHA256, QueueDelay: time.Hour})
+	_, err = s.rsaKey.Sign(rand.Reader, hashMsg(crypto.SHA256), crypto.SHA256)
+	require.NoError(err)
+}
+
+func (s *IntegrationTestSuite) TestFaultInjection() {
+	require := require.New(s.T())
+
+	ping := func() error {
+		conn, err := s.remote.Dial(s.client)
+		require.NoError(err)
+		defer conn.Close()
+		ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+		defer cancel()
+		return conn.Ping(ctx, nil)
+	}
+
+	s.server.Config().WithFaultInjection(server.Fault{Op: protocol.OpPing, ErrorRate: 1, Errors: []protocol.Error{protocol.ErrThrottled}})
+	require.Len(s.server.Config().FaultInjection(), 1)
+	err := ping()
+	require.True(errors.Is(err, protocol.ErrThrottled), "got %v", err)
+
+	s.server.Config().WithFaultInjection(server.Fault{Op: protocol.OpPing, Latency: 200 * time.Millisecond, LatencyRate: 1})
+	begin := time.Now()
+	require.NoError(ping())
+	require.True(time.Since(begin) >= 200*time.Millisecond)
+
+	s.server.Config().WithFaultInjection(server.Fault{Op: protocol.OpPing, TruncateRate: 1})
+	require.Error(ping())
+	s.server.Config().WithFaultInjection(server.Fault{Op: protocol.OpPing, ResetRate: 1})
+	require.Error(ping())
+
+	// Other opcodes are left alone.
+	_, err = s.ecdsaKey.Sign(rand.Reader, hashMsg(crypto.SHA256), crypto.SHA256)
+	require.NoError(err)
+	s.server.Config().WithFaultInjection()
+	require.NoError(ping())
+}
+
+// recordingSink is a MetricsSink which records the counters it receives.
+type recordingSink struct {
+	mtx    sync.Mutex
+	counts map[string]float64
+}
+
+func (r *recordingSink) Count(name string, delta float64, labels server.Labels) {
+	r.mtx.Lock()
+	defer r.mtx.Unlock()
+	r.counts[fmt.Sprintf("%s%v", name, labels)] += delta
+}
+
+func (r *recordingSink) Gauge(name string, value float64, labels server.Labels) {}
+
+func (r *recordingSink) Timing(name string, d time.Duration, labels server.Labels) {}
+
+func (s *IntegrationTestSuite) TestMetricsSinks() {
+	require := require.New(s.T())
+
+	udp, err := net.ListenPacket("udp", "127.0.0.1:0")
+	require.NoError(err)
+	defer udp.Close()
+	statsd, err := server.NewStatsdSink(udp.LocalAddr().String(), "test.")
+	require.NoError(err)
+	defer statsd.Close()
+
+	exports := make(chan []byte, 1)
+	collector := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body, _ := ioutil.ReadAll(r.Body)
+		exports <- body
+	}))
+	defer collector.Close()
+	otlp := server.NewOTLPSink(collector.URL, time.Hour)
+
+	rec := &recordingSink{counts: make(map[string]float64)}
+	server.SetMetricsSinks(server.PrometheusSink, rec, statsd, otlp)
+	defer server.SetMetricsSinks(server.PrometheusSink)
+
+	remote := client.NewServer(&net.TCPAddr{IP: net.IPv4(127, 0, 0, 1), Port: s.serverPort}, "localhost")
+	conn, err := remote.Dial(s.client)
+	require.NoError(err)
+	defer conn.Close()
+	require.NoError(conn.Ping(context.Background(), nil))
+
+	rec.mtx.Lock()
+	require.NotZero(rec.counts["keyless_requests"+fmt.Sprint(server.Labels{"opcode": "OpPing"})])
+	rec.mtx.Unlock()
+
+	// Other metrics, such as the utilization of the workers, may come first.
+	buf := make([]byte, 1024)
+	udp.SetReadDeadline(time.Now().Add(5 * time.Second))
+	for {
+		n, _, err := udp.ReadFrom(buf)
+		require.NoError(err)
+		if string(buf[:n]) == "test.keyless_requests:1|c|#opcode:OpPing" {
+			break
+		}
+	}
+
+	require.NoError(otlp.Close())
+	body := <-exports
+	var export struct {
+		ResourceMetrics []struct {
+			ScopeMetrics []struct {
+				Metrics []struct {
+					Name string `json:"name"`
+				} `json:"metrics"`
+			} `json:"scopeMetrics"`
+		} `json:"resourceMetrics"`
+	}
+	require.NoError(json.Unmarshal(body, &export))
+	var names []string
+	for _, m := range export.ResourceMetrics[0].ScopeMetrics[0].Metrics {
+		names = append(names, m.Name)
+	}
+	require.Contains(names, "keyless_requests")
+	require.Contains(names, "keyless_request_total_duration_per_opcode")
+}
+
+func (s *IntegrationTestSuite) TestKeyLimits() {
+	require := require.New(s.T())
+
+	keys, err := server.NewKeystoreFromDir("testdata", server.DefaultLoadKey)
+	require.NoError(err)
+	s.server.SetKeystore(slowKeystore{keys, 200 * time.Millisecond})
+
+	var group atomic.Value
+	group.Store("no-queue")
+	s.server.Config().WithKeyLimits(func(op *protocol.Operation, key crypto.Signer) server.KeyLimit {
+		if group.Load() == "no-queue" {
+			return server.KeyLimit{Group: "no-queue", Concurrency: 1}
+		}
+		return server.KeyLimit{Group: "queue", Concurrency: 1, Queue: 1, Timeout: time.Second}
+	})
+
+	signConcurrently := func() (failed int) {
+		errs := make(chan error, 2)
+		for i := 0; i < 2; i++ {
+			go func() {
+				_, err := s.ecdsaKey.Sign(rand.Reader, hashMsg(crypto.SHA256), crypto.SHA256)
+				errs <- err
+			}()
+		}
+		for i := 0; i < 2; i++ {
+			if <-errs != nil {
+				failed++
+			}
+		}
+		return failed
+	}
+
+	// Without a queue, the second request fails while the first holds the key.
+	require.Equal(1, signConcurrently())
+
+	// With a queue, it waits for the first.
+	group.Store("queue")
+	require.Equal(0, signConcurrently())
+}
+
+func (s *IntegrationTestSuite) TestConnectionLimits() {
+	require := require.New(s.T())
+
+	// Dial the server directly, since a Group opens extra connections to ping
+	// its servers.
+	remote := client.NewServer(&net.TCPAddr{IP: net.IPv4(127, 0, 0, 1), Port: s.serverPort}, "localhost")
+	// The server notices closed connections asynchronously, so wait for a slot.
+	dialAvailable := func() *client.Conn {
+		for deadline := time.Now().Add(5 * time.Second); ; {
+			conn, err := remote.Dial(s.client)
+			require.NoError(err)
+			err = conn.Ping(context.Background(), nil)
+			if err == nil {
+				return conn
+			}
+			conn.Close()
+			require.Equal(protocol.ErrThrottled, err)
+			require.True(time.Now().Before(deadline), "connection slot not released")
+			time.Sleep(10 * time.Millisecond)
+		}
+	}
+
+	for _, limits := range [][2]int{{1, 0}, {0, 1}} {
+		s.server.Config().WithConnectionLimits(limits[0], limits[1])
+		first := dialAvailable()
+
+		// The second connection is told why it was rejected.
+		second, err := remote.Dial(s.client)
+		require.NoError(err)
+		require.Equal(protocol.ErrThrottled, second.Ping(context.Background(), nil))
+		second.Close()
+
+		// A rejected connection which sends nothing is closed quickly rather
+		// than after the TCP timeout.
+		config := s.client.Config.Clone()
+		config.ServerName = "localhost"
+		idle, err := tls.Dial("tcp", fmt.Sprintf("127.0.0.1:%d", s.serverPort), config)
+		require.NoError(err)
+		require.NoError(idle.SetReadDeadline(time.Now().Add(5 * time.Second)))
+		_, err = idle.Read(make([]byte, 1))
+		require.Equal(io.EOF, err)
+		idle.Close()
+
+		first.Close()
+		dialAvailable().Close()
+	}
+}
+
+func (s *IntegrationTestSuite) TestIPFilter() {
+	require := require.New(s.T())
+
+	loopback, err := server.ParseCIDRs([]string{"127.0.0.0/8"})
+	require.NoError(err)
+	other, err := server.ParseCIDRs([]string{"192.0.2.1"})
+	require.NoError(err)
+	filter := server.NewIPFilter(other, nil)
+	s.server.Config().WithIPFilter(filter)
+
+	remote := client.NewServer(&net.TCPAddr{IP: net.IPv4(127, 0, 0, 1), Port: s.serverPort}, "localhost")
+	// Rejected connections are closed before the TLS handshake.
+	_, err = remote.Dial(s.client)
+	require.Error(err)
+
+	filter.Set(loopback, nil)
+	conn, err := remote.Dial(s.client)
+	require.NoError(err)
+	require.NoError(conn.Ping(context.Background(), nil))
+	conn.Close()
+
+	// The deny list wins over the allow list.
+	filter.Set(loopback, loopback)
+	_, err = remote.Dial(s.client)
+	require.Error(err)
+
+	_, err = server.ParseCIDRs([]string{"not an address"})
+	require.Error(err)
+}
+
+func (s *IntegrationTestSuite) TestNoiseTransport() {
+	require := require.New(s.T())
+
+	serverKey, err := noise.GenerateKeyPair(nil)
+	require.NoError(err)
+	clientKey, err := noise.GenerateKeyPair(nil)
+	require.NoError(err)
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	require.NoError(err)
+	defer l.Close()
+	go s.server.ServeWithNoise(l, &noise.Config{StaticKey: serverKey, ClientKeys: []noise.PublicKey{clientKey.Public}})
+
+	c := client.NewClient(tls.Certificate{}, nil)
+	c.NoiseKey = &clientKey
+	remote := client.NewNoiseServer(l.Addr(), serverKey.Public)
+	conn, err := remote.Dial(c)
+	require.NoError(err)
+	require.NoError(conn.Ping(context.Background(), []byte("noise")))
+	conn.Close()
+
+	// Clients whose key the server doesn't know are rejected once the server
+	// has read their first handshake message.
+	other, err := noise.GenerateKeyPair(nil)
+	require.NoError(err)
+	c.NoiseKey = &other
+	_, err = remote.Dial(c)
+	require.Error(err)
+	c.NoiseKey = nil
+	_, err = remote.Dial(c)
+	require.Error(err)
+}
+
+func (s *IntegrationTestSuite) TestRevocationChecks() {
+	require := require.New(s.T())
+
+	ca, err := tls.LoadX509KeyPair(keylessCA, "testdata/ca-key.pem")
+	require.NoError(err)
+	caCert, err := x509.ParseCertificate(ca.Certificate[0])
+	require.NoError(err)
+	leaf, err := tls.LoadX509KeyPair(clientCert, clientKey)
+	require.NoError(err)
+	clientLeaf, err := x509.ParseCertificate(leaf.Certificate[0])
+	require.NoError(err)
+
+	dir, err := ioutil.TempDir("", "gokeyless")
+	require.NoError(err)
+	defer os.RemoveAll(dir)
+	writeCRL := func(revoked ...pkix.RevokedCertificate) string {
+		now := time.Now()
+		der, err := caCert.CreateCRL(rand.Reader, ca.PrivateKey, revoked, now, now.Add(time.Hour))
+		require.NoError(err)
+		path := filepath.Join(dir, fmt.Sprintf("ca-%d.crl", len(revoked)))
+		require.NoError(ioutil.WriteFile(path, der, 0644))
+		return path
+	}
+	// ping dials a new connection, since the server only rejects the client
+	// once it has verified its certificate, after the client's handshake.
+	remote := client.NewServer(&net.TCPAddr{IP: net.IPv4(127, 0, 0, 1), Port: s.serverPort}, "localhost")
+	ping := func() error {
+		conn, err := remote.Dial(s.client)
+		if err != nil {
+			return err
+		}
+		defer conn.Close()
+		ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+		defer cancel()
+		return conn.Ping(ctx, nil)
+	}
+
+	rc, err := server.NewRevocationChecker(server.RevocationConfig{CRLs: []string{writeCRL()}})
+	require.NoError(err)
+	defer rc.Close()
+	s.server.Config().WithRevocationChecker(rc)
+	require.NoError(ping())
+
+	revoked := writeCRL(pkix.RevokedCertificate{SerialNumber: clientLeaf.SerialNumber, RevocationTime: time.Now()})
+	rc, err = server.NewRevocationChecker(server.RevocationConfig{CRLs: []string{revoked}})
+	require.NoError(err)
+	defer rc.Close()
+	require.True(errors.Is(rc.Check([]*x509.Certificate{clientLeaf, caCert}), server.ErrCertificateRevoked))
+	s.server.Config().WithRevocationChecker(rc)
+	require.Error(ping())
+
+	// Without a CRL, the status of the certificate is unknown, which only
+	// soft-fail mode accepts.
+	_, err = server.NewRevocationChecker(server.RevocationConfig{CRLs: []string{filepath.Join(dir, "missing.crl")}})
+	require.Error(err)
+	rc, err = server.NewRevocationChecker(server.RevocationConfig{OCSP: true})
+	require.NoError(err)
+	defer rc.Close()
+	s.server.Config().WithRevocationChecker(rc)
+	require.Error(ping())
+	rc, err = server.NewRevocationChecker(server.RevocationConfig{OCSP: true, SoftFail: true})
+	require.NoError(err)
+	defer rc.Close()
+	s.server.Config().WithRevocationChecker(rc)
+	require.NoError(ping())
+}
+
+func (s *IntegrationTestSuite) TestMaxOutstandingRequests() {
+	require := require.New(s.T())
+
+	started := make(chan struct{})
+	release := make(chan struct{})
+	s.server.Config().WithMaxOutstandingRequests(1)
+	s.server.Config().WithCustomOpFunction(func(ctx context.Context, op protocol.Operation) ([]byte, error) {
+		close(started)
+		<-release
+		return op.Payload, nil
+	})
+
+	remote := client.NewServer(&net.TCPAddr{IP: net.IPv4(127, 0, 0, 1), Port: s.serverPort}, "localhost")
+	conn, err := remote.Dial(s.client)
+	require.NoError(err)
+	defer conn.Close()
+
+	blocked := make(chan *protocol.Operation, 1)
+	go func() {
+		resp, err := conn.DoOperation(context.Background(), protocol.Operation{Opcode: protocol.OpCustom, Payload: []byte("slow")})
+		if err != nil {
+			resp = nil
+		}
+		blocked <- resp
+	}()
+	<-started
+
+	// The first request occupies the connection's only slot.
+	require.Equal(protocol.ErrThrottled, conn.Ping(context.Background(), nil))
+
+	close(release)
+	resp := <-blocked
+	require.NotNil(resp)
+	require.Equal(protocol.OpResponse, resp.Opcode)
+	require.Equal([]byte("slow"), resp.Payload)
+	require.NoError(conn.Ping(context.Background(), nil))
+}
+
+func (s *IntegrationTestSuite) TestPayloadLimits() {
+	require := require.New(s.T())
+
+	s.server.Config().WithPayloadLimit(protocol.OpECDSASignSHA256, 32).WithDefaultPayloadLimit(1024)
+	conn, err := s.remote.Dial(s.client)
+	require.NoError(err)
+	defer conn.Close()
+	ski, err := protocol.GetSKI(s.ecdsaKey.Public())
+	require.NoError(err)
+
+	resp, err := conn.DoOperation(context.Background(), protocol.Operation{
+		Opcode:  protocol.OpECDSASignSHA256,
+		Payload: hashMsg(crypto.SHA256),
+		SKI:     ski,
+	})
+	require.NoError(err)
+	require.Equal(protocol.OpResponse, resp.Opcode)
+	resp, err = conn.DoOperation(context.Background(), protocol.Operation{
+		Opcode:  protocol.OpECDSASignSHA256,
+		Payload: make([]byte, 33),
+		SKI:     ski,
+	})
+	require.NoError(err)
+	require.Equal(protocol.ErrFormat, resp.GetError())
+
+	// Packets too long for any limit are skipped, and the connection remains
+	// usable.
+	resp, err = conn.DoOperation(context.Background(), protocol.Operation{
+		Opcode:  protocol.OpSeal,
+		Payload: make([]byte, 8192),
+	})
+	require.NoError(err)
+	require.Equal(protocol.ErrFormat, resp.GetError())
+	require.NoError(conn.Ping(context.Background(), nil))
+}
+
+func (s *IntegrationTestSuite) TestReadiness() {
+	require := require.New(s.T())
+
+	backend := errors.New("backend unreachable")
+	var failing int32 = 1
+	s.server.AddReadinessCheck("backend", func(ctx context.Context) error {
+		if atomic.LoadInt32(&failing) == 1 {
+			return backend
+		}
+		return nil
+	})
+	s.server.Config().WithRejectUntilReady(true)
+
+	handler := s.server.ReadinessHandler()
+	serveReadiness := func() (int, server.ReadinessStatus) {
+		w := httptest.NewRecorder()
+		handler.ServeHTTP(w, httptest.NewRequest(http.MethodGet, "/readyz", nil))
+		var status server.ReadinessStatus
+		require.NoError(json.NewDecoder(w.Body).Decode(&status))
+		return w.Code, status
+	}
+	code, status := serveReadiness()
+	require.Equal(http.StatusServiceUnavailable, code)
+	require.Equal(map[string]string{"backend": "not run"}, status.Pending)
+
+	ctx, cancel := context.WithTimeout(context.Background(), 20*time.Millisecond)
+	defer cancel()
+	require.Equal(context.DeadlineExceeded, s.server.WaitReady(ctx, time.Millisecond))
+	code, status = serveReadiness()
+	require.Equal(http.StatusServiceUnavailable, code)
+	require.Equal(map[string]string{"backend": backend.Error()}, status.Pending)
+
+	// Connections are rejected with a retryable error until the server is
+	// ready.
+	remote := client.NewServer(&net.TCPAddr{IP: net.IPv4(127, 0, 0, 1), Port: s.serverPort}, "localhost")
+	conn, err := remote.Dial(s.client)
+	require.NoError(err)
+	err = conn.Ping(context.Background(), nil)
+	conn.Close()
+	require.True(errors.Is(err, protocol.ErrNotReady), "got %v", err)
+	require.True(protocol.ErrNotReady.Temporary())
+
+	atomic.StoreInt32(&failing, 0)
+	require.NoError(s.server.WaitReady(context.Background(), time.Millisecond))
+	require.True(s.server.Ready())
+	code, status = serveReadiness()
+	require.Equal(http.StatusOK, code)
+	require.True(status.Ready)
+	require.Empty(status.Pending)
+
+	conn, err = remote.Dial(s.client)
+	require.NoError(err)
+	defer conn.Close()
+	require.NoError(conn.Ping(context.Background(), nil))
+}
+
+func (s *IntegrationTestSuite) TestDeterministicECDSA() {
+	require := require.New(s.T())
+	if testSoftHSM {
+		s.T().Skip("deterministic signatures only apply to software keys")
+	}
+
+	s.server.Config().WithDeterministicECDSA(true).WithLowSECDSA(true)
+	sig, err := s.ecdsaKey.Sign(rand.Reader, hashMsg(crypto.SHA256), crypto.SHA256)
+	require.NoError(err)
+	require.NoError(checkSignature(s.ecdsaKey.Public(), crypto.SHA256, sig))
+	again, err := s.ecdsaKey.Sign(rand.Reader, hashMsg(crypto.SHA256), crypto.SHA256)
+	require.NoError(err)
+	require.Equal(sig, again)
+
+	var parsed struct{ R, S *big.Int }
+	_, err = asn1.Unmarshal(sig, &parsed)
+	require.NoError(err)
+	halfN := new(big.Int).Rsh(s.ecdsaKey.Public().(*ecdsa.PublicKey).Params().N, 1)
+	require.True(parsed.S.Cmp(halfN) <= 0, "signature is not low-S")
+
+	s.server.Config().WithDeterministicECDSA(false)
+	again, err = s.ecdsaKey.Sign(rand.Reader, hashMsg(crypto.SHA256), crypto.SHA256)
+	require.NoError(err)
+	require.NotEqual(sig, again)
+}
+
+func (s *IntegrationTestSuite) TestAttestation() {
+	require := require.New(s.T())
+
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	require.NoError(err)
+	s.server.SetAttester(&server.Attester{Key: key, BuildHash: []byte("build")})
+	ski, err := protocol.GetSKI(s.ecdsaKey.Public())
+	require.NoError(err)
+
+	s.client.Attestation = &client.AttestationPolicy{
+		Key:         key.Public(),
+		SKIs:        []protocol.SKI{ski},
+		BuildHashes: [][]byte{[]byte("other"), []byte("build")},
+	}
+	conn, err := s.remote.Dial(s.client)
+	require.NoError(err)
+	conn.Close()
+	_, err = s.ecdsaKey.Sign(rand.Reader, hashMsg(crypto.SHA256), crypto.SHA256)
+	require.NoError(err)
+
+	// Servers which fail the policy are not sent any requests.
+	for _, policy := range []client.AttestationPolicy{
+		{Key: s.ecdsaKey.Public()},
+		{Key: key.Public(), SKIs: []protocol.SKI{{1}}},
+		{Key: key.Public(), BuildHashes: [][]byte{[]byte("other")}},
+	} {
+		policy := policy
+		s.client.Attestation = &policy
+		_, err = s.remote.Dial(s.client)
+		require.True(errors.Is(err, client.ErrNotAttested), "got error %v", err)
+		_, err = s.ecdsaKey.Sign(rand.Reader, hashMsg(crypto.SHA256), crypto.SHA256)
+		require.Error(err)
+	}
+}
+
+func (s *IntegrationTestSuite) TestPooledConnPolicies() {
+	require := require.New(s.T())
+
+	atomic.StoreUint32(&client.TestDisableConnectionPool, 0)
+	defer atomic.StoreUint32(&client.TestDisableConnectionPool, 1)
+	conn, err := s.remote.Dial(s.client)
+	require.NoError(err)
+	defer conn.Close()
+
+	// Another client with stricter policies doesn't get the pooled
+	// connection, which was never checked against them.
+	other, err := client.NewClientFromFile(clientCert, clientKey, keyserverCA)
+	require.NoError(err)
+	other.Config.Time = fixedCurrentTime
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	require.NoError(err)
+	other.Attestation = &client.AttestationPolicy{Key: key.Public()}
+	_, err = s.remote.Dial(other)
+	require.True(errors.Is(err, client.ErrNotAttested), "got error %v", err)
+
+	other.Attestation = nil
+	other.CertPolicy = client.NewCertPolicy()
+	other.CertPolicy.Pin(client.Fingerprint{})
+	_, err = s.remote.Dial(other)
+	require.True(errors.Is(err, client.ErrCertificateNotPinned), "got error %v", err)
+
+	again, err := s.remote.Dial(s.client)
+	require.NoError(err)
+	require.True(conn == again, "pooled connection wasn't reused")
+}
+
+func (s *IntegrationTestSuite) TestKeyManifest() {
+	require := require.New(s.T())
+
+	ctx := context.Background()
+	_, err := s.client.LoadManifest(ctx, "", s.ecdsaKey.Public(), 0)
+	require.Error(err, "manifests need an Attester")
+
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	require.NoError(err)
+	s.server.SetAttester(&server.Attester{Key: key})
+	ski, err := protocol.GetSKI(s.ecdsaKey.Public())
+	require.NoError(err)
+
+	km, err := s.client.LoadManifest(ctx, "", key.Public(), time.Hour)
+	require.NoError(err)
+	defer km.Close()
+	require.Contains(km.SKIs(), ski)
+	require.False(km.Issued().IsZero())
+	signer := km.Signer(ski)
+	require.NotNil(signer)
+	_, err = signer.Sign(rand.Reader, hashMsg(crypto.SHA256), crypto.SHA256)
+	require.NoError(err)
+	require.Nil(km.Signer(protocol.SKI{1}))
+
+	_, err = s.client.LoadManifest(ctx, "", s.ecdsaKey.Public(), 0)
+	require.Equal(protocol.ErrManifest, err)
+}
+
+func (s *IntegrationTestSuite) TestDebugHandler() {
+	require := require.New(s.T())
+
+	remote := client.NewServer(&net.TCPAddr{IP: net.IPv4(127, 0, 0, 1), Port: s.serverPort}, "localhost")
+	conn, err := remote.Dial(s.client)
+	require.NoError(err)
+	defer conn.Close()
+	require.NoError(conn.Ping(context.Background(), nil))
+
+	debug := httptest.NewServer(s.server.DebugHandler())
+	defer debug.Close()
+	for _, path := range []string{"/debug/pprof/", "/debug/vars"} {
+		resp, err := http.Get(debug.URL + path)
+		require.NoError(err)
+		resp.Body.Close()
+		require.Equal(http.StatusOK, resp.StatusCode, path)
+	}
+
+	resp, err := http.Get(debug.URL + "/debug/connections")
+	require.NoError(err)
+	defer resp.Body.Close()
+	var conns []server.ConnInfo
+	require.NoError(json.NewDecoder(resp.Body).Decode(&conns))
+	found := false
+	for _, info := range conns {
+		if info.LastRead.Opcode == protocol.OpPing.String() && info.Writes > 0 {
+			found = true
+			require.Contains(info.Client, "sha256:")
+		}
+	}
+	require.True(found, "connection not listed: %+v", conns)
+}
+
+func (s *IntegrationTestSuite) TestConnectionHistory() {
+	require := require.New(s.T())
+
+	conn, err := s.remote.Dial(s.client)
+	require.NoError(err)
+	require.NoError(conn.Ping(context.Background(), nil))
+	resp, err := conn.DoOperation(context.Background(), protocol.Operation{Opcode: protocol.Op(0x7F)})
+	require.NoError(err)
+	require.Equal(protocol.ErrBadOpcode, resp.GetError())
+	conn.Close()
+
+	// The history of the connection is kept once the server notices it closed.
+	var closed *server.ConnHistory
+	require.Eventually(func() bool {
+		for _, h := range s.server.ConnectionHistory().Connections {
+			if h.ClosedTime != nil && h.Errors[protocol.ErrBadOpcode.String()] > 0 {
+				closed = &h
+				return true
+			}
+		}
+		return false
+	}, 5*time.Second, 10*time.Millisecond)
+	require.Equal(1, closed.Ops[protocol.OpPing.String()])
+	require.Equal(1, closed.Ops[protocol.Op(0x7F).String()])
+	require.True(closed.BytesRead > 0)
+	require.True(closed.BytesWritten > 0)
+	require.Len(closed.ErrorEvents, 1)
+	require.Equal("write", closed.ErrorEvents[0].Kind)
+	require.True(len(closed.Events) >= 4)
+
+	debug := httptest.NewServer(s.server.DebugHandler())
+	defer debug.Close()
+	httpResp, err := http.Get(debug.URL + "/debug/connections/history")
+	require.NoError(err)
+	defer httpResp.Body.Close()
+	var dump server.ConnStatsDump
+	require.NoError(json.NewDecoder(httpResp.Body).Decode(&dump))
+	require.True(dump.Errors[protocol.ErrBadOpcode.String()] > 0)
+	require.NotEmpty(dump.ErrorTimeline)
+	require.True(dump.BytesRead >= closed.BytesRead)
+}
+
+func (s *IntegrationTestSuite) TestClientUsage() {
+	require := require.New(s.T())
+
+	usageOf := func(usage []server.ClientUsage) *server.ClientUsage {
+		for i := range usage {
+			if usage[i].Ops[protocol.OpPing.String()] > 0 {
+				return &usage[i]
+			}
+		}
+		return nil
+	}
+	// The requests on both connections count towards the same client.
+	for i := 0; i < 2; i++ {
+		conn, err := s.remote.Dial(s.client)
+		require.NoError(err)
+		require.NoError(conn.Ping(context.Background(), nil))
+		resp, err := conn.DoOperation(context.Background(), protocol.Operation{Opcode: protocol.Op(0x7F)})
+		require.NoError(err)
+		require.Equal(protocol.ErrBadOpcode, resp.GetError())
+		conn.Close()
+	}
+	usage := usageOf(s.server.ClientUsage())
+	require.NotNil(usage)
+	require.NotEqual("<anonymous>", usage.Client)
+	require.True(usage.Ops[protocol.OpPing.String()] >= 2)
+	require.Equal(2, usage.Ops[protocol.Op(0x7F).String()])
+	require.Equal(2, usage.Errors[protocol.ErrBadOpcode.String()])
+	require.True(usage.Requests >= 4)
+	require.True(usage.BytesRead > 0)
+	require.True(usage.BytesWritten > 0)
+	require.False(usage.LastSeen.Before(usage.FirstSeen))
+
+	admin, adminClient := s.newAdmin()
+	defer admin.Close()
+	httpResp, err := adminClient.Get(admin.URL + "/admin/clients")
+	require.NoError(err)
+	defer httpResp.Body.Close()
+	var listed []server.ClientUsage
+	require.NoError(json.NewDecoder(httpResp.Body).Decode(&listed))
+	require.Equal(usage.Client, usageOf(listed).Client)
+}
+
+func (s *IntegrationTestSuite) TestBatch() {
+	require := require.New(s.T())
+
+	digests := make([][]byte, 10)
+	for i := range digests {
+		digest := sha256.Sum256([]byte{byte(i)})
+		digests[i] = digest[:]
+	}
+	for _, key := range []*client.PrivateKey{s.ecdsaKey, &s.rsaKey.PrivateKey} {
+		sigs, err := key.SignBatch(digests, crypto.SHA256)
+		require.NoError(err)
+		require.Len(sigs, len(digests))
+		for i, sig := range sigs {
+			switch pub := key.Public().(type) {
+			case *ecdsa.PublicKey:
+				require.True(ecdsa.VerifyASN1(pub, digests[i], sig))
+			case *rsa.PublicKey:
+				require.NoError(rsa.VerifyPKCS1v15(pub, crypto.SHA256, digests[i], sig))
+			}
+		}
+	}
+
+	// Each operation succeeds or fails on its own.
+	results, err := s.client.DoBatch(context.Background(), "", []protocol.Operation{
+		{Opcode: protocol.OpPing, Payload: []byte("ping")},
+		{Opcode: protocol.OpECDSASignSHA256, Payload: digests[0], SKI: protocol.SKI{1}},
+	})
+	require.NoError(err)
+	require.Len(results, 2)
+	require.Equal(protocol.OpPong, results[0].Opcode)
+	require.Equal([]byte("ping"), results[0].Payload)
+	require.Equal(protocol.OpError, results[1].Opcode)
+	require.Equal(protocol.ErrKeyNotFound, results[1].GetError())
+
+	// Nested batches and operations of the connection are rejected, and the
+	// payload limits apply to each operation.
+	s.server.Config().WithPayloadLimit(protocol.OpECDSASignSHA256, 32)
+	ski, err := protocol.GetSKI(s.ecdsaKey.Public())
+	require.NoError(err)
+	nested := protocol.Operation{Opcode: protocol.OpBatch, NoPadding: true}
+	nested.Payload, err = protocol.MarshalBatch([]protocol.Operation{{Opcode: protocol.OpPing}})
+	require.NoError(err)
+	body, err := nested.MarshalBinary()
+	require.NoError(err)
+	payload, err := protocol.MarshalBatch([]protocol.Operation{
+		{Opcode: protocol.OpStream},
+		{Opcode: protocol.OpHello},
+		{Opcode: protocol.OpAuthenticate},
+		{Opcode: protocol.OpECDSASignSHA256, Payload: make([]byte, 33), SKI: ski},
+		{Opcode: protocol.OpECDSASignSHA256, Payload: digests[0], SKI: ski},
+	})
+	require.NoError(err)
+	// MarshalBatch refuses to nest batches, so the nested one is prepended by
+	// hand.
+	payload = append([]byte{byte(len(body) >> 8), byte(len(body))}, append(body, payload...)...)
+	conn, err := s.remote.Dial(s.client)
+	require.NoError(err)
+	defer conn.Close()
+	resp, err := conn.DoOperation(context.Background(), protocol.Operation{Opcode: protocol.OpBatch, Payload: payload})
+	require.NoError(err)
+	require.Equal(protocol.OpResponse, resp.Opcode)
+	results, err = protocol.UnmarshalBatch(resp.Payload)
+	require.NoError(err)
+	require.Len(results, 6)
+	for _, res := range results[:4] {
+		require.Equal(protocol.ErrBadOpcode, res.GetError())
+	}
+	require.Equal(protocol.ErrFormat, results[4].GetError())
+	require.Equal(protocol.OpResponse, results[5].Opcode)
+}
+
+func (s *IntegrationTestSuite) TestWorkerPools() {
+	require := require.New(s.T())
+	if testSoftHSM {
+		s.T().Skip("the replacement server loads its keys from testdata")
+	}
+
+	_, err := server.NewServerFromFile(server.DefaultServeConfig().WithOpcodePool(protocol.OpPing, "missing"), serverCert, serverKey, keylessCA)
+	require.Error(err)
+	_, err = server.NewServerFromFile(server.DefaultServeConfig().WithWorkerPool(server.WorkerPoolConfig{Name: server.PoolRSA, Workers: 1}), serverCert, serverKey, keylessCA)
+	require.Error(err)
+
+	ski, err := protocol.GetSKI(s.ecdsaKey.Public())
+	require.NoError(err)
+	var mtx sync.Mutex
+	selected := make(map[protocol.Op]bool)
+	cfg := server.DefaultServeConfig().
+		WithWorkerPool(server.WorkerPoolConfig{Name: "slow", Workers: 1, Queue: 4}).
+		WithKeyPool(ski, "slow").
+		WithOpcodePool(protocol.OpPing, "slow").
+		WithWorkerPoolSelector(func(pkt *protocol.Packet) server.WorkerPoolType {
+			mtx.Lock()
+			selected[pkt.Operation.Opcode] = true
+			mtx.Unlock()
+			return server.PoolOther
+		})
+
+	// Replace the server with one using the custom pools.
+	require.NoError(shutdownServer(s.server, 2*time.Second))
+	s.server, err = server.NewServerFromFile(cfg, serverCert, serverKey, keylessCA)
+	require.NoError(err)
+	s.server.TLSConfig().Time = fixedCurrentTime
+	keys, err := server.NewKeystoreFromDir("testdata", server.DefaultLoadKey)
+	require.NoError(err)
+	s.server.SetKeystore(keys)
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	require.NoError(err)
+	go s.server.Serve(l)
+	s.client.DefaultRemote = client.NewServer(l.Addr(), "localhost")
+
+	conn, err := s.client.DefaultRemote.Dial(s.client)
+	require.NoError(err)
+	require.NoError(conn.Ping(context.Background(), nil))
+	conn.Close()
+	sig, err := s.ecdsaKey.Sign(rand.Reader, hashMsg(crypto.SHA256), crypto.SHA256)
+	require.NoError(err)
+	require.NoError(checkSignature(s.ecdsaKey.Public(), crypto.SHA256, sig))
+	sig, err = s.rsaKey.Sign(rand.Reader, hashMsg(crypto.SHA256), crypto.SHA256)
+	require.NoError(err)
+	require.NoError(checkSignature(s.rsaKey.Public(), crypto.SHA256, sig))
+
+	// Routed requests bypass the selector.
+	mtx.Lock()
+	defer mtx.Unlock()
+	require.False(selected[protocol.OpPing])
+	require.False(selected[protocol.OpECDSASignSHA256])
+	require.True(selected[protocol.OpRSASignSHA256])
+}
+
+func (s *IntegrationTestSuite) TestRSAProcs() {
+	require := require.New(s.T())
+	if testSoftHSM {
+		s.T().Skip("the replacement server loads its keys from testdata")
+	}
+
+	n := server.AvailableCPUs()
+	require.True(n >= 1 && n <= runtime.GOMAXPROCS(0))
+	_, err := server.NewServerFromFile(server.DefaultServeConfig().WithRSAProcs(-1), serverCert, serverKey, keylessCA)
+	require.Error(err)
+
+	// Replace the server with one running one RSA operation at a time.
+	cfg := server.DefaultServeConfig().WithRSAWorkers(4).WithRSAProcs(1)
+	require.Equal(1, cfg.RSAProcs())
+	require.NoError(shutdownServer(s.server, 2*time.Second))
+	s.server, err = server.NewServerFromFile(cfg, serverCert, serverKey, keylessCA)
+	require.NoError(err)
+	s.server.TLSConfig().Time = fixedCurrentTime
+	keys, err := server.NewKeystoreFromDir("testdata", server.DefaultLoadKey)
+	require.NoError(err)
+	s.server.SetKeystore(keys)
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	require.NoError(err)
+	go s.server.Serve(l)
+	s.client.DefaultRemote = client.NewServer(l.Addr(), "localhost")
+
+	// Concurrent RSA signatures all complete, and don't hold up ECDSA ones.
+	var wg sync.WaitGroup
+	errs := make(chan error, 16)
+	for i := 0; i < 8; i++ {
+		wg.Add(2)
+		go func() {
+			defer wg.Done()
+			sig, err := s.rsaKey.Sign(rand.Reader, hashMsg(crypto.SHA256), crypto.SHA256)
+			if err == nil {
+				err = checkSignature(s.rsaKey.Public(), crypto.SHA256, sig)
+			}
+			errs <- err
+		}()
+		go func() {
+			defer wg.Done()
+			sig, err := s.ecdsaKey.Sign(rand.Reader, hashMsg(crypto.SHA256), crypto.SHA256)
+			if err == nil {
+				err = checkSignature(s.ecdsaKey.Public(), crypto.SHA256, sig)
+			}
+			errs <- err
+		}()
+	}
+	wg.Wait()
+	close(errs)
+	for err := range errs {
+		require.NoError(err)
+	}
+}
+
+func (s *IntegrationTestSuite) TestPriority() {
+	require := require.New(s.T())
+
+	priorities := make(chan protocol.Priority, 1)
+	s.server.Config().WithMiddleware(func(next server.Handler) server.Handler {
+		return server.HandlerFunc(func(ctx context.Context, op *protocol.Operation) protocol.Operation {
+			if op.Opcode == protocol.OpECDSASignSHA256 {
+				priorities <- op.Priority
+			}
+			return next.Handle(ctx, op)
+		})
+	})
+
+	_, err := s.ecdsaKey.Sign(rand.Reader, hashMsg(crypto.SHA256), crypto.SHA256)
+	require.NoError(err)
+	require.Equal(protocol.PriorityNormal, <-priorities)
+
+	ctx := conn.WithPriority(context.Background(), protocol.PriorityHigh)
+	_, err = s.ecdsaKey.SignContext(ctx, rand.Reader, hashMsg(crypto.SHA256), crypto.SHA256)
+	require.NoError(err)
+	require.Equal(protocol.PriorityHigh, <-priorities)
+}
+
+func (s *IntegrationTestSuite) TestBudget() {
+	require := require.New(s.T())
+
+	var calls uint32
+	budgets := make(chan time.Duration, 4)
+	release := make(chan struct{})
+	cfg := server.DefaultServeConfig().
+		WithWorkerPool(server.WorkerPoolConfig{Name: "slow", Workers: 1, Queue: 4}).
+		WithOpcodePool(protocol.OpCustom, "slow").
+		WithCustomOpFunction(func(ctx context.Context, op protocol.Operation) ([]byte, error) {
+			atomic.AddUint32(&calls, 1)
+			budgets <- op.Budget
+			<-release
+			return nil, nil
+		})
+
+	// Replace the server with one whose custom ops queue behind each other.
+	require.NoError(shutdownServer(s.server, 2*time.Second))
+	var err error
+	s.server, err = server.NewServerFromFile(cfg, serverCert, serverKey, keylessCA)
+	require.NoError(err)
+	s.server.TLSConfig().Time = fixedCurrentTime
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	require.NoError(err)
+	go s.server.Serve(l)
+
+	conn, err := client.NewServer(l.Addr(), "localhost").Dial(s.client)
+	require.NoError(err)
+	defer conn.Close()
+
+	// The client sends how long it will wait by default.
+	first := make(chan error, 1)
+	go func() {
+		resp, err := conn.DoOperation(context.Background(), protocol.Operation{Opcode: protocol.OpCustom})
+		if err == nil && resp.Opcode != protocol.OpResponse {
+			err = resp.GetError()
+		}
+		first <- err
+	}()
+	require.True((<-budgets) > 0)
+
+	// A request which queues behind it for longer than its budget is shed
+	// instead of executed.
+	second := make(chan error, 1)
+	go func() {
+		resp, err := conn.DoOperation(context.Background(), protocol.Operation{Opcode: protocol.OpCustom, Budget: 50 * time.Millisecond})
+		if err == nil {
+			err = resp.GetError()
+		}
+		second <- err
+	}()
+	time.Sleep(200 * time.Millisecond)
+	close(release)
+	require.NoError(<-first)
+	require.Equal(protocol.ErrTimedOut, <-second)
+	require.Equal(uint32(1), atomic.LoadUint32(&calls))
+}
+
+func (s *IntegrationTestSuite) TestOCSPSign() {
+	require := require.New(s.T())
+
+	caKey, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	require.NoError(err)
+	caTemplate := &x509.Certificate{
+		SerialNumber:          big.NewInt(1),
+		Subject:               pkix.Name{CommonName: "OCSP test CA"},
+		NotBefore:             time.Now().Add(-time.Hour),
+		NotAfter:              time.Now().Add(time.Hour),
+		IsCA:                  true,
+		BasicConstraintsValid: true,
+		KeyUsage:              x509.KeyUsageCertSign,
+	}
+	der, err := x509.CreateCertificate(rand.Reader, caTemplate, caTemplate, caKey.Public(), caKey)
+	require.NoError(err)
+	issuer, err := x509.ParseCertificate(der)
+	require.NoError(err)
+
+	for _, key := range []*client.PrivateKey{s.ecdsaKey, &s.rsaKey.PrivateKey} {
+		der, err := x509.CreateCertificate(rand.Reader, &x509.Certificate{
+			SerialNumber: big.NewInt(2),
+			Subject:      pkix.Name{CommonName: "OCSP responder"},
+			NotBefore:    time.Now().Add(-time.Hour),
+			NotAfter:     time.Now().Add(time.Hour),
+			ExtKeyUsage:  []x509.ExtKeyUsage{x509.ExtKeyUsageOCSPSigning},
+		}, issuer, key.Public(), caKey)
+		require.NoError(err)
+		responder, err := x509.ParseCertificate(der)
+		require.NoError(err)
+
+		resp, err := key.CreateOCSPResponse(issuer, responder, ocsp.Response{
+			Status:       ocsp.Revoked,
+			SerialNumber: big.NewInt(42),
+			ThisUpdate:   time.Now().Truncate(time.Hour),
+			NextUpdate:   time.Now().Truncate(time.Hour).Add(24 * time.Hour),
+			RevokedAt:    time.Now().Truncate(time.Hour),
+			Certificate:  responder,
+		})
+		require.NoError(err)
+		parsed, err := ocsp.ParseResponse(resp, issuer)
+		require.NoError(err)
+		require.Equal(ocsp.Revoked, parsed.Status)
+		require.Equal(big.NewInt(42), parsed.SerialNumber)
+	}
+
+	// Anything but an OCSP response is refused.
+	remote := client.NewServer(&net.TCPAddr{IP: net.IPv4(127, 0, 0, 1), Port: s.serverPort}, "localhost")
+	conn, err := remote.Dial(s.client)
+	require.NoError(err)
+	defer conn.Close()
+	ski, err := protocol.GetSKI(s.ecdsaKey.Public())
+	require.NoError(err)
+	result, err := conn.Conn.DoOperation(context.Background(), protocol.Operation{
+		Opcode:  protocol.OpOCSPSign,
+		Payload: hashMsg(crypto.SHA256),
+		SKI:     ski,
+	})
+	require.NoError(err)
+	require.Equal(protocol.ErrFormat, result.GetError())
+}
+
+func (s *IntegrationTestSuite) TestKeyUsage() {
+	require := require.New(s.T())
+
+	rsaSKI, err := protocol.GetSKI(s.rsaKey.Public())
+	require.NoError(err)
+	s.server.Config().WithKeyUsage(server.PerSKIKeyUsage(map[protocol.SKI]*server.KeyUsage{
+		rsaSKI: {Sign: true, Hashes: []crypto.Hash{crypto.SHA256}},
+	}))
+
+	_, err = s.rsaKey.Sign(rand.Reader, hashMsg(crypto.SHA256), crypto.SHA256)
+	require.NoError(err)
+	_, err = s.rsaKey.Sign(rand.Reader, hashMsg(crypto.SHA384), crypto.SHA384)
+	require.True(errors.Is(err, protocol.ErrKeyUsage))
+	var operr *client.OperationError
+	require.True(errors.As(err, &operr))
+	require.Equal(protocol.OpRSASignSHA384, operr.Op)
+	require.False(operr.Temporary())
+	c, err := rsa.EncryptPKCS1v15(rand.Reader, s.rsaKey.Public().(*rsa.PublicKey), []byte("secret"))
+	require.NoError(err)
+	_, err = s.rsaKey.Decrypt(rand.Reader, c, &rsa.PKCS1v15DecryptOptions{})
+	require.True(errors.Is(err, protocol.ErrKeyUsage))
+
+	// Keys can also be restricted in the keystore.
+	keys := server.NewDefaultKeystore()
+	require.NoError(keys.AddFromDir("testdata", server.DefaultLoadKey))
+	ecdsaSKI, err := protocol.GetSKI(s.ecdsaKey.Public())
+	require.NoError(err)
+	keys.SetKeyUsage(ecdsaSKI, &server.KeyUsage{OCSP: true})
+	s.server.SetKeystore(keys)
+	_, err = s.ecdsaKey.Sign(rand.Reader, hashMsg(crypto.SHA256), crypto.SHA256)
+	require.True(errors.Is(err, protocol.ErrKeyUsage))
+
+	keys.SetKeyUsage(ecdsaSKI, nil)
+	_, err = s.ecdsaKey.Sign(rand.Reader, hashMsg(crypto.SHA256), crypto.SHA256)
+	require.NoError(err)
+}
+
+func (s *IntegrationTestSuite) TestListeners() {
+	require := require.New(s.T())
+
+	ski, err := protocol.GetSKI(s.ecdsaKey.Public())
+	require.NoError(err)
+	sign := protocol.Operation{Opcode: protocol.OpECDSASignSHA256, Payload: hashMsg(crypto.SHA256), SKI: ski}
+
+	// A plaintext Unix listener serves clients without TLS.
+	dir, err := ioutil.TempDir("", "gokeyless")
+	require.NoError(err)
+	defer os.RemoveAll(dir)
+	l, err := net.Listen("unix", filepath.Join(dir, "plaintext.sock"))
+	require.NoError(err)
+	go s.server.ServeWithTLS(l, nil)
+	inner, err := net.Dial("unix", l.Addr().String())
+	require.NoError(err)
+	cn := conn.NewConn(inner)
+	defer cn.Close()
+	go func() {
+		for cn.DoRead() == nil {
+		}
+	}()
+	result, err := cn.DoOperation(context.Background(), sign)
+	require.NoError(err)
+	require.Equal(protocol.OpResponse, result.Opcode)
+
+	// Each TLS listener verifies clients with its own CAs.
+	serveTLS := func(clientCAs *x509.CertPool) error {
+		config := s.server.TLSConfig().Clone()
+		config.ClientCAs = clientCAs
+		l, err := net.Listen("tcp", "127.0.0.1:0")
+		require.NoError(err)
+		go s.server.ServeWithTLS(l, config)
+		cn, err := client.NewServer(l.Addr(), "localhost").Dial(s.client)
+		if err != nil {
+			return err
+		}
+		defer cn.Close()
+		return cn.Ping(context.Background(), nil)
+	}
+	require.NoError(serveTLS(s.server.TLSConfig().ClientCAs))
+	require.Error(serveTLS(x509.NewCertPool()))
+}
+
+func (s *IntegrationTestSuite) TestClientCAMap() {
+	require := require.New(s.T())
+
+	// Partner clients are verified against a CA which didn't issue the test
+	// client's certificate.
+	config := s.server.TLSConfig().Clone()
+	server.ClientCAMap{
+		"partner.example.com":    x509.NewCertPool(),
+		"*.internal.example.com": config.ClientCAs,
+	}.ConfigureServer(config)
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	require.NoError(err)
+	go s.server.ServeWithTLS(l, config)
+
+	// handshake connects with serverName over TLS 1.2, in which client
+	// certificates are verified during the handshake.
+	handshake := func(serverName string) error {
+		conn, err := tls.Dial("tcp", l.Addr().String(), &tls.Config{
+			Certificates:       s.client.Config.Certificates,
+			ServerName:         serverName,
+			InsecureSkipVerify: true,
+			MaxVersion:         tls.VersionTLS12,
+		})
+		if err != nil {
+			return err
+		}
+		return conn.Close()
+	}
+	require.NoError(handshake("localhost"))
+	require.NoError(handshake(""))
+	require.NoError(handshake("a.internal.example.com"))
+	require.Error(handshake("partner.example.com"))
+	require.Error(handshake("PARTNER.example.com."))
+}
+
+func (s *IntegrationTestSuite) TestTokenAuth() {
+	require := require.New(s.T())
+
+	s.server.Config().WithTokenVerifier(server.NewStaticTokenVerifier(map[string]string{"secret": "terminator"}))
+	config := s.server.TLSConfig().Clone()
+	config.ClientAuth = tls.VerifyClientCertIfGiven
+	// sign signs with a client which has no certificate, over a new
+	// listener so that no pooled connection is reused.
+	sign := func(token string) error {
+		l, err := net.Listen("tcp", "127.0.0.1:0")
+		require.NoError(err)
+		go s.server.ServeWithTLS(l, config)
+		c := client.NewClient(tls.Certificate{}, s.client.Config.RootCAs)
+		c.Config.Time = fixedCurrentTime
+		if token != "" {
+			c.Token = func(context.Context) (string, error) { return token, nil }
+		}
+		c.DefaultRemote = client.NewServer(l.Addr(), "localhost")
+		key, err := c.NewRemoteSignerByPublicKey(context.Background(), "", s.ecdsaKey.Public())
+		require.NoError(err)
+		_, err = key.Sign(rand.Reader, hashMsg(crypto.SHA256), crypto.SHA256)
+		return err
+	}
+	require.NoError(sign("secret"))
+	require.True(errors.Is(sign(""), protocol.ErrUnauthorized))
+	require.True(errors.Is(sign("wrong"), protocol.ErrUnauthorized))
+
+	// JWTs are verified with the keys of an OpenID Connect provider.
+	signingKey, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	require.NoError(err)
+	var idp *httptest.Server
+	idp = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch r.URL.Path {
+		case "/.well-known/openid-configuration":
+			json.NewEncoder(w).Encode(map[string]string{"issuer": idp.URL, "jwks_uri": idp.URL + "/jwks"})
+		case "/jwks":
+			json.NewEncoder(w).Encode(jose.JSONWebKeySet{Keys: []jose.JSONWebKey{
+				{Key: signingKey.Public(), KeyID: "k1", Algorithm: "ES256", Use: "sig"},
+			}})
+		default:
+			http.NotFound(w, r)
+		}
+	}))
+	defer idp.Close()
+	signer, err := jose.NewSigner(jose.SigningKey{Algorithm: jose.ES256, Key: jose.JSONWebKey{Key: signingKey, KeyID: "k1"}}, nil)
+	require.NoError(err)
+	issue := func(audience string, expiry time.Time) string {
+		token, err := jwt.Signed(signer).Claims(jwt.Claims{
+			Issuer:   idp.URL,
+			Subject:  "spiffe://example.org/terminator",
+			Audience: jwt.Audience{audience},
+			Expiry:   jwt.NewNumericDate(expiry),
+		}).CompactSerialize()
+		require.NoError(err)
+		return token
+	}
+
+	ctx := context.Background()
+	verifier, err := server.NewOIDCTokenVerifier(ctx, idp.URL, "keyless")
+	require.NoError(err)
+	expiry := time.Now().Add(time.Hour).Truncate(time.Second)
+	id, exp, err := verifier.VerifyToken(ctx, issue("keyless", expiry))
+	require.NoError(err)
+	require.Equal("spiffe://example.org/terminator", id.SPIFFEID)
+	require.True(expiry.Equal(exp))
+	_, _, err = verifier.VerifyToken(ctx, issue("other", expiry))
+	require.Error(err)
+	_, _, err = verifier.VerifyToken(ctx, issue("keyless", time.Now().Add(-time.Hour)))
+	require.Error(err)
+}
+
+func (s *IntegrationTestSuite) TestZeroizeKeys() {
 	require := require.New(s.T())
 
-	if testing.Short() {
-		s.T().SkipNow()
-	}
 	if testSoftHSM {
-		// TODO(cjpatton) Decide if it's worth adding an Ed25519 test for
-		// SoftHSM. If so, then move this test to `TestSign()` above.
-		s.T().Skip("skipping test")
+		s.T().Skip("skipping test; keys in SoftHSM2 are not zeroized")
 	}
 
-	b, err := s.ed25519Key.Sign(rand.Reader, testEd25519Msg, crypto.Hash(0))
+	keys := server.NewDefaultKeystore()
+	keys.SetZeroize(true)
+	require.NoError(keys.AddFromFile(ecdsaPrivKey, server.DefaultLoadKey))
+	require.NoError(keys.AddFromFile(rsaPrivKey, server.DefaultLoadKey))
+	s.server.SetKeystore(keys)
+
+	ecdsaSKI, err := protocol.GetSKI(s.ecdsaKey.Public())
 	require.NoError(err)
-	require.NoError(checkSignature(s.ed25519Key.Public(), crypto.Hash(0), b))
+	priv, err := keys.Get(context.Background(), &protocol.Operation{SKI: ecdsaSKI})
+	require.NoError(err)
+	key, ok := priv.(*server.CryptoKey)
+	require.True(ok, "got a %T key", priv)
+	for _, format := range []string{"%v", "%+v", "%#v", "%s"} {
+		require.Equal("CryptoKey("+ecdsaSKI.String()+")", fmt.Sprintf(format, key))
+	}
+	_, err = json.Marshal(struct{ Key crypto.Signer }{key})
+	require.Error(err)
+
+	// The wrapped keys still take the fast paths, including textbook RSA.
+	_, err = s.ecdsaKey.Sign(rand.Reader, hashMsg(crypto.SHA256), crypto.SHA256)
+	require.NoError(err)
+	c, err := rsa.EncryptPKCS1v15(rand.Reader, s.rsaKey.Public().(*rsa.PublicKey), ptxt)
+	require.NoError(err)
+	m, err := s.rsaKey.Decrypt(rand.Reader, c, &rsa.PKCS1v15DecryptOptions{})
+	require.NoError(err)
+	require.Equal(ptxt, m)
+
+	// Removed keys are destroyed.
+	keys.Remove(ecdsaSKI)
+	_, err = key.Sign(rand.Reader, hashMsg(crypto.SHA256), crypto.SHA256)
+	require.Equal(server.ErrKeyDestroyed, err)
+	require.NotNil(key.Public())
+
+	keys.DestroyKeys()
+	_, err = s.rsaKey.Sign(rand.Reader, hashMsg(crypto.SHA256), crypto.SHA256)
+	require.Error(err)
 }
 
-func (s *IntegrationTestSuite) TestRSADecrypt() {
+func (s *IntegrationTestSuite) TestKeyRotation() {
 	require := require.New(s.T())
 
-	if testing.Short() {
-		s.T().SkipNow()
+	keys := server.NewDefaultKeystore()
+	require.NoError(keys.AddFromFile(ecdsaPrivKey, server.DefaultLoadKey))
+	s.server.SetKeystore(keys)
+	admin, adminClient := s.newAdmin()
+	defer admin.Close()
+
+	priv, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	require.NoError(err)
+	der, err := x509.MarshalECPrivateKey(priv)
+	require.NoError(err)
+	dir, err := ioutil.TempDir("", "gokeyless")
+	require.NoError(err)
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "new.key")
+	require.NoError(ioutil.WriteFile(path, pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: der}), 0600))
+	newKey, err := s.client.NewRemoteSignerByPublicKey(context.Background(), "", priv.Public())
+	require.NoError(err)
+
+	oldSKI, err := protocol.GetSKI(s.ecdsaKey.Public())
+	require.NoError(err)
+	newSKI, err := protocol.GetSKI(priv.Public())
+	require.NoError(err)
+	do := func(method, path string, body interface{}, status int) server.KeyRotation {
+		b, err := json.Marshal(body)
+		require.NoError(err)
+		req, err := http.NewRequest(method, admin.URL+path, bytes.NewReader(b))
+		require.NoError(err)
+		resp, err := adminClient.Do(req)
+		require.NoError(err)
+		defer resp.Body.Close()
+		require.Equal(status, resp.StatusCode)
+		var rotation server.KeyRotation
+		if status == http.StatusOK {
+			require.NoError(json.NewDecoder(resp.Body).Decode(&rotation))
+		}
+		return rotation
 	}
-	if testSoftHSM {
-		s.T().Skip("skipping test; SoftHSM2 does not support PKCS1v15")
+	sign := func(key crypto.Signer) error {
+		_, err := key.Sign(rand.Reader, hashMsg(crypto.SHA256), crypto.SHA256)
+		return err
 	}
 
-	pub, ok := s.rsaKey.Public().(*rsa.PublicKey)
-	require.True(ok, "couldn't use public key as RSA key")
+	// A staged key isn't served yet.
+	rotation := do(http.MethodPost, "/admin/rotations", server.StageKeyRequest{OldSKI: oldSKI.String(), File: path}, http.StatusOK)
+	require.Equal(server.RotationStaged, rotation.State)
+	require.Equal(newSKI.String(), rotation.NewSKI)
+	require.NoError(sign(s.ecdsaKey))
+	require.True(errors.Is(sign(newKey), protocol.ErrKeyNotFound))
+	do(http.MethodPost, "/admin/rotations", server.StageKeyRequest{OldSKI: oldSKI.String(), File: path}, http.StatusConflict)
+
+	// An aborted rotation can be staged again.
+	do(http.MethodDelete, "/admin/rotations/"+oldSKI.String(), nil, http.StatusNoContent)
+	do(http.MethodGet, "/admin/rotations/"+oldSKI.String(), nil, http.StatusNotFound)
+	do(http.MethodPost, "/admin/rotations", server.StageKeyRequest{OldSKI: oldSKI.String(), File: path}, http.StatusOK)
+
+	// Both keys are served during the grace period, and only the new one
+	// after it.
+	rotation = do(http.MethodPost, "/admin/rotations/"+oldSKI.String()+"/switch?grace=500ms", nil, http.StatusOK)
+	require.Equal(server.RotationSwitched, rotation.State)
+	require.NoError(sign(s.ecdsaKey))
+	require.NoError(sign(newKey))
+	do(http.MethodDelete, "/admin/rotations/"+oldSKI.String(), nil, http.StatusConflict)
+
+	require.Eventually(func() bool {
+		return do(http.MethodGet, "/admin/rotations/"+oldSKI.String(), nil, http.StatusOK).State == server.RotationComplete
+	}, 5*time.Second, 50*time.Millisecond)
+	require.True(errors.Is(sign(s.ecdsaKey), protocol.ErrKeyNotFound))
+	require.NoError(sign(newKey))
+}
 
-	c, err := rsa.EncryptPKCS1v15(rand.Reader, pub, ptxt)
-	require.NoError(err)
+func (s *IntegrationTestSuite) TestAEADSealer() {
+	require := require.New(s.T())
+	ctx := context.Background()
 
-	m, err := s.rsaKey.Decrypt(rand.Reader, c, &rsa.PKCS1v15DecryptOptions{})
+	key1, key2 := make([]byte, 32), make([]byte, 32)
+	_, err := rand.Read(key1)
 	require.NoError(err)
-	require.Equal(0, bytes.Compare(ptxt, m), fmt.Sprintf("rsa decrypt failed m: %dB\tptxt: %dB", len(m), len(ptxt)))
+	_, err = rand.Read(key2)
+	require.NoError(err)
+	sealer, err := server.NewAEADSealer(map[uint32][]byte{1: key1})
+	require.NoError(err)
+	s.server.SetSealer(sealer)
 
-	m, err = s.rsaKey.Decrypt(rand.Reader, c, &rsa.PKCS1v15DecryptOptions{SessionKeyLen: len(ptxt)})
+	blob := []byte("bootstrap secret")
+	sealed, err := s.client.Seal(ctx, "", blob)
 	require.NoError(err)
-	require.Equal(0, bytes.Compare(ptxt, m), fmt.Sprintf("rsa decrypt failed m: %dB\tptxt: %dB", len(m), len(ptxt)))
+	require.False(bytes.Contains(sealed, blob))
+	unsealed, err := s.client.Unseal(ctx, "", sealed)
+	require.NoError(err)
+	require.Equal(blob, unsealed)
+
+	// Tampered blobs don't unseal.
+	tampered := append([]byte(nil), sealed...)
+	tampered[len(tampered)-1] ^= 1
+	_, err = s.client.Unseal(ctx, "", tampered)
+	require.True(errors.Is(err, protocol.ErrCrypto))
+	_, err = s.client.Unseal(ctx, "", []byte("garbage"))
+	require.True(errors.Is(err, protocol.ErrFormat))
+
+	// After a rotation, new blobs are sealed with the new key and old blobs
+	// still unseal until the old key is removed.
+	require.NoError(sealer.SetKeys(map[uint32][]byte{1: key1, 2: key2}))
+	sealed2, err := s.client.Seal(ctx, "", blob)
+	require.NoError(err)
+	require.Equal([]byte{1, 0, 0, 0, 2}, sealed2[:5])
+	unsealed, err = s.client.Unseal(ctx, "", sealed)
+	require.NoError(err)
+	require.Equal(blob, unsealed)
 
-	m, err = s.rsaKey.Decrypt(rand.Reader, c, &rsa.PKCS1v15DecryptOptions{SessionKeyLen: len(ptxt) + 1})
+	require.NoError(sealer.SetKeys(map[uint32][]byte{2: key2}))
+	_, err = s.client.Unseal(ctx, "", sealed)
+	require.True(errors.Is(err, protocol.ErrExpired))
+	unsealed, err = s.client.Unseal(ctx, "", sealed2)
 	require.NoError(err)
-	require.NotEqual(0, bytes.Compare(ptxt, m), fmt.Sprintf("rsa decrypt succeeded despite incorrect SessionKeyLen m: %dB\tptxt: %dB", len(m), len(ptxt)))
+	require.Equal(blob, unsealed)
+
+	require.Error(sealer.SetKeys(map[uint32][]byte{3: key2[:16]}))
 }
 
-func (s *IntegrationTestSuite) TestSeal() {
+func (s *IntegrationTestSuite) TestCompression() {
 	require := require.New(s.T())
 
 	conn, err := s.remote.Dial(s.client)
 	require.NoError(err)
 	defer conn.Close()
+	features, err := conn.Hello(context.Background(), protocol.Features{
+		Version:     protocol.Version,
+		MaxPayload:  protocol.V1Features.MaxPayload,
+		Compression: []protocol.Compression{0x7F, protocol.CompressionDeflate},
+		Padding:     protocol.PaddingOptional,
+	})
+	require.NoError(err)
+	require.Equal([]protocol.Compression{protocol.CompressionDeflate}, features.Compression)
 
-	r := make([]byte, 20)
-	_, err = rand.Read(r)
+	// Large payloads are compressed in both directions.
+	payload := bytes.Repeat([]byte("certificate chain "), 1000)
+	result, err := conn.DoOperation(context.Background(), protocol.Operation{Opcode: protocol.OpSeal, Payload: payload})
+	require.NoError(err)
+	require.Equal(protocol.OpResponse, result.Opcode)
+	require.Equal(append([]byte("OpSeal "), payload...), result.Payload)
+	require.NoError(conn.Ping(context.Background(), []byte("small")))
+}
+
+// newAdmin serves the admin handler of s.server, which requires the bearer
+// token "secret", and returns it with a client which sends the token.
+func (s *IntegrationTestSuite) newAdmin() (*httptest.Server, *http.Client) {
+	s.server.Config().WithAdminTokenVerifier(server.NewStaticTokenVerifier(map[string]string{"secret": "operator"}))
+	return httptest.NewServer(s.server.AdminHandler()), &http.Client{Transport: bearerTransport("secret")}
+}
+
+// bearerTransport is an http.RoundTripper which authenticates requests with
+// its bearer token.
+type bearerTransport string
+
+func (t bearerTransport) RoundTrip(r *http.Request) (*http.Response, error) {
+	r = r.Clone(r.Context())
+	r.Header.Set("Authorization", "Bearer "+string(t))
+	return http.DefaultTransport.RoundTrip(r)
+}
+
+func (s *IntegrationTestSuite) TestAdminAPI() {
+	require := require.New(s.T())
+
+	// Without an admin token verifier, every request is refused.
+	unverified := httptest.NewServer(s.server.AdminHandler())
+	resp, err := http.Get(unverified.URL + "/admin/keys")
+	require.NoError(err)
+	resp.Body.Close()
+	unverified.Close()
+	require.Equal(http.StatusUnauthorized, resp.StatusCode)
+	require.Error(s.server.AdminListenAndServe("localhost:0"))
+
+	ecdsaSKI, err := protocol.GetSKI(s.ecdsaKey.Public())
+	require.NoError(err)
+	rsaSKI, err := protocol.GetSKI(s.rsaKey.Public())
+	require.NoError(err)
+	keys := server.NewDefaultKeystore()
+	require.NoError(keys.AddFromFile(ecdsaPrivKey, server.DefaultLoadKey))
+	keys.SetKeyUsage(ecdsaSKI, &server.KeyUsage{Sign: true})
+	s.server.SetKeystore(keys)
+	s.server.Config().WithAdminTokenVerifier(server.NewStaticTokenVerifier(map[string]string{"secret": "operator"}))
+	admin := httptest.NewServer(s.server.AdminHandler())
+	defer admin.Close()
+	defer func(level int) { log.Level = level }(log.Level)
+
+	do := func(method, path, token string, body, out interface{}, status int) {
+		b, err := json.Marshal(body)
+		require.NoError(err)
+		req, err := http.NewRequest(method, admin.URL+path, bytes.NewReader(b))
+		require.NoError(err)
+		if token != "" {
+			req.Header.Set("Authorization", "Bearer "+token)
+		}
+		resp, err := http.DefaultClient.Do(req)
+		require.NoError(err)
+		defer resp.Body.Close()
+		require.Equal(status, resp.StatusCode)
+		if out != nil {
+			require.NoError(json.NewDecoder(resp.Body).Decode(out))
+		}
+	}
+	sign := func(key crypto.Signer) error {
+		_, err := key.Sign(rand.Reader, hashMsg(crypto.SHA256), crypto.SHA256)
+		return err
+	}
+
+	do(http.MethodGet, "/admin/keys", "", nil, nil, http.StatusUnauthorized)
+	do(http.MethodGet, "/admin/keys", "wrong", nil, nil, http.StatusUnauthorized)
+
+	var infos []server.KeyInfo
+	do(http.MethodGet, "/admin/keys", "secret", nil, &infos, http.StatusOK)
+	require.Equal([]server.KeyInfo{{
+		SKI:   ecdsaSKI.String(),
+		Type:  "ECDSA",
+		Bits:  256,
+		Usage: []string{"sign"},
+	}}, infos)
+
+	// Loaded keys are served, and evicted ones no longer are.
+	var info server.KeyInfo
+	do(http.MethodPost, "/admin/keys", "secret", server.LoadKeyRequest{File: rsaPrivKey}, &info, http.StatusOK)
+	require.Equal(rsaSKI.String(), info.SKI)
+	require.Equal("RSA", info.Type)
+	require.NoError(sign(s.rsaKey))
+	do(http.MethodPost, "/admin/keys", "secret", server.LoadKeyRequest{}, nil, http.StatusBadRequest)
+	do(http.MethodDelete, "/admin/keys/"+info.SKI, "secret", nil, nil, http.StatusNoContent)
+	require.True(errors.Is(sign(s.rsaKey), protocol.ErrKeyNotFound))
+	do(http.MethodGet, "/admin/keys", "secret", nil, &infos, http.StatusOK)
+	require.Len(infos, 1)
+
+	// Keys can be pushed wrapped for the server's certificate instead.
+	cert, err := x509.ParseCertificate(s.server.TLSConfig().Certificates[0].Certificate[0])
+	require.NoError(err)
+	in, err := ioutil.ReadFile(rsaPrivKey)
+	require.NoError(err)
+	wrapped, err := protocol.WrapKey(cert.PublicKey, in)
+	require.NoError(err)
+	do(http.MethodPost, "/admin/keys", "secret", server.LoadKeyRequest{Wrapped: wrapped}, &info, http.StatusOK)
+	require.Equal(rsaSKI.String(), info.SKI)
+	require.NoError(sign(s.rsaKey))
+	wrapped[len(wrapped)-1] ^= 1
+	do(http.MethodPost, "/admin/keys", "secret", server.LoadKeyRequest{Wrapped: wrapped}, nil, http.StatusBadRequest)
+	do(http.MethodPost, "/admin/keys", "secret", server.LoadKeyRequest{File: rsaPrivKey, Wrapped: wrapped}, nil, http.StatusBadRequest)
+
+	var conns []server.ConnInfo
+	do(http.MethodGet, "/admin/connections", "secret", nil, &conns, http.StatusOK)
+	require.NotEmpty(conns)
+
+	var level server.LogLevel
+	do(http.MethodPut, "/admin/loglevel", "secret", server.LogLevel{Level: log.LevelError}, &level, http.StatusOK)
+	require.Equal(log.LevelError, level.Level)
+	do(http.MethodGet, "/admin/loglevel", "secret", nil, &level, http.StatusOK)
+	require.Equal(log.LevelError, level.Level)
+	do(http.MethodPut, "/admin/loglevel", "secret", server.LogLevel{Level: 9}, nil, http.StatusBadRequest)
+}
+
+func (s *IntegrationTestSuite) TestCurves() {
+	require := require.New(s.T())
+	keys := server.NewDefaultKeystore()
+	require.NoError(keys.AddFromFile("testdata/p384-key.pem", server.DefaultLoadKey))
+	require.NoError(keys.AddFromFile("testdata/p521-key.pem", server.DefaultLoadKey))
+	// Go has no brainpool curves, so such keys are refused when loaded.
+	require.Error(keys.AddFromFile("testdata/brainpool-key.pem", server.DefaultLoadKey))
+	s.server.SetKeystore(keys)
+
+	for _, name := range []string{"p384", "p521"} {
+		cert, err := s.client.LoadTLSCertificate("", "testdata/"+name+".pem")
+		require.NoError(err, name)
+		key := cert.PrivateKey.(crypto.Signer)
+		for _, h := range []crypto.Hash{crypto.SHA1, crypto.SHA256, crypto.SHA384, crypto.SHA512} {
+			sig, err := key.Sign(rand.Reader, hashMsg(h), h)
+			require.NoError(err, "%s-%s", name, h)
+			require.NoError(checkSignature(cert.Leaf.PublicKey, h, sig), "%s-%s", name, h)
+		}
+
+		roots := x509.NewCertPool()
+		roots.AddCert(cert.Leaf)
+		for _, version := range []uint16{tls.VersionTLS12, tls.VersionTLS13} {
+			sconn, cconn := net.Pipe()
+			done := make(chan error, 1)
+			go func() {
+				defer sconn.Close()
+				done <- tls.Server(sconn, &tls.Config{Certificates: []tls.Certificate{cert}}).Handshake()
+			}()
+			err = tls.Client(cconn, &tls.Config{
+				RootCAs:    roots,
+				ServerName: name + ".example.com",
+				MinVersion: version,
+				MaxVersion: version,
+			}).Handshake()
+			cconn.Close()
+			require.NoError(err, "%s over TLS %x", name, version)
+			require.NoError(<-done, "%s over TLS %x", name, version)
+		}
+	}
+}
+
+func (s *IntegrationTestSuite) TestGetClientCertificate() {
+	require := require.New(s.T())
+	keys := server.NewDefaultKeystore()
+	require.NoError(keys.AddFromFile("testdata/p384-key.pem", server.DefaultLoadKey))
+	require.NoError(keys.AddFromFile("testdata/p521-key.pem", server.DefaultLoadKey))
+	s.server.SetKeystore(keys)
+
+	// Both ends of the handshake keep their keys on the keyserver.
+	clientCert, err := s.client.LoadTLSCertificate("", "testdata/p384.pem")
 	require.NoError(err)
+	serverCert, err := s.client.LoadTLSCertificate("", "testdata/p521.pem")
+	require.NoError(err)
+	getClientCertificate, err := client.NewGetClientCertificate(s.client, "", clientCert)
+	require.NoError(err)
+
+	clientCAs := x509.NewCertPool()
+	clientCAs.AddCert(clientCert.Leaf)
+	roots := x509.NewCertPool()
+	roots.AddCert(serverCert.Leaf)
+	for _, version := range []uint16{tls.VersionTLS12, tls.VersionTLS13} {
+		sconn, cconn := net.Pipe()
+		done := make(chan error, 1)
+		go func() {
+			defer sconn.Close()
+			conn := tls.Server(sconn, &tls.Config{
+				Certificates: []tls.Certificate{serverCert},
+				ClientAuth:   tls.RequireAndVerifyClientCert,
+				ClientCAs:    clientCAs,
+			})
+			err := conn.Handshake()
+			if err == nil && !conn.ConnectionState().PeerCertificates[0].Equal(clientCert.Leaf) {
+				err = errors.New("wrong client certificate")
+			}
+			done <- err
+		}()
+		err = tls.Client(cconn, &tls.Config{
+			RootCAs:              roots,
+			ServerName:           "p521.example.com",
+			GetClientCertificate: getClientCertificate,
+			MinVersion:           version,
+			MaxVersion:           version,
+		}).Handshake()
+		require.NoError(<-done, "TLS %x", version)
+		cconn.Close()
+		require.NoError(err, "TLS %x", version)
+	}
+}
+
+func (s *IntegrationTestSuite) TestSM2() {
+	require := require.New(s.T())
+	keys := server.NewDefaultKeystore()
+	require.NoError(keys.AddFromFile("testdata/sm2-key.pem", server.DefaultLoadKey))
+	require.NoError(keys.AddFromFile("testdata/ecdsa.key", server.DefaultLoadKey))
+	s.server.SetKeystore(keys)
+
+	certPEM, err := ioutil.ReadFile("testdata/sm2.pem")
+	require.NoError(err)
+	key, err := s.client.NewRemoteSignerByCertPEM(context.Background(), "", certPEM)
+	require.NoError(err)
+	pub, ok := key.Public().(*sm2.PublicKey)
+	require.True(ok)
+
+	msg := []byte("gokeyless SM2 signing")
+	digest, err := sm2.Digest(pub, nil, msg)
+	require.NoError(err)
+	sig, err := key.Sign(rand.Reader, digest, sm2.SignerOpts{})
+	require.NoError(err)
+	require.True(sm2.VerifyASN1(pub, digest, sig))
 
+	// SM2 keys only sign SM3 digests, and other keys refuse OpSM2SignSM3.
+	_, err = key.Sign(rand.Reader, hashMsg(crypto.SHA256), crypto.SHA256)
+	require.Error(err)
+	_, err = key.Sign(rand.Reader, msg, sm2.SignerOpts{})
+	require.Error(err)
+	ski, err := protocol.GetSKI(s.ecdsaKey.Public())
+	require.NoError(err)
+	conn, err := s.remote.Dial(s.client)
+	require.NoError(err)
+	defer conn.Close()
 	resp, err := conn.DoOperation(context.Background(), protocol.Operation{
-		Opcode:  protocol.OpSeal,
-		Payload: r,
+		Opcode:  protocol.OpSM2SignSM3,
+		SKI:     ski,
+		Payload: digest,
 	})
 	require.NoError(err)
-	require.NotEqual(protocol.OpError, resp.Opcode, resp.GetError())
-	require.True(bytes.Equal([]byte("OpSeal "), resp.Payload[:len("OpSeal ")]), "payload type mismatch")
-	require.True(bytes.Equal(r, resp.Payload[len("OpSeal "):]), "payload value mismatch")
+	require.Equal(protocol.ErrCrypto, resp.GetError())
+}
 
-	resp, err = conn.DoOperation(context.Background(), protocol.Operation{
-		Opcode:  protocol.OpUnseal,
-		Payload: r,
-	})
+func (s *IntegrationTestSuite) TestKeepalive() {
+	require := require.New(s.T())
+
+	unixTimeout := s.server.Config().UnixTimeout()
+	s.server.Config().WithKeepalive(20*time.Millisecond, 50*time.Millisecond).WithUnixTimeout(100 * time.Millisecond)
+	defer func() { s.server.Config().WithKeepalive(0, 0).WithUnixTimeout(unixTimeout) }()
+
+	dir, err := ioutil.TempDir("", "gokeyless")
 	require.NoError(err)
-	require.NotEqual(protocol.OpError, resp.Opcode, resp.GetError())
-	require.True(bytes.Equal([]byte("OpUnseal "), resp.Payload[:len("OpUnseal ")]), "payload type mismatch")
-	require.True(bytes.Equal(r, resp.Payload[len("OpUnseal "):]), "payload value mismatch")
+	defer os.RemoveAll(dir)
+	l, err := net.Listen("unix", filepath.Join(dir, "keepalive.sock"))
+	require.NoError(err)
+	defer l.Close()
+	go s.server.ServeWithTLS(l, nil)
+	hello := protocol.Features{Version: protocol.Version, MaxPayload: protocol.V1Features.MaxPayload}
+	// dial returns a connection which has been idle for longer than the
+	// Unix timeout.
+	dial := func(keepalive bool) *conn.Conn {
+		inner, err := net.Dial("unix", l.Addr().String())
+		require.NoError(err)
+		cn := conn.NewConn(inner)
+		go func() {
+			for cn.DoRead() == nil {
+			}
+		}()
+		hello.Keepalive = keepalive
+		features, err := cn.Hello(context.Background(), hello)
+		require.NoError(err)
+		require.Equal(keepalive, features.Keepalive)
+		time.Sleep(300 * time.Millisecond)
+		return cn
+	}
+
+	// Clients which answer pings aren't closed for being idle; others are.
+	cn := dial(true)
+	defer cn.Close()
+	require.NoError(cn.Ping(context.Background(), nil))
+	cn = dial(false)
+	defer cn.Close()
+	require.Error(cn.Ping(context.Background(), nil))
+
+	// Clients which don't answer are closed after the keepalive timeout.
+	inner, err := net.Dial("unix", l.Addr().String())
+	require.NoError(err)
+	defer inner.Close()
+	require.NoError(inner.SetReadDeadline(time.Now().Add(5 * time.Second)))
+	hello.Keepalive = true
+	payload, err := hello.MarshalBinary()
+	require.NoError(err)
+	pkt := protocol.NewPacket(1, protocol.Operation{Opcode: protocol.OpHello, Payload: payload})
+	_, err = pkt.WriteTo(inner)
+	require.NoError(err)
+	_, err = pkt.ReadFrom(inner)
+	require.NoError(err)
+	require.Equal(protocol.OpResponse, pkt.Opcode)
+	start := time.Now()
+	_, err = pkt.ReadFrom(inner)
+	require.NoError(err)
+	require.Equal(protocol.OpPing, pkt.Opcode)
+	_, err = pkt.ReadFrom(inner)
+	require.Equal(io.EOF, err)
+	require.True(time.Since(start) < time.Second)
+}
+
+func (s *IntegrationTestSuite) TestReplayDetection() {
+	require := require.New(s.T())
+
+	s.server.Config().WithReplayDetection(time.Minute)
+	defer s.server.Config().WithReplayDetection(0)
+
+	dir, err := ioutil.TempDir("", "gokeyless")
+	require.NoError(err)
+	defer os.RemoveAll(dir)
+	l, err := net.Listen("unix", filepath.Join(dir, "replay.sock"))
+	require.NoError(err)
+	defer l.Close()
+	go s.server.ServeWithTLS(l, nil)
+
+	inner, err := net.Dial("unix", l.Addr().String())
+	require.NoError(err)
+	defer inner.Close()
+	require.NoError(inner.SetDeadline(time.Now().Add(5 * time.Second)))
+	ski, err := protocol.GetSKI(s.ecdsaKey.Public())
+	require.NoError(err)
+	op := protocol.Operation{Opcode: protocol.OpECDSASignSHA256, SKI: ski, Payload: hashMsg(crypto.SHA256)}
+	send := func(id uint32) protocol.Operation {
+		pkt := protocol.NewPacket(id, op)
+		_, err := pkt.WriteTo(inner)
+		require.NoError(err)
+		_, err = pkt.ReadFrom(inner)
+		require.NoError(err)
+		require.Equal(id, pkt.ID)
+		return pkt.Operation
+	}
+
+	require.Equal(protocol.OpResponse, send(7).Opcode)
+	resp := send(7)
+	require.Equal(protocol.OpError, resp.Opcode)
+	require.Equal([]byte{byte(protocol.ErrReplayed)}, resp.Payload)
+	// The same operation with another packet ID is a new request.
+	require.Equal(protocol.OpResponse, send(8).Opcode)
+
+	// Identical operations in a batch share its packet ID, but aren't replays
+	// of each other, unlike those of a replayed batch.
+	batch, err := protocol.MarshalBatch([]protocol.Operation{op, op})
+	require.NoError(err)
+	op = protocol.Operation{Opcode: protocol.OpBatch, Payload: batch}
+	for _, code := range []protocol.Op{protocol.OpResponse, protocol.OpError} {
+		resp := send(9)
+		require.Equal(protocol.OpResponse, resp.Opcode)
+		results, err := protocol.UnmarshalBatch(resp.Payload)
+		require.NoError(err)
+		require.Len(results, 2)
+		for _, res := range results {
+			require.Equal(code, res.Opcode)
+		}
+	}
+}
+
+func (s *IntegrationTestSuite) TestPadding() {
+	require := require.New(s.T())
+
+	s.server.Config().WithMinResponseLength(2048).WithStrictPadding(true)
+	defer func() {
+		s.server.Config().WithMinResponseLength(0).WithStrictPadding(false)
+	}()
+
+	dir, err := ioutil.TempDir("", "gokeyless")
+	require.NoError(err)
+	defer os.RemoveAll(dir)
+	l, err := net.Listen("unix", filepath.Join(dir, "padding.sock"))
+	require.NoError(err)
+	defer l.Close()
+	go s.server.ServeWithTLS(l, nil)
+
+	inner, err := net.Dial("unix", l.Addr().String())
+	require.NoError(err)
+	defer inner.Close()
+	require.NoError(inner.SetDeadline(time.Now().Add(5 * time.Second)))
+	send := func(wire []byte) protocol.Packet {
+		_, err := inner.Write(wire)
+		require.NoError(err)
+		var pkt protocol.Packet
+		_, err = pkt.ReadFrom(inner)
+		require.NoError(err)
+		require.NoError(pkt.CheckPadding(true))
+		return pkt
+	}
+	marshal := func(op protocol.Operation) []byte {
+		pkt := protocol.NewPacket(1, op)
+		wire, err := pkt.MarshalBinary()
+		require.NoError(err)
+		return wire
+	}
+
+	resp := send(marshal(protocol.Operation{Opcode: protocol.OpPing}))
+	require.Equal(protocol.OpPong, resp.Opcode)
+	require.Equal(2048, 8+int(resp.Length))
+
+	// Without optional padding, requests must be padded...
+	resp = send(marshal(protocol.Operation{Opcode: protocol.OpPing, NoPadding: true}))
+	require.Equal(protocol.OpError, resp.Opcode)
+	require.Equal([]byte{byte(protocol.ErrFormat)}, resp.Payload)
+	require.Equal(2048, 8+int(resp.Length))
+
+	// ...with zero bytes.
+	wire := marshal(protocol.Operation{Opcode: protocol.OpPing})
+	for i := 8 + 4 + 3; i < len(wire); i++ {
+		wire[i] = 0xff
+	}
+	resp = send(wire)
+	require.Equal(protocol.OpError, resp.Opcode)
+	require.Equal([]byte{byte(protocol.ErrFormat)}, resp.Payload)
+}
+
+func (s *IntegrationTestSuite) TestAuditLog() {
+	require := require.New(s.T())
+
+	dir, err := ioutil.TempDir("", "audit")
+	require.NoError(err)
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "audit.log")
+	key := []byte("audit key")
+
+	audit, err := server.NewFileAuditLogger(path, key, 0)
+	require.NoError(err)
+	s.server.SetAuditLogger(audit)
+
+	_, err = s.ecdsaKey.Sign(rand.Reader, hashMsg(crypto.SHA256), crypto.SHA256)
+	require.NoError(err)
+	require.NoError(audit.Rotate())
+	_, err = s.rsaKey.Sign(rand.Reader, hashMsg(crypto.SHA256), crypto.SHA256)
+	require.NoError(err)
+	// Operations not using a private key are not audited.
+	_, err = s.client.GetCapabilities(context.Background(), "")
+	require.NoError(err)
+	require.NoError(audit.Close())
+
+	rotated, err := filepath.Glob(path + ".*")
+	require.NoError(err)
+	require.Len(rotated, 1)
+
+	// The chain continues across the rotated file.
+	f, err := os.Open(rotated[0])
+	require.NoError(err)
+	defer f.Close()
+	mac, err := server.VerifyAuditLog(f, key, nil)
+	require.NoError(err)
+
+	current, err := ioutil.ReadFile(path)
+	require.NoError(err)
+	_, err = server.VerifyAuditLog(bytes.NewReader(current), key, mac)
+	require.NoError(err)
+	_, err = server.VerifyAuditLog(bytes.NewReader(current), key, nil)
+	require.Error(err)
+
+	var rec server.AuditRecord
+	require.NoError(json.Unmarshal(bytes.TrimSpace(current), &rec))
+	require.Equal(protocol.OpRSASignSHA256.String(), rec.Op)
+	require.Equal(protocol.ErrNone, rec.Result)
+	require.Contains(rec.Client, "sha256:")
+	digest := sha256.Sum256(hashMsg(crypto.SHA256))
+	require.Equal(hex.EncodeToString(digest[:]), rec.Digest)
+
+	tampered := bytes.Replace(current, []byte(rec.Digest), []byte(strings.Repeat("0", len(rec.Digest))), 1)
+	_, err = server.VerifyAuditLog(bytes.NewReader(tampered), key, mac)
+	require.Error(err)
 }
 
 func (s *IntegrationTestSuite) TestUndefinedCustomOp() {
@@ -374,3 +3620,244 @@ func (s *IntegrationTestSuite) TestShutdown() {
 
 	require.NoError(err)
 }
+
+func (s *IntegrationTestSuite) TestCertIndex() {
+	require := require.New(s.T())
+
+	loadCert := func(path string) *x509.Certificate {
+		in, err := ioutil.ReadFile(path)
+		require.NoError(err)
+		block, _ := pem.Decode(in)
+		cert, err := x509.ParseCertificate(block.Bytes)
+		require.NoError(err)
+		return cert
+	}
+	p384 := loadCert("testdata/p384.pem")
+	localhost := loadCert("testdata/server.pem")
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	require.NoError(err)
+	der, err := x509.CreateCertificate(rand.Reader, &x509.Certificate{
+		SerialNumber: big.NewInt(42),
+		DNSNames:     []string{"*.example.com"},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(24 * time.Hour),
+	}, &x509.Certificate{}, key.Public(), key)
+	require.NoError(err)
+	wildcard, err := x509.ParseCertificate(der)
+	require.NoError(err)
+	require.NoError(s.server.CertIndex().Add(p384, localhost, wildcard, p384))
+	require.Equal(3, s.server.CertIndex().Len())
+
+	query := func(q protocol.CertificateQuery) []*x509.Certificate {
+		l, err := s.client.GetCertificates(context.Background(), "", q)
+		require.NoError(err)
+		require.False(l.Truncated)
+		return l.Certificates
+	}
+	raw := func(certs ...*x509.Certificate) [][]byte {
+		var b [][]byte
+		for _, cert := range certs {
+			b = append(b, cert.Raw)
+		}
+		return b
+	}
+	// Certificates are listed soonest to expire first.
+	require.Equal(raw(wildcard, localhost, p384), raw(query(protocol.CertificateQuery{})...))
+	require.Equal(raw(wildcard, p384), raw(query(protocol.CertificateQuery{Name: "P384.example.com."})...))
+	require.Equal(raw(wildcard), raw(query(protocol.CertificateQuery{Name: "www.example.com"})...))
+	require.Empty(query(protocol.CertificateQuery{Name: "a.b.example.com"}))
+	require.Equal(raw(p384), raw(query(protocol.CertificateQuery{Serial: p384.SerialNumber})...))
+	ski, err := protocol.GetSKI(wildcard.PublicKey)
+	require.NoError(err)
+	require.Equal(raw(wildcard), raw(query(protocol.CertificateQuery{SKI: ski})...))
+	require.Empty(query(protocol.CertificateQuery{Name: "localhost", SKI: ski}))
+	require.Equal(raw(wildcard), raw(query(protocol.CertificateQuery{ExpiresBefore: time.Now().Add(48 * time.Hour)})...))
+
+	admin, adminClient := s.newAdmin()
+	defer admin.Close()
+	resp, err := adminClient.Get(admin.URL + "/admin/certificates?name=localhost")
+	require.NoError(err)
+	defer resp.Body.Close()
+	var infos []server.CertificateInfo
+	require.NoError(json.NewDecoder(resp.Body).Decode(&infos))
+	require.Len(infos, 1)
+	require.Equal([]string{"localhost"}, infos[0].Names)
+	require.Equal(hex.EncodeToString(localhost.SerialNumber.Bytes()), infos[0].Serial)
+	resp, err = adminClient.Get(admin.URL + "/admin/certificates?expires_before=48h&serial=2a")
+	require.NoError(err)
+	require.NoError(json.NewDecoder(resp.Body).Decode(&infos))
+	resp.Body.Close()
+	require.Len(infos, 1)
+	require.Equal([]string{"*.example.com"}, infos[0].Names)
+	resp, err = adminClient.Get(admin.URL + "/admin/certificates?ski=zz")
+	require.NoError(err)
+	resp.Body.Close()
+	require.Equal(http.StatusBadRequest, resp.StatusCode)
+}
+
+func (s *IntegrationTestSuite) TestKeyExpiry() {
+	require := require.New(s.T())
+
+	keys := server.NewDefaultKeystore()
+	var pubs []crypto.PublicKey
+	for _, path := range []string{"testdata/ecdsa.key", "testdata/rsa.key", "testdata/ed25519.key"} {
+		in, err := ioutil.ReadFile(path)
+		require.NoError(err)
+		priv, err := server.DefaultLoadKey(in)
+		require.NoError(err)
+		require.NoError(keys.Add(nil, priv))
+		pubs = append(pubs, priv.Public())
+	}
+	s.server.SetKeystore(keys)
+	ca, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	require.NoError(err)
+	issue := func(pub crypto.PublicKey, serial int64, notAfter time.Time) *x509.Certificate {
+		der, err := x509.CreateCertificate(rand.Reader, &x509.Certificate{
+			SerialNumber: big.NewInt(serial),
+			DNSNames:     []string{"example.com"},
+			NotBefore:    notAfter.Add(-90 * 24 * time.Hour),
+			NotAfter:     notAfter,
+		}, &x509.Certificate{}, pub, ca)
+		require.NoError(err)
+		cert, err := x509.ParseCertificate(der)
+		require.NoError(err)
+		return cert
+	}
+	ecdsaSKI, err := protocol.GetSKI(pubs[0])
+	require.NoError(err)
+	rsaSKI, err := protocol.GetSKI(pubs[1])
+	require.NoError(err)
+	// The Ed25519 key has no certificate, and is never flagged.
+	require.NoError(s.server.CertIndex().Add(
+		issue(pubs[0], 1, time.Now().Add(time.Hour)),
+		issue(pubs[1], 2, time.Now().Add(-time.Hour)),
+	))
+	flagged := func(expiries []server.KeyExpiry) map[protocol.SKI]server.KeyExpiry {
+		m := make(map[protocol.SKI]server.KeyExpiry)
+		for _, k := range expiries {
+			m[k.SKI] = k
+		}
+		return m
+	}
+
+	// Without a window or eviction, no key is flagged.
+	require.Empty(s.server.CheckKeyExpiry())
+
+	s.server.Config().WithKeyExpiry(24*time.Hour, false)
+	expiries := flagged(s.server.CheckKeyExpiry())
+	require.Len(expiries, 2)
+	require.False(expiries[ecdsaSKI].Expired)
+	require.True(expiries[rsaSKI].Expired)
+	require.False(expiries[rsaSKI].Evicted)
+	require.Len(keys.SKIs(), 3)
+
+	s.server.Config().WithKeyExpiry(24*time.Hour, true)
+	expiries = flagged(s.server.CheckKeyExpiry())
+	require.True(expiries[rsaSKI].Evicted)
+	require.False(expiries[ecdsaSKI].Evicted)
+	key, err := keys.Get(context.Background(), &protocol.Operation{SKI: rsaSKI})
+	require.NoError(err)
+	require.Nil(key)
+	require.Len(keys.SKIs(), 2)
+
+	// Once the key is reloaded with a renewed certificate, it is no longer
+	// flagged, since its latest certificate is valid.
+	in, err := ioutil.ReadFile("testdata/rsa.key")
+	require.NoError(err)
+	priv, err := server.DefaultLoadKey(in)
+	require.NoError(err)
+	require.NoError(keys.Add(nil, priv))
+	require.NoError(s.server.CertIndex().Add(issue(pubs[1], 3, time.Now().Add(90*24*time.Hour))))
+	expiries = flagged(s.server.CheckKeyExpiry())
+	require.Len(expiries, 1)
+	require.Contains(expiries, ecdsaSKI)
+	require.Len(keys.SKIs(), 3)
+}
+
+// recordingLogger is a log.SyslogWriter which records the messages it
+// receives.
+type recordingLogger struct {
+	mtx  sync.Mutex
+	msgs []string
+}
+
+func (r *recordingLogger) record(msg string) {
+	r.mtx.Lock()
+	defer r.mtx.Unlock()
+	r.msgs = append(r.msgs, msg)
+}
+
+func (r *recordingLogger) Debug(msg string)   { r.record(msg) }
+func (r *recordingLogger) Info(msg string)    { r.record(msg) }
+func (r *recordingLogger) Warning(msg string) { r.record(msg) }
+func (r *recordingLogger) Err(msg string)     { r.record(msg) }
+func (r *recordingLogger) Crit(msg string)    { r.record(msg) }
+func (r *recordingLogger) Emerg(msg string)   { r.record(msg) }
+
+func (s *IntegrationTestSuite) TestEmbeddedServer() {
+	require := require.New(s.T())
+
+	cert, err := tls.LoadX509KeyPair(serverCert, serverKey)
+	require.NoError(err)
+	pemCerts, err := ioutil.ReadFile(keylessCA)
+	require.NoError(err)
+	pool := x509.NewCertPool()
+	require.True(pool.AppendCertsFromPEM(pemCerts))
+	keys := server.NewDefaultKeystore()
+	require.NoError(keys.AddFromFile("testdata/ecdsa.key", server.DefaultLoadKey))
+	ski, err := protocol.GetSKI(s.ecdsaKey.Public())
+	require.NoError(err)
+
+	_, err = server.New(server.WithKeystore(nil))
+	require.Error(err)
+	_, err = server.New(server.WithLogger(&recordingLogger{}, 42))
+	require.Error(err)
+
+	// The server's logs and metrics only go to its own logger and sinks.
+	logger := &recordingLogger{}
+	rec := &recordingSink{counts: make(map[string]float64)}
+	global := &recordingSink{counts: make(map[string]float64)}
+	server.SetMetricsSinks(global)
+	defer server.SetMetricsSinks(server.PrometheusSink)
+	embedded, err := server.New(
+		server.WithConfig(server.DefaultServeConfig().WithTCPTimeout(time.Minute)),
+		server.WithCertificate(cert),
+		server.WithClientCAs(pool),
+		server.WithKeystore(keys),
+		server.WithLogger(logger, log.LevelDebug),
+		server.WithMetricsSinks(rec),
+	)
+	require.NoError(err)
+	embedded.TLSConfig().Time = fixedCurrentTime
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	require.NoError(err)
+	errs := make(chan error, 1)
+	go func() { errs <- embedded.Serve(l) }()
+
+	cn, err := client.NewServer(l.Addr(), "localhost").Dial(s.client)
+	require.NoError(err)
+	defer cn.Close()
+	resp, err := cn.Conn.DoOperation(context.Background(), protocol.Operation{Opcode: protocol.OpProbeKey, SKI: ski})
+	require.NoError(err)
+	require.Equal(protocol.OpResponse, resp.Opcode)
+
+	probes := "keyless_requests" + fmt.Sprint(server.Labels{"opcode": "OpProbeKey"})
+	rec.mtx.Lock()
+	require.NotZero(rec.counts[probes])
+	rec.mtx.Unlock()
+	global.mtx.Lock()
+	require.Zero(global.counts[probes])
+	global.mtx.Unlock()
+	logger.mtx.Lock()
+	require.NotEmpty(logger.msgs)
+	logger.mtx.Unlock()
+
+	// Serve returns nil once the server is closed.
+	require.NoError(embedded.Close())
+	select {
+	case err := <-errs:
+		require.NoError(err)
+	case <-time.After(5 * time.Second):
+		require.Fail("Serve didn't return after Close")
+	}
+}
@@ -0,0 +1,265 @@
+package conformance
+
+import (
+	"bytes"
+	"context"
+	"crypto"
+	"crypto/ed25519"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/pem"
+	"errors"
+	"flag"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"os"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+
+	"github.com/cloudflare/cfssl/helpers/derhelpers"
+	"github.com/cloudflare/cfssl/log"
+	"github.com/cloudflare/gokeyless/client"
+	"github.com/cloudflare/gokeyless/protocol"
+	"github.com/cloudflare/gokeyless/server"
+	"github.com/cloudflare/gokeyless/tests"
+)
+
+const testdata = "../testdata"
+
+var (
+	keyserver          string
+	serverName         string
+	certFile           string
+	keyFile            string
+	caFile             string
+	pubkeys            string
+	insecureSkipVerify bool
+)
+
+func init() {
+	flag.IntVar(&log.Level, "loglevel", log.LevelFatal, "Log level (0 = DEBUG, 5 = FATAL)")
+	flag.StringVar(&keyserver, "keyserver", "", "Keyless server to test, in the form [host:port], instead of a local one")
+	flag.StringVar(&serverName, "server-name", "", "Name the keyserver's certificate is verified against, its host by default")
+	flag.StringVar(&certFile, "cert", testdata+"/client.pem", "Keyless server authentication certificate")
+	flag.StringVar(&keyFile, "key", testdata+"/client-key.pem", "Keyless server authentication key")
+	flag.StringVar(&caFile, "ca-file", testdata+"/ca.pem", "Keyless server certificate authority")
+	flag.StringVar(&pubkeys, "pubkeys", testdata+"/rsa.pubkey,"+testdata+"/ecdsa.pubkey,"+testdata+"/ed25519.pubkey",
+		"Comma-separated PEM files of the public keys held by the keyserver")
+	flag.BoolVar(&insecureSkipVerify, "no-verify", false, "Don't verify server certificate against Keyserver CA")
+}
+
+func TestMain(m *testing.M) {
+	flag.Parse()
+	if keyserver != "" {
+		os.Exit(m.Run())
+	}
+	s, err := startLocalServer()
+	if err != nil {
+		fmt.Fprintln(os.Stderr, "failed to start local keyserver:", err)
+		os.Exit(1)
+	}
+	code := m.Run()
+	s.Close()
+	os.Exit(code)
+}
+
+// startLocalServer serves the keys in testdata on a loopback address, which
+// the tests run against when no keyserver is given.
+func startLocalServer() (*server.Server, error) {
+	s, err := server.NewServerFromFile(nil, testdata+"/server.pem", testdata+"/server-key.pem", testdata+"/ca.pem")
+	if err != nil {
+		return nil, err
+	}
+	keys, err := server.NewKeystoreFromDir(testdata, server.DefaultLoadKey)
+	if err != nil {
+		return nil, err
+	}
+	s.SetKeystore(keys)
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		return nil, err
+	}
+	go s.Serve(l)
+	keyserver, serverName = l.Addr().String(), "localhost"
+	return s, nil
+}
+
+// newClient returns a client whose DefaultRemote is the keyserver.
+func newClient(t *testing.T) *client.Client {
+	c, err := client.NewClientFromFile(certFile, keyFile, caFile)
+	require.NoError(t, err)
+	c.Config.InsecureSkipVerify = insecureSkipVerify
+	host, port, err := net.SplitHostPort(keyserver)
+	require.NoError(t, err)
+	name := serverName
+	if name == "" {
+		name = host
+	}
+	c.DefaultRemote, err = c.LookupServerWithName(name, host, port)
+	require.NoError(t, err)
+	return c
+}
+
+func dial(t *testing.T, c *client.Client) *client.Conn {
+	conn, err := c.DefaultRemote.Dial(c)
+	require.NoError(t, err)
+	t.Cleanup(func() { conn.Close() })
+	return conn
+}
+
+// signers returns a remote signer for each of the public keys.
+func signers(t *testing.T, c *client.Client) []crypto.Signer {
+	var signers []crypto.Signer
+	for _, file := range strings.Split(pubkeys, ",") {
+		in, err := ioutil.ReadFile(file)
+		require.NoError(t, err)
+		p, _ := pem.Decode(in)
+		require.NotNil(t, p, "%s: no PEM data", file)
+		pub, err := x509.ParsePKIXPublicKey(p.Bytes)
+		if err != nil {
+			pub, err = derhelpers.ParseEd25519PublicKey(p.Bytes)
+			require.NoError(t, err, file)
+		}
+		signer, err := c.NewRemoteSignerByPublicKey(context.Background(), "", pub)
+		require.NoError(t, err, file)
+		signers = append(signers, signer)
+	}
+	return signers
+}
+
+func TestPing(t *testing.T) {
+	conn := dial(t, newClient(t))
+	for _, payload := range [][]byte{nil, []byte("Hello!"), bytes.Repeat([]byte{0xA5}, 1024)} {
+		require.NoError(t, conn.Ping(context.Background(), payload), "%dB payload", len(payload))
+	}
+}
+
+func TestSign(t *testing.T) {
+	for _, signer := range signers(t, newClient(t)) {
+		ski, err := protocol.GetSKI(signer.Public())
+		require.NoError(t, err)
+		pub, ok := signer.Public().(ed25519.PublicKey)
+		if !ok {
+			for name, test := range tests.NewSignTests(signer) {
+				test := test
+				t.Run(ski.String()+"."+name, func(t *testing.T) { require.NoError(t, test()) })
+			}
+			continue
+		}
+		t.Run(ski.String()+".sign.ed25519", func(t *testing.T) {
+			msg := []byte("Test Plaintext")
+			sig, err := signer.Sign(rand.Reader, msg, crypto.Hash(0))
+			require.NoError(t, err)
+			require.True(t, ed25519.Verify(pub, msg, sig), "invalid signature")
+		})
+	}
+}
+
+func TestRSADecrypt(t *testing.T) {
+	tested := false
+	for _, signer := range signers(t, newClient(t)) {
+		if _, ok := signer.Public().(*rsa.PublicKey); !ok {
+			continue
+		}
+		require.NoError(t, tests.NewDecryptTest(signer.(crypto.Decrypter))())
+		tested = true
+	}
+	if !tested {
+		t.Skip("no RSA key")
+	}
+}
+
+func TestErrors(t *testing.T) {
+	c := newClient(t)
+	var rsaSKI protocol.SKI
+	for _, signer := range signers(t, c) {
+		if _, ok := signer.Public().(*rsa.PublicKey); ok {
+			rsaSKI, _ = protocol.GetSKI(signer.Public())
+			break
+		}
+	}
+	// Decryption is raw RSA, so only ciphertexts larger than the modulus fail.
+	badCiphertext := bytes.Repeat([]byte{0xFF}, 1024)
+	var unknownSKI protocol.SKI
+	copy(unknownSKI[:], bytes.Repeat([]byte{0x42}, len(unknownSKI)))
+
+	conn := dial(t, c)
+	for _, tc := range []struct {
+		name string
+		op   protocol.Operation
+		want protocol.Error
+	}{
+		{"bad opcode", protocol.Operation{Opcode: protocol.Op(0x7F)}, protocol.ErrBadOpcode},
+		{"response opcode", protocol.Operation{Opcode: protocol.OpResponse}, protocol.ErrUnexpectedOpcode},
+		{"error opcode", protocol.Operation{Opcode: protocol.OpError}, protocol.ErrUnexpectedOpcode},
+		{"unknown key", protocol.Operation{Opcode: protocol.OpRSASignSHA256, SKI: unknownSKI, Payload: make([]byte, 32)}, protocol.ErrKeyNotFound},
+		{"bad ciphertext", protocol.Operation{Opcode: protocol.OpRSADecrypt, SKI: rsaSKI, Payload: badCiphertext}, protocol.ErrCrypto},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			if tc.op.Opcode == protocol.OpRSADecrypt && !rsaSKI.Valid() {
+				t.Skip("no RSA key")
+			}
+			resp, err := conn.DoOperation(context.Background(), tc.op)
+			require.NoError(t, err)
+			require.Equal(t, protocol.OpError, resp.Opcode)
+			require.Equal(t, tc.want, resp.GetError())
+		})
+	}
+}
+
+// TestVersionMismatch checks that a request of an unknown major version is
+// rejected, either with an error or by closing the connection.
+func TestVersionMismatch(t *testing.T) {
+	c := newClient(t)
+	config := c.Config.Clone()
+	host, _, err := net.SplitHostPort(keyserver)
+	require.NoError(t, err)
+	config.ServerName = serverName
+	if config.ServerName == "" {
+		config.ServerName = host
+	}
+	conn, err := tls.Dial("tcp", keyserver, config)
+	require.NoError(t, err)
+	defer conn.Close()
+
+	pkt := protocol.NewPacket(1, protocol.Operation{Opcode: protocol.OpPing})
+	pkt.MajorVers = 2
+	_, err = pkt.WriteTo(conn)
+	require.NoError(t, err)
+	require.NoError(t, conn.SetReadDeadline(time.Now().Add(10*time.Second)))
+	var resp protocol.Packet
+	if _, err := resp.ReadFrom(conn); err != nil {
+		var netErr net.Error
+		require.False(t, errors.As(err, &netErr) && netErr.Timeout(), "no response to a request of major version 2")
+		return
+	}
+	require.Equal(t, protocol.OpError, resp.Opcode)
+	require.Equal(t, protocol.ErrVersionMismatch, resp.GetError())
+}
+
+// TestConcurrentRequests checks that the responses to requests outstanding at
+// once on a connection are matched to their requests.
+func TestConcurrentRequests(t *testing.T) {
+	conn := dial(t, newClient(t))
+	var wg sync.WaitGroup
+	errs := make(chan error, 64)
+	for i := 0; i < cap(errs); i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			errs <- conn.Ping(context.Background(), []byte(fmt.Sprintf("request %d", i)))
+		}(i)
+	}
+	wg.Wait()
+	close(errs)
+	for err := range errs {
+		require.NoError(t, err)
+	}
+}
@@ -0,0 +1,14 @@
+// Package conformance checks that a keyserver speaks the keyless protocol the
+// way the origin implementation's test client expects: pings, signatures and
+// decryptions with each of its keys, and the error codes of malformed or
+// unexpected requests. It only contains tests, which run against any server
+// given with the -keyserver flag:
+//
+//	go test ./tests/conformance -args -keyserver keyserver.example.com:2407 \
+//		-cert client.pem -key client-key.pem -ca-file ca.pem \
+//		-pubkeys rsa.pubkey,ecdsa.pubkey
+//
+// The public keys must be those of keys held by the server. Without
+// -keyserver, the tests run against a gokeyless server serving the keys in
+// tests/testdata.
+package conformance
@@ -2,3 +2,16 @@ cfssl gencert -initca ca_csr.json |cfssljson -bare ca
 cfssl gencert -ca ca.pem -ca-key ca-key.pem -config signing.json -profile client csr.json |cfssljson -bare client
 cfssl gencert -ca ca.pem -ca-key ca-key.pem -config signing.json -profile server csr.json |cfssljson -bare server
 rm *.csr
+
+# Self-signed ECDSA certificates on other curves, generated with OpenSSL for
+# interop tests. Go can't load the brainpool key.
+for c in p384:secp384r1:sha384 p521:secp521r1:sha512 brainpool:brainpoolP256r1:sha256; do
+	IFS=: read name curve hash <<< "$c"
+	openssl ecparam -name $curve -genkey -noout -out $name-key.pem
+	openssl req -x509 -new -key $name-key.pem -subj /CN=$name.example.com -addext subjectAltName=DNS:$name.example.com -days 36500 -$hash -out $name.pem
+done
+
+# Self-signed SM2 certificate, signed with SM3 and the default user ID, for the
+# SM2 interop tests.
+openssl genpkey -algorithm SM2 -out sm2-key.pem
+openssl req -x509 -new -key sm2-key.pem -subj /CN=sm2.example.com -days 36500 -sm3 -sigopt distid:1234567812345678 -out sm2.pem